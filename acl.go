@@ -0,0 +1,92 @@
+package authdelegate
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// accessControl restricts access to an operational listener (e.g. admin) to
+// clients from allowed networks that present the expected bearer token. An
+// empty network list or token is not enforced.
+type accessControl struct {
+	networks []*net.IPNet
+	token    []byte
+	handler  http.Handler
+}
+
+func (acl *accessControl) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if !acl.allowsAddress(req.RemoteAddr) {
+		log.Printf("access denied from %s to %s", req.RemoteAddr,
+			req.URL.Path)
+		http.Error(rw, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !acl.allowsToken(req.Header.Get("Authorization")) {
+		log.Printf("invalid bearer token from %s to %s",
+			req.RemoteAddr, req.URL.Path)
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	acl.handler.ServeHTTP(rw, req)
+}
+
+func (acl *accessControl) allowsAddress(remoteAddr string) bool {
+	if len(acl.networks) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range acl.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *accessControl) allowsToken(authorization string) bool {
+	if len(acl.token) == 0 {
+		return true
+	}
+	const prefix = "Bearer "
+	if len(authorization) < len(prefix) ||
+		!strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return false
+	}
+	token := []byte(strings.TrimSpace(authorization[len(prefix):]))
+	return subtle.ConstantTimeCompare(token, acl.token) == 1
+}
+
+// newAdminServer creates the server for the admin listener, enforcing the
+// access controls defined by the admin_* options, and applying the overrides
+// of profile to the configurations posted to it.
+func newAdminServer(opts *AuthDelegateOptions, delegate http.Handler,
+	profile string) *http.Server {
+	server := &http.Server{
+		Addr: opts.AdminAddress,
+		Handler: &accessControl{
+			networks: opts.adminNetworks,
+			token:    opts.adminBearerToken,
+			handler:  newAdminHandler(delegate, profile),
+		},
+	}
+	if opts.AdminSslCert != "" {
+		server.TLSConfig = hardenTLS(&tls.Config{}, opts)
+	}
+	if opts.adminClientCAs != nil {
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLSConfig.ClientCAs = opts.adminClientCAs
+	}
+	return server
+}
@@ -0,0 +1,109 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("Admin listener access control", func() {
+	var dir string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "authdelegate-acl-test")
+		opts = &AuthDelegateOptions{
+			Port:         8080,
+			AdminAddress: "127.0.0.1:8081",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://foo.com/"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	adminStatus := func(remoteAddr, authorization string) int {
+		Expect(opts.Validate()).To(BeNil())
+		server := newAdminServer(opts, NewAuthDelegate(opts), "")
+		req, _ := http.NewRequest("GET", "/upstreams", nil)
+		req.RemoteAddr = remoteAddr
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should allow all requests by default", func() {
+		Expect(adminStatus("192.168.0.1:1234", "")).To(
+			Equal(http.StatusOK))
+	})
+
+	It("should only allow requests from allowed networks", func() {
+		opts.AdminAllowedNetworks = []string{"10.0.0.0/8", "127.0.0.1"}
+		Expect(adminStatus("10.1.2.3:1234", "")).To(Equal(http.StatusOK))
+		Expect(adminStatus("127.0.0.1:1234", "")).To(Equal(http.StatusOK))
+		Expect(adminStatus("127.0.0.2:1234", "")).To(
+			Equal(http.StatusForbidden))
+	})
+
+	It("should only allow requests with the bearer token", func() {
+		opts.AdminBearerTokenFile = filepath.Join(dir, "token")
+		ioutil.WriteFile(opts.AdminBearerTokenFile, []byte("s3cr3t\n"),
+			0600)
+		Expect(adminStatus("127.0.0.1:1234", "Bearer s3cr3t")).To(
+			Equal(http.StatusOK))
+		Expect(adminStatus("127.0.0.1:1234", "Bearer bogus")).To(
+			Equal(http.StatusUnauthorized))
+		Expect(adminStatus("127.0.0.1:1234", "")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should require client certificates if a CA is given", func() {
+		cert := writeTestCertificate(dir, "admin", time.Hour)
+		opts.AdminSslCert = cert.CertFile
+		opts.AdminSslKey = cert.KeyFile
+		opts.AdminClientCA = cert.CertFile
+		Expect(opts.Validate()).To(BeNil())
+		server := newAdminServer(opts, NewAuthDelegate(opts), "")
+		Expect(server.TLSConfig.ClientAuth).To(
+			Equal(tls.RequireAndVerifyClientCert))
+		Expect(server.TLSConfig.ClientCAs).ToNot(BeNil())
+	})
+
+	It("should fail validation for invalid admin options", func() {
+		opts.AdminClientCA = filepath.Join(dir, "bogus.crt")
+		opts.AdminBearerTokenFile = filepath.Join(dir, "bogus")
+		opts.AdminAllowedNetworks = []string{"10.0.0.0/33"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"admin-client-ca requires admin-ssl-cert and " +
+				"admin-ssl-key",
+			"admin-bearer-token-file could not be read: open " +
+				opts.AdminBearerTokenFile +
+				": no such file or directory",
+			"invalid admin_allowed_networks entry: 10.0.0.0/33",
+		})))
+	})
+
+	It("should fail validation if admin_address is missing", func() {
+		opts.AdminAddress = ""
+		opts.AdminAllowedNetworks = []string{"127.0.0.1"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"admin options specified without admin_address",
+		})))
+	})
+})
@@ -0,0 +1,71 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeRenewBefore is how long before its certificate expires that a new one
+// is obtained.
+const acmeRenewBefore = 30 * 24 * time.Hour
+
+// acmeCertificate serves a certificate for the domains of the acme
+// configuration, obtained by autocert from an ACME certificate authority on
+// the first handshake that needs it and renewed before it expires, and the
+// certificates with which the authority validates tls-alpn-01 challenges.
+// Certificates and the account key are kept in the cache directory, so that
+// restarts needn't obtain new ones.
+type acmeCertificate struct {
+	manager *autocert.Manager
+
+	// Holds the *tls.Certificate last served, for daysToExpiry
+	current atomic.Value
+}
+
+func newACMECertificate(config *AuthDelegateAcme) *acmeCertificate {
+	manager := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(config.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(config.Domains...),
+		RenewBefore: acmeRenewBefore,
+		Email:       config.Email,
+	}
+	if config.DirectoryURL != "" {
+		manager.Client = &acme.Client{DirectoryURL: config.DirectoryURL}
+	}
+	return &acmeCertificate{manager: manager}
+}
+
+// tlsConfig returns the TLS configuration that serves the certificate and
+// answers tls-alpn-01 challenges.
+func (certificate *acmeCertificate) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: certificate.getCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+}
+
+func (certificate *acmeCertificate) getCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	served, err := certificate.manager.GetCertificate(hello)
+	if err == nil && served.Leaf != nil &&
+		!(len(hello.SupportedProtos) == 1 &&
+			hello.SupportedProtos[0] == acme.ALPNProto) {
+		certificate.current.Store(served)
+	}
+	return served, err
+}
+
+// daysToExpiry returns the number of days until the certificate last served
+// expires, or zero if none has been served.
+func (certificate *acmeCertificate) daysToExpiry() float64 {
+	served, _ := certificate.current.Load().(*tls.Certificate)
+	if served == nil {
+		return 0
+	}
+	return time.Until(served.Leaf.NotAfter).Hours() / 24
+}
@@ -0,0 +1,101 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var _ = Describe("ACME certificates", func() {
+	var dir string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "acme")
+		Expect(err).To(BeNil())
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Acme: &AuthDelegateAcme{
+				Domains:              []string{"auth.example.test"},
+				CacheDir:             dir,
+				DirectoryURL:         "https://127.0.0.1:1/directory",
+				Email:                "ops@example.test",
+				AcceptTermsOfService: true,
+			},
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should serve a cached certificate", func() {
+		// autocert caches a certificate and its key in a file named
+		// after its domain, the key first.
+		cached := issueTestCertificate(dir, "cached", 90*24*time.Hour,
+			nil, func(template *x509.Certificate) {
+				template.DNSNames = opts.Acme.Domains
+			})
+		key, err := ioutil.ReadFile(cached.KeyFile)
+		Expect(err).To(BeNil())
+		chain, err := ioutil.ReadFile(cached.CertFile)
+		Expect(err).To(BeNil())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "auth.example.test"),
+			append(key, chain...), 0600)).To(Succeed())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		go server.ServeTLS(listener, "", "")
+		defer server.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(cached.Cert)
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{RootCAs: roots, ServerName: "auth.example.test"})
+		Expect(err).To(BeNil())
+		conn.Close()
+		Expect(delegate.(*authDelegateHandler).certificate.
+			daysToExpiry()).To(BeNumerically("~", 90, 0.01))
+
+		// Other names are refused without contacting the authority.
+		_, err = tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{RootCAs: roots, ServerName: "other.example.test"})
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should fail validation for an invalid configuration", func() {
+		opts.SslCert = "cert.pem"
+		opts.Acme = &AuthDelegateAcme{
+			Domains:      []string{"*.example.test", "192.0.2.1"},
+			DirectoryURL: "http://acme.example.test/directory",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(strings.Join([]string{
+			"acme can't be combined with ssl_cert and ssl_key",
+			"acme domains entry must be a host name: *.example.test",
+			"acme domains entry must be a host name: 192.0.2.1",
+			"acme requires cache_dir",
+			"acme directory_url must be an https URL: " +
+				"http://acme.example.test/directory",
+			"acme requires accept_terms_of_service: true, agreeing to " +
+				"the certificate authority's terms of service",
+		}, "\n  ")))
+	})
+})
@@ -0,0 +1,360 @@
+package authdelegate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxAdminConfig is the largest configuration accepted in the body of a
+// request to the admin API.
+const maxAdminConfig = 4 << 20
+
+// NewAdminHandler creates a http.Handler exposing administrative operations
+// on delegate, which must have been created by NewAuthDelegate. It should be
+// served on a separate, non-public listener.
+func NewAdminHandler(delegate http.Handler) http.Handler {
+	return newAdminHandler(delegate, "")
+}
+
+// newAdminHandler creates the handler returned by NewAdminHandler, applying
+// the overrides of profile to the configurations posted to it.
+func newAdminHandler(delegate http.Handler, profile string) http.Handler {
+	handler := delegate.(*authDelegateHandler)
+	admin := &adminHandler{handler, newConfigScheduler(handler), profile}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", admin.serveVersion)
+	mux.HandleFunc("/runtime/gc", serveGCInfo)
+	mux.HandleFunc("/debug/verbose", admin.verboseLogging)
+	mux.HandleFunc("/debug/cpu_profile", admin.cpuProfile)
+	mux.HandleFunc("/debug/error_samples", admin.errorSamples)
+	mux.HandleFunc("/upstreams", admin.listUpstreams)
+	mux.HandleFunc("/upstreams/latency", admin.upstreamLatency)
+	mux.HandleFunc("/upstreams/drain", admin.drainUpstream)
+	mux.HandleFunc("/upstreams/undrain", admin.undrainUpstream)
+	mux.HandleFunc("/rejections", admin.listRejections)
+	mux.HandleFunc("/metrics", admin.delegate.serveMetrics)
+	mux.HandleFunc("/credentials/revoked", admin.listRevoked)
+	mux.HandleFunc("/credentials/revoke", admin.revokeCredential)
+	mux.HandleFunc("/credentials/reinstate", admin.reinstateCredential)
+	mux.HandleFunc("/config/schedule", admin.scheduleConfig)
+	mux.HandleFunc("/config/confirm", admin.confirmConfig)
+	mux.HandleFunc("/config/candidate", admin.candidateConfig)
+	return mux
+}
+
+type adminHandler struct {
+	delegate  *authDelegateHandler
+	scheduler *configScheduler
+	profile   string
+}
+
+type upstreamStatus struct {
+	Name     string `json:"name"`
+	Draining bool   `json:"draining"`
+	InFlight int64  `json:"in_flight"`
+
+	// Number of requests of each traffic class routed to the upstream
+	Traffic trafficCounts `json:"traffic"`
+
+	// Present only if the upstream enables adaptive concurrency
+	Concurrency *limiterStatus `json:"concurrency,omitempty"`
+}
+
+type upstreamLatency struct {
+	Name string `json:"name"`
+	latencySummary
+}
+
+func writeJSON(rw http.ResponseWriter, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		log.Printf("admin: error writing response: %s", err)
+	}
+}
+
+func (admin *adminHandler) listUpstreams(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := []upstreamStatus{}
+	for _, upstream := range admin.delegate.routes().upstreams {
+		statuses = append(statuses, upstreamStatus{
+			Name:        upstream.name,
+			Draining:    upstream.isDraining(),
+			InFlight:    atomic.LoadInt64(&upstream.inFlight),
+			Traffic:     upstream.trafficCounts(),
+			Concurrency: upstream.limiter.status(),
+		})
+	}
+	writeJSON(rw, statuses)
+}
+
+// upstreamLatency reports each upstream's latency percentiles since it was
+// configured.
+func (admin *adminHandler) upstreamLatency(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	latencies := []upstreamLatency{}
+	for _, upstream := range admin.delegate.routes().upstreams {
+		latencies = append(latencies, upstreamLatency{
+			upstream.name, upstream.latency.totalSummary(),
+		})
+	}
+	writeJSON(rw, latencies)
+}
+
+// listRejections reports the number of requests rejected by each rule.
+func (admin *adminHandler) listRejections(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, admin.delegate.rejections.load())
+}
+
+func (admin *adminHandler) drainUpstream(
+	rw http.ResponseWriter, req *http.Request) {
+	admin.setDraining(rw, req, true)
+}
+
+func (admin *adminHandler) undrainUpstream(
+	rw http.ResponseWriter, req *http.Request) {
+	admin.setDraining(rw, req, false)
+}
+
+func (admin *adminHandler) setDraining(
+	rw http.ResponseWriter, req *http.Request, draining bool) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	upstream := admin.delegate.routes().findUpstream(name)
+	if upstream == nil {
+		http.Error(rw, "unknown upstream: "+name, http.StatusNotFound)
+		return
+	}
+	upstream.setDraining(draining)
+	log.Printf("admin: upstream %s draining: %t", name, draining)
+	writeJSON(rw, upstreamStatus{
+		Name:     upstream.name,
+		Draining: draining,
+		InFlight: atomic.LoadInt64(&upstream.inFlight),
+	})
+}
+
+// scheduleConfig reports the status of a scheduled configuration on GET,
+// schedules the configuration in the request body on POST, and cancels a
+// pending configuration on DELETE.
+func (admin *adminHandler) scheduleConfig(
+	rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		if !admin.schedule(rw, req) {
+			return
+		}
+	case "DELETE":
+		if err := admin.scheduler.cancel(); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, admin.scheduler.getStatus())
+}
+
+func (admin *adminHandler) schedule(
+	rw http.ResponseWriter, req *http.Request) bool {
+	query := req.URL.Query()
+	activateAt, err := time.Parse(time.RFC3339, query.Get("activate_at"))
+	if err != nil {
+		http.Error(rw, "invalid activate_at: "+err.Error(),
+			http.StatusBadRequest)
+		return false
+	}
+	var revertAfter time.Duration
+	if value := query.Get("revert_after"); value != "" {
+		if revertAfter, err = time.ParseDuration(value); err != nil {
+			http.Error(rw, "invalid revert_after: "+err.Error(),
+				http.StatusBadRequest)
+			return false
+		}
+	}
+
+	table := admin.readRoutingTable(rw, req)
+	if table == nil {
+		return false
+	}
+	err = admin.scheduler.schedule(table, activateAt, revertAfter)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// readRoutingTable parses and validates the configuration in the body of req,
+// which is YAML if its Content-Type says so and JSON otherwise, with the
+// overrides of the admin handler's profile, and returns the corresponding
+// routing table. Returns nil and writes an error response if the
+// configuration is too large or invalid.
+func (admin *adminHandler) readRoutingTable(rw http.ResponseWriter,
+	req *http.Request) *routingTable {
+	config, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body,
+		maxAdminConfig))
+	if err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(rw, "error reading configuration: "+err.Error(),
+			status)
+		return nil
+	}
+	configName := "config.json"
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if strings.HasSuffix(mediaType, "yaml") {
+		configName = "config.yaml"
+	}
+	opts, err := parseOptions(configName, admin.profile, config)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	opts.ErrorHandler = admin.delegate.customErrors
+	return newRoutingTable(opts)
+}
+
+func (admin *adminHandler) confirmConfig(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if err := admin.scheduler.confirm(); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(rw, admin.scheduler.getStatus())
+}
+
+// candidateConfig reports comparison statistics on GET, begins comparing
+// requests against the configuration in the request body on POST, and stops
+// comparing on DELETE.
+func (admin *adminHandler) candidateConfig(
+	rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		table := admin.readRoutingTable(rw, req)
+		if table == nil {
+			return
+		}
+		admin.delegate.setCandidate(table)
+		log.Printf("admin: comparing requests against candidate config")
+	case "DELETE":
+		admin.delegate.setCandidate(nil)
+		log.Printf("admin: stopped comparing against candidate config")
+	default:
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, admin.delegate.comparison().status())
+}
+
+func (admin *adminHandler) listRevoked(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, admin.delegate.revocations.list())
+}
+
+// revokeCredential denies requests carrying the credential whose hash is the
+// "hash" query parameter, and notifies its subscribers.
+func (admin *adminHandler) revokeCredential(
+	rw http.ResponseWriter, req *http.Request) {
+	hash, ok := credentialHashParam(rw, req)
+	if !ok {
+		return
+	}
+	err := admin.delegate.revocations.revoke(hash)
+	admin.delegate.subscriptions.publish(hash, decisionEvent{
+		Status: http.StatusUnauthorized, Source: "revoked",
+	})
+	log.Printf("admin: revoked credential %s", hash)
+	if err != nil {
+		log.Printf("admin: failed to store revocation: %s", err)
+		http.Error(rw, "revoked, but not stored: "+err.Error(),
+			http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, admin.delegate.revocations.list())
+}
+
+// reinstateCredential reverses revokeCredential. Subscribers are notified that
+// the credential is no longer denied, though the upstream may still deny it.
+func (admin *adminHandler) reinstateCredential(
+	rw http.ResponseWriter, req *http.Request) {
+	hash, ok := credentialHashParam(rw, req)
+	if !ok {
+		return
+	}
+	err := admin.delegate.revocations.reinstate(hash)
+	admin.delegate.subscriptions.publish(hash, decisionEvent{
+		Allowed: true, Status: http.StatusOK, Source: "reinstated",
+	})
+	log.Printf("admin: reinstated credential %s", hash)
+	if err != nil {
+		log.Printf("admin: failed to remove stored revocation: %s", err)
+		http.Error(rw, "reinstated, but not removed from storage: "+
+			err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(rw, admin.delegate.revocations.list())
+}
+
+func credentialHashParam(
+	rw http.ResponseWriter, req *http.Request) (string, bool) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return "", false
+	}
+	hash := strings.ToLower(req.URL.Query().Get("hash"))
+	if digest, err := hex.DecodeString(hash); err != nil ||
+		len(digest) != sha256.Size {
+		http.Error(rw, "hash must be a hex-encoded SHA-256 digest",
+			http.StatusBadRequest)
+		return "", false
+	}
+	return hash, true
+}
@@ -0,0 +1,123 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Admin operations", func() {
+	var opts *AuthDelegateOptions
+	var servers []*httptest.Server
+	var delegate http.Handler
+	var admin http.Handler
+
+	addUpstream := func(name string, httpStatus int, headerName string) {
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(httpStatus)
+		}
+		server := httptest.NewServer(http.HandlerFunc(handler))
+		servers = append(servers, server)
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			Name:       name,
+			URL:        server.URL,
+			HeaderName: headerName,
+		})
+	}
+
+	BeforeEach(func() {
+		servers = nil
+		opts = &AuthDelegateOptions{Port: 8080}
+		addUpstream("hmac", http.StatusAccepted, "X-Signature")
+		addUpstream("fallback", http.StatusUnauthorized, "")
+		Expect(opts.Validate()).To(BeNil())
+		delegate = NewAuthDelegate(opts)
+		admin = NewAdminHandler(delegate)
+	})
+
+	AfterEach(func() {
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	adminRequest := func(method, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	signedRequestStatus := func() int {
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("X-Signature", "foobar")
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should list upstreams and their status", func() {
+		recorder := adminRequest("GET", "/upstreams")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var statuses []upstreamStatus
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &statuses)).
+			To(BeNil())
+		Expect(statuses).To(Equal([]upstreamStatus{
+			{Name: "hmac"},
+			{Name: "fallback"},
+		}))
+	})
+
+	It("should report the version and runtime settings", func() {
+		recorder := adminRequest("GET", "/version")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var info versionInfo
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &info)).To(BeNil())
+		expected := currentVersionInfo()
+		expected.ConfigFingerprint = opts.Fingerprint()
+		Expect(info).To(Equal(expected))
+	})
+
+	It("should route around a drained upstream until undrained", func() {
+		Expect(signedRequestStatus()).To(Equal(http.StatusAccepted))
+
+		recorder := adminRequest("POST", "/upstreams/drain?name=hmac")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(signedRequestStatus()).To(Equal(http.StatusUnauthorized))
+
+		recorder = adminRequest("POST", "/upstreams/undrain?name=hmac")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(signedRequestStatus()).To(Equal(http.StatusAccepted))
+	})
+
+	It("should return Not Found for an unknown upstream", func() {
+		recorder := adminRequest("POST", "/upstreams/drain?name=bogus")
+		Expect(recorder.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should only drain on POST", func() {
+		recorder := adminRequest("GET", "/upstreams/drain?name=hmac")
+		Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(signedRequestStatus()).To(Equal(http.StatusAccepted))
+	})
+
+	It("should fail validation if upstream names are repeated", func() {
+		opts.Upstreams[1].Name = "hmac"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"repeated upstream names: hmac",
+		})))
+	})
+
+	It("should fail validation if admin_address is malformed", func() {
+		opts.AdminAddress = "localhost"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix(optionErrors([]string{
+			"invalid admin_address: ",
+		})))
+	})
+})
@@ -0,0 +1,117 @@
+package authdelegate
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// emergencyAllowHeader is added to responses that allow a request because its
+// upstream failed and it matches the emergency allowlist.
+const emergencyAllowHeader = "X-Auth-Emergency-Allow"
+
+// emergencyAllowlist identifies requests, such as those from monitoring and
+// deployment tooling, that are allowed when their upstream fails, so that
+// they aren't locked out during an authentication outage. Requests are
+// matched locally, by the hash of their credential or by the identity of
+// their client certificate. A nil *emergencyAllowlist matches nothing.
+type emergencyAllowlist struct {
+	hashes         map[string]bool
+	identityHeader string
+	identities     map[string]bool
+}
+
+// newEmergencyAllowlist returns nil if opts defines no emergency allowlist.
+func newEmergencyAllowlist(opts *AuthDelegateOptions) *emergencyAllowlist {
+	config := opts.EmergencyAllowlist
+	if config == nil {
+		return nil
+	}
+	allowlist := &emergencyAllowlist{
+		hashes:     config.hashes,
+		identities: make(map[string]bool),
+	}
+	if config.ClientIdentityHeader != "" {
+		allowlist.identityHeader = http.CanonicalHeaderKey(
+			config.ClientIdentityHeader)
+	}
+	for _, identity := range config.ClientIdentities {
+		allowlist.identities[identity] = true
+	}
+	return allowlist
+}
+
+// match returns the kind, "credential" or "identity", and value of the
+// allowlist entry matching req, whose credential, if any, has the specified
+// hash. Returns empty strings if there is no such entry.
+func (allowlist *emergencyAllowlist) match(
+	req *http.Request, hash string) (kind, value string) {
+	if allowlist == nil {
+		return
+	}
+	if hash != "" && allowlist.hashes[hash] {
+		return "credential", hash
+	}
+	identity := allowlist.clientIdentity(req)
+	if identity != "" && allowlist.identities[identity] {
+		return "identity", identity
+	}
+	return
+}
+
+// clientIdentity returns the identity of the client certificate of req: the
+// value of identityHeader, if req is from a trusted proxy, which must
+// overwrite it, or else the subject DN of the certificate req's peer
+// presented, if verified. Returns the empty string if there is none.
+func (allowlist *emergencyAllowlist) clientIdentity(
+	req *http.Request) string {
+	if allowlist.identityHeader != "" && identityOf(req).proxied {
+		identity, _ := headerValue(req.Header, allowlist.identityHeader)
+		return identity
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	return req.TLS.VerifiedChains[0][0].Subject.String()
+}
+
+// emergencyWriter allows a request matching the emergency allowlist if its
+// upstream fails, replacing any 5xx response with a 200 response.
+type emergencyWriter struct {
+	http.ResponseWriter
+	req     *http.Request
+	kind    string
+	value   string
+	allowed bool
+}
+
+func (writer *emergencyWriter) WriteHeader(status int) {
+	if status < 500 {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+	log.Printf("AUDIT emergency allowlist: allowed %s %s for %s %s; "+
+		"upstream failed with %d", writer.req.Method,
+		originalURI(writer.req), writer.kind, writer.value, status)
+	writer.allowed = true
+	if audit := auditOf(writer.req); audit != nil {
+		audit.Reason = fmt.Sprintf("emergency allowlist matches %s; "+
+			"upstream failed with %d", writer.kind, status)
+	}
+	header := writer.ResponseWriter.Header()
+	for name := range header {
+		if name != matchTraceHeader {
+			delete(header, name)
+		}
+	}
+	header.Set(emergencyAllowHeader, writer.kind)
+	writer.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+// Write discards the body of a replaced 5xx response.
+func (writer *emergencyWriter) Write(data []byte) (int, error) {
+	if writer.allowed {
+		return len(data), nil
+	}
+	return writer.ResponseWriter.Write(data)
+}
@@ -0,0 +1,165 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Emergency allowlist", func() {
+	var opts *AuthDelegateOptions
+	var upstreamStatus int
+	var upstream *httptest.Server
+
+	BeforeEach(func() {
+		upstreamStatus = http.StatusServiceUnavailable
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Upstream", "down")
+				rw.WriteHeader(upstreamStatus)
+				rw.Write([]byte("maintenance"))
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL:        upstream.URL,
+				HeaderName: "X-Token",
+			}},
+			EmergencyAllowlist: &AuthDelegateEmergencyAllowlist{
+				CredentialHashes: []string{strings.ToUpper(
+					hashCredential("deploy-token"))},
+				ClientIdentityHeader: "X-Ssl-Client-S-Dn",
+				ClientIdentities:     []string{"CN=monitoring"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	serve := func(token, identity string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Token", token)
+		if identity != "" {
+			req.Header.Set("X-Ssl-Client-S-Dn", identity)
+		}
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should allow an allowlisted credential if the upstream fails",
+		func() {
+			Expect(opts.Validate()).To(BeNil())
+			recorder := serve("deploy-token", "")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get(emergencyAllowHeader)).
+				To(Equal("credential"))
+			Expect(recorder.Header().Get("X-Upstream")).To(BeEmpty())
+			Expect(recorder.Body.String()).To(BeEmpty())
+		})
+
+	It("should allow an allowlisted identity if the upstream fails",
+		func() {
+			Expect(opts.Validate()).To(BeNil())
+			recorder := serve("other-token", "CN=monitoring")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get(emergencyAllowHeader)).
+				To(Equal("identity"))
+		})
+
+	It("should ignore the identity header from untrusted peers", func() {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Token", "other-token")
+		req.Header.Set("X-Ssl-Client-S-Dn", "CN=monitoring")
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should match the verified client certificate of other peers",
+		func() {
+			opts.EmergencyAllowlist.ClientIdentityHeader = ""
+			Expect(opts.Validate()).To(BeNil())
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set("X-Token", "other-token")
+			certificate := &x509.Certificate{
+				Subject: pkix.Name{CommonName: "monitoring"},
+			}
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{
+					{certificate},
+				},
+			}
+			recorder := httptest.NewRecorder()
+			NewAuthDelegate(opts).ServeHTTP(recorder, req)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get(emergencyAllowHeader)).
+				To(Equal("identity"))
+		})
+
+	It("should allow an allowlisted request if the upstream is down",
+		func() {
+			Expect(opts.Validate()).To(BeNil())
+			upstream.Close()
+			Expect(serve("deploy-token", "").Code).
+				To(Equal(http.StatusOK))
+		})
+
+	It("should not affect requests that aren't allowlisted", func() {
+		Expect(opts.Validate()).To(BeNil())
+		Expect(serve("other-token", "CN=intruder").Code).
+			To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should pass through upstream decisions", func() {
+		Expect(opts.Validate()).To(BeNil())
+		upstreamStatus = http.StatusUnauthorized
+		recorder := serve("deploy-token", "CN=monitoring")
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Header().Get(emergencyAllowHeader)).To(BeEmpty())
+		Expect(recorder.Body.String()).To(Equal("maintenance"))
+	})
+
+	It("should not allow revoked credentials", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts).(*authDelegateHandler)
+		Expect(delegate.revocations.revoke(
+			hashCredential("deploy-token"))).To(Succeed())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Token", "deploy-token")
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should fail validation for an invalid allowlist", func() {
+		opts.EmergencyAllowlist = &AuthDelegateEmergencyAllowlist{
+			CredentialHashes: []string{"deadbeef"},
+			ClientIdentities: []string{"CN=monitoring"},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"emergency allowlist credential hash is not a " +
+				"hex-encoded SHA-256 digest: deadbeef",
+		})))
+
+		opts.EmergencyAllowlist = &AuthDelegateEmergencyAllowlist{}
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"emergency_allowlist must define credential_hashes or " +
+				"client_identities",
+		})))
+	})
+})
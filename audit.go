@@ -0,0 +1,126 @@
+package authdelegate
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Values of audit_decisions
+const (
+	auditDecisionsAll     = "all"
+	auditDecisionsDenials = "denials"
+)
+
+// decisionAudit collects the explanation of the decision for a request, to
+// be logged as an audit record once the response has been written. A nil
+// *decisionAudit is valid and records nothing, so that callers need not
+// check whether decisions are audited.
+type decisionAudit struct {
+	Method   string `json:"method"`
+	URI      string `json:"uri"`
+	Host     string `json:"host"`
+	ClientIP string `json:"client_ip"`
+	Listener string `json:"listener,omitempty"`
+
+	// The selected upstream, and why it accepted the request
+	Upstream string `json:"upstream,omitempty"`
+	Matched  string `json:"matched,omitempty"`
+
+	Decision string `json:"decision"`
+	Status   int    `json:"status"`
+
+	// Why the decision was made, if known: the check that failed in a
+	// local verifier, the error that prevented a decision, or where a
+	// decision made earlier came from
+	Reason string `json:"reason,omitempty"`
+}
+
+// decisionAuditContextKey identifies the decisionAudit of a request in its
+// context.
+type decisionAuditContextKey struct{}
+
+// startAudit returns req with a new decisionAudit in its context, and the
+// decisionAudit, if audit_decisions is enabled; otherwise it returns req
+// unchanged and nil.
+func (table *routingTable) startAudit(
+	req *http.Request) (*http.Request, *decisionAudit) {
+	if table.auditDecisions == "" {
+		return req, nil
+	}
+	audit := &decisionAudit{
+		Method:   originalMethod(req),
+		URI:      originalURI(req),
+		Host:     requestHost(req),
+		ClientIP: clientIP(req),
+		Listener: requestListener(req),
+	}
+	return req.WithContext(context.WithValue(req.Context(),
+		decisionAuditContextKey{}, audit)), audit
+}
+
+// selected records that upstream was selected for req.
+func (audit *decisionAudit) selected(upstream *authDelegate,
+	req *http.Request) {
+	if audit == nil {
+		return
+	}
+	audit.Upstream = upstream.name
+	audit.Matched = upstream.explain(req)
+}
+
+// auditOf returns the decisionAudit of req, or nil if its decision isn't
+// audited.
+func auditOf(req *http.Request) *decisionAudit {
+	audit, _ := req.Context().Value(decisionAuditContextKey{}).(*decisionAudit)
+	return audit
+}
+
+// explainDecision records why the decision for req was made, unless a
+// reason has already been recorded, if its decision is audited.
+func explainDecision(req *http.Request, reason string) {
+	if audit := auditOf(req); audit != nil && audit.Reason == "" {
+		audit.Reason = reason
+	}
+}
+
+// log logs the audit record of a request whose response had status, if
+// its decision is one that table audits.
+func (audit *decisionAudit) log(table *routingTable, status int) {
+	if audit == nil {
+		return
+	}
+	audit.Decision = decisionName(status)
+	audit.Status = status
+	if audit.Decision == "allow" &&
+		table.auditDecisions != auditDecisionsAll {
+		return
+	}
+	record, err := json.Marshal(audit)
+	if err != nil {
+		log.Printf("failed to encode audit record: %s", err)
+		return
+	}
+	log.Printf("AUDIT decision: %s", record)
+}
+
+// explainingErrorHandler records the error reported to handler as the
+// reason for the decision of each audited request.
+func explainingErrorHandler(handler ErrorHandler) ErrorHandler {
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		explainDecision(req, err.Error())
+		handler(rw, req, err)
+	}
+}
+
+func validateAuditDecisions(opts *AuthDelegateOptions,
+	msgs []string) []string {
+	switch opts.AuditDecisions {
+	case "", auditDecisionsDenials, auditDecisionsAll:
+	default:
+		msgs = append(msgs, "audit_decisions must be denials or all: "+
+			opts.AuditDecisions)
+	}
+	return msgs
+}
@@ -0,0 +1,119 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Decision audit records", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port:           8080,
+			AuditDecisions: "denials",
+			RejectPaths:    []string{"/internal/"},
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "api-tokens",
+					Type:       "static_tokens",
+					HeaderName: "X-Api-Key",
+					TokenHashes: []string{
+						hashCredential("s3cret"),
+					},
+				},
+			},
+		}
+	})
+
+	// audit returns the audit records logged while authorizing a request
+	// for uri with the X-Api-Key token.
+	audit := func(uri, token string) []*decisionAudit {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", uri)
+		req.RemoteAddr = "192.0.2.7:41000"
+		if token != "" {
+			req.Header.Set("X-Api-Key", token)
+		}
+
+		var output bytes.Buffer
+		log.SetOutput(&output)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		log.SetOutput(os.Stderr)
+		if token != "" {
+			Expect(output.String()).ToNot(ContainSubstring(token))
+		}
+
+		records := []*decisionAudit{}
+		for _, line := range strings.Split(output.String(), "\n") {
+			if i := strings.Index(line, "AUDIT decision: "); i != -1 {
+				record := &decisionAudit{}
+				Expect(json.Unmarshal([]byte(line[i+16:]),
+					record)).To(Succeed())
+				records = append(records, record)
+			}
+		}
+		return records
+	}
+
+	It("should explain why a local verifier denied a request", func() {
+		records := audit("/reports?month=5", "guess")
+		Expect(records).To(HaveLen(1))
+		Expect(records[0]).To(Equal(&decisionAudit{
+			Method:   "GET",
+			URI:      "/reports?month=5",
+			Host:     "delegate",
+			ClientIP: "192.0.2.7",
+			Upstream: "api-tokens",
+			Matched:  "header X-Api-Key present",
+			Decision: "deny",
+			Status:   http.StatusUnauthorized,
+			Reason:   "static: token not recognized",
+		}))
+	})
+
+	It("should explain requests no upstream decided", func() {
+		records := audit("/internal/jobs", "s3cret")
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Upstream).To(BeEmpty())
+		Expect(records[0].Decision).To(Equal("deny"))
+		Expect(records[0].Reason).To(Equal("rejected by path rule"))
+
+		records = audit("/reports", "")
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Status).To(Equal(http.StatusUnauthorized))
+		Expect(records[0].Reason).To(Equal(
+			ErrNoUpstreamMatch.Error()))
+	})
+
+	It("should record allowed requests only if all are audited", func() {
+		Expect(audit("/reports", "s3cret")).To(BeEmpty())
+
+		opts.AuditDecisions = "all"
+		records := audit("/reports", "s3cret")
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Decision).To(Equal("allow"))
+		Expect(records[0].Reason).To(BeEmpty())
+
+		opts.AuditDecisions = ""
+		Expect(audit("/reports", "guess")).To(BeEmpty())
+	})
+
+	It("should fail validation for an unknown setting", func() {
+		opts.AuditDecisions = "denied"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"audit_decisions must be denials or all: denied",
+		})))
+	})
+})
@@ -0,0 +1,46 @@
+// Package authdelegate routes authentication requests, such as the
+// subrequests of Nginx's auth_request directive, to one of several
+// authentication servers ("upstreams") depending on the headers or cookies
+// each request carries, and returns the upstream's decision.
+//
+// The authdelegate command in cmd/authdelegate serves a delegate configured
+// by a JSON or YAML file. Programs may instead embed a delegate by
+// validating Options and serving the handler returned by NewHandler:
+//
+//	opts := &authdelegate.Options{
+//		Port: 8080,
+//		Upstreams: []*authdelegate.Upstream{
+//			{URL: "http://127.0.0.1:4180/oauth2/auth",
+//				CookieName: "_oauth2_proxy"},
+//			{URL: "http://127.0.0.1:8081/auth"},
+//		},
+//	}
+//	if err := opts.Validate(); err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Handle("/auth", authdelegate.NewHandler(opts))
+//
+// Options, Upstream, NewHandler, NewAdminHandler, the ErrorHandler hook, and
+// the Err* decision failure codes form the package's stable API.
+package authdelegate
+
+import (
+	"net/http"
+)
+
+// Options configures a delegate. Its fields are those of the configuration
+// file; see AuthDelegateOptions.
+type Options = AuthDelegateOptions
+
+// Upstream configures an authentication server to which requests may be
+// routed; see AuthDelegateUpstream.
+type Upstream = AuthDelegateUpstream
+
+// NewHandler creates a http.Handler that routes each request to the upstream
+// of opts that matches it and writes the upstream's decision. opts must have
+// been validated by Options.Validate, or created by
+// NewAuthDelegateOptionsFromJSON or NewAuthDelegateOptionsFromYAML, and
+// must not be modified afterwards.
+func NewHandler(opts *Options) http.Handler {
+	return NewAuthDelegate(opts)
+}
@@ -0,0 +1,31 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Embedding API", func() {
+	It("should serve decisions from validated Options", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Forwarded-User", "mbland")
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		defer upstream.Close()
+		opts := &Options{
+			Port:      8080,
+			Upstreams: []*Upstream{{URL: upstream.URL}},
+		}
+		Expect(opts.Validate()).To(Succeed())
+
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		recorder := httptest.NewRecorder()
+		NewHandler(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("X-Forwarded-User")).To(
+			Equal("mbland"))
+	})
+})
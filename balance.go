@@ -0,0 +1,90 @@
+package authdelegate
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Values of an upstream's load_balancing option
+const (
+	balanceRoundRobin = "round_robin"
+	balanceLeastConn  = "least_conn"
+	balanceRandom     = "random"
+)
+
+// balance returns a healthy replica among those across which requests are
+// balanced, chosen by the set's strategy, or nil if none is healthy. Each
+// strategy starts from a different replica for each request, so that ties
+// are broken fairly.
+func (set *replicaSet) balance() *replica {
+	count := set.balanced
+	var start int
+	if count > 1 && set.strategy == balanceRandom {
+		start = rand.Intn(count)
+	} else if count > 1 {
+		start = int((atomic.AddUint64(&set.next, 1) - 1) %
+			uint64(count))
+	}
+	var chosen *replica
+	for i := 0; i != count; i++ {
+		replica := set.replicas[(start+i)%count]
+		if !replica.isHealthy() {
+			continue
+		} else if set.strategy != balanceLeastConn {
+			return replica
+		} else if chosen == nil || atomic.LoadInt64(&replica.inFlight) <
+			atomic.LoadInt64(&chosen.inFlight) {
+			chosen = replica
+		}
+	}
+	return chosen
+}
+
+// replicaTransport counts the requests in flight to each replica of an
+// upstream, for least_conn balancing.
+type replicaTransport struct {
+	http.RoundTripper
+	replicas *replicaSet
+}
+
+// newReplicaTransport returns transport unchanged unless replicas are
+// balanced by least_conn.
+func newReplicaTransport(transport http.RoundTripper,
+	replicas *replicaSet) http.RoundTripper {
+	if replicas.strategy != balanceLeastConn {
+		return transport
+	}
+	return &replicaTransport{transport, replicas}
+}
+
+func (transport *replicaTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	replica := transport.replicas.find(req.URL)
+	if replica == nil {
+		return transport.RoundTripper.RoundTrip(req)
+	}
+	atomic.AddInt64(&replica.inFlight, 1)
+	res, err := transport.RoundTripper.RoundTrip(req)
+	if err != nil {
+		atomic.AddInt64(&replica.inFlight, -1)
+		return nil, err
+	}
+	res.Body = &replicaBody{ReadCloser: res.Body, replica: replica}
+	return res, nil
+}
+
+// replicaBody ends the request in flight to a replica when its response body
+// is closed.
+type replicaBody struct {
+	io.ReadCloser
+	replica *replica
+	once    sync.Once
+}
+
+func (body *replicaBody) Close() error {
+	body.once.Do(func() { atomic.AddInt64(&body.replica.inFlight, -1) })
+	return body.ReadCloser.Close()
+}
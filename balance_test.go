@@ -0,0 +1,129 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+)
+
+var _ = Describe("Load balancing", func() {
+	var servers []*httptest.Server
+	var release chan struct{}
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		servers = nil
+		release = make(chan struct{})
+		for _, name := range []string{"a", "b", "c"} {
+			name := name
+			servers = append(servers, httptest.NewServer(
+				http.HandlerFunc(func(rw http.ResponseWriter,
+					req *http.Request) {
+					if req.Header.Get("X-Hold") != "" {
+						<-release
+					}
+					rw.Header().Set("X-Replica", name)
+					rw.WriteHeader(http.StatusAccepted)
+				})))
+		}
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL: servers[0].URL,
+					ReplicaURLs: []string{
+						servers[1].URL, servers[2].URL,
+					},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		close(release)
+		for _, server := range servers {
+			server.Close()
+		}
+	})
+
+	replicas := func(handler http.Handler, count int) []string {
+		var names []string
+		for i := 0; i != count; i++ {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			names = append(names, recorder.Header().Get("X-Replica"))
+		}
+		return names
+	}
+
+	It("should spread requests across replicas in turn", func() {
+		Expect(opts.Validate()).To(BeNil())
+		Expect(replicas(NewAuthDelegate(opts), 4)).To(
+			Equal([]string{"a", "b", "c", "a"}))
+	})
+
+	It("should send requests to random replicas", func() {
+		opts.Upstreams[0].LoadBalancing = "random"
+		Expect(opts.Validate()).To(BeNil())
+		Expect(replicas(NewAuthDelegate(opts), 50)).To(
+			ContainElement("c"))
+	})
+
+	It("should prefer the replica with fewest requests in flight", func() {
+		opts.Upstreams[0].LoadBalancing = "least_conn"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		held := make(chan string)
+		for i := 0; i != 2; i++ {
+			go func() {
+				req, _ := http.NewRequest("GET", "http://delegate/",
+					nil)
+				req.Header.Set("X-Hold", "true")
+				recorder := httptest.NewRecorder()
+				handler.ServeHTTP(recorder, req)
+				held <- recorder.Header().Get("X-Replica")
+			}()
+		}
+		table := handler.(*authDelegateHandler).routes()
+		set := table.upstreams[0].replicas
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&set.replicas[0].inFlight) +
+				atomic.LoadInt64(&set.replicas[1].inFlight) +
+				atomic.LoadInt64(&set.replicas[2].inFlight)
+		}).Should(Equal(int64(2)))
+		idle := ""
+		for i, name := range []string{"a", "b", "c"} {
+			if atomic.LoadInt64(&set.replicas[i].inFlight) == 0 {
+				idle = name
+			}
+		}
+		Expect(replicas(handler, 2)).To(Equal([]string{idle, idle}))
+		release <- struct{}{}
+		release <- struct{}{}
+		Expect([]string{<-held, <-held}).ToNot(ContainElement(idle))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].ReplicaURLs = []string{"localhost:4180"}
+		opts.Upstreams[0].LoadBalancing = "fastest"
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			URL:           servers[1].URL,
+			CookieName:    "_session",
+			LoadBalancing: "random",
+		})
+		opts.Upstreams[0], opts.Upstreams[1] = opts.Upstreams[1],
+			opts.Upstreams[0]
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"load_balancing requires replica_urls: " + servers[1].URL,
+			"replica_urls must be http URLs like url: " +
+				servers[0].URL + ": localhost:4180",
+			"load_balancing must be round_robin, least_conn, or " +
+				"random for URL: " + servers[0].URL,
+		})))
+	})
+})
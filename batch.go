@@ -0,0 +1,168 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+)
+
+const defaultBatchMaxRequests = 100
+
+// batchRequestBytes is the size of the body of a batch request allowed for
+// each of batch_max_requests, so that the body is read into memory only up to
+// the size of the largest batch that will be accepted.
+const batchRequestBytes = 16 << 10
+
+// batchConcurrency limits the number of requests from a single batch that
+// are delegated to upstreams at the same time.
+const batchConcurrency = 8
+
+// batchRequest is the body of a request to batch_path. The headers of the
+// batch request itself (e.g. Cookie) apply to every request in the batch,
+// unless overridden by the request's own headers.
+type batchRequest struct {
+	Requests []batchRequestItem `json:"requests"`
+}
+
+type batchRequestItem struct {
+	// Defaults to GET
+	Method string `json:"method"`
+
+	// The URI the decision is for, as in X-Original-URI
+	URI string `json:"uri"`
+
+	Headers map[string]string `json:"headers"`
+}
+
+type batchResponse struct {
+	Decisions []batchDecision `json:"decisions"`
+}
+
+type batchDecision struct {
+	Status  int  `json:"status"`
+	Allowed bool `json:"allowed"`
+}
+
+// decisionRecorder captures the status of a delegated request, discarding
+// the response body.
+type decisionRecorder struct {
+	header http.Header
+	status int
+}
+
+func (recorder *decisionRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *decisionRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	return len(data), nil
+}
+
+func (recorder *decisionRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+}
+
+// serveBatch delegates each request in a batch, concurrently, and responds
+// with the decisions in the same order.
+func (handler *authDelegateHandler) serveBatch(rw http.ResponseWriter,
+	req *http.Request, table *routingTable) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var batch batchRequest
+	body := http.MaxBytesReader(rw, req.Body,
+		int64(table.batchMax)*batchRequestBytes)
+	if err := json.NewDecoder(body).Decode(&batch); err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		http.Error(rw, "invalid batch: "+err.Error(), status)
+		return
+	}
+	if len(batch.Requests) > table.batchMax {
+		http.Error(rw, "batch exceeds "+strconv.Itoa(table.batchMax)+
+			" requests", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	items := make([]*http.Request, len(batch.Requests))
+	for i, item := range batch.Requests {
+		var err error
+		if items[i], err = newBatchItemRequest(req, item); err != nil {
+			http.Error(rw, "invalid request "+strconv.Itoa(i)+
+				" in batch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	response := batchResponse{make([]batchDecision, len(items))}
+	var wg sync.WaitGroup
+	semaphore := make(chan struct{}, batchConcurrency)
+	for i, item := range items {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(i int, item *http.Request) {
+			defer func() { <-semaphore; wg.Done() }()
+			recorder := &decisionRecorder{header: http.Header{}}
+			handler.delegate(recorder, item, table)
+			if recorder.status == 0 {
+				recorder.status = http.StatusOK
+			}
+			response.Decisions[i] = batchDecision{
+				Status:  recorder.status,
+				Allowed: recorder.status/100 == 2,
+			}
+		}(i, item)
+	}
+	wg.Wait()
+	writeJSON(rw, response)
+}
+
+// newBatchItemRequest creates the request to delegate for item, inheriting
+// the headers of batch. Batch requests have low priority, since they are
+// typically made ahead of user interactions.
+func newBatchItemRequest(batch *http.Request,
+	item batchRequestItem) (*http.Request, error) {
+	uri, err := url.ParseRequestURI(item.URI)
+	if err != nil {
+		return nil, err
+	}
+	method := item.Method
+	if method == "" {
+		method = "GET"
+	}
+	req := &http.Request{
+		Method:     method,
+		URL:        uri,
+		Proto:      batch.Proto,
+		ProtoMajor: batch.ProtoMajor,
+		ProtoMinor: batch.ProtoMinor,
+		Header:     http.Header{},
+		Host:       batch.Host,
+		RemoteAddr: batch.RemoteAddr,
+		RequestURI: item.URI,
+	}
+	for name, values := range batch.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Content-Length", "Content-Type", "X-Original-Uri":
+			continue
+		}
+		req.Header[name] = values
+	}
+	for name, value := range item.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("X-Original-URI", item.URI)
+	return req.WithContext(withPriority(batch.Context(), priorityLow)), nil
+}
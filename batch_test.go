@@ -0,0 +1,115 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Batch decisions", func() {
+	var server *httptest.Server
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		// Allow /public/* to anyone, and /private/* only to "admin".
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			uri := req.Header.Get("X-Original-URI")
+			cookie, _ := req.Cookie("_session")
+			if strings.HasPrefix(uri, "/public/") ||
+				(cookie != nil && cookie.Value == "admin") {
+				rw.WriteHeader(http.StatusAccepted)
+			} else {
+				rw.WriteHeader(http.StatusForbidden)
+			}
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		opts = &AuthDelegateOptions{
+			Port:      8080,
+			BatchPath: "/batch",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        server.URL,
+					CookieName: "_session",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	postBatch := func(body string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("POST", "http://delegate/batch",
+			bytes.NewBufferString(body))
+		req.AddCookie(&http.Cookie{Name: "_session", Value: "user"})
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	decisions := func(recorder *httptest.ResponseRecorder) []batchDecision {
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var response batchResponse
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &response)).
+			To(BeNil())
+		return response.Decisions
+	}
+
+	It("should return decisions in request order", func() {
+		Expect(decisions(postBatch(`{"requests": [
+			{"uri": "/private/foo"},
+			{"uri": "/public/bar"},
+			{"uri": "/private/baz",
+			 "headers": {"Cookie": "_session=admin"}}
+		]}`))).To(Equal([]batchDecision{
+			{Status: http.StatusForbidden, Allowed: false},
+			{Status: http.StatusAccepted, Allowed: true},
+			{Status: http.StatusAccepted, Allowed: true},
+		}))
+	})
+
+	It("should deny requests matching no upstream", func() {
+		Expect(decisions(postBatch(`{"requests": [
+			{"uri": "/public/foo", "headers": {"Cookie": "x=y"}}
+		]}`))).To(Equal([]batchDecision{
+			{Status: http.StatusUnauthorized, Allowed: false},
+		}))
+	})
+
+	It("should reject batches that are too large", func() {
+		opts.BatchMaxRequests = 1
+		recorder := postBatch(`{"requests": [
+			{"uri": "/public/foo"}, {"uri": "/public/bar"}
+		]}`)
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should reject bodies too large for batch_max_requests", func() {
+		opts.BatchMaxRequests = 1
+		recorder := postBatch(`{"requests": [{"uri": "/public/` +
+			strings.Repeat("a", batchRequestBytes) + `"}]}`)
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should reject malformed batches", func() {
+		Expect(postBatch(`{"requests": [`).Code).To(
+			Equal(http.StatusBadRequest))
+		Expect(postBatch(`{"requests": [{"uri": "foo"}]}`).Code).To(
+			Equal(http.StatusBadRequest))
+	})
+
+	It("should fail validation for an invalid batch_path", func() {
+		opts.BatchPath = "batch"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"batch_path must begin with '/': batch",
+		})))
+	})
+})
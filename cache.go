@@ -0,0 +1,336 @@
+package authdelegate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// decisionPrefix begins the Storage key of each cached decision.
+const decisionPrefix = "decision:"
+
+// cacheTTLHeader may be set by an upstream to shorten the time for which its
+// decision is cached, in seconds; "0" prevents caching.
+const cacheTTLHeader = "X-Auth-Cache-Ttl"
+
+// uncachedHeaders are not stored with a decision, since a cached decision is
+// served without a body and at a different time.
+var uncachedHeaders = []string{
+	"Content-Length", "Content-Encoding", "Transfer-Encoding", "Date",
+	cacheTTLHeader,
+}
+
+// cachedDecision is an upstream response stored in a decisionCache.
+type cachedDecision struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+func (decision *cachedDecision) write(rw http.ResponseWriter) {
+	for name, values := range decision.Header {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(decision.Status)
+}
+
+// decisionCache stores upstream decisions by upstream name and credential
+// hash, which may be extended by a cache variant. Storage errors are logged
+// and treated as cache misses, so that an unavailable backend doesn't cause
+// requests to fail.
+type decisionCache struct {
+	storage Storage
+}
+
+func decisionKey(upstream, hash string) string {
+	return decisionPrefix + upstream + ":" + hash
+}
+
+func (cache *decisionCache) get(upstream, hash string) *cachedDecision {
+	value, ok, err := cache.storage.Get(decisionKey(upstream, hash))
+	if err != nil {
+		log.Printf("cache: failed to get decision: %s", err)
+		return nil
+	} else if !ok {
+		return nil
+	}
+	var decision cachedDecision
+	if err := json.Unmarshal(value, &decision); err != nil {
+		log.Printf("cache: discarding malformed decision: %s", err)
+		return nil
+	}
+	return &decision
+}
+
+func (cache *decisionCache) put(upstream, hash string,
+	decision *cachedDecision, ttl time.Duration) {
+	value, _ := json.Marshal(decision)
+	err := cache.storage.Set(decisionKey(upstream, hash), value, ttl)
+	if err != nil {
+		log.Printf("cache: failed to store decision: %s", err)
+	}
+}
+
+// delete deletes the decision cached for hash by upstream, if any.
+func (cache *decisionCache) delete(upstream, hash string) {
+	if err := cache.storage.Delete(decisionKey(upstream,
+		hash)); err != nil {
+		log.Printf("cache: failed to delete decision: %s", err)
+	}
+}
+
+// flush deletes the cached decisions of upstream, or of every upstream if
+// upstream is empty, and returns the number deleted.
+func (cache *decisionCache) flush(upstream string) (int, error) {
+	prefix := decisionPrefix
+	if upstream != "" {
+		prefix = decisionKey(upstream, "")
+	}
+	keys, err := cache.storage.Keys(prefix)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := cache.storage.Delete(key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// cacheRecorder captures the status and headers written by an upstream
+// handler, so that they may be cached.
+type cacheRecorder struct {
+	http.ResponseWriter
+	decision cachedDecision
+
+	// Value of cacheTTLHeader, if any
+	ttl string
+}
+
+func (recorder *cacheRecorder) WriteHeader(status int) {
+	recorder.decision.Status = status
+	recorder.ttl = recorder.Header().Get(cacheTTLHeader)
+	recorder.decision.Header = make(http.Header)
+	for name, values := range recorder.Header() {
+		recorder.decision.Header[name] = values
+	}
+	for _, name := range uncachedHeaders {
+		delete(recorder.decision.Header, name)
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// allowed returns false for responses allowed by a failOpenPolicy, which
+// must not outlive the upstream's outage.
+func (decision *cachedDecision) allowed() bool {
+	return decision.Status/100 == 2 &&
+		decision.Header.Get(failOpenHeader) == ""
+}
+
+// denied returns true for decisions that reject the request's credential, as
+// opposed to failures, which are never cached.
+func (decision *cachedDecision) denied() bool {
+	return decision.Status == http.StatusUnauthorized ||
+		decision.Status == http.StatusForbidden
+}
+
+// Request attributes that may be added to the credential in cache keys
+const (
+	cacheKeyMethod   = "method"
+	cacheKeyPath     = "path"
+	cacheKeyClientIP = "client_ip"
+)
+
+// cacheKeyAttributes are valid elements of AuthDelegateUpstream.CacheKey.
+var cacheKeyAttributes = map[string]bool{
+	cacheKeyMethod: true, cacheKeyPath: true, cacheKeyClientIP: true,
+}
+
+// cacheVariant returns a digest of the attributes of req named by this
+// upstream's cache key, and of its cookie if it requires both a header and a
+// cookie, to be appended to the credential hash; returns the empty string if
+// the cache key consists of the credential alone.
+func (delegate *authDelegate) cacheVariant(req *http.Request) string {
+	paired := delegate.headerName != "" && delegate.cookieName != ""
+	if len(delegate.cacheKey) == 0 && !paired {
+		return ""
+	}
+	digest := sha256.New()
+	if paired {
+		cookie, _ := delegate.cookieCredential(req)
+		io.WriteString(digest, cookie+"\x00")
+	}
+	for _, attribute := range delegate.cacheKey {
+		var value string
+		switch attribute {
+		case cacheKeyMethod:
+			value = originalMethod(req)
+		case cacheKeyPath:
+			value = pathPrefix(requestPath(req),
+				delegate.cacheKeyPathSegments)
+		case cacheKeyClientIP:
+			value = clientIP(req)
+		}
+		io.WriteString(digest, value+"\x00")
+	}
+	return hex.EncodeToString(digest.Sum(nil)[:16])
+}
+
+// originalURI returns the URI of the request being authorized, as the
+// upstream will receive it in X-Original-URI.
+func originalURI(req *http.Request) string {
+	if uri := req.Header.Get("X-Original-URI"); uri != "" {
+		return uri
+	}
+	return req.RequestURI
+}
+
+// pathPrefix returns the path of uri without its query, truncated to its
+// first segments if segments is nonzero.
+func pathPrefix(uri string, segments int) string {
+	if query := strings.IndexByte(uri, '?'); query >= 0 {
+		uri = uri[:query]
+	}
+	if segments == 0 {
+		return uri
+	}
+	parts := strings.Split(strings.Trim(uri, "/"), "/")
+	if len(parts) > segments {
+		parts = parts[:segments]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// requestPath returns the path of the X-Original-URI of req without its
+// query, percent-decoded and with repeated slashes and dot segments removed,
+// as the upstream app will resolve it: "/api/../admin" and "/api/%2e%2e/admin"
+// are both "/admin". A trailing slash is kept. Paths must be normalized
+// before they are matched, or any client could reach the decision of an
+// upstream for one path with a request for another.
+func requestPath(req *http.Request) string {
+	return cleanPath(pathPrefix(originalURI(req), 0))
+}
+
+// cleanPath percent-decodes p, leaving invalid escapes as they are, and
+// removes repeated slashes and dot segments, keeping a trailing slash.
+func cleanPath(p string) string {
+	var decoded strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '%' && i+2 < len(p) {
+			if b, err := strconv.ParseUint(p[i+1:i+3], 16, 8); err == nil {
+				decoded.WriteByte(byte(b))
+				i += 2
+				continue
+			}
+		}
+		decoded.WriteByte(p[i])
+	}
+	p = decoded.String()
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func (delegate *authDelegate) caching() bool {
+	return delegate.cacheTTL != 0 || delegate.denyCacheTTL != 0
+}
+
+// cacheLimit returns the maximum time for which this upstream's decision may
+// be cached, or zero if it must not be.
+func (delegate *authDelegate) cacheLimit(
+	decision *cachedDecision) time.Duration {
+	if decision.allowed() {
+		return delegate.cacheTTL
+	} else if decision.denied() {
+		return delegate.denyCacheTTL
+	}
+	return 0
+}
+
+// storeDecision caches the decision captured by recorder under key, the
+// credential hash and cache variant, if upstream permits it.
+func (handler *authDelegateHandler) storeDecision(upstream *authDelegate,
+	key string, recorder *cacheRecorder) {
+	decision := &recorder.decision
+	ttl := recorder.cacheLifetime(upstream.cacheLimit(decision))
+	budget := upstream.approvals
+	if decision.denied() {
+		budget = upstream.denials
+	}
+	if ttl == 0 {
+		return
+	}
+	removed := func(key string) { handler.cache.delete(upstream.name, key) }
+	if budget.admit(key, ttl, removed) {
+		handler.cache.put(upstream.name, key, decision, ttl)
+	}
+}
+
+// cacheBudget limits the number of approvals or denials an upstream may have
+// cached at once, so that a flood of distinct credentials can't fill the
+// storage backend. Entries are counted locally; a nil *cacheBudget admits
+// every decision.
+type cacheBudget struct {
+	max int
+
+	mutex   sync.Mutex
+	expires *expiryQueue
+}
+
+func newCacheBudget(max int) *cacheBudget {
+	if max == 0 {
+		return nil
+	}
+	return &cacheBudget{max: max, expires: newExpiryQueue()}
+}
+
+// admit returns true if a decision for hash may be cached for ttl, first
+// passing the hash of each cached decision that has expired to removed, so
+// that it is deleted from storage rather than left for the backend to expire.
+func (budget *cacheBudget) admit(hash string, ttl time.Duration,
+	removed func(hash string)) bool {
+	if budget == nil {
+		return true
+	}
+	budget.mutex.Lock()
+	defer budget.mutex.Unlock()
+	now := time.Now()
+	budget.expires.expire(now, removed)
+	if !budget.expires.has(hash) && budget.expires.Len() >= budget.max {
+		return false
+	}
+	budget.expires.set(hash, now.Add(ttl))
+	return true
+}
+
+// cacheLifetime returns the time for which the recorded decision should be
+// cached: the lesser of limit and the upstream's cacheTTLHeader, ignoring an
+// invalid header. A header of zero prevents caching even if limit is less than
+// a second.
+func (recorder *cacheRecorder) cacheLifetime(
+	limit time.Duration) time.Duration {
+	if recorder.ttl == "" {
+		return limit
+	}
+	seconds, err := strconv.ParseInt(recorder.ttl, 10, 64)
+	if err != nil || seconds < 0 {
+		log.Printf("cache: ignoring invalid %s: %s", cacheTTLHeader,
+			recorder.ttl)
+		return limit
+	} else if seconds == 0 {
+		return 0
+	} else if seconds < int64(limit/time.Second) {
+		return time.Duration(seconds) * time.Second
+	}
+	return limit
+}
@@ -0,0 +1,274 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Decision cache", func() {
+	var upstream *httptest.Server
+	var requests int
+	var status int
+	var ttlHeader string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		requests = 0
+		status = http.StatusAccepted
+		ttlHeader = ""
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				requests++
+				rw.Header().Set("X-User", "user@example.gov")
+				if ttlHeader != "" {
+					rw.Header().Set("X-Auth-Cache-TTL", ttlHeader)
+				}
+				rw.WriteHeader(status)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        upstream.URL,
+					HeaderName: "X-Api-Key",
+					CacheTTL:   "1m",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorize := func(handler http.Handler,
+		key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate/foo", nil)
+		req.Header.Set("X-Api-Key", key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should serve repeated allowed decisions from the cache", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "key").Code).
+			To(Equal(http.StatusAccepted))
+		cached := authorize(handler, "key")
+		Expect(cached.Code).To(Equal(http.StatusAccepted))
+		Expect(cached.Header().Get("X-User")).
+			To(Equal("user@example.gov"))
+		Expect(requests).To(Equal(1))
+
+		authorize(handler, "other")
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should not cache denials", func() {
+		status = http.StatusForbidden
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "key")
+		Expect(authorize(handler, "key").Code).
+			To(Equal(http.StatusForbidden))
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should cache denials for deny_cache_ttl", func() {
+		status = http.StatusForbidden
+		opts.Upstreams[0].DenyCacheTTL = "1m"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "key")
+		Expect(authorize(handler, "key").Code).
+			To(Equal(http.StatusForbidden))
+		Expect(requests).To(Equal(1))
+
+		// Failures are not denials, and are never cached.
+		status = http.StatusInternalServerError
+		authorize(handler, "other")
+		authorize(handler, "other")
+		Expect(requests).To(Equal(3))
+	})
+
+	It("should limit the number of cached denials", func() {
+		status = http.StatusUnauthorized
+		opts.Upstreams[0].DenyCacheTTL = "1m"
+		opts.Upstreams[0].DenyCacheMaxEntries = 1
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "first")
+		authorize(handler, "second")
+		authorize(handler, "first")
+		authorize(handler, "second")
+		Expect(requests).To(Equal(3))
+	})
+
+	It("should limit the number of cached approvals", func() {
+		opts.Upstreams[0].CacheMaxEntries = 1
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "first")
+		authorize(handler, "second")
+		authorize(handler, "first")
+		authorize(handler, "second")
+		Expect(requests).To(Equal(3))
+	})
+
+	It("should admit denials again once cached ones expire", func() {
+		budget := newCacheBudget(1)
+		var removed []string
+		remove := func(hash string) { removed = append(removed, hash) }
+		Expect(budget.admit("first", time.Millisecond, remove)).
+			To(BeTrue())
+		Expect(budget.admit("second", time.Minute, remove)).
+			To(BeFalse())
+		time.Sleep(2 * time.Millisecond)
+		Expect(budget.admit("second", time.Minute, remove)).
+			To(BeTrue())
+		Expect(removed).To(Equal([]string{"first"}))
+		Expect(newCacheBudget(0).admit("any", time.Minute, remove)).
+			To(BeTrue())
+	})
+
+	It("should delete expired decisions from storage", func() {
+		opts.Upstreams[0].CacheTTL = "10ms"
+		opts.Upstreams[0].CacheMaxEntries = 5
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		for i := 0; i != 5; i++ {
+			authorize(handler, "first"+strconv.Itoa(i))
+		}
+		time.Sleep(20 * time.Millisecond)
+		authorize(handler, "second")
+		Expect(handler.storage.(*memoryStorage).entries).To(HaveLen(1))
+	})
+
+	It("should vary cache keys by the configured attributes", func() {
+		opts.Upstreams[0].CacheKey = []string{"method", "path"}
+		opts.Upstreams[0].CacheKeyPathSegments = 1
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorizeURI := func(method, uri string) {
+			req, _ := http.NewRequest(method, "http://delegate/", nil)
+			req.Header.Set("X-Api-Key", "key")
+			req.Header.Set("X-Original-URI", uri)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		authorizeURI("GET", "/api/users?page=2")
+		authorizeURI("GET", "/api/reports")
+		Expect(requests).To(Equal(1))
+		authorizeURI("POST", "/api/reports")
+		authorizeURI("GET", "/admin/users")
+		Expect(requests).To(Equal(3))
+	})
+
+	It("should fail validation for an invalid cache_key", func() {
+		opts.Upstreams[0].CacheKey = []string{"method", "cookie",
+			"method"}
+		opts.Upstreams[0].CacheKeyPathSegments = 2
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"unknown cache_key attribute for " + upstream.URL +
+				": cookie",
+			"repeated cache_key attributes for " + upstream.URL +
+				": method",
+			"cache_key_path_segments requires the path cache_key " +
+				"attribute: " + upstream.URL,
+		})))
+	})
+
+	It("should not cache without cache_ttl", func() {
+		opts.Upstreams[0].CacheTTL = ""
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "key")
+		authorize(handler, "key")
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should not cache if the upstream sets a zero TTL", func() {
+		ttlHeader = "0"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "key")
+		authorize(handler, "key")
+		Expect(requests).To(Equal(2))
+	})
+
+	It("should limit the TTL set by the upstream to cache_ttl", func() {
+		recorder := &cacheRecorder{}
+		Expect(recorder.cacheLifetime(time.Minute)).To(Equal(time.Minute))
+		recorder.ttl = "30"
+		Expect(recorder.cacheLifetime(time.Minute)).
+			To(Equal(30 * time.Second))
+		recorder.ttl = "9223372036854775807"
+		Expect(recorder.cacheLifetime(time.Minute)).To(Equal(time.Minute))
+		recorder.ttl = "soon"
+		Expect(recorder.cacheLifetime(time.Minute)).To(Equal(time.Minute))
+		recorder.ttl = "0"
+		Expect(recorder.cacheLifetime(500 * time.Millisecond)).
+			To(BeZero())
+		recorder.ttl = "1"
+		Expect(recorder.cacheLifetime(500 * time.Millisecond)).
+			To(Equal(500 * time.Millisecond))
+	})
+
+	It("should not store the TTL header with the decision", func() {
+		ttlHeader = "30"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		authorize(handler, "key")
+		cached := authorize(handler, "key")
+		Expect(requests).To(Equal(1))
+		Expect(cached.Header().Get("X-Auth-Cache-TTL")).To(BeEmpty())
+	})
+
+	It("should deny revoked credentials despite a cached decision", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		authorize(handler, "key")
+		handler.revocations.revoke(hashCredential("key"))
+		Expect(authorize(handler, "key").Code).
+			To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should fail validation for deny_cache_max_entries alone", func() {
+		opts.Upstreams[0].DenyCacheMaxEntries = 10
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"deny_cache_max_entries requires deny_cache_ttl: " +
+				upstream.URL,
+		})))
+	})
+
+	It("should fail validation for cache_max_entries alone", func() {
+		opts.Upstreams[0].CacheTTL = ""
+		opts.Upstreams[0].CacheMaxEntries = 10
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"cache_max_entries requires cache_ttl: " + upstream.URL,
+		})))
+	})
+
+	It("should fail validation for cache_ttl on a default upstream", func() {
+		opts.Upstreams[0].HeaderName = ""
+		opts.Upstreams[0].CacheTTL = "-1s"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"cache_ttl for " + upstream.URL +
+				" must not be negative: -1s",
+			"caching requires header_name or cookie_name: " +
+				upstream.URL,
+		})))
+	})
+})
@@ -0,0 +1,458 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspRetryInterval is how long to wait after failing to obtain an OCSP
+	// response before trying again.
+	ocspRetryInterval = 5 * time.Minute
+
+	// ocspDefaultRefresh is how long to staple an OCSP response that
+	// doesn't specify when the next update will be available.
+	ocspDefaultRefresh = time.Hour
+
+	// maxOCSPResponseSize limits the size of an OCSP response.
+	maxOCSPResponseSize = 1 << 20
+
+	// defaultSslCertReloadInterval is how often to check for a renewed
+	// certificate unless ssl_cert_reload_interval is specified.
+	defaultSslCertReloadInterval = time.Minute
+)
+
+// ocspClient sends OCSP requests to the responder of the SSL certificate.
+var ocspClient = &http.Client{Timeout: 30 * time.Second}
+
+// serverCertificate is the certificate served on Port and, if stapling is
+// enabled, the latest OCSP response for it, which is refreshed in the
+// background.
+type serverCertificate struct {
+	// Holds the current *tls.Certificate
+	current atomic.Value
+
+	leaf *x509.Certificate
+
+	// The certificate that signed leaf, or nil if the chain doesn't include
+	// it
+	issuer *x509.Certificate
+
+	// Closed when the certificate is replaced by a renewed one, to stop
+	// stapling OCSP responses for it
+	retired chan struct{}
+}
+
+// expiringCertificate is the certificate served on Port, whose expiry is
+// reported in metrics.
+type expiringCertificate interface {
+	daysToExpiry() float64
+}
+
+// serveCertificate loads the SSL certificate defined by opts, if any, for the
+// listeners of server, or obtains one if opts enables acme, and reports its
+// expiry in the metrics of delegate, which must have been created by
+// NewAuthDelegate. Returns an error if the certificate doesn't match its key
+// or its chain is invalid, rather than failing each TLS handshake.
+func serveCertificate(delegate http.Handler, server *http.Server,
+	opts *AuthDelegateOptions) error {
+	var certificate expiringCertificate
+	if opts.Acme != nil {
+		acme := newACMECertificate(opts.Acme)
+		server.TLSConfig = hardenTLS(acme.tlsConfig(), opts)
+		certificate = acme
+	} else if opts.SslCert != "" {
+		reloader, err := newCertificateReloader("ssl_cert", opts.SslCert,
+			opts.SslKey, opts)
+		if err != nil {
+			return err
+		}
+		server.TLSConfig = hardenTLS(&tls.Config{
+			GetCertificate: reloader.getCertificate,
+		}, opts)
+		certificate = reloader
+	} else {
+		return nil
+	}
+	if opts.SslSessionResumption != nil && !*opts.SslSessionResumption {
+		server.TLSConfig.SessionTicketsDisabled = true
+	}
+	if opts.RequireClientCert {
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLSConfig.ClientCAs = opts.clientCAs
+	}
+	delegate.(*authDelegateHandler).certificate = certificate
+	return nil
+}
+
+// listenerTLSConfig returns the TLS configuration of an additional listener:
+// that of server, the server for Port, unless the listener defines its own
+// certificate or client certificate requirement, or nil if it serves
+// plaintext.
+func listenerTLSConfig(server *http.Server, config *AuthDelegateListener,
+	opts *AuthDelegateOptions) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if config.SslCert != "" {
+		certificate, err := newCertificateReloader("listener "+
+			config.listenerName()+" ssl_cert", config.SslCert,
+			config.SslKey, opts)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = hardenTLS(&tls.Config{
+			GetCertificate: certificate.getCertificate,
+		}, opts)
+		if opts.SslSessionResumption != nil &&
+			!*opts.SslSessionResumption {
+			tlsConfig.SessionTicketsDisabled = true
+		}
+	} else if server.TLSConfig != nil && !config.Plaintext {
+		tlsConfig = server.TLSConfig.Clone()
+	} else {
+		return nil, nil
+	}
+	if config.requiresClientCert(opts) {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = config.clientCAs
+	} else {
+		tlsConfig.ClientAuth = tls.NoClientCert
+		tlsConfig.ClientCAs = nil
+	}
+	return tlsConfig, nil
+}
+
+// hardenTLS applies the minimum TLS version, cipher suites, and curve
+// preferences of opts to config, which it returns. The minimum version is
+// TLS 1.2 unless opts raises it.
+func hardenTLS(config *tls.Config, opts *AuthDelegateOptions) *tls.Config {
+	config.MinVersion = tls.VersionTLS12
+	if opts.sslMinVersion != 0 {
+		config.MinVersion = opts.sslMinVersion
+	}
+	config.CipherSuites = opts.sslCipherSuites
+	config.CurvePreferences = opts.sslCurvePreferences
+	return config
+}
+
+// validateServerCertificate checks that the SSL certificates defined by opts
+// for Port and for its Listeners, if any, can be served.
+func validateServerCertificate(opts *AuthDelegateOptions) error {
+	if opts.SslCert != "" {
+		if _, err := loadServerCertificate(opts.SslCert,
+			opts.SslKey); err != nil {
+			return err
+		}
+	}
+	for _, listener := range opts.Listeners {
+		if listener.SslCert == "" {
+			continue
+		}
+		if _, err := loadServerCertificate(listener.SslCert,
+			listener.SslKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadServerCertificate loads the certificate chain in certFile and the
+// matching key in keyFile. Each certificate of the chain must be signed by
+// the next, and the first must be currently valid.
+func loadServerCertificate(certFile, keyFile string) (
+	*serverCertificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s and %s could not be loaded: %s",
+			certFile, keyFile, err)
+	}
+	chain := make([]*x509.Certificate, len(certificate.Certificate))
+	for i, der := range certificate.Certificate {
+		if chain[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("certificate %d of %s failed to "+
+				"parse: %s", i+1, certFile, err)
+		}
+	}
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, fmt.Errorf("certificate chain in %s is out of "+
+				"order or incomplete: certificate %d (%s) is not "+
+				"signed by certificate %d (%s)", certFile, i+1,
+				chain[i].Subject, i+2, chain[i+1].Subject)
+		}
+	}
+	leaf := chain[0]
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate in %s expired at %s",
+			certFile, leaf.NotAfter.UTC().Format(time.RFC3339))
+	} else if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate in %s is not valid until %s",
+			certFile, leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	certificate.Leaf = leaf
+	result := &serverCertificate{leaf: leaf, retired: make(chan struct{})}
+	if len(chain) > 1 {
+		result.issuer = chain[1]
+	}
+	result.current.Store(&certificate)
+	return result, nil
+}
+
+func (certificate *serverCertificate) getCertificate(
+	*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return certificate.current.Load().(*tls.Certificate), nil
+}
+
+// daysToExpiry returns the number of days until the certificate expires.
+func (certificate *serverCertificate) daysToExpiry() float64 {
+	return time.Until(certificate.leaf.NotAfter).Hours() / 24
+}
+
+// staple replaces the OCSP response stapled to the certificate; nil removes
+// it.
+func (certificate *serverCertificate) staple(response []byte) {
+	updated := *certificate.getCurrent()
+	updated.OCSPStaple = response
+	certificate.current.Store(&updated)
+}
+
+func (certificate *serverCertificate) getCurrent() *tls.Certificate {
+	return certificate.current.Load().(*tls.Certificate)
+}
+
+// certificateReloader serves the certificate in certFile and keyFile, and
+// replaces it when either file changes, so that renewals, e.g. by certbot,
+// take effect without a restart. Files are checked by their modification
+// times, which os.Stat reads through symlinks such as those certbot
+// maintains.
+type certificateReloader struct {
+	label    string
+	certFile string
+	keyFile  string
+	stapling bool
+
+	// Holds the current *serverCertificate
+	current atomic.Value
+
+	// Latest modification time of certFile and keyFile when last checked
+	modified time.Time
+}
+
+// newCertificateReloader loads the certificate in certFile and keyFile,
+// identified as label in logs, staples OCSP responses to it if opts enables
+// ssl_ocsp_stapling, and checks for a renewed certificate every
+// ssl_cert_reload_interval in the background.
+func newCertificateReloader(label, certFile, keyFile string,
+	opts *AuthDelegateOptions) (*certificateReloader, error) {
+	reloader := &certificateReloader{
+		label:    label,
+		certFile: certFile,
+		keyFile:  keyFile,
+		stapling: opts.SslOcspStapling,
+	}
+	reloader.modified, _ = reloader.lastModified()
+	certificate, err := loadServerCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloader.serve(certificate)
+	interval := opts.sslCertReloadInterval
+	if opts.SslCertReloadInterval == "" {
+		interval = defaultSslCertReloadInterval
+	}
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				reloader.check()
+			}
+		}()
+	}
+	return reloader, nil
+}
+
+func (reloader *certificateReloader) serve(certificate *serverCertificate) {
+	reloader.current.Store(certificate)
+	if reloader.stapling {
+		go certificate.stapleOCSP()
+	}
+}
+
+// lastModified returns the latest modification time of certFile and
+// keyFile.
+func (reloader *certificateReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{reloader.certFile, reloader.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// check reloads the certificate if either of its files has changed since the
+// last check. A certificate that fails to load, e.g. because only one of the
+// files has been replaced so far, is logged, and the current one is served
+// until the files change again.
+func (reloader *certificateReloader) check() {
+	modified, err := reloader.lastModified()
+	if err != nil {
+		log.Printf("certs: failed to check %s: %s", reloader.label, err)
+		return
+	} else if modified.Equal(reloader.modified) {
+		return
+	}
+	reloader.modified = modified
+	certificate, err := loadServerCertificate(reloader.certFile,
+		reloader.keyFile)
+	if err != nil {
+		log.Printf("certs: failed to reload %s: %s", reloader.label, err)
+		return
+	}
+	previous := reloader.getServerCertificate()
+	reloader.serve(certificate)
+	close(previous.retired)
+	log.Printf("certs: reloaded %s from %s; expires %s", reloader.label,
+		reloader.certFile,
+		certificate.leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+func (reloader *certificateReloader) getServerCertificate() *serverCertificate {
+	return reloader.current.Load().(*serverCertificate)
+}
+
+func (reloader *certificateReloader) getCertificate(
+	hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return reloader.getServerCertificate().getCertificate(hello)
+}
+
+// daysToExpiry returns the number of days until the current certificate
+// expires.
+func (reloader *certificateReloader) daysToExpiry() float64 {
+	return reloader.getServerCertificate().daysToExpiry()
+}
+
+// stapleOCSP obtains an OCSP response for the certificate from its responder
+// and staples it, then refreshes it halfway through its validity period,
+// until the certificate is retired. An expired response is removed if it
+// can't be refreshed.
+func (certificate *serverCertificate) stapleOCSP() {
+	if len(certificate.leaf.OCSPServer) == 0 {
+		log.Printf("ocsp: certificate has no OCSP responder; not stapling")
+		return
+	} else if certificate.issuer == nil {
+		log.Printf("ocsp: ssl-cert does not include the issuer " +
+			"certificate; not stapling")
+		return
+	}
+	var expires time.Time
+	for {
+		response, status, err := certificate.fetchOCSP()
+		wait := ocspRetryInterval
+		if err != nil {
+			log.Printf("ocsp: %s", err)
+			if !expires.IsZero() && time.Now().After(expires) {
+				certificate.staple(nil)
+				expires = time.Time{}
+			}
+		} else {
+			certificate.staple(response)
+			expires = status.NextUpdate
+			wait = ocspDefaultRefresh
+			if !expires.IsZero() {
+				wait = expires.Sub(status.ThisUpdate) / 2
+				wait -= time.Since(status.ThisUpdate)
+			}
+			if wait < time.Minute {
+				wait = time.Minute
+			}
+		}
+		select {
+		case <-time.After(wait):
+		case <-certificate.retired:
+			return
+		}
+	}
+}
+
+// fetchOCSP requests the status of the certificate from its OCSP responder.
+// Returns the response, to be stapled, once its signature and status have
+// been verified.
+func (certificate *serverCertificate) fetchOCSP() (
+	[]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(certificate.leaf,
+		certificate.issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	responder := certificate.leaf.OCSPServer[0]
+	resp, err := ocspClient.Post(responder, "application/ocsp-request",
+		bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned %d", responder,
+			resp.StatusCode)
+	}
+	response, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body,
+		maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	status, err := certificate.verifyOCSP(response)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid response from %s: %s",
+			responder, err)
+	}
+	return response, status, nil
+}
+
+// verifyOCSP returns the status of the certificate in response, if it is
+// signed by the issuer or a responder it authorized, and reports the
+// certificate is good.
+func (certificate *serverCertificate) verifyOCSP(response []byte) (
+	*ocsp.Response, error) {
+	status, err := ocsp.ParseResponseForCert(response, certificate.leaf,
+		certificate.issuer)
+	if err != nil {
+		return nil, err
+	}
+	// ParseResponseForCert checks that the issuer signed a delegated
+	// responder's certificate, but not that it's for OCSP signing.
+	if responder := status.Certificate; responder != nil &&
+		!responder.Equal(certificate.issuer) &&
+		!authorizedForOCSP(responder) {
+		return nil, errors.New("responder certificate is not " +
+			"authorized for OCSP signing")
+	} else if status.Status != ocsp.Good {
+		return nil, errors.New("certificate status is not good")
+	} else if !status.NextUpdate.IsZero() &&
+		time.Now().After(status.NextUpdate) {
+		return nil, errors.New("response is stale")
+	}
+	return status, nil
+}
+
+func authorizedForOCSP(responder *x509.Certificate) bool {
+	for _, usage := range responder.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
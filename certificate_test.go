@@ -0,0 +1,451 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+var _ = Describe("Server certificate", func() {
+	var dir string
+	var ca, leaf *testCertificate
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "certificate")
+		Expect(err).To(BeNil())
+		ca = writeTestCertificate(dir, "ca", 24*time.Hour)
+		leaf = issueTestCertificate(dir, "leaf", time.Hour, ca,
+			func(template *x509.Certificate) {
+				template.IsCA = false
+				template.OCSPServer = []string{"http://ocsp.invalid"}
+			})
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should load a valid chain", func() {
+		certificate, err := loadServerCertificate(leaf.CertFile,
+			leaf.KeyFile)
+		Expect(err).To(BeNil())
+		Expect(certificate.leaf.Equal(leaf.Cert)).To(BeTrue())
+		Expect(certificate.issuer.Equal(ca.Cert)).To(BeTrue())
+		served, err := certificate.getCertificate(nil)
+		Expect(err).To(BeNil())
+		Expect(served.Certificate).To(HaveLen(2))
+		Expect(certificate.daysToExpiry()).To(
+			BeNumerically("~", 1.0/24, 0.001))
+	})
+
+	It("should reject a key that doesn't match the certificate", func() {
+		_, err := loadServerCertificate(leaf.CertFile, ca.KeyFile)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix(leaf.CertFile + " and " +
+			ca.KeyFile + " could not be loaded: "))
+	})
+
+	It("should reject a chain that is out of order", func() {
+		writePEM(leaf.CertFile, "CERTIFICATE", leaf.Cert.Raw, leaf.Cert.Raw)
+		_, err := loadServerCertificate(leaf.CertFile, leaf.KeyFile)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("certificate chain in " +
+			leaf.CertFile + " is out of order or incomplete: " +
+			"certificate 1 (CN=leaf) is not signed by certificate 2 " +
+			"(CN=leaf)"))
+	})
+
+	It("should reject an expired certificate", func() {
+		expired := writeTestCertificate(dir, "expired", -time.Minute)
+		_, err := loadServerCertificate(expired.CertFile, expired.KeyFile)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix("certificate in " +
+			expired.CertFile + " expired at "))
+	})
+
+	It("should fail validation if stapling without a certificate", func() {
+		opts := &AuthDelegateOptions{
+			Port:            8080,
+			SslOcspStapling: true,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"ssl_ocsp_stapling requires ssl_cert and ssl_key",
+		})))
+	})
+
+	It("should report the days until the certificate expires", func() {
+		opts := &AuthDelegateOptions{
+			Port:        8080,
+			MetricsPath: "/metrics",
+			SslCert:     leaf.CertFile,
+			SslKey:      leaf.KeyFile,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		Expect(server.TLSConfig.GetCertificate).ToNot(BeNil())
+
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(strings.Split(recorder.Body.String(), "\n")).To(
+			ContainElement(HavePrefix(
+				"authdelegate_ssl_cert_expiry_days 0.04")))
+	})
+
+	It("should disable session resumption if configured", func() {
+		disabled := false
+		opts := &AuthDelegateOptions{
+			Port:                 8080,
+			SslCert:              leaf.CertFile,
+			SslKey:               leaf.KeyFile,
+			SslSessionResumption: &disabled,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		Expect(server.TLSConfig.SessionTicketsDisabled).To(BeTrue())
+
+		opts.SslSessionResumption = nil
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		Expect(server.TLSConfig.SessionTicketsDisabled).To(BeFalse())
+	})
+
+	It("should fail validation for invalid session options", func() {
+		enabled := true
+		opts := &AuthDelegateOptions{
+			Port:                 8080,
+			SslSessionResumption: &enabled,
+			SslEarlyData:         true,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"ssl_session_resumption requires ssl_cert and ssl_key",
+			"ssl_early_data is not supported, since TLS 1.3 0-RTT " +
+				"data can be replayed",
+		})))
+	})
+
+	It("should require TLS 1.2 or later by default", func() {
+		opts := &AuthDelegateOptions{
+			Port:    8080,
+			SslCert: leaf.CertFile,
+			SslKey:  leaf.KeyFile,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		go server.ServeTLS(listener, "", "")
+		defer server.Close()
+
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Cert)
+		handshake := func(version uint16) error {
+			conn, err := tls.Dial("tcp", listener.Addr().String(),
+				&tls.Config{RootCAs: roots,
+					MinVersion: tls.VersionTLS10,
+					MaxVersion: version})
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}
+		Expect(handshake(tls.VersionTLS11)).ToNot(Succeed())
+		Expect(handshake(tls.VersionTLS12)).To(Succeed())
+	})
+
+	It("should apply the configured TLS settings", func() {
+		opts := &AuthDelegateOptions{
+			Port:          8080,
+			SslCert:       leaf.CertFile,
+			SslKey:        leaf.KeyFile,
+			SslMinVersion: "1.2",
+			SslCipherSuites: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			},
+			SslCurvePreferences: []string{"P-384", "X25519"},
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		Expect(server.TLSConfig.MinVersion).To(Equal(
+			uint16(tls.VersionTLS12)))
+		Expect(server.TLSConfig.CipherSuites).To(Equal([]uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		}))
+		Expect(server.TLSConfig.CurvePreferences).To(Equal(
+			[]tls.CurveID{tls.CurveP384, tls.X25519}))
+
+	})
+
+	It("should fail validation for invalid TLS settings", func() {
+		opts := &AuthDelegateOptions{
+			Port:          8080,
+			SslMinVersion: "1.1",
+			SslCipherSuites: []string{
+				"TLS_RSA_WITH_RC4_128_SHA",
+				"TLS_AES_128_GCM_SHA256",
+				"TLS_NO_SUCH_SUITE",
+			},
+			SslCurvePreferences: []string{"P-224"},
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: "http://localhost:8081",
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"ssl_min_version must be 1.2 or 1.3: 1.1",
+			"insecure ssl_cipher_suites entry: TLS_RSA_WITH_RC4_128_SHA",
+			"ssl_cipher_suites entry is a TLS 1.3 suite, which isn't " +
+				"configurable: TLS_AES_128_GCM_SHA256",
+			"unknown ssl_cipher_suites entry: TLS_NO_SUCH_SUITE",
+			"ssl_curve_preferences entry must be X25519, P-256, P-384, " +
+				"or P-521: P-224",
+		})))
+
+		opts.SslMinVersion = "1.3"
+		opts.SslCipherSuites = []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		}
+		opts.SslCurvePreferences = nil
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"ssl_cipher_suites has no effect with ssl_min_version 1.3",
+		})))
+	})
+
+	Context("when the certificate is renewed", func() {
+		var reloader *certificateReloader
+		var renewed time.Time
+
+		// touch advances the modification times of the files, which may
+		// otherwise be unchanged at the resolution of the file system.
+		touch := func() {
+			renewed = renewed.Add(time.Minute)
+			Expect(os.Chtimes(leaf.CertFile, renewed, renewed)).To(
+				Succeed())
+			Expect(os.Chtimes(leaf.KeyFile, renewed, renewed)).To(
+				Succeed())
+		}
+
+		BeforeEach(func() {
+			opts := &AuthDelegateOptions{SslCertReloadInterval: "0s"}
+			Expect(validateSsl(opts, nil)).To(BeEmpty())
+			var err error
+			reloader, err = newCertificateReloader("ssl_cert",
+				leaf.CertFile, leaf.KeyFile, opts)
+			Expect(err).To(BeNil())
+			renewed = time.Now()
+		})
+
+		It("should serve the renewed certificate", func() {
+			previous := reloader.getServerCertificate()
+			reloader.check()
+			Expect(reloader.getServerCertificate()).To(Equal(previous))
+
+			leaf = issueTestCertificate(dir, "leaf", 2*time.Hour, ca,
+				func(template *x509.Certificate) {
+					template.IsCA = false
+				})
+			touch()
+			reloader.check()
+			served, err := reloader.getCertificate(nil)
+			Expect(err).To(BeNil())
+			Expect(served.Leaf.Equal(leaf.Cert)).To(BeTrue())
+			Expect(reloader.daysToExpiry()).To(
+				BeNumerically("~", 2.0/24, 0.001))
+			_, open := <-previous.retired
+			Expect(open).To(BeFalse())
+		})
+
+		It("should keep serving the certificate if the renewal is "+
+			"invalid", func() {
+			writePEM(leaf.CertFile, "CERTIFICATE", ca.Cert.Raw)
+			touch()
+			reloader.check()
+			served, err := reloader.getCertificate(nil)
+			Expect(err).To(BeNil())
+			Expect(served.Leaf.Equal(leaf.Cert)).To(BeTrue())
+		})
+
+		It("should fail validation for an invalid interval", func() {
+			opts := &AuthDelegateOptions{SslCertReloadInterval: "-1m"}
+			Expect(validateSsl(opts, nil)).To(Equal([]string{
+				"invalid ssl_cert_reload_interval: -1m",
+			}))
+			opts.SslCertReloadInterval = "30s"
+			Expect(validateSsl(opts, nil)).To(BeEmpty())
+			Expect(opts.sslCertReloadInterval).To(
+				Equal(30 * time.Second))
+		})
+	})
+
+	Context("with OCSP stapling", func() {
+		var responder *httptest.Server
+		var signer *testCertificate
+		var revoked bool
+		var certificate *serverCertificate
+
+		// respond returns a response signed by signer to the encoded
+		// request.
+		respond := func(request []byte) []byte {
+			decoded, err := ocsp.ParseRequest(request)
+			Expect(err).To(BeNil())
+			now := time.Now().UTC().Truncate(time.Second)
+			template := ocsp.Response{
+				Status:       ocsp.Good,
+				SerialNumber: decoded.SerialNumber,
+				IssuerHash:   decoded.HashAlgorithm,
+				ThisUpdate:   now,
+				NextUpdate:   now.Add(time.Hour),
+			}
+			if revoked {
+				template.Status = ocsp.Revoked
+				template.RevokedAt = now
+			}
+			if signer != ca {
+				template.Certificate = signer.Cert
+			}
+			encoded, err := ocsp.CreateResponse(ca.Cert, signer.Cert,
+				template, signer.Key)
+			Expect(err).To(BeNil())
+			return encoded
+		}
+
+		BeforeEach(func() {
+			signer, revoked = ca, false
+			responder = httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					defer GinkgoRecover()
+					Expect(req.Method).To(Equal("POST"))
+					Expect(req.Header.Get("Content-Type")).To(
+						Equal("application/ocsp-request"))
+					request, _ := ioutil.ReadAll(req.Body)
+					rw.Header().Set("Content-Type",
+						"application/ocsp-response")
+					rw.Write(respond(request))
+				}))
+			leaf = issueTestCertificate(dir, "leaf", time.Hour, ca,
+				func(template *x509.Certificate) {
+					template.IsCA = false
+					template.OCSPServer = []string{responder.URL}
+				})
+			var err error
+			certificate, err = loadServerCertificate(leaf.CertFile,
+				leaf.KeyFile)
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			responder.Close()
+		})
+
+		It("should staple a good response signed by the issuer", func() {
+			response, status, err := certificate.fetchOCSP()
+			Expect(err).To(BeNil())
+			Expect(status.Status).To(Equal(ocsp.Good))
+			Expect(status.NextUpdate).To(BeTemporally(">", time.Now()))
+			certificate.staple(response)
+
+			listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+				GetCertificate: certificate.getCertificate,
+			})
+			Expect(err).To(BeNil())
+			defer listener.Close()
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					conn.(*tls.Conn).Handshake()
+					conn.Close()
+				}
+			}()
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Cert)
+			conn, err := tls.Dial("tcp", listener.Addr().String(),
+				&tls.Config{RootCAs: roots})
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			Expect(conn.ConnectionState().OCSPResponse).To(Equal(response))
+		})
+
+		It("should accept a response from a delegated responder", func() {
+			signer = issueTestCertificate(dir, "responder", time.Hour, ca,
+				func(template *x509.Certificate) {
+					template.IsCA = false
+					template.ExtKeyUsage = []x509.ExtKeyUsage{
+						x509.ExtKeyUsageOCSPSigning}
+				})
+			_, _, err := certificate.fetchOCSP()
+			Expect(err).To(BeNil())
+		})
+
+		It("should reject a responder not authorized to sign", func() {
+			signer = issueTestCertificate(dir, "responder", time.Hour, ca,
+				func(template *x509.Certificate) {
+					template.IsCA = false
+				})
+			_, _, err := certificate.fetchOCSP()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal("invalid response from " +
+				responder.URL + ": responder certificate is not " +
+				"authorized for OCSP signing"))
+		})
+
+		It("should reject a response not signed by the issuer", func() {
+			signer = writeTestCertificate(dir, "other", time.Hour)
+			_, _, err := certificate.fetchOCSP()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(HavePrefix("invalid response from " +
+				responder.URL + ": bad OCSP signature: "))
+		})
+
+		It("should reject a revoked certificate", func() {
+			revoked = true
+			_, _, err := certificate.fetchOCSP()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal("invalid response from " +
+				responder.URL + ": certificate status is not good"))
+		})
+	})
+})
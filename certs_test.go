@@ -0,0 +1,102 @@
+package authdelegate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// testCertificate is a certificate, valid for 127.0.0.1, whose PEM-encoded
+// certificate chain and key have been written to CertFile and KeyFile.
+type testCertificate struct {
+	Cert     *x509.Certificate
+	Key      *ecdsa.PrivateKey
+	CertFile string
+	KeyFile  string
+}
+
+// writeTestCertificate creates a self-signed testCertificate in dir that
+// expires after validFor.
+func writeTestCertificate(dir, name string,
+	validFor time.Duration) *testCertificate {
+	return issueTestCertificate(dir, name, validFor, nil,
+		func(*x509.Certificate) {})
+}
+
+// issueTestCertificate creates a testCertificate in dir that expires after
+// validFor, signed by issuer, whose certificate follows it in CertFile, or
+// self-signed if issuer is nil. customize may modify the template before it
+// is signed.
+func issueTestCertificate(dir, name string, validFor time.Duration,
+	issuer *testCertificate,
+	customize func(*x509.Certificate)) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	customize(template)
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.Cert, issuer.Key
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		panic(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	result := &testCertificate{
+		Cert:     cert,
+		Key:      key,
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	chain := [][]byte{der}
+	if issuer != nil {
+		chain = append(chain, issuer.Cert.Raw)
+	}
+	writePEM(result.CertFile, "CERTIFICATE", chain...)
+	writePEM(result.KeyFile, "EC PRIVATE KEY", keyDer)
+	return result
+}
+
+// writePEM writes each of ders to path as a PEM block of blockType.
+func writePEM(path, blockType string, ders ...[]byte) {
+	var data []byte
+	for _, der := range ders {
+		data = append(data, pem.EncodeToMemory(
+			&pem.Block{Type: blockType, Bytes: der})...)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,223 @@
+package authdelegate
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults of an upstream's circuit_breaker options
+const (
+	defaultCircuitFailures    = 5
+	defaultCircuitMinRequests = 20
+	defaultCircuitWindow      = 10 * time.Second
+	defaultCircuitCoolDown    = 30 * time.Second
+)
+
+// States of a circuitBreaker
+const (
+	// Requests are sent to the upstream
+	circuitClosed = iota
+
+	// Requests are refused until the cool-down period has passed
+	circuitOpen
+
+	// A single trial request has been sent to the upstream, whose result
+	// closes or reopens the circuit; other requests are refused meanwhile
+	circuitHalfOpen
+)
+
+// circuitBreaker stops sending requests to an upstream that fails
+// repeatedly, so that a struggling auth backend isn't buried under retries
+// and callers aren't kept waiting for it, until a trial request after a
+// cool-down period succeeds. An upstream fails if it can't be reached, times
+// out, or returns a 5xx status. Its state is reset when the configuration is
+// reloaded.
+type circuitBreaker struct {
+	upstream            string
+	consecutiveFailures int
+	failureRate         float64
+	minRequests         int
+	window              time.Duration
+	coolDown            time.Duration
+
+	mutex    sync.Mutex
+	state    int
+	openedAt time.Time
+
+	// Failures in a row, and the requests and failures since windowStart
+	failures       int
+	windowStart    time.Time
+	windowRequests int
+	windowFailures int
+}
+
+// newCircuitBreaker returns nil if upstream doesn't define a circuit
+// breaker.
+func newCircuitBreaker(upstream *AuthDelegateUpstream) *circuitBreaker {
+	config := upstream.CircuitBreaker
+	if config == nil {
+		return nil
+	}
+	return &circuitBreaker{
+		upstream:            upstreamLabel(upstream),
+		consecutiveFailures: config.ConsecutiveFailures,
+		failureRate:         config.FailureRate,
+		minRequests:         config.MinRequests,
+		window:              config.window,
+		coolDown:            config.coolDown,
+	}
+}
+
+// inherit continues the state of previous, the breaker of the same upstream
+// in the routing table being replaced, so that replacing the table doesn't
+// close an open circuit.
+func (breaker *circuitBreaker) inherit(previous *circuitBreaker) {
+	if breaker == nil || previous == nil {
+		return
+	}
+	previous.mutex.Lock()
+	defer previous.mutex.Unlock()
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.state = previous.state
+	breaker.openedAt = previous.openedAt
+	breaker.failures = previous.failures
+	breaker.windowStart = previous.windowStart
+	breaker.windowRequests = previous.windowRequests
+	breaker.windowFailures = previous.windowFailures
+}
+
+// isOpen returns true unless the circuit is closed.
+func (breaker *circuitBreaker) isOpen() bool {
+	return breaker.stateName() != "closed"
+}
+
+// stateName returns "closed", "open", or "half_open".
+func (breaker *circuitBreaker) stateName() string {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// allow returns true if a request may be sent to the upstream, after which
+// its result must be passed to record. Once the cool-down period has passed,
+// the first request allowed is the trial.
+func (breaker *circuitBreaker) allow(now time.Time) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case circuitOpen:
+		if now.Sub(breaker.openedAt) < breaker.coolDown {
+			return false
+		}
+		breaker.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		return false
+	}
+	return true
+}
+
+// record updates the circuit with the result of a request that allow
+// permitted.
+func (breaker *circuitBreaker) record(now time.Time, failed bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	switch breaker.state {
+	case circuitHalfOpen:
+		if failed {
+			breaker.open(now, "trial request failed")
+			return
+		}
+		log.Printf("circuit breaker closed: upstream %s recovered after "+
+			"%s", breaker.upstream,
+			now.Sub(breaker.openedAt).Round(time.Second))
+		breaker.state = circuitClosed
+		breaker.failures = 0
+		breaker.windowStart = now
+		breaker.windowRequests, breaker.windowFailures = 0, 0
+		return
+	case circuitOpen:
+		// Sent before the circuit opened
+		return
+	}
+
+	if now.Sub(breaker.windowStart) >= breaker.window {
+		breaker.windowStart = now
+		breaker.windowRequests, breaker.windowFailures = 0, 0
+	}
+	breaker.windowRequests++
+	if !failed {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	breaker.windowFailures++
+	if breaker.failures >= breaker.consecutiveFailures {
+		breaker.open(now, fmt.Sprintf("failed %d times in a row",
+			breaker.failures))
+	} else if breaker.failureRate != 0 &&
+		breaker.windowRequests >= breaker.minRequests &&
+		float64(breaker.windowFailures) >=
+			breaker.failureRate*float64(breaker.windowRequests) {
+		breaker.open(now, fmt.Sprintf("failed %d of %d requests",
+			breaker.windowFailures, breaker.windowRequests))
+	}
+}
+
+// open opens the circuit; the caller must hold the mutex.
+func (breaker *circuitBreaker) open(now time.Time, reason string) {
+	log.Printf("circuit breaker open: upstream %s %s; refusing requests "+
+		"for %s", breaker.upstream, reason, breaker.coolDown)
+	breaker.state = circuitOpen
+	breaker.openedAt = now
+}
+
+// circuitBreakerHandler refuses requests to an upstream while its circuit is
+// open, with ErrCircuitOpen, or with status if it allows them instead.
+type circuitBreakerHandler struct {
+	breaker      *circuitBreaker
+	handler      http.Handler
+	errorHandler ErrorHandler
+	status       int
+}
+
+func newCircuitBreakerHandler(upstream *AuthDelegateUpstream,
+	opts *AuthDelegateOptions, breaker *circuitBreaker,
+	handler http.Handler) *circuitBreakerHandler {
+	return &circuitBreakerHandler{
+		breaker:      breaker,
+		handler:      handler,
+		errorHandler: opts.errorHandler(),
+		status:       upstream.CircuitBreaker.Status,
+	}
+}
+
+func (circuit *circuitBreakerHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	if !circuit.breaker.allow(time.Now()) {
+		if circuit.status/100 == 2 {
+			rw.Header().Set(failOpenHeader, circuit.breaker.upstream)
+			rw.WriteHeader(circuit.status)
+			return
+		}
+		circuit.errorHandler(rw, req, &DelegateError{
+			Code: ErrCircuitOpen, Upstream: circuit.breaker.upstream,
+		})
+		return
+	}
+	recorder := &statusRecorder{rw, http.StatusOK}
+	circuit.handler.ServeHTTP(recorder, req)
+	circuit.breaker.record(time.Now(),
+		recorder.status >= http.StatusInternalServerError ||
+			rw.Header().Get(failOpenHeader) != "")
+}
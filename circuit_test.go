@@ -0,0 +1,146 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Circuit breakers", func() {
+	var server *httptest.Server
+	var failing, requests int32
+	var opts *AuthDelegateOptions
+	var handler http.Handler
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&failing, 1)
+		atomic.StoreInt32(&requests, 0)
+		handler = nil
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				if atomic.LoadInt32(&failing) == 1 {
+					rw.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL: server.URL,
+					CircuitBreaker: &AuthDelegateCircuitBreaker{
+						ConsecutiveFailures: 2,
+						CoolDown:            "50ms",
+					},
+				},
+			},
+			MetricsPath: "/metrics",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		if handler == nil {
+			Expect(opts.Validate()).To(BeNil())
+			handler = NewAuthDelegate(opts)
+		}
+		req, _ := http.NewRequest("GET", "http://delegate"+path, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	authorize := func() int {
+		return serve("/").Code
+	}
+
+	It("should refuse requests after consecutive failures", func() {
+		Expect(authorize()).To(Equal(http.StatusInternalServerError))
+		Expect(authorize()).To(Equal(http.StatusInternalServerError))
+		Expect(authorize()).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+		Expect(serve("/metrics").Body.String()).To(ContainSubstring(
+			`authdelegate_upstream_circuit_open{upstream="` +
+				server.URL + `"} 1`))
+
+		atomic.StoreInt32(&failing, 0)
+		Eventually(authorize).Should(Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+		Expect(serve("/metrics").Body.String()).To(ContainSubstring(
+			`authdelegate_upstream_circuit_open{upstream="` +
+				server.URL + `"} 0`))
+	})
+
+	It("should reopen if the trial request fails", func() {
+		authorize()
+		authorize()
+		time.Sleep(60 * time.Millisecond)
+		Expect(authorize()).To(Equal(http.StatusInternalServerError))
+		Expect(authorize()).To(Equal(http.StatusServiceUnavailable))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+	})
+
+	It("should open once the failure rate is reached", func() {
+		opts.Upstreams[0].CircuitBreaker = &AuthDelegateCircuitBreaker{
+			ConsecutiveFailures: 100,
+			FailureRate:         0.5,
+			MinRequests:         4,
+		}
+		for i := 0; i != 4; i++ {
+			atomic.StoreInt32(&failing, int32(i%2))
+			authorize()
+		}
+		atomic.StoreInt32(&failing, 0)
+		Expect(authorize()).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should allow requests while open if configured to", func() {
+		opts.Upstreams[0].CircuitBreaker.Status = http.StatusAccepted
+		authorize()
+		authorize()
+		recorder := serve("/")
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get(failOpenHeader)).To(
+			Equal(server.URL))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].CircuitBreaker = &AuthDelegateCircuitBreaker{
+			ConsecutiveFailures: -1,
+			FailureRate:         1.5,
+			CoolDown:            "a while",
+			Status:              http.StatusUnauthorized,
+		}
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			Type:           "static_tokens",
+			Name:           "tokens",
+			HeaderName:     "X-Api-Key",
+			TokenHashes:    []string{hashCredential("token")},
+			CircuitBreaker: &AuthDelegateCircuitBreaker{},
+		})
+		opts.Upstreams[0], opts.Upstreams[1] = opts.Upstreams[1],
+			opts.Upstreams[0]
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"circuit_breaker requires an http or https url: " +
+				"static:tokens",
+			"invalid circuit_breaker cool_down for " + server.URL +
+				": a while",
+			"circuit_breaker consecutive_failures and min_requests " +
+				"must be positive: " + server.URL,
+			"circuit_breaker failure_rate must be between 0 and 1: " +
+				server.URL,
+			"circuit_breaker status must be 503 or 2xx for " +
+				server.URL + ": 401",
+		})))
+	})
+})
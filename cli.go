@@ -0,0 +1,258 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Exit statuses of the authdelegate command, on which automation may rely
+const (
+	ExitOK = 0
+
+	// The configuration is invalid, or the server failed
+	ExitFailure = 1
+
+	// The command line is invalid
+	ExitUsage = 2
+
+	// The configuration file couldn't be read, or a remote configuration
+	// couldn't be fetched or verified
+	ExitUnreadableConfig = 3
+
+	// -check couldn't reach an upstream, or no upstream accepts the request
+	// of -explain
+	ExitUnsatisfied = 4
+)
+
+// Output formats selected by -o
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+// validationResult is the output of -validate in JSON format.
+type validationResult struct {
+	Config      string   `json:"config"`
+	Valid       bool     `json:"valid"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	Errors      []string `json:"errors"`
+	Warnings    []string `json:"warnings"`
+}
+
+// RunValidate validates and lints the configuration at configPath with the
+// overrides of profile, writes the result to w in format, and returns the
+// exit status.
+func RunValidate(w io.Writer, format, configPath, profile string) int {
+	result, _, status, err := validateConfig(configPath, profile)
+	if format == OutputJSON {
+		writeCLIJSON(w, result)
+	} else {
+		writeValidation(w, configPath, result, status, err)
+	}
+	return status
+}
+
+// validateConfig reads, validates, and lints the configuration at configPath
+// with the overrides of profile, returning the result, the options if they
+// are valid, the exit status, and any error.
+func validateConfig(configPath, profile string) (validationResult,
+	*AuthDelegateOptions, int, error) {
+	result := validationResult{
+		Config: configPath, Errors: []string{}, Warnings: []string{},
+	}
+	configName, config, err := readConfig(configPath)
+	var opts *AuthDelegateOptions
+	if err != nil {
+		result.Errors = append(result.Errors, "reading: "+err.Error())
+		return result, nil, ExitUnreadableConfig, err
+	} else if opts, err = parseOptions(configName, profile,
+		config); err != nil {
+		result.Errors = append(result.Errors, optionMessages(err)...)
+		return result, nil, ExitFailure, err
+	} else if err = validateServerCertificate(opts); err != nil {
+		result.Errors = append(result.Errors, err.Error())
+		return result, nil, ExitFailure, err
+	}
+	result.Valid = true
+	result.Fingerprint = opts.Fingerprint()
+	result.Warnings = append(result.Warnings, opts.Lint()...)
+	return result, opts, ExitOK, nil
+}
+
+// writeValidation writes result, with its exit status and error, to w as
+// text.
+func writeValidation(w io.Writer, configPath string, result validationResult,
+	status int, err error) {
+	switch status {
+	case ExitUnreadableConfig:
+		fmt.Fprintf(w, "Error reading %s: %s\n", configPath, err)
+	case ExitFailure:
+		fmt.Fprintf(w, "Error parsing %s: %s\n", configPath, err)
+	default:
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(w, "Warning: %s: %s\n", configPath, warning)
+		}
+		fmt.Fprintf(w, "%s: configuration is valid\n", configPath)
+	}
+}
+
+// checkResult is the output of -check in JSON format.
+type checkResult struct {
+	validationResult
+	Unreachable []string `json:"unreachable"`
+}
+
+// RunCheck validates the configuration at configPath with the overrides of
+// profile, as RunValidate does, then connects to each upstream as the
+// readiness check of readiness_check_upstreams does, writes the result to w
+// in format, and returns the exit status.
+func RunCheck(w io.Writer, format, configPath, profile string) int {
+	validation, opts, status, err := validateConfig(configPath, profile)
+	result := checkResult{validation, []string{}}
+	if opts != nil {
+		table := newRoutingTable(opts)
+		result.Unreachable = table.unreachableUpstreams()
+		if len(result.Unreachable) != 0 {
+			status = ExitUnsatisfied
+		}
+	}
+	if format == OutputJSON {
+		writeCLIJSON(w, result)
+		return status
+	}
+	writeValidation(w, configPath, validation, status, err)
+	for _, failure := range result.Unreachable {
+		fmt.Fprintf(w, "Error: %s: %s\n", configPath, failure)
+	}
+	if opts != nil && status == ExitOK {
+		fmt.Fprintf(w, "%s: all upstreams are reachable\n", configPath)
+	}
+	return status
+}
+
+// ExplainRequest describes the request of which -explain reports the routing.
+type ExplainRequest struct {
+	Method string
+	Host   string
+	URI    string
+
+	// Each as "Name: value"
+	Headers []string
+}
+
+// explanationResult is the output of -explain in JSON format.
+type explanationResult struct {
+	Config string `json:"config"`
+
+	// The upstream that decides the request, or empty if none does
+	Upstream    string            `json:"upstream"`
+	Evaluations []matchEvaluation `json:"evaluations"`
+	Errors      []string          `json:"errors"`
+}
+
+// RunExplain reports to w in format the upstream of the configuration at
+// configPath, with the overrides of profile, that would decide request, and
+// why each upstream evaluated before it doesn't, and returns the exit status.
+func RunExplain(w io.Writer, format, configPath, profile string,
+	request ExplainRequest) int {
+	result := explanationResult{
+		Config: configPath, Evaluations: []matchEvaluation{},
+		Errors: []string{},
+	}
+	validation, opts, status, err := validateConfig(configPath, profile)
+	var req *http.Request
+	if opts != nil {
+		if req, err = request.newRequest(); err != nil {
+			status = ExitUsage
+			validation.Errors = append(validation.Errors,
+				err.Error())
+		}
+	}
+	result.Errors = validation.Errors
+	if req != nil {
+		table := newRoutingTable(opts)
+		trace := &requestTrace{recordMatches: true}
+		upstream := table.selectUpstream(req, trace)
+		if upstream != nil {
+			result.Upstream = upstream.name
+		} else {
+			status = ExitUnsatisfied
+		}
+		result.Evaluations = append(result.Evaluations,
+			trace.matches...)
+	}
+
+	if format == OutputJSON {
+		writeCLIJSON(w, result)
+		return status
+	} else if req == nil {
+		if status == ExitUsage {
+			fmt.Fprintf(w, "Error: %s\n", err)
+		} else {
+			writeValidation(w, configPath, validation, status, err)
+		}
+		return status
+	}
+	for _, evaluation := range result.Evaluations {
+		fmt.Fprintf(w, "%s: %s (%s)\n", evaluation.Upstream,
+			evaluation.Result, evaluation.Reason)
+	}
+	if result.Upstream == "" {
+		fmt.Fprintf(w, "%s: no upstream accepts the request\n",
+			configPath)
+	}
+	return status
+}
+
+// newRequest returns the authorization request nginx would make for the
+// request.
+func (request ExplainRequest) newRequest() (*http.Request, error) {
+	req, err := http.NewRequest(request.Method, "http://authdelegate/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = request.Host
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set("X-Original-URI", request.URI)
+	for _, header := range request.Headers {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf(
+				"header must be \"Name: value\": %s", header)
+		}
+		req.Header.Add(strings.TrimSpace(name),
+			strings.TrimSpace(value))
+	}
+	return req, nil
+}
+
+// optionMessages splits an error returned by Validate into its messages.
+func optionMessages(err error) []string {
+	const prefix = "Invalid options:\n  "
+	if message := err.Error(); strings.HasPrefix(message, prefix) {
+		return strings.Split(message[len(prefix):], "\n  ")
+	}
+	return []string{err.Error()}
+}
+
+// RunVersion writes the version information to w in format and returns the
+// exit status.
+func RunVersion(w io.Writer, format string) int {
+	info := currentVersionInfo()
+	if format == OutputJSON {
+		writeCLIJSON(w, info)
+	} else {
+		fmt.Fprintf(w, "authdelegate %s (%s)\n", info.Version,
+			info.GoVersion)
+	}
+	return ExitOK
+}
+
+func writeCLIJSON(w io.Writer, value interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
@@ -0,0 +1,173 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+var _ = Describe("Command line", func() {
+	var dir, configPath string
+	var output *bytes.Buffer
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "cli")
+		Expect(err).To(BeNil())
+		configPath = filepath.Join(dir, "config.yaml")
+		output = &bytes.Buffer{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeConfig := func(config string) {
+		Expect(ioutil.WriteFile(configPath, []byte(config),
+			0600)).To(Succeed())
+	}
+
+	validationJSON := func(format string) (int, *validationResult) {
+		status := RunValidate(output, format, configPath, "")
+		result := &validationResult{}
+		Expect(json.Unmarshal(output.Bytes(), result)).To(Succeed())
+		return status, result
+	}
+
+	It("should report a valid configuration and its warnings", func() {
+		writeConfig("port: 8080\nupstreams:\n  - url: http://foo.com/auth\n")
+		Expect(RunValidate(output, OutputText, configPath, "")).
+			To(Equal(ExitOK))
+		Expect(output.String()).To(Equal("Warning: " + configPath +
+			": upstream http://foo.com/auth uses plaintext HTTP to a " +
+			"remote host; credentials will be sent unencrypted; use " +
+			"https instead\n" + configPath + ": configuration is valid\n"))
+	})
+
+	It("should report a valid configuration as JSON", func() {
+		config := "port: 8080\nupstreams:\n  - url: https://foo.com/auth\n"
+		writeConfig(config)
+		status, result := validationJSON(OutputJSON)
+		Expect(status).To(Equal(ExitOK))
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(config))
+		Expect(err).To(BeNil())
+		Expect(result).To(Equal(&validationResult{
+			Config:      configPath,
+			Valid:       true,
+			Fingerprint: opts.Fingerprint(),
+			Errors:      []string{},
+			Warnings:    []string{},
+		}))
+	})
+
+	It("should report each validation error as JSON", func() {
+		writeConfig("port: 0\nupstreams:\n  - url: ftp://foo.com/auth\n")
+		status, result := validationJSON(OutputJSON)
+		Expect(status).To(Equal(ExitFailure))
+		Expect(result.Valid).To(BeFalse())
+		Expect(result.Fingerprint).To(Equal(""))
+		Expect(result.Errors).To(Equal([]string{
+			"port must be specified and greater than zero",
+			"invalid upstream scheme: ftp://foo.com/auth",
+		}))
+	})
+
+	It("should exit with a distinct status if unreadable", func() {
+		status, result := validationJSON(OutputJSON)
+		Expect(status).To(Equal(ExitUnreadableConfig))
+		Expect(result.Errors).To(Equal([]string{"reading: open " +
+			configPath + ": no such file or directory"}))
+
+		output.Reset()
+		Expect(RunValidate(output, OutputText, configPath, "")).
+			To(Equal(ExitUnreadableConfig))
+		Expect(output.String()).To(Equal("Error reading " + configPath +
+			": open " + configPath + ": no such file or directory\n"))
+	})
+
+	It("should check that each upstream is reachable", func() {
+		server := httptest.NewServer(http.NotFoundHandler())
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		writeConfig("port: 8080\nupstreams:\n" +
+			"  - url: " + server.URL + "\n    name: up\n" +
+			"    header_name: X-Api-Key\n")
+		Expect(RunCheck(output, OutputText, configPath, "")).
+			To(Equal(ExitOK))
+		Expect(output.String()).To(Equal(configPath +
+			": configuration is valid\n" + configPath +
+			": all upstreams are reachable\n"))
+
+		server.Close()
+		writeConfig("port: 8080\nupstreams:\n" +
+			"  - url: " + closed.URL + "\n    name: down\n")
+		output.Reset()
+		Expect(RunCheck(output, OutputJSON, configPath, "")).
+			To(Equal(ExitUnsatisfied))
+		result := &checkResult{}
+		Expect(json.Unmarshal(output.Bytes(), result)).To(Succeed())
+		Expect(result.Valid).To(BeTrue())
+		Expect(result.Unreachable).To(HaveLen(1))
+		Expect(result.Unreachable[0]).To(HavePrefix(
+			"upstream down unreachable: "))
+	})
+
+	It("should explain which upstream decides a request", func() {
+		writeConfig("port: 8080\nupstreams:\n" +
+			"  - url: https://api.example.gov/auth\n    name: api\n" +
+			"    header_name: X-Api-Key\n" +
+			"  - url: https://sso.example.gov/auth\n    name: sso\n" +
+			"    cookie_name: _session\n")
+		request := ExplainRequest{
+			Method: "GET", Host: "example.gov", URI: "/",
+			Headers: []string{"Cookie: _session=abc"},
+		}
+		Expect(RunExplain(output, OutputText, configPath, "",
+			request)).To(Equal(ExitOK))
+		Expect(output.String()).To(Equal(
+			"api: miss (header X-Api-Key absent)\n" +
+				"sso: match (cookie _session present)\n"))
+
+		output.Reset()
+		request.Headers = nil
+		Expect(RunExplain(output, OutputJSON, configPath, "",
+			request)).To(Equal(ExitUnsatisfied))
+		result := &explanationResult{}
+		Expect(json.Unmarshal(output.Bytes(), result)).To(Succeed())
+		Expect(result).To(Equal(&explanationResult{
+			Config: configPath,
+			Evaluations: []matchEvaluation{
+				{"api", "miss", "header X-Api-Key absent"},
+				{"sso", "miss", "cookie _session absent"},
+			},
+			Errors: []string{},
+		}))
+
+		output.Reset()
+		request.Headers = []string{"X-Api-Key"}
+		Expect(RunExplain(output, OutputText, configPath, "",
+			request)).To(Equal(ExitUsage))
+		Expect(output.String()).To(Equal(
+			"Error: header must be \"Name: value\": X-Api-Key\n"))
+	})
+
+	It("should print the version", func() {
+		Expect(RunVersion(output, OutputText)).To(Equal(ExitOK))
+		Expect(output.String()).To(Equal("authdelegate dev (" +
+			runtime.Version() + ")\n"))
+
+		output.Reset()
+		Expect(RunVersion(output, OutputJSON)).To(Equal(ExitOK))
+		var info versionInfo
+		Expect(json.Unmarshal(output.Bytes(), &info)).To(Succeed())
+		Expect(info.Version).To(Equal("dev"))
+		Expect(info.GoVersion).To(Equal(runtime.Version()))
+	})
+})
@@ -0,0 +1,37 @@
+package authdelegate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// clientCertHeaderPrefix prefixes the headers describing the client
+// certificate forwarded to upstreams if require_client_cert is true.
+const clientCertHeaderPrefix = "X-Client-Cert-"
+
+// setClientCertHeaders replaces any X-Client-Cert-* headers of req, which
+// callers could otherwise forge, with the details of the verified
+// certificate the client presented.
+func setClientCertHeaders(req *http.Request) {
+	for name := range req.Header {
+		if strings.HasPrefix(name, clientCertHeaderPrefix) {
+			req.Header.Del(name)
+		}
+	}
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	req.Header.Set(clientCertHeaderPrefix+"Subject", cert.Subject.String())
+	req.Header.Set(clientCertHeaderPrefix+"Issuer", cert.Issuer.String())
+	req.Header.Set(clientCertHeaderPrefix+"Serial",
+		cert.SerialNumber.Text(16))
+	req.Header.Set(clientCertHeaderPrefix+"Fingerprint",
+		hex.EncodeToString(fingerprint[:]))
+	req.Header.Set(clientCertHeaderPrefix+"Not-After",
+		cert.NotAfter.UTC().Format(time.RFC3339))
+}
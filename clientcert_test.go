@@ -0,0 +1,251 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+var _ = Describe("Client certificates", func() {
+	var dir string
+	var ca, clientCert *testCertificate
+	var upstream *httptest.Server
+	var forwarded http.Header
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "clientcert")
+		Expect(err).To(BeNil())
+		ca = writeTestCertificate(dir, "ca", time.Hour)
+		server := issueTestCertificate(dir, "server", time.Hour, ca,
+			func(template *x509.Certificate) { template.IsCA = false })
+		clientCert = issueTestCertificate(dir, "client", time.Hour, ca,
+			func(template *x509.Certificate) { template.IsCA = false })
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				forwarded = req.Header
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+		opts = &AuthDelegateOptions{
+			Port:              8080,
+			SslCert:           server.CertFile,
+			SslKey:            server.KeyFile,
+			RequireClientCert: true,
+			ClientCAFile:      ca.CertFile,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: upstream.URL,
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		os.RemoveAll(dir)
+	})
+
+	// serve starts the delegate on a local listener, and returns its URL
+	// and a function that stops it.
+	serve := func() (string, func()) {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		server := &http.Server{Handler: delegate}
+		Expect(serveCertificate(delegate, server, opts)).To(Succeed())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		go server.ServeTLS(listener, "", "")
+		return "https://" + listener.Addr().String(),
+			func() { server.Close() }
+	}
+
+	client := func(certs ...*testCertificate) *http.Client {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.Cert)
+		config := &tls.Config{RootCAs: roots}
+		for _, cert := range certs {
+			keyPair, err := tls.LoadX509KeyPair(cert.CertFile,
+				cert.KeyFile)
+			Expect(err).To(BeNil())
+			config.Certificates = append(config.Certificates, keyPair)
+		}
+		return &http.Client{
+			Transport: &http.Transport{TLSClientConfig: config},
+		}
+	}
+
+	It("should forward the details of the client certificate", func() {
+		url, stop := serve()
+		defer stop()
+		req, _ := http.NewRequest("GET", url+"/foo", nil)
+		req.Header.Set("X-Client-Cert-Subject", "CN=admin")
+		req.Header.Set("X-Client-Cert-Forged", "true")
+		res, err := client(clientCert).Do(req)
+		Expect(err).To(BeNil())
+		res.Body.Close()
+		Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+		Expect(forwarded.Get("X-Client-Cert-Subject")).To(Equal("CN=client"))
+		Expect(forwarded.Get("X-Client-Cert-Issuer")).To(Equal("CN=ca"))
+		Expect(forwarded.Get("X-Client-Cert-Serial")).To(Equal(
+			clientCert.Cert.SerialNumber.Text(16)))
+		Expect(forwarded.Get("X-Client-Cert-Fingerprint")).To(
+			MatchRegexp("^[0-9a-f]{64}$"))
+		Expect(forwarded.Get("X-Client-Cert-Not-After")).To(Equal(
+			clientCert.Cert.NotAfter.UTC().Format(time.RFC3339)))
+		Expect(forwarded).ToNot(HaveKey("X-Client-Cert-Forged"))
+	})
+
+	It("should reject clients without a certificate", func() {
+		url, stop := serve()
+		defer stop()
+		_, err := client().Get(url + "/foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should reject a certificate from another CA", func() {
+		url, stop := serve()
+		defer stop()
+		other := writeTestCertificate(dir, "other", time.Hour)
+		_, err := client(other).Get(url + "/foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should remove forged headers from requests without TLS", func() {
+		req, _ := http.NewRequest("GET", "http://delegate/foo", nil)
+		req.Header.Set("X-Client-Cert-Subject", "CN=admin")
+		setClientCertHeaders(req)
+		Expect(req.Header).To(BeEmpty())
+	})
+
+	Context("on additional listeners", func() {
+		var server *testCertificate
+
+		BeforeEach(func() {
+			server = issueTestCertificate(dir, "listener", time.Hour, ca,
+				func(template *x509.Certificate) {
+					template.IsCA = false
+				})
+		})
+
+		// serveListener starts the delegate on a local listener with
+		// the TLS settings of the listener of opts at index, and returns
+		// its URL and a function that stops it.
+		serveListener := func(index int) (string, func()) {
+			Expect(opts.Validate()).To(BeNil())
+			delegate := NewAuthDelegate(opts)
+			main := &http.Server{Handler: delegate}
+			Expect(serveCertificate(delegate, main, opts)).To(Succeed())
+			server, err := newListenerServer(main, opts.Listeners[index],
+				opts)
+			Expect(err).To(BeNil())
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).To(BeNil())
+			if server.TLSConfig == nil {
+				go server.Serve(listener)
+				return "http://" + listener.Addr().String(),
+					func() { server.Close() }
+			}
+			go server.ServeTLS(listener, "", "")
+			return "https://" + listener.Addr().String(),
+				func() { server.Close() }
+		}
+
+		It("should serve plaintext or override the requirement", func() {
+			optional := false
+			opts.Listeners = []*AuthDelegateListener{
+				{Name: "local", Address: "127.0.0.1:0",
+					Plaintext: true},
+				{Name: "partner", Address: "127.0.0.1:0",
+					RequireClientCert: &optional},
+			}
+			for i := range opts.Listeners {
+				url, stop := serveListener(i)
+				req, _ := http.NewRequest("GET", url+"/foo", nil)
+				req.Header.Set("X-Client-Cert-Subject", "CN=admin")
+				res, err := client().Do(req)
+				stop()
+				Expect(err).To(BeNil())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+				Expect(forwarded).ToNot(
+					HaveKey("X-Client-Cert-Subject"))
+			}
+		})
+
+		It("should serve its own certificate", func() {
+			required := true
+			opts.SslCert, opts.SslKey = "", ""
+			opts.RequireClientCert, opts.ClientCAFile = false, ""
+			opts.Listeners = []*AuthDelegateListener{{
+				Name:              "remote",
+				Address:           "127.0.0.1:0",
+				SslCert:           server.CertFile,
+				SslKey:            server.KeyFile,
+				RequireClientCert: &required,
+				ClientCAFile:      ca.CertFile,
+			}}
+			url, stop := serveListener(0)
+			defer stop()
+			_, err := client().Get(url + "/foo")
+			Expect(err).ToNot(BeNil())
+
+			res, err := client(clientCert).Get(url + "/foo")
+			Expect(err).To(BeNil())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusNoContent))
+			Expect(forwarded.Get("X-Client-Cert-Subject")).To(
+				Equal("CN=client"))
+		})
+
+		It("should fail validation of inconsistent settings", func() {
+			required := true
+			opts.RequireClientCert, opts.ClientCAFile = false, ""
+			opts.Listeners = []*AuthDelegateListener{
+				{Name: "both", Address: "127.0.0.1:0",
+					Plaintext: true, SslCert: server.CertFile,
+					SslKey: server.KeyFile},
+				{Name: "no-ca", Address: "127.0.0.1:0",
+					RequireClientCert: &required},
+				{Name: "plain", Address: "127.0.0.1:0",
+					Plaintext: true, RequireClientCert: &required},
+				{Name: "stray-ca", Address: "127.0.0.1:0",
+					ClientCAFile: ca.CertFile},
+			}
+			err := opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"listener both can't be plaintext and define " +
+					"ssl_cert",
+				"listener no-ca require_client_cert requires " +
+					"client_ca_file",
+				"listener plain require_client_cert requires " +
+					"ssl_cert and ssl_key",
+				"listener stray-ca client_ca_file requires " +
+					"require_client_cert",
+			})))
+		})
+	})
+
+	It("should fail validation without a CA or SSL certificate", func() {
+		opts.SslCert, opts.SslKey, opts.ClientCAFile = "", "", ""
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"require_client_cert requires ssl_cert and ssl_key",
+			"require_client_cert requires client_ca_file",
+		})))
+
+		opts.RequireClientCert, opts.ClientCAFile = false, ca.CertFile
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"client_ca_file requires require_client_cert",
+		})))
+	})
+})
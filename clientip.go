@@ -0,0 +1,157 @@
+package authdelegate
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// defaultTrustedProxies are trusted unless trusted_proxies is defined: nginx
+// running on the same host, or in the same pod.
+var defaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// trustedProxies are the networks of the proxies whose X-Real-IP and
+// X-Forwarded-For headers report the client address of a request, and whose
+// X-Original-Host header reports its host. Those of any other peer are
+// ignored, since clients can set them to anything.
+type trustedProxies []*net.IPNet
+
+// requestIdentity is the client address and host of a request, as
+// determined by identify.
+type requestIdentity struct {
+	clientIP string
+	host     string
+
+	// If true, the request is from a trusted proxy, whose headers may be
+	// believed
+	proxied bool
+}
+
+type requestIdentityContextKey struct{}
+
+// parseTrustedProxies parses networks, each in CIDR notation or a single IP
+// address, returning the invalid ones.
+func parseTrustedProxies(networks []string) (trustedProxies, []string) {
+	var proxies trustedProxies
+	var invalid []string
+	for _, network := range networks {
+		if parsed, ok := parseNetwork(network); ok {
+			proxies = append(proxies, parsed)
+		} else {
+			invalid = append(invalid, network)
+		}
+	}
+	return proxies, invalid
+}
+
+func newTrustedProxies(opts *AuthDelegateOptions) trustedProxies {
+	if opts.TrustedProxies == nil {
+		proxies, _ := parseTrustedProxies(defaultTrustedProxies)
+		return proxies
+	}
+	return opts.trustedProxies
+}
+
+// trusts returns true if address is that of a trusted proxy, or isn't an IP
+// address at all, as for connections on a Unix domain socket.
+func (proxies trustedProxies) trusts(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return true
+	}
+	for _, network := range proxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// identify returns req with its client address and host determined, so that
+// clientIP and requestHost return them.
+func (proxies trustedProxies) identify(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(),
+		requestIdentityContextKey{}, proxies.identity(req)))
+}
+
+func (proxies trustedProxies) identity(req *http.Request) requestIdentity {
+	peer := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(peer); err == nil {
+		peer = host
+	}
+	if !proxies.trusts(peer) {
+		return requestIdentity{peer, stripPort(req.Host), false}
+	}
+	host, _ := headerValue(req.Header, "X-Original-Host")
+	if host == "" {
+		host = req.Host
+	}
+	return requestIdentity{proxies.clientIP(req, peer), stripPort(host),
+		true}
+}
+
+// clientIP returns the address of the client on whose behalf req is made by
+// peer, a trusted proxy: the value of X-Real-IP, which the proxy must
+// overwrite, or else the last address in X-Forwarded-For not of a trusted
+// proxy, or else peer.
+func (proxies trustedProxies) clientIP(req *http.Request,
+	peer string) string {
+	if ip := strings.TrimSpace(req.Header.Get("X-Real-IP")); ip != "" {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(
+		req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address != "" && (i == 0 || !proxies.trusts(address)) {
+			return address
+		}
+	}
+	return peer
+}
+
+// identityOf returns the client address and host of req, as determined when
+// the delegate received it, or else as reported by a proxy on the same host.
+func identityOf(req *http.Request) requestIdentity {
+	identity, ok := req.Context().Value(
+		requestIdentityContextKey{}).(requestIdentity)
+	if !ok {
+		proxies, _ := parseTrustedProxies(defaultTrustedProxies)
+		identity = proxies.identity(req)
+	}
+	return identity
+}
+
+// clientIP returns the address of the client on whose behalf req is made.
+// That is the address of the peer, unless it's a trusted proxy, in which
+// case it's reported by the proxy's headers.
+func clientIP(req *http.Request) string {
+	return identityOf(req).clientIP
+}
+
+// requestHost returns the host of the original request, without any port:
+// the value of X-Original-Host, if present and set by a trusted proxy, which
+// must overwrite it, else that of Host.
+func requestHost(req *http.Request) string {
+	return identityOf(req).host
+}
+
+// stripPort returns host without any port.
+func stripPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 &&
+		strings.IndexByte(host[i:], ']') < 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+func validateTrustedProxies(opts *AuthDelegateOptions,
+	msgs []string) []string {
+	var invalid []string
+	opts.trustedProxies, invalid = parseTrustedProxies(opts.TrustedProxies)
+	for _, network := range invalid {
+		msgs = append(msgs, "invalid trusted_proxies entry: "+network)
+	}
+	return msgs
+}
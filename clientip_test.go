@@ -0,0 +1,101 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Client addresses", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://localhost:8081"},
+			},
+		}
+	})
+
+	clientIPOf := func(remoteAddr, realIP, forwarded string) string {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.RemoteAddr = remoteAddr
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		if forwarded != "" {
+			req.Header.Set("X-Forwarded-For", forwarded)
+		}
+		return clientIP(newTrustedProxies(opts).identify(req))
+	}
+
+	It("should believe the headers of proxies on the same host", func() {
+		Expect(clientIPOf("127.0.0.1:1234", "", "")).To(
+			Equal("127.0.0.1"))
+		Expect(clientIPOf("127.0.0.1:1234", "192.0.2.3",
+			"192.0.2.1")).To(Equal("192.0.2.3"))
+		Expect(clientIPOf("[::1]:1234", "", "192.0.2.1, 192.0.2.2")).To(
+			Equal("192.0.2.2"))
+		Expect(clientIPOf("@", "192.0.2.3", "")).To(Equal("192.0.2.3"))
+	})
+
+	It("should ignore the headers of other clients", func() {
+		Expect(clientIPOf("198.51.100.1:1234", "192.0.2.3",
+			"192.0.2.1")).To(Equal("198.51.100.1"))
+	})
+
+	It("should skip trusted proxies in X-Forwarded-For", func() {
+		opts.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.9"}
+		Expect(clientIPOf("10.0.0.1:1234", "",
+			"203.0.113.5, 192.0.2.1, 10.0.0.2, 192.0.2.9")).To(
+			Equal("192.0.2.1"))
+		Expect(clientIPOf("10.0.0.1:1234", "", "10.0.0.3, 10.0.0.2")).To(
+			Equal("10.0.0.3"))
+		Expect(clientIPOf("127.0.0.1:1234", "192.0.2.3", "")).To(
+			Equal("127.0.0.1"))
+	})
+
+	It("should take the host only from trusted proxies", func() {
+		Expect(opts.Validate()).To(BeNil())
+		hostOf := func(remoteAddr string) string {
+			req, _ := http.NewRequest("GET", "http://delegate:8080/", nil)
+			req.RemoteAddr = remoteAddr
+			req.Header.Set("X-Original-Host", "admin.example.gov:443")
+			return requestHost(newTrustedProxies(opts).identify(req))
+		}
+		Expect(hostOf("127.0.0.1:1234")).To(Equal("admin.example.gov"))
+		Expect(hostOf("198.51.100.1:1234")).To(Equal("delegate"))
+	})
+
+	It("should not let clients evade per-address rate limits", func() {
+		opts.Upstreams[0].RateLimits = []*AuthDelegateRateLimit{
+			{Key: "client_ip", RequestsPerSecond: 0.5, Burst: 1},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		codes := []int{}
+		for _, forwarded := range []string{"192.0.2.1", "192.0.2.2"} {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			req.RemoteAddr = "198.51.100.1:1234"
+			req.Header.Set("X-Forwarded-For", forwarded)
+			req.Header.Set("X-Real-IP", forwarded)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			codes = append(codes, recorder.Code)
+		}
+		Expect(codes[1]).To(Equal(http.StatusTooManyRequests))
+	})
+
+	It("should fail validation for invalid entries", func() {
+		opts.TrustedProxies = []string{"10.0.0.0/33", "proxy"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid trusted_proxies entry: 10.0.0.0/33",
+			"invalid trusted_proxies entry: proxy",
+		})))
+	})
+})
@@ -0,0 +1,90 @@
+// Command authdelegate serves authentication delegation requests from Nginx,
+// routing each to the upstream authentication server that matches it. See
+// the README for its configuration.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/18F/authdelegate"
+)
+
+// headerFlags collects the values of a repeated -header flag.
+type headerFlags []string
+
+func (headers *headerFlags) String() string {
+	return strings.Join(*headers, ", ")
+}
+
+func (headers *headerFlags) Set(value string) error {
+	*headers = append(*headers, value)
+	return nil
+}
+
+func usage() {
+	fmt.Printf("Usage: %s [-validate|-check] [-profile name] "+
+		"[-o text|json] config.{json,yaml}\n"+
+		"       %s -explain [-method method] [-host host] [-uri uri] "+
+		"[-header 'Name: value']... [-profile name] [-o text|json] "+
+		"config.{json,yaml}\n"+
+		"       %s -version [-o text|json]\n",
+		os.Args[0], os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	validateOnly := flag.Bool("validate", false,
+		"validate and lint the configuration, then exit")
+	check := flag.Bool("check", false,
+		"validate the configuration and connect to each upstream, "+
+			"then exit")
+	explain := flag.Bool("explain", false,
+		"report the upstream that would decide the request described "+
+			"by -method, -host, -uri, and -header, then exit")
+	var request authdelegate.ExplainRequest
+	flag.StringVar(&request.Method, "method", "GET",
+		"method of the -explain request")
+	flag.StringVar(&request.Host, "host", "localhost",
+		"host of the -explain request")
+	flag.StringVar(&request.URI, "uri", "/",
+		"URI of the -explain request, as in X-Original-URI")
+	flag.Var((*headerFlags)(&request.Headers), "header",
+		"header of the -explain request, as 'Name: value'; may be "+
+			"repeated")
+	profile := flag.String("profile", os.Getenv(authdelegate.ProfileEnvVar),
+		"configuration profile to apply; defaults to $"+
+			authdelegate.ProfileEnvVar)
+	showVersion := flag.Bool("version", false,
+		"print the version, then exit")
+	output := flag.String("o", authdelegate.OutputText,
+		"output format of -validate, -check, -explain, and -version: "+
+			"text or json")
+	flag.Usage = usage
+	flag.Parse()
+	if *output != authdelegate.OutputText &&
+		*output != authdelegate.OutputJSON {
+		usage()
+		os.Exit(authdelegate.ExitUsage)
+	} else if *showVersion {
+		os.Exit(authdelegate.RunVersion(os.Stdout, *output))
+	} else if flag.NArg() != 1 {
+		usage()
+		os.Exit(authdelegate.ExitUsage)
+	}
+
+	configPath := flag.Arg(0)
+	if *validateOnly {
+		os.Exit(authdelegate.RunValidate(os.Stdout, *output, configPath,
+			*profile))
+	} else if *check {
+		os.Exit(authdelegate.RunCheck(os.Stdout, *output, configPath,
+			*profile))
+	} else if *explain {
+		os.Exit(authdelegate.RunExplain(os.Stdout, *output, configPath,
+			*profile, request))
+	}
+	os.Exit(authdelegate.RunServer(configPath, *profile))
+}
@@ -0,0 +1,123 @@
+package authdelegate
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// requestCoalescer forwards only one of a set of concurrent requests with the
+// same key to an upstream, and copies its response to the others. A nil
+// *requestCoalescer forwards every request.
+type requestCoalescer struct {
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	done     chan struct{}
+	response *bufferedResponse
+}
+
+func newRequestCoalescer(enabled bool) *requestCoalescer {
+	if !enabled {
+		return nil
+	}
+	return &requestCoalescer{calls: make(map[string]*coalescedCall)}
+}
+
+// serve writes handler's response to req to rw, unless a request with the
+// same key is already in flight, in which case it waits for and writes that
+// request's response instead. Returns true in the latter case.
+//
+// The first request is sent in its own goroutine, detached from the
+// cancellation of its client's request, so that the others still receive
+// its response if that client disconnects. A request whose client
+// disconnects while waiting is answered with a 502 status, so that it's
+// counted as an error rather than an approval.
+func (coalescer *requestCoalescer) serve(key string, handler http.Handler,
+	rw http.ResponseWriter, req *http.Request) (shared bool) {
+	if coalescer == nil {
+		handler.ServeHTTP(rw, req)
+		return false
+	}
+	coalescer.mutex.Lock()
+	call, shared := coalescer.calls[key]
+	if !shared {
+		call = &coalescedCall{
+			done:     make(chan struct{}),
+			response: &bufferedResponse{header: make(http.Header)},
+		}
+		coalescer.calls[key] = call
+		go coalescer.send(key, call, handler,
+			req.WithContext(context.WithoutCancel(req.Context())))
+	}
+	coalescer.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		call.response.writeTo(rw)
+	case <-req.Context().Done():
+		http.Error(rw, http.StatusText(http.StatusBadGateway),
+			http.StatusBadGateway)
+	}
+	return shared
+}
+
+// send writes handler's response to req to call, then releases the requests
+// waiting for it, even if handler panics, e.g. with http.ErrAbortHandler, in
+// which case the response is a 502.
+func (coalescer *requestCoalescer) send(key string, call *coalescedCall,
+	handler http.Handler, req *http.Request) {
+	defer func() {
+		if err := recover(); err != nil && err != http.ErrAbortHandler {
+			log.Printf("coalesced request for %s %s panicked: %v",
+				req.Method, originalURI(req), err)
+		}
+		coalescer.mutex.Lock()
+		delete(coalescer.calls, key)
+		coalescer.mutex.Unlock()
+		close(call.done)
+	}()
+	handler.ServeHTTP(call.response, req)
+}
+
+// bufferedResponse is a http.ResponseWriter that holds a response in memory,
+// so that it may be written to several clients.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (response *bufferedResponse) Header() http.Header {
+	return response.header
+}
+
+func (response *bufferedResponse) WriteHeader(status int) {
+	if response.status == 0 {
+		response.status = status
+	}
+}
+
+func (response *bufferedResponse) Write(data []byte) (int, error) {
+	response.WriteHeader(http.StatusOK)
+	return response.body.Write(data)
+}
+
+// writeTo writes a 502 response if the handler failed to write a status, so
+// that an aborted response is never mistaken for an approval.
+func (response *bufferedResponse) writeTo(rw http.ResponseWriter) {
+	if response.status == 0 {
+		http.Error(rw, http.StatusText(http.StatusBadGateway),
+			http.StatusBadGateway)
+		return
+	}
+	for name, values := range response.header {
+		rw.Header()[name] = values
+	}
+	rw.WriteHeader(response.status)
+	rw.Write(response.body.Bytes())
+}
@@ -0,0 +1,155 @@
+package authdelegate
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Request coalescing", func() {
+	var upstream *httptest.Server
+	var requests int32
+	var release chan struct{}
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		requests = 0
+		release = make(chan struct{})
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				<-release
+				rw.Header().Set("X-User", "user@example.gov")
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:              upstream.URL,
+					CookieName:       "_session",
+					CoalesceRequests: true,
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	// authorizeConcurrently sends a request for each session concurrently,
+	// and releases the upstream once all are in flight.
+	authorizeConcurrently := func(
+		sessions ...string) []*httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		recorders := make([]*httptest.ResponseRecorder, len(sessions))
+		var wg sync.WaitGroup
+		for i, session := range sessions {
+			recorders[i] = httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			req.AddCookie(&http.Cookie{Name: "_session", Value: session})
+			wg.Add(1)
+			go func(recorder *httptest.ResponseRecorder) {
+				defer wg.Done()
+				handler.ServeHTTP(recorder, req)
+			}(recorders[i])
+		}
+		delegate := handler.routes().upstreams[0]
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&delegate.inFlight)
+		}).Should(Equal(int64(len(sessions))))
+		time.Sleep(10 * time.Millisecond)
+		close(release)
+		wg.Wait()
+		return recorders
+	}
+
+	It("should send concurrent requests with a credential once", func() {
+		recorders := authorizeConcurrently("user", "user", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		for _, recorder := range recorders {
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(recorder.Header().Get("X-User")).
+				To(Equal("user@example.gov"))
+		}
+	})
+
+	It("should not coalesce requests with different credentials", func() {
+		authorizeConcurrently("alice", "bob", "alice")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+	})
+
+	It("should not coalesce unless enabled", func() {
+		opts.Upstreams[0].CoalesceRequests = false
+		authorizeConcurrently("user", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+	})
+
+	It("should outlive the client of the first request", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		delegate := handler.routes().upstreams[0]
+		start := func() (*httptest.ResponseRecorder, context.CancelFunc,
+			chan struct{}) {
+			ctx, cancel := context.WithCancel(context.Background())
+			req, _ := http.NewRequestWithContext(ctx, "GET",
+				"http://delegate/", nil)
+			req.AddCookie(&http.Cookie{Name: "_session", Value: "user"})
+			recorder := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				handler.ServeHTTP(recorder, req)
+			}()
+			return recorder, cancel, done
+		}
+
+		first, cancelFirst, firstDone := start()
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&requests)
+		}).Should(Equal(int32(1)))
+		second, cancelSecond, secondDone := start()
+		defer cancelSecond()
+		third, cancelThird, thirdDone := start()
+		Eventually(func() int64 {
+			return atomic.LoadInt64(&delegate.inFlight)
+		}).Should(Equal(int64(3)))
+
+		cancelFirst()
+		cancelThird()
+		Eventually(firstDone).Should(BeClosed())
+		Eventually(thirdDone).Should(BeClosed())
+		Expect(first.Code).To(Equal(http.StatusBadGateway))
+		Expect(third.Code).To(Equal(http.StatusBadGateway))
+		Expect(atomic.LoadInt64(&delegate.failed)).To(Equal(int64(2)))
+		Expect(atomic.LoadInt64(&delegate.allowed)).To(BeZero())
+
+		close(release)
+		Eventually(secondDone).Should(BeClosed())
+		Expect(second.Code).To(Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+	})
+
+	It("should not share an aborted response as an approval", func() {
+		recorder := httptest.NewRecorder()
+		(&bufferedResponse{}).writeTo(recorder)
+		Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+	})
+
+	It("should fail validation for a default upstream", func() {
+		opts.Upstreams[0].CookieName = ""
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"coalesce_requests requires header_name or cookie_name: " +
+				upstream.URL,
+		})))
+	})
+})
@@ -0,0 +1,139 @@
+package authdelegate
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// printError reports that operation failed on the file at path.
+func printError(operation, path string, err error) {
+	fmt.Printf("Error %s %s: %s\n", operation, path, err.Error())
+}
+
+// parseOptions parses config as YAML if configPath ends in ".yaml" or ".yml",
+// and as JSON otherwise, applying the overrides of profile if it isn't empty.
+func parseOptions(configPath, profile string, config []byte) (
+	*AuthDelegateOptions, error) {
+	var err error
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		if config, err = yamlToJSON(config); err != nil {
+			return nil, err
+		}
+	}
+	if config, err = selectProfile(config, profile); err != nil {
+		return nil, err
+	}
+	return NewAuthDelegateOptionsFromJSON(config)
+}
+
+// RunServer serves auth delegation requests as configured by the file at
+// configPath, with the overrides of profile, until the process receives
+// SIGTERM or an interrupt, then shuts down gracefully. Returns the exit
+// status of the authdelegate command: ExitUnreadableConfig if the file
+// can't be read, else ExitFailure if it's invalid or a listener fails.
+func RunServer(configPath, profile string) int {
+	configName, configBytes, err := readConfig(configPath)
+	if err != nil {
+		printError("reading", configPath, err)
+		return ExitUnreadableConfig
+	}
+
+	var opts *AuthDelegateOptions
+	if opts, err = parseOptions(configName, profile,
+		configBytes); err != nil {
+		printError("parsing", configPath, err)
+		return ExitFailure
+	}
+
+	applyRuntimeSettings(opts, cgroupRoot)
+	address := ":" + strconv.Itoa(opts.Port)
+	handler := NewAuthDelegate(opts)
+	redactLogs(handler)
+	watchUpstreams(handler, opts)
+	reloadOnHangup(handler, configPath, profile)
+	toggleDiagnosticsOnSignals(handler)
+	seedCaches(handler, opts)
+	server := &http.Server{Addr: address, Handler: handler}
+	if err = serveCertificate(handler, server, opts); err != nil {
+		printError("loading", opts.SslCert, err)
+		return ExitFailure
+	}
+	watchCertificateExpiry(handler, opts)
+	fmt.Printf("config fingerprint: %s\n", opts.Fingerprint())
+	if opts.Port != 0 {
+		fmt.Printf("port %d: awaiting auth delegation requests\n",
+			opts.Port)
+	}
+	if opts.Listen != "" {
+		fmt.Printf("%s: awaiting auth delegation requests\n",
+			opts.Listen)
+	}
+	if opts.PlaintextListener != nil {
+		fmt.Printf("%s: serving plaintext requests (%s)\n",
+			opts.PlaintextListener.Address, opts.PlaintextListener.Mode)
+	}
+
+	// The failure of the admin or control listener stops the server.
+	running, fail := context.WithCancelCause(context.Background())
+	defer fail(nil)
+	if opts.AdminAddress != "" {
+		admin := newAdminServer(opts, handler, profile)
+		fmt.Printf("%s: serving admin operations\n", opts.AdminAddress)
+		go func() {
+			if opts.AdminSslCert != "" {
+				fail(admin.ListenAndServeTLS(
+					opts.AdminSslCert, opts.AdminSslKey))
+			} else {
+				fail(admin.ListenAndServe())
+			}
+		}()
+	}
+
+	if opts.ControlAddress != "" {
+		fmt.Printf("%s: serving the control API\n", opts.ControlAddress)
+		go func() {
+			fail(serveControl(opts, handler, configPath, profile))
+		}()
+	}
+
+	// Stop handling signals once shutdown begins, so that a second
+	// signal exits immediately.
+	ctx, stop := signal.NotifyContext(running, syscall.SIGTERM,
+		os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	err = serve(ctx, server, opts)
+	if running.Err() != nil {
+		err = context.Cause(running)
+	}
+	if ctx.Err() == nil || running.Err() != nil {
+		log.Print(err)
+		return ExitFailure
+	}
+	status := ExitOK
+	if err != nil {
+		log.Printf("shutdown: %s", err)
+		status = ExitFailure
+	}
+	logExitSummary(handler, opts)
+	if opts.StateSnapshotPath != "" {
+		err = saveDelegateSnapshot(handler, opts.StateSnapshotPath)
+		if err != nil {
+			log.Printf("snapshot: failed to save to %s: %s",
+				opts.StateSnapshotPath, err)
+			status = ExitFailure
+		}
+	}
+	return status
+}
@@ -0,0 +1,72 @@
+package authdelegate
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// routeComparison evaluates requests against a candidate routing table,
+// without serving from it, and logs each request the candidate would route
+// differently from the active table.
+type routeComparison struct {
+	candidate *routingTable
+
+	// Accessed atomically
+	compared    int64
+	differences int64
+}
+
+type comparisonStatus struct {
+	Enabled     bool  `json:"enabled"`
+	Compared    int64 `json:"compared"`
+	Differences int64 `json:"differences"`
+}
+
+func upstreamName(upstream *authDelegate) string {
+	if upstream == nil {
+		return "(none)"
+	}
+	return upstream.name
+}
+
+func (comparison *routeComparison) compare(
+	req *http.Request, active *authDelegate) {
+	candidate := comparison.candidate.selectUpstream(req, nil)
+	atomic.AddInt64(&comparison.compared, 1)
+	if upstreamName(candidate) == upstreamName(active) {
+		return
+	}
+	atomic.AddInt64(&comparison.differences, 1)
+	log.Printf("compare: %s %s routed to %s; candidate routes to %s",
+		req.Method, req.RequestURI, upstreamName(active),
+		upstreamName(candidate))
+}
+
+func (comparison *routeComparison) status() comparisonStatus {
+	if comparison == nil {
+		return comparisonStatus{}
+	}
+	return comparisonStatus{
+		Enabled:     true,
+		Compared:    atomic.LoadInt64(&comparison.compared),
+		Differences: atomic.LoadInt64(&comparison.differences),
+	}
+}
+
+// comparison returns the routeComparison currently in effect, or nil if
+// comparison mode is disabled.
+func (handler *authDelegateHandler) comparison() *routeComparison {
+	comparison, _ := handler.candidate.Load().(*routeComparison)
+	return comparison
+}
+
+// setCandidate enables comparison mode against candidate, resetting the
+// comparison counters, or disables it if candidate is nil.
+func (handler *authDelegateHandler) setCandidate(candidate *routingTable) {
+	var comparison *routeComparison
+	if candidate != nil {
+		comparison = &routeComparison{candidate: candidate}
+	}
+	handler.candidate.Store(comparison)
+}
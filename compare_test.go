@@ -0,0 +1,86 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Candidate configuration comparison", func() {
+	var server *httptest.Server
+	var delegate http.Handler
+	var admin http.Handler
+
+	config := func(headerName string) string {
+		return `{"port": 8080, "upstreams": [` +
+			`{"url": "` + server.URL + `", "name": "signed",` +
+			` "header_name": "` + headerName + `"},` +
+			`{"url": "` + server.URL + `", "name": "default"}]}`
+	}
+
+	BeforeEach(func() {
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		opts, err := NewAuthDelegateOptionsFromJSON(
+			[]byte(config("X-Signature")))
+		Expect(err).To(BeNil())
+		delegate = NewAuthDelegate(opts)
+		admin = NewAdminHandler(delegate)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	adminRequest := func(method, body string) comparisonStatus {
+		req, _ := http.NewRequest(method, "/config/candidate",
+			bytes.NewBufferString(body))
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var status comparisonStatus
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &status)).To(BeNil())
+		return status
+	}
+
+	serveSigned := func() {
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("X-Signature", "foobar")
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	}
+
+	It("should be disabled by default", func() {
+		Expect(adminRequest("GET", "")).To(Equal(comparisonStatus{}))
+	})
+
+	It("should count requests the candidate routes the same", func() {
+		adminRequest("POST", config("X-Signature"))
+		serveSigned()
+		Expect(adminRequest("GET", "")).To(Equal(comparisonStatus{
+			Enabled: true, Compared: 1, Differences: 0,
+		}))
+	})
+
+	It("should count requests the candidate routes differently", func() {
+		adminRequest("POST", config("X-Hmac-Signature"))
+		serveSigned()
+		serveSigned()
+		Expect(adminRequest("GET", "")).To(Equal(comparisonStatus{
+			Enabled: true, Compared: 2, Differences: 2,
+		}))
+	})
+
+	It("should stop comparing when the candidate is removed", func() {
+		adminRequest("POST", config("X-Hmac-Signature"))
+		Expect(adminRequest("DELETE", "")).To(Equal(comparisonStatus{}))
+		serveSigned()
+		Expect(adminRequest("GET", "")).To(Equal(comparisonStatus{}))
+	})
+})
@@ -0,0 +1,175 @@
+//go:build !nocontrol
+// +build !nocontrol
+
+package authdelegate
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/18F/authdelegate/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// controlSupported is false in builds with the nocontrol tag, which omit the
+// control API.
+const controlSupported = true
+
+// maxControlMessageSize limits the size of a control API request.
+const maxControlMessageSize = 1 << 20
+
+// controlService implements the control API, a gRPC service defined in
+// controlpb/control.proto, which exposes the operations a fleet controller
+// needs to manage the delegate.
+type controlService struct {
+	controlpb.UnimplementedControlServer
+
+	delegate *authDelegateHandler
+
+	// Configuration reloaded by the Reload method; if configPath is empty,
+	// Reload fails
+	configPath string
+	profile    string
+}
+
+// serveControl serves the control API on opts.ControlAddress until it fails.
+func serveControl(opts *AuthDelegateOptions, delegate http.Handler,
+	configPath, profile string) error {
+	server, err := newControlServer(opts, delegate, configPath, profile)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", opts.ControlAddress)
+	if err != nil {
+		return err
+	}
+	return server.Serve(listener)
+}
+
+// newControlServer creates the server of the control API, which delegate,
+// created by NewAuthDelegate, reloads from configPath with the overrides of
+// profile. Clients must present a certificate signed by one of the
+// control_client_ca certificates.
+func newControlServer(opts *AuthDelegateOptions, delegate http.Handler,
+	configPath, profile string) (*grpc.Server, error) {
+	config, err := controlTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(config)),
+		grpc.MaxRecvMsgSize(maxControlMessageSize))
+	controlpb.RegisterControlServer(server, &controlService{
+		delegate:   delegate.(*authDelegateHandler),
+		configPath: configPath,
+		profile:    profile,
+	})
+	return server, nil
+}
+
+// controlTLSConfig returns the TLS configuration of the control listener,
+// which requires client certificates.
+func controlTLSConfig(opts *AuthDelegateOptions) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(opts.ControlSslCert,
+		opts.ControlSslKey)
+	if err != nil {
+		return nil, err
+	}
+	return hardenTLS(&tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    opts.controlClientCAs,
+	}, opts), nil
+}
+
+func (control *controlService) findUpstream(name string) (
+	*authDelegate, error) {
+	upstream := control.delegate.routes().findUpstream(name)
+	if upstream == nil {
+		return nil, status.Error(codes.NotFound,
+			"unknown upstream: "+name)
+	}
+	return upstream, nil
+}
+
+// upstreamMessage describes upstream.
+func upstreamMessage(upstream *authDelegate) *controlpb.Upstream {
+	return &controlpb.Upstream{
+		Name:     upstream.name,
+		Draining: upstream.isDraining(),
+		InFlight: atomic.LoadInt64(&upstream.inFlight),
+	}
+}
+
+func (control *controlService) DrainUpstream(ctx context.Context,
+	request *controlpb.UpstreamRequest) (*controlpb.Upstream, error) {
+	return control.setDraining(request.GetName(), true)
+}
+
+func (control *controlService) UndrainUpstream(ctx context.Context,
+	request *controlpb.UpstreamRequest) (*controlpb.Upstream, error) {
+	return control.setDraining(request.GetName(), false)
+}
+
+func (control *controlService) setDraining(
+	name string, draining bool) (*controlpb.Upstream, error) {
+	upstream, err := control.findUpstream(name)
+	if err != nil {
+		return nil, err
+	}
+	upstream.setDraining(draining)
+	log.Printf("control: upstream %s draining: %t", name, draining)
+	return upstreamMessage(upstream), nil
+}
+
+// FlushCache deletes the cached decisions of the upstream named in the
+// request, or of every upstream if none is named.
+func (control *controlService) FlushCache(ctx context.Context,
+	request *controlpb.FlushCacheRequest) (
+	*controlpb.FlushCacheResponse, error) {
+	name := request.GetUpstream()
+	if name != "" {
+		if _, err := control.findUpstream(name); err != nil {
+			return nil, err
+		}
+	}
+	flushed, err := control.delegate.cache.flush(name)
+	log.Printf("control: flushed %d cached decisions", flushed)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &controlpb.FlushCacheResponse{Flushed: int64(flushed)}, nil
+}
+
+func (control *controlService) Reload(ctx context.Context,
+	request *controlpb.ReloadRequest) (*controlpb.ReloadResponse, error) {
+	if control.configPath == "" {
+		return nil, status.Error(codes.FailedPrecondition,
+			"no configuration file to reload")
+	}
+	err := control.delegate.reload(control.configPath, control.profile)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &controlpb.ReloadResponse{
+		Fingerprint: control.delegate.routes().fingerprint,
+	}, nil
+}
+
+// GetTable describes the routing table in effect.
+func (control *controlService) GetTable(ctx context.Context,
+	request *controlpb.GetTableRequest) (*controlpb.Table, error) {
+	table := control.delegate.routes()
+	response := &controlpb.Table{Fingerprint: table.fingerprint}
+	for _, upstream := range table.upstreams {
+		response.Upstreams = append(response.Upstreams,
+			upstreamMessage(upstream))
+	}
+	return response, nil
+}
@@ -0,0 +1,18 @@
+//go:build nocontrol
+// +build nocontrol
+
+package authdelegate
+
+import (
+	"errors"
+	"net/http"
+)
+
+const controlSupported = false
+
+// serveControl is never called, since validation rejects control_address in
+// builds with the nocontrol tag.
+func serveControl(opts *AuthDelegateOptions, delegate http.Handler,
+	configPath, profile string) error {
+	return errors.New("the control API is not supported by this build")
+}
@@ -0,0 +1,23 @@
+//go:build nocontrol
+// +build nocontrol
+
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Builds without the control API", func() {
+	It("should fail validation for a control_address", func() {
+		opts := &AuthDelegateOptions{
+			Port:           8080,
+			Upstreams:      []*AuthDelegateUpstream{{URL: "http://x"}},
+			ControlAddress: "localhost:9090",
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"control_address is not supported by this build, which has " +
+				"the nocontrol tag",
+		})))
+	})
+})
@@ -0,0 +1,207 @@
+//go:build !nocontrol
+// +build !nocontrol
+
+package authdelegate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/18F/authdelegate/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Describe("Control API", func() {
+	var dir, configPath string
+	var upstream *httptest.Server
+	var server *grpc.Server
+	var opts *AuthDelegateOptions
+	var handler *authDelegateHandler
+	var address string
+	var clientConfig *tls.Config
+	var conn *grpc.ClientConn
+	var client controlpb.ControlClient
+	var ctx context.Context
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "control")
+		Expect(err).To(BeNil())
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusNoContent)
+			}))
+		configPath = filepath.Join(dir, "config.yaml")
+		Expect(ioutil.WriteFile(configPath, []byte("port: 8080\n"+
+			"upstreams:\n  - name: foo\n    url: "+upstream.URL+"\n"),
+			0600)).To(Succeed())
+
+		cert := writeTestCertificate(dir, "control", time.Hour)
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				Name: "foo", URL: upstream.URL,
+				HeaderName: "Authorization", CacheTTL: "1m",
+			}},
+			ControlAddress:  "127.0.0.1:8081",
+			ControlSslCert:  cert.CertFile,
+			ControlSslKey:   cert.KeyFile,
+			ControlClientCA: cert.CertFile,
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler = NewAuthDelegate(opts).(*authDelegateHandler)
+
+		server, err = newControlServer(opts, handler, configPath, "")
+		Expect(err).To(BeNil())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		address = listener.Addr().String()
+		go server.Serve(listener)
+
+		keyPair, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile)
+		Expect(err).To(BeNil())
+		roots := x509.NewCertPool()
+		roots.AddCert(cert.Cert)
+		clientConfig = &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{keyPair},
+		}
+		conn, err = grpc.NewClient(address, grpc.WithTransportCredentials(
+			credentials.NewTLS(clientConfig)))
+		Expect(err).To(BeNil())
+		client = controlpb.NewControlClient(conn)
+		ctx = context.Background()
+	})
+
+	AfterEach(func() {
+		conn.Close()
+		server.Stop()
+		upstream.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should drain and undrain an upstream", func() {
+		response, err := client.DrainUpstream(ctx,
+			&controlpb.UpstreamRequest{Name: "foo"})
+		Expect(err).To(BeNil())
+		Expect(response.GetName()).To(Equal("foo"))
+		Expect(response.GetDraining()).To(BeTrue())
+		Expect(handler.routes().findUpstream("foo").isDraining()).
+			To(BeTrue())
+
+		response, err = client.UndrainUpstream(ctx,
+			&controlpb.UpstreamRequest{Name: "foo"})
+		Expect(err).To(BeNil())
+		Expect(response.GetDraining()).To(BeFalse())
+		Expect(handler.routes().findUpstream("foo").isDraining()).
+			To(BeFalse())
+	})
+
+	It("should return NOT_FOUND for an unknown upstream", func() {
+		_, err := client.DrainUpstream(ctx,
+			&controlpb.UpstreamRequest{Name: "bar"})
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+		Expect(status.Convert(err).Message()).To(
+			Equal("unknown upstream: bar"))
+	})
+
+	It("should flush cached decisions", func() {
+		handler.cache.put("foo", "abc", &cachedDecision{Status: 200},
+			time.Minute)
+		handler.cache.put("bar", "abc", &cachedDecision{Status: 200},
+			time.Minute)
+		response, err := client.FlushCache(ctx,
+			&controlpb.FlushCacheRequest{Upstream: "foo"})
+		Expect(err).To(BeNil())
+		Expect(response.GetFlushed()).To(Equal(int64(1)))
+		Expect(handler.cache.get("foo", "abc")).To(BeNil())
+		Expect(handler.cache.get("bar", "abc")).ToNot(BeNil())
+
+		response, err = client.FlushCache(ctx,
+			&controlpb.FlushCacheRequest{})
+		Expect(err).To(BeNil())
+		Expect(response.GetFlushed()).To(Equal(int64(1)))
+		Expect(handler.cache.get("bar", "abc")).To(BeNil())
+	})
+
+	It("should reload the configuration and describe the table", func() {
+		fingerprint := handler.routes().fingerprint
+		table, err := client.GetTable(ctx, &controlpb.GetTableRequest{})
+		Expect(err).To(BeNil())
+		Expect(table.GetFingerprint()).To(Equal(fingerprint))
+		Expect(table.GetUpstreams()).To(HaveLen(1))
+		Expect(table.GetUpstreams()[0].GetName()).To(Equal("foo"))
+
+		reloaded, err := client.Reload(ctx, &controlpb.ReloadRequest{})
+		Expect(err).To(BeNil())
+		Expect(reloaded.GetFingerprint()).ToNot(Equal(fingerprint))
+		Expect(reloaded.GetFingerprint()).To(
+			Equal(handler.routes().fingerprint))
+	})
+
+	It("should report a failed reload", func() {
+		Expect(ioutil.WriteFile(configPath, []byte("port: 0\n"),
+			0600)).To(Succeed())
+		_, err := client.Reload(ctx, &controlpb.ReloadRequest{})
+		Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+		Expect(status.Convert(err).Message()).To(
+			HavePrefix("Invalid options:\n  "))
+	})
+
+	It("should return UNIMPLEMENTED for an unknown method", func() {
+		err := conn.Invoke(ctx, "/authdelegate.control.v1.Control/Restart",
+			&controlpb.GetTableRequest{}, &controlpb.Table{})
+		Expect(status.Code(err)).To(Equal(codes.Unimplemented))
+	})
+
+	It("should reject clients without a certificate", func() {
+		clientConfig.Certificates = nil
+		conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(
+			credentials.NewTLS(clientConfig)))
+		Expect(err).To(BeNil())
+		defer conn.Close()
+		_, err = controlpb.NewControlClient(conn).GetTable(ctx,
+			&controlpb.GetTableRequest{})
+		Expect(status.Code(err)).To(Equal(codes.Unavailable))
+	})
+
+	It("should apply the configured TLS settings", func() {
+		opts.SslMinVersion = "1.3"
+		Expect(opts.Validate()).To(BeNil())
+		config, err := controlTLSConfig(opts)
+		Expect(err).To(BeNil())
+		Expect(config.MinVersion).To(Equal(uint16(tls.VersionTLS13)))
+		Expect(config.ClientAuth).To(
+			Equal(tls.RequireAndVerifyClientCert))
+	})
+
+	It("should fail validation without mutual TLS options", func() {
+		opts.ControlClientCA = ""
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"control_address requires control-ssl-cert, " +
+				"control-ssl-key, and control-client-ca",
+		})))
+
+		opts.ControlAddress = ""
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"control options specified without control_address",
+		})))
+	})
+})
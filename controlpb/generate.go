@@ -0,0 +1,5 @@
+// Package controlpb holds the messages and the gRPC service of the control
+// API, generated from control.proto by protoc-gen-go and protoc-gen-go-grpc.
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
@@ -0,0 +1,225 @@
+package authdelegate
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// headerValue returns the first value of the header name, which must be in
+// canonical form, and whether it is present and not empty. Unlike
+// header.Get, it doesn't canonicalize name on every call.
+func headerValue(header http.Header, name string) (string, bool) {
+	values := header[name]
+	if len(values) == 0 || values[0] == "" {
+		return "", false
+	}
+	return values[0], true
+}
+
+// canonicalHeaderKeys returns names in canonical form, for headerValue.
+func canonicalHeaderKeys(names []string) []string {
+	var keys []string
+	for _, name := range names {
+		keys = append(keys, http.CanonicalHeaderKey(name))
+	}
+	return keys
+}
+
+// cookieValue returns the value of the first cookie called name in the Cookie
+// headers of header, and whether it is present. Unlike http.Request.Cookie,
+// it scans the headers in place rather than parsing every cookie into a new
+// http.Cookie, so it doesn't allocate. Surrounding double quotes are removed
+// from the value.
+func cookieValue(header http.Header, name string) (string, bool) {
+	for _, line := range header["Cookie"] {
+		for len(line) != 0 {
+			var part string
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				part, line = line[:i], line[i+1:]
+			} else {
+				part, line = line, ""
+			}
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, name) {
+				continue
+			} else if len(part) == len(name) {
+				return "", true
+			} else if part[len(name)] != '=' {
+				continue
+			}
+			return unquoteCookieValue(part[len(name)+1:]), true
+		}
+	}
+	return "", false
+}
+
+// cookiePrefixValue returns the value of the cookie split into chunks named
+// prefix followed by "_0", "_1" and so on in the Cookie headers of header,
+// joined in numeric order, and whether there are any. This is how
+// oauth2_proxy splits a session too large for one cookie into _oauth2_proxy_0,
+// _oauth2_proxy_1 and so on. If there are no chunks, it returns the value of
+// the cookie named prefix itself, since a session small enough for one cookie
+// isn't split. Cookies such as _oauth2_proxy_csrf are ignored.
+func cookiePrefixValue(header http.Header, prefix string) (string, bool) {
+	type chunk struct {
+		index int
+		value string
+	}
+	var chunks []chunk
+	var whole string
+	found := false
+	for _, line := range header["Cookie"] {
+		for len(line) != 0 {
+			var part string
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				part, line = line[:i], line[i+1:]
+			} else {
+				part, line = line, ""
+			}
+			part = strings.TrimSpace(part)
+			if !strings.HasPrefix(part, prefix) {
+				continue
+			}
+			name, value := part, ""
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				name, value = part[:i], unquoteCookieValue(part[i+1:])
+			}
+			if name == prefix {
+				if !found {
+					whole, found = value, true
+				}
+			} else if index, ok := cookieChunkIndex(prefix, name); ok {
+				chunks = append(chunks, chunk{index, value})
+			}
+		}
+	}
+	if len(chunks) == 0 {
+		return whole, found
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return chunks[i].index < chunks[j].index
+	})
+	var value strings.Builder
+	for i, c := range chunks {
+		if i == 0 || c.index != chunks[i-1].index {
+			value.WriteString(c.value)
+		}
+	}
+	return value.String(), true
+}
+
+// cookieChunkIndex returns the number of the chunk of the cookie prefix that
+// name is, and whether it's one at all: whether it consists of prefix, an
+// underscore, unless prefix already ends in one, and a number.
+func cookieChunkIndex(prefix, name string) (int, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, false
+	}
+	suffix := name[len(prefix):]
+	if !strings.HasSuffix(prefix, "_") {
+		if !strings.HasPrefix(suffix, "_") {
+			return 0, false
+		}
+		suffix = suffix[1:]
+	}
+	if suffix == "" || suffix[0] < '0' || suffix[0] > '9' {
+		return 0, false
+	}
+	index, err := strconv.Atoi(suffix)
+	return index, err == nil
+}
+
+// matchCookie returns the value of the cookie name, as cookieValue does, or
+// of the cookie chunks it matches, as cookiePrefixValue does, if it ends in
+// "*".
+func matchCookie(header http.Header, name string) (string, bool) {
+	if prefix, ok := cookieNamePrefix(name); ok {
+		return cookiePrefixValue(header, prefix)
+	}
+	return cookieValue(header, name)
+}
+
+// cookieNamePrefix returns name without its trailing "*" and true, if it is a
+// prefix pattern, or false otherwise.
+func cookieNamePrefix(name string) (string, bool) {
+	if last := len(name) - 1; last >= 0 && name[last] == '*' {
+		return name[:last], true
+	}
+	return name, false
+}
+
+// unquoteCookieValue removes surrounding double quotes from value.
+func unquoteCookieValue(value string) string {
+	if len(value) > 1 && value[0] == '"' && value[len(value)-1] == '"' {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// valueMatcher restricts the values of the cookie that selects an upstream to
+// those beginning with prefix or containing a match for pattern. A nil
+// *valueMatcher accepts every value.
+type valueMatcher struct {
+	prefix  string
+	pattern *regexp.Regexp
+}
+
+func (matcher *valueMatcher) matches(value string) bool {
+	if matcher == nil {
+		return true
+	} else if matcher.pattern != nil {
+		return matcher.pattern.MatchString(value)
+	}
+	return strings.HasPrefix(value, matcher.prefix)
+}
+
+// String describes the values matcher accepts, for explain.
+func (matcher *valueMatcher) String() string {
+	if matcher == nil {
+		return ""
+	} else if matcher.pattern != nil {
+		return " matching " + matcher.pattern.String()
+	}
+	return " beginning with " + matcher.prefix
+}
+
+// cookieValueCovers returns true if every cookie value later accepts is one
+// that earlier accepts: if earlier accepts any value, if both have the same
+// pattern, or if the prefix of later begins with that of earlier.
+func cookieValueCovers(earlier, later *AuthDelegateUpstream) bool {
+	if earlier.CookieValuePattern != "" {
+		return earlier.CookieValuePattern == later.CookieValuePattern
+	} else if earlier.CookieValuePrefix == "" {
+		return true
+	}
+	return later.CookieValuePattern == "" &&
+		strings.HasPrefix(later.CookieValuePrefix, earlier.CookieValuePrefix)
+}
+
+func validateCookieValue(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	if upstream.CookieValuePrefix == "" &&
+		upstream.CookieValuePattern == "" {
+		return msgs
+	} else if upstream.CookieName == "" {
+		msgs = append(msgs, "cookie_value_prefix and "+
+			"cookie_value_pattern require cookie_name: "+upstream.URL)
+	} else if upstream.CookieValuePrefix != "" &&
+		upstream.CookieValuePattern != "" {
+		msgs = append(msgs, "both cookie_value_prefix and "+
+			"cookie_value_pattern defined: "+upstream.URL)
+	}
+	upstream.cookieValue = &valueMatcher{prefix: upstream.CookieValuePrefix}
+	if upstream.CookieValuePattern != "" {
+		var err error
+		if upstream.cookieValue.pattern, err = regexp.Compile(
+			upstream.CookieValuePattern); err != nil {
+			msgs = append(msgs, "invalid cookie_value_pattern for "+
+				upstream.URL+": "+err.Error())
+		}
+	}
+	return msgs
+}
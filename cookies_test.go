@@ -0,0 +1,247 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+var _ = Describe("Cookie and header scanning", func() {
+	var header http.Header
+
+	BeforeEach(func() {
+		header = http.Header{}
+	})
+
+	It("should find no cookies if there is no Cookie header", func() {
+		_, ok := cookieValue(header, "_cookie")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should find cookies in any position and header line", func() {
+		header.Add("Cookie", "foo=bar; _cookie_not=xyzzy;baz=quux")
+		header.Add("Cookie", "plugh= ; _cookie=\"v2:foobar\"")
+		for name, expected := range map[string]string{
+			"foo":     "bar",
+			"baz":     "quux",
+			"plugh":   "",
+			"_cookie": "v2:foobar",
+		} {
+			value, ok := cookieValue(header, name)
+			Expect(ok).To(BeTrue())
+			Expect(value).To(Equal(expected))
+		}
+		_, ok := cookieValue(header, "_cook")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should agree with http.Request.Cookie", func() {
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header = header
+		header.Set("Cookie", "a=1; b=\"2\"; c=; d")
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			cookie, err := req.Cookie(name)
+			value, ok := cookieValue(header, name)
+			Expect(ok).To(Equal(err == nil))
+			if ok {
+				Expect(value).To(Equal(cookie.Value))
+			}
+		}
+	})
+
+	It("should join the values of cookies matching a prefix", func() {
+		header.Add("Cookie", "_oauth2_proxy_0=abc; theme=dark")
+		header.Add("Cookie", "_oauth2_proxy_1=\"def\"")
+		value, ok := matchCookie(header, "_oauth2_proxy*")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("abcdef"))
+		value, ok = matchCookie(header, "theme")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("dark"))
+		_, ok = matchCookie(header, "_oauth2_proxy")
+		Expect(ok).To(BeFalse())
+		_, ok = matchCookie(header, "_session*")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should join only numbered chunks, in numeric order", func() {
+		header.Add("Cookie", "_oauth2_proxy_10=k; _oauth2_proxy_csrf=x")
+		header.Add("Cookie", "_oauth2_proxy_1=b; _oauth2_proxy_0=a")
+		header.Add("Cookie", "_oauth2_proxy=whole; _oauth2_proxyfoo_0=y")
+		for i := 2; i < 10; i++ {
+			header.Add("Cookie", "_oauth2_proxy_"+strconv.Itoa(i)+"=-")
+		}
+		value, ok := matchCookie(header, "_oauth2_proxy*")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("ab--------k"))
+
+		header.Del("Cookie")
+		header.Add("Cookie", "_oauth2_proxy_csrf=x; _oauth2_proxy=whole")
+		value, ok = matchCookie(header, "_oauth2_proxy*")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("whole"))
+
+		header.Set("Cookie", "_oauth2_proxy_csrf=x")
+		_, ok = matchCookie(header, "_oauth2_proxy*")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should treat an empty header as absent", func() {
+		header.Set("X-Signature", "")
+		_, ok := headerValue(header, "X-Signature")
+		Expect(ok).To(BeFalse())
+		header.Set("X-Signature", "foobar")
+		value, ok := headerValue(header, "X-Signature")
+		Expect(ok).To(BeTrue())
+		Expect(value).To(Equal("foobar"))
+	})
+})
+
+var _ = Describe("Cookie value matching", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:              "v2",
+					URL:               "http://localhost:8081",
+					CookieName:        "_session",
+					CookieAliases:     []string{"_session_v2"},
+					CookieValuePrefix: "v2:",
+				},
+				&AuthDelegateUpstream{
+					Name:               "v3",
+					URL:                "http://localhost:8082",
+					CookieName:         "_session",
+					CookieValuePattern: "^v3:[0-9a-f]+$",
+				},
+				&AuthDelegateUpstream{
+					Name:       "legacy",
+					URL:        "http://localhost:8083",
+					CookieName: "_session",
+				},
+			},
+		}
+	})
+
+	selected := func(cookie string) string {
+		Expect(opts.Validate()).To(BeNil())
+		table := newRoutingTable(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("Cookie", cookie)
+		if upstream := table.selectUpstream(req, nil); upstream != nil {
+			return upstream.name + ": " + upstream.explain(req)
+		}
+		return ""
+	}
+
+	It("should route cookies by their values", func() {
+		const v2 = "v2: cookie _session or _session_v2 beginning with " +
+			"v2: present"
+		Expect(selected("_session=v2:abc")).To(Equal(v2))
+		Expect(selected("_session=v1:abc; _session_v2=v2:def")).To(
+			Equal(v2))
+		Expect(selected("_session=\"v3:c0ffee\"")).To(Equal(
+			"v3: cookie _session matching ^v3:[0-9a-f]+$ present"))
+		Expect(selected("_session=v3:tea")).To(Equal(
+			"legacy: cookie _session present"))
+		Expect(selected("_session=abc")).To(Equal(
+			"legacy: cookie _session present"))
+		Expect(selected("_session_v2=v1:abc")).To(BeEmpty())
+	})
+
+	It("should report upstreams shadowed by a broader one", func() {
+		opts.Upstreams = append(opts.Upstreams[2:], opts.Upstreams[:2]...)
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"upstream v3 is shadowed by earlier upstream legacy and " +
+				"can never match",
+		})))
+
+		opts.MatchPolicy = "most_specific"
+		Expect(selected("_session=v3:c0ffee")).To(HavePrefix("v3: "))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].CookieValuePattern = "^v2:"
+		opts.Upstreams[1].CookieValuePattern = "v3:("
+		opts.Upstreams[2] = &AuthDelegateUpstream{
+			URL:               "http://localhost:8083",
+			HeaderName:        "X-Session",
+			CookieValuePrefix: "v1:",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"both cookie_value_prefix and cookie_value_pattern " +
+				"defined: http://localhost:8081",
+			"invalid cookie_value_pattern for http://localhost:8082: " +
+				"error parsing regexp: missing closing ): `v3:(`",
+			"cookie_value_prefix and cookie_value_pattern require " +
+				"cookie_name: http://localhost:8083",
+		})))
+	})
+})
+
+func newBenchmarkCookieRequest() *http.Request {
+	req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+	req.Header.Set("Cookie", "_ga=GA1.2.3456789.1234567890; "+
+		"_gid=GA1.2.987654321.1234567890; theme=dark; "+
+		"_oauth2_proxy=dGhpcyBpcyBhIHNlc3Npb24gY29va2ll")
+	return req
+}
+
+// BenchmarkRequestCookie is the baseline for BenchmarkUpstreamAcceptsCookie:
+// the cost of the presence check using http.Request.Cookie.
+func BenchmarkRequestCookie(b *testing.B) {
+	req := newBenchmarkCookieRequest()
+	b.ReportAllocs()
+	for i := 0; i != b.N; i++ {
+		if _, err := req.Cookie("_oauth2_proxy"); err != nil {
+			b.Fatal("cookie not found")
+		}
+	}
+}
+
+func BenchmarkUpstreamAcceptsCookie(b *testing.B) {
+	req := newBenchmarkCookieRequest()
+	upstream := &authDelegate{cookieName: "_oauth2_proxy"}
+	b.ReportAllocs()
+	for i := 0; i != b.N; i++ {
+		if !upstream.accepts(req) {
+			b.Fatal("cookie not found")
+		}
+	}
+}
+
+func BenchmarkUpstreamAcceptsHeader(b *testing.B) {
+	req := newBenchmarkCookieRequest()
+	req.Header.Set("X-Signature", "foobar")
+	upstream := &authDelegate{headerName: "X-Signature"}
+	b.ReportAllocs()
+	for i := 0; i != b.N; i++ {
+		if !upstream.accepts(req) {
+			b.Fatal("header not found")
+		}
+	}
+}
+
+func BenchmarkSelectUpstream(b *testing.B) {
+	req := newBenchmarkCookieRequest()
+	table := &routingTable{upstreams: []*authDelegate{
+		&authDelegate{name: "hmac", headerName: "X-Signature"},
+		&authDelegate{name: "oauth2", cookieName: "_oauth2_proxy"},
+		&authDelegate{name: "default"},
+	}}
+	b.ReportAllocs()
+	for i := 0; i != b.N; i++ {
+		if table.selectUpstream(req, nil).name != "oauth2" {
+			b.Fatal("wrong upstream selected")
+		}
+	}
+}
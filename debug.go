@@ -0,0 +1,116 @@
+package authdelegate
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// debugHeader carries the trace ID of a traced request to the upstream, so
+// that backend logs for the same request can be correlated with ours.
+const debugHeader = "X-Auth-Debug"
+
+// configFingerprintHeader reports the fingerprint of the configuration in
+// effect in the response to a traced request.
+const configFingerprintHeader = "X-Auth-Config-Fingerprint"
+
+// matchTraceHeader reports the result of evaluating each upstream against a
+// request in the response, if match_trace_header is enabled.
+const matchTraceHeader = "X-Auth-Match-Trace"
+
+// requestTrace logs verbose details about the handling of a single request,
+// and may record how each upstream was evaluated against it. A nil
+// *requestTrace is valid and discards all output, so that callers need not
+// check whether tracing is enabled.
+type requestTrace struct {
+	// Empty unless verbose logging is enabled for the request
+	id string
+
+	// If true, matches records each upstream evaluation
+	recordMatches bool
+	matches       []matchEvaluation
+}
+
+// matchEvaluation records the result of evaluating an upstream against a
+// request, and the reason for it.
+type matchEvaluation struct {
+	Upstream string `json:"upstream"`
+	Result   string `json:"result"`
+	Reason   string `json:"reason"`
+}
+
+// String formats the evaluation as a matchTraceHeader value.
+func (evaluation matchEvaluation) String() string {
+	return "name=" + evaluation.Upstream + "; result=" + evaluation.Result +
+		"; reason=" + evaluation.Reason
+}
+
+func (trace *requestTrace) logging() bool {
+	return trace != nil && trace.id != ""
+}
+
+func (trace *requestTrace) Printf(format string, args ...interface{}) {
+	if !trace.logging() {
+		return
+	}
+	log.Printf("debug %s: "+format, append([]interface{}{trace.id}, args...)...)
+}
+
+// evaluated records that upstream was evaluated against req with the
+// specified result: "match", "miss", "draining", or "skipped".
+func (trace *requestTrace) evaluated(upstream *authDelegate,
+	req *http.Request, result string) {
+	if trace == nil {
+		return
+	}
+	reason := upstream.explain(req)
+	trace.Printf("upstream %s: %s (%s)", upstream.name, result, reason)
+	if trace.recordMatches {
+		trace.matches = append(trace.matches,
+			matchEvaluation{upstream.name, result, reason})
+	}
+}
+
+func newRequestTrace() *requestTrace {
+	var id [8]byte
+	rand.Read(id[:])
+	return &requestTrace{id: hex.EncodeToString(id[:])}
+}
+
+func hashCredential(credential string) string {
+	digest := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(digest[:])
+}
+
+// traceFor returns a new requestTrace if req carries the debug cookie or a
+// credential whose hash appears in the debug set; returns nil otherwise.
+func (table *routingTable) traceFor(req *http.Request) *requestTrace {
+	if table.debugCookieName != "" {
+		if _, ok := cookieValue(req.Header, table.debugCookieName); ok {
+			return newRequestTrace()
+		}
+	}
+	if len(table.debugHashes) == 0 {
+		return nil
+	}
+	for _, upstream := range table.upstreams {
+		credential, ok := upstream.credential(req)
+		if ok && table.debugHashes[hashCredential(credential)] {
+			return newRequestTrace()
+		}
+	}
+	return nil
+}
+
+// statusRecorder captures the status code written by an upstream handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
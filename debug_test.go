@@ -0,0 +1,179 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Per-credential debug tracing", func() {
+	var req *http.Request
+	var opts *AuthDelegateOptions
+	var server *httptest.Server
+	var debugID string
+
+	BeforeEach(func() {
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			debugID = req.Header.Get(debugHeader)
+			rw.WriteHeader(http.StatusAccepted)
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		debugID = ""
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        server.URL,
+					HeaderName: "X-Signature",
+				},
+				&AuthDelegateUpstream{URL: server.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newHandler := func() *authDelegateHandler {
+		Expect(opts.Validate()).To(BeNil())
+		return NewAuthDelegate(opts).(*authDelegateHandler)
+	}
+
+	traceFor := func(handler *authDelegateHandler) *requestTrace {
+		return handler.routes().traceFor(req)
+	}
+
+	It("should not trace requests by default", func() {
+		req.Header.Set("X-Signature", "foobar")
+		Expect(traceFor(newHandler())).To(BeNil())
+	})
+
+	It("should trace requests carrying the debug cookie", func() {
+		opts.DebugCookieName = "_debug"
+		req.AddCookie(&http.Cookie{Name: "_debug", Value: "1"})
+		Expect(traceFor(newHandler())).ToNot(BeNil())
+	})
+
+	It("should trace requests carrying a listed credential", func() {
+		opts.DebugCredentialHashes = []string{hashCredential("foobar")}
+		handler := newHandler()
+		req.Header.Set("X-Signature", "foobar")
+		Expect(traceFor(handler)).ToNot(BeNil())
+		req.Header.Set("X-Signature", "bazquux")
+		Expect(traceFor(handler)).To(BeNil())
+	})
+
+	It("should pass the trace ID to the upstream", func() {
+		opts.DebugCookieName = "_debug"
+		req.AddCookie(&http.Cookie{Name: "_debug", Value: "1"})
+		recorder := httptest.NewRecorder()
+		newHandler().ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(debugID).To(HaveLen(16))
+	})
+
+	It("should strip a trace ID from untraced requests", func() {
+		req.Header.Set(debugHeader, "spoofed")
+		recorder := httptest.NewRecorder()
+		newHandler().ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(debugID).To(Equal(""))
+	})
+
+	It("should fail validation if a hash is malformed", func() {
+		opts.DebugCredentialHashes = []string{"foobar"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"debug credential hash is not a hex-encoded " +
+				"SHA-256 digest: foobar",
+		})))
+	})
+})
+
+var _ = Describe("Match evaluation trace header", func() {
+	var server *httptest.Server
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusAccepted)
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "oauth2",
+					URL:        server.URL,
+					CookieName: "_oauth2_proxy",
+				},
+				&AuthDelegateUpstream{
+					Name:       "hmac",
+					URL:        server.URL,
+					HeaderName: "X-Signature",
+				},
+				&AuthDelegateUpstream{
+					Name: "default",
+					URL:  server.URL,
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("X-Signature", "foobar")
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		return recorder
+	}
+
+	It("should not add the header by default", func() {
+		Expect(serve().HeaderMap[matchTraceHeader]).To(BeNil())
+	})
+
+	It("should report each upstream evaluated up to the match", func() {
+		opts.MatchTraceHeader = true
+		Expect(serve().HeaderMap[matchTraceHeader]).To(Equal([]string{
+			"name=oauth2; result=miss; " +
+				"reason=cookie _oauth2_proxy absent",
+			"name=hmac; result=match; " +
+				"reason=header X-Signature present",
+		}))
+	})
+
+	It("should report the config fingerprint with the trace", func() {
+		Expect(serve().HeaderMap[configFingerprintHeader]).To(BeNil())
+		opts.MatchTraceHeader = true
+		Expect(serve().Header().Get(configFingerprintHeader)).To(
+			Equal(opts.Fingerprint()))
+	})
+
+	It("should report draining upstreams", func() {
+		opts.MatchTraceHeader = true
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts).(*authDelegateHandler)
+		delegate.routes().findUpstream("hmac").setDraining(true)
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("X-Signature", "foobar")
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.HeaderMap[matchTraceHeader]).To(Equal([]string{
+			"name=oauth2; result=miss; " +
+				"reason=cookie _oauth2_proxy absent",
+			"name=hmac; result=draining; " +
+				"reason=header X-Signature present",
+			"name=default; result=match; reason=default upstream",
+		}))
+	})
+})
@@ -1,69 +1,979 @@
-package main
+package authdelegate
 
 import (
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // NewAuthDelegate creates a http.Handler that demultiplexes requests based on
 // the configuration of opts.Upstreams.
 func NewAuthDelegate(opts *AuthDelegateOptions) http.Handler {
-	var handler authDelegateHandler
-	for _, upstream := range opts.Upstreams {
-		handler.upstreams = append(handler.upstreams, authDelegate{
-			upstream.HeaderName,
-			upstream.CookieName,
-			newAuthDelegateReverseProxy(upstream.parsedURL),
-		})
+	storage := newStorage(opts)
+	handler := &authDelegateHandler{
+		storage:       storage,
+		cache:         &decisionCache{storage},
+		revocations:   newRevocationList(storage),
+		subscriptions: newDecisionSubscriptions(),
+		diagnostics:   newDiagnostics(opts),
+		redactor:      newLogRedactor(opts),
+		exporter:      newSpanExporter(),
+		started:       time.Now(),
+
+		forwardClientCert: opts.forwardsClientCert(),
+		customErrors:      opts.ErrorHandler,
+	}
+	handler.activate(newRoutingTable(opts))
+	if opts.Storage != nil && opts.Storage.Type == storageRedis {
+		go handler.revocations.refresh(revocationRefreshInterval)
 	}
-	return &handler
+	if opts.latencyLogInterval != 0 {
+		go handler.logLatency(opts.latencyLogInterval)
+	}
+	return handler
 }
 
 type authDelegateHandler struct {
-	upstreams []authDelegate
+	// Holds the current *routingTable
+	table atomic.Value
+
+	// Holds the current *routeComparison, if any
+	candidate atomic.Value
+
+	storage       Storage
+	cache         *decisionCache
+	revocations   *revocationList
+	subscriptions *decisionSubscriptions
+	rejections    rejectionCounts
+	diagnostics   *diagnostics
+
+	// Redacts logs and trace spans; nil unless log_redaction is defined
+	redactor *logRedactor
+
+	// Sends the trace spans of every routing table; idle unless the table
+	// in effect enables tracing
+	exporter *spanExporter
+
+	// Serializes swapRoutes
+	swapping sync.Mutex
+
+	// When the delegate was created, for its exit summary
+	started time.Time
+
+	// Set if the upstreams are read from a key-value store
+	watcher *upstreamWatcher
+
+	// Set by serveCertificate if requests are served over SSL
+	certificate expiringCertificate
+
+	// Set by watchCertificateExpiry if cert_expiry_alerts is enabled
+	certExpiry *certExpiryMonitor
+
+	// If true, replace the X-Client-Cert-* headers of each request with
+	// the details of the client's certificate
+	forwardClientCert bool
+
+	// The ErrorHandler of the options the delegate was created with, if any,
+	// which configurations posted to the admin API can't include
+	customErrors ErrorHandler
+
+	// Accessed atomically
+	requests int64
+
+	// Accessed atomically; the phase of shutdown, e.g. shutdownServing
+	shutdownPhase int32
+}
+
+// routes returns the routing table currently in effect.
+func (handler *authDelegateHandler) routes() *routingTable {
+	return handler.table.Load().(*routingTable)
+}
+
+// swapRoutes atomically replaces the routing table in effect and returns the
+// previous one. Requests already in flight complete using the previous table.
+func (handler *authDelegateHandler) swapRoutes(
+	table *routingTable) (previous *routingTable) {
+	handler.swapping.Lock()
+	defer handler.swapping.Unlock()
+	previous = handler.routes()
+	handler.activate(table)
+	return
 }
 
-func (handler authDelegateHandler) ServeHTTP(
+// activate puts table into effect, and configures the resources the delegate
+// shares between routing tables, such as its span exporter, for it. The
+// upstreams of table inherit the state of those of the previous table, if
+// any, with the same names. Health checks of the replicas of the previous
+// table stop, and those of table start.
+func (handler *authDelegateHandler) activate(table *routingTable) {
+	handler.exporter.configure(table.tracer.exportConfig())
+	previous, _ := handler.table.Load().(*routingTable)
+	if previous != nil && previous != table {
+		table.inherit(previous)
+	}
+	table.checkHealth(true)
+	handler.table.Store(table)
+	if previous != nil && previous != table {
+		previous.checkHealth(false)
+	}
+}
+
+// inherit carries the state of each upstream of previous over to the upstream
+// of table with the same name, if any.
+func (table *routingTable) inherit(previous *routingTable) {
+	for _, upstream := range table.upstreams {
+		if match := previous.findUpstream(upstream.name); match != nil {
+			upstream.inherit(match)
+		}
+	}
+}
+
+// checkHealth starts or stops checking the health of the replicas of the
+// upstreams of table.
+func (table *routingTable) checkHealth(start bool) {
+	for _, upstream := range table.upstreams {
+		if upstream.replicas == nil {
+			continue
+		} else if start {
+			upstream.replicas.checker.start()
+		} else {
+			upstream.replicas.checker.halt()
+		}
+	}
+}
+
+func (handler *authDelegateHandler) ServeHTTP(
 	rw http.ResponseWriter, req *http.Request) {
-	for _, upstream := range handler.upstreams {
-		if upstream.accepts(req) {
-			upstream.handler.ServeHTTP(rw, req)
+	table := handler.routes()
+	if table.batchPath != "" && req.URL.Path == table.batchPath {
+		handler.serveBatch(rw, req, table)
+		return
+	} else if table.subscribePath != "" &&
+		req.URL.Path == table.subscribePath {
+		handler.serveSubscription(rw, req, table)
+		return
+	} else if table.metricsPath != "" && req.URL.Path == table.metricsPath {
+		handler.serveMetrics(rw, req)
+		return
+	} else if table.healthPath != "" && req.URL.Path == table.healthPath {
+		handler.serveHealth(rw, req)
+		return
+	} else if table.readinessPath != "" &&
+		req.URL.Path == table.readinessPath {
+		handler.serveReadiness(rw, req, table)
+		return
+	} else if table.upstreamStatusPath != "" &&
+		req.URL.Path == table.upstreamStatusPath {
+		handler.serveUpstreamStatus(rw, req, table)
+		return
+	}
+	handler.delegate(rw, req, table)
+}
+
+// delegate routes req to the upstream selected by table.
+func (handler *authDelegateHandler) delegate(rw http.ResponseWriter,
+	req *http.Request, table *routingTable) {
+	atomic.AddInt64(&handler.requests, 1)
+	req = table.forwardAuth.translate(req)
+	req = table.trustedProxies.identify(req)
+	req, audit := table.startAudit(req)
+	if audit != nil {
+		recorder := &statusRecorder{rw, http.StatusOK}
+		defer func() { audit.log(table, recorder.status) }()
+		rw = recorder
+	}
+	span := table.tracer.start(req, handler.exporter, handler.redactor)
+	if span != nil {
+		recorder := &statusRecorder{rw, http.StatusOK}
+		defer func() { span.endDecision(recorder.status) }()
+		rw = recorder
+		req = req.WithContext(withSpan(req.Context(), span))
+	}
+	trace := table.traceFor(req)
+	if trace == nil && handler.diagnostics.verbose() {
+		trace = newRequestTrace()
+	}
+	if table.matchTrace {
+		if trace == nil {
+			trace = &requestTrace{}
+		}
+		trace.recordMatches = true
+	}
+	if trace != nil {
+		rw.Header().Set(configFingerprintHeader, table.fingerprint)
+	}
+	req.Header.Del(debugHeader)
+	if handler.forwardClientCert {
+		setClientCertHeaders(req)
+	}
+	if rule := table.filter.match(req); rule != "" {
+		trace.Printf("rejected by %s rule", rule)
+		explainDecision(req, "rejected by "+rule+" rule")
+		handler.rejections.count(rule)
+		table.errorHandler(rw, req, &DelegateError{Code: ErrRejected})
+		return
+	}
+	matches := table.acceptedBy(req, trace)
+	upstream := table.chooseUpstream(matches)
+	if trace != nil {
+		for _, match := range trace.matches {
+			rw.Header().Add(matchTraceHeader, match.String())
+		}
+	}
+	if upstream == nil || upstream.isDefault {
+		if allowed := table.allowedMethods(req); allowed != nil {
+			trace.Printf("method %s not allowed", originalMethod(req))
+			explainDecision(req, "method not allowed by "+
+				strings.Join(allowed, ", ")+" upstreams")
+			rw.Header().Set("Allow", strings.Join(allowed, ", "))
+			table.errorHandler(rw, req,
+				&DelegateError{Code: ErrMethodNotAllowed})
 			return
 		}
 	}
-	http.Error(rw, "unauthorized request", http.StatusUnauthorized)
+	if comparison := handler.comparison(); comparison != nil {
+		comparison.compare(req, upstream)
+	}
+	if upstream == nil && len(matches) != 0 {
+		trace.Printf("multiple upstreams match %s %s",
+			req.Method, req.RequestURI)
+		table.errorHandler(rw, req, ambiguousMatchError(matches))
+		return
+	} else if upstream == nil {
+		trace.Printf("no upstream matches %s %s",
+			req.Method, req.RequestURI)
+		table.errorHandler(rw, req,
+			&DelegateError{Code: ErrNoUpstreamMatch})
+		return
+	}
+	span.setString("authdelegate.upstream", upstream.name)
+	audit.selected(upstream, req)
+	class := table.classifier.classify(req)
+	upstream.countTraffic(class)
+	trace.Printf("traffic class %s", class)
+	rw = newAnnotationWriter(rw, upstream.acceptHeaders,
+		upstream.denyHeaders)
+	decision := &statusRecorder{rw, http.StatusOK}
+	defer func() { upstream.countDecision(decision.status) }()
+	rw = decision
+
+	var hash, key string
+	if upstream.caching() || upstream.coalescer != nil ||
+		upstream.retries != nil || len(upstream.rateLimits) != 0 ||
+		handler.revocations.any() || handler.subscriptions.any() ||
+		table.allowlist != nil {
+		if credential, ok := upstream.credential(req); ok {
+			hash = hashCredential(credential)
+			key = hash
+			if variant := upstream.cacheVariant(req); variant != "" {
+				key += ":" + variant
+			}
+		}
+	}
+	if hash != "" && handler.revocations.isRevoked(hash) {
+		trace.Printf("credential is revoked")
+		table.errorHandler(rw, req, &DelegateError{
+			Code: ErrRevoked, Upstream: upstream.name,
+		})
+		return
+	}
+	if limit := upstream.checkRateLimits(rw, req, hash); limit != "" {
+		trace.Printf("upstream %s: rate limited by %s", upstream.name,
+			limit)
+		explainDecision(req, "rate limited by "+limit)
+		table.errorHandler(rw, req, &DelegateError{
+			Code: ErrRateLimited, Upstream: upstream.name,
+		})
+		return
+	}
+	if kind, value := table.allowlist.match(req, hash); kind != "" {
+		trace.Printf("emergency allowlist matches %s", kind)
+		rw = &emergencyWriter{ResponseWriter: rw, req: req, kind: kind,
+			value: value}
+	}
+	if hash != "" {
+		if handler.subscriptions.has(hash) {
+			recorder := &statusRecorder{rw, http.StatusOK}
+			defer func() {
+				handler.subscriptions.publish(hash,
+					decisionFromStatus(recorder.status))
+			}()
+			rw = recorder
+		}
+		if upstream.caching() {
+			if decision := handler.cache.get(upstream.name,
+				key); decision != nil {
+				trace.Printf("upstream %s: cached decision %d",
+					upstream.name, decision.Status)
+				explainDecision(req, "cached decision")
+				decision.write(rw)
+				return
+			}
+			recorder := &cacheRecorder{ResponseWriter: rw}
+			defer handler.storeDecision(upstream, key, recorder)
+			rw = recorder
+		}
+	}
+	if retryKey := upstream.retries.key(req, key); retryKey != "" {
+		if decision := upstream.retries.get(retryKey); decision != nil {
+			trace.Printf("upstream %s: decision %d for a retry of the "+
+				"same request", upstream.name, decision.Status)
+			explainDecision(req, "decision for a retry of the same request")
+			decision.write(rw)
+			return
+		}
+		recorder := &cacheRecorder{ResponseWriter: rw}
+		defer upstream.retries.put(retryKey, recorder)
+		rw = recorder
+	}
+
+	if upstream.credentialHeader != "" {
+		upstream.copyCredential(req)
+	}
+	atomic.AddInt64(&upstream.inFlight, 1)
+	defer atomic.AddInt64(&upstream.inFlight, -1)
+	if !trace.logging() {
+		upstream.forward(key, rw, req)
+		return
+	}
+	req.Header.Set(debugHeader, trace.id)
+	recorder := &statusRecorder{rw, http.StatusOK}
+	start := time.Now()
+	if upstream.forward(key, recorder, req) {
+		trace.Printf("upstream %s returned %d in %s to a concurrent "+
+			"request", upstream.name, recorder.status,
+			time.Since(start))
+		return
+	}
+	trace.Printf("upstream %s returned %d in %s",
+		upstream.name, recorder.status, time.Since(start))
+}
+
+// routingTable contains the configuration-dependent state of an
+// authDelegateHandler, so that it may be replaced as a unit.
+type routingTable struct {
+	upstreams       []*authDelegate
+	debugCookieName string
+	debugHashes     map[string]bool
+	matchTrace      bool
+	errorHandler    ErrorHandler
+	batchPath       string
+	batchMax        int
+	subscribePath   string
+	metricsPath     string
+	classifier      *trafficClassifier
+	filter          *requestFilter
+	allowlist       *emergencyAllowlist
+	forwardAuth     *forwardAuthHeaders
+	trustedProxies  trustedProxies
+	tracer          *tracer
+	fingerprint     string
+	matchPolicy     string
+	auditDecisions  string
+
+	// If not empty, the paths on which to serve health and readiness checks
+	healthPath              string
+	readinessPath           string
+	upstreamStatusPath      string
+	readinessCheckUpstreams bool
+
+	// Names of the upstreams skipped by each additional listener
+	listenerSkips map[string]map[string]bool
+}
+
+func newRoutingTable(opts *AuthDelegateOptions) *routingTable {
+	table := &routingTable{
+		debugCookieName: opts.DebugCookieName,
+		debugHashes:     opts.debugHashes,
+		matchTrace:      opts.MatchTraceHeader,
+		errorHandler:    opts.errorHandler(),
+		batchPath:       opts.BatchPath,
+		batchMax:        opts.BatchMaxRequests,
+		subscribePath:   opts.SubscribePath,
+		metricsPath:     opts.MetricsPath,
+		classifier:      newTrafficClassifier(opts),
+		filter:          newRequestFilter(opts),
+		allowlist:       newEmergencyAllowlist(opts),
+		forwardAuth:     newForwardAuthHeaders(opts),
+		trustedProxies:  newTrustedProxies(opts),
+		tracer:          newTracer(opts),
+		fingerprint:     opts.Fingerprint(),
+		matchPolicy:     opts.MatchPolicy,
+		auditDecisions:  opts.AuditDecisions,
+
+		healthPath:              opts.HealthPath,
+		readinessPath:           opts.ReadinessPath,
+		upstreamStatusPath:      opts.UpstreamStatusPath,
+		readinessCheckUpstreams: opts.ReadinessCheckUpstreams,
+	}
+	for _, listener := range opts.Listeners {
+		if len(listener.SkipUpstreams) == 0 {
+			continue
+		}
+		if table.listenerSkips == nil {
+			table.listenerSkips = make(map[string]map[string]bool)
+		}
+		skips := make(map[string]bool)
+		for _, name := range listener.SkipUpstreams {
+			skips[name] = true
+		}
+		table.listenerSkips[listener.listenerName()] = skips
+	}
+	for _, upstream := range opts.Upstreams {
+		delegate := &authDelegate{
+			name:             upstreamLabel(upstream),
+			headerName:       http.CanonicalHeaderKey(upstream.HeaderName),
+			cookieName:       upstream.CookieName,
+			headerAliases:    canonicalHeaderKeys(upstream.HeaderAliases),
+			cookieAliases:    upstream.CookieAliases,
+			cookieValue:      upstream.cookieValue,
+			headerPatterns:   upstream.headerValueRegex,
+			credentialHeader: upstream.CredentialHeader,
+			acceptHeaders:    upstream.AcceptHeaders,
+			denyHeaders:      upstream.DenyHeaders,
+			address:          upstreamAddress(upstream.parsedURL),
+			isDefault:        upstream.isDefault(),
+			specificity:      newMatchSpecificity(upstream),
+			latency:          newLatencyHistogram(upstream.latencyBuckets),
+			host:             upstream.Host,
+			pathPrefix:       upstream.PathPrefix,
+			traffic:          upstream.Traffic,
+			classifier:       table.classifier,
+			authScheme:       authSchemePrefix(upstream.AuthScheme),
+			expression:       upstream.matchExpression,
+			match:            upstream.match,
+			methods:          upstream.methods,
+
+			cacheTTL:             upstream.cacheTTL,
+			denyCacheTTL:         upstream.denyCacheTTL,
+			approvals:            newCacheBudget(upstream.CacheMaxEntries),
+			denials:              newCacheBudget(upstream.DenyCacheMaxEntries),
+			cacheKey:             upstream.CacheKey,
+			cacheKeyPathSegments: upstream.CacheKeyPathSegments,
+			coalescer:            newRequestCoalescer(upstream.CoalesceRequests),
+			retries:              newRetryDeduplicator(upstream),
+			rateLimits:           newRateLimiters(upstream),
+		}
+		var decider http.Handler
+		if upstream.Type == upstreamStaticTokens {
+			decider = newStaticTokensHandler(upstream, delegate)
+		} else if upstream.Type == upstreamHMAC {
+			decider = newHMACHandler(upstream, delegate)
+		} else if upstream.Type == upstreamJWT {
+			decider = newJWTHandler(upstream, delegate)
+		} else if upstream.Type == upstreamPlugin {
+			decider, delegate.plugin = newPluginHandler(upstream)
+		} else if upstream.Type == upstreamExec {
+			decider = newExecHandler(upstream, delegate)
+		} else {
+			delegate.replicas = newReplicaSet(upstream)
+			delegate.retryPolicy = newRetryPolicy(upstream,
+				delegate.replicas)
+			proxy := newAuthDelegateReverseProxy(upstream, opts,
+				delegate.replicas, delegate.retryPolicy)
+			delegate.failOpen = newFailOpenPolicy(upstream)
+			if delegate.failOpen != nil {
+				delegate.failOpen.apply(proxy)
+			}
+			if upstream.OnError == onErrorFailOpen {
+				failOpenOnError(proxy, upstreamLabel(upstream))
+			}
+			delegate.errorSamples = newErrorSampler(opts)
+			if delegate.errorSamples != nil {
+				delegate.errorSamples.apply(proxy)
+			}
+			decider = proxy
+			if upstream.DisableChunkedRequests {
+				decider = newBufferingHandler(upstream, opts,
+					proxy)
+			}
+		}
+		delegate.handler = &timedHandler{delegate.latency, decider}
+		delegate.breaker = newCircuitBreaker(upstream)
+		if delegate.breaker != nil {
+			delegate.handler = newCircuitBreakerHandler(upstream,
+				opts, delegate.breaker, delegate.handler)
+		}
+		delegate.limiter = newAdaptiveLimiter(upstream)
+		if delegate.limiter != nil {
+			delegate.handler = newLimitedHandler(upstream, opts,
+				delegate.limiter, delegate.handler)
+		}
+		table.upstreams = append(table.upstreams, delegate)
+	}
+	return table
+}
+
+// selectUpstream returns the upstream that decides req under the match
+// policy, or nil if no upstream accepts it, or if the policy refuses it as
+// ambiguous.
+func (table *routingTable) selectUpstream(
+	req *http.Request, trace *requestTrace) *authDelegate {
+	return table.chooseUpstream(table.acceptedBy(req, trace))
+}
+
+// findUpstream returns the upstream with the specified name, or nil if there
+// is no such upstream.
+func (table *routingTable) findUpstream(name string) *authDelegate {
+	for _, upstream := range table.upstreams {
+		if upstream.name == name {
+			return upstream
+		}
+	}
+	return nil
 }
 
 type authDelegate struct {
+	name       string
 	headerName string
 	cookieName string
 	handler    http.Handler
+	address    string
+
+	// Further headers or cookies whose values are used as the credential if
+	// headerName or cookieName is absent
+	headerAliases []string
+	cookieAliases []string
+
+	// If not nil, the values of cookieName or cookieAliases this upstream
+	// accepts
+	cookieValue *valueMatcher
+
+	// Headers whose values must match for this upstream to accept requests
+	headerPatterns []headerPattern
+
+	// If not empty, the header in which the credential is sent upstream
+	credentialHeader string
+
+	// Headers added to responses that allow and deny requests
+	acceptHeaders map[string]string
+	denyHeaders   map[string]string
+
+	// URLs to which requests are sent, or nil if the upstream decides them
+	// itself
+	replicas *replicaSet
+
+	// Whether the upstream has no match conditions, and how narrow they are
+	isDefault   bool
+	specificity matchSpecificity
+
+	// If not empty, the only hosts, paths, and traffic class this upstream
+	// accepts
+	host       string
+	pathPrefix string
+	traffic    string
+	classifier *trafficClassifier
+
+	// If not empty, the Authorization scheme, followed by a space, that
+	// requests must carry to be accepted
+	authScheme string
+
+	// If not nil, an expression that must be true of requests accepted
+	expression *expression
+
+	// If not nil, the compiled match block that must be true of requests
+	// accepted
+	match *expression
+
+	// If not nil, the only methods of requests accepted
+	methods []string
+
+	// If not nil, the plugin verifier that must accept requests accepted
+	plugin pluginMatcher
+
+	cacheTTL             time.Duration
+	denyCacheTTL         time.Duration
+	approvals            *cacheBudget
+	denials              *cacheBudget
+	cacheKey             []string
+	cacheKeyPathSegments int
+	coalescer            *requestCoalescer
+	retries              *retryDeduplicator
+	retryPolicy          *retryPolicy
+	rateLimits           []*rateLimiter
+	limiter              *adaptiveLimiter
+	breaker              *circuitBreaker
+	failOpen             *failOpenPolicy
+	latency              *latencyHistogram
+	errorSamples         *errorSampler
+
+	// Accessed atomically
+	draining        int32
+	inFlight        int64
+	humanRequests   int64
+	serviceRequests int64
+	allowed         int64
+	denied          int64
+	failed          int64
 }
 
-func (delegate authDelegate) accepts(req *http.Request) bool {
-	if delegate.headerName != "" {
-		return req.Header.Get(delegate.headerName) != ""
+func (delegate *authDelegate) isDraining() bool {
+	return atomic.LoadInt32(&delegate.draining) != 0
+}
+
+// setDraining stops (or resumes) the routing of new requests to this
+// upstream. Requests already in flight are unaffected.
+func (delegate *authDelegate) setDraining(draining bool) {
+	var value int32
+	if draining {
+		value = 1
+	}
+	atomic.StoreInt32(&delegate.draining, value)
+}
+
+// inherit carries over the state that previous, the upstream of the same name
+// in the routing table being replaced, has accumulated: whether it's
+// draining, the limit its adaptive limiter has learned, the state of its
+// circuit breaker and fail-open policy, the health of its replicas, and its
+// latency histogram. The state of features that delegate doesn't enable is
+// dropped.
+func (delegate *authDelegate) inherit(previous *authDelegate) {
+	atomic.StoreInt32(&delegate.draining,
+		atomic.LoadInt32(&previous.draining))
+	delegate.limiter.inherit(previous.limiter)
+	delegate.breaker.inherit(previous.breaker)
+	delegate.failOpen.inherit(previous.failOpen)
+	delegate.replicas.inherit(previous.replicas)
+	delegate.latency.inherit(previous.latency)
+}
+
+// forward sends req to the upstream, unless the upstream coalesces requests
+// and one with the same key, the credential hash and cache variant, is
+// already in flight. Returns true if the response was shared with such a
+// request.
+func (delegate *authDelegate) forward(key string, rw http.ResponseWriter,
+	req *http.Request) bool {
+	if key == "" {
+		delegate.handler.ServeHTTP(rw, req)
+		return false
+	}
+	return delegate.coalescer.serve(key, delegate.handler, rw, req)
+}
+
+func (delegate *authDelegate) accepts(req *http.Request) bool {
+	return delegate.acceptsMethod(req) && delegate.acceptsAnyMethod(req)
+}
+
+// acceptsAnyMethod returns true if this upstream would accept req were it
+// not restricted to methods.
+func (delegate *authDelegate) acceptsAnyMethod(req *http.Request) bool {
+	if delegate.traffic != "" &&
+		delegate.classifier.classify(req) != delegate.traffic {
+		return false
+	} else if !delegate.acceptsHost(req) || !delegate.acceptsPath(req) ||
+		!delegate.acceptsAuthScheme(req) ||
+		!delegate.acceptsExpression(req) ||
+		(delegate.match != nil && !delegate.match.matches(req)) ||
+		!delegate.acceptsPlugin(req) ||
+		unmatchedHeader(delegate.headerPatterns, req) != nil {
+		return false
+	}
+	if delegate.headerName == "" && delegate.cookieName == "" {
+		return true
+	}
+	_, ok := delegate.credential(req)
+	return ok
+}
+
+// explain describes why this upstream does or doesn't accept req.
+func (delegate *authDelegate) explain(req *http.Request) string {
+	if delegate.traffic != "" {
+		if class := delegate.classifier.classify(req); class !=
+			delegate.traffic {
+			return class + " traffic"
+		}
+	}
+	if !delegate.acceptsHost(req) {
+		return "host other than " + delegate.host
+	} else if !delegate.acceptsPath(req) {
+		return "path outside " + delegate.pathPrefix
+	} else if !delegate.acceptsMethod(req) {
+		return "method " + originalMethod(req) + " other than " +
+			strings.Join(delegate.methods, ", ")
+	} else if !delegate.acceptsAuthScheme(req) {
+		return "Authorization scheme other than " +
+			strings.TrimSuffix(delegate.authScheme, " ")
+	} else if delegate.expression != nil &&
+		!delegate.expression.matches(req) {
+		return "match_expression false"
+	} else if delegate.match != nil && !delegate.match.matches(req) {
+		return "match " + delegate.match.source + " false"
+	} else if !delegate.acceptsPlugin(req) {
+		return "plugin declined"
+	} else if unmatched := unmatchedHeader(delegate.headerPatterns,
+		req); unmatched != nil {
+		return "header " + unmatched.name + " not matching " +
+			unmatched.pattern.String()
+	}
+	var description string
+	if delegate.headerName != "" && delegate.cookieName != "" {
+		if _, ok := delegate.headerCredential(req); !ok {
+			return delegate.describeHeader() + " absent"
+		}
+		description = delegate.describeHeader() + " and " +
+			delegate.describeCookie()
+	} else if delegate.headerName != "" {
+		description = delegate.describeHeader()
 	} else if delegate.cookieName != "" {
-		_, err := req.Cookie(delegate.cookieName)
-		return err != http.ErrNoCookie
+		description = delegate.describeCookie()
+	} else if len(delegate.headerPatterns) != 0 {
+		return describeHeaderPatterns(delegate.headerPatterns)
+	} else if delegate.expression != nil {
+		return "match_expression true"
+	} else if delegate.match != nil {
+		return "match " + delegate.match.source + " true"
+	} else if delegate.plugin != nil {
+		return "plugin accepted"
+	} else if delegate.pathPrefix != "" {
+		return "path within " + delegate.pathPrefix
+	} else if delegate.host != "" {
+		return "host " + delegate.host
+	} else if delegate.methods != nil {
+		return "method " + strings.Join(delegate.methods, " or ")
+	} else if delegate.traffic != "" {
+		return delegate.traffic + " traffic"
+	} else {
+		return "default upstream"
+	}
+	if _, ok := delegate.credential(req); ok {
+		return description + " present"
+	}
+	return description + " absent"
+}
+
+func (delegate *authDelegate) describeHeader() string {
+	return "header " + strings.Join(append([]string{delegate.headerName},
+		delegate.headerAliases...), " or ")
+}
+
+func (delegate *authDelegate) describeCookie() string {
+	return "cookie " + strings.Join(append([]string{delegate.cookieName},
+		delegate.cookieAliases...), " or ") +
+		delegate.cookieValue.String()
+}
+
+// acceptsHost returns true if this upstream has no host, or if it matches the
+// host of req.
+func (delegate *authDelegate) acceptsHost(req *http.Request) bool {
+	return delegate.host == "" || hostMatches(requestHost(req),
+		delegate.host)
+}
+
+// hostMatches returns true if host is pattern, ignoring case, or if pattern
+// begins with "*." and host is a subdomain of the rest of it.
+func hostMatches(host, pattern string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return strings.EqualFold(host, pattern)
+	}
+	suffix := pattern[1:]
+	return len(host) > len(suffix) &&
+		strings.EqualFold(host[len(host)-len(suffix):], suffix)
+}
+
+// acceptsPath returns true if this upstream has no path prefix, or if the
+// normalized path of the X-Original-URI of req is or is below it.
+func (delegate *authDelegate) acceptsPath(req *http.Request) bool {
+	return delegate.pathPrefix == "" || hasPathPrefix(requestPath(req),
+		delegate.pathPrefix)
+}
+
+// hasPathPrefix returns true if path is prefix, or is below it: "/api"
+// matches "/api" and "/api/users", but not "/apis".
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") ||
+		path[len(prefix)] == '/'
+}
+
+// authSchemePrefix returns the prefix of Authorization headers using scheme,
+// or the empty string if scheme is empty.
+func authSchemePrefix(scheme string) string {
+	if scheme == "" {
+		return ""
+	}
+	return scheme + " "
+}
+
+// acceptsAuthScheme returns true if this upstream has no Authorization scheme,
+// or if the Authorization header of req uses it, ignoring case.
+func (delegate *authDelegate) acceptsAuthScheme(req *http.Request) bool {
+	if delegate.authScheme == "" {
+		return true
+	}
+	authorization, _ := headerValue(req.Header, "Authorization")
+	return len(authorization) > len(delegate.authScheme) &&
+		strings.EqualFold(authorization[:len(delegate.authScheme)],
+			delegate.authScheme)
+}
+
+// acceptsExpression returns true if this upstream has no match_expression, or
+// if it is true of req.
+func (delegate *authDelegate) acceptsExpression(req *http.Request) bool {
+	return delegate.expression == nil || delegate.expression.matches(req)
+}
+
+// acceptsPlugin returns true if this upstream has no plugin verifier that
+// decides which requests it accepts, or if its verifier accepts req.
+func (delegate *authDelegate) acceptsPlugin(req *http.Request) bool {
+	return delegate.plugin == nil || delegate.plugin.Accepts(req)
+}
+
+// credential returns the value of the header or cookie that selects this
+// upstream, and whether it was present in req with a value the upstream
+// accepts. An upstream with both a header_name and a cookie_name requires
+// both, and its credential is the value of the header. Always returns false
+// for a default upstream. Does not allocate, as it's called for every
+// upstream evaluated against every request.
+func (delegate *authDelegate) credential(req *http.Request) (string, bool) {
+	if delegate.cookieName != "" {
+		value, ok := delegate.cookieCredential(req)
+		if !ok || delegate.headerName == "" {
+			return value, ok
+		}
+	}
+	if delegate.headerName != "" {
+		return delegate.headerCredential(req)
+	}
+	return "", false
+}
+
+// headerCredential returns the value of the first of this upstream's
+// names of header_name present in req.
+func (delegate *authDelegate) headerCredential(req *http.Request) (
+	string, bool) {
+	if value, ok := headerValue(req.Header, delegate.headerName); ok {
+		return value, ok
+	}
+	for _, name := range delegate.headerAliases {
+		if value, ok := headerValue(req.Header, name); ok {
+			return value, ok
+		}
+	}
+	return "", false
+}
+
+// cookieCredential returns the value of the first of this upstream's
+// names of cookie_name present in req with a value it accepts.
+func (delegate *authDelegate) cookieCredential(req *http.Request) (
+	string, bool) {
+	if value, ok := matchCookie(req.Header,
+		delegate.cookieName); ok && delegate.cookieValue.matches(value) {
+		return value, ok
+	}
+	for _, name := range delegate.cookieAliases {
+		if value, ok := matchCookie(req.Header, name); ok &&
+			delegate.cookieValue.matches(value) {
+			return value, ok
+		}
+	}
+	return "", false
+}
+
+// copyCredential sets the credentialHeader of req to the credential that
+// selected this upstream, replacing any value the client sent.
+func (delegate *authDelegate) copyCredential(req *http.Request) {
+	req.Header.Del(delegate.credentialHeader)
+	if credential, ok := delegate.credential(req); ok {
+		req.Header.Set(delegate.credentialHeader, credential)
+	}
+}
+
+// Values of an upstream's head_requests and options_requests options
+const (
+	methodPass = "pass"
+	methodGet  = "get"
+)
+
+// convertedMethods returns the set of methods that upstream sends as GET.
+func convertedMethods(upstream *AuthDelegateUpstream) map[string]bool {
+	converted := make(map[string]bool)
+	if upstream.HeadRequests == methodGet {
+		converted[http.MethodHead] = true
 	}
-	return true
+	if upstream.OptionsRequests == methodGet {
+		converted[http.MethodOptions] = true
+	}
+	return converted
 }
 
-func newAuthDelegateReverseProxy(url *url.URL) (proxy *httputil.ReverseProxy) {
-	proxy = httputil.NewSingleHostReverseProxy(url)
+func newAuthDelegateReverseProxy(upstream *AuthDelegateUpstream,
+	opts *AuthDelegateOptions, replicas *replicaSet,
+	retryPolicy *retryPolicy) (proxy *httputil.ReverseProxy) {
+	proxy = httputil.NewSingleHostReverseProxy(upstream.parsedURL)
+	proxy.Transport = newTimeoutTransport(retryPolicy.wrap(
+		newReplicaTransport(newTracingTransport(
+			newUpstreamTransport(upstream), opts), replicas)),
+		upstream.timeout)
+	converted := convertedMethods(upstream)
 	director := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		director(req)
+		if converted[req.Method] {
+			req.Method = http.MethodGet
+		}
 		origURI := req.Header.Get("X-Original-URI")
 		if origURI == "" {
 			origURI = req.RequestURI
 			req.Header.Set("X-Original-URI", origURI)
 		}
+		if !opts.PassAcceptEncoding {
+			req.Header.Set("Accept-Encoding", "identity")
+		}
+		url := replicas.target()
 		log.Printf("auth %s via %s\n", origURI, url.String())
 		req.URL = url
 	}
+
+	var modifiers []func(*http.Response) error
+	if !opts.PassAcceptEncoding {
+		modifiers = append(modifiers, decodeResponseBody)
+	}
+	if len(upstream.PassResponseHeaders) != 0 {
+		modifiers = append(modifiers, func(res *http.Response) error {
+			keepResponseHeaders(res, upstream.PassResponseHeaders)
+			return nil
+		})
+	}
+	if len(upstream.AuthResponseHeaders) != 0 {
+		modifiers = append(modifiers, func(res *http.Response) error {
+			keepAuthResponseHeaders(res, upstream.AuthResponseHeaders)
+			return nil
+		})
+	}
+	if opts.MaxResponseHeaders > 0 || opts.MaxResponseHeaderBytes > 0 {
+		modifiers = append(modifiers, func(res *http.Response) error {
+			limitResponseHeaders(res, opts.MaxResponseHeaders,
+				opts.MaxResponseHeaderBytes)
+			return nil
+		})
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(res); err != nil {
+				return &DelegateError{
+					Code:     ErrInvalidUpstreamResponse,
+					Upstream: upstreamLabel(upstream),
+					Cause:    err,
+				}
+			}
+		}
+		return nil
+	}
+	errorHandler := opts.errorHandler()
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request,
+		err error) {
+		delegateErr := classifyProxyError(upstreamLabel(upstream), err)
+		if code := delegateErr.Code; code == ErrUpstreamUnavailable ||
+			code == ErrUpstreamTimeout {
+			delegateErr.Status = upstream.FailClosedStatus
+		}
+		errorHandler(rw, req, delegateErr)
+	}
 	return
 }
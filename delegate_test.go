@@ -1,4 +1,4 @@
-package main
+package authdelegate
 
 import (
 	. "github.com/onsi/ginkgo"
@@ -119,6 +119,113 @@ var _ = Describe("AuthDelegate", func() {
 		Expect(recorder.Code).To(Equal(http.StatusAccepted))
 	})
 
+	It("should require both the header and the cookie if both", func() {
+		addUpstream(http.StatusAccepted, "_cookie", "X-Signature")
+		addUpstream(http.StatusNoContent, "", "X-Signature")
+		addUpstream(http.StatusUnauthorized, "", "")
+		opts.Port = 8080
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		status := func() int {
+			recorder = httptest.NewRecorder()
+			delegate.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		req.AddCookie(&http.Cookie{Name: "_cookie", Value: "session"})
+		Expect(status()).To(Equal(http.StatusUnauthorized))
+		req.Header.Set("X-Signature", "foobar")
+		Expect(status()).To(Equal(http.StatusAccepted))
+		req.Header.Del("Cookie")
+		Expect(status()).To(Equal(http.StatusNoContent))
+	})
+
+	It("should route by path prefix combined with header", func() {
+		addUpstream(http.StatusAccepted, "", "X-Signature")
+		addUpstream(http.StatusNoContent, "", "X-Signature")
+		addUpstream(http.StatusUnauthorized, "", "")
+		opts.Port = 8080
+		opts.Upstreams[0].PathPrefix = "/api"
+		opts.Upstreams[1].PathPrefix = "/admin/"
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		status := func(uri string) int {
+			recorder = httptest.NewRecorder()
+			req.Header.Set("X-Original-URI", uri)
+			delegate.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		req.Header.Set("X-Signature", "foobar")
+		Expect(status("/api")).To(Equal(http.StatusAccepted))
+		Expect(status("/api/users?id=1")).To(Equal(http.StatusAccepted))
+		Expect(status("/admin/users")).To(Equal(http.StatusNoContent))
+		Expect(status("/apis")).To(Equal(http.StatusUnauthorized))
+		Expect(status("/admin")).To(Equal(http.StatusUnauthorized))
+		Expect(status("/api/../admin/secret")).
+			To(Equal(http.StatusNoContent))
+		Expect(status("/api/%2e%2E/admin/secret")).
+			To(Equal(http.StatusNoContent))
+		Expect(status("/api/..%2fsecret")).To(Equal(http.StatusUnauthorized))
+		Expect(status("//api/./users")).To(Equal(http.StatusAccepted))
+		req.Header.Del("X-Signature")
+		Expect(status("/api/users")).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should route by virtual host", func() {
+		addUpstream(http.StatusAccepted, "", "")
+		addUpstream(http.StatusNoContent, "", "")
+		addUpstream(http.StatusUnauthorized, "", "")
+		opts.Port = 8080
+		opts.Upstreams[0].Host = "app1.example.gov"
+		opts.Upstreams[1].Host = "*.example.gov"
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		status := func(host string) int {
+			recorder = httptest.NewRecorder()
+			req.Header.Set("X-Original-Host", host)
+			delegate.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		Expect(status("APP1.example.gov:443")).
+			To(Equal(http.StatusAccepted))
+		Expect(status("app2.example.gov")).To(Equal(http.StatusNoContent))
+		Expect(status("a.app2.example.gov")).
+			To(Equal(http.StatusNoContent))
+		Expect(status("example.gov")).To(Equal(http.StatusUnauthorized))
+		req.Header.Del("X-Original-Host")
+		req.Host = "app1.example.gov"
+		recorder = httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	})
+
+	It("should route by Authorization scheme", func() {
+		addUpstream(http.StatusAccepted, "", "")
+		addUpstream(http.StatusNoContent, "_oauth2_proxy", "")
+		addUpstream(http.StatusUnauthorized, "", "")
+		opts.Port = 8080
+		opts.Upstreams[0].AuthScheme = "Bearer"
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Upstreams[0].HeaderName).To(Equal("Authorization"))
+		delegate := NewAuthDelegate(opts)
+		status := func(authorization string) int {
+			recorder = httptest.NewRecorder()
+			req.Header.Set("Authorization", authorization)
+			delegate.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		Expect(status("Bearer eyJhbGciOi")).To(Equal(http.StatusAccepted))
+		Expect(status("bearer eyJhbGciOi")).To(Equal(http.StatusAccepted))
+		Expect(status("Bearer")).To(Equal(http.StatusUnauthorized))
+		Expect(status("BearerToken foo")).
+			To(Equal(http.StatusUnauthorized))
+		Expect(status("Basic Zm9vOmJhcg==")).
+			To(Equal(http.StatusUnauthorized))
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "foo"})
+		Expect(status("Basic Zm9vOmJhcg==")).
+			To(Equal(http.StatusNoContent))
+		Expect(status("Bearer eyJhbGciOi")).To(Equal(http.StatusAccepted))
+	})
+
 	// For the following tests, we need to launch a server rather than
 	// test the AuthDelegate handler directly, so that req.RequestURI is
 	// parsed as it would be in a live server.
@@ -165,4 +272,206 @@ var _ = Describe("AuthDelegate", func() {
 		Expect(response.StatusCode).To(Equal(http.StatusAccepted))
 		Expect(*xOriginalURI).To(Equal("/baz?quux"))
 	})
+
+	It("should convert HEAD and OPTIONS requests to GET if configured",
+		func() {
+			var method string
+			server := httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					method = req.Method
+					rw.WriteHeader(http.StatusAccepted)
+				}))
+			servers = append(servers, server)
+			opts.Port = 8080
+			opts.Upstreams = []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:          server.URL,
+					HeadRequests: "get",
+				},
+			}
+			Expect(opts.Validate()).To(BeNil())
+			methodFor := func(original string) string {
+				req, _ = http.NewRequest(original, "http://foo.com/", nil)
+				recorder = httptest.NewRecorder()
+				NewAuthDelegate(opts).ServeHTTP(recorder, req)
+				Expect(recorder.Code).To(Equal(http.StatusAccepted))
+				return method
+			}
+			Expect(methodFor("HEAD")).To(Equal("GET"))
+			Expect(methodFor("OPTIONS")).To(Equal("OPTIONS"))
+			Expect(methodFor("POST")).To(Equal("POST"))
+
+			opts.Upstreams[0].HeadRequests = "pass"
+			opts.Upstreams[0].OptionsRequests = "get"
+			Expect(opts.Validate()).To(BeNil())
+			Expect(methodFor("HEAD")).To(Equal("HEAD"))
+			Expect(methodFor("OPTIONS")).To(Equal("GET"))
+		})
+
+	It("should fail validation for unknown HEAD or OPTIONS handling", func() {
+		opts.Port = 8080
+		addUpstream(http.StatusAccepted, "", "")
+		opts.Upstreams[0].HeadRequests = "GET"
+		opts.Upstreams[0].OptionsRequests = "deny"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"head_requests must be pass or get for " +
+				opts.Upstreams[0].URL + ": GET",
+			"options_requests must be pass or get for " +
+				opts.Upstreams[0].URL + ": deny",
+		})))
+	})
+
+	It("should copy the credential into credential_header", func() {
+		var credentials []string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				credentials = req.Header["X-Auth-Credential"]
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		servers = append(servers, server)
+		opts.Port = 8080
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				URL:              server.URL,
+				HeaderName:       "x-api-key",
+				CredentialHeader: "X-Auth-Credential",
+			},
+			&AuthDelegateUpstream{
+				URL:              server.URL,
+				CookieName:       "_session",
+				CredentialHeader: "x-auth-credential",
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+
+		req.Header.Set("X-Api-Key", "key")
+		req.Header.Set("X-Auth-Credential", "spoofed")
+		handler.ServeHTTP(recorder, req)
+		Expect(credentials).To(Equal([]string{"key"}))
+
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "_session", Value: "session"})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(credentials).To(Equal([]string{"session"}))
+	})
+
+	It("should match any of the header or cookie aliases", func() {
+		var credentials []string
+		server := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				credentials = req.Header["X-Auth-Credential"]
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		servers = append(servers, server)
+		opts.Port = 8080
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				URL:              server.URL,
+				CookieName:       "_oauth2_proxy",
+				CookieAliases:    []string{"_oauth2_proxy_v4"},
+				CredentialHeader: "X-Auth-Credential",
+			},
+			&AuthDelegateUpstream{
+				URL:              server.URL,
+				HeaderName:       "X-Api-Key",
+				HeaderAliases:    []string{"x-legacy-key"},
+				CredentialHeader: "X-Auth-Credential",
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_v4", Value: "old"})
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(credentials).To(Equal([]string{"old"}))
+
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy", Value: "new"})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(credentials).To(Equal([]string{"new"}))
+
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("X-Legacy-Key", "key")
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(credentials).To(Equal([]string{"key"}))
+
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should match cookie name prefixes", func() {
+		opts.Port = 8080
+		addUpstream(http.StatusAccepted, "_app_session_*", "")
+		addUpstream(http.StatusUnauthorized, "_oauth2_proxy*", "")
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+
+		req.AddCookie(&http.Cookie{Name: "_app_session_2"})
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "_app_session_billing"})
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+
+		req, _ = http.NewRequest("GET", "http://foo.com/", nil)
+		req.AddCookie(&http.Cookie{Name: "_oauth2_proxy_1"})
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should fail validation for invalid cookie name patterns", func() {
+		opts.Port = 8080
+		addUpstream(http.StatusAccepted, "_oauth2_proxy*", "")
+		addUpstream(http.StatusAccepted, "_oauth2_proxy_1", "")
+		addUpstream(http.StatusAccepted, "_a*b", "")
+		addUpstream(http.StatusAccepted, "*", "")
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid cookie name for " + opts.Upstreams[2].URL + ": _a*b",
+			"invalid cookie name for " + opts.Upstreams[3].URL + ": *",
+			"upstream " + opts.Upstreams[1].URL + " is shadowed by " +
+				"earlier upstream " + opts.Upstreams[0].URL +
+				" and can never match",
+		})))
+	})
+
+	It("should fail validation for invalid or repeated aliases", func() {
+		opts.Port = 8080
+		addUpstream(http.StatusAccepted, "_session", "")
+		addUpstream(http.StatusAccepted, "_legacy", "")
+		addUpstream(http.StatusAccepted, "", "")
+		opts.Upstreams[0].CookieAliases = []string{"_legacy"}
+		opts.Upstreams[2].HeaderAliases = []string{"X-Api-Key"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"header_name must not include empty names: " +
+				opts.Upstreams[2].URL,
+			"repeated cookie names: _legacy",
+		})))
+	})
+
+	It("should fail validation if credential_header has no source", func() {
+		opts.Port = 8080
+		addUpstream(http.StatusAccepted, "", "")
+		opts.Upstreams[0].CredentialHeader = "X-Auth-Credential"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"credential_header requires header_name or cookie_name: " +
+				opts.Upstreams[0].URL,
+		})))
+	})
 })
@@ -0,0 +1,281 @@
+package authdelegate
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"runtime/pprof"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults and limits of the durations of verbose logging and CPU profiles
+const (
+	defaultVerboseLoggingDuration = 5 * time.Minute
+	maxVerboseLoggingDuration     = time.Hour
+	defaultCPUProfileDuration     = 30 * time.Second
+	maxCPUProfileDuration         = 10 * time.Minute
+)
+
+var (
+	errProfilingDisabled = errors.New("cpu_profile_path is not configured")
+	errProfileRunning    = errors.New("a CPU profile is already running")
+)
+
+// diagnostics enables live debugging without a restart: verbose logging of
+// every request, and CPU profiles, each for a limited time. Either may be
+// toggled by a signal or through the admin listener.
+type diagnostics struct {
+	verboseDuration time.Duration
+	profilePath     string
+	profileDuration time.Duration
+
+	// Accessed atomically; the time, in Unix nanoseconds, until which every
+	// request is traced, or 0
+	verboseUntil int64
+
+	// Guards the following fields, which are set while a CPU profile is
+	// being written
+	mutex        sync.Mutex
+	profile      *os.File
+	profileTimer *time.Timer
+	profileUntil time.Time
+}
+
+func newDiagnostics(opts *AuthDelegateOptions) *diagnostics {
+	diagnostics := &diagnostics{
+		verboseDuration: opts.verboseLoggingDuration,
+		profilePath:     opts.CPUProfilePath,
+		profileDuration: opts.cpuProfileDuration,
+	}
+	if diagnostics.verboseDuration == 0 {
+		diagnostics.verboseDuration = defaultVerboseLoggingDuration
+	}
+	if diagnostics.profileDuration == 0 {
+		diagnostics.profileDuration = defaultCPUProfileDuration
+	}
+	return diagnostics
+}
+
+// verbose returns true while every request is to be traced.
+func (diagnostics *diagnostics) verbose() bool {
+	until := atomic.LoadInt64(&diagnostics.verboseUntil)
+	return until != 0 && time.Now().UnixNano() < until
+}
+
+// setVerbose traces every request for duration, or stops doing so if
+// duration is zero.
+func (diagnostics *diagnostics) setVerbose(duration time.Duration) {
+	if duration == 0 {
+		atomic.StoreInt64(&diagnostics.verboseUntil, 0)
+		log.Printf("diagnostics: verbose logging disabled")
+		return
+	}
+	until := time.Now().Add(duration)
+	atomic.StoreInt64(&diagnostics.verboseUntil, until.UnixNano())
+	log.Printf("diagnostics: verbose logging enabled until %s",
+		until.UTC().Format(time.RFC3339))
+}
+
+// toggleVerbose disables verbose logging if it is enabled, and otherwise
+// enables it for the configured duration.
+func (diagnostics *diagnostics) toggleVerbose() {
+	if diagnostics.verbose() {
+		diagnostics.setVerbose(0)
+	} else {
+		diagnostics.setVerbose(diagnostics.verboseDuration)
+	}
+}
+
+// startProfile starts writing a CPU profile to the configured path, which
+// stops after duration. The profile is written to a temporary file, which
+// replaces the path once the profile is complete.
+func (diagnostics *diagnostics) startProfile(duration time.Duration) error {
+	if diagnostics.profilePath == "" {
+		return errProfilingDisabled
+	}
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	if diagnostics.profile != nil {
+		return errProfileRunning
+	}
+	file, err := os.Create(diagnostics.profilePath + ".tmp")
+	if err != nil {
+		return err
+	}
+	if err = pprof.StartCPUProfile(file); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	diagnostics.profile = file
+	diagnostics.profileUntil = time.Now().Add(duration)
+	diagnostics.profileTimer = time.AfterFunc(duration,
+		func() { diagnostics.stopProfile() })
+	log.Printf("diagnostics: writing a CPU profile to %s until %s",
+		diagnostics.profilePath,
+		diagnostics.profileUntil.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// stopProfile completes the CPU profile being written, if any, returning
+// false if there is none.
+func (diagnostics *diagnostics) stopProfile() bool {
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	file := diagnostics.profile
+	if file == nil {
+		return false
+	}
+	diagnostics.profileTimer.Stop()
+	diagnostics.profile = nil
+	pprof.StopCPUProfile()
+	err := file.Close()
+	if err == nil {
+		err = os.Rename(file.Name(), diagnostics.profilePath)
+	}
+	if err != nil {
+		log.Printf("diagnostics: failed to write the CPU profile to "+
+			"%s: %s", diagnostics.profilePath, err)
+	} else {
+		log.Printf("diagnostics: wrote a CPU profile to %s",
+			diagnostics.profilePath)
+	}
+	return true
+}
+
+// toggleProfile completes the CPU profile being written, if any, and
+// otherwise starts one for the configured duration.
+func (diagnostics *diagnostics) toggleProfile() {
+	if diagnostics.stopProfile() {
+		return
+	}
+	if err := diagnostics.startProfile(
+		diagnostics.profileDuration); err != nil {
+		log.Printf("diagnostics: failed to start a CPU profile: %s", err)
+	}
+}
+
+type diagnosticsStatus struct {
+	// Present while every request is traced
+	VerboseUntil *time.Time `json:"verbose_until,omitempty"`
+
+	// Present while a CPU profile is being written to CPUProfilePath
+	CPUProfilePath  string     `json:"cpu_profile_path,omitempty"`
+	CPUProfileUntil *time.Time `json:"cpu_profile_until,omitempty"`
+}
+
+func (diagnostics *diagnostics) status() diagnosticsStatus {
+	var status diagnosticsStatus
+	if diagnostics.verbose() {
+		until := time.Unix(0, atomic.LoadInt64(
+			&diagnostics.verboseUntil)).UTC()
+		status.VerboseUntil = &until
+	}
+	diagnostics.mutex.Lock()
+	defer diagnostics.mutex.Unlock()
+	if diagnostics.profile != nil {
+		until := diagnostics.profileUntil.UTC()
+		status.CPUProfilePath = diagnostics.profilePath
+		status.CPUProfileUntil = &until
+	}
+	return status
+}
+
+// toggleDiagnosticsOnSignals toggles verbose logging for delegate, which
+// must have been created by NewAuthDelegate, whenever the process receives
+// SIGUSR1, and a CPU profile whenever it receives SIGUSR2. Does nothing on
+// platforms without those signals.
+func toggleDiagnosticsOnSignals(delegate http.Handler) {
+	diagnostics := delegate.(*authDelegateHandler).diagnostics
+	verbose, profile := notifyDiagnosticSignals()
+	go func() {
+		for {
+			select {
+			case <-verbose:
+				diagnostics.toggleVerbose()
+			case <-profile:
+				diagnostics.toggleProfile()
+			}
+		}
+	}()
+}
+
+// diagnosticDuration parses the duration query parameter of req, returning
+// fallback if it is absent, and false if it is invalid or exceeds limit.
+func diagnosticDuration(req *http.Request, fallback,
+	limit time.Duration) (time.Duration, bool) {
+	value := req.URL.Query().Get("duration")
+	if value == "" {
+		return fallback, true
+	}
+	duration, err := time.ParseDuration(value)
+	return duration, err == nil && duration > 0 && duration <= limit
+}
+
+// verboseLogging reports whether every request is traced on GET, traces them
+// for the configured duration, or the duration query parameter, on POST,
+// and stops on DELETE.
+func (admin *adminHandler) verboseLogging(
+	rw http.ResponseWriter, req *http.Request) {
+	diagnostics := admin.delegate.diagnostics
+	switch req.Method {
+	case "GET":
+	case "POST":
+		duration, ok := diagnosticDuration(req,
+			diagnostics.verboseDuration, maxVerboseLoggingDuration)
+		if !ok {
+			http.Error(rw, "duration must be positive and at most "+
+				maxVerboseLoggingDuration.String(),
+				http.StatusBadRequest)
+			return
+		}
+		diagnostics.setVerbose(duration)
+	case "DELETE":
+		diagnostics.setVerbose(0)
+	default:
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, diagnostics.status())
+}
+
+// cpuProfile reports the CPU profile being written on GET, starts one for
+// the configured duration, or the duration query parameter, on POST, and
+// completes it early on DELETE.
+func (admin *adminHandler) cpuProfile(
+	rw http.ResponseWriter, req *http.Request) {
+	diagnostics := admin.delegate.diagnostics
+	switch req.Method {
+	case "GET":
+	case "POST":
+		duration, ok := diagnosticDuration(req,
+			diagnostics.profileDuration, maxCPUProfileDuration)
+		if !ok {
+			http.Error(rw, "duration must be positive and at most "+
+				maxCPUProfileDuration.String(),
+				http.StatusBadRequest)
+			return
+		}
+		err := diagnostics.startProfile(duration)
+		if err == errProfilingDisabled || err == errProfileRunning {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("diagnostics: failed to start a CPU profile: %s",
+				err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		diagnostics.stopProfile()
+	default:
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, diagnostics.status())
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package authdelegate
+
+import "os"
+
+// notifyDiagnosticSignals returns channels that never receive anything, since
+// there is no SIGUSR1 or SIGUSR2 on this platform; use the admin listener
+// instead.
+func notifyDiagnosticSignals() (verbose, profile <-chan os.Signal) {
+	return nil, nil
+}
@@ -0,0 +1,142 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Diagnostics", func() {
+	var server *httptest.Server
+	var dir string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		var err error
+		dir, err = ioutil.TempDir("", "diagnostics")
+		Expect(err).ToNot(HaveOccurred())
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: server.URL},
+			},
+			CPUProfilePath: filepath.Join(dir, "cpu.pprof"),
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	request := func(handler http.Handler,
+		method, url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	status := func(recorder *httptest.ResponseRecorder) diagnosticsStatus {
+		var status diagnosticsStatus
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(json.Unmarshal(recorder.Body.Bytes(),
+			&status)).To(Succeed())
+		return status
+	}
+
+	It("should trace every request while verbose logging is on", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		admin := NewAdminHandler(delegate)
+		traced := func() bool {
+			recorder := request(delegate, "GET", "http://delegate/")
+			return recorder.Header().Get(configFingerprintHeader) != ""
+		}
+		Expect(traced()).To(BeFalse())
+
+		enabled := status(request(admin, "POST",
+			"http://admin/debug/verbose?duration=1m"))
+		Expect(enabled.VerboseUntil).ToNot(BeNil())
+		Expect(traced()).To(BeTrue())
+
+		disabled := status(request(admin, "DELETE",
+			"http://admin/debug/verbose"))
+		Expect(disabled.VerboseUntil).To(BeNil())
+		Expect(traced()).To(BeFalse())
+
+		diagnostics := delegate.(*authDelegateHandler).diagnostics
+		diagnostics.toggleVerbose()
+		Expect(traced()).To(BeTrue())
+		diagnostics.toggleVerbose()
+		Expect(traced()).To(BeFalse())
+
+		Expect(request(admin, "POST",
+			"http://admin/debug/verbose?duration=2h").Code).To(
+			Equal(http.StatusBadRequest))
+	})
+
+	It("should write a bounded CPU profile", func() {
+		Expect(opts.Validate()).To(BeNil())
+		admin := NewAdminHandler(NewAuthDelegate(opts))
+		started := status(request(admin, "POST",
+			"http://admin/debug/cpu_profile?duration=50ms"))
+		Expect(started.CPUProfilePath).To(Equal(opts.CPUProfilePath))
+		Expect(started.CPUProfileUntil).ToNot(BeNil())
+		Expect(request(admin, "POST",
+			"http://admin/debug/cpu_profile").Code).To(
+			Equal(http.StatusConflict))
+
+		Eventually(func() string {
+			return status(request(admin, "GET",
+				"http://admin/debug/cpu_profile")).CPUProfilePath
+		}).Should(BeEmpty())
+		info, err := os.Stat(opts.CPUProfilePath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically(">", 0))
+	})
+
+	It("should complete a CPU profile early", func() {
+		Expect(opts.Validate()).To(BeNil())
+		diagnostics := newDiagnostics(opts)
+		diagnostics.toggleProfile()
+		Expect(diagnostics.status().CPUProfilePath).ToNot(BeEmpty())
+		diagnostics.toggleProfile()
+		Expect(diagnostics.status().CPUProfilePath).To(BeEmpty())
+		_, err := os.Stat(opts.CPUProfilePath)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should refuse to profile without cpu_profile_path", func() {
+		opts.CPUProfilePath = ""
+		Expect(opts.Validate()).To(BeNil())
+		admin := NewAdminHandler(NewAuthDelegate(opts))
+		recorder := request(admin, "POST", "http://admin/debug/cpu_profile")
+		Expect(recorder.Code).To(Equal(http.StatusConflict))
+		Expect(recorder.Body.String()).To(Equal(
+			"cpu_profile_path is not configured\n"))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.CPUProfilePath = ""
+		opts.VerboseLoggingDuration = "forever"
+		opts.CPUProfileDuration = "1h"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid verbose_logging_duration: forever",
+			"cpu_profile_duration must be positive and at most " +
+				"10m0s: 1h",
+			"cpu_profile_duration requires cpu_profile_path",
+		})))
+	})
+})
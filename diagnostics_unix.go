@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package authdelegate
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDiagnosticSignals returns channels that receive SIGUSR1 and SIGUSR2.
+func notifyDiagnosticSignals() (verbose, profile <-chan os.Signal) {
+	usr1 := make(chan os.Signal, 1)
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	return usr1, usr2
+}
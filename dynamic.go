@@ -0,0 +1,252 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key-value stores from which upstreams may be read
+const (
+	dynamicConsul = "consul"
+	dynamicEtcd   = "etcd"
+)
+
+const (
+	// defaultDynamicPollInterval is how often etcd is polled for changes
+	// unless poll_interval is specified.
+	defaultDynamicPollInterval = 10 * time.Second
+
+	// dynamicRetryInterval is how long to wait after failing to read the
+	// upstreams before trying again.
+	dynamicRetryInterval = 5 * time.Second
+
+	// consulWait is the maximum duration of a Consul blocking query.
+	consulWait = 5 * time.Minute
+)
+
+// upstreamWatcher replaces the upstreams of a delegate's routing table with
+// those read from a Consul or etcd key whenever its value changes. The other
+// options are those of the configuration file, which may be reloaded.
+type upstreamWatcher struct {
+	delegate *authDelegateHandler
+	config   *AuthDelegateDynamicUpstreams
+	client   *http.Client
+
+	mutex sync.Mutex
+	base  *AuthDelegateOptions
+
+	// Latest valid value of the key, or nil if it hasn't been read
+	upstreams []byte
+
+	// Consul index or etcd revision of the latest value read
+	version string
+}
+
+func newUpstreamWatcher(delegate *authDelegateHandler,
+	opts *AuthDelegateOptions) *upstreamWatcher {
+	return &upstreamWatcher{
+		delegate: delegate,
+		config:   opts.DynamicUpstreams,
+		client:   &http.Client{Timeout: consulWait + time.Minute},
+		base:     opts,
+	}
+}
+
+// watchUpstreams reads the upstreams of delegate, which must have been
+// created by NewAuthDelegate, from the key-value store defined by opts, if
+// any, then watches for changes to them in the background.
+func watchUpstreams(delegate http.Handler, opts *AuthDelegateOptions) {
+	if opts.DynamicUpstreams == nil {
+		return
+	}
+	handler := delegate.(*authDelegateHandler)
+	watcher := newUpstreamWatcher(handler, opts)
+	handler.watcher = watcher
+	if err := watcher.poll(); err != nil {
+		log.Printf("dynamic upstreams: %s; using upstreams from the "+
+			"configuration file", err)
+	}
+	go watcher.run()
+}
+
+func (watcher *upstreamWatcher) run() {
+	for {
+		if err := watcher.poll(); err != nil {
+			log.Printf("dynamic upstreams: %s", err)
+			time.Sleep(dynamicRetryInterval)
+		} else if watcher.config.Type == dynamicEtcd {
+			time.Sleep(watcher.config.pollInterval)
+		}
+	}
+}
+
+// poll reads the key, waiting for it to change if the store supports
+// blocking queries, and applies its value if it has changed.
+func (watcher *upstreamWatcher) poll() error {
+	var value []byte
+	var version string
+	var err error
+	if watcher.config.Type == dynamicConsul {
+		value, version, err = watcher.readConsul()
+	} else {
+		value, version, err = watcher.readEtcd()
+	}
+	if err != nil {
+		return err
+	}
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	if version == watcher.version {
+		return nil
+	}
+	watcher.version = version
+	return watcher.apply(watcher.base, value)
+}
+
+// rebase replaces the options of the configuration file, to which the latest
+// upstreams read from the key are applied. Returns an error if they are
+// invalid with the new options.
+func (watcher *upstreamWatcher) rebase(opts *AuthDelegateOptions) error {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	if watcher.upstreams == nil {
+		watcher.base = opts
+		watcher.delegate.swapRoutes(newRoutingTable(opts))
+		return nil
+	}
+	if err := watcher.apply(opts, watcher.upstreams); err != nil {
+		return err
+	}
+	watcher.base = opts
+	return nil
+}
+
+// apply replaces the upstreams of base with value and swaps in the resulting
+// routing table. If the result is invalid, leaves the current routing table
+// in effect and returns an error. Must be called with the mutex held.
+func (watcher *upstreamWatcher) apply(
+	base *AuthDelegateOptions, value []byte) error {
+	opts, err := withUpstreams(base, value)
+	if err != nil {
+		return fmt.Errorf("ignoring upstreams from %s: %s",
+			watcher.config.Key, err)
+	}
+	watcher.delegate.swapRoutes(newRoutingTable(opts))
+	watcher.upstreams = value
+	log.Printf("dynamic upstreams: applied %d upstreams from %s; "+
+		"fingerprint %s", len(opts.Upstreams), watcher.config.Key,
+		opts.Fingerprint())
+	return nil
+}
+
+// withUpstreams returns a validated copy of opts whose upstreams are parsed
+// from the JSON list in value. The copy is shallow, so that it keeps the
+// fields that can't be encoded, such as ErrorHandler.
+func withUpstreams(opts *AuthDelegateOptions, value []byte) (
+	*AuthDelegateOptions, error) {
+	var upstreams []*AuthDelegateUpstream
+	if err := json.Unmarshal(value, &upstreams); err != nil {
+		return nil, errors.New("JSON parsing failed: " + err.Error())
+	}
+	updated := *opts
+	updated.Upstreams = upstreams
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// readConsul reads the key using a blocking query that returns once its index
+// differs from that of the latest value read.
+func (watcher *upstreamWatcher) readConsul() ([]byte, string, error) {
+	query := url.Values{"raw": {""}, "wait": {consulWait.String()}}
+	watcher.mutex.Lock()
+	if watcher.version != "" {
+		query.Set("index", watcher.version)
+	}
+	watcher.mutex.Unlock()
+	req, err := http.NewRequest("GET", strings.TrimSuffix(
+		watcher.config.Address, "/")+"/v1/kv/"+
+		strings.TrimPrefix(watcher.config.Key, "/")+"?"+query.Encode(),
+		nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if watcher.config.Token != "" {
+		req.Header.Set("X-Consul-Token", watcher.config.Token)
+	}
+	body, header, err := watcher.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, header.Get("X-Consul-Index"), nil
+}
+
+// etcdRangeResponse is the response of the etcd gRPC gateway's range method.
+type etcdRangeResponse struct {
+	Kvs []struct {
+		Value       []byte `json:"value"`
+		ModRevision string `json:"mod_revision"`
+	} `json:"kvs"`
+}
+
+// readEtcd reads the key and returns the revision at which it last changed.
+func (watcher *upstreamWatcher) readEtcd() ([]byte, string, error) {
+	request, _ := json.Marshal(map[string]string{
+		"key": base64.StdEncoding.EncodeToString(
+			[]byte(watcher.config.Key)),
+	})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(
+		watcher.config.Address, "/")+"/v3/kv/range",
+		bytes.NewReader(request))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if watcher.config.Token != "" {
+		req.Header.Set("Authorization", watcher.config.Token)
+	}
+	body, _, err := watcher.do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	var response etcdRangeResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, "", errors.New("invalid etcd response: " +
+			err.Error())
+	} else if len(response.Kvs) == 0 {
+		return nil, "", errors.New("key not found: " +
+			watcher.config.Key)
+	}
+	return response.Kvs[0].Value, response.Kvs[0].ModRevision, nil
+}
+
+// do sends req and returns the response body and headers, or an error if the
+// status is not 200.
+func (watcher *upstreamWatcher) do(
+	req *http.Request) ([]byte, http.Header, error) {
+	resp, err := watcher.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil, errors.New("key not found: " +
+			watcher.config.Key)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("reading %s returned %d",
+			watcher.config.Key, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.Header, err
+}
@@ -0,0 +1,186 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Dynamic upstreams", func() {
+	var first, second, store *httptest.Server
+	var opts *AuthDelegateOptions
+	var value string
+	var index int
+	var lastRequest *http.Request
+	var lastBody []byte
+
+	newServer := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+			}))
+	}
+
+	upstreamsAt := func(url string) string {
+		return `[{"name": "dynamic", "url": "` + url + `"}]`
+	}
+
+	BeforeEach(func() {
+		first = newServer(http.StatusAccepted)
+		second = newServer(http.StatusNoContent)
+		value = upstreamsAt(second.URL)
+		index = 7
+		store = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				lastRequest = req
+				lastBody, _ = ioutil.ReadAll(req.Body)
+				if req.URL.Path == "/v3/kv/range" {
+					response, _ := json.Marshal(map[string]interface{}{
+						"kvs": []map[string]interface{}{{
+							"value":        []byte(value),
+							"mod_revision": strconv.Itoa(index),
+						}},
+					})
+					rw.Write(response)
+					return
+				} else if req.URL.Path != "/v1/kv/authdelegate/upstreams" {
+					http.NotFound(rw, req)
+					return
+				}
+				rw.Header().Set("X-Consul-Index", strconv.Itoa(index))
+				rw.Write([]byte(value))
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: first.URL},
+			},
+			DynamicUpstreams: &AuthDelegateDynamicUpstreams{
+				Type:    "consul",
+				Address: store.URL,
+				Key:     "authdelegate/upstreams",
+				Token:   "secret",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		first.Close()
+		second.Close()
+		store.Close()
+	})
+
+	status := func(handler http.Handler) int {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	newWatcher := func() (*authDelegateHandler, *upstreamWatcher) {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		watcher := newUpstreamWatcher(handler, opts)
+		handler.watcher = watcher
+		return handler, watcher
+	}
+
+	It("should read and watch the upstreams in Consul", func() {
+		handler, watcher := newWatcher()
+		Expect(status(handler)).To(Equal(http.StatusAccepted))
+		Expect(watcher.poll()).To(Succeed())
+		Expect(status(handler)).To(Equal(http.StatusNoContent))
+		Expect(handler.routes().findUpstream("dynamic")).ToNot(BeNil())
+		Expect(lastRequest.Header.Get("X-Consul-Token")).To(Equal("secret"))
+		Expect(lastRequest.URL.Query().Get("index")).To(Equal(""))
+
+		value = upstreamsAt(first.URL)
+		index = 8
+		Expect(watcher.poll()).To(Succeed())
+		Expect(lastRequest.URL.Query().Get("index")).To(Equal("7"))
+		Expect(status(handler)).To(Equal(http.StatusAccepted))
+	})
+
+	It("should read the upstreams from etcd", func() {
+		opts.DynamicUpstreams.Type = "etcd"
+		handler, watcher := newWatcher()
+		Expect(watcher.poll()).To(Succeed())
+		Expect(status(handler)).To(Equal(http.StatusNoContent))
+		Expect(lastRequest.Header.Get("Authorization")).To(Equal("secret"))
+		Expect(string(lastBody)).
+			To(Equal(`{"key":"YXV0aGRlbGVnYXRlL3Vwc3RyZWFtcw=="}`))
+		Expect(opts.DynamicUpstreams.pollInterval).
+			To(Equal(defaultDynamicPollInterval))
+	})
+
+	It("should keep the current upstreams if the new ones are invalid",
+		func() {
+			handler, watcher := newWatcher()
+			Expect(watcher.poll()).To(Succeed())
+			value = `[{"url": "ftp://foo.com/auth"}]`
+			index = 8
+			err := watcher.poll()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal("ignoring upstreams from " +
+				"authdelegate/upstreams: " + optionErrors([]string{
+				"invalid upstream scheme: ftp://foo.com/auth",
+			})))
+			Expect(status(handler)).To(Equal(http.StatusNoContent))
+
+			opts.DynamicUpstreams.Key = "missing"
+			Expect(watcher.poll()).To(MatchError("key not found: missing"))
+			Expect(status(handler)).To(Equal(http.StatusNoContent))
+		})
+
+	It("should apply the upstreams to reloaded options", func() {
+		handler, watcher := newWatcher()
+		Expect(watcher.poll()).To(Succeed())
+		reloaded := *opts
+		reloaded.MatchTraceHeader = true
+		Expect(watcher.rebase(&reloaded)).To(Succeed())
+		Expect(status(handler)).To(Equal(http.StatusNoContent))
+		Expect(handler.routes().matchTrace).To(BeTrue())
+	})
+
+	It("should keep the error handler of the options", func() {
+		opts.ErrorHandler = func(rw http.ResponseWriter, req *http.Request,
+			err error) {
+			rw.WriteHeader(http.StatusTeapot)
+		}
+		handler, watcher := newWatcher()
+		second.Close()
+		Expect(watcher.poll()).To(Succeed())
+		Expect(status(handler)).To(Equal(http.StatusTeapot))
+	})
+
+	It("should fail validation for an invalid key-value store", func() {
+		opts.DynamicUpstreams = &AuthDelegateDynamicUpstreams{
+			Type:         "zookeeper",
+			Address:      "127.0.0.1:2181",
+			PollInterval: "1m",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"dynamic_upstreams type must be consul or etcd: zookeeper",
+			"invalid dynamic_upstreams address: 127.0.0.1:2181",
+			"dynamic_upstreams key must be specified",
+		})))
+
+		opts.DynamicUpstreams = &AuthDelegateDynamicUpstreams{
+			Type:         "consul",
+			Address:      store.URL,
+			Key:          "authdelegate/upstreams",
+			PollInterval: "1m",
+		}
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"dynamic_upstreams poll_interval requires type etcd",
+		})))
+	})
+})
@@ -0,0 +1,56 @@
+package authdelegate
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// decodedBody closes both the decoder and the original response body.
+type decodedBody struct {
+	io.Reader
+	decoder io.Closer
+	body    io.Closer
+}
+
+func (body *decodedBody) Close() error {
+	body.decoder.Close()
+	return body.body.Close()
+}
+
+// decodeResponseBody transparently decodes a gzip or deflate encoded response
+// from an upstream that ignored our request for "identity" encoding, so that
+// the delegate's response is never encoded. Responses with other encodings
+// are left untouched.
+func decodeResponseBody(res *http.Response) (err error) {
+	encoding := strings.ToLower(
+		strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	var decoder io.ReadCloser
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(res.Body)
+	case "deflate":
+		decoder, err = zlib.NewReader(res.Body)
+	default:
+		return nil
+	}
+	if err == io.EOF {
+		// An empty body is valid; there's nothing to decode.
+		err = nil
+		decoder = nil
+	} else if err != nil {
+		return
+	}
+
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	if decoder != nil {
+		res.Body = &decodedBody{decoder, decoder, res.Body}
+	}
+	return nil
+}
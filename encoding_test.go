@@ -0,0 +1,90 @@
+package authdelegate
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Upstream content encoding", func() {
+	var server *httptest.Server
+	var opts *AuthDelegateOptions
+	var acceptEncoding string
+	var encoding string
+
+	encode := func(body string) []byte {
+		var buf bytes.Buffer
+		var writer io.WriteCloser
+		if encoding == "gzip" {
+			writer = gzip.NewWriter(&buf)
+		} else {
+			writer = zlib.NewWriter(&buf)
+		}
+		writer.Write([]byte(body))
+		writer.Close()
+		return buf.Bytes()
+	}
+
+	BeforeEach(func() {
+		encoding = "gzip"
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			acceptEncoding = req.Header.Get("Accept-Encoding")
+			rw.Header().Set("Content-Encoding", encoding)
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write(encode("session expired"))
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: server.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		return recorder
+	}
+
+	It("should request identity encoding by default", func() {
+		serve()
+		Expect(acceptEncoding).To(Equal("identity"))
+	})
+
+	It("should decode gzip responses by default", func() {
+		recorder := serve()
+		Expect(recorder.HeaderMap.Get("Content-Encoding")).To(Equal(""))
+		Expect(recorder.Body.String()).To(Equal("session expired"))
+	})
+
+	It("should decode deflate responses by default", func() {
+		encoding = "deflate"
+		recorder := serve()
+		Expect(recorder.HeaderMap.Get("Content-Encoding")).To(Equal(""))
+		Expect(recorder.Body.String()).To(Equal("session expired"))
+	})
+
+	It("should pass encoding through if configured", func() {
+		opts.PassAcceptEncoding = true
+		recorder := serve()
+		Expect(acceptEncoding).To(Equal("gzip, deflate"))
+		Expect(recorder.HeaderMap.Get("Content-Encoding")).To(
+			Equal("gzip"))
+		Expect(recorder.Body.Bytes()).To(Equal(encode("session expired")))
+	})
+})
@@ -0,0 +1,265 @@
+package authdelegate
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errorPage is the data with which error pages are rendered.
+type errorPage struct {
+	Status     int
+	StatusText string
+
+	// Lowercased language of the template, e.g. "es"
+	Language string
+
+	// Name of the upstream selected for the request, if any
+	Upstream string
+
+	// Value of the request's X-Request-Id header, if any, which support
+	// staff can find in the logs
+	RequestID string
+
+	// The support_contact option, and a mailto: or http(s) URL for it, if
+	// it is an email address or URL
+	SupportContact string
+	SupportLink    string
+}
+
+func newErrorPage(req *http.Request, err error, status int,
+	language, supportContact string) *errorPage {
+	page := &errorPage{
+		Status:         status,
+		StatusText:     http.StatusText(status),
+		Language:       language,
+		RequestID:      req.Header.Get(defaultRequestIDHeader),
+		SupportContact: supportContact,
+	}
+	var delegateErr *DelegateError
+	if errors.As(err, &delegateErr) {
+		page.Upstream = delegateErr.Upstream
+	}
+	if strings.HasPrefix(supportContact, "https://") ||
+		strings.HasPrefix(supportContact, "http://") {
+		page.SupportLink = supportContact
+	} else if strings.Contains(supportContact, "@") &&
+		!strings.ContainsAny(supportContact, ": ") {
+		page.SupportLink = "mailto:" + supportContact
+	}
+	return page
+}
+
+// render writes page, rendered by tmpl, as the response.
+func (page *errorPage) render(rw http.ResponseWriter,
+	tmpl *template.Template) error {
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, page); err != nil {
+		return err
+	}
+	header := rw.Header()
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Language", page.Language)
+	rw.WriteHeader(page.Status)
+	rw.Write(body.Bytes())
+	return nil
+}
+
+// defaultErrorPage is served to browsers by newDefaultErrorHandler. It
+// follows Section 508 and WCAG 2.1 AA: it declares its language, has a
+// title and a single main landmark and heading, conveys nothing by color
+// alone, keeps a contrast ratio above 7:1, shows keyboard focus, and reflows
+// to narrow screens and 200% zoom.
+var defaultErrorPage = template.Must(template.New("error").Parse(
+	`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{template "title" .}}</title>
+<style>
+body { margin: 0; background: #fff; color: #1b1b1b;
+  font-family: "Source Sans Pro", "Helvetica Neue", Helvetica, Arial,
+    sans-serif;
+  font-size: 1.0625rem; line-height: 1.5; }
+main { max-width: 40rem; margin: 0 auto; padding: 2rem 1rem; }
+h1 { font-size: 2rem; line-height: 1.2; margin: 0 0 1rem; }
+a { color: #1a4480; text-decoration: underline; }
+a:focus { outline: 0.25rem solid #2491ff; outline-offset: 0.125rem; }
+dt { font-weight: bold; }
+dd { margin: 0 0 0.5rem; }
+</style>
+</head>
+<body>
+<main>
+<h1>{{template "title" .}}</h1>
+<p>{{if eq .Status 401}}You need to sign in to view this page.
+{{- else if eq .Status 403}}You don't have permission to view this page.
+{{- else}}We can't check your access right now. Please try again in a few
+minutes.{{end}}</p>
+{{- if .SupportContact}}
+<p>If you need help, contact
+{{if .SupportLink}}<a href="{{.SupportLink}}">{{.SupportContact}}</a>
+{{- else}}{{.SupportContact}}{{end}}
+{{- if .RequestID}} and include the request ID below{{end}}.</p>
+{{- end}}
+<dl>
+<dt>Error</dt>
+<dd>{{.Status}} {{.StatusText}}</dd>
+{{- if .RequestID}}
+<dt>Request ID</dt>
+<dd><code>{{.RequestID}}</code></dd>
+{{- end}}
+</dl>
+</main>
+</body>
+</html>
+{{define "title"}}{{if eq .Status 401}}Sign in required
+{{- else if eq .Status 403}}Access denied
+{{- else}}Service unavailable{{end}}{{end}}`))
+
+// newDefaultErrorHandler returns an ErrorHandler that responds to browsers
+// with defaultErrorPage, and to other clients as defaultErrorHandler does.
+func newDefaultErrorHandler(supportContact string) ErrorHandler {
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		rw.Header().Add("Vary", "Accept")
+		if !acceptsHTML(req) {
+			defaultErrorHandler(rw, req, err)
+			return
+		}
+		status := errorStatus(err)
+		if status >= http.StatusInternalServerError {
+			log.Printf("%s %s: %s", req.Method, req.RequestURI, err)
+		}
+		page := newErrorPage(req, err, status, "en", supportContact)
+		if renderErr := page.render(rw,
+			defaultErrorPage); renderErr != nil {
+			log.Printf("rendering error page: %s", renderErr)
+			defaultErrorHandler(rw, req, err)
+		}
+	}
+}
+
+// acceptsHTML returns true if the Accept header of req lists text/html, as
+// browsers' do for pages.
+func acceptsHTML(req *http.Request) bool {
+	for _, item := range strings.Split(req.Header.Get("Accept"), ",") {
+		fields := strings.Split(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(fields[0]), "text/html") {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if weight := strings.TrimSpace(param); strings.HasPrefix(
+				weight, "q=") {
+				if q, _ := strconv.ParseFloat(weight[2:], 64); q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// parseErrorPageName returns the status and lowercased language of the
+// error_pages template named "<status>.<language>.html".
+func parseErrorPageName(name string) (int, string, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, ".html"), ".")
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+	status, err := strconv.Atoi(parts[0])
+	if err != nil || status < 400 || status > 599 {
+		return 0, "", false
+	}
+	return status, strings.ToLower(parts[1]), true
+}
+
+// newErrorPageHandler returns an ErrorHandler rendering the template for the
+// status of each error in the language that the request's Accept-Language
+// header prefers, falling back to fallback for statuses without templates.
+func newErrorPageHandler(config *AuthDelegateErrorPages,
+	supportContact string, fallback ErrorHandler) ErrorHandler {
+	defaultLanguage := strings.ToLower(config.DefaultLanguage)
+	return func(rw http.ResponseWriter, req *http.Request, err error) {
+		status := errorStatus(err)
+		templates := config.templates[status]
+		if templates == nil {
+			fallback(rw, req, err)
+			return
+		}
+		if status >= http.StatusInternalServerError {
+			log.Printf("%s %s: %s", req.Method, req.RequestURI, err)
+		}
+		language := preferredLanguage(
+			req.Header.Get("Accept-Language"), templates)
+		if language == "" {
+			language = defaultLanguage
+		}
+		rw.Header().Add("Vary", "Accept-Language")
+		page := newErrorPage(req, err, status, language, supportContact)
+		if renderErr := page.render(rw,
+			templates[language]); renderErr != nil {
+			log.Printf("error_pages: rendering %d.%s.html: %s",
+				status, language, renderErr)
+			rw.Header().Del("Vary")
+			fallback(rw, req, err)
+		}
+	}
+}
+
+// preferredLanguage returns the language among those of templates that the
+// Accept-Language header value acceptLanguage ranks highest, or the empty
+// string if it accepts none of them. A range such as "es-mx" matches "es" if
+// there is no "es-mx" template, and "es" matches "es-mx" if there is no "es"
+// template.
+func preferredLanguage(acceptLanguage string,
+	templates map[string]*template.Template) string {
+	type weightedRange struct {
+		tag    string
+		weight float64
+	}
+	var ranges []weightedRange
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(item, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				weight, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		if tag != "" && tag != "*" && weight > 0 {
+			ranges = append(ranges, weightedRange{tag, weight})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].weight > ranges[j].weight
+	})
+	for _, r := range ranges {
+		if templates[r.tag] != nil {
+			return r.tag
+		}
+		primary := strings.SplitN(r.tag, "-", 2)[0]
+		if templates[primary] != nil {
+			return primary
+		}
+		var candidates []string
+		for language := range templates {
+			if strings.HasPrefix(language, primary+"-") {
+				candidates = append(candidates, language)
+			}
+		}
+		if len(candidates) != 0 {
+			sort.Strings(candidates)
+			return candidates[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,189 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Error pages", func() {
+	var dir string
+	var opts *AuthDelegateOptions
+
+	writeTemplate := func(name, content string) {
+		Expect(ioutil.WriteFile(filepath.Join(dir, name),
+			[]byte(content), 0644)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		dir, _ = ioutil.TempDir("", "authdelegate-error-pages-test")
+		writeTemplate("401.en.html", "<p>{{.Status}} Sign in</p>")
+		writeTemplate("401.es.html", "<p>{{.Status}} Inicie sesión</p>")
+		writeTemplate("401.es-mx.html", "<p>Inicie sesión, por favor</p>")
+		writeTemplate("README.txt", "ignored")
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        "http://localhost:4180",
+					HeaderName: "X-Api-Key",
+				},
+			},
+			ErrorPages: &AuthDelegateErrorPages{
+				Dir:             dir,
+				DefaultLanguage: "en",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	serve := func(acceptLanguage string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/admin")
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should render the page in the preferred language", func() {
+		recorder := serve("fr;q=0.9, es;q=0.8, en;q=0.5")
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Body.String()).To(
+			Equal("<p>401 Inicie sesión</p>"))
+		Expect(recorder.Header().Get("Content-Type")).To(
+			Equal("text/html; charset=utf-8"))
+		Expect(recorder.Header().Get("Content-Language")).To(
+			Equal("es"))
+		Expect(recorder.Header().Get("Vary")).To(
+			Equal("Accept-Language"))
+	})
+
+	It("should fall back to the default language", func() {
+		for _, acceptLanguage := range []string{"", "fr", "*", "es;q=0"} {
+			recorder := serve(acceptLanguage)
+			Expect(recorder.Body.String()).To(
+				Equal("<p>401 Sign in</p>"))
+			Expect(recorder.Header().Get("Content-Language")).To(
+				Equal("en"))
+		}
+	})
+
+	It("should use the default handler for statuses without pages",
+		func() {
+			opts.RejectPaths = []string{"/admin"}
+			recorder := serve("es")
+			Expect(recorder.Code).To(Equal(http.StatusForbidden))
+			Expect(recorder.Body.String()).To(
+				Equal("forbidden request\n"))
+		})
+
+	It("should match languages by their primary subtag", func() {
+		templates := opts.ErrorPages
+		Expect(opts.Validate()).To(BeNil())
+		pages := templates.templates[http.StatusUnauthorized]
+		Expect(preferredLanguage("ES-MX", pages)).To(Equal("es-mx"))
+		Expect(preferredLanguage("es-AR", pages)).To(Equal("es"))
+		delete(pages, "es")
+		Expect(preferredLanguage("es", pages)).To(Equal("es-mx"))
+		Expect(preferredLanguage("de, fr", pages)).To(BeEmpty())
+	})
+
+	It("should fail validation for invalid templates", func() {
+		writeTemplate("403.es.html", "<p>{{.Status</p>")
+		writeTemplate("forbidden.html", "<p>Forbidden</p>")
+		writeTemplate("503.es.html", "<p>{{.Status}}</p>")
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(
+			"\n  error_pages template could not be parsed: " +
+				"template: 403.es.html:1: "))
+		Expect(err.Error()).To(ContainSubstring(
+			"\n  error_pages template must be named " +
+				"<status>.<language>.html: forbidden.html\n"))
+		Expect(err.Error()).To(HaveSuffix(
+			"\n  error_pages has no en template for 503"))
+
+		opts.ErrorPages = &AuthDelegateErrorPages{Dir: dir}
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"error_pages requires dir and default_language",
+		})))
+	})
+})
+
+var _ = Describe("Default error page", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        "http://localhost:4180",
+					HeaderName: "X-Api-Key",
+				},
+			},
+			SupportContact: "help@example.gov",
+		}
+	})
+
+	serve := func(accept string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("Accept", accept)
+		req.Header.Set("X-Request-Id", "<abc123>")
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should serve an accessible HTML page to browsers", func() {
+		recorder := serve("text/html,application/xhtml+xml;q=0.9")
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Header().Get("Content-Type")).To(
+			Equal("text/html; charset=utf-8"))
+		Expect(recorder.Header().Get("Vary")).To(Equal("Accept"))
+		body := recorder.Body.String()
+		Expect(body).To(ContainSubstring(`<html lang="en">`))
+		Expect(body).To(ContainSubstring(
+			"<title>Sign in required</title>"))
+		Expect(body).To(ContainSubstring(
+			"<main>\n<h1>Sign in required</h1>"))
+		Expect(body).To(ContainSubstring(
+			`<a href="mailto:help@example.gov">help@example.gov</a>`))
+		Expect(body).To(ContainSubstring(
+			"<dd><code>&lt;abc123&gt;</code></dd>"))
+	})
+
+	It("should link to a support URL", func() {
+		opts.SupportContact = "https://support.example.gov/"
+		Expect(serve("text/html").Body.String()).To(ContainSubstring(
+			`<a href="https://support.example.gov/">`))
+		opts.SupportContact = "the help desk"
+		body := serve("text/html").Body.String()
+		Expect(body).To(ContainSubstring("contact\nthe help desk and"))
+		Expect(body).ToNot(ContainSubstring("<a "))
+	})
+
+	It("should respond to other clients in plain text", func() {
+		for _, accept := range []string{"", "application/json",
+			"text/html;q=0"} {
+			recorder := serve(accept)
+			Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+			Expect(recorder.Body.String()).To(
+				Equal("unauthorized request\n"))
+		}
+	})
+})
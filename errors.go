@@ -0,0 +1,159 @@
+package authdelegate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Causes of the failures to obtain a decision from an upstream reported to an
+// ErrorHandler, wrapped in a *DelegateError. Use errors.Is to test for them.
+var (
+	// No upstream accepts the request
+	ErrNoUpstreamMatch = errors.New("no upstream matches request")
+
+	// Upstreams restricted to other methods would otherwise accept the
+	// request, which would fall through to the default upstream
+	ErrMethodNotAllowed = errors.New("method not allowed")
+
+	// Several upstreams accept the request, and the match policy is reject
+	ErrAmbiguousMatch = errors.New("multiple upstreams match request")
+
+	// The credential carried by the request has been revoked
+	ErrRevoked = errors.New("credential revoked")
+
+	// The request matches a rule rejecting vulnerability scanners and bots
+	ErrRejected = errors.New("request rejected")
+
+	// The upstream did not respond in time
+	ErrUpstreamTimeout = errors.New("upstream timed out")
+
+	// The upstream could not be reached
+	ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
+	// The upstream's adaptive concurrency limit was reached
+	ErrUpstreamOverloaded = errors.New("upstream overloaded")
+
+	// The client or credential exceeded one of the upstream's rate limits
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// The upstream's circuit breaker is open after repeated failures
+	ErrCircuitOpen = errors.New("upstream circuit open")
+
+	// The upstream's response could not be processed
+	ErrInvalidUpstreamResponse = errors.New("invalid upstream response")
+
+	// The request body, to be buffered for an upstream that disables
+	// chunked requests, exceeds the limit
+	ErrRequestBodyTooLarge = errors.New("request body too large")
+
+	// The request body, to be buffered for an upstream that disables
+	// chunked requests, could not be read
+	ErrInvalidRequestBody = errors.New("invalid request body")
+)
+
+// ErrorHandler writes the response to req when the delegate fails to obtain
+// a decision from an upstream. err is always a *DelegateError.
+type ErrorHandler func(rw http.ResponseWriter, req *http.Request, err error)
+
+// DelegateError describes a failure to obtain a decision from an upstream.
+type DelegateError struct {
+	// One of the Err* values defined by this package
+	Code error
+
+	// Name of the upstream selected for the request, if any
+	Upstream string
+
+	// Underlying error, if any
+	Cause error
+
+	// If not zero, the status with which the request is refused instead of
+	// the one implied by Code, as set by an upstream's fail_closed_status
+	Status int
+}
+
+func (err *DelegateError) Error() string {
+	msg := err.Code.Error()
+	if err.Upstream != "" {
+		msg += ": " + err.Upstream
+	}
+	if err.Cause != nil {
+		msg += ": " + err.Cause.Error()
+	}
+	return msg
+}
+
+// Unwrap returns err.Code, so that errors.Is(err, ErrUpstreamTimeout) and
+// the like work as expected.
+func (err *DelegateError) Unwrap() error {
+	return err.Code
+}
+
+// errorStatus returns the HTTP status code corresponding to the Code of a
+// *DelegateError, unless its Status overrides it.
+func errorStatus(err error) int {
+	var delegateErr *DelegateError
+	if errors.As(err, &delegateErr) && delegateErr.Status != 0 {
+		return delegateErr.Status
+	}
+	if errors.Is(err, ErrNoUpstreamMatch) || errors.Is(err, ErrRevoked) {
+		return http.StatusUnauthorized
+	} else if errors.Is(err, ErrRejected) {
+		return http.StatusForbidden
+	} else if errors.Is(err, ErrMethodNotAllowed) {
+		return http.StatusMethodNotAllowed
+	} else if errors.Is(err, ErrAmbiguousMatch) {
+		return http.StatusConflict
+	} else if errors.Is(err, ErrRequestBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	} else if errors.Is(err, ErrInvalidRequestBody) {
+		return http.StatusBadRequest
+	} else if errors.Is(err, ErrRateLimited) {
+		return http.StatusTooManyRequests
+	} else if errors.Is(err, ErrUpstreamOverloaded) ||
+		errors.Is(err, ErrCircuitOpen) {
+		return http.StatusServiceUnavailable
+	} else if errors.Is(err, ErrUpstreamTimeout) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func defaultErrorHandler(rw http.ResponseWriter, req *http.Request,
+	err error) {
+	status := errorStatus(err)
+	if status == http.StatusUnauthorized {
+		if errors.Is(err, ErrUpstreamUnavailable) ||
+			errors.Is(err, ErrUpstreamTimeout) {
+			log.Printf("%s %s: %s", req.Method, req.RequestURI, err)
+		}
+		http.Error(rw, "unauthorized request", status)
+		return
+	} else if status == http.StatusForbidden {
+		http.Error(rw, "forbidden request", status)
+		return
+	} else if status == http.StatusMethodNotAllowed {
+		http.Error(rw, "method not allowed", status)
+		return
+	}
+	log.Printf("%s %s: %s", req.Method, req.RequestURI, err)
+	rw.WriteHeader(status)
+}
+
+// classifyProxyError wraps an error reported by the reverse proxy for
+// upstream in a *DelegateError, unless it is one already.
+func classifyProxyError(upstream string, err error) *DelegateError {
+	var delegateErr *DelegateError
+	if errors.As(err, &delegateErr) {
+		return delegateErr
+	}
+	code := ErrUpstreamUnavailable
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		code = ErrUpstreamTimeout
+	}
+	return &DelegateError{Code: code, Upstream: upstream, Cause: err}
+}
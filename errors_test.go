@@ -0,0 +1,104 @@
+package authdelegate
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Delegate errors", func() {
+	var opts *AuthDelegateOptions
+	var reported error
+
+	BeforeEach(func() {
+		reported = nil
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			ErrorHandler: func(rw http.ResponseWriter,
+				req *http.Request, err error) {
+				reported = err
+				rw.WriteHeader(http.StatusTeapot)
+			},
+		}
+	})
+
+	addUpstream := func(handler http.HandlerFunc) *httptest.Server {
+		server := httptest.NewServer(handler)
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			Name: "upstream",
+			URL:  server.URL,
+		})
+		Expect(opts.Validate()).To(BeNil())
+		return server
+	}
+
+	serve := func(req *http.Request) {
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusTeapot))
+	}
+
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		return req
+	}
+
+	It("should report ErrNoUpstreamMatch", func() {
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				URL:        "http://127.0.0.1/",
+				HeaderName: "X-Signature",
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		serve(newRequest())
+		Expect(errors.Is(reported, ErrNoUpstreamMatch)).To(BeTrue())
+		Expect(reported.Error()).To(Equal("no upstream matches request"))
+	})
+
+	It("should report ErrUpstreamUnavailable", func() {
+		server := addUpstream(func(http.ResponseWriter, *http.Request) {})
+		server.Close()
+		serve(newRequest())
+		Expect(errors.Is(reported, ErrUpstreamUnavailable)).To(BeTrue())
+		Expect(reported.(*DelegateError).Upstream).To(Equal("upstream"))
+		Expect(reported.(*DelegateError).Cause).ToNot(BeNil())
+	})
+
+	It("should report ErrUpstreamTimeout", func() {
+		server := addUpstream(func(http.ResponseWriter, *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		})
+		defer server.Close()
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 10*time.Millisecond)
+		defer cancel()
+		serve(newRequest().WithContext(ctx))
+		Expect(errors.Is(reported, ErrUpstreamTimeout)).To(BeTrue())
+	})
+
+	It("should report ErrInvalidUpstreamResponse", func() {
+		server := addUpstream(func(rw http.ResponseWriter,
+			req *http.Request) {
+			rw.Header().Set("Content-Encoding", "gzip")
+			rw.Write([]byte("not actually gzipped"))
+		})
+		defer server.Close()
+		serve(newRequest())
+		Expect(errors.Is(reported, ErrInvalidUpstreamResponse)).To(
+			BeTrue())
+	})
+
+	It("should return Bad Gateway by default", func() {
+		opts.ErrorHandler = nil
+		server := addUpstream(func(http.ResponseWriter, *http.Request) {})
+		server.Close()
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, newRequest())
+		Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+	})
+})
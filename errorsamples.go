@@ -0,0 +1,257 @@
+package authdelegate
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Defaults and limits of error_samples
+const (
+	defaultErrorSampleCount    = 10
+	maxErrorSampleCount        = 1000
+	defaultErrorSampleBytes    = 1024
+	maxErrorSampleBytes        = 64 * 1024
+	defaultErrorSampleInterval = time.Second
+)
+
+// errorSampleSlack is how many bytes beyond max_bytes are read, so that a
+// credential that straddles the limit is redacted rather than truncated
+// beyond recognition.
+const errorSampleSlack = 256
+
+// errorSampleRedactor redacts sampled bodies when log_redaction is
+// undefined, since backend error messages may echo the credentials of the
+// requests that caused them.
+var errorSampleRedactor = &logRedactor{credentials: redactSuppress}
+
+// errorSample is the beginning of the body of a 5xx response from an
+// upstream.
+type errorSample struct {
+	Time    time.Time `json:"time"`
+	Status  int       `json:"status"`
+	Replica string    `json:"replica"`
+	Body    string    `json:"body"`
+
+	// True if the body was longer than max_bytes
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Present, instead of the body, if the body was encoded
+	ContentEncoding string `json:"content_encoding,omitempty"`
+
+	// The sanitized body, including the slack, before redaction
+	body string
+}
+
+// errorSampler keeps the most recent samples of the bodies of an upstream's
+// 5xx responses, taking at most one per interval, so that backend error
+// messages can be seen without access to the backend.
+type errorSampler struct {
+	count    int
+	maxBytes int
+	interval time.Duration
+
+	// Guards the following fields; samples is a ring, of which next is the
+	// oldest once it's full
+	mutex   sync.Mutex
+	samples []errorSample
+	next    int
+	taken   time.Time
+}
+
+func newErrorSampler(opts *AuthDelegateOptions) *errorSampler {
+	config := opts.ErrorSamples
+	if config == nil {
+		return nil
+	}
+	sampler := &errorSampler{
+		count:    config.Count,
+		maxBytes: config.MaxBytes,
+		interval: config.interval,
+	}
+	if sampler.count == 0 {
+		sampler.count = defaultErrorSampleCount
+	}
+	if sampler.maxBytes == 0 {
+		sampler.maxBytes = defaultErrorSampleBytes
+	}
+	if config.Interval == "" {
+		sampler.interval = defaultErrorSampleInterval
+	}
+	return sampler
+}
+
+// apply samples the 5xx responses proxy receives, before any other
+// ModifyResponse hook, so that those failing open are sampled too.
+func (sampler *errorSampler) apply(proxy *httputil.ReverseProxy) {
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if res.StatusCode >= http.StatusInternalServerError &&
+			sampler.due(time.Now()) {
+			sampler.add(sampler.capture(res))
+		}
+		return modifyResponse(res)
+	}
+}
+
+// due returns true, and reserves the sample, if interval has passed since
+// the last sample was taken.
+func (sampler *errorSampler) due(now time.Time) bool {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	if now.Sub(sampler.taken) < sampler.interval {
+		return false
+	}
+	sampler.taken = now
+	return true
+}
+
+// capture reads up to maxBytes of the body of res, and the slack, into a
+// sample, replacing the body so that it still reaches the client intact.
+func (sampler *errorSampler) capture(res *http.Response) errorSample {
+	sample := errorSample{
+		Time:   time.Now().UTC(),
+		Status: res.StatusCode,
+	}
+	if res.Request != nil {
+		sample.Replica = res.Request.URL.Scheme + "://" +
+			res.Request.URL.Host
+	}
+	encoding := strings.TrimSpace(res.Header.Get("Content-Encoding"))
+	if encoding != "" && !strings.EqualFold(encoding, "identity") {
+		sample.ContentEncoding = encoding
+		return sample
+	}
+	body := make([]byte, sampler.maxBytes+errorSampleSlack)
+	n, _ := io.ReadFull(res.Body, body)
+	body = body[:n]
+	res.Body = &sampledBody{
+		io.MultiReader(bytes.NewReader(body), res.Body), res.Body,
+	}
+	sample.Truncated = n > sampler.maxBytes
+	sample.body = sanitizeErrorSample(body)
+	return sample
+}
+
+// sampledBody is a response body of which the beginning has been read into
+// a sample and is replayed before the rest.
+type sampledBody struct {
+	io.Reader
+	io.Closer
+}
+
+// sanitizeErrorSample makes body safe to display: invalid UTF-8, including
+// a character cut short by truncation, and control characters other than
+// newlines and tabs are replaced.
+func sanitizeErrorSample(body []byte) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\n' && r != '\t' && unicode.IsControl(r) {
+			return unicode.ReplacementChar
+		}
+		return r
+	}, strings.ToValidUTF8(string(body), string(unicode.ReplacementChar)))
+}
+
+// truncateUTF8 returns at most the first n bytes of s, without splitting a
+// character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func (sampler *errorSampler) add(sample errorSample) {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	if len(sampler.samples) < sampler.count {
+		sampler.samples = append(sampler.samples, sample)
+		return
+	}
+	sampler.samples[sampler.next] = sample
+	sampler.next = (sampler.next + 1) % sampler.count
+}
+
+// list returns the samples kept, oldest first, with the values
+// redactor redacts removed, and each body then truncated to maxBytes.
+func (sampler *errorSampler) list(redactor *logRedactor) []errorSample {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	samples := append(append([]errorSample{},
+		sampler.samples[sampler.next:]...), sampler.samples[:sampler.next]...)
+	for i := range samples {
+		samples[i].Replica = redactor.text(samples[i].Replica)
+		samples[i].Body = truncateUTF8(redactor.text(samples[i].body),
+			sampler.maxBytes)
+	}
+	return samples
+}
+
+func (sampler *errorSampler) clear() {
+	sampler.mutex.Lock()
+	defer sampler.mutex.Unlock()
+	sampler.samples = nil
+	sampler.next = 0
+}
+
+type upstreamErrorSamples struct {
+	Upstream string        `json:"upstream"`
+	Samples  []errorSample `json:"samples"`
+}
+
+// errorSamples reports the samples of each proxied upstream's 5xx responses
+// on GET, and on DELETE also discards them.
+func (admin *adminHandler) errorSamples(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "DELETE" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	redactor := admin.delegate.redactor
+	if redactor == nil {
+		redactor = errorSampleRedactor
+	}
+	reports := []upstreamErrorSamples{}
+	for _, upstream := range admin.delegate.routes().upstreams {
+		if upstream.errorSamples == nil {
+			continue
+		}
+		reports = append(reports, upstreamErrorSamples{
+			upstream.name, upstream.errorSamples.list(redactor),
+		})
+		if req.Method == "DELETE" {
+			upstream.errorSamples.clear()
+		}
+	}
+	writeJSON(rw, reports)
+}
+
+func validateErrorSamples(opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.ErrorSamples
+	if config == nil {
+		return msgs
+	}
+	if config.Count < 0 || config.Count > maxErrorSampleCount {
+		msgs = append(msgs, "error_samples count must be from 0 to "+
+			strconv.Itoa(maxErrorSampleCount)+": "+
+			strconv.Itoa(config.Count))
+	}
+	if config.MaxBytes < 0 || config.MaxBytes > maxErrorSampleBytes {
+		msgs = append(msgs, "error_samples max_bytes must be from 0 to "+
+			strconv.Itoa(maxErrorSampleBytes)+": "+
+			strconv.Itoa(config.MaxBytes))
+	}
+	return validateDuration(config.Interval, "interval", "error_samples",
+		&config.interval, msgs)
+}
@@ -0,0 +1,143 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Error samples", func() {
+	var server *httptest.Server
+	var body string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		body = "database unavailable\x00 for Bearer s3cret-token-value; " +
+			"retry later"
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("X-Fail") == "" {
+					rw.WriteHeader(http.StatusAccepted)
+					return
+				}
+				rw.WriteHeader(http.StatusBadGateway)
+				rw.Write([]byte(body))
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{Name: "legacy", URL: server.URL},
+			},
+			ErrorSamples: &AuthDelegateErrorSamples{
+				Count:    2,
+				MaxBytes: 48,
+				Interval: "0s",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	request := func(handler http.Handler,
+		method string, fail bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "http://delegate/", nil)
+		if fail {
+			req.Header.Set("X-Fail", "true")
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	samples := func(admin http.Handler,
+		method string) []upstreamErrorSamples {
+		req, _ := http.NewRequest(method,
+			"http://admin/debug/error_samples", nil)
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var reports []upstreamErrorSamples
+		Expect(json.Unmarshal(recorder.Body.Bytes(),
+			&reports)).To(Succeed())
+		return reports
+	}
+
+	It("should keep sanitized samples of recent 5xx bodies", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		admin := NewAdminHandler(delegate)
+
+		Expect(request(delegate, "GET", false).Code).To(
+			Equal(http.StatusAccepted))
+		recorder := request(delegate, "GET", true)
+		Expect(recorder.Code).To(Equal(http.StatusBadGateway))
+		Expect(recorder.Body.String()).To(Equal(body))
+
+		reports := samples(admin, "GET")
+		Expect(reports).To(HaveLen(1))
+		Expect(reports[0].Upstream).To(Equal("legacy"))
+		Expect(reports[0].Samples).To(HaveLen(1))
+		sample := reports[0].Samples[0]
+		Expect(sample.Status).To(Equal(http.StatusBadGateway))
+		Expect(sample.Replica).To(Equal(server.URL))
+		Expect(sample.Body).To(Equal(
+			"database unavailable� for Bearer [credential];"))
+		Expect(sample.Truncated).To(BeTrue())
+
+		body = "second"
+		request(delegate, "GET", true)
+		body = "third"
+		request(delegate, "GET", true)
+		reports = samples(admin, "DELETE")
+		Expect(reports[0].Samples).To(HaveLen(2))
+		Expect(reports[0].Samples[0].Body).To(Equal("second"))
+		Expect(reports[0].Samples[1].Body).To(Equal("third"))
+		Expect(reports[0].Samples[1].Truncated).To(BeFalse())
+		Expect(samples(admin, "GET")[0].Samples).To(BeEmpty())
+	})
+
+	It("should take at most one sample per interval", func() {
+		opts.ErrorSamples.Interval = "1h"
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		request(delegate, "GET", true)
+		request(delegate, "GET", true)
+		reports := samples(NewAdminHandler(delegate), "GET")
+		Expect(reports[0].Samples).To(HaveLen(1))
+	})
+
+	It("should not sample unless configured", func() {
+		opts.ErrorSamples = nil
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		request(delegate, "GET", true)
+		Expect(samples(NewAdminHandler(delegate), "GET")).To(BeEmpty())
+	})
+
+	It("should replace invalid UTF-8 and control characters", func() {
+		Expect(sanitizeErrorSample([]byte("a\tb\nc\rd\xe2\x82"))).To(
+			Equal("a\tb\nc�d�"))
+		Expect(strings.Count(sanitizeErrorSample(
+			[]byte("\x1b[31mred")), "�")).To(Equal(1))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.ErrorSamples = &AuthDelegateErrorSamples{
+			Count:    -1,
+			MaxBytes: 1 << 20,
+			Interval: "often",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"error_samples count must be from 0 to 1000: -1",
+			"error_samples max_bytes must be from 0 to 65536: 1048576",
+			"invalid interval for error_samples: often",
+		})))
+	})
+})
@@ -0,0 +1,246 @@
+package authdelegate
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// upstreamExec is the type of upstream that decides requests by running a
+// command, so that existing verification scripts can be used without
+// wrapping them in a service.
+const upstreamExec = "exec"
+
+const (
+	// execTimeout limits each command of an exec upstream if the upstream
+	// has no timeout.
+	execTimeout = 5 * time.Second
+
+	// defaultExecMaxConcurrency is the number of commands an exec upstream
+	// runs at once unless exec_max_concurrency is specified.
+	defaultExecMaxConcurrency = 8
+
+	// execWaitDelay is how long to wait for the output of a command that
+	// has been killed, in case processes it started still hold its output
+	// open.
+	execWaitDelay = time.Second
+
+	// execOutputLimit is the number of bytes of the standard output, and of
+	// the standard error, of a command that are kept. A request fails if
+	// its command writes more to its standard output.
+	execOutputLimit = 64 << 10
+)
+
+// Exit statuses of exec_command, other than which the request fails. The
+// denials are unusual statuses, after the 401 and 403 responses they stand
+// for, so that a command that fails for another reason, as with the status
+// 1 or 2 of many commands and shells, doesn't deny the request.
+const (
+	execAllow        = 0
+	execUnauthorized = 41
+	execForbidden    = 43
+)
+
+// execHeaderPrefix begins the names of the headers an exec command may
+// return, unless its upstream lists them in auth_response_headers.
+const execHeaderPrefix = "X-Auth-"
+
+// execInput describes the request being authorized to exec_command, as a
+// single line of JSON on its standard input.
+type execInput struct {
+	Method     string      `json:"method"`
+	Host       string      `json:"host"`
+	URI        string      `json:"uri"`
+	ClientIP   string      `json:"client_ip"`
+	Listener   string      `json:"listener,omitempty"`
+	Credential string      `json:"credential,omitempty"`
+	Headers    http.Header `json:"headers"`
+}
+
+// execHandler decides requests by running the command of an exec upstream,
+// at most len(slots) at a time. The exit status of the command is the
+// decision, and lines of its standard output of the form "Name: value" are
+// returned as headers if it allows the request.
+type execHandler struct {
+	upstream   string
+	command    []string
+	timeout    time.Duration
+	credential func(*http.Request) (string, bool)
+	slots      chan struct{}
+
+	// Canonical names of the headers the command may return, or nil if
+	// they are those beginning with execHeaderPrefix
+	headers map[string]bool
+}
+
+func newExecHandler(upstream *AuthDelegateUpstream,
+	delegate *authDelegate) http.Handler {
+	handler := &execHandler{
+		upstream:   upstreamLabel(upstream),
+		command:    upstream.ExecCommand,
+		timeout:    upstream.timeout,
+		credential: delegate.credential,
+	}
+	if handler.timeout == 0 {
+		handler.timeout = execTimeout
+	}
+	concurrency := upstream.ExecMaxConcurrency
+	if concurrency == 0 {
+		concurrency = defaultExecMaxConcurrency
+	}
+	handler.slots = make(chan struct{}, concurrency)
+	for _, name := range upstream.AuthResponseHeaders {
+		if handler.headers == nil {
+			handler.headers = make(map[string]bool)
+		}
+		handler.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	return handler
+}
+
+// input returns the standard input of the command for req.
+func (handler *execHandler) input(req *http.Request) ([]byte, error) {
+	credential, _ := handler.credential(req)
+	input, err := json.Marshal(&execInput{
+		Method:     originalMethod(req),
+		Host:       requestHost(req),
+		URI:        originalURI(req),
+		ClientIP:   clientIP(req),
+		Listener:   requestListener(req),
+		Credential: credential,
+		Headers:    req.Header,
+	})
+	return append(input, '\n'), err
+}
+
+func (handler *execHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), handler.timeout)
+	defer cancel()
+	select {
+	case handler.slots <- struct{}{}:
+		defer func() { <-handler.slots }()
+	case <-ctx.Done():
+		log.Printf("upstream %s: exec: %d commands already running",
+			handler.upstream, cap(handler.slots))
+		explainDecision(req, "exec: too many commands running")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	input, err := handler.input(req)
+	if err != nil {
+		log.Printf("upstream %s: exec: %s", handler.upstream, err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	stdout := &limitedBuffer{limit: execOutputLimit}
+	stderr := &limitedBuffer{limit: execOutputLimit}
+	cmd := exec.CommandContext(ctx, handler.command[0],
+		handler.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = execWaitDelay
+	err = cmd.Run()
+	if message := strings.TrimSpace(stderr.buffer.String()); message != "" {
+		log.Printf("upstream %s: exec: stderr: %s", handler.upstream,
+			message)
+	}
+
+	var exitErr *exec.ExitError
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Printf("upstream %s: exec: killed after %s",
+			handler.upstream, handler.timeout)
+		explainDecision(req, "exec: killed after "+
+			handler.timeout.String())
+		rw.WriteHeader(http.StatusGatewayTimeout)
+	} else if err == nil && stdout.truncated {
+		log.Printf("upstream %s: exec: standard output exceeds %d "+
+			"bytes", handler.upstream, execOutputLimit)
+		explainDecision(req, "exec: standard output too long")
+		rw.WriteHeader(http.StatusBadGateway)
+	} else if err == nil {
+		writeExecHeaders(rw.Header(), &stdout.buffer, handler.headers)
+		rw.WriteHeader(http.StatusAccepted)
+	} else if !errors.As(err, &exitErr) {
+		log.Printf("upstream %s: exec: %s", handler.upstream, err)
+		explainDecision(req, "exec: "+err.Error())
+		rw.WriteHeader(http.StatusBadGateway)
+	} else if exitErr.ExitCode() == execUnauthorized {
+		explainDecision(req, "exec: "+err.Error())
+		rw.WriteHeader(http.StatusUnauthorized)
+	} else if exitErr.ExitCode() == execForbidden {
+		explainDecision(req, "exec: "+err.Error())
+		rw.WriteHeader(http.StatusForbidden)
+	} else {
+		log.Printf("upstream %s: exec: %s", handler.upstream, err)
+		explainDecision(req, "exec: "+err.Error())
+		rw.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// limitedBuffer keeps the first limit bytes written to it, discarding the
+// rest, so that a command's output can't exhaust memory. Writes never fail,
+// so that the command isn't disturbed. The buffer isn't embedded, so that
+// io.Copy can't bypass Write with its ReadFrom method.
+type limitedBuffer struct {
+	buffer    bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (buffer *limitedBuffer) Write(p []byte) (int, error) {
+	if room := buffer.limit - buffer.buffer.Len(); len(p) > room {
+		buffer.truncated = true
+		buffer.buffer.Write(p[:room])
+	} else {
+		buffer.buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// writeExecHeaders adds the lines of output of the form "Name: value" to
+// header, if allowed includes their names, or if allowed is nil and their
+// names begin with execHeaderPrefix; other lines are ignored, so that a
+// command can't set headers such as Set-Cookie that the proxy would pass
+// to the client.
+func writeExecHeaders(header http.Header, output *bytes.Buffer,
+	allowed map[string]bool) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		name := http.CanonicalHeaderKey(strings.TrimSpace(parts[0]))
+		permitted := strings.HasPrefix(name, execHeaderPrefix)
+		if allowed != nil {
+			permitted = allowed[name]
+		}
+		if len(parts) != 2 || !permitted ||
+			strings.ContainsAny(name, " \t") {
+			continue
+		}
+		header.Add(name, strings.TrimSpace(parts[1]))
+	}
+}
+
+// validateExec checks that the command of an exec upstream can be found.
+func validateExec(upstream *AuthDelegateUpstream, msgs []string) []string {
+	if len(upstream.ExecCommand) == 0 || upstream.ExecCommand[0] == "" {
+		msgs = append(msgs, "exec requires exec_command: "+upstream.URL)
+	} else if _, err := exec.LookPath(upstream.ExecCommand[0]); err != nil {
+		msgs = append(msgs, "exec_command can't be run for "+
+			upstream.URL+": "+err.Error())
+	}
+	if upstream.ExecMaxConcurrency < 0 {
+		msgs = append(msgs, "exec_max_concurrency must not be "+
+			"negative: "+upstream.URL)
+	}
+	return msgs
+}
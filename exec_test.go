@@ -0,0 +1,132 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Exec upstreams", func() {
+	var opts *AuthDelegateOptions
+
+	// script allows requests whose credential is "good", denies those
+	// whose credential is "forbidden" with a 403 status, writes too much
+	// for those whose credential is "verbose", and otherwise exits with
+	// the status in the credential.
+	const script = `read -r input
+case "$input" in
+*'"credential":"good"'*)
+	echo "X-Auth-User: alice"
+	echo "Set-Cookie: session=forged"
+	echo "ignored"
+	exit 0;;
+*'"credential":"forbidden"'*) exit 43;;
+*'"credential":"slow"'*) exec sleep 5;;
+*'"credential":"verbose"'*) head -c 70000 /dev/zero | tr '\0' x; exit 0;;
+esac
+echo "denied $input" >&2
+exit "$(echo "$input" | sed 's/.*"credential":"\([0-9]*\)".*/\1/')"`
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:        "legacy",
+					Type:        "exec",
+					HeaderName:  "X-Legacy-Token",
+					Timeout:     "500ms",
+					ExecCommand: []string{"sh", "-c", script},
+				},
+			},
+		}
+	})
+
+	authorize := func(handler http.Handler,
+		token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/reports")
+		req.Header.Set("X-Legacy-Token", token)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should decide requests by the command's exit status", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+
+		recorder := authorize(handler, "good")
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("X-Auth-User")).To(Equal("alice"))
+		Expect(recorder.Header().Get("Set-Cookie")).To(BeEmpty())
+		for _, test := range []struct {
+			token    string
+			expected int
+		}{
+			{"41", http.StatusUnauthorized},
+			{"forbidden", http.StatusForbidden},
+			{"1", http.StatusBadGateway},
+			{"2", http.StatusBadGateway},
+			{"3", http.StatusBadGateway},
+			{"slow", http.StatusGatewayTimeout},
+			{"verbose", http.StatusBadGateway},
+		} {
+			recorder := authorize(handler, test.token)
+			Expect(recorder.Code).To(Equal(test.expected), test.token)
+			Expect(recorder.Header().Get("X-Auth-User")).To(BeEmpty())
+		}
+	})
+
+	It("should return only the headers in auth_response_headers", func() {
+		opts.Upstreams[0].AuthResponseHeaders = []string{"set-cookie"}
+		Expect(opts.Validate()).To(BeNil())
+		recorder := authorize(NewAuthDelegate(opts), "good")
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("Set-Cookie")).To(
+			Equal("session=forged"))
+		Expect(recorder.Header().Get("X-Auth-User")).To(BeEmpty())
+	})
+
+	It("should limit the commands running at once", func() {
+		opts.Upstreams[0].ExecMaxConcurrency = 1
+		opts.Upstreams[0].Timeout = "50ms"
+		Expect(opts.Validate()).To(BeNil())
+		handler := newExecHandler(opts.Upstreams[0],
+			&authDelegate{headerName: "X-Legacy-Token"})
+		handler.(*execHandler).slots <- struct{}{}
+		Expect(authorize(handler, "good").Code).To(
+			Equal(http.StatusServiceUnavailable))
+
+		<-handler.(*execHandler).slots
+		Expect(authorize(handler, "good").Code).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should fail validation if the command can't be run", func() {
+		opts.Upstreams[0].ExecCommand = []string{"/nonexistent/verify"}
+		opts.Upstreams[0].ExecMaxConcurrency = -1
+		opts.Upstreams = append(opts.Upstreams,
+			&AuthDelegateUpstream{
+				Name:       "unset",
+				Type:       "exec",
+				HeaderName: "X-Unset",
+			},
+			&AuthDelegateUpstream{
+				URL:         "http://localhost:8081",
+				ExecCommand: []string{"true"},
+			})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"exec_command can't be run for exec:legacy: exec: " +
+				"\"/nonexistent/verify\": stat /nonexistent/verify: " +
+				"no such file or directory",
+			"exec_max_concurrency must not be negative: exec:legacy",
+			"exec requires exec_command: exec:unset",
+			"exec_command and exec_max_concurrency require type exec: " +
+				"http://localhost:8081",
+		})))
+	})
+})
@@ -0,0 +1,257 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of cert_expiry_alerts
+var defaultCertExpiryThresholds = []string{"720h", "168h"}
+
+const defaultCertExpiryCheckInterval = time.Hour
+
+// certExpiryWebhookClient sends alerts to the cert_expiry_alerts webhook.
+var certExpiryWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// certExpiryMonitor periodically reads the certificate files named in the
+// configuration, and warns as the earliest-expiring certificate in each
+// approaches expiry. Files are read on each check, so that replacing a
+// certificate clears its warning.
+type certExpiryMonitor struct {
+	files      []certFile
+	thresholds []time.Duration
+	webhookURL string
+
+	// Guards levels and expiries
+	mutex sync.Mutex
+
+	// Number of thresholds each file's certificate has crossed, plus one
+	// if it has expired, by label
+	levels map[string]int
+
+	// Earliest expiry of the certificates in each file, by label
+	expiries map[string]time.Time
+
+	// Accessed atomically
+	alerts int64
+}
+
+// certFile identifies a certificate file to monitor by its label, such as
+// "ssl_cert" or "upstream sso client_cert", and path.
+type certFile struct {
+	label string
+	path  string
+}
+
+// certExpiryAlert is logged, and sent to the webhook, when a certificate
+// crosses a threshold or expires.
+type certExpiryAlert struct {
+	Certificate   string    `json:"certificate"`
+	Path          string    `json:"path"`
+	Subject       string    `json:"subject"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining float64   `json:"days_remaining"`
+
+	// The threshold crossed, or empty if the certificate has expired
+	Threshold string `json:"threshold,omitempty"`
+}
+
+// watchCertificateExpiry checks the certificates of opts immediately, then
+// periodically in the background, if opts enables cert_expiry_alerts. The
+// results are reported in the metrics of delegate, which must have been
+// created by NewAuthDelegate.
+func watchCertificateExpiry(delegate http.Handler, opts *AuthDelegateOptions) {
+	config := opts.CertExpiryAlerts
+	if config == nil {
+		return
+	}
+	monitor := newCertExpiryMonitor(opts)
+	delegate.(*authDelegateHandler).certExpiry = monitor
+	monitor.check(time.Now())
+	go func() {
+		for range time.Tick(config.checkInterval) {
+			monitor.check(time.Now())
+		}
+	}()
+}
+
+func newCertExpiryMonitor(opts *AuthDelegateOptions) *certExpiryMonitor {
+	config := opts.CertExpiryAlerts
+	return &certExpiryMonitor{
+		files:      certFiles(opts),
+		thresholds: config.thresholds,
+		webhookURL: config.WebhookURL,
+		levels:     make(map[string]int),
+		expiries:   make(map[string]time.Time),
+	}
+}
+
+// certFiles returns the certificate files the delegate serves, presents to
+// upstreams, or trusts to verify clients and upstreams.
+func certFiles(opts *AuthDelegateOptions) []certFile {
+	var files []certFile
+	add := func(label, path string) {
+		if path != "" {
+			files = append(files, certFile{label, path})
+		}
+	}
+	add("ssl_cert", opts.SslCert)
+	add("client_ca_file", opts.ClientCAFile)
+	add("admin_ssl_cert", opts.AdminSslCert)
+	add("admin_client_ca", opts.AdminClientCA)
+	add("control_ssl_cert", opts.ControlSslCert)
+	add("control_client_ca", opts.ControlClientCA)
+	for _, listener := range opts.Listeners {
+		name := listener.listenerName()
+		add("listener "+name+" ssl_cert", listener.SslCert)
+		add("listener "+name+" client_ca_file", listener.ClientCAFile)
+	}
+	for _, upstream := range opts.Upstreams {
+		name := upstreamLabel(upstream)
+		add("upstream "+name+" client_cert", upstream.ClientCert)
+		add("upstream "+name+" client_ca", upstream.ClientCA)
+	}
+	return files
+}
+
+// check reads each certificate file and raises an alert for each whose
+// earliest-expiring certificate has crossed another threshold since the
+// last check. Files that can't be read are logged and skipped.
+func (monitor *certExpiryMonitor) check(now time.Time) {
+	for _, file := range monitor.files {
+		cert, err := earliestExpiry(file.path)
+		if err != nil {
+			log.Printf("certs: failed to check %s: %s", file.label, err)
+			continue
+		}
+		remaining := cert.NotAfter.Sub(now)
+		level := 0
+		for _, threshold := range monitor.thresholds {
+			if remaining <= threshold {
+				level++
+			}
+		}
+		if remaining <= 0 {
+			level++
+		}
+
+		monitor.mutex.Lock()
+		previous := monitor.levels[file.label]
+		monitor.levels[file.label] = level
+		monitor.expiries[file.label] = cert.NotAfter
+		monitor.mutex.Unlock()
+
+		if level > previous {
+			monitor.alert(file, cert, remaining, level)
+		} else if level < previous && level == 0 {
+			log.Printf("certs: %s (%s) was replaced and expires at %s",
+				file.label, cert.Subject,
+				cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+	}
+}
+
+// alert logs that the certificate of file has reached level, and sends the
+// alert to the webhook, if any, in the background.
+func (monitor *certExpiryMonitor) alert(file certFile,
+	cert *x509.Certificate, remaining time.Duration, level int) {
+	atomic.AddInt64(&monitor.alerts, 1)
+	alert := &certExpiryAlert{
+		Certificate:   file.label,
+		Path:          file.path,
+		Subject:       cert.Subject.String(),
+		NotAfter:      cert.NotAfter.UTC(),
+		DaysRemaining: remaining.Hours() / 24,
+	}
+	if level <= len(monitor.thresholds) {
+		alert.Threshold = monitor.thresholds[level-1].String()
+		log.Printf("certs: warning: %s (%s) expires in %.1f days, at %s",
+			file.label, alert.Subject, alert.DaysRemaining,
+			alert.NotAfter.Format(time.RFC3339))
+	} else {
+		log.Printf("certs: warning: %s (%s) expired at %s", file.label,
+			alert.Subject, alert.NotAfter.Format(time.RFC3339))
+	}
+	if monitor.webhookURL != "" {
+		go monitor.notify(alert)
+	}
+}
+
+// notify posts alert to the webhook as JSON, logging any failure.
+func (monitor *certExpiryMonitor) notify(alert *certExpiryAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("certs: failed to encode alert: %s", err)
+		return
+	}
+	resp, err := certExpiryWebhookClient.Post(monitor.webhookURL,
+		"application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("certs: failed to send alert for %s: %s",
+			alert.Certificate, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("certs: webhook returned %d for alert for %s",
+			resp.StatusCode, alert.Certificate)
+	}
+}
+
+// expiryDays returns the number of days until the earliest-expiring
+// certificate in each file expires, as of the last check, by label, sorted by
+// label.
+func (monitor *certExpiryMonitor) expiryDays() (
+	labels []string, days []float64) {
+	monitor.mutex.Lock()
+	defer monitor.mutex.Unlock()
+	for label := range monitor.expiries {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		days = append(days,
+			time.Until(monitor.expiries[label]).Hours()/24)
+	}
+	return
+}
+
+// earliestExpiry returns the certificate in the PEM file at path that expires
+// first.
+func earliestExpiry(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var earliest *x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		} else if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if earliest == nil || cert.NotAfter.Before(earliest.NotAfter) {
+			earliest = cert
+		}
+	}
+	if earliest == nil {
+		return nil, errors.New("no PEM-encoded certificates in " + path)
+	}
+	return earliest, nil
+}
@@ -0,0 +1,157 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Certificate expiry alerts", func() {
+	var dir string
+	var server, upstreamCA *testCertificate
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "expiry")
+		Expect(err).To(BeNil())
+		server = writeTestCertificate(dir, "server", 90*24*time.Hour)
+		upstreamCA = writeTestCertificate(dir, "upstream-ca",
+			20*24*time.Hour)
+		opts = &AuthDelegateOptions{
+			Port:             8080,
+			MetricsPath:      "/metrics",
+			SslCert:          server.CertFile,
+			SslKey:           server.KeyFile,
+			CertExpiryAlerts: &AuthDelegateCertExpiryAlerts{},
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				Name:     "sso",
+				URL:      "https://localhost:8081",
+				ClientCA: upstreamCA.CertFile,
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should default the thresholds and check interval", func() {
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.CertExpiryAlerts.thresholds).To(Equal(
+			[]time.Duration{720 * time.Hour, 168 * time.Hour}))
+		Expect(opts.CertExpiryAlerts.checkInterval).To(Equal(time.Hour))
+	})
+
+	It("should sort the thresholds longest first", func() {
+		opts.CertExpiryAlerts.Thresholds = []string{"24h", "336h"}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.CertExpiryAlerts.thresholds).To(Equal(
+			[]time.Duration{336 * time.Hour, 24 * time.Hour}))
+	})
+
+	It("should reject invalid settings", func() {
+		opts.CertExpiryAlerts = &AuthDelegateCertExpiryAlerts{
+			Thresholds:    []string{"30d", "-1h"},
+			CheckInterval: "0s",
+			WebhookURL:    "ftp://alerts.example.com",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid cert_expiry_alerts threshold: 30d",
+			"invalid cert_expiry_alerts threshold: -1h",
+			"cert_expiry_alerts check_interval must be positive",
+			"invalid cert_expiry_alerts webhook_url: " +
+				"ftp://alerts.example.com",
+		})))
+	})
+
+	It("should monitor the certificates of the configuration", func() {
+		opts.AdminAddress = "127.0.0.1:9090"
+		opts.AdminSslCert = server.CertFile
+		opts.AdminSslKey = server.KeyFile
+		Expect(opts.Validate()).To(BeNil())
+		Expect(certFiles(opts)).To(Equal([]certFile{
+			{"ssl_cert", server.CertFile},
+			{"admin_ssl_cert", server.CertFile},
+			{"upstream sso client_ca", upstreamCA.CertFile},
+		}))
+	})
+
+	It("should alert once as each threshold is crossed", func() {
+		alerts := make(chan certExpiryAlert, 10)
+		webhook := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				var alert certExpiryAlert
+				Expect(json.NewDecoder(req.Body).Decode(&alert)).
+					To(Succeed())
+				alerts <- alert
+			}))
+		defer webhook.Close()
+		opts.CertExpiryAlerts.WebhookURL = webhook.URL
+		Expect(opts.Validate()).To(BeNil())
+		monitor := newCertExpiryMonitor(opts)
+
+		now := time.Now()
+		monitor.check(now)
+		var alert certExpiryAlert
+		Eventually(alerts).Should(Receive(&alert))
+		Expect(alert.Certificate).To(Equal("upstream sso client_ca"))
+		Expect(alert.Path).To(Equal(upstreamCA.CertFile))
+		Expect(alert.Subject).To(Equal("CN=upstream-ca"))
+		Expect(alert.Threshold).To(Equal("720h0m0s"))
+		Expect(alert.DaysRemaining).To(BeNumerically("~", 20, 0.01))
+
+		monitor.check(now.Add(time.Hour))
+		Consistently(alerts, 50*time.Millisecond).ShouldNot(Receive())
+
+		monitor.check(now.Add(15 * 24 * time.Hour))
+		Eventually(alerts).Should(Receive(&alert))
+		Expect(alert.Threshold).To(Equal("168h0m0s"))
+
+		monitor.check(now.Add(21 * 24 * time.Hour))
+		Eventually(alerts).Should(Receive(&alert))
+		Expect(alert.Threshold).To(Equal(""))
+		Expect(monitor.alerts).To(Equal(int64(3)))
+	})
+
+	It("should clear the alert when the certificate is replaced", func() {
+		Expect(opts.Validate()).To(BeNil())
+		monitor := newCertExpiryMonitor(opts)
+		monitor.check(time.Now())
+		Expect(monitor.levels["upstream sso client_ca"]).To(Equal(1))
+
+		writeTestCertificate(dir, "upstream-ca", 90*24*time.Hour)
+		monitor.check(time.Now())
+		Expect(monitor.levels["upstream sso client_ca"]).To(Equal(0))
+		monitor.check(time.Now().Add(61 * 24 * time.Hour))
+		Expect(monitor.levels["upstream sso client_ca"]).To(Equal(1))
+		Expect(monitor.levels["ssl_cert"]).To(Equal(1))
+		Expect(monitor.alerts).To(Equal(int64(3)))
+	})
+
+	It("should report the expiry of each certificate file", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		watchCertificateExpiry(delegate, opts)
+
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		metrics := strings.Split(recorder.Body.String(), "\n")
+		Expect(metrics).To(ContainElement(HavePrefix(
+			`authdelegate_cert_expiry_days{certificate="ssl_cert"} 89.9`)))
+		Expect(metrics).To(ContainElement(HavePrefix(
+			"authdelegate_cert_expiry_days{" +
+				`certificate="upstream sso client_ca"} 19.9`)))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_cert_expiry_alerts_total 1"))
+	})
+})
@@ -0,0 +1,88 @@
+package authdelegate
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryQueue is a set of keys, each with the time at which it expires, kept
+// in a heap ordered by that time, so that expired keys are removed in
+// logarithmic time each rather than by scanning every key. It isn't safe for
+// concurrent use.
+type expiryQueue struct {
+	entries []*expiryEntry
+	keys    map[string]*expiryEntry
+}
+
+type expiryEntry struct {
+	key     string
+	expires time.Time
+
+	// Position of the entry in expiryQueue.entries
+	index int
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{keys: make(map[string]*expiryEntry)}
+}
+
+// has returns true if the queue holds key, whether or not it has expired.
+func (queue *expiryQueue) has(key string) bool {
+	_, ok := queue.keys[key]
+	return ok
+}
+
+// set adds key to the queue, or moves it, to expire at expires.
+func (queue *expiryQueue) set(key string, expires time.Time) {
+	if entry, ok := queue.keys[key]; ok {
+		entry.expires = expires
+		heap.Fix(queue, entry.index)
+		return
+	}
+	entry := &expiryEntry{key: key, expires: expires}
+	queue.keys[key] = entry
+	heap.Push(queue, entry)
+}
+
+// expire removes the keys that expire at or before now, passing each to
+// removed, if it isn't nil.
+func (queue *expiryQueue) expire(now time.Time, removed func(key string)) {
+	for len(queue.entries) != 0 && !now.Before(queue.entries[0].expires) {
+		entry := heap.Pop(queue).(*expiryEntry)
+		delete(queue.keys, entry.key)
+		if removed != nil {
+			removed(entry.key)
+		}
+	}
+}
+
+// Len, Less, Swap, Push, and Pop implement heap.Interface, and are only for
+// the use of the heap package.
+
+func (queue *expiryQueue) Len() int {
+	return len(queue.entries)
+}
+
+func (queue *expiryQueue) Less(i, j int) bool {
+	return queue.entries[i].expires.Before(queue.entries[j].expires)
+}
+
+func (queue *expiryQueue) Swap(i, j int) {
+	queue.entries[i], queue.entries[j] = queue.entries[j], queue.entries[i]
+	queue.entries[i].index = i
+	queue.entries[j].index = j
+}
+
+func (queue *expiryQueue) Push(x interface{}) {
+	entry := x.(*expiryEntry)
+	entry.index = len(queue.entries)
+	queue.entries = append(queue.entries, entry)
+}
+
+func (queue *expiryQueue) Pop() interface{} {
+	last := len(queue.entries) - 1
+	entry := queue.entries[last]
+	queue.entries[last] = nil
+	queue.entries = queue.entries[:last]
+	return entry
+}
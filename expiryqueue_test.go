@@ -0,0 +1,30 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Expiry queues", func() {
+	It("should remove keys in order of expiry", func() {
+		queue := newExpiryQueue()
+		now := time.Now()
+		queue.set("late", now.Add(3*time.Second))
+		queue.set("early", now.Add(time.Second))
+		queue.set("moved", now.Add(time.Hour))
+		queue.set("middle", now.Add(2*time.Second))
+		queue.set("moved", now)
+		Expect(queue.Len()).To(Equal(4))
+
+		var removed []string
+		remove := func(key string) { removed = append(removed, key) }
+		queue.expire(now, remove)
+		Expect(removed).To(Equal([]string{"moved"}))
+		queue.expire(now.Add(2*time.Second), remove)
+		Expect(removed).To(Equal([]string{"moved", "early", "middle"}))
+		Expect(queue.has("middle")).To(BeFalse())
+		Expect(queue.has("late")).To(BeTrue())
+		Expect(queue.Len()).To(Equal(1))
+	})
+})
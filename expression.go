@@ -0,0 +1,793 @@
+package authdelegate
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// expression is a compiled match_expression: a condition on the attributes
+// of a request, for routing rules the other match conditions can't express,
+// e.g.
+//
+//	request.host.endsWith('.gov') && has(request.cookies['_sess'])
+//
+// The language borrows the syntax of the Common Expression Language (CEL),
+// and the meaning of the CEL operators and functions it supports, but isn't
+// CEL: an absent header, cookie, or query parameter is the empty string
+// rather than an error, and cookie names may end in *. Expressions are
+// type-checked when the configuration is loaded, and their evaluation can't
+// fail or loop; regular expressions are RE2.
+type expression struct {
+	source string
+	eval   func(req *http.Request) bool
+}
+
+// matches returns true if the expression is true of req.
+func (expression *expression) matches(req *http.Request) bool {
+	return expression.eval(req)
+}
+
+// Types of subexpressions
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprInt
+	exprString
+	exprList
+	exprMap
+	exprRequest
+)
+
+var exprTypeNames = []string{"bool", "int", "string", "list", "map",
+	"request"}
+
+func (typ exprType) String() string {
+	return exprTypeNames[typ]
+}
+
+// exprValue is a compiled subexpression, of which only the fields for its
+// type are set. Evaluation functions are typed, rather than returning
+// interface{}, so that evaluating an expression doesn't allocate.
+type exprValue struct {
+	typ     exprType
+	boolean func(req *http.Request) bool
+	integer func(req *http.Request) int64
+	str     func(req *http.Request) string
+
+	// The constant value of a string literal, or the elements of a list,
+	// which must be string literals
+	literal *string
+	list    []string
+
+	// lookup returns the value of key in a map, and whether it is present;
+	// normalize converts keys to the form lookup expects, e.g. canonical
+	// header names
+	lookup    func(req *http.Request, key string) (string, bool)
+	normalize func(key string) string
+
+	// For map entries, whether the entry is present, for has()
+	present func(req *http.Request) bool
+}
+
+func boolValue(eval func(req *http.Request) bool) *exprValue {
+	return &exprValue{typ: exprBool, boolean: eval}
+}
+
+func stringValue(eval func(req *http.Request) string) *exprValue {
+	return &exprValue{typ: exprString, str: eval}
+}
+
+func mapValue(lookup func(req *http.Request, key string) (string, bool),
+	normalize func(key string) string) *exprValue {
+	return &exprValue{typ: exprMap, lookup: lookup, normalize: normalize}
+}
+
+// requestAttribute returns the attribute of a request selected by a field of
+// the request variable, or false if there is no such field.
+func requestAttribute(name string) (*exprValue, bool) {
+	switch name {
+	case "method":
+		return stringValue(originalMethod), true
+	case "host":
+		return stringValue(requestHost), true
+	case "path":
+		return stringValue(requestPath), true
+	case "uri":
+		return stringValue(originalURI), true
+	case "client_ip":
+		return stringValue(clientIP), true
+	case "listener":
+		return stringValue(requestListener), true
+	case "headers":
+		return mapValue(func(req *http.Request, name string) (string, bool) {
+			return headerValue(req.Header, name)
+		}, http.CanonicalHeaderKey), true
+	case "cookies":
+		return mapValue(func(req *http.Request, name string) (string, bool) {
+			return matchCookie(req.Header, name)
+		}, nil), true
+	case "query":
+		return mapValue(queryValue, nil), true
+	}
+	return nil, false
+}
+
+// queryValue returns the first value of the query parameter name of the
+// X-Original-URI of req, and whether it is present.
+func queryValue(req *http.Request, name string) (string, bool) {
+	uri := originalURI(req)
+	query := strings.IndexByte(uri, '?')
+	if query < 0 {
+		return "", false
+	}
+	values, _ := url.ParseQuery(uri[query+1:])
+	if value, ok := values[name]; ok {
+		return value[0], true
+	}
+	return "", false
+}
+
+// compileExpression parses and type-checks source, which must be a bool
+// expression.
+func compileExpression(source string) (*expression, error) {
+	tokens, err := lexExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &exprParser{tokens: tokens}
+	value, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	} else if next := parser.peek(); next.kind != tokenEOF {
+		return nil, parser.errorf(next, "unexpected %s", next)
+	} else if value.typ != exprBool {
+		return nil, fmt.Errorf("expression is a %s, not a bool",
+			value.typ)
+	}
+	return &expression{source: source, eval: value.boolean}, nil
+}
+
+// Kinds of expression tokens
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenInt
+	tokenString
+	tokenPunct
+)
+
+type exprToken struct {
+	kind int
+
+	// The identifier, punctuation, or decoded string literal
+	text  string
+	value int64
+
+	// Offset of the token in the expression
+	pos int
+}
+
+func (token exprToken) String() string {
+	switch token.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(token.text)
+	}
+	return "'" + token.text + "'"
+}
+
+// exprPunctuation lists the operators and delimiters of expressions, longest
+// first.
+var exprPunctuation = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">",
+	"!", ".", "(", ")", "[", "]", ","}
+
+// lexExpression splits source into tokens, ending with a tokenEOF.
+func lexExpression(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	for pos := 0; ; {
+		for pos < len(source) && strings.IndexByte(" \t\r\n",
+			source[pos]) >= 0 {
+			pos++
+		}
+		if pos == len(source) {
+			return append(tokens, exprToken{kind: tokenEOF, pos: pos}),
+				nil
+		}
+		token := exprToken{pos: pos}
+		c := source[pos]
+		switch {
+		case c == '_' || isLetter(c):
+			end := pos + 1
+			for end < len(source) && (source[end] == '_' ||
+				isLetter(source[end]) || isDigit(source[end])) {
+				end++
+			}
+			token.kind, token.text = tokenIdent, source[pos:end]
+			pos = end
+		case isDigit(c):
+			end := pos + 1
+			for end < len(source) && isDigit(source[end]) {
+				end++
+			}
+			value, err := strconv.ParseInt(source[pos:end], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integer at "+
+					"position %d: %s", pos+1, source[pos:end])
+			}
+			token.kind, token.text, token.value = tokenInt,
+				source[pos:end], value
+			pos = end
+		case c == '\'' || c == '"':
+			text, end, err := lexString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			token.kind, token.text = tokenString, text
+			pos = end
+		default:
+			for _, punct := range exprPunctuation {
+				if strings.HasPrefix(source[pos:], punct) {
+					token.kind, token.text = tokenPunct, punct
+					break
+				}
+			}
+			if token.kind != tokenPunct {
+				return nil, fmt.Errorf("unexpected character at "+
+					"position %d: %q", pos+1, c)
+			}
+			pos += len(token.text)
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func isLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// lexString decodes the string literal at start of source, returning its
+// value and the offset following it.
+func lexString(source string, start int) (string, int, error) {
+	quote := source[start]
+	var text strings.Builder
+	for pos := start + 1; pos < len(source); pos++ {
+		c := source[pos]
+		if c == quote {
+			return text.String(), pos + 1, nil
+		} else if c != '\\' {
+			text.WriteByte(c)
+			continue
+		} else if pos++; pos == len(source) {
+			break
+		}
+		switch source[pos] {
+		case '\\', '\'', '"':
+			text.WriteByte(source[pos])
+		case 'n':
+			text.WriteByte('\n')
+		case 't':
+			text.WriteByte('\t')
+		default:
+			return "", 0, fmt.Errorf("invalid escape at position %d: "+
+				"\\%c", pos, source[pos])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at position %d",
+		start+1)
+}
+
+// exprParser compiles tokens by recursive descent. From lowest to highest
+// precedence, expressions are made of ||, &&, a comparison (==, !=, <, <=,
+// >, >=, or in), !, and member selection, indexing, and method calls on
+// literals, parenthesized expressions, the request variable, and calls to
+// has() and size().
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+func (parser *exprParser) peek() exprToken {
+	return parser.tokens[parser.next]
+}
+
+// accept consumes the next token and returns true if it is the punctuation
+// or identifier text.
+func (parser *exprParser) accept(text string) bool {
+	next := parser.peek()
+	if (next.kind == tokenPunct || next.kind == tokenIdent) &&
+		next.text == text {
+		parser.next++
+		return true
+	}
+	return false
+}
+
+func (parser *exprParser) expect(punct string) error {
+	if next := parser.peek(); !parser.accept(punct) {
+		return parser.errorf(next, "expected '%s', not %s", punct, next)
+	}
+	return nil
+}
+
+func (parser *exprParser) errorf(token exprToken, format string,
+	args ...interface{}) error {
+	return fmt.Errorf("%s at position %d", fmt.Sprintf(format, args...),
+		token.pos+1)
+}
+
+func (parser *exprParser) parseOr() (*exprValue, error) {
+	left, err := parser.parseAnd()
+	for err == nil {
+		operator := parser.peek()
+		if !parser.accept("||") {
+			break
+		}
+		var right *exprValue
+		if right, err = parser.parseAnd(); err == nil {
+			left, err = parser.logical(operator, left, right)
+		}
+	}
+	return left, err
+}
+
+func (parser *exprParser) parseAnd() (*exprValue, error) {
+	left, err := parser.parseComparison()
+	for err == nil {
+		operator := parser.peek()
+		if !parser.accept("&&") {
+			break
+		}
+		var right *exprValue
+		if right, err = parser.parseComparison(); err == nil {
+			left, err = parser.logical(operator, left, right)
+		}
+	}
+	return left, err
+}
+
+// logical combines bool operands with && or ||, evaluating the right operand
+// only if the left doesn't decide the result.
+func (parser *exprParser) logical(operator exprToken,
+	left, right *exprValue) (*exprValue, error) {
+	if left.typ != exprBool || right.typ != exprBool {
+		return nil, parser.errorf(operator, "%s requires bool "+
+			"operands, not %s and %s", operator.text, left.typ,
+			right.typ)
+	}
+	leftEval, rightEval := left.boolean, right.boolean
+	if operator.text == "&&" {
+		return boolValue(func(req *http.Request) bool {
+			return leftEval(req) && rightEval(req)
+		}), nil
+	}
+	return boolValue(func(req *http.Request) bool {
+		return leftEval(req) || rightEval(req)
+	}), nil
+}
+
+func (parser *exprParser) parseComparison() (*exprValue, error) {
+	left, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	operator := parser.peek()
+	switch {
+	case operator.kind == tokenIdent && operator.text == "in":
+	case operator.kind != tokenPunct:
+		return left, nil
+	case operator.text == "==", operator.text == "!=", operator.text == "<",
+		operator.text == "<=", operator.text == ">",
+		operator.text == ">=":
+	default:
+		return left, nil
+	}
+	parser.next++
+	right, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	} else if operator.text == "in" {
+		return parser.membership(operator, left, right)
+	}
+	return parser.compare(operator, left, right)
+}
+
+// membership tests whether a string is an element of a list or a key of a
+// map.
+func (parser *exprParser) membership(operator exprToken,
+	left, right *exprValue) (*exprValue, error) {
+	if left.typ != exprString ||
+		(right.typ != exprList && right.typ != exprMap) {
+		return nil, parser.errorf(operator, "in requires a string and "+
+			"a list or map, not %s and %s", left.typ, right.typ)
+	}
+	element := left.str
+	if right.typ == exprMap {
+		key := right.key(left)
+		return boolValue(func(req *http.Request) bool {
+			_, ok := key(req)
+			return ok
+		}), nil
+	}
+	list := right.list
+	return boolValue(func(req *http.Request) bool {
+		value := element(req)
+		for _, candidate := range list {
+			if value == candidate {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// compare compares operands of the same type: any for == and !=, and ints or
+// strings for the others.
+func (parser *exprParser) compare(operator exprToken,
+	left, right *exprValue) (*exprValue, error) {
+	equality := operator.text == "==" || operator.text == "!="
+	if left.typ != right.typ || !(left.typ == exprInt ||
+		left.typ == exprString || (equality && left.typ == exprBool)) {
+		return nil, parser.errorf(operator, "%s can't compare %s and "+
+			"%s", operator.text, left.typ, right.typ)
+	}
+	op := operator.text
+	switch left.typ {
+	case exprBool:
+		leftEval, rightEval := left.boolean, right.boolean
+		return boolValue(func(req *http.Request) bool {
+			return (leftEval(req) == rightEval(req)) == (op == "==")
+		}), nil
+	case exprInt:
+		leftEval, rightEval := left.integer, right.integer
+		return boolValue(func(req *http.Request) bool {
+			l, r := leftEval(req), rightEval(req)
+			return ordered(op, l < r, l == r)
+		}), nil
+	}
+	leftEval, rightEval := left.str, right.str
+	return boolValue(func(req *http.Request) bool {
+		l, r := leftEval(req), rightEval(req)
+		return ordered(op, l < r, l == r)
+	}), nil
+}
+
+// ordered returns the result of the comparison op given whether its left
+// operand is less than, or equal to, its right.
+func ordered(op string, less, equal bool) bool {
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	case "<":
+		return less
+	case "<=":
+		return less || equal
+	case ">":
+		return !less && !equal
+	}
+	return !less
+}
+
+func (parser *exprParser) parseUnary() (*exprValue, error) {
+	operator := parser.peek()
+	if !parser.accept("!") {
+		return parser.parseMember()
+	}
+	operand, err := parser.parseUnary()
+	if err != nil {
+		return nil, err
+	} else if operand.typ != exprBool {
+		return nil, parser.errorf(operator, "! requires a bool, not %s",
+			operand.typ)
+	}
+	eval := operand.boolean
+	return boolValue(func(req *http.Request) bool { return !eval(req) }),
+		nil
+}
+
+// parseMember parses a primary expression followed by any number of field
+// selections, indexes, and method calls.
+func (parser *exprParser) parseMember() (*exprValue, error) {
+	value, err := parser.parsePrimary()
+	for err == nil {
+		operator := parser.peek()
+		if parser.accept("[") {
+			var key *exprValue
+			if key, err = parser.parseOr(); err == nil {
+				if err = parser.expect("]"); err == nil {
+					value, err = parser.index(operator, value,
+						key)
+				}
+			}
+		} else if parser.accept(".") {
+			name := parser.peek()
+			if name.kind != tokenIdent {
+				return nil, parser.errorf(name, "expected a field "+
+					"or method name, not %s", name)
+			}
+			parser.next++
+			if parser.accept("(") {
+				value, err = parser.method(name, value)
+			} else {
+				value, err = parser.field(name, value)
+			}
+		} else {
+			break
+		}
+	}
+	return value, err
+}
+
+// field selects an attribute of the request variable, or an entry of a map,
+// as if indexed by the field name.
+func (parser *exprParser) field(name exprToken,
+	value *exprValue) (*exprValue, error) {
+	if value.typ == exprMap {
+		text := name.text
+		return parser.index(name, value,
+			&exprValue{typ: exprString, literal: &text,
+				str: func(*http.Request) string { return text }})
+	} else if value.typ != exprRequest {
+		return nil, parser.errorf(name, "%s has no fields", value.typ)
+	}
+	attribute, ok := requestAttribute(name.text)
+	if !ok {
+		return nil, parser.errorf(name, "request has no field %s",
+			name.text)
+	}
+	return attribute, nil
+}
+
+// key returns a function that looks up the value of key in map, normalizing
+// it when it's compiled if it's a literal.
+func (value *exprValue) key(key *exprValue) func(
+	req *http.Request) (string, bool) {
+	lookup, normalize := value.lookup, value.normalize
+	if normalize == nil {
+		normalize = func(key string) string { return key }
+	}
+	if key.literal != nil {
+		name := normalize(*key.literal)
+		return func(req *http.Request) (string, bool) {
+			return lookup(req, name)
+		}
+	}
+	eval := key.str
+	return func(req *http.Request) (string, bool) {
+		return lookup(req, normalize(eval(req)))
+	}
+}
+
+// index looks up a string key in a map, whose absent entries are empty
+// strings.
+func (parser *exprParser) index(operator exprToken,
+	value, key *exprValue) (*exprValue, error) {
+	if value.typ != exprMap || key.typ != exprString {
+		return nil, parser.errorf(operator, "only maps may be indexed, "+
+			"by strings, not %s by %s", value.typ, key.typ)
+	}
+	lookup := value.key(key)
+	entry := stringValue(func(req *http.Request) string {
+		entry, _ := lookup(req)
+		return entry
+	})
+	entry.present = func(req *http.Request) bool {
+		_, ok := lookup(req)
+		return ok
+	}
+	return entry, nil
+}
+
+// method calls a string method: startsWith, endsWith, contains, or matches,
+// which take a string, or lowerAscii, which takes none. The pattern of
+// matches must be a literal, so that it's compiled only once.
+func (parser *exprParser) method(name exprToken,
+	value *exprValue) (*exprValue, error) {
+	args, err := parser.parseArguments()
+	if err != nil {
+		return nil, err
+	} else if value.typ != exprString {
+		return nil, parser.errorf(name, "%s has no method %s",
+			value.typ, name.text)
+	}
+	eval := value.str
+	if name.text == "lowerAscii" {
+		if len(args) != 0 {
+			return nil, parser.errorf(name, "lowerAscii takes no "+
+				"arguments")
+		}
+		return stringValue(func(req *http.Request) string {
+			return strings.Map(lowerASCII, eval(req))
+		}), nil
+	}
+	var test func(s, arg string) bool
+	switch name.text {
+	case "startsWith":
+		test = strings.HasPrefix
+	case "endsWith":
+		test = strings.HasSuffix
+	case "contains":
+		test = strings.Contains
+	case "matches":
+	default:
+		return nil, parser.errorf(name, "string has no method %s",
+			name.text)
+	}
+	if len(args) != 1 || args[0].typ != exprString {
+		return nil, parser.errorf(name, "%s takes a string", name.text)
+	}
+	if test != nil {
+		arg := args[0].str
+		return boolValue(func(req *http.Request) bool {
+			return test(eval(req), arg(req))
+		}), nil
+	} else if args[0].literal == nil {
+		return nil, parser.errorf(name, "the pattern of matches must "+
+			"be a string literal")
+	}
+	pattern, err := regexp.Compile(*args[0].literal)
+	if err != nil {
+		return nil, parser.errorf(name, "invalid pattern: %s", err)
+	}
+	return boolValue(func(req *http.Request) bool {
+		return pattern.MatchString(eval(req))
+	}), nil
+}
+
+// parseArguments parses a comma-separated list of arguments following an
+// opening parenthesis, up to the closing one.
+func (parser *exprParser) parseArguments() ([]*exprValue, error) {
+	var args []*exprValue
+	if parser.accept(")") {
+		return args, nil
+	}
+	for {
+		arg, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if !parser.accept(",") {
+			return args, parser.expect(")")
+		}
+	}
+}
+
+func (parser *exprParser) parsePrimary() (*exprValue, error) {
+	token := parser.peek()
+	if token.kind == tokenEOF {
+		return nil, parser.errorf(token, "unexpected %s", token)
+	}
+	parser.next++
+	switch token.kind {
+	case tokenInt:
+		value := token.value
+		return &exprValue{typ: exprInt,
+			integer: func(*http.Request) int64 { return value }}, nil
+	case tokenString:
+		text := token.text
+		return &exprValue{typ: exprString, literal: &text,
+			str: func(*http.Request) string { return text }}, nil
+	case tokenPunct:
+		if token.text == "(" {
+			value, err := parser.parseOr()
+			if err == nil {
+				err = parser.expect(")")
+			}
+			return value, err
+		} else if token.text == "[" {
+			return parser.parseList(token)
+		}
+	case tokenIdent:
+		switch token.text {
+		case "true", "false":
+			value := token.text == "true"
+			return boolValue(func(*http.Request) bool {
+				return value
+			}), nil
+		case "request":
+			return &exprValue{typ: exprRequest}, nil
+		case "has", "size":
+			if err := parser.expect("("); err != nil {
+				return nil, err
+			}
+			args, err := parser.parseArguments()
+			if err != nil {
+				return nil, err
+			} else if len(args) != 1 {
+				return nil, parser.errorf(token, "%s takes one "+
+					"argument", token.text)
+			} else if token.text == "has" {
+				return parser.has(token, args[0])
+			}
+			return parser.size(token, args[0])
+		}
+		return nil, parser.errorf(token, "undeclared reference to %s",
+			token.text)
+	}
+	return nil, parser.errorf(token, "unexpected %s", token)
+}
+
+// parseList parses a list literal, whose elements must be string literals,
+// following its opening bracket.
+func (parser *exprParser) parseList(open exprToken) (*exprValue, error) {
+	list := &exprValue{typ: exprList, list: []string{}}
+	args := []*exprValue{}
+	if !parser.accept("]") {
+		for {
+			element, err := parser.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, element)
+			if !parser.accept(",") {
+				if err = parser.expect("]"); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	for _, element := range args {
+		if element.literal == nil {
+			return nil, parser.errorf(open, "list elements must be "+
+				"string literals")
+		}
+		list.list = append(list.list, *element.literal)
+	}
+	return list, nil
+}
+
+// has tests whether a map entry is present, e.g.
+// has(request.cookies['_sess']) or has(request.query.page).
+func (parser *exprParser) has(token exprToken,
+	arg *exprValue) (*exprValue, error) {
+	if arg.present == nil {
+		return nil, parser.errorf(token, "has requires a map entry, "+
+			"e.g. has(request.headers['Authorization'])")
+	}
+	return boolValue(arg.present), nil
+}
+
+// size returns the number of characters in a string, or of elements in a
+// list.
+func (parser *exprParser) size(token exprToken,
+	arg *exprValue) (*exprValue, error) {
+	switch arg.typ {
+	case exprString:
+		eval := arg.str
+		return &exprValue{typ: exprInt, integer: func(
+			req *http.Request) int64 {
+			return int64(utf8.RuneCountInString(eval(req)))
+		}}, nil
+	case exprList:
+		length := int64(len(arg.list))
+		return &exprValue{typ: exprInt, integer: func(
+			*http.Request) int64 {
+			return length
+		}}, nil
+	}
+	return nil, parser.errorf(token, "size requires a string or list, "+
+		"not %s", arg.typ)
+}
+
+// lowerASCII returns the lowercase form of r if it's an ASCII letter, as the
+// lowerAscii method requires, else r.
+func lowerASCII(r rune) rune {
+	if 'A' <= r && r <= 'Z' {
+		return r + 'a' - 'A'
+	}
+	return r
+}
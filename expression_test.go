@@ -0,0 +1,151 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Match expressions", func() {
+	newRequest := func() *http.Request {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/api/./users?page=2&sort=")
+		req.Header.Set("X-Original-Host", "app.example.gov:443")
+		req.Header.Set("X-Api-Key", "key")
+		req.Header.Set("X-Real-IP", "192.0.2.1")
+		req.Header.Set("X-Name", "JOSÉ")
+		req.AddCookie(&http.Cookie{Name: "_sess", Value: "abc"})
+		return req
+	}
+
+	It("should evaluate expressions", func() {
+		for _, test := range []struct {
+			name, source string
+			expected     bool
+		}{
+			{"string method", "request.host.endsWith('.gov')", true},
+			{"map index", "has(request.cookies['_sess'])", true},
+			{"absent entry", "has(request.cookies['_other'])", false},
+			{"header names ignoring case",
+				"request.headers['x-api-key'] == 'key'", true},
+			{"field selection on a map",
+				`has(request.query.page) && request.query.page == "2"`,
+				true},
+			{"empty query parameter", "has(request.query.sort)", true},
+			{"absent entry value", "request.headers['X-Other'] == ''",
+				true},
+			{"path without query",
+				"request.path.startsWith('/api/') && " +
+					"!request.path.contains('?')", true},
+			{"normalized path",
+				"request.path == '/api/users' && " +
+					"request.uri.startsWith('/api/./')", true},
+			{"regular expression",
+				"request.path.matches('^/api/[a-z]+$')", true},
+			{"list membership",
+				"request.method in ['GET', 'HEAD']", true},
+			{"map membership", "'_sess' in request.cookies", true},
+			{"size", "size(request.client_ip) > 10", false},
+			{"precedence", "false && true || true", true},
+			{"parentheses", "false && (true || true)", false},
+			{"lowercase", "request.host.lowerAscii() == " +
+				"'app.example.gov'", true},
+			{"size in characters",
+				"size(request.headers['X-Name']) == 4", true},
+			{"lowercase ASCII only",
+				"request.headers['X-Name'].lowerAscii() == 'josÉ'",
+				true},
+		} {
+			compiled, err := compileExpression(test.source)
+			Expect(err).To(BeNil(), test.name)
+			Expect(compiled.matches(newRequest())).To(
+				Equal(test.expected), test.name)
+		}
+	})
+
+	It("should report errors in expressions", func() {
+		for _, test := range []struct{ name, source, expected string }{
+			{"non-bool", "request.host",
+				"expression is a string, not a bool"},
+			{"mismatched types", "request.host == 1",
+				"== can't compare string and int at position 14"},
+			{"unknown field", "request.body == ''",
+				"request has no field body at position 9"},
+			{"unknown reference", "user == 'x'",
+				"undeclared reference to user at position 1"},
+			{"unknown method", "request.host.startswith('a')",
+				"string has no method startswith at position 14"},
+			{"has without an entry", "has(request.host)",
+				"has requires a map entry, e.g. " +
+					"has(request.headers['Authorization']) at position 1"},
+			{"dynamic pattern",
+				"request.path.matches(request.host)",
+				"the pattern of matches must be a string literal at " +
+					"position 14"},
+			{"invalid pattern", "request.path.matches('(')",
+				"invalid pattern: error parsing regexp: missing " +
+					"closing ): `(` at position 14"},
+			{"unterminated string", "request.host == 'a",
+				"unterminated string at position 17"},
+			{"trailing tokens", "true true",
+				"unexpected 'true' at position 6"},
+			{"incomplete", "true &&",
+				"unexpected end of expression at position 8"},
+			{"bad character", "true & false",
+				"unexpected character at position 6: '&'"},
+		} {
+			_, err := compileExpression(test.source)
+			Expect(err).To(MatchError(test.expected), test.name)
+		}
+	})
+
+	It("should route requests by expression", func() {
+		var selected string
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				selected = req.URL.Path
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		defer upstream.Close()
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:             upstream.URL + "/gov",
+					CookieName:      "_sess",
+					MatchExpression: "request.host.endsWith('.gov')",
+				},
+				&AuthDelegateUpstream{
+					URL:        upstream.URL + "/other",
+					CookieName: "_sess",
+				},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+
+		handler.ServeHTTP(httptest.NewRecorder(), newRequest())
+		Expect(selected).To(Equal("/gov"))
+
+		req := newRequest()
+		req.Header.Set("X-Original-Host", "app.example.com")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		Expect(selected).To(Equal("/other"))
+	})
+
+	It("should report invalid expressions when validating", func() {
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:             "http://localhost:8081",
+					MatchExpression: "request.host",
+				},
+			},
+		}
+		Expect(opts.Validate()).To(MatchError("Invalid options:\n  " +
+			"invalid match_expression for http://localhost:8081: " +
+			"expression is a string, not a bool"))
+	})
+})
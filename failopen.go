@@ -0,0 +1,179 @@
+package authdelegate
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failOpenHeader is added to responses that allow a request because its
+// upstream is down and its path is covered by a fail-open policy.
+const failOpenHeader = "X-Auth-Fail-Open"
+
+// Policies of on_error, for when an upstream is unreachable or times out.
+const (
+	onErrorFailClosed = "fail_closed"
+	onErrorFailOpen   = "fail_open"
+)
+
+// failOpenPolicy allows requests for low-risk paths when their upstream has
+// been failing for longer than a grace period, as when following an incident
+// playbook by hand. Requests are still sent to the upstream, and are only
+// allowed if it fails, so that its recovery is detected and the policy
+// disengaged as soon as it responds.
+type failOpenPolicy struct {
+	upstream     string
+	after        time.Duration
+	pathPrefixes []string
+
+	mutex sync.Mutex
+
+	// Zero while the upstream is healthy
+	downSince time.Time
+	engaged   bool
+}
+
+// newFailOpenPolicy returns nil if upstream doesn't define a fail-open
+// policy.
+func newFailOpenPolicy(upstream *AuthDelegateUpstream) *failOpenPolicy {
+	config := upstream.FailOpen
+	if config == nil {
+		return nil
+	}
+	return &failOpenPolicy{
+		upstream:     upstreamLabel(upstream),
+		after:        config.after,
+		pathPrefixes: config.PathPrefixes,
+	}
+}
+
+func (policy *failOpenPolicy) failed(now time.Time) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if policy.downSince.IsZero() {
+		policy.downSince = now
+	}
+	if !policy.engaged && now.Sub(policy.downSince) >= policy.after {
+		policy.engaged = true
+		log.Printf("AUDIT fail-open engaged: upstream %s has failed "+
+			"since %s; allowing requests for %s", policy.upstream,
+			policy.downSince.Format(time.RFC3339),
+			strings.Join(policy.pathPrefixes, ", "))
+	}
+}
+
+func (policy *failOpenPolicy) succeeded(now time.Time) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	if policy.engaged {
+		log.Printf("AUDIT fail-open disengaged: upstream %s recovered "+
+			"after %s", policy.upstream,
+			now.Sub(policy.downSince).Round(time.Second))
+	}
+	policy.downSince = time.Time{}
+	policy.engaged = false
+}
+
+// inherit continues the state of previous, the policy of the same upstream in
+// the routing table being replaced, so that replacing the table neither
+// disengages the policy nor restarts the time the upstream has been down.
+func (policy *failOpenPolicy) inherit(previous *failOpenPolicy) {
+	if policy == nil || previous == nil {
+		return
+	}
+	previous.mutex.Lock()
+	downSince, engaged := previous.downSince, previous.engaged
+	previous.mutex.Unlock()
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	policy.downSince, policy.engaged = downSince, engaged
+}
+
+func (policy *failOpenPolicy) isEngaged() bool {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	return policy.engaged
+}
+
+// allows returns true if the policy is engaged and covers the normalized path
+// of req.
+func (policy *failOpenPolicy) allows(req *http.Request) bool {
+	if !policy.isEngaged() {
+		return false
+	}
+	path := requestPath(req)
+	for _, prefix := range policy.pathPrefixes {
+		if hasPathPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply makes proxy report its upstream's failures and successes to the
+// policy, and allow covered requests that fail while the policy is engaged.
+// An upstream fails if it can't be reached, times out, or returns a 5xx
+// status.
+func (policy *failOpenPolicy) apply(proxy *httputil.ReverseProxy) {
+	modifyResponse := proxy.ModifyResponse
+	proxy.ModifyResponse = func(res *http.Response) error {
+		if res.StatusCode >= http.StatusInternalServerError {
+			policy.failed(time.Now())
+			if policy.allows(res.Request) {
+				return &DelegateError{
+					Code:     ErrUpstreamUnavailable,
+					Upstream: policy.upstream,
+					Cause:    errUpstreamServerError,
+				}
+			}
+		} else {
+			policy.succeeded(time.Now())
+		}
+		return modifyResponse(res)
+	}
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request,
+		err error) {
+		var delegateErr *DelegateError
+		if !errors.As(err, &delegateErr) ||
+			delegateErr.Cause != errUpstreamServerError {
+			policy.failed(time.Now())
+		}
+		if !policy.allows(req) {
+			errorHandler(rw, req, err)
+			return
+		}
+		log.Printf("fail-open: allowed %s %s for upstream %s: %s",
+			req.Method, originalURI(req), policy.upstream, err)
+		rw.Header().Set(failOpenHeader, policy.upstream)
+		rw.WriteHeader(http.StatusOK)
+	}
+}
+
+// failOpenOnError makes proxy allow every request, with a 202 status, that
+// fails because upstream is unreachable or times out, as its on_error
+// policy of fail_open specifies. Requests it decides, including those it
+// refuses with a 5xx status, are unaffected.
+func failOpenOnError(proxy *httputil.ReverseProxy, upstream string) {
+	errorHandler := proxy.ErrorHandler
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request,
+		err error) {
+		var delegateErr *DelegateError
+		if errors.As(err, &delegateErr) {
+			errorHandler(rw, req, err)
+			return
+		}
+		log.Printf("fail-open: allowed %s %s for upstream %s: %s",
+			req.Method, originalURI(req), upstream, err)
+		rw.Header().Set(failOpenHeader, upstream)
+		rw.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// errUpstreamServerError replaces a 5xx upstream response that a
+// failOpenPolicy allows, so that it reaches the proxy's ErrorHandler.
+var errUpstreamServerError = errors.New("upstream returned a server error")
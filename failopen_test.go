@@ -0,0 +1,263 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Fail-open policies", func() {
+	var upstream *httptest.Server
+	var status int
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		status = http.StatusServiceUnavailable
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{{
+				Name: "sso",
+				URL:  upstream.URL,
+				FailOpen: &AuthDelegateFailOpen{
+					After:        "0s",
+					PathPrefixes: []string{"/assets/"},
+				},
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorize := func(handler http.Handler,
+		uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", uri)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should allow covered paths while the upstream fails", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		allowed := authorize(handler, "/assets/logo.png")
+		Expect(allowed.Code).To(Equal(http.StatusOK))
+		Expect(allowed.Header().Get("X-Auth-Fail-Open")).To(Equal("sso"))
+		Expect(authorize(handler, "/admin/").Code).
+			To(Equal(http.StatusServiceUnavailable))
+		Expect(authorize(handler, "/assets/../admin/").Code).
+			To(Equal(http.StatusServiceUnavailable))
+		Expect(authorize(handler, "/assets/%2e%2e/admin/").Code).
+			To(Equal(http.StatusServiceUnavailable))
+
+		status = http.StatusForbidden
+		Expect(authorize(handler, "/assets/logo.png").Code).
+			To(Equal(http.StatusForbidden))
+		status = http.StatusServiceUnavailable
+		Expect(authorize(handler, "/assets/logo.png").Code).
+			To(Equal(http.StatusOK))
+	})
+
+	It("should allow covered paths while the upstream is unreachable",
+		func() {
+			Expect(opts.Validate()).To(BeNil())
+			handler := NewAuthDelegate(opts)
+			upstream.Close()
+			Expect(authorize(handler, "/assets/logo.png").Code).
+				To(Equal(http.StatusOK))
+			Expect(authorize(handler, "/admin/").Code).
+				To(Equal(http.StatusBadGateway))
+		})
+
+	It("should not cache decisions allowed by the policy", func() {
+		opts.Upstreams[0].CookieName = "_session"
+		opts.Upstreams[0].CacheTTL = "1m"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/assets/logo.png")
+		req.AddCookie(&http.Cookie{Name: "_session", Value: "user"})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		status = http.StatusForbidden
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should not engage before the grace period", func() {
+		opts.Upstreams[0].FailOpen.After = "1h"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "/assets/logo.png").Code).
+			To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("should fail validation for an incomplete policy", func() {
+		opts.Upstreams[0].FailOpen = &AuthDelegateFailOpen{
+			PathPrefixes: []string{"assets"},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"fail_open after must be specified: " + upstream.URL,
+			"fail_open path prefix must begin with '/': assets",
+		})))
+	})
+
+	It("should allow every request while on_error is fail_open", func() {
+		opts.Upstreams[0].FailOpen = nil
+		opts.Upstreams[0].OnError = "fail_open"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "/admin/").Code).
+			To(Equal(http.StatusServiceUnavailable))
+
+		upstream.Close()
+		allowed := authorize(handler, "/admin/")
+		Expect(allowed.Code).To(Equal(http.StatusAccepted))
+		Expect(allowed.Header().Get("X-Auth-Fail-Open")).To(Equal("sso"))
+	})
+
+	It("should keep failing open once the circuit opens", func() {
+		opts.Upstreams[0].FailOpen = nil
+		opts.Upstreams[0].OnError = "fail_open"
+		opts.Upstreams[0].CircuitBreaker = &AuthDelegateCircuitBreaker{
+			ConsecutiveFailures: 2,
+			CoolDown:            "1h",
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		upstream.Close()
+		for i := 0; i != 3; i++ {
+			allowed := authorize(handler, "/admin/")
+			Expect(allowed.Code).To(Equal(http.StatusAccepted))
+			Expect(allowed.Header().Get("X-Auth-Fail-Open")).
+				To(Equal("sso"))
+		}
+		table := handler.(*authDelegateHandler).routes()
+		Expect(table.upstreams[0].breaker.allow(time.Now())).To(BeFalse())
+
+		opts.Upstreams[0].CircuitBreaker.Status =
+			http.StatusServiceUnavailable
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"on_error fail_open requires a 2xx circuit_breaker " +
+				"status: " + upstream.URL,
+		})))
+	})
+
+	It("should refuse requests while on_error is fail_closed", func() {
+		opts.Upstreams[0].FailOpen = nil
+		opts.Upstreams[0].OnError = "fail_closed"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		upstream.Close()
+		refused := authorize(handler, "/assets/logo.png")
+		Expect(refused.Code).To(Equal(http.StatusBadGateway))
+		Expect(refused.Header().Get("X-Auth-Fail-Open")).To(BeEmpty())
+	})
+
+	It("should refuse requests with the fail_closed_status", func() {
+		opts.Upstreams[0].FailOpen = nil
+		opts.Upstreams[0].FailClosedStatus =
+			http.StatusServiceUnavailable
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		status = http.StatusInternalServerError
+		Expect(authorize(handler, "/admin/").Code).
+			To(Equal(http.StatusInternalServerError))
+
+		upstream.Close()
+		Expect(authorize(handler, "/admin/").Code).
+			To(Equal(http.StatusServiceUnavailable))
+
+		opts.Upstreams[0].FailClosedStatus = http.StatusUnauthorized
+		Expect(opts.Validate()).To(BeNil())
+		Expect(authorize(NewAuthDelegate(opts), "/admin/").Code).
+			To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should refuse timed out requests with the fail_closed_status",
+		func() {
+			upstream.Close()
+			upstream = httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					time.Sleep(50 * time.Millisecond)
+				}))
+			opts.Upstreams[0].URL = upstream.URL
+			opts.Upstreams[0].FailOpen = nil
+			opts.Upstreams[0].Timeout = "10ms"
+			opts.Upstreams[0].FailClosedStatus =
+				http.StatusUnauthorized
+			Expect(opts.Validate()).To(BeNil())
+			Expect(authorize(NewAuthDelegate(opts), "/admin/").Code).
+				To(Equal(http.StatusUnauthorized))
+		})
+
+	It("should fail validation for an invalid fail_closed_status", func() {
+		opts.Upstreams[0].FailOpen = nil
+		opts.Upstreams[0].FailClosedStatus = http.StatusBadGateway
+		opts.Upstreams[0].CookieName = "_session"
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			URL:              "http://localhost:8082",
+			HeaderName:       "X-Other-Key",
+			OnError:          "fail_open",
+			FailClosedStatus: http.StatusServiceUnavailable,
+		})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"fail_closed_status must be 401 or 503 for " +
+				upstream.URL + ": 502",
+			"fail_closed_status requires on_error fail_closed: " +
+				"http://localhost:8082",
+		})))
+	})
+
+	It("should fail validation for an invalid on_error", func() {
+		opts.Upstreams[0].OnError = "fail_open"
+		opts.Upstreams[0].CookieName = "_session"
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			Name:        "tokens",
+			Type:        "static_tokens",
+			HeaderName:  "X-Api-Key",
+			TokenHashes: []string{hashCredential("token")},
+			OnError:     "fail_open",
+		}, &AuthDelegateUpstream{
+			URL:        "http://localhost:8082",
+			HeaderName: "X-Other-Key",
+			OnError:    "allow",
+		})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"fail_open is redundant with on_error fail_open: " +
+				upstream.URL,
+			"on_error fail_open requires an http or https url: " +
+				"static:tokens",
+			"invalid on_error for http://localhost:8082: allow",
+		})))
+	})
+
+	It("should warn about failing open for every path", func() {
+		opts.Upstreams[0].URL = "https://localhost"
+		opts.Upstreams[0].FailOpen.PathPrefixes = []string{"/"}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Lint()).To(Equal([]string{
+			"upstream sso fails open for every path; list only " +
+				"low-risk path prefixes",
+		}))
+	})
+})
@@ -0,0 +1,261 @@
+package authdelegate
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of an upstream's health_check options
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// replica is one of the URLs to which an upstream's requests may be sent.
+type replica struct {
+	url *url.URL
+
+	// URL of its health check, or nil if it has none
+	healthURL *url.URL
+
+	// Accessed atomically; 1 if the replica is considered healthy
+	healthy int32
+
+	// Accessed atomically; requests sent to the replica whose responses
+	// have not yet been completed
+	inFlight int64
+
+	// Consecutive results of its latest health checks; accessed only by
+	// the health checker
+	successes int
+	failures  int
+}
+
+func (replica *replica) isHealthy() bool {
+	return atomic.LoadInt32(&replica.healthy) == 1
+}
+
+// replicaSet chooses the URL of an upstream to which to send each request:
+// one of its url and replica_urls, chosen by its load_balancing strategy, or
+// if health checks find those down, the first healthy one of its
+// failover_urls.
+type replicaSet struct {
+	// The url, replica_urls, and failover_urls of the upstream, in order
+	replicas []*replica
+
+	// Number of leading replicas among which requests are balanced
+	balanced int
+	strategy string
+
+	// Accessed atomically; incremented for every request balanced
+	next uint64
+
+	// Checks the health of the replicas while the routing table that uses
+	// the set is in effect; nil if the upstream has no health_check
+	checker *healthChecker
+}
+
+// newReplicaSet creates the replicas of upstream, and a checker of their
+// health if it has a health_check, which checks them once started.
+func newReplicaSet(upstream *AuthDelegateUpstream) *replicaSet {
+	set := &replicaSet{
+		balanced: 1 + len(upstream.parsedReplicaURLs),
+		strategy: upstream.LoadBalancing,
+	}
+	targets := append([]*url.URL{upstream.parsedURL},
+		upstream.parsedReplicaURLs...)
+	for _, target := range append(targets, upstream.parsedFailoverURLs...) {
+		set.replicas = append(set.replicas, &replica{
+			url:     target,
+			healthy: 1,
+		})
+	}
+	config := upstream.HealthCheck
+	if config == nil {
+		return set
+	}
+	for _, replica := range set.replicas {
+		replica.healthURL = &url.URL{
+			Scheme: replica.url.Scheme,
+			Host:   replica.url.Host,
+			Path:   config.Path,
+		}
+	}
+	set.checker = &healthChecker{
+		upstream: upstreamLabel(upstream),
+		replicas: set.replicas,
+		client: &http.Client{
+			Transport: newUpstreamTransport(upstream),
+			Timeout:   config.timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		interval: config.interval,
+		rise:     config.HealthyThreshold,
+		fall:     config.UnhealthyThreshold,
+	}
+	return set
+}
+
+// inherit marks each replica of set that has a health check healthy or not as
+// the replica of previous, the set of the same upstream in the routing table
+// being replaced, with the same URL is, so that requests aren't sent to
+// replicas known to be down until their checks catch up.
+func (set *replicaSet) inherit(previous *replicaSet) {
+	if set == nil || previous == nil {
+		return
+	}
+	for _, replica := range set.replicas {
+		if replica.healthURL == nil {
+			continue
+		}
+		for _, old := range previous.replicas {
+			if old.url.String() == replica.url.String() {
+				atomic.StoreInt32(&replica.healthy,
+					atomic.LoadInt32(&old.healthy))
+				break
+			}
+		}
+	}
+}
+
+// target returns the URL of a healthy balanced replica, chosen by the
+// load-balancing strategy, else of the first healthy failover replica, else of
+// the first replica, since it may recover before a health check notices.
+func (set *replicaSet) target() *url.URL {
+	if replica := set.balance(); replica != nil {
+		return replica.url
+	}
+	for _, replica := range set.replicas[set.balanced:] {
+		if replica.isHealthy() {
+			return replica.url
+		}
+	}
+	return set.replicas[0].url
+}
+
+// find returns the replica whose URL is target, as returned by set.target, or
+// nil if there is none.
+func (set *replicaSet) find(target *url.URL) *replica {
+	for _, replica := range set.replicas {
+		if replica.url == target {
+			return replica
+		}
+	}
+	return nil
+}
+
+// healthChecker periodically requests the health check URL of each replica of
+// an upstream, marking a replica unhealthy after fall consecutive failures
+// and healthy again after rise consecutive successes. A nil *healthChecker
+// does nothing.
+type healthChecker struct {
+	upstream string
+	replicas []*replica
+	client   *http.Client
+	interval time.Duration
+	rise     int
+	fall     int
+
+	// Guards stop, which is closed to stop the checks in progress, if any
+	mutex sync.Mutex
+	stop  chan struct{}
+}
+
+// start begins checking the replicas, unless the checker already is.
+func (checker *healthChecker) start() {
+	if checker == nil {
+		return
+	}
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.stop == nil {
+		checker.stop = make(chan struct{})
+		go checker.run(checker.stop)
+	}
+}
+
+// halt stops checking the replicas, which keep their latest health, until
+// start is called again.
+func (checker *healthChecker) halt() {
+	if checker == nil {
+		return
+	}
+	checker.mutex.Lock()
+	defer checker.mutex.Unlock()
+	if checker.stop != nil {
+		close(checker.stop)
+		checker.stop = nil
+	}
+}
+
+func (checker *healthChecker) run(stop chan struct{}) {
+	ticker := time.NewTicker(checker.interval)
+	defer ticker.Stop()
+	defer checker.client.CloseIdleConnections()
+	for {
+		checker.checkAll()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkAll checks every replica concurrently, and returns once they have all
+// been checked.
+func (checker *healthChecker) checkAll() {
+	var wg sync.WaitGroup
+	for _, target := range checker.replicas {
+		wg.Add(1)
+		go func(target *replica) {
+			defer wg.Done()
+			checker.record(target, checker.check(target))
+		}(target)
+	}
+	wg.Wait()
+}
+
+// check returns true if the health check URL of replica responds with a 2xx
+// or 3xx status.
+func (checker *healthChecker) check(replica *replica) bool {
+	req, err := http.NewRequest("GET", replica.healthURL.String(), nil)
+	if err != nil {
+		return false
+	}
+	res, err := checker.client.Do(req)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode/100 == 2 || res.StatusCode/100 == 3
+}
+
+// record updates the health of replica with the result of a check.
+func (checker *healthChecker) record(replica *replica, ok bool) {
+	if ok {
+		replica.failures = 0
+		replica.successes++
+		if !replica.isHealthy() && replica.successes >= checker.rise {
+			atomic.StoreInt32(&replica.healthy, 1)
+			log.Printf("upstream %s: %s is healthy", checker.upstream,
+				replica.url)
+		}
+		return
+	}
+	replica.successes = 0
+	replica.failures++
+	if replica.isHealthy() && replica.failures >= checker.fall {
+		atomic.StoreInt32(&replica.healthy, 0)
+		log.Printf("upstream %s: %s is unhealthy", checker.upstream,
+			replica.url)
+	}
+}
@@ -0,0 +1,161 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Upstream failover", func() {
+	var primary, backup *httptest.Server
+	var primaryDown, backupChecks int32
+	var opts *AuthDelegateOptions
+
+	newReplica := func(name string, down *int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if name == "backup" && req.URL.Path == "/ping" {
+					atomic.AddInt32(&backupChecks, 1)
+				}
+				if down != nil && atomic.LoadInt32(down) == 1 {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				rw.Header().Set("X-Replica", name)
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+	}
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&primaryDown, 0)
+		atomic.StoreInt32(&backupChecks, 0)
+		primary = newReplica("primary", &primaryDown)
+		backup = newReplica("backup", nil)
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:          primary.URL + "/auth",
+					FailoverURLs: []string{backup.URL + "/auth"},
+					HealthCheck: &AuthDelegateHealthCheck{
+						Path:               "/ping",
+						Interval:           "10ms",
+						HealthyThreshold:   1,
+						UnhealthyThreshold: 1,
+					},
+				},
+			},
+			MetricsPath: "/metrics",
+		}
+	})
+
+	AfterEach(func() {
+		primary.Close()
+		backup.Close()
+	})
+
+	It("should fail over to a healthy replica and back", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		replica := func() string {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder.Header().Get("X-Replica")
+		}
+		Expect(replica()).To(Equal("primary"))
+
+		atomic.StoreInt32(&primaryDown, 1)
+		Eventually(replica).Should(Equal("backup"))
+
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Body.String()).To(ContainSubstring(
+			`authdelegate_upstream_replica_healthy{upstream="` +
+				primary.URL + `/auth",url="` + primary.URL +
+				`/auth"} 0`))
+
+		atomic.StoreInt32(&primaryDown, 0)
+		Eventually(replica).Should(Equal("primary"))
+	})
+
+	It("should check health only while its routes are in effect", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		checks := func() int32 { return atomic.LoadInt32(&backupChecks) }
+		Eventually(checks).Should(BeNumerically(">", 1))
+
+		untracked := *opts.Upstreams[0]
+		untracked.FailoverURLs = nil
+		untracked.HealthCheck = nil
+		unchecked := *opts
+		unchecked.Upstreams = []*AuthDelegateUpstream{&untracked}
+		Expect(unchecked.Validate()).To(BeNil())
+		previous := handler.swapRoutes(newRoutingTable(&unchecked))
+		time.Sleep(20 * time.Millisecond)
+		stopped := checks()
+		Consistently(checks, "50ms").Should(Equal(stopped))
+
+		handler.swapRoutes(previous)
+		Eventually(checks).Should(BeNumerically(">", stopped))
+	})
+
+	It("should keep the health of replicas with the same URL", func() {
+		Expect(opts.Validate()).To(BeNil())
+		previous := newReplicaSet(opts.Upstreams[0])
+		atomic.StoreInt32(&previous.replicas[0].healthy, 0)
+
+		opts.Upstreams[0].ReplicaURLs = []string{backup.URL + "/other"}
+		Expect(opts.Validate()).To(BeNil())
+		set := newReplicaSet(opts.Upstreams[0])
+		set.inherit(previous)
+		Expect(set.replicas[0].isHealthy()).To(BeFalse())
+		Expect(set.replicas[1].isHealthy()).To(BeTrue())
+		Expect(set.replicas[2].isHealthy()).To(BeTrue())
+	})
+
+	It("should apply defaults to the health check", func() {
+		opts.Upstreams[0].HealthCheck = &AuthDelegateHealthCheck{
+			Path: "/ping",
+		}
+		Expect(opts.Validate()).To(BeNil())
+		config := opts.Upstreams[0].HealthCheck
+		Expect(config.interval).To(Equal(defaultHealthCheckInterval))
+		Expect(config.timeout).To(Equal(defaultHealthCheckTimeout))
+		Expect(config.HealthyThreshold).To(Equal(2))
+		Expect(config.UnhealthyThreshold).To(Equal(3))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		url := opts.Upstreams[0].URL
+		opts.Upstreams[0].CookieName = "_session"
+		opts.Upstreams[0].FailoverURLs = []string{
+			strings.Replace(backup.URL, "http:", "https:", 1),
+		}
+		opts.Upstreams[0].HealthCheck = &AuthDelegateHealthCheck{
+			Path:             "ping",
+			Interval:         "often",
+			HealthyThreshold: -1,
+		}
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			URL:          backup.URL,
+			HeaderName:   "X-Api-Key",
+			FailoverURLs: []string{primary.URL},
+		})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"failover_urls must be http URLs like url: " + url + ": " +
+				strings.Replace(backup.URL, "http:", "https:", 1),
+			"health_check path must begin with /: " + url,
+			"invalid health_check interval for " + url + ": often",
+			"health_check thresholds must be positive: " + url,
+			"failover_urls requires health_check: " + backup.URL,
+		})))
+	})
+})
@@ -0,0 +1,96 @@
+package authdelegate
+
+import (
+	"context"
+	"net/http"
+)
+
+// Headers from which Traefik's ForwardAuth middleware reports the original
+// request, used if forward_auth doesn't name others
+const (
+	defaultForwardedURIHeader    = "X-Forwarded-Uri"
+	defaultForwardedHostHeader   = "X-Forwarded-Host"
+	defaultForwardedMethodHeader = "X-Forwarded-Method"
+)
+
+// originalMethodContextKey holds the method of the original request, if it
+// was reported by a ForwardAuth header rather than being the method of the
+// request itself.
+type originalMethodContextKey struct{}
+
+// forwardAuthHeaders translates the headers with which a ForwardAuth proxy
+// such as Traefik reports the original request into the X-Original-URI and
+// X-Original-Host headers that nginx sends, so that requests from either are
+// routed, cached, and forwarded alike. A nil *forwardAuthHeaders translates
+// nothing.
+type forwardAuthHeaders struct {
+	uri    string
+	host   string
+	method string
+}
+
+func newForwardAuthHeaders(opts *AuthDelegateOptions) *forwardAuthHeaders {
+	config := opts.ForwardAuth
+	if config == nil {
+		return nil
+	}
+	headers := &forwardAuthHeaders{
+		uri:    defaultForwardedURIHeader,
+		host:   defaultForwardedHostHeader,
+		method: defaultForwardedMethodHeader,
+	}
+	if config.URIHeader != "" {
+		headers.uri = http.CanonicalHeaderKey(config.URIHeader)
+	}
+	if config.HostHeader != "" {
+		headers.host = http.CanonicalHeaderKey(config.HostHeader)
+	}
+	if config.MethodHeader != "" {
+		headers.method = http.CanonicalHeaderKey(config.MethodHeader)
+	}
+	return headers
+}
+
+// translate replaces the X-Original-URI and X-Original-Host headers of req
+// with the values of the ForwardAuth headers, if present, and returns req
+// with the original method recorded in its context. The nginx headers are
+// replaced rather than preferred, since a ForwardAuth proxy passes through
+// any that the client sends.
+func (headers *forwardAuthHeaders) translate(req *http.Request) *http.Request {
+	if headers == nil {
+		return req
+	}
+	if uri := req.Header.Get(headers.uri); uri != "" {
+		req.Header.Set("X-Original-URI", uri)
+	}
+	if host := req.Header.Get(headers.host); host != "" {
+		req.Header.Set("X-Original-Host", host)
+	}
+	if method := req.Header.Get(headers.method); method != "" {
+		req = req.WithContext(context.WithValue(req.Context(),
+			originalMethodContextKey{}, method))
+	}
+	return req
+}
+
+// originalMethod returns the method of the request being authorized: that
+// reported by a ForwardAuth proxy, if any, else the method of req, which
+// nginx's auth_request copies from the original request.
+func originalMethod(req *http.Request) string {
+	if method, ok := req.Context().Value(
+		originalMethodContextKey{}).(string); ok {
+		return method
+	}
+	return req.Method
+}
+
+// keepAuthResponseHeaders removes from a successful upstream response every
+// header but names and framingResponseHeaders, so that a ForwardAuth proxy
+// copies only the agreed headers to the request it forwards. Unsuccessful
+// responses are passed through unchanged, so that redirects to a login page
+// and their cookies reach the client.
+func keepAuthResponseHeaders(res *http.Response, names []string) {
+	if res.StatusCode/100 == 2 {
+		keepResponseHeaders(res, names)
+	}
+}
@@ -0,0 +1,128 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("ForwardAuth compatibility", func() {
+	var upstream *httptest.Server
+	var status int
+	var originalURI string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		status = http.StatusOK
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				originalURI = req.Header.Get("X-Original-URI")
+				rw.Header().Set("X-Auth-User", "user@example.gov")
+				rw.Header().Set("X-Auth-Groups", "admins")
+				rw.Header().Set("Set-Cookie", "_session=refreshed")
+				rw.WriteHeader(status)
+			}))
+		opts = &AuthDelegateOptions{
+			Port:        8080,
+			ForwardAuth: &AuthDelegateForwardAuth{},
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        upstream.URL,
+					Host:       "app.example.gov",
+					PathPrefix: "/api",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorize := func(header http.Header) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should route by the X-Forwarded headers", func() {
+		recorder := authorize(http.Header{
+			"X-Forwarded-Host":   {"app.example.gov"},
+			"X-Forwarded-Uri":    {"/api/users?page=2"},
+			"X-Forwarded-Method": {"POST"},
+			"X-Original-Uri":     {"/spoofed"},
+		})
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(originalURI).To(Equal("/api/users?page=2"))
+
+		recorder = authorize(http.Header{
+			"X-Forwarded-Host": {"app.example.gov"},
+			"X-Forwarded-Uri":  {"/public"},
+		})
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should read the headers named in the configuration", func() {
+		opts.ForwardAuth = &AuthDelegateForwardAuth{
+			URIHeader:  "X-Auth-Uri",
+			HostHeader: "X-Auth-Host",
+		}
+		recorder := authorize(http.Header{
+			"X-Auth-Host": {"app.example.gov"},
+			"X-Auth-Uri":  {"/api"},
+		})
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(originalURI).To(Equal("/api"))
+	})
+
+	It("should report the forwarded method as the original method", func() {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Forwarded-Method", "DELETE")
+		Expect(originalMethod(req)).To(Equal("GET"))
+		Expect(opts.Validate()).To(BeNil())
+		req = newForwardAuthHeaders(opts).translate(req)
+		Expect(originalMethod(req)).To(Equal("DELETE"))
+	})
+
+	It("should return only the agreed headers on success", func() {
+		opts.Upstreams[0].AuthResponseHeaders = []string{"x-auth-user"}
+		header := http.Header{
+			"X-Forwarded-Host": {"app.example.gov"},
+			"X-Forwarded-Uri":  {"/api"},
+		}
+		recorder := authorize(header)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("X-Auth-User")).To(
+			Equal("user@example.gov"))
+		Expect(recorder.Header()).ToNot(HaveKey("X-Auth-Groups"))
+		Expect(recorder.Header()).ToNot(HaveKey("Set-Cookie"))
+
+		status = http.StatusUnauthorized
+		recorder = authorize(header)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Header().Get("Set-Cookie")).To(
+			Equal("_session=refreshed"))
+	})
+
+	It("should fail validation for conflicting headers", func() {
+		opts.ForwardAuth.HostHeader = "x-forwarded-uri"
+		opts.Upstreams[0].AuthResponseHeaders = []string{
+			"X-Auth-User", "x-auth-user", "",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"empty auth_response_headers name: " + upstream.URL,
+			"repeated auth_response_headers for " + upstream.URL +
+				": X-Auth-User",
+			"forward_auth uri_header, host_header, and method_header " +
+				"must be different",
+		})))
+	})
+})
@@ -0,0 +1,193 @@
+package authdelegate
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// limitResponseHeaders drops header lines from res beyond maxCount lines or
+// maxBytes total bytes, as they would appear on the wire. A limit of zero is
+// ignored. The first value of every header is kept in preference to repeated
+// values, so that a flood of one header (e.g. Set-Cookie) doesn't crowd out
+// the others.
+func limitResponseHeaders(res *http.Response, maxCount, maxBytes int) {
+	var keys []string
+	total := 0
+	for key, values := range res.Header {
+		keys = append(keys, key)
+		total += len(values)
+	}
+	sort.Strings(keys)
+
+	limited := make(http.Header, len(keys))
+	count, size := 0, 0
+	for pass := 0; ; pass++ {
+		added := false
+		for _, key := range keys {
+			values := res.Header[key]
+			if pass >= len(values) {
+				continue
+			}
+			added = true
+			lineSize := len(key) + len(values[pass]) + len(": \r\n")
+			if (maxCount > 0 && count+1 > maxCount) ||
+				(maxBytes > 0 && size+lineSize > maxBytes) {
+				continue
+			}
+			limited[key] = append(limited[key], values[pass])
+			count++
+			size += lineSize
+		}
+		if !added {
+			break
+		}
+	}
+
+	if dropped := total - count; dropped != 0 {
+		source := "upstream"
+		if res.Request != nil {
+			source = res.Request.URL.String()
+		}
+		log.Printf("dropped %d of %d response headers from %s",
+			dropped, total, source)
+		res.Header = limited
+	}
+}
+
+// framingResponseHeaders are kept by keepResponseHeaders, since they describe
+// the response itself rather than the user.
+var framingResponseHeaders = []string{
+	"Content-Length", "Content-Type", cacheTTLHeader,
+}
+
+// keepResponseHeaders removes every header from res but names and
+// framingResponseHeaders.
+func keepResponseHeaders(res *http.Response, names []string) {
+	kept := make(http.Header, len(names)+len(framingResponseHeaders))
+	for _, list := range [][]string{names, framingResponseHeaders} {
+		for _, name := range list {
+			name = http.CanonicalHeaderKey(name)
+			if values, ok := res.Header[name]; ok {
+				kept[name] = values
+			}
+		}
+	}
+	res.Header = kept
+}
+
+// annotationWriter adds an upstream's accept_headers to the responses that
+// allow a request, and its deny_headers to all others, replacing any headers
+// of the same names.
+type annotationWriter struct {
+	http.ResponseWriter
+	accept map[string]string
+	deny   map[string]string
+}
+
+// newAnnotationWriter returns rw unchanged if accept and deny are empty.
+func newAnnotationWriter(rw http.ResponseWriter,
+	accept, deny map[string]string) http.ResponseWriter {
+	if len(accept) == 0 && len(deny) == 0 {
+		return rw
+	}
+	return &annotationWriter{rw, accept, deny}
+}
+
+func (writer *annotationWriter) WriteHeader(status int) {
+	annotations := writer.deny
+	if status/100 == 2 {
+		annotations = writer.accept
+	}
+	header := writer.Header()
+	for name, value := range annotations {
+		header.Set(name, value)
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// headerPattern is a regular expression that the value of a header must
+// match for an upstream to accept a request.
+type headerPattern struct {
+	name    string
+	pattern *regexp.Regexp
+}
+
+// unmatchedHeader returns the first of patterns whose header is absent from
+// req or doesn't match, or nil if they all match.
+func unmatchedHeader(patterns []headerPattern,
+	req *http.Request) *headerPattern {
+	for i := range patterns {
+		value, ok := headerValue(req.Header, patterns[i].name)
+		if !ok || !patterns[i].pattern.MatchString(value) {
+			return &patterns[i]
+		}
+	}
+	return nil
+}
+
+// describeHeaderPatterns describes the headers that patterns require, for
+// explain.
+func describeHeaderPatterns(patterns []headerPattern) string {
+	var descriptions []string
+	for _, header := range patterns {
+		descriptions = append(descriptions, "header "+header.name+
+			" matching "+header.pattern.String())
+	}
+	return strings.Join(descriptions, " and ")
+}
+
+// headerPatternsCover returns true if every header value later accepts is
+// one that earlier accepts: if each header that earlier requires to match a
+// pattern must match the same pattern for later.
+func headerPatternsCover(earlier, later *AuthDelegateUpstream) bool {
+	for name, pattern := range earlier.HeaderValueRegex {
+		if laterPattern, ok := headerPatternFor(later,
+			name); !ok || laterPattern != pattern {
+			return false
+		}
+	}
+	return true
+}
+
+// headerPatternFor returns the pattern upstream requires of the header name,
+// ignoring the case of names, and whether there is one.
+func headerPatternFor(upstream *AuthDelegateUpstream,
+	name string) (string, bool) {
+	for other, pattern := range upstream.HeaderValueRegex {
+		if strings.EqualFold(name, other) {
+			return pattern, true
+		}
+	}
+	return "", false
+}
+
+func validateHeaderValueRegex(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	var names []string
+	for name := range upstream.HeaderValueRegex {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	upstream.headerValueRegex = nil
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name,
+			" \t\r\n:()<>@,;\\\"/[]?={}") {
+			msgs = append(msgs, "invalid header_value_regex name "+
+				"for "+upstream.URL+": "+name)
+			continue
+		}
+		pattern, err := regexp.Compile(upstream.HeaderValueRegex[name])
+		if err != nil {
+			msgs = append(msgs, "invalid header_value_regex "+
+				"pattern for "+upstream.URL+": "+name+": "+
+				err.Error())
+			continue
+		}
+		upstream.headerValueRegex = append(upstream.headerValueRegex,
+			headerPattern{http.CanonicalHeaderKey(name), pattern})
+	}
+	return msgs
+}
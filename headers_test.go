@@ -0,0 +1,334 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+)
+
+var _ = Describe("Upstream response header limits", func() {
+	var res *http.Response
+
+	BeforeEach(func() {
+		res = &http.Response{Header: http.Header{
+			"X-Forwarded-User": []string{"mbland"},
+			"Set-Cookie":       []string{"a=1", "b=2", "c=3"},
+		}}
+	})
+
+	It("should pass all headers when within limits", func() {
+		expected := res.Header
+		limitResponseHeaders(res, 4, 1024)
+		Expect(res.Header).To(Equal(expected))
+	})
+
+	It("should keep the first value of each header first", func() {
+		limitResponseHeaders(res, 2, 0)
+		Expect(res.Header).To(Equal(http.Header{
+			"X-Forwarded-User": []string{"mbland"},
+			"Set-Cookie":       []string{"a=1"},
+		}))
+	})
+
+	It("should drop headers beyond the byte limit", func() {
+		// "Set-Cookie: a=1\r\n" is 17 bytes; "X-Forwarded-User:
+		// mbland\r\n" is 26.
+		limitResponseHeaders(res, 0, 17+26+17)
+		Expect(res.Header).To(Equal(http.Header{
+			"X-Forwarded-User": []string{"mbland"},
+			"Set-Cookie":       []string{"a=1", "b=2"},
+		}))
+	})
+
+	It("should limit headers proxied from an upstream", func() {
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			for i := 0; i != 100; i++ {
+				rw.Header().Add("Set-Cookie",
+					"cookie"+strconv.Itoa(i)+"=foobar")
+			}
+			rw.WriteHeader(http.StatusAccepted)
+		}
+		server := httptest.NewServer(http.HandlerFunc(handler))
+		defer server.Close()
+		opts := &AuthDelegateOptions{
+			Port:               8080,
+			MaxResponseHeaders: 10,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: server.URL},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		numHeaders := 0
+		for _, values := range recorder.HeaderMap {
+			numHeaders += len(values)
+		}
+		Expect(numHeaders).To(Equal(10))
+	})
+
+	It("should fail validation if limits are negative", func() {
+		opts := &AuthDelegateOptions{
+			Port:                   8080,
+			MaxResponseHeaders:     -1,
+			MaxResponseHeaderBytes: -1,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://foo.com/"},
+			},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"max_response_headers must not be negative",
+			"max_response_header_bytes must not be negative",
+		})))
+	})
+})
+
+var _ = Describe("Passing selected upstream response headers", func() {
+	var server *httptest.Server
+	var status int
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		status = http.StatusAccepted
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Auth-Request-User", "mbland")
+				rw.Header().Set("X-Auth-Request-Email",
+					"mbland@example.gov")
+				rw.Header().Set("X-Internal-Session", "secret")
+				rw.Header().Set("Content-Type", "text/plain")
+				rw.WriteHeader(status)
+				rw.Write([]byte("ok"))
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL: server.URL,
+					PassResponseHeaders: []string{
+						"x-auth-request-user",
+						"X-Auth-Request-Email",
+					},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should return only the listed headers", func() {
+		for _, code := range []int{http.StatusAccepted,
+			http.StatusUnauthorized} {
+			status = code
+			recorder := serve()
+			Expect(recorder.Code).To(Equal(code))
+			Expect(recorder.Header()).To(Equal(http.Header{
+				"X-Auth-Request-User":  []string{"mbland"},
+				"X-Auth-Request-Email": []string{"mbland@example.gov"},
+				"Content-Type":         []string{"text/plain"},
+				"Content-Length":       []string{"2"},
+			}))
+			Expect(recorder.Body.String()).To(Equal("ok"))
+		}
+	})
+
+	It("should return every header if none are listed", func() {
+		opts.Upstreams[0].PassResponseHeaders = nil
+		Expect(serve().Header().Get("X-Internal-Session")).To(
+			Equal("secret"))
+	})
+
+	It("should fail validation if a header is repeated", func() {
+		opts.Upstreams[0].PassResponseHeaders = append(
+			opts.Upstreams[0].PassResponseHeaders, "X-Auth-Request-User")
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"repeated pass_response_headers for " + server.URL +
+				": X-Auth-Request-User",
+		})))
+	})
+})
+
+var _ = Describe("Response annotation headers", func() {
+	var server *httptest.Server
+	var status int
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		status = http.StatusAccepted
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("X-Auth-Source", "upstream")
+				rw.WriteHeader(status)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        server.URL,
+					HeaderName: "X-Api-Key",
+					AcceptHeaders: map[string]string{
+						"x-auth-source":    "sso",
+						"X-Policy-Version": "3",
+					},
+					DenyHeaders: map[string]string{
+						"X-Auth-Source": "sso-denied",
+					},
+					CacheTTL: "1m",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should add the headers for accepted and denied requests", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		serve := func() http.Header {
+			req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+			req.Header.Set("X-Api-Key", "key")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder.Header()
+		}
+		header := serve()
+		Expect(header["X-Auth-Source"]).To(Equal([]string{"sso"}))
+		Expect(header.Get("X-Policy-Version")).To(Equal("3"))
+
+		header = serve()
+		Expect(header["X-Auth-Source"]).To(Equal([]string{"sso"}))
+
+		status = http.StatusForbidden
+		handler = NewAuthDelegate(opts)
+		header = serve()
+		Expect(header["X-Auth-Source"]).To(
+			Equal([]string{"sso-denied"}))
+		Expect(header.Get("X-Policy-Version")).To(BeEmpty())
+	})
+
+	It("should fail validation for invalid headers", func() {
+		opts.Upstreams[0].AcceptHeaders = map[string]string{
+			"X-Auth Source":  "sso",
+			"X-Policy":       "3\r\nSet-Cookie: x",
+			"content-length": "0",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid accept_headers name for " + server.URL +
+				": X-Auth Source",
+			"invalid accept_headers value for " + server.URL +
+				": X-Policy",
+			"accept_headers must not set Content-Length: " +
+				server.URL,
+		})))
+	})
+})
+
+var _ = Describe("Header value matching", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "tokens-v2",
+					URL:        "http://localhost:8081",
+					HeaderName: "Authorization",
+					HeaderValueRegex: map[string]string{
+						"x-api-version": `^2\.`,
+					},
+				},
+				&AuthDelegateUpstream{
+					Name:       "tokens",
+					URL:        "http://localhost:8082",
+					HeaderName: "Authorization",
+				},
+			},
+		}
+	})
+
+	selected := func(version string) string {
+		Expect(opts.Validate()).To(BeNil())
+		table := newRoutingTable(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("Authorization", "Bearer token")
+		if version != "" {
+			req.Header.Set("X-Api-Version", version)
+		}
+		trace := &requestTrace{recordMatches: true}
+		if upstream := table.selectUpstream(req, trace); upstream != nil {
+			return upstream.name + ": " + trace.matches[0].String()
+		}
+		return ""
+	}
+
+	It("should route requests by the values of headers", func() {
+		const v2 = "tokens-v2: name=tokens-v2; result=match; " +
+			"reason=header Authorization present"
+		Expect(selected("2.1")).To(Equal(v2))
+		Expect(selected("2.0-beta")).To(Equal(v2))
+		Expect(selected("1.9")).To(Equal("tokens: name=tokens-v2; " +
+			`result=miss; reason=header X-Api-Version not matching ^2\.`))
+		Expect(selected("")).To(HavePrefix("tokens: "))
+	})
+
+	It("should match on header values alone", func() {
+		opts.Upstreams[0].HeaderName = ""
+		Expect(selected("2.1")).To(Equal("tokens-v2: name=tokens-v2; " +
+			`result=match; reason=header X-Api-Version matching ^2\.`))
+		Expect(selected("3")).To(HavePrefix("tokens: "))
+	})
+
+	It("should report upstreams shadowed by a broader one", func() {
+		opts.Upstreams[0], opts.Upstreams[1] = opts.Upstreams[1],
+			opts.Upstreams[0]
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"upstream tokens-v2 is shadowed by earlier upstream tokens " +
+				"and can never match",
+		})))
+
+		opts.MatchPolicy = "most_specific"
+		Expect(selected("2.1")).To(HavePrefix("tokens-v2: "))
+	})
+
+	It("should fail validation for invalid patterns", func() {
+		opts.Upstreams[0].HeaderValueRegex = map[string]string{
+			"X-Api-Version": "2.(",
+			"X Tenant":      "acme",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid header_value_regex name for " +
+				"http://localhost:8081: X Tenant",
+			"invalid header_value_regex pattern for " +
+				"http://localhost:8081: X-Api-Version: error parsing " +
+				"regexp: missing closing ): `2.(`",
+		})))
+	})
+})
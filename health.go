@@ -0,0 +1,229 @@
+package authdelegate
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readinessDialTimeout limits how long the readiness check waits to connect to
+// each upstream.
+const readinessDialTimeout = 2 * time.Second
+
+// serveHealth reports that the delegate is running and able to serve
+// requests, without contacting any upstream.
+func (handler *authDelegateHandler) serveHealth(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write([]byte("ok\n"))
+}
+
+// serveReadiness reports whether the delegate is ready to accept requests. If
+// table checks upstreams, it is ready only if a TCP connection can be opened
+// to every upstream; no request is sent to them.
+func (handler *authDelegateHandler) serveReadiness(
+	rw http.ResponseWriter, req *http.Request, table *routingTable) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	if handler.shuttingDown() {
+		http.Error(rw, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if table.readinessCheckUpstreams {
+		if failures := table.unreachableUpstreams(); len(failures) != 0 {
+			http.Error(rw, strings.Join(failures, "\n"),
+				http.StatusServiceUnavailable)
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write([]byte("ok\n"))
+}
+
+// unreachableUpstreams concurrently connects to the address of each upstream,
+// or of each replica in turn until one succeeds, and returns a description of
+// each upstream that couldn't be reached, sorted by upstream name.
+func (table *routingTable) unreachableUpstreams() []string {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failures := []string{}
+	for _, upstream := range table.upstreams {
+		if upstream.address == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(upstream *authDelegate) {
+			defer wg.Done()
+			var err error
+			for _, address := range upstream.addresses() {
+				var conn net.Conn
+				conn, err = net.DialTimeout("tcp", address,
+					readinessDialTimeout)
+				if err == nil {
+					conn.Close()
+					return
+				}
+			}
+			mutex.Lock()
+			failures = append(failures, fmt.Sprintf(
+				"upstream %s unreachable: %s", upstream.name, err))
+			mutex.Unlock()
+		}(upstream)
+	}
+	wg.Wait()
+	sort.Strings(failures)
+	return failures
+}
+
+// addresses returns the address of each of the upstream's replicas, the
+// first of which is its address.
+func (delegate *authDelegate) addresses() []string {
+	if delegate.replicas == nil {
+		return []string{delegate.address}
+	}
+	var addresses []string
+	for _, replica := range delegate.replicas.replicas {
+		addresses = append(addresses, upstreamAddress(replica.url))
+	}
+	return addresses
+}
+
+// upstreamAddress returns the host and port of the upstream with the
+// specified URL, using the default port for its scheme if it has none, or the
+// empty string if the upstream isn't reached over the network.
+func upstreamAddress(upstreamURL *url.URL) string {
+	if upstreamURL.Scheme != "http" && upstreamURL.Scheme != "https" {
+		return ""
+	}
+	port := upstreamURL.Port()
+	if port == "" {
+		port = "80"
+		if upstreamURL.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(upstreamURL.Hostname(), port)
+}
+
+// Values of the status of an upstream, and of all upstreams, reported at
+// upstream_status_path, in increasing order of severity
+const (
+	upstreamUp       = "up"
+	upstreamDegraded = "degraded"
+	upstreamDown     = "down"
+)
+
+var upstreamSeverity = map[string]int{
+	upstreamUp: 0, upstreamDegraded: 1, upstreamDown: 2,
+}
+
+// upstreamStatusReport is served at upstream_status_path. Its Status is the
+// most severe of those of its Upstreams.
+type upstreamStatusReport struct {
+	Status    string           `json:"status"`
+	Upstreams []upstreamHealth `json:"upstreams"`
+}
+
+type upstreamHealth struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Draining bool   `json:"draining"`
+
+	// Present only if the upstream has a circuit_breaker
+	Circuit string `json:"circuit,omitempty"`
+
+	// Present only if the upstream has a fail_open policy
+	FailOpen *bool `json:"fail_open,omitempty"`
+
+	// Present only if the upstream has a health_check
+	Replicas []replicaHealth `json:"replicas,omitempty"`
+}
+
+type replicaHealth struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+}
+
+// serveUpstreamStatus reports the health of each upstream as JSON, so that
+// nginx can switch to a maintenance page before users see failures. It
+// reflects what the delegate has already observed, from health checks,
+// circuit breakers, and fail-open policies, without contacting any upstream,
+// so it is cheap to poll. An upstream is down if its circuit is open, its
+// fail-open policy is engaged, or none of its checked replicas are healthy,
+// and degraded if only some are.
+func (handler *authDelegateHandler) serveUpstreamStatus(
+	rw http.ResponseWriter, req *http.Request, table *routingTable) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	report := upstreamStatusReport{
+		Status:    upstreamUp,
+		Upstreams: []upstreamHealth{},
+	}
+	for _, upstream := range table.upstreams {
+		health := upstream.health()
+		if upstreamSeverity[health.Status] >
+			upstreamSeverity[report.Status] {
+			report.Status = health.Status
+		}
+		report.Upstreams = append(report.Upstreams, health)
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	writeJSON(rw, report)
+}
+
+func (delegate *authDelegate) health() upstreamHealth {
+	health := upstreamHealth{
+		Name:     delegate.name,
+		Status:   upstreamUp,
+		Draining: delegate.isDraining(),
+	}
+	if delegate.replicas != nil {
+		healthy := 0
+		for _, replica := range delegate.replicas.replicas {
+			if replica.healthURL == nil {
+				continue
+			}
+			health.Replicas = append(health.Replicas, replicaHealth{
+				URL: replica.url.String(), Healthy: replica.isHealthy(),
+			})
+			if replica.isHealthy() {
+				healthy++
+			}
+		}
+		if healthy == 0 && len(health.Replicas) != 0 {
+			health.Status = upstreamDown
+		} else if healthy != len(health.Replicas) {
+			health.Status = upstreamDegraded
+		}
+	}
+	if delegate.breaker != nil {
+		health.Circuit = delegate.breaker.stateName()
+		if health.Circuit != "closed" {
+			health.Status = upstreamDown
+		}
+	}
+	if delegate.failOpen != nil {
+		engaged := delegate.failOpen.isEngaged()
+		health.FailOpen = &engaged
+		if engaged {
+			health.Status = upstreamDown
+		}
+	}
+	return health
+}
@@ -0,0 +1,228 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+)
+
+var _ = Describe("Health checks", func() {
+	var opts *AuthDelegateOptions
+	var upstream *httptest.Server
+	var upstreamRequests int64
+
+	BeforeEach(func() {
+		atomic.StoreInt64(&upstreamRequests, 0)
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt64(&upstreamRequests, 1)
+				rw.WriteHeader(http.StatusOK)
+			}))
+		opts = &AuthDelegateOptions{
+			Port:          8080,
+			HealthPath:    "/healthz",
+			ReadinessPath: "/readyz",
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				URL: upstream.URL,
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	serve := func(delegate http.Handler, method, path string) int {
+		req, _ := http.NewRequest(method, "http://delegate"+path, nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should report health and readiness without upstream requests",
+		func() {
+			opts.ReadinessCheckUpstreams = true
+			Expect(opts.Validate()).To(BeNil())
+			delegate := NewAuthDelegate(opts)
+			Expect(serve(delegate, "GET", "/healthz")).
+				To(Equal(http.StatusOK))
+			Expect(serve(delegate, "HEAD", "/readyz")).
+				To(Equal(http.StatusOK))
+			Expect(serve(delegate, "POST", "/healthz")).
+				To(Equal(http.StatusMethodNotAllowed))
+			Expect(atomic.LoadInt64(&upstreamRequests)).
+				To(Equal(int64(0)))
+		})
+
+	It("should report not ready if an upstream is unreachable", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		unreachable := "http://" + listener.Addr().String() + "/auth"
+		listener.Close()
+		opts.Upstreams = append([]*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				Name:       "down",
+				URL:        unreachable,
+				HeaderName: "X-Token",
+			},
+		}, opts.Upstreams...)
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		Expect(serve(delegate, "GET", "/readyz")).
+			To(Equal(http.StatusOK))
+
+		opts.ReadinessCheckUpstreams = true
+		delegate = NewAuthDelegate(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/readyz", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(recorder.Body.String()).
+			To(HavePrefix("upstream down unreachable: "))
+		Expect(serve(delegate, "GET", "/healthz")).
+			To(Equal(http.StatusOK))
+	})
+
+	It("should delegate health check paths if not configured", func() {
+		opts.HealthPath = ""
+		Expect(opts.Validate()).To(BeNil())
+		serve(NewAuthDelegate(opts), "GET", "/healthz")
+		Expect(atomic.LoadInt64(&upstreamRequests)).To(Equal(int64(1)))
+	})
+
+	It("should use the default port for the upstream scheme", func() {
+		for rawURL, address := range map[string]string{
+			"https://auth.example.gov/check":   "auth.example.gov:443",
+			"http://auth.example.gov/check":    "auth.example.gov:80",
+			"http://127.0.0.1:8080/auth":       "127.0.0.1:8080",
+			"https://[::1]/auth":               "[::1]:443",
+			"http://auth.example.gov:81/check": "auth.example.gov:81",
+		} {
+			parsed, _ := url.Parse(rawURL)
+			Expect(upstreamAddress(parsed)).To(Equal(address))
+		}
+	})
+
+	It("should fail validation if the paths conflict", func() {
+		opts.MetricsPath = "/readyz"
+		opts.HealthPath = "/readyz"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"health_path must differ from batch_path, " +
+				"subscribe_path, and metrics_path: /readyz",
+			"readiness_path must differ from batch_path, " +
+				"subscribe_path, metrics_path, and health_path: " +
+				"/readyz",
+		})))
+	})
+
+	It("should fail validation if upstream checks lack a path", func() {
+		opts.ReadinessPath = ""
+		opts.ReadinessCheckUpstreams = true
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"readiness_check_upstreams requires readiness_path",
+		})))
+	})
+})
+
+var _ = Describe("Upstream status", func() {
+	var opts *AuthDelegateOptions
+	var upstream, down *httptest.Server
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/fail" {
+					rw.WriteHeader(http.StatusBadGateway)
+				}
+			}))
+		down = httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		opts = &AuthDelegateOptions{
+			Port:               8080,
+			UpstreamStatusPath: "/upstream-status",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:         "sso",
+					URL:          upstream.URL + "/auth",
+					CookieName:   "_session",
+					FailoverURLs: []string{down.URL + "/auth"},
+					HealthCheck: &AuthDelegateHealthCheck{
+						Path:               "/ping",
+						Interval:           "10ms",
+						UnhealthyThreshold: 1,
+					},
+				},
+				&AuthDelegateUpstream{
+					Name: "api",
+					URL:  upstream.URL + "/fail",
+					CircuitBreaker: &AuthDelegateCircuitBreaker{
+						ConsecutiveFailures: 1,
+						CoolDown:            "1h",
+					},
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	report := func(delegate http.Handler) upstreamStatusReport {
+		req, _ := http.NewRequest("GET",
+			"http://delegate/upstream-status", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(
+			Equal("application/json"))
+		var report upstreamStatusReport
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).
+			To(Succeed())
+		return report
+	}
+
+	It("should report the health of each upstream", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		Eventually(func() string {
+			return report(delegate).Status
+		}).Should(Equal(upstreamDegraded))
+		status := report(delegate)
+		Expect(status.Upstreams).To(HaveLen(2))
+		Expect(status.Upstreams[0].Status).To(Equal(upstreamDegraded))
+		Expect(status.Upstreams[0].Replicas).To(Equal([]replicaHealth{
+			{upstream.URL + "/auth", true},
+			{down.URL + "/auth", false},
+		}))
+		Expect(status.Upstreams[1].Status).To(Equal(upstreamUp))
+		Expect(status.Upstreams[1].Circuit).To(Equal("closed"))
+
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		delegate.ServeHTTP(httptest.NewRecorder(), req)
+		status = report(delegate)
+		Expect(status.Status).To(Equal(upstreamDown))
+		Expect(status.Upstreams[1].Status).To(Equal(upstreamDown))
+		Expect(status.Upstreams[1].Circuit).To(Equal("open"))
+	})
+
+	It("should fail validation if the path conflicts", func() {
+		opts.HealthPath = "/upstream-status"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"upstream_status_path must differ from batch_path, " +
+				"subscribe_path, metrics_path, health_path, and " +
+				"readiness_path: /upstream-status",
+		})))
+	})
+})
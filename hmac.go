@@ -0,0 +1,99 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// upstreamHMAC is the type of upstream that verifies request signatures
+// itself, rather than forwarding requests to a signature-validation service.
+const upstreamHMAC = "hmac"
+
+const defaultHMACDigest = "sha1"
+
+// hmacDigests are the valid values of hmac_digest, which name the digest in
+// signatures as 18F/hmacauth does.
+var hmacDigests = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// hmacHandler allows requests whose signature header, of the form
+// "<digest> <base64-encoded signature>" as produced by 18F/hmacauth, is the
+// HMAC of the original request with one of a set of secrets, and denies all
+// others.
+type hmacHandler struct {
+	credential    func(*http.Request) (string, bool)
+	signedHeaders []string
+	digest        string
+	newHash       func() hash.Hash
+	secrets       [][]byte
+}
+
+func newHMACHandler(upstream *AuthDelegateUpstream,
+	delegate *authDelegate) http.Handler {
+	return &hmacHandler{
+		credential: delegate.credential,
+		digest:     upstream.HmacDigest,
+		newHash:    hmacDigests[upstream.HmacDigest],
+		secrets:    upstream.hmacSecrets,
+
+		signedHeaders: canonicalHeaderKeys(upstream.HmacSignedHeaders),
+	}
+}
+
+// stringToSign returns the data signed by the client for the original
+// request that req authorizes: its method, the values of each signed header
+// on a line of their own, and its URI.
+func (handler *hmacHandler) stringToSign(req *http.Request) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(originalMethod(req))
+	buffer.WriteString("\n")
+	for _, name := range handler.signedHeaders {
+		buffer.WriteString(strings.Join(req.Header[name], ","))
+		buffer.WriteString("\n")
+	}
+	buffer.WriteString(originalURI(req))
+	return buffer.String()
+}
+
+// verify returns true if signature is the HMAC of data with one of the
+// handler's secrets.
+func (handler *hmacHandler) verify(data string, signature []byte) bool {
+	for _, secret := range handler.secrets {
+		mac := hmac.New(handler.newHash, secret)
+		mac.Write([]byte(data))
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *hmacHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	value, _ := handler.credential(req)
+	parts := strings.SplitN(value, " ", 2)
+	if len(parts) == 2 && parts[0] == handler.digest {
+		signature, err := base64.StdEncoding.DecodeString(parts[1])
+		if err == nil && handler.verify(handler.stringToSign(req),
+			signature) {
+			rw.WriteHeader(http.StatusAccepted)
+			return
+		}
+		explainDecision(req, "hmac: invalid signature")
+	} else {
+		explainDecision(req, "hmac: missing or malformed signature")
+	}
+	rw.WriteHeader(http.StatusUnauthorized)
+}
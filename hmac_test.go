@@ -0,0 +1,124 @@
+package authdelegate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("HMAC signature upstreams", func() {
+	var dir string
+	var opts *AuthDelegateOptions
+
+	writeSecret := func(name, secret string) string {
+		path := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(path, []byte(secret+"\n"), 0600)).
+			To(Succeed())
+		return path
+	}
+
+	// sign returns the signature of a request as 18F/hmacauth computes it.
+	sign := func(secret, data string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(data))
+		return "sha256 " + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "hmac")
+		Expect(err).To(BeNil())
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "signed",
+					Type:       "hmac",
+					HeaderName: "X-Signature",
+					HmacSecretFiles: []string{
+						writeSecret("old", "old-secret"),
+						writeSecret("new", "new-secret"),
+					},
+					HmacSignedHeaders: []string{
+						"Content-Type", "x-forwarded-user",
+					},
+					HmacDigest: "sha256",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	authorize := func(signature string) int {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("POST", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/api/users?page=2")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Add("X-Forwarded-User", "mbland")
+		req.Header.Add("X-Forwarded-User", "admin")
+		req.Header.Set("X-Signature", signature)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	data := "POST\napplication/json\nmbland,admin\n/api/users?page=2"
+
+	It("should allow requests signed with any of the secrets", func() {
+		Expect(authorize(sign("old-secret", data))).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize(sign("new-secret", data))).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should deny requests with invalid signatures", func() {
+		Expect(authorize(sign("guess", data))).To(
+			Equal(http.StatusUnauthorized))
+		Expect(authorize(sign("new-secret", data+"&page=3"))).To(
+			Equal(http.StatusUnauthorized))
+		Expect(authorize("sha256 not-base64")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should require the configured digest", func() {
+		signature := sign("new-secret", data)
+		Expect(authorize("sha1" + signature[len("sha256"):])).To(
+			Equal(http.StatusUnauthorized))
+		opts.Upstreams[0].HmacDigest = ""
+		Expect(authorize(signature)).To(Equal(http.StatusUnauthorized))
+		Expect(opts.Upstreams[0].HmacDigest).To(Equal("sha1"))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].CookieName = "_signature"
+		opts.Upstreams[0].HmacDigest = "md5"
+		opts.Upstreams[0].HmacSecretFiles = []string{
+			writeSecret("empty", ""),
+		}
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			URL:        "http://localhost:8081",
+			HmacDigest: "sha1",
+		})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid hmac_digest for hmac:signed: md5",
+			"hmac requires header_name, not cookie_name or " +
+				"auth_scheme: hmac:signed",
+			"hmac secret file for hmac:signed is empty: " +
+				filepath.Join(dir, "empty"),
+			"hmac_secret_files, hmac_signed_headers, and hmac_digest " +
+				"require type hmac: http://localhost:8081",
+		})))
+	})
+})
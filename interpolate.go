@@ -0,0 +1,87 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// envReference matches "${VAR}" or "${VAR:-default}", or an escaped "$${".
+var envReference = regexp.MustCompile(
+	`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolateEnv replaces each "${VAR}" in the string values of the JSON
+// config with the value of the environment variable VAR. "${VAR:-default}"
+// uses default if VAR is unset or empty, and "$${" produces a literal "${".
+// Object keys are not expanded. Returns an error listing every variable that
+// is referenced without a default but isn't set. Returns config unchanged if
+// it references no variables or isn't valid JSON, so that the error is
+// reported when it is parsed as options.
+func interpolateEnv(config []byte) ([]byte, error) {
+	if !bytes.Contains(config, []byte("${")) {
+		return config, nil
+	}
+	var parsed interface{}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.UseNumber()
+	if err := decoder.Decode(&parsed); err != nil {
+		return config, nil
+	}
+	var msgs []string
+	parsed = interpolateValue(parsed, "", &msgs)
+	if len(msgs) != 0 {
+		sort.Strings(msgs)
+		return nil, errors.New("Invalid options:\n  " +
+			strings.Join(msgs, "\n  "))
+	}
+	return json.Marshal(parsed)
+}
+
+// interpolateValue expands the strings within value, whose location in the
+// configuration is path, appending a message to msgs for each unset
+// variable.
+func interpolateValue(value interface{}, path string,
+	msgs *[]string) interface{} {
+	switch value := value.(type) {
+	case string:
+		return interpolateString(value, path, msgs)
+	case map[string]interface{}:
+		for key, item := range value {
+			itemPath := key
+			if path != "" {
+				itemPath = path + "." + key
+			}
+			value[key] = interpolateValue(item, itemPath, msgs)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = interpolateValue(item, path+"["+strconv.Itoa(i)+"]",
+				msgs)
+		}
+	}
+	return value
+}
+
+func interpolateString(value, path string, msgs *[]string) string {
+	return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		match := envReference.FindStringSubmatch(ref)
+		name, hasDefault, fallback := match[1], match[2] != "", match[3]
+		if expanded, set := os.LookupEnv(name); set &&
+			!(hasDefault && expanded == "") {
+			return expanded
+		} else if hasDefault {
+			return fallback
+		}
+		*msgs = append(*msgs, "environment variable "+name+
+			" is not set: "+path)
+		return ""
+	})
+}
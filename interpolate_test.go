@@ -0,0 +1,83 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Environment variable interpolation", func() {
+	BeforeEach(func() {
+		os.Setenv("AUTHDELEGATE_TEST_SSO", "https://sso.example.gov")
+		os.Setenv("AUTHDELEGATE_TEST_EMPTY", "")
+		os.Unsetenv("AUTHDELEGATE_TEST_UNSET")
+		os.Unsetenv("AUTHDELEGATE_TEST_TOKEN")
+	})
+
+	AfterEach(func() {
+		os.Unsetenv("AUTHDELEGATE_TEST_SSO")
+		os.Unsetenv("AUTHDELEGATE_TEST_EMPTY")
+	})
+
+	It("should expand variables in string values", func() {
+		opts, err := NewAuthDelegateOptionsFromJSON([]byte(`{
+			"port": 8080,
+			"upstreams": [{
+				"url": "${AUTHDELEGATE_TEST_SSO}/auth",
+				"cookie_name": "_sso${AUTHDELEGATE_TEST_EMPTY}"
+			}]
+		}`))
+		Expect(err).To(BeNil())
+		Expect(opts.Upstreams[0].URL).To(
+			Equal("https://sso.example.gov/auth"))
+		Expect(opts.Upstreams[0].CookieName).To(Equal("_sso"))
+	})
+
+	It("should use defaults for unset or empty variables", func() {
+		config, err := interpolateEnv([]byte(
+			`{"a": "${AUTHDELEGATE_TEST_UNSET:-http://localhost}",` +
+				` "b": "${AUTHDELEGATE_TEST_EMPTY:-fallback}",` +
+				` "c": "${AUTHDELEGATE_TEST_SSO:-unused}",` +
+				` "d": "${AUTHDELEGATE_TEST_UNSET:-}"}`))
+		Expect(err).To(BeNil())
+		Expect(config).To(MatchJSON(`{"a": "http://localhost",` +
+			` "b": "fallback", "c": "https://sso.example.gov", "d": ""}`))
+	})
+
+	It("should preserve escaped references and other values", func() {
+		config, err := interpolateEnv([]byte(
+			`{"${AUTHDELEGATE_TEST_SSO}": "$${HOME} costs $5",` +
+				` "n": 12345678901234567890, "b": true, "z": null}`))
+		Expect(err).To(BeNil())
+		Expect(config).To(MatchJSON(`{"${AUTHDELEGATE_TEST_SSO}":` +
+			` "${HOME} costs $5", "n": 12345678901234567890,` +
+			` "b": true, "z": null}`))
+	})
+
+	It("should report every unset variable", func() {
+		_, err := parseOptions("config.yaml", "", []byte(strings.Join(
+			[]string{
+				`port: 8080`,
+				`ssl_cert: ${AUTHDELEGATE_TEST_UNSET}/server.crt`,
+				`upstreams:`,
+				`  - url: ${AUTHDELEGATE_TEST_SSO}/auth`,
+				`    cookie_name: _sso`,
+				`  - url: ${AUTHDELEGATE_TEST_TOKEN}`,
+			}, "\n")))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"environment variable AUTHDELEGATE_TEST_TOKEN is not set: " +
+				"upstreams[1].url",
+			"environment variable AUTHDELEGATE_TEST_UNSET is not set: " +
+				"ssl_cert",
+		})))
+	})
+
+	It("should leave invalid JSON to be reported by the parser", func() {
+		_, err := NewAuthDelegateOptionsFromJSON(
+			[]byte(`{"port": "${PORT}"`))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix("JSON parsing failed: "))
+	})
+})
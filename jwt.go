@@ -0,0 +1,498 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamJWT is the type of upstream that validates JSON Web Tokens itself,
+// rather than forwarding requests to a token-validation service.
+const upstreamJWT = "jwt"
+
+// defaultJWTClaims are the claims of a valid token returned in X-Auth-*
+// headers unless jwt_claims names others.
+var defaultJWTClaims = []string{"sub"}
+
+const (
+	// jwksRefreshInterval is how often the keys at a jwt_jwks_url are read
+	// again, so that new keys are used and revoked keys are not.
+	jwksRefreshInterval = 10 * time.Minute
+
+	// jwksMinRefreshInterval is how long to wait after reading the keys
+	// at a jwt_jwks_url before reading them again because a token names a
+	// key they don't include, so that such tokens can't flood the server.
+	jwksMinRefreshInterval = 30 * time.Second
+
+	// jwksTimeout limits requests for the keys at a jwt_jwks_url if the
+	// upstream has no timeout.
+	jwksTimeout = 10 * time.Second
+
+	// maxJWKSBytes limits the size of the document at a jwt_jwks_url.
+	maxJWKSBytes = 1 << 20
+)
+
+// jwtHashes are the digests used by the signature algorithms, named by the
+// "alg" header of a token, other than EdDSA, which needs none.
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// jwtCurves are the curves of the keys that ECDSA signature algorithms
+// require.
+var jwtCurves = map[string]elliptic.Curve{
+	"ES256": elliptic.P256(),
+	"ES384": elliptic.P384(),
+	"ES512": elliptic.P521(),
+}
+
+// jwtHandler allows requests whose credential is a JSON Web Token signed with
+// one of a set of public keys, issued for the configured issuer and
+// audience, and current, returning the configured claims in X-Auth-*
+// headers. It denies all others.
+type jwtHandler struct {
+	credential func(*http.Request) (string, bool)
+	authScheme string
+	issuer     string
+	audience   string
+	leeway     time.Duration
+
+	// Claims returned in the response, and the headers that contain them
+	claims  []string
+	headers []string
+
+	// Keys from jwt_key_files, which verify tokens with any key ID
+	keys []crypto.PublicKey
+
+	// Keys from jwt_jwks_url, or nil if it's empty
+	jwks *jwksKeySet
+}
+
+func newJWTHandler(upstream *AuthDelegateUpstream,
+	delegate *authDelegate) http.Handler {
+	handler := &jwtHandler{
+		credential: delegate.credential,
+		authScheme: authSchemePrefix(upstream.AuthScheme),
+		issuer:     upstream.JwtIssuer,
+		audience:   upstream.JwtAudience,
+		leeway:     upstream.jwtLeeway,
+		claims:     upstream.JwtClaims,
+		keys:       upstream.jwtKeys,
+	}
+	if len(handler.claims) == 0 {
+		handler.claims = defaultJWTClaims
+	}
+	for _, claim := range handler.claims {
+		handler.headers = append(handler.headers, jwtClaimHeader(claim))
+	}
+	if upstream.JwtJwksURL != "" {
+		timeout := upstream.timeout
+		if timeout == 0 {
+			timeout = jwksTimeout
+		}
+		handler.jwks = &jwksKeySet{
+			url:    upstream.JwtJwksURL,
+			client: &http.Client{Timeout: timeout},
+		}
+	}
+	return handler
+}
+
+// jwtClaimHeader returns the response header containing claim, e.g.
+// X-Auth-Preferred-Username for "preferred_username".
+func jwtClaimHeader(claim string) string {
+	return http.CanonicalHeaderKey("X-Auth-" +
+		strings.Replace(claim, "_", "-", -1))
+}
+
+func (handler *jwtHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	credential, _ := handler.credential(req)
+	claims, err := handler.validate(
+		withoutAuthScheme(credential, handler.authScheme), time.Now())
+	if err != nil {
+		explainDecision(req, "jwt: "+err.Error())
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	for i, claim := range handler.claims {
+		if value, ok := jwtClaimValue(claims[claim]); ok {
+			rw.Header().Set(handler.headers[i], value)
+		}
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// validate returns the claims of token if it is a valid JWT at now, or an
+// error describing why it isn't.
+func (handler *jwtHandler) validate(token string,
+	now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a signed JWT")
+	}
+	var header struct {
+		Alg  string          `json:"alg"`
+		Kid  string          `json:"kid"`
+		Crit json.RawMessage `json:"crit"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	} else if header.Crit != nil {
+		return nil, errors.New("unsupported critical header parameters")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+	verified := false
+	for _, key := range handler.candidateKeys(header.Kid) {
+		if verifyJWTSignature(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	return claims, handler.checkClaims(claims, now)
+}
+
+// candidateKeys returns the keys that may have signed a token with the key
+// ID kid: every static key, and those from the JWKS URL with that ID, or all
+// of them if kid is empty.
+func (handler *jwtHandler) candidateKeys(kid string) []crypto.PublicKey {
+	if handler.jwks == nil {
+		return handler.keys
+	}
+	keys := append([]crypto.PublicKey(nil), handler.keys...)
+	return append(keys, handler.jwks.keys(kid)...)
+}
+
+// checkClaims returns an error if claims are not those of a token for the
+// handler's issuer and audience that is current at now.
+func (handler *jwtHandler) checkClaims(claims map[string]interface{},
+	now time.Time) error {
+	exp, ok := claims["exp"].(json.Number)
+	if !ok {
+		return errors.New("missing exp claim")
+	} else if expires, err := exp.Float64(); err != nil ||
+		!now.Before(jwtTime(expires).Add(handler.leeway)) {
+		return errors.New("expired")
+	}
+	if nbf, ok := claims["nbf"].(json.Number); ok {
+		if notBefore, err := nbf.Float64(); err != nil ||
+			now.Add(handler.leeway).Before(jwtTime(notBefore)) {
+			return errors.New("not yet valid")
+		}
+	}
+	if handler.issuer != "" && claims["iss"] != handler.issuer {
+		return errors.New("wrong issuer")
+	}
+	if handler.audience != "" && !jwtAudienceIncludes(claims["aud"],
+		handler.audience) {
+		return errors.New("wrong audience")
+	}
+	return nil
+}
+
+// jwtTime converts a NumericDate claim, in seconds since the epoch, to a
+// time.
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// jwtAudienceIncludes returns true if the aud claim, either a string or a
+// list of strings, includes audience.
+func jwtAudienceIncludes(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, value := range aud {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jwtClaimValue returns claim formatted as a header value: strings as they
+// are, numbers and booleans in their JSON form, and lists of these joined by
+// commas. Returns false for objects, which aren't returned.
+func jwtClaimValue(claim interface{}) (string, bool) {
+	switch claim := claim.(type) {
+	case string:
+		return claim, true
+	case json.Number:
+		return claim.String(), true
+	case bool:
+		return strconv.FormatBool(claim), true
+	case []interface{}:
+		var values []string
+		for _, item := range claim {
+			if value, ok := jwtClaimValue(item); ok {
+				values = append(values, value)
+			}
+		}
+		return strings.Join(values, ","), true
+	}
+	return "", false
+}
+
+// decodeJWTPart decodes the base64url-encoded JSON object part into value,
+// keeping numbers as json.Number.
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(value)
+}
+
+// verifyJWTSignature returns true if signature is that of signed by the
+// private key of key using the algorithm alg. Symmetric algorithms and
+// "none" are never valid.
+func verifyJWTSignature(alg string, key crypto.PublicKey,
+	signed, signature []byte) bool {
+	if alg == "EdDSA" {
+		key, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(key, signed, signature)
+	}
+	hash, ok := jwtHashes[alg]
+	if !ok {
+		return false
+	}
+	digester := hash.New()
+	digester.Write(signed)
+	digest := digester.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(key, hash, digest,
+				signature) == nil
+		} else if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(key, hash, digest, signature,
+				nil) == nil
+		}
+	case *ecdsa.PublicKey:
+		if jwtCurves[alg] != key.Curve {
+			return false
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, digest, r, s)
+	}
+	return false
+}
+
+// jwksKeySet holds the keys published at a JWKS URL, reading them again
+// periodically and when a token names a key they don't include.
+type jwksKeySet struct {
+	url    string
+	client *http.Client
+
+	mutex sync.Mutex
+
+	// Keys by key ID, the empty string for keys without one
+	byID map[string][]crypto.PublicKey
+
+	// Time of the latest attempt to read the keys
+	fetched time.Time
+
+	// If not nil, closed once the keys being read have been
+	fetching chan struct{}
+}
+
+// keys returns the keys with the ID kid, or every key if kid is empty. If
+// they are out of date, they are read again in the background, and the keys
+// already read are returned meanwhile, unless there are none or none has the
+// ID kid, in which case the reading is awaited.
+func (set *jwksKeySet) keys(kid string) []crypto.PublicKey {
+	set.mutex.Lock()
+	age := time.Since(set.fetched)
+	_, known := set.byID[kid]
+	if set.fetching == nil && (age >= jwksRefreshInterval ||
+		(kid != "" && !known && age >= jwksMinRefreshInterval)) {
+		set.fetched = time.Now()
+		set.fetching = make(chan struct{})
+		go set.refresh(set.fetching)
+	}
+	fetching := set.fetching
+	wait := fetching != nil && (set.byID == nil || (kid != "" && !known))
+	set.mutex.Unlock()
+	if wait {
+		<-fetching
+	}
+
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if kid != "" {
+		return set.byID[kid]
+	}
+	var keys []crypto.PublicKey
+	for _, byID := range set.byID {
+		keys = append(keys, byID...)
+	}
+	return keys
+}
+
+// refresh reads the keys again, keeping those already read if that fails,
+// then closes done.
+func (set *jwksKeySet) refresh(done chan struct{}) {
+	byID, err := set.fetch()
+	if err != nil {
+		log.Printf("jwks %s: %s", set.url, err)
+	}
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	if err == nil {
+		set.byID = byID
+	}
+	set.fetching = nil
+	close(done)
+}
+
+// fetch reads the signature verification keys at the JWKS URL, ignoring
+// those of unsupported types.
+func (set *jwksKeySet) fetch() (map[string][]crypto.PublicKey, error) {
+	res, err := set.client.Get(set.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New("unexpected status: " + res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxJWKSBytes+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxJWKSBytes {
+		return nil, errors.New("document exceeds " +
+			strconv.Itoa(maxJWKSBytes) + " bytes")
+	}
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	byID := make(map[string][]crypto.PublicKey)
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			byID[jwk.Kid] = append(byID[jwk.Kid], key)
+		}
+	}
+	return byID, nil
+}
+
+// jsonWebKey is a public key as published in a JWKS document (RFC 7517).
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwkCurves are the curves of EC keys, by their "crv" names.
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+func (jwk *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent},
+			nil
+	case "EC":
+		curve := jwkCurves[jwk.Crv]
+		if curve == nil {
+			return nil, errors.New("unsupported curve: " + jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid EC key coordinates")
+		}
+		point := append(append([]byte{4}, x...), y...)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	case "OKP":
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		} else if jwk.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported OKP key: " + jwk.Crv)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %q", jwk.Kty)
+}
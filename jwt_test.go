@@ -0,0 +1,341 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("JWT upstreams", func() {
+	var dir string
+	var jwks *httptest.Server
+	var jwksRequests int
+	var rsaKey *rsa.PrivateKey
+	var ecKey *ecdsa.PrivateKey
+	var edKey ed25519.PrivateKey
+	var opts *AuthDelegateOptions
+
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		Expect(err).To(BeNil())
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	// sign returns a token with claims signed by key with the algorithm
+	// alg, identified by kid if it isn't empty.
+	sign := func(alg, kid string, key crypto.Signer,
+		claims map[string]interface{}) string {
+		header := map[string]string{"alg": alg, "typ": "JWT"}
+		if kid != "" {
+			header["kid"] = kid
+		}
+		signed := encode(header) + "." + encode(claims)
+		digest := sha256.Sum256([]byte(signed))
+		var signature []byte
+		var err error
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key,
+				crypto.SHA256, digest[:])
+		case *ecdsa.PrivateKey:
+			var r, s *big.Int
+			r, s, err = ecdsa.Sign(rand.Reader, key, digest[:])
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		case ed25519.PrivateKey:
+			signature = ed25519.Sign(key, []byte(signed))
+		}
+		Expect(err).To(BeNil())
+		return signed + "." +
+			base64.RawURLEncoding.EncodeToString(signature)
+	}
+
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":    "https://login.example.gov",
+			"aud":    []string{"api", "admin"},
+			"sub":    "mbland",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"admins", "users"},
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "jwt")
+		Expect(err).To(BeNil())
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(BeNil())
+		ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).To(BeNil())
+		_, edKey, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).To(BeNil())
+
+		der, err := x509.MarshalPKIXPublicKey(rsaKey.Public())
+		Expect(err).To(BeNil())
+		keyFile := filepath.Join(dir, "rsa.pem")
+		Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+			Type: "PUBLIC KEY", Bytes: der}), 0600)).To(Succeed())
+
+		jwksRequests = 0
+		point := ecKey.PublicKey
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		point.X.FillBytes(x)
+		point.Y.FillBytes(y)
+		document := encodeJSON(map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kty": "EC", "kid": "ec-1", "use": "sig",
+					"crv": "P-256",
+					"x":   base64.RawURLEncoding.EncodeToString(x),
+					"y":   base64.RawURLEncoding.EncodeToString(y),
+				},
+				{
+					"kty": "OKP", "kid": "ed-1", "crv": "Ed25519",
+					"x": base64.RawURLEncoding.EncodeToString(
+						edKey.Public().(ed25519.PublicKey)),
+				},
+				{"kty": "oct", "kid": "secret", "k": "c2VjcmV0"},
+			},
+		})
+		jwks = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				jwksRequests++
+				rw.Write(document)
+			}))
+
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:        "tokens",
+					Type:        "jwt",
+					AuthScheme:  "Bearer",
+					JwtJwksURL:  jwks.URL,
+					JwtKeyFiles: []string{keyFile},
+					JwtIssuer:   "https://login.example.gov",
+					JwtAudience: "api",
+					JwtClaims:   []string{"sub", "groups"},
+					JwtLeeway:   "1m",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		jwks.Close()
+		os.RemoveAll(dir)
+	})
+
+	authorize := func(token string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should allow tokens signed with static or JWKS keys", func() {
+		for _, token := range []string{
+			sign("RS256", "", rsaKey, claims()),
+			sign("ES256", "ec-1", ecKey, claims()),
+			sign("EdDSA", "ed-1", edKey, claims()),
+			sign("EdDSA", "", edKey, claims()),
+		} {
+			recorder := authorize(token)
+			Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			Expect(recorder.Header().Get("X-Auth-Sub")).To(
+				Equal("mbland"))
+			Expect(recorder.Header().Get("X-Auth-Groups")).To(
+				Equal("admins,users"))
+		}
+	})
+
+	It("should deny tokens with invalid signatures", func() {
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).To(BeNil())
+		for _, token := range []string{
+			"",
+			"not.a.token",
+			sign("ES256", "ec-1", otherKey, claims()),
+			sign("EdDSA", "ec-1", edKey, claims()),
+			sign("PS256", "", rsaKey, claims()),
+			encode(map[string]string{"alg": "none"}) + "." +
+				encode(claims()) + ".",
+		} {
+			Expect(authorize(token).Code).To(
+				Equal(http.StatusUnauthorized))
+		}
+	})
+
+	It("should check the expiry, issuer, and audience", func() {
+		valid := func(change func(map[string]interface{})) int {
+			values := claims()
+			change(values)
+			return authorize(sign("ES256", "ec-1", ecKey, values)).Code
+		}
+		Expect(valid(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-30 * time.Second).Unix()
+			c["aud"] = "api"
+		})).To(Equal(http.StatusAccepted))
+		Expect(valid(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+		})).To(Equal(http.StatusUnauthorized))
+		Expect(valid(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})).To(Equal(http.StatusUnauthorized))
+		Expect(valid(func(c map[string]interface{}) {
+			c["nbf"] = time.Now().Add(5 * time.Minute).Unix()
+		})).To(Equal(http.StatusUnauthorized))
+		Expect(valid(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		})).To(Equal(http.StatusUnauthorized))
+		Expect(valid(func(c map[string]interface{}) {
+			c["aud"] = []string{"admin"}
+		})).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should explain denials in audit records", func() {
+		opts.AuditDecisions = "denials"
+		otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).To(BeNil())
+		expired := claims()
+		expired["exp"] = time.Now().Add(-2 * time.Minute).Unix()
+		unexpiring := claims()
+		delete(unexpiring, "exp")
+		for _, test := range []struct {
+			token  string
+			reason string
+		}{
+			{sign("ES256", "ec-1", ecKey, expired), "jwt: expired"},
+			{sign("ES256", "ec-1", otherKey, claims()),
+				"jwt: invalid signature"},
+			{sign("ES256", "ec-1", ecKey, unexpiring),
+				"jwt: missing exp claim"},
+		} {
+			var output bytes.Buffer
+			log.SetOutput(&output)
+			authorize(test.token)
+			log.SetOutput(os.Stderr)
+			Expect(output.String()).To(ContainSubstring(
+				`"upstream":"tokens","matched":"header Authorization `+
+					`present","decision":"deny","status":401,"reason":"`+
+					test.reason+`"`), test.reason)
+		}
+	})
+
+	It("should read the JWKS URL again only when needed", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		for _, kid := range []string{"ec-1", "ed-1", "unknown", "ec-1"} {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			req.Header.Set("Authorization", "Bearer "+
+				sign("ES256", kid, ecKey, claims()))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		Expect(jwksRequests).To(Equal(1))
+	})
+
+	It("should use the keys already read while reading them again", func() {
+		release := make(chan struct{})
+		slow := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				<-release
+				rw.Write([]byte(`{"keys": []}`))
+			}))
+		defer slow.Close()
+		set := &jwksKeySet{
+			url:    slow.URL,
+			client: &http.Client{Timeout: time.Second},
+			byID: map[string][]crypto.PublicKey{
+				"ec-1": {&ecKey.PublicKey},
+			},
+		}
+		Expect(set.keys("ec-1")).To(HaveLen(1))
+		Expect(set.keys("")).To(HaveLen(1))
+
+		unknown := make(chan []crypto.PublicKey)
+		go func() { unknown <- set.keys("ec-2") }()
+		Consistently(unknown, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Eventually(unknown).Should(Receive(BeEmpty()))
+		Expect(set.keys("ec-1")).To(BeEmpty())
+	})
+
+	It("should ignore oversized JWKS documents", func() {
+		large := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.Write([]byte(`{"keys": [], "padding": "`))
+				rw.Write(bytes.Repeat([]byte("x"), maxJWKSBytes))
+				rw.Write([]byte(`"}`))
+			}))
+		defer large.Close()
+		set := &jwksKeySet{url: large.URL, client: http.DefaultClient}
+		_, err := set.fetch()
+		Expect(err).To(MatchError("document exceeds 1048576 bytes"))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				Name:       "no-keys",
+				Type:       "jwt",
+				HeaderName: "X-Token",
+				JwtClaims:  []string{""},
+			},
+			&AuthDelegateUpstream{
+				Name:        "bad-keys",
+				Type:        "jwt",
+				CookieName:  "_token",
+				JwtJwksURL:  "ftp://keys",
+				JwtKeyFiles: []string{filepath.Join(dir, "missing")},
+				JwtLeeway:   "soon",
+			},
+			&AuthDelegateUpstream{
+				URL:        "http://localhost:8081",
+				HeaderName: "X-Signature",
+				JwtIssuer:  "https://login.example.gov",
+			},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"jwt requires jwt_jwks_url or jwt_key_files: jwt:no-keys",
+			"empty jwt_claims name: jwt:no-keys",
+			"invalid jwt_jwks_url for jwt:bad-keys: ftp://keys",
+			"jwt_key_files for jwt:bad-keys could not be read: open " +
+				filepath.Join(dir, "missing") +
+				": no such file or directory",
+			"invalid jwt_leeway for jwt:bad-keys: soon",
+			"jwt_* options require type jwt: http://localhost:8081",
+		})))
+	})
+})
+
+func encodeJSON(value interface{}) []byte {
+	data, err := json.Marshal(value)
+	Expect(err).To(BeNil())
+	return data
+}
@@ -0,0 +1,223 @@
+package authdelegate
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Latency histogram buckets grow exponentially from latencyBucketMin, with
+// latencyBucketsPerDoubling buckets each time the latency doubles, so that a
+// percentile is estimated within about 19%. Latencies beyond the last bucket
+// (about 32 seconds) are counted in it.
+const (
+	latencyBucketMin          = 500 * time.Microsecond
+	latencyBucketsPerDoubling = 4
+	latencyBuckets            = 16*latencyBucketsPerDoubling + 1
+)
+
+// maxLatencyBuckets limits the latency_buckets of an upstream, each of which
+// is a metrics series.
+const maxLatencyBuckets = 30
+
+// latencyBounds contains the upper bound of each latency histogram bucket.
+var latencyBounds = func() (bounds [latencyBuckets]time.Duration) {
+	for i := range bounds {
+		bounds[i] = time.Duration(float64(latencyBucketMin) *
+			math.Pow(2, float64(i)/latencyBucketsPerDoubling))
+	}
+	return
+}()
+
+// latencyHistogram counts an upstream's response latencies, both since it was
+// created and since the last call to rollWindow.
+type latencyHistogram struct {
+	// Accessed atomically
+	total  [latencyBuckets]uint64
+	window [latencyBuckets]uint64
+
+	// Sum of the latencies counted in total; accessed atomically
+	sum int64
+
+	// If latency_buckets is defined, the upper bounds of the buckets that
+	// metrics report, and the number of latencies in each, which are
+	// counted separately as the bounds needn't be those above. The last
+	// count, of latencies beyond the last bound, is accessed atomically,
+	// like the others.
+	exportBounds []time.Duration
+	exportCounts []uint64
+}
+
+func newLatencyHistogram(bounds []time.Duration) *latencyHistogram {
+	histogram := &latencyHistogram{}
+	if len(bounds) != 0 {
+		histogram.exportBounds = bounds
+		histogram.exportCounts = make([]uint64, len(bounds)+1)
+	}
+	return histogram
+}
+
+// inherit continues the counts of previous, the histogram of the same
+// upstream in the routing table being replaced, so that replacing the table
+// doesn't reset the counts that metrics report. The counts of the
+// latency_buckets continue only if both histograms have the same bounds.
+func (histogram *latencyHistogram) inherit(previous *latencyHistogram) {
+	for i := range histogram.total {
+		atomic.StoreUint64(&histogram.total[i],
+			atomic.LoadUint64(&previous.total[i]))
+		atomic.StoreUint64(&histogram.window[i],
+			atomic.LoadUint64(&previous.window[i]))
+	}
+	atomic.StoreInt64(&histogram.sum, atomic.LoadInt64(&previous.sum))
+	if len(histogram.exportBounds) != len(previous.exportBounds) {
+		return
+	}
+	for i, bound := range histogram.exportBounds {
+		if previous.exportBounds[i] != bound {
+			return
+		}
+	}
+	for i := range histogram.exportCounts {
+		atomic.StoreUint64(&histogram.exportCounts[i],
+			atomic.LoadUint64(&previous.exportCounts[i]))
+	}
+}
+
+func latencyBucket(latency time.Duration) int {
+	for i, bound := range latencyBounds {
+		if latency <= bound {
+			return i
+		}
+	}
+	return latencyBuckets - 1
+}
+
+func (histogram *latencyHistogram) observe(latency time.Duration) {
+	bucket := latencyBucket(latency)
+	atomic.AddUint64(&histogram.total[bucket], 1)
+	atomic.AddUint64(&histogram.window[bucket], 1)
+	atomic.AddInt64(&histogram.sum, int64(latency))
+	if histogram.exportBounds != nil {
+		atomic.AddUint64(&histogram.exportCounts[sort.Search(
+			len(histogram.exportBounds), func(i int) bool {
+				return latency <= histogram.exportBounds[i]
+			})], 1)
+	}
+}
+
+// latencySummary reports the number of observations in a latency histogram
+// and estimates of its percentiles, in milliseconds.
+type latencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+func summarizeLatency(counts *[latencyBuckets]uint64) latencySummary {
+	summary := latencySummary{}
+	for _, count := range counts {
+		summary.Count += count
+	}
+	summary.P50 = latencyPercentile(counts, summary.Count, 0.50)
+	summary.P95 = latencyPercentile(counts, summary.Count, 0.95)
+	summary.P99 = latencyPercentile(counts, summary.Count, 0.99)
+	return summary
+}
+
+// latencyPercentile returns the upper bound, in milliseconds, of the bucket
+// containing the specified fraction of observations.
+func latencyPercentile(counts *[latencyBuckets]uint64, total uint64,
+	fraction float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(fraction * float64(total)))
+	var seen uint64
+	for i, count := range counts {
+		if seen += count; seen >= rank {
+			return float64(latencyBounds[i]) / float64(time.Millisecond)
+		}
+	}
+	return float64(latencyBounds[latencyBuckets-1]) /
+		float64(time.Millisecond)
+}
+
+func (histogram *latencyHistogram) totalSummary() latencySummary {
+	var counts [latencyBuckets]uint64
+	for i := range counts {
+		counts[i] = atomic.LoadUint64(&histogram.total[i])
+	}
+	return summarizeLatency(&counts)
+}
+
+// rollWindow summarizes the observations since the previous call, and begins
+// a new window.
+func (histogram *latencyHistogram) rollWindow() latencySummary {
+	var counts [latencyBuckets]uint64
+	for i := range counts {
+		counts[i] = atomic.SwapUint64(&histogram.window[i], 0)
+	}
+	return summarizeLatency(&counts)
+}
+
+// timedHandler records the latency of an upstream's successful responses,
+// i.e. those with other than a 5xx status, in a latencyHistogram. Failures
+// are excluded so that they don't mask a slowdown of the happy path.
+type timedHandler struct {
+	histogram *latencyHistogram
+	handler   http.Handler
+}
+
+func (timed *timedHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	recorder := &statusRecorder{rw, http.StatusOK}
+	start := time.Now()
+	timed.handler.ServeHTTP(recorder, req)
+	if recorder.status < http.StatusInternalServerError {
+		timed.histogram.observe(time.Since(start))
+	}
+}
+
+// logLatency logs the latency percentiles of each upstream that responded
+// during each interval.
+func (handler *authDelegateHandler) logLatency(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, upstream := range handler.routes().upstreams {
+			summary := upstream.latency.rollWindow()
+			if summary.Count == 0 {
+				continue
+			}
+			log.Printf("latency %s: p50=%.1fms p95=%.1fms "+
+				"p99=%.1fms count=%d", upstream.name, summary.P50,
+				summary.P95, summary.P99, summary.Count)
+		}
+	}
+}
+
+func validateLatencyBuckets(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	upstream.latencyBuckets = nil
+	if len(upstream.LatencyBuckets) > maxLatencyBuckets {
+		return append(msgs, "more than "+strconv.Itoa(maxLatencyBuckets)+
+			" latency_buckets for "+upstream.URL)
+	}
+	for _, value := range upstream.LatencyBuckets {
+		bound, err := time.ParseDuration(value)
+		if err != nil {
+			return append(msgs, "invalid latency_buckets for "+
+				upstream.URL+": "+value)
+		}
+		if last := len(upstream.latencyBuckets) - 1; bound <= 0 ||
+			(last >= 0 && bound <= upstream.latencyBuckets[last]) {
+			return append(msgs, "latency_buckets for "+upstream.URL+
+				" must be positive and increasing: "+value)
+		}
+		upstream.latencyBuckets = append(upstream.latencyBuckets, bound)
+	}
+	return msgs
+}
@@ -0,0 +1,133 @@
+package authdelegate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Upstream latency", func() {
+	It("should estimate percentiles within a bucket", func() {
+		histogram := &latencyHistogram{}
+		for i := 1; i <= 100; i++ {
+			histogram.observe(time.Duration(i) * time.Millisecond)
+		}
+		summary := histogram.totalSummary()
+		Expect(summary.Count).To(Equal(uint64(100)))
+		Expect(summary.P50).To(BeNumerically(">=", 50))
+		Expect(summary.P50).To(BeNumerically("<", 50*1.19))
+		Expect(summary.P95).To(BeNumerically(">=", 95))
+		Expect(summary.P99).To(BeNumerically(">=", 99))
+		Expect(summary.P99).To(BeNumerically("<", 99*1.19))
+	})
+
+	It("should count latencies beyond the last bucket in it", func() {
+		histogram := &latencyHistogram{}
+		histogram.observe(time.Hour)
+		Expect(histogram.totalSummary().P50).To(Equal(
+			float64(latencyBounds[latencyBuckets-1]) /
+				float64(time.Millisecond)))
+	})
+
+	It("should summarize each window separately", func() {
+		histogram := &latencyHistogram{}
+		histogram.observe(time.Millisecond)
+		Expect(histogram.rollWindow().Count).To(Equal(uint64(1)))
+		Expect(histogram.rollWindow()).To(Equal(latencySummary{}))
+		Expect(histogram.totalSummary().Count).To(Equal(uint64(1)))
+	})
+
+	It("should report successful responses via the admin API", func() {
+		status := http.StatusOK
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+			}))
+		defer upstream.Close()
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				{Name: "sso", URL: upstream.URL},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		for _, status = range []int{200, 403, 502} {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			delegate.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		req, _ := http.NewRequest("GET", "/upstreams/latency", nil)
+		recorder := httptest.NewRecorder()
+		NewAdminHandler(delegate).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		var latencies []upstreamLatency
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &latencies)).
+			To(BeNil())
+		Expect(latencies).To(HaveLen(1))
+		Expect(latencies[0].Name).To(Equal("sso"))
+		Expect(latencies[0].Count).To(Equal(uint64(2)))
+	})
+
+	It("should export latencies in custom buckets", func() {
+		histogram := newLatencyHistogram([]time.Duration{
+			time.Millisecond, 10 * time.Millisecond,
+		})
+		for _, latency := range []time.Duration{
+			500 * time.Microsecond, time.Millisecond,
+			5 * time.Millisecond, time.Second,
+		} {
+			histogram.observe(latency)
+		}
+		var output bytes.Buffer
+		writer := metricsWriter{bufio.NewWriter(&output)}
+		writer.histogram("latency", "sso", histogram)
+		writer.Flush()
+		Expect(output.String()).To(Equal(
+			`latency_bucket{upstream="sso",le="0.001"} 2` + "\n" +
+				`latency_bucket{upstream="sso",le="0.01"} 3` + "\n" +
+				`latency_bucket{upstream="sso",le="+Inf"} 4` + "\n" +
+				`latency_sum{upstream="sso"} 1.0065` + "\n" +
+				`latency_count{upstream="sso"} 4` + "\n"))
+		Expect(histogram.totalSummary().Count).To(Equal(uint64(4)))
+	})
+
+	It("should fail validation for invalid latency_buckets", func() {
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				{URL: "http://a", HeaderName: "X-A",
+					LatencyBuckets: []string{"5ms", "fast"}},
+				{URL: "http://b", HeaderName: "X-B",
+					LatencyBuckets: []string{"5ms", "5ms"}},
+				{URL: "http://c", HeaderName: "X-C",
+					LatencyBuckets: []string{"0s"}},
+				{URL: "http://d", LatencyBuckets: make([]string, 31)},
+			},
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"invalid latency_buckets for http://a: fast",
+			"latency_buckets for http://b must be positive and " +
+				"increasing: 5ms",
+			"latency_buckets for http://c must be positive and " +
+				"increasing: 0s",
+			"more than 30 latency_buckets for http://d",
+		})))
+	})
+
+	It("should fail validation for a nonpositive interval", func() {
+		opts := &AuthDelegateOptions{
+			Port:               8080,
+			Upstreams:          []*AuthDelegateUpstream{{URL: "http://x"}},
+			LatencyLogInterval: "0s",
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"latency_log_interval must be positive",
+		})))
+	})
+})
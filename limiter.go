@@ -0,0 +1,170 @@
+package authdelegate
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// adaptiveDecrease is the factor by which an adaptiveLimiter reduces its limit
+// when an upstream slows down or fails.
+const adaptiveDecrease = 0.9
+
+// adaptiveLimiter bounds the number of requests in flight to an upstream,
+// adjusting the bound by additive increase, multiplicative decrease (AIMD):
+// each timely, successful response raises the limit by 1/limit, so that it
+// grows by about one per round trip, and a response slower than the target
+// latency or with a 5xx status reduces it by adaptiveDecrease. As in TCP
+// congestion control, the limit is decreased at most once per round trip, so
+// that a burst of slow responses doesn't collapse it.
+type adaptiveLimiter struct {
+	target   time.Duration
+	minLimit float64
+	maxLimit float64
+
+	// Fraction of the limit available to low priority requests
+	lowShare float64
+
+	mutex        sync.Mutex
+	limit        float64
+	inFlight     int
+	lastDecrease time.Time
+}
+
+// limiterStatus reports the state of an adaptiveLimiter.
+type limiterStatus struct {
+	Limit    int `json:"limit"`
+	InFlight int `json:"in_flight"`
+}
+
+// newAdaptiveLimiter returns nil if upstream does not enable adaptive
+// concurrency. The limit starts at its maximum, so that requests are not
+// rejected while the limiter learns the upstream's capacity.
+func newAdaptiveLimiter(upstream *AuthDelegateUpstream) *adaptiveLimiter {
+	config := upstream.AdaptiveConcurrency
+	if config == nil {
+		return nil
+	}
+	lowShare := defaultLowPriorityShare
+	if config.LowPriorityShare != nil {
+		lowShare = *config.LowPriorityShare
+	}
+	return &adaptiveLimiter{
+		target:   config.targetLatency,
+		minLimit: float64(config.MinLimit),
+		maxLimit: float64(config.MaxLimit),
+		lowShare: lowShare,
+		limit:    float64(config.MaxLimit),
+	}
+}
+
+// acquire admits a request of the specified priority class if the number in
+// flight is below the limit, or below the low priority share of it for a low
+// priority request.
+func (limiter *adaptiveLimiter) acquire(class string) bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limit := limiter.limit
+	if class == priorityLow {
+		limit *= limiter.lowShare
+	}
+	if limiter.inFlight >= int(limit) {
+		return false
+	}
+	limiter.inFlight++
+	return true
+}
+
+func (limiter *adaptiveLimiter) release(latency time.Duration, failed bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.inFlight--
+	now := time.Now()
+	if !failed && latency <= limiter.target {
+		limiter.limit += 1 / limiter.limit
+		if limiter.limit > limiter.maxLimit {
+			limiter.limit = limiter.maxLimit
+		}
+	} else if now.Sub(limiter.lastDecrease) >= latency {
+		limiter.lastDecrease = now
+		limiter.limit *= adaptiveDecrease
+		if limiter.limit < limiter.minLimit {
+			limiter.limit = limiter.minLimit
+		}
+	}
+}
+
+// inherit continues the limit that previous, the limiter of the same upstream
+// in the routing table being replaced, has learned, within the bounds of
+// limiter.
+func (limiter *adaptiveLimiter) inherit(previous *adaptiveLimiter) {
+	if limiter == nil || previous == nil {
+		return
+	}
+	previous.mutex.Lock()
+	limit, lastDecrease := previous.limit, previous.lastDecrease
+	previous.mutex.Unlock()
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.limit = math.Max(limiter.minLimit,
+		math.Min(limiter.maxLimit, limit))
+	limiter.lastDecrease = lastDecrease
+}
+
+func (limiter *adaptiveLimiter) status() *limiterStatus {
+	if limiter == nil {
+		return nil
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return &limiterStatus{
+		Limit: int(limiter.limit), InFlight: limiter.inFlight,
+	}
+}
+
+// limitedHandler rejects requests to an upstream that exceed the limit of
+// its adaptiveLimiter for their priority class.
+type limitedHandler struct {
+	upstream     string
+	limiter      *adaptiveLimiter
+	handler      http.Handler
+	errorHandler ErrorHandler
+
+	// The upstream's default priority class, and the header that may
+	// override it
+	priority       string
+	priorityHeader string
+}
+
+func newLimitedHandler(upstream *AuthDelegateUpstream,
+	opts *AuthDelegateOptions, limiter *adaptiveLimiter,
+	handler http.Handler) *limitedHandler {
+	return &limitedHandler{
+		upstream:       upstreamLabel(upstream),
+		limiter:        limiter,
+		handler:        handler,
+		errorHandler:   opts.errorHandler(),
+		priority:       upstream.Priority,
+		priorityHeader: http.CanonicalHeaderKey(opts.PriorityHeader),
+	}
+}
+
+func (limited *limitedHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	class := requestPriority(req, limited.priorityHeader,
+		limited.priority)
+	if !limited.limiter.acquire(class) {
+		limited.errorHandler(rw, req, &DelegateError{
+			Code: ErrUpstreamOverloaded, Upstream: limited.upstream,
+		})
+		return
+	}
+	recorder := &statusRecorder{rw, http.StatusOK}
+	start := time.Now()
+	defer func() {
+		limited.limiter.release(time.Since(start),
+			recorder.status >= http.StatusInternalServerError)
+	}()
+	limited.handler.ServeHTTP(recorder, req)
+}
@@ -0,0 +1,134 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Adaptive concurrency limits", func() {
+	var limiter *adaptiveLimiter
+
+	BeforeEach(func() {
+		limiter = newAdaptiveLimiter(&AuthDelegateUpstream{
+			AdaptiveConcurrency: &AuthDelegateAdaptiveConcurrency{
+				MinLimit:      2,
+				MaxLimit:      4,
+				targetLatency: 10 * time.Millisecond,
+			},
+		})
+	})
+
+	It("should reject requests beyond the limit", func() {
+		for i := 0; i != 4; i++ {
+			Expect(limiter.acquire(priorityHigh)).To(BeTrue())
+		}
+		Expect(limiter.acquire(priorityHigh)).To(BeFalse())
+		limiter.release(time.Millisecond, false)
+		Expect(limiter.acquire(priorityHigh)).To(BeTrue())
+	})
+
+	It("should reserve part of the limit for high priority", func() {
+		Expect(limiter.acquire(priorityLow)).To(BeTrue())
+		Expect(limiter.acquire(priorityLow)).To(BeTrue())
+		Expect(limiter.acquire(priorityLow)).To(BeFalse())
+		Expect(limiter.acquire(priorityHigh)).To(BeTrue())
+		Expect(limiter.acquire(priorityHigh)).To(BeTrue())
+		Expect(limiter.acquire(priorityHigh)).To(BeFalse())
+	})
+
+	It("should decrease the limit at most once per round trip", func() {
+		limiter.acquire(priorityHigh)
+		limiter.release(time.Second, false)
+		Expect(limiter.status().Limit).To(Equal(3))
+		limiter.acquire(priorityHigh)
+		limiter.release(time.Second, true)
+		Expect(limiter.limit).To(BeNumerically("~", 3.6))
+
+		limiter.lastDecrease = time.Time{}
+		for i := 0; i != 10; i++ {
+			limiter.acquire(priorityHigh)
+			limiter.release(0, true)
+			limiter.lastDecrease = time.Time{}
+		}
+		Expect(limiter.status()).To(Equal(
+			&limiterStatus{Limit: 2, InFlight: 0}))
+	})
+
+	It("should increase the limit additively up to the maximum", func() {
+		limiter.limit = 2
+		for i := 0; i != 2; i++ {
+			limiter.acquire(priorityHigh)
+			limiter.release(time.Millisecond, false)
+		}
+		Expect(limiter.status().Limit).To(Equal(2))
+		for i := 0; i != 100; i++ {
+			limiter.acquire(priorityHigh)
+			limiter.release(time.Millisecond, false)
+		}
+		Expect(limiter.status().Limit).To(Equal(4))
+	})
+
+	It("should return 503 when the limit is reached", func() {
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				<-release
+			}))
+		defer upstream.Close()
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{{
+				URL: upstream.URL,
+				AdaptiveConcurrency: &AuthDelegateAdaptiveConcurrency{
+					TargetLatency: "1s",
+					MaxLimit:      1,
+				},
+			}},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		done := make(chan int)
+		go func() {
+			recorder := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			handler.ServeHTTP(recorder, req)
+			done <- recorder.Code
+		}()
+		limiter := handler.(*authDelegateHandler).routes().
+			upstreams[0].limiter
+		Eventually(func() int {
+			return limiter.status().InFlight
+		}).Should(Equal(1))
+
+		recorder := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+		close(release)
+		Expect(<-done).To(Equal(http.StatusOK))
+	})
+
+	It("should fail validation for invalid limits", func() {
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{{
+				URL: "http://localhost",
+				AdaptiveConcurrency: &AuthDelegateAdaptiveConcurrency{
+					MinLimit: 5,
+					MaxLimit: 4,
+				},
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"adaptive_concurrency target_latency must be specified: " +
+				"http://localhost",
+			"adaptive_concurrency requires 0 < min_limit <= " +
+				"max_limit: http://localhost",
+		})))
+	})
+})
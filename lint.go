@@ -0,0 +1,168 @@
+package authdelegate
+
+import "net"
+
+// Lint checks a validated AuthDelegateOptions configuration for patterns that
+// are legal, but likely mistakes. Returns a message describing each problem
+// and how to fix it.
+func (opts *AuthDelegateOptions) Lint() (warnings []string) {
+	warnings = lintRedundantMatchers(opts, warnings)
+	warnings = lintConflictingOptions(opts, warnings)
+	warnings = lintPlaintextUpstreams(opts, warnings)
+	warnings = lintDenyCacheTTL(opts, warnings)
+	warnings = lintFailOpenEverything(opts, warnings)
+	warnings = lintMissingFailPolicies(opts, warnings)
+	return
+}
+
+// lintRedundantMatchers detects upstreams with a header or cookie matcher
+// that route to the same URL as the default upstream, which would receive the
+// same requests without the matcher.
+func lintRedundantMatchers(opts *AuthDelegateOptions,
+	warnings []string) []string {
+	numUpstreams := len(opts.Upstreams)
+	if numUpstreams == 0 {
+		return warnings
+	}
+	last := opts.Upstreams[numUpstreams-1]
+	if !last.isDefault() {
+		return warnings
+	}
+	for _, upstream := range opts.Upstreams[:numUpstreams-1] {
+		if upstream.URL == last.URL {
+			warnings = append(warnings, "upstream "+
+				upstreamLabel(upstream)+" has the same URL as "+
+				"the default upstream; remove it unless its "+
+				"options differ intentionally")
+		}
+	}
+	return warnings
+}
+
+// lintConflictingOptions detects upstreams with the same URL but different
+// transport options, which suggests one of them was updated and the other
+// forgotten.
+func lintConflictingOptions(opts *AuthDelegateOptions,
+	warnings []string) []string {
+	first := make(map[string]*AuthDelegateUpstream)
+	for _, upstream := range opts.Upstreams {
+		earlier, ok := first[upstream.URL]
+		if !ok {
+			first[upstream.URL] = upstream
+			continue
+		}
+		if earlier.expectContinueTimeout !=
+			upstream.expectContinueTimeout ||
+			earlier.timeout != upstream.timeout ||
+			earlier.ClientCert != upstream.ClientCert ||
+			earlier.ClientCA != upstream.ClientCA ||
+			earlier.DisableChunkedRequests !=
+				upstream.DisableChunkedRequests {
+			warnings = append(warnings, "upstreams "+
+				upstreamLabel(earlier)+" and "+
+				upstreamLabel(upstream)+" share URL "+
+				upstream.URL+" but have different transport "+
+				"options; make them consistent")
+		}
+	}
+	return warnings
+}
+
+// lintPlaintextUpstreams detects http:// upstreams on hosts other than the
+// loopback interface, since credentials would cross the network unencrypted.
+func lintPlaintextUpstreams(opts *AuthDelegateOptions,
+	warnings []string) []string {
+	for _, upstream := range opts.Upstreams {
+		if upstream.parsedURL == nil ||
+			upstream.parsedURL.Scheme != "http" {
+			continue
+		}
+		host := upstream.parsedURL.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if ip := net.ParseIP(host); host == "localhost" ||
+			(ip != nil && ip.IsLoopback()) {
+			continue
+		}
+		warnings = append(warnings, "upstream "+upstreamLabel(upstream)+
+			" uses plaintext HTTP to a remote host; credentials "+
+			"will be sent unencrypted; use https instead")
+	}
+	return warnings
+}
+
+// lintDenyCacheTTL detects upstreams that cache denials at least as long as
+// approvals, which would keep users locked out long after they reauthenticate
+// with the same credential.
+func lintDenyCacheTTL(opts *AuthDelegateOptions, warnings []string) []string {
+	for _, upstream := range opts.Upstreams {
+		if upstream.denyCacheTTL == 0 || upstream.cacheTTL == 0 ||
+			upstream.denyCacheTTL < upstream.cacheTTL {
+			continue
+		}
+		warnings = append(warnings, "upstream "+upstreamLabel(upstream)+
+			" caches denials at least as long as approvals; make "+
+			"deny_cache_ttl shorter than cache_ttl")
+	}
+	return warnings
+}
+
+// lintFailOpenEverything detects fail-open policies covering every path,
+// which would allow any request whenever the upstream is down.
+func lintFailOpenEverything(opts *AuthDelegateOptions,
+	warnings []string) []string {
+	for _, upstream := range opts.Upstreams {
+		if upstream.FailOpen == nil {
+			continue
+		}
+		for _, prefix := range upstream.FailOpen.PathPrefixes {
+			if prefix == "/" {
+				warnings = append(warnings, "upstream "+
+					upstreamLabel(upstream)+" fails open for "+
+					"every path; list only low-risk path "+
+					"prefixes")
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// lintMissingFailPolicies detects upstreams reached over the network without
+// a circuit_breaker or fail-open policy when another upstream has one, which
+// suggests the policy was added to one and the others forgotten. Requests
+// for such an upstream wait out its timeout for as long as it is down.
+func lintMissingFailPolicies(opts *AuthDelegateOptions,
+	warnings []string) []string {
+	var example *AuthDelegateUpstream
+	for _, upstream := range opts.Upstreams {
+		if hasFailPolicy(upstream) {
+			example = upstream
+			break
+		}
+	}
+	if example == nil {
+		return warnings
+	}
+	for _, upstream := range opts.Upstreams {
+		if upstream.parsedURL == nil ||
+			upstreamAddress(upstream.parsedURL) == "" ||
+			hasFailPolicy(upstream) {
+			continue
+		}
+		warnings = append(warnings, "upstream "+upstreamLabel(upstream)+
+			" has no circuit_breaker, fail_open, or on_error "+
+			"policy, unlike upstream "+upstreamLabel(example)+
+			"; define one, or requests will wait out its timeout "+
+			"while it is down")
+	}
+	return warnings
+}
+
+// hasFailPolicy returns true if upstream limits the effect of its outages on
+// requests.
+func hasFailPolicy(upstream *AuthDelegateUpstream) bool {
+	return upstream.CircuitBreaker != nil || upstream.FailOpen != nil ||
+		upstream.OnError == onErrorFailOpen
+}
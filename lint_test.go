@@ -0,0 +1,101 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration linting", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{Port: 8080}
+	})
+
+	addUpstream := func(
+		url, headerName, cookieName string) *AuthDelegateUpstream {
+		upstream := &AuthDelegateUpstream{
+			URL:        url,
+			HeaderName: headerName,
+			CookieName: cookieName,
+		}
+		opts.Upstreams = append(opts.Upstreams, upstream)
+		return upstream
+	}
+
+	lint := func() []string {
+		Expect(opts.Validate()).To(BeNil())
+		return opts.Lint()
+	}
+
+	It("should not warn about a sensible configuration", func() {
+		addUpstream("https://foo.com/auth", "", "_oauth2_proxy")
+		addUpstream("http://127.0.0.1:8080/auth", "X-Signature", "")
+		addUpstream("http://localhost/auth", "", "")
+		Expect(lint()).To(BeEmpty())
+	})
+
+	It("should warn about matchers redundant with the default", func() {
+		addUpstream("https://foo.com/auth", "X-Signature", "").Name =
+			"hmac"
+		addUpstream("https://foo.com/auth", "", "")
+		Expect(lint()).To(Equal([]string{
+			"upstream hmac has the same URL as the default " +
+				"upstream; remove it unless its options differ " +
+				"intentionally",
+		}))
+	})
+
+	It("should warn about conflicting options for the same URL", func() {
+		addUpstream("https://foo.com/auth", "X-Signature", "").Name =
+			"hmac"
+		addUpstream("https://foo.com/auth", "", "_cookie").
+			DisableChunkedRequests = true
+		Expect(lint()).To(Equal([]string{
+			"upstreams hmac and https://foo.com/auth share URL " +
+				"https://foo.com/auth but have different " +
+				"transport options; make them consistent",
+		}))
+	})
+
+	It("should warn about plaintext remote upstreams", func() {
+		addUpstream("http://foo.com/auth", "", "")
+		Expect(lint()).To(Equal([]string{
+			"upstream http://foo.com/auth uses plaintext HTTP to a " +
+				"remote host; credentials will be sent " +
+				"unencrypted; use https instead",
+		}))
+	})
+
+	It("should warn about denials cached as long as approvals", func() {
+		upstream := addUpstream("https://foo.com/auth", "", "_cookie")
+		upstream.CacheTTL = "30s"
+		upstream.DenyCacheTTL = "1m"
+		Expect(lint()).To(Equal([]string{
+			"upstream https://foo.com/auth caches denials at least " +
+				"as long as approvals; make deny_cache_ttl " +
+				"shorter than cache_ttl",
+		}))
+	})
+
+	It("should warn about upstreams missing a fail policy", func() {
+		addUpstream("https://foo.com/auth", "", "_cookie").
+			CircuitBreaker = &AuthDelegateCircuitBreaker{}
+		addUpstream("https://bar.com/auth", "X-Api-Key", "").Name =
+			"api"
+		addUpstream("https://baz.com/auth", "X-Token", "").OnError =
+			"fail_open"
+		addUpstream("", "X-Static-Token", "").Type = "static_tokens"
+		opts.Upstreams[3].Name = "tokens"
+		opts.Upstreams[3].TokenHashes = []string{
+			hashCredential("token"),
+		}
+		Expect(lint()).To(Equal([]string{
+			"upstream api has no circuit_breaker, fail_open, or " +
+				"on_error policy, unlike upstream " +
+				"https://foo.com/auth; define one, or " +
+				"requests will wait out its timeout while it " +
+				"is down",
+		}))
+	})
+})
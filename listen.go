@@ -0,0 +1,243 @@
+package authdelegate
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultShutdownGracePeriod is how long to wait for requests in flight to
+// complete on shutdown unless shutdown_grace_period is specified.
+const defaultShutdownGracePeriod = 30 * time.Second
+
+// unixSocketScheme prefixes the path of the Unix domain socket in listen.
+const unixSocketScheme = "unix://"
+
+// defaultUnixSocketMode are the permissions of the listen socket unless
+// unix_socket_mode is specified.
+const defaultUnixSocketMode = 0660
+
+// maxSocketPathLength is the longest socket path that every supported
+// platform accepts.
+const maxSocketPathLength = 104
+
+// listenerContextKey identifies the additional listener, if any, on which a
+// request was received.
+type listenerContextKey struct{}
+
+// requestListener returns the name of the additional listener on which req
+// was received, or the empty string if it was received on the main port.
+func requestListener(req *http.Request) string {
+	name, _ := req.Context().Value(listenerContextKey{}).(string)
+	return name
+}
+
+// listen opens the listeners for the main port: one, or several sharing the
+// port via SO_REUSEPORT if opts.ReusePort is set, followed by the listen
+// socket, if any. Either may be absent, but not both.
+func listen(opts *AuthDelegateOptions) (listeners []net.Listener, err error) {
+	if opts.Port != 0 {
+		if listeners, err = listenPort(opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.socketPath != "" {
+		var listener net.Listener
+		listener, err = listenUnix(opts.socketPath, opts.unixSocketMode)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return
+}
+
+// listenUnix opens a listener on the Unix domain socket at path with the
+// permissions of mode, first removing a stale socket left at path by a
+// process that didn't exit cleanly. The socket is removed when the listener
+// is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil &&
+		info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, errors.New("another process is listening " +
+				"on " + path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func listenPort(opts *AuthDelegateOptions) (listeners []net.Listener,
+	err error) {
+	address := ":" + strconv.Itoa(opts.Port)
+	if !opts.ReusePort {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", address); err != nil {
+			return nil, err
+		}
+		return []net.Listener{listener}, nil
+	}
+
+	numListeners := opts.ReusePortListeners
+	if numListeners == 0 {
+		numListeners = runtime.NumCPU()
+	}
+	for i := 0; i != numListeners; i++ {
+		var listener net.Listener
+		if listener, err = listenReusePort(address); err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return
+}
+
+// serve accepts connections for server, whose handler must have been created
+// by NewAuthDelegate, on each of the listeners for the main port, and on each
+// of opts.Listeners, each in its own goroutine, until ctx is done. If opts
+// defines a plaintext listener, it is served as well. Then it deregisters,
+// stops accepting connections, and waits for requests in flight to complete,
+// for up to the shutdown grace period. Returns the first
+// error from any of the listeners, or an error if the grace period expires.
+func serve(ctx context.Context, server *http.Server,
+	opts *AuthDelegateOptions) error {
+	listeners, err := listen(opts)
+	if err != nil {
+		return err
+	}
+	servers := make([]*http.Server, len(listeners))
+	for i := range servers {
+		servers[i] = server
+	}
+	distinct := []*http.Server{server}
+	for _, config := range opts.Listeners {
+		listenerServer, err := newListenerServer(server, config, opts)
+		var listener net.Listener
+		if err == nil {
+			listener, err = net.Listen("tcp", config.Address)
+		}
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+		servers = append(servers, listenerServer)
+		distinct = append(distinct, listenerServer)
+	}
+	handler := server.Handler.(*authDelegateHandler)
+	server.RegisterOnShutdown(handler.subscriptions.closeAll)
+	errs := make(chan error, len(listeners)+1)
+	if config := opts.PlaintextListener; config != nil {
+		listener, err := net.Listen("tcp", config.Address)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return err
+		}
+		plaintext := newPlaintextServer(server.Handler, opts)
+		distinct = append(distinct, plaintext)
+		go func() { errs <- plaintext.Serve(listener) }()
+	}
+	for i, listener := range listeners {
+		go func(listenerServer *http.Server, listener net.Listener) {
+			if listenerServer.TLSConfig != nil {
+				errs <- listenerServer.ServeTLS(listener, "", "")
+			} else if opts.SslCert != "" && listenerServer == server {
+				errs <- server.ServeTLS(listener, opts.SslCert,
+					opts.SslKey)
+			} else {
+				errs <- listenerServer.Serve(listener)
+			}
+		}(servers[i], listener)
+	}
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	deregister(server.Handler, opts)
+	gracePeriod := opts.shutdownGracePeriod
+	if opts.ShutdownGracePeriod == "" {
+		gracePeriod = defaultShutdownGracePeriod
+	}
+	handler.setShutdownPhase(shutdownDraining)
+	log.Printf("shutting down; waiting up to %s for %d requests in flight",
+		gracePeriod, handler.requestsInFlight())
+	err = shutdown(distinct, gracePeriod)
+	handler.exporter.shutdown()
+	return err
+}
+
+// shutdown gracefully shuts down each of servers concurrently, waiting for
+// up to gracePeriod for requests in flight to complete.
+func shutdown(servers []*http.Server, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				errs <- err
+			}
+		}(server)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return errors.New("shutdown grace period expired " +
+				"with requests in flight")
+		}
+		return err
+	}
+	return nil
+}
+
+// newListenerServer returns a server for an additional listener, whose
+// requests are handled by the handler of server and identified by
+// requestListener, with the TLS settings of the listener.
+func newListenerServer(server *http.Server, config *AuthDelegateListener,
+	opts *AuthDelegateOptions) (*http.Server, error) {
+	name := config.listenerName()
+	tlsConfig, err := listenerTLSConfig(server, config, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Handler:   server.Handler,
+		TLSConfig: tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(),
+				listenerContextKey{}, name)
+		},
+	}, nil
+}
@@ -0,0 +1,347 @@
+package authdelegate
+
+import (
+	"context"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Main port listeners", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		// Find a free port by letting the kernel choose one.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		opts = &AuthDelegateOptions{Port: port}
+	})
+
+	closeAll := func(listeners []net.Listener) {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	It("should open a single listener by default", func() {
+		listeners, err := listen(opts)
+		Expect(err).To(BeNil())
+		defer closeAll(listeners)
+		Expect(listeners).To(HaveLen(1))
+	})
+
+	It("should open multiple listeners on one port if configured", func() {
+		if !reusePortSupported {
+			Skip("SO_REUSEPORT not supported")
+		}
+		opts.ReusePort = true
+		opts.ReusePortListeners = 3
+		listeners, err := listen(opts)
+		Expect(err).To(BeNil())
+		defer closeAll(listeners)
+		Expect(listeners).To(HaveLen(3))
+		for _, listener := range listeners {
+			Expect(listener.Addr().String()).To(
+				HaveSuffix(":" + strconv.Itoa(opts.Port)))
+		}
+	})
+
+	It("should fail validation if listeners set without reuse_port",
+		func() {
+			opts.ReusePortListeners = 2
+			opts.Upstreams = []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://127.0.0.1/"},
+			}
+			err := opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"reuse_port_listeners requires reuse_port",
+			})))
+		})
+
+	It("should apply listener overrides to requests it receives", func() {
+		newServer := func(status int) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					rw.WriteHeader(status)
+				}))
+		}
+		stepUp := newServer(http.StatusUnauthorized)
+		defer stepUp.Close()
+		sso := newServer(http.StatusAccepted)
+		defer sso.Close()
+		opts.Upstreams = []*AuthDelegateUpstream{
+			{Name: "step-up", URL: stepUp.URL, PathPrefix: "/admin"},
+			{Name: "sso", URL: sso.URL},
+		}
+		opts.Listeners = []*AuthDelegateListener{{
+			Name:          "internal",
+			Address:       "127.0.0.1:0",
+			SkipUpstreams: []string{"step-up"},
+		}}
+		Expect(opts.Validate()).To(BeNil())
+		main := &http.Server{Handler: NewAuthDelegate(opts)}
+
+		internal, err := newListenerServer(main, opts.Listeners[0], opts)
+		Expect(err).To(BeNil())
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		go internal.Serve(listener)
+		defer internal.Close()
+
+		status := func(url string) int {
+			req, _ := http.NewRequest("GET", url, nil)
+			req.Header.Set("X-Original-URI", "/admin/users")
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).To(BeNil())
+			res.Body.Close()
+			return res.StatusCode
+		}
+		Expect(status("http://" + listener.Addr().String() + "/")).
+			To(Equal(http.StatusAccepted))
+		external := httptest.NewServer(main.Handler)
+		defer external.Close()
+		Expect(status(external.URL + "/")).
+			To(Equal(http.StatusUnauthorized))
+	})
+
+	Context("on shutdown", func() {
+		var upstream *httptest.Server
+		var received chan struct{}
+		var release chan struct{}
+
+		BeforeEach(func() {
+			received = make(chan struct{}, 1)
+			release = make(chan struct{})
+			upstream = httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					received <- struct{}{}
+					<-release
+					rw.WriteHeader(http.StatusAccepted)
+				}))
+			opts.Upstreams = []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: upstream.URL},
+			}
+		})
+
+		AfterEach(func() {
+			upstream.Close()
+		})
+
+		address := func() string {
+			return "127.0.0.1:" + strconv.Itoa(opts.Port)
+		}
+
+		// start serves until the returned cancel function is called,
+		// after sending a request that blocks until release is closed.
+		start := func() (context.CancelFunc, chan error, chan int) {
+			Expect(opts.Validate()).To(BeNil())
+			server := &http.Server{Handler: NewAuthDelegate(opts)}
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- serve(ctx, server, opts) }()
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", address())
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(Succeed())
+			statuses := make(chan int, 1)
+			go func() {
+				res, err := http.Get("http://" + address() + "/")
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				res.Body.Close()
+				statuses <- res.StatusCode
+			}()
+			Eventually(received).Should(Receive())
+			return cancel, served, statuses
+		}
+
+		It("should complete requests in flight", func() {
+			cancel, served, statuses := start()
+			cancel()
+			Consistently(served, 50*time.Millisecond).ShouldNot(Receive())
+			close(release)
+			Eventually(statuses).Should(Receive(Equal(http.StatusAccepted)))
+			Eventually(served).Should(Receive(BeNil()))
+			_, err := net.Dial("tcp", address())
+			Expect(err).ToNot(BeNil())
+		})
+
+		It("should give up once the grace period expires", func() {
+			opts.ShutdownGracePeriod = "20ms"
+			cancel, served, _ := start()
+			defer close(release)
+			cancel()
+			var err error
+			Eventually(served).Should(Receive(&err))
+			Expect(err).To(MatchError("shutdown grace period expired " +
+				"with requests in flight"))
+		})
+
+		It("should end decision streams", func() {
+			opts.SubscribePath = "/subscribe"
+			opts.Upstreams[0].HeaderName = "X-Api-Key"
+			Expect(opts.Validate()).To(BeNil())
+			server := &http.Server{Handler: NewAuthDelegate(opts)}
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() { served <- serve(ctx, server, opts) }()
+			var res *http.Response
+			Eventually(func() error {
+				req, _ := http.NewRequest("GET",
+					"http://"+address()+"/subscribe", nil)
+				req.Header.Set("X-Api-Key", "key")
+				var err error
+				res, err = http.DefaultClient.Do(req)
+				return err
+			}).Should(Succeed())
+			defer res.Body.Close()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			cancel()
+			Eventually(served, time.Second).Should(Receive(BeNil()))
+		})
+	})
+
+	It("should fail validation for invalid listeners", func() {
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{URL: "http://127.0.0.1/"},
+		}
+		opts.Listeners = []*AuthDelegateListener{
+			{Address: "127.0.0.1", SkipUpstreams: []string{"sso"}},
+			{Name: "internal", Address: "127.0.0.1:8081"},
+			{Name: "internal", Address: "127.0.0.1:8082"},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid listener address: address 127.0.0.1: " +
+				"missing port in address",
+			"listener 127.0.0.1 skips unknown upstream: sso",
+			"repeated listener names: internal",
+		})))
+	})
+})
+
+var _ = Describe("Unix socket listener", func() {
+	var dir, path string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "socket")
+		Expect(err).To(BeNil())
+		path = filepath.Join(dir, "authdelegate.sock")
+		opts = &AuthDelegateOptions{
+			Listen: "unix://" + path,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://127.0.0.1/"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should serve requests on the socket without a port", func() {
+		upstream := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		defer upstream.Close()
+		opts.Upstreams[0].URL = upstream.URL
+		Expect(opts.Validate()).To(BeNil())
+		server := &http.Server{Handler: NewAuthDelegate(opts)}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- serve(ctx, server, opts) }()
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context,
+				network, address string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		}}
+		Eventually(func() error {
+			res, err := client.Get("http://delegate/")
+			if err == nil {
+				res.Body.Close()
+				if res.StatusCode != http.StatusAccepted {
+					return errors.New(res.Status)
+				}
+			}
+			return err
+		}).Should(Succeed())
+		info, err := os.Stat(path)
+		Expect(err).To(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+
+		cancel()
+		Eventually(served).Should(Receive(BeNil()))
+		_, err = os.Stat(path)
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should replace a stale socket but not a live one", func() {
+		stale, err := net.Listen("unix", path)
+		Expect(err).To(BeNil())
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+
+		listener, err := listenUnix(path, 0600)
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		info, err := os.Stat(path)
+		Expect(err).To(BeNil())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+		_, err = listenUnix(path, 0600)
+		Expect(err).To(MatchError("another process is listening on " +
+			path))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Listen = "/run/authdelegate.sock"
+		opts.UnixSocketMode = "rw-rw----"
+		opts.ReusePort = true
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid unix_socket_mode: rw-rw----",
+			"listen must be a unix:// socket path: " +
+				"/run/authdelegate.sock",
+			"reuse_port requires port",
+		})))
+
+		opts.Listen = "unix://"
+		opts.UnixSocketMode = "1777"
+		opts.ReusePort = false
+		opts.PlaintextListener = &AuthDelegatePlaintextListener{
+			Address: ":8080",
+			Mode:    "redirect",
+		}
+		opts.SslCert, opts.SslKey = "cert.pem", "key.pem"
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(
+			"\n  invalid unix_socket_mode: 1777\n  " +
+				"listen must include a socket path: unix://\n"))
+		Expect(err.Error()).To(ContainSubstring(
+			"plaintext_listener mode redirect requires port"))
+	})
+})
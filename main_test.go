@@ -1,4 +1,4 @@
-package main
+package authdelegate
 
 import (
 	. "github.com/onsi/ginkgo"
@@ -0,0 +1,195 @@
+package authdelegate
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Values of match_policy, which decides which of several upstreams that
+// accept a request decides it
+const (
+	// The first upstream to accept the request, in configuration order
+	matchFirst = "first"
+
+	// The upstream whose conditions are narrowest, per moreSpecific
+	matchMostSpecific = "most_specific"
+
+	// None: the request is refused with ErrAmbiguousMatch
+	matchReject = "reject"
+)
+
+// matchSpecificity ranks how narrowly the conditions of an upstream match
+// requests, for the most_specific match policy. Hosts outrank paths, which
+// outrank the remaining conditions.
+type matchSpecificity struct {
+	// Whether the upstream matches a single host, rather than a wildcard
+	exactHost bool
+
+	// Lengths of the host or wildcard and of the path prefix, if any
+	host       int
+	pathPrefix int
+
+	// Number of header or cookie names, cookie value, header value,
+	// auth_scheme, traffic, match_expression, match, methods, and plugin
+	// conditions
+	conditions int
+}
+
+func newMatchSpecificity(upstream *AuthDelegateUpstream) matchSpecificity {
+	specificity := matchSpecificity{
+		exactHost: upstream.Host != "" &&
+			!strings.HasPrefix(upstream.Host, "*."),
+		host:       len(upstream.Host),
+		pathPrefix: len(strings.TrimSuffix(upstream.PathPrefix, "/")),
+	}
+	for _, condition := range []string{
+		upstream.HeaderName, upstream.CookieName,
+		upstream.CookieValuePrefix + upstream.CookieValuePattern,
+		upstream.AuthScheme, upstream.Traffic, upstream.MatchExpression,
+	} {
+		if condition != "" {
+			specificity.conditions++
+		}
+	}
+	if pluginMayMatch(upstream) {
+		specificity.conditions++
+	}
+	if upstream.Match != nil {
+		specificity.conditions++
+	}
+	if len(upstream.Methods) != 0 {
+		specificity.conditions++
+	}
+	specificity.conditions += len(upstream.HeaderValueRegex)
+	return specificity
+}
+
+// moreSpecific returns true if specificity ranks strictly above other.
+func (specificity matchSpecificity) moreSpecific(
+	other matchSpecificity) bool {
+	if specificity.exactHost != other.exactHost {
+		return specificity.exactHost
+	} else if specificity.host != other.host {
+		return specificity.host > other.host
+	} else if specificity.pathPrefix != other.pathPrefix {
+		return specificity.pathPrefix > other.pathPrefix
+	}
+	return specificity.conditions > other.conditions
+}
+
+// chooseUpstream returns the upstream that decides a request accepted by
+// matches, which are in configuration order, under table's match policy. A
+// default upstream decides only requests that no other upstream accepts.
+// Returns nil if the policy is reject and more than one upstream accepts
+// the request.
+func (table *routingTable) chooseUpstream(
+	matches []*authDelegate) *authDelegate {
+	if last := len(matches) - 1; last > 0 && matches[last].isDefault {
+		matches = matches[:last]
+	}
+	if len(matches) == 0 {
+		return nil
+	} else if table.matchPolicy == matchReject && len(matches) > 1 {
+		return nil
+	}
+	chosen := matches[0]
+	for _, upstream := range matches[1:] {
+		if upstream.specificity.moreSpecific(chosen.specificity) {
+			chosen = upstream
+		}
+	}
+	return chosen
+}
+
+// ambiguousMatchError reports the upstreams that all accept req under the
+// reject match policy.
+func ambiguousMatchError(matches []*authDelegate) *DelegateError {
+	var names []string
+	for _, upstream := range matches {
+		if !upstream.isDefault {
+			names = append(names, upstream.name)
+		}
+	}
+	return &DelegateError{
+		Code:     ErrAmbiguousMatch,
+		Upstream: strings.Join(names, ", "),
+	}
+}
+
+func validateMatchPolicy(opts *AuthDelegateOptions, msgs []string) []string {
+	switch opts.MatchPolicy {
+	case "", matchFirst, matchMostSpecific, matchReject:
+	default:
+		msgs = append(msgs, "match_policy must be first, "+
+			"most_specific, or reject: "+opts.MatchPolicy)
+	}
+	return msgs
+}
+
+// validateOverlappingUpstreams reports each pair of upstreams that the match
+// policy can't reconcile: under first, an upstream shadowed by an earlier
+// one can never match; under most_specific, neither can one shadowed by a
+// broader or equally specific one; and under reject, every request matching
+// one of a pair where one shadows the other is refused. Default upstreams
+// and repeated names are reported separately.
+func validateOverlappingUpstreams(opts *AuthDelegateOptions,
+	msgs []string) []string {
+	upstreams := opts.Upstreams
+	for i, later := range upstreams {
+		for _, earlier := range upstreams[:i] {
+			if opts.MatchPolicy == matchReject {
+				if shadows(earlier, later) ||
+					shadows(later, earlier) {
+					msgs = append(msgs, "upstreams "+
+						upstreamLabel(earlier)+" and "+
+						upstreamLabel(later)+" overlap, "+
+						"so match_policy reject refuses "+
+						"every request matching the "+
+						"narrower one")
+					break
+				}
+			} else if shadows(earlier, later) &&
+				!(opts.MatchPolicy == matchMostSpecific &&
+					newMatchSpecificity(later).moreSpecific(
+						newMatchSpecificity(earlier))) {
+				msgs = append(msgs, "upstream "+
+					upstreamLabel(later)+" is shadowed by "+
+					"earlier upstream "+
+					upstreamLabel(earlier)+
+					" and can never match")
+				break
+			}
+		}
+	}
+	return msgs
+}
+
+// acceptedBy returns the upstreams that accept req, in configuration order,
+// recording each evaluation in trace. Under the first match policy, it stops
+// at the first, and returns a slice of the table's upstreams rather than
+// allocating one.
+func (table *routingTable) acceptedBy(
+	req *http.Request, trace *requestTrace) []*authDelegate {
+	var skips map[string]bool
+	if table.listenerSkips != nil {
+		skips = table.listenerSkips[requestListener(req)]
+	}
+	var matches []*authDelegate
+	for i, upstream := range table.upstreams {
+		if skips[upstream.name] {
+			trace.evaluated(upstream, req, "skipped")
+		} else if !upstream.accepts(req) {
+			trace.evaluated(upstream, req, "miss")
+		} else if upstream.isDraining() {
+			trace.evaluated(upstream, req, "draining")
+		} else {
+			trace.evaluated(upstream, req, "match")
+			if table.matchPolicy == matchFirst ||
+				table.matchPolicy == "" {
+				return table.upstreams[i : i+1]
+			}
+			matches = append(matches, upstream)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,146 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Match policies", func() {
+	var upstream *httptest.Server
+	var selected string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				selected = req.URL.Path
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		selected = ""
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "session",
+					URL:        upstream.URL + "/session",
+					CookieName: "_session",
+				},
+				&AuthDelegateUpstream{
+					Name:       "admin",
+					URL:        upstream.URL + "/admin",
+					CookieName: "_admin",
+					Host:       "admin.example.gov",
+				},
+				&AuthDelegateUpstream{
+					Name:       "api",
+					URL:        upstream.URL + "/api",
+					CookieName: "_session",
+					PathPrefix: "/api",
+				},
+				&AuthDelegateUpstream{
+					Name: "fallback",
+					URL:  upstream.URL + "/fallback",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorize := func(cookies ...string) int {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/api/users")
+		req.Header.Set("X-Original-Host", "admin.example.gov")
+		for _, name := range cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: "x"})
+		}
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should choose the first matching upstream by default", func() {
+		upstreams := opts.Upstreams
+		opts.Upstreams = []*AuthDelegateUpstream{
+			upstreams[2], upstreams[1], upstreams[0], upstreams[3],
+		}
+		Expect(authorize("_session", "_admin")).To(
+			Equal(http.StatusAccepted))
+		Expect(selected).To(Equal("/api"))
+	})
+
+	It("should choose the most specific matching upstream", func() {
+		opts.MatchPolicy = "most_specific"
+		Expect(authorize("_session")).To(Equal(http.StatusAccepted))
+		Expect(selected).To(Equal("/api"))
+		Expect(authorize("_session", "_admin")).To(
+			Equal(http.StatusAccepted))
+		Expect(selected).To(Equal("/admin"))
+		Expect(authorize()).To(Equal(http.StatusAccepted))
+		Expect(selected).To(Equal("/fallback"))
+	})
+
+	It("should reject requests that match several upstreams", func() {
+		opts.MatchPolicy = "reject"
+		opts.Upstreams = append(opts.Upstreams[:2], opts.Upstreams[3])
+		Expect(authorize("_admin")).To(Equal(http.StatusAccepted))
+		Expect(selected).To(Equal("/admin"))
+		selected = ""
+		Expect(authorize("_session", "_admin")).To(
+			Equal(http.StatusConflict))
+		Expect(selected).To(BeEmpty())
+	})
+
+	It("should report the upstreams matching an ambiguous request", func() {
+		opts.MatchPolicy = "reject"
+		opts.Upstreams = append(opts.Upstreams[:2], opts.Upstreams[3])
+		var reported error
+		opts.ErrorHandler = func(rw http.ResponseWriter,
+			req *http.Request, err error) {
+			reported = err
+			rw.WriteHeader(errorStatus(err))
+		}
+		Expect(authorize("_session", "_admin")).To(
+			Equal(http.StatusConflict))
+		Expect(reported).To(MatchError(
+			"multiple upstreams match request: session, admin"))
+	})
+
+	It("should fail validation for overlaps the policy can't resolve",
+		func() {
+			opts.MatchPolicy = "most_specific"
+			Expect(opts.Validate()).To(BeNil())
+
+			opts.MatchPolicy = "reject"
+			err := opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"upstreams session and api overlap, so " +
+					"match_policy reject refuses every " +
+					"request matching the narrower one",
+			})))
+
+			opts.MatchPolicy = "first"
+			err = opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"upstream api is shadowed by earlier upstream " +
+					"session and can never match",
+			})))
+
+			opts.MatchPolicy = "best"
+			err = opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"match_policy must be first, most_specific, or " +
+					"reject: best",
+				"upstream api is shadowed by earlier upstream " +
+					"session and can never match",
+			})))
+		})
+})
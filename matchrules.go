@@ -0,0 +1,176 @@
+package authdelegate
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// compileMatch compiles a match block into an expression whose source
+// describes it, e.g.
+//
+//	all(header X-Api-Key, any(host *.example.gov, path_prefix /api))
+//
+// appending a message to msgs for each invalid block. The block is
+// translated into a match_expression, so that both are evaluated alike.
+func compileMatch(block *AuthDelegateMatch, upstreamURL string,
+	msgs []string) (*expression, []string) {
+	description, source, msgs := translateMatch(block, "match",
+		upstreamURL, msgs)
+	if source == "" {
+		return nil, msgs
+	}
+	compiled, err := compileExpression(source)
+	if err != nil {
+		return nil, append(msgs, "invalid match for "+upstreamURL+": "+
+			err.Error())
+	}
+	compiled.source = description
+	return compiled, msgs
+}
+
+// translateMatch returns the description of a match block and the
+// match_expression equivalent to it, or empty strings if the block is
+// invalid, appending a message to msgs for each invalid block. path is the
+// block's position in the configuration, e.g. "match.all[1]", for those
+// messages.
+func translateMatch(block *AuthDelegateMatch, path, upstreamURL string,
+	msgs []string) (string, string, []string) {
+	invalid := func(msg string) (string, string, []string) {
+		return "", "", append(msgs, "invalid match for "+upstreamURL+
+			": "+path+" "+msg)
+	}
+	if block == nil {
+		return invalid("must not be null")
+	}
+	defined := 0
+	for _, condition := range []bool{
+		block.Header != "", block.Cookie != "", block.Host != "",
+		block.PathPrefix != "", block.Method != "", block.All != nil,
+		block.Any != nil, block.Not != nil,
+	} {
+		if condition {
+			defined++
+		}
+	}
+	if defined != 1 {
+		return invalid("must define exactly one of header, cookie, " +
+			"host, path_prefix, method, all, any, or not")
+	}
+	if block.ValuePattern != "" && block.Header == "" &&
+		block.Cookie == "" {
+		return invalid("value_pattern requires header or cookie")
+	}
+	if _, err := regexp.Compile(block.ValuePattern); err != nil {
+		return invalid("value_pattern: " + err.Error())
+	}
+
+	switch {
+	case block.Header != "":
+		if strings.ContainsAny(block.Header, " \t\r\n:()<>@,;\\\"/[]?={}") {
+			return invalid("header is not a valid name: " + block.Header)
+		}
+		name := http.CanonicalHeaderKey(block.Header)
+		description, source := matchValue("header "+name,
+			"request.headers["+quoteExpression(name)+"]",
+			block.ValuePattern)
+		return description, source, msgs
+	case block.Cookie != "":
+		description, source := matchValue("cookie "+block.Cookie,
+			"request.cookies["+quoteExpression(block.Cookie)+"]",
+			block.ValuePattern)
+		return description, source, msgs
+	case block.Host != "":
+		host := strings.ToLower(block.Host)
+		source := "request.host.lowerAscii() == " + quoteExpression(host)
+		if strings.HasPrefix(host, "*.") {
+			source = "request.host.lowerAscii().endsWith(" +
+				quoteExpression(host[1:]) + ")"
+		}
+		return "host " + block.Host, source, msgs
+	case block.PathPrefix != "":
+		prefix := block.PathPrefix
+		if !strings.HasPrefix(prefix, "/") {
+			return invalid("path_prefix must begin with /: " + prefix)
+		}
+		source := "request.path.startsWith(" + quoteExpression(prefix) +
+			")"
+		if !strings.HasSuffix(prefix, "/") {
+			source = "(request.path == " + quoteExpression(prefix) +
+				" || request.path.startsWith(" +
+				quoteExpression(prefix+"/") + "))"
+		}
+		return "path_prefix " + prefix, source, msgs
+	case block.Method != "":
+		return "method " + block.Method,
+			"request.method.lowerAscii() == " +
+				quoteExpression(strings.ToLower(block.Method)), msgs
+	case block.Not != nil:
+		var description, source string
+		description, source, msgs = translateMatch(block.Not,
+			path+".not", upstreamURL, msgs)
+		if source == "" {
+			return "", "", msgs
+		}
+		return "not(" + description + ")", "!(" + source + ")", msgs
+	}
+
+	name, blocks, operator := "any", block.Any, " || "
+	if block.All != nil {
+		name, blocks, operator = "all", block.All, " && "
+	}
+	if len(blocks) == 0 {
+		return invalid(name + " must not be empty")
+	}
+	var descriptions, sources []string
+	for i, operandBlock := range blocks {
+		var description, source string
+		description, source, msgs = translateMatch(operandBlock,
+			path+"."+name+"["+strconv.Itoa(i)+"]", upstreamURL, msgs)
+		if source != "" {
+			descriptions = append(descriptions, description)
+			sources = append(sources, "("+source+")")
+		}
+	}
+	if len(sources) != len(blocks) {
+		return "", "", msgs
+	}
+	return name + "(" + strings.Join(descriptions, ", ") + ")",
+		strings.Join(sources, operator), msgs
+}
+
+// matchValue returns the description of a header or cookie condition, and
+// the expression that is true if the entry of a request map is present and,
+// if pattern isn't empty, its value contains a match for pattern.
+func matchValue(description, entry, pattern string) (string, string) {
+	if pattern == "" {
+		return description, "has(" + entry + ")"
+	}
+	return description + " matching " + pattern, "has(" + entry +
+		") && " + entry + ".matches(" + quoteExpression(pattern) + ")"
+}
+
+// quoteExpression returns s as a string literal of a match_expression.
+func quoteExpression(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`, "\n", `\n`,
+		"\t", `\t`).Replace(s) + "'"
+}
+
+func validateMatch(upstream *AuthDelegateUpstream, msgs []string) []string {
+	upstream.match = nil
+	if upstream.Match == nil {
+		return msgs
+	}
+	upstream.match, msgs = compileMatch(upstream.Match, upstream.URL, msgs)
+	return msgs
+}
+
+// matchSource returns the description of the compiled match block of
+// upstream, or the empty string if it has none.
+func matchSource(upstream *AuthDelegateUpstream) string {
+	if upstream.match == nil {
+		return ""
+	}
+	return upstream.match.source
+}
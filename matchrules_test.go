@@ -0,0 +1,171 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Composite match rules", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var match AuthDelegateMatch
+		Expect(json.Unmarshal([]byte(`{"all": [
+			{"cookie": "_partner_session"},
+			{"any": [
+				{"host": "*.partner.example.gov"},
+				{"path_prefix": "/partner"}]},
+			{"not": {"method": "delete"}}]}`), &match)).To(Succeed())
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "partner-api",
+					URL:        "http://localhost:8081",
+					HeaderName: "X-Api-Key",
+					Match:      &match,
+				},
+				&AuthDelegateUpstream{
+					Name: "default",
+					URL:  "http://localhost:8082",
+				},
+			},
+		}
+	})
+
+	selected := func(method, host, uri, cookie string) string {
+		Expect(opts.Validate()).To(BeNil())
+		table := newRoutingTable(opts)
+		req, _ := http.NewRequest(method, "http://"+host+"/", nil)
+		req.Header.Set("X-Original-URI", uri)
+		req.Header.Set("X-Api-Key", "key")
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		upstream := table.selectUpstream(req, nil)
+		return upstream.name + ": " + table.upstreams[0].explain(req)
+	}
+
+	It("should route requests satisfying the combination", func() {
+		const source = "match all(cookie _partner_session, " +
+			"any(host *.partner.example.gov, path_prefix /partner), " +
+			"not(method delete))"
+		Expect(selected("GET", "app.partner.example.gov", "/",
+			"_partner_session=abc")).To(Equal(
+			"partner-api: header X-Api-Key present"))
+		Expect(selected("POST", "example.gov", "/partner/orders",
+			"_partner_session=abc")).To(HavePrefix("partner-api: "))
+		Expect(selected("POST", "example.gov", "/partner/%2e%2e/orders",
+			"_partner_session=abc")).To(HavePrefix("default: "))
+		Expect(selected("GET", "example.gov", "/",
+			"_partner_session=abc")).To(Equal(
+			"default: " + source + " false"))
+		Expect(selected("DELETE", "app.partner.example.gov", "/",
+			"_partner_session=abc")).To(HavePrefix("default: "))
+		Expect(selected("GET", "app.partner.example.gov", "/",
+			"")).To(HavePrefix("default: "))
+	})
+
+	It("should match on header and cookie values alone", func() {
+		opts.Upstreams[0].HeaderName = ""
+		opts.Upstreams[0].Match = &AuthDelegateMatch{
+			Any: []*AuthDelegateMatch{
+				{Header: "x-tenant", ValuePattern: "^acme$"},
+				{Cookie: "_tenant*", ValuePattern: "^acme$"},
+			},
+		}
+		const source = "match any(header X-Tenant matching ^acme$, " +
+			"cookie _tenant* matching ^acme$)"
+		Expect(selected("GET", "example.gov", "/",
+			"_tenant_0=ac; _tenant_1=me")).To(Equal(
+			"partner-api: " + source + " true"))
+		Expect(selected("GET", "example.gov", "/",
+			"_tenant=acme2")).To(HavePrefix("default: "))
+	})
+
+	It("should translate blocks into match expressions", func() {
+		_, source, msgs := translateMatch(&AuthDelegateMatch{
+			All: []*AuthDelegateMatch{
+				{Header: "x-tenant", ValuePattern: `^'a\d'$`},
+				{Not: &AuthDelegateMatch{Host: "*.Example.gov"}},
+				{PathPrefix: "/partner"},
+				{Method: "get"},
+			},
+		}, "match", "http://localhost:8081", nil)
+		Expect(msgs).To(BeEmpty())
+		Expect(source).To(Equal(`(has(request.headers['X-Tenant']) && ` +
+			`request.headers['X-Tenant'].matches('^\'a\\d\'$')) && ` +
+			`(!(request.host.lowerAscii().endsWith('.example.gov'))) && ` +
+			`((request.path == '/partner' || ` +
+			`request.path.startsWith('/partner/'))) && ` +
+			`(request.method.lowerAscii() == 'get')`))
+
+		opts.Upstreams[0].HeaderName = ""
+		opts.Upstreams[0].Match = &AuthDelegateMatch{
+			Header: "X-Tenant", ValuePattern: `^'a\d'$`,
+		}
+		Expect(selected("GET", "example.gov", "/", "")).To(
+			HavePrefix("default: "))
+		opts.Upstreams[0].Match.ValuePattern = `^key$`
+		Expect(selected("GET", "example.gov", "/", "")).To(
+			HavePrefix("default: "))
+		opts.Upstreams[0].Match.Header = "X-Api-Key"
+		Expect(selected("GET", "example.gov", "/", "")).To(Equal(
+			"partner-api: match header X-Api-Key matching ^key$ true"))
+	})
+
+	It("should report upstreams shadowed by an earlier one", func() {
+		opts.Upstreams[0].HeaderName = ""
+		later := *opts.Upstreams[0]
+		later.Name = "partner-api-v2"
+		later.URL = "http://localhost:8083"
+		later.HeaderName = "X-Partner-Key"
+		opts.Upstreams = []*AuthDelegateUpstream{
+			opts.Upstreams[0], &later, opts.Upstreams[1],
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(
+			"upstream partner-api-v2 is shadowed by earlier upstream " +
+				"partner-api and can never match"))
+
+		later.Match = &AuthDelegateMatch{Method: "GET"}
+		Expect(opts.Validate()).To(BeNil())
+	})
+
+	It("should fail validation for invalid blocks", func() {
+		opts.Upstreams[0].Match = &AuthDelegateMatch{
+			All: []*AuthDelegateMatch{
+				{Header: "X-Api-Key", Cookie: "_session"},
+				{Any: []*AuthDelegateMatch{}},
+				{Not: &AuthDelegateMatch{PathPrefix: "partner"}},
+				{Host: "example.gov", ValuePattern: "x"},
+				{Cookie: "_session", ValuePattern: "("},
+				nil,
+			},
+		}
+		opts.Upstreams[1].Match = &AuthDelegateMatch{}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid match for http://localhost:8081: match.all[0] must " +
+				"define exactly one of header, cookie, host, path_prefix, " +
+				"method, all, any, or not",
+			"invalid match for http://localhost:8081: match.all[1] any " +
+				"must not be empty",
+			"invalid match for http://localhost:8081: match.all[2].not " +
+				"path_prefix must begin with /: partner",
+			"invalid match for http://localhost:8081: match.all[3] " +
+				"value_pattern requires header or cookie",
+			"invalid match for http://localhost:8081: match.all[4] " +
+				"value_pattern: error parsing regexp: missing closing ): `(`",
+			"invalid match for http://localhost:8081: match.all[5] must " +
+				"not be null",
+			"invalid match for http://localhost:8082: match must define " +
+				"exactly one of header, cookie, host, path_prefix, method, " +
+				"all, any, or not",
+		})))
+	})
+})
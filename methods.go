@@ -0,0 +1,72 @@
+package authdelegate
+
+import (
+	"net/http"
+	"strings"
+)
+
+// acceptsMethod returns true if this upstream isn't restricted to methods,
+// or if the original method of req is one of them.
+func (delegate *authDelegate) acceptsMethod(req *http.Request) bool {
+	if delegate.methods == nil {
+		return true
+	}
+	method := originalMethod(req)
+	for _, allowed := range delegate.methods {
+		if method == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedMethods returns the methods of the upstreams that would accept req
+// but for its method, in configuration order, or nil if there are none. A
+// request such upstreams don't accept is refused rather than falling
+// through to the default upstream, as it's likely that an upstream was
+// restricted to safe methods so that others are decided more strictly.
+func (table *routingTable) allowedMethods(req *http.Request) []string {
+	var skips map[string]bool
+	if table.listenerSkips != nil {
+		skips = table.listenerSkips[requestListener(req)]
+	}
+	var allowed []string
+	for _, upstream := range table.upstreams {
+		if upstream.methods == nil || skips[upstream.name] ||
+			upstream.isDraining() || !upstream.acceptsAnyMethod(req) {
+			continue
+		}
+		for _, method := range upstream.methods {
+			if !includesNames(allowed, []string{method}, sameName) {
+				allowed = append(allowed, method)
+			}
+		}
+	}
+	return allowed
+}
+
+// methodsCover returns true if every method later accepts is one that
+// earlier accepts.
+func methodsCover(earlier, later *AuthDelegateUpstream) bool {
+	if earlier.methods == nil {
+		return true
+	}
+	return includesNames(earlier.methods, later.methods, sameName)
+}
+
+func validateMethods(upstream *AuthDelegateUpstream, msgs []string) []string {
+	upstream.methods = nil
+	for _, method := range upstream.Methods {
+		if method == "" || strings.ContainsAny(method,
+			" \t\r\n:()<>@,;\\\"/[]?={}") {
+			msgs = append(msgs, "invalid methods for "+upstream.URL+": "+
+				method)
+			continue
+		}
+		method = strings.ToUpper(method)
+		if !includesNames(upstream.methods, []string{method}, sameName) {
+			upstream.methods = append(upstream.methods, method)
+		}
+	}
+	return msgs
+}
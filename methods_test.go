@@ -0,0 +1,123 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Method routing", func() {
+	var server *httptest.Server
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "reads",
+					URL:        server.URL,
+					CookieName: "_session",
+					Methods:    []string{"get", "HEAD"},
+				},
+				&AuthDelegateUpstream{
+					Name:       "writes",
+					URL:        server.URL,
+					CookieName: "_session",
+					Methods:    []string{"POST", "PUT", "PATCH", "DELETE"},
+				},
+				&AuthDelegateUpstream{Name: "default", URL: server.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	request := func(method string, session bool) *http.Request {
+		req, _ := http.NewRequest(method, "http://delegate/", nil)
+		req.Header.Set("X-Original-Method", method)
+		if session {
+			req.Header.Set("Cookie", "_session=abc")
+		}
+		return req
+	}
+
+	It("should route requests by method", func() {
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Upstreams[0].methods).To(Equal([]string{"GET", "HEAD"}))
+		table := newRoutingTable(opts)
+		selected := func(method string, session bool) string {
+			return table.selectUpstream(request(method, session), nil).name
+		}
+		Expect(selected("GET", true)).To(Equal("reads"))
+		Expect(selected("HEAD", true)).To(Equal("reads"))
+		Expect(selected("POST", true)).To(Equal("writes"))
+		Expect(selected("DELETE", true)).To(Equal("writes"))
+		Expect(selected("POST", false)).To(Equal("default"))
+		Expect(table.upstreams[0].explain(request("GET", true))).To(
+			Equal("cookie _session present"))
+		Expect(table.upstreams[0].explain(request("POST", true))).To(
+			Equal("method POST other than GET, HEAD"))
+	})
+
+	It("should refuse other methods rather than use the default", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		serve := func(req *http.Request) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			delegate.ServeHTTP(recorder, req)
+			return recorder
+		}
+		Expect(serve(request("GET", true)).Code).To(
+			Equal(http.StatusAccepted))
+		Expect(serve(request("OPTIONS", false)).Code).To(
+			Equal(http.StatusAccepted))
+
+		recorder := serve(request("OPTIONS", true))
+		Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(recorder.Header().Get("Allow")).To(Equal(
+			"GET, HEAD, POST, PUT, PATCH, DELETE"))
+		Expect(recorder.Body.String()).To(Equal("method not allowed\n"))
+	})
+
+	It("should refuse other methods without a default upstream", func() {
+		opts.Upstreams = opts.Upstreams[:1]
+		Expect(opts.Validate()).To(BeNil())
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, request("PUT", true))
+		Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+		Expect(recorder.Header().Get("Allow")).To(Equal("GET, HEAD"))
+	})
+
+	It("should report upstreams shadowed by an earlier one", func() {
+		opts.Upstreams[1].Methods = []string{"HEAD"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(
+			"upstream writes is shadowed by earlier upstream reads and " +
+				"can never match"))
+
+		opts.Upstreams[0].Methods = nil
+		opts.Upstreams[1].Methods = []string{"POST"}
+		opts.Upstreams[0], opts.Upstreams[1] = opts.Upstreams[1],
+			opts.Upstreams[0]
+		Expect(opts.Validate()).To(BeNil())
+	})
+
+	It("should fail validation for invalid methods", func() {
+		opts.Upstreams[0].Methods = []string{"GET", "", "BAD METHOD"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid methods for " + server.URL + ": ",
+			"invalid methods for " + server.URL + ": BAD METHOD",
+		})))
+	})
+})
@@ -0,0 +1,298 @@
+package authdelegate
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// countDecision records the status of a response returned for a request
+// routed to this upstream.
+func (delegate *authDelegate) countDecision(status int) {
+	switch decisionName(status) {
+	case "allow":
+		atomic.AddInt64(&delegate.allowed, 1)
+	case "deny":
+		atomic.AddInt64(&delegate.denied, 1)
+	default:
+		atomic.AddInt64(&delegate.failed, 1)
+	}
+}
+
+// decisionName returns the decision a response status conveys: allow (2xx),
+// deny (401 or 403), or error.
+func decisionName(status int) string {
+	if status/100 == 2 {
+		return "allow"
+	} else if status == http.StatusUnauthorized ||
+		status == http.StatusForbidden {
+		return "deny"
+	}
+	return "error"
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format.
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+// family writes the HELP and TYPE lines that precede the samples of a metric.
+func (writer metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(writer, "# HELP %s %s\n# TYPE %s %s\n", name, help, name,
+		kind)
+}
+
+// sample writes a sample of a metric, whose labels are alternating names and
+// values.
+func (writer metricsWriter) sample(name string, value interface{},
+	labels ...string) {
+	writer.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			writer.WriteByte('{')
+		} else {
+			writer.WriteByte(',')
+		}
+		fmt.Fprintf(writer, "%s=\"%s\"", labels[i],
+			metricsLabelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) != 0 {
+		writer.WriteByte('}')
+	}
+	fmt.Fprintf(writer, " %v\n", value)
+}
+
+var metricsLabelEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// histogram writes the samples of an upstream's latency histogram. Unless
+// the upstream defines latency_buckets, only the bound of every
+// latencyBucketsPerDoubling-th bucket is reported, to limit the number of
+// series, and the last bucket, which also counts latencies beyond its bound,
+// is reported only as +Inf.
+func (writer metricsWriter) histogram(name, upstream string,
+	histogram *latencyHistogram) {
+	var cumulative uint64
+	if histogram.exportBounds != nil {
+		for i, bound := range histogram.exportBounds {
+			cumulative += atomic.LoadUint64(&histogram.exportCounts[i])
+			writer.sample(name+"_bucket", cumulative,
+				"upstream", upstream, "le", fmt.Sprint(bound.Seconds()))
+		}
+		cumulative += atomic.LoadUint64(
+			&histogram.exportCounts[len(histogram.exportBounds)])
+	} else {
+		for i := 0; i != latencyBuckets; i++ {
+			cumulative += atomic.LoadUint64(&histogram.total[i])
+			if i%latencyBucketsPerDoubling == 0 && i != latencyBuckets-1 {
+				writer.sample(name+"_bucket", cumulative,
+					"upstream", upstream, "le",
+					fmt.Sprint(latencyBounds[i].Seconds()))
+			}
+		}
+	}
+	writer.sample(name+"_bucket", cumulative, "upstream", upstream,
+		"le", "+Inf")
+	sum := time.Duration(atomic.LoadInt64(&histogram.sum))
+	writer.sample(name+"_sum", sum.Seconds(), "upstream", upstream)
+	writer.sample(name+"_count", cumulative, "upstream", upstream)
+}
+
+// serveMetrics writes the delegate's metrics in the Prometheus text
+// exposition format.
+func (handler *authDelegateHandler) serveMetrics(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(rw, "method not allowed",
+			http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writer := metricsWriter{bufio.NewWriter(rw)}
+	defer writer.Flush()
+	upstreams := handler.routes().upstreams
+
+	writer.family("authdelegate_requests_total", "counter",
+		"Requests received for a decision.")
+	writer.sample("authdelegate_requests_total",
+		atomic.LoadInt64(&handler.requests))
+
+	writer.family("authdelegate_shutdown_phase", "gauge",
+		"1 for the current phase of shutdown, and 0 for the others.")
+	current := atomic.LoadInt32(&handler.shutdownPhase)
+	for i, phase := range shutdownPhases {
+		value := 0
+		if int32(i) == current {
+			value = 1
+		}
+		writer.sample("authdelegate_shutdown_phase", value,
+			"phase", phase)
+	}
+
+	if handler.certificate != nil {
+		writer.family("authdelegate_ssl_cert_expiry_days", "gauge",
+			"Days until the SSL certificate expires.")
+		writer.sample("authdelegate_ssl_cert_expiry_days",
+			handler.certificate.daysToExpiry())
+	}
+
+	if handler.certExpiry != nil {
+		labels, days := handler.certExpiry.expiryDays()
+		writer.family("authdelegate_cert_expiry_days", "gauge",
+			"Days until the earliest-expiring certificate in each "+
+				"certificate file expires.")
+		for i, label := range labels {
+			writer.sample("authdelegate_cert_expiry_days", days[i],
+				"certificate", label)
+		}
+		writer.family("authdelegate_cert_expiry_alerts_total", "counter",
+			"Warnings raised about expiring certificates.")
+		writer.sample("authdelegate_cert_expiry_alerts_total",
+			atomic.LoadInt64(&handler.certExpiry.alerts))
+	}
+
+	rejections := handler.rejections.load()
+	writer.family("authdelegate_rejected_requests_total", "counter",
+		"Requests rejected as being from scanners or bots, by rule.")
+	writer.sample("authdelegate_rejected_requests_total",
+		rejections.UserAgent, "rule", rejectUserAgent)
+	writer.sample("authdelegate_rejected_requests_total",
+		rejections.Path, "rule", rejectPath)
+
+	if exporter := handler.exporter; handler.routes().tracer != nil {
+		writer.family("authdelegate_trace_spans_exported_total",
+			"counter", "Spans sent to the OpenTelemetry collector.")
+		writer.sample("authdelegate_trace_spans_exported_total",
+			atomic.LoadInt64(&exporter.exported))
+		writer.family("authdelegate_trace_spans_dropped_total",
+			"counter", "Spans the collector failed to accept.")
+		writer.sample("authdelegate_trace_spans_dropped_total",
+			atomic.LoadInt64(&exporter.dropped))
+	}
+
+	writer.family("authdelegate_upstream_decisions_total", "counter",
+		"Responses to requests routed to each upstream, by decision.")
+	for _, upstream := range upstreams {
+		for _, decision := range []struct {
+			name  string
+			count *int64
+		}{
+			{"allow", &upstream.allowed},
+			{"deny", &upstream.denied},
+			{"error", &upstream.failed},
+		} {
+			writer.sample("authdelegate_upstream_decisions_total",
+				atomic.LoadInt64(decision.count),
+				"upstream", upstream.name, "decision",
+				decision.name)
+		}
+	}
+
+	writer.family("authdelegate_upstream_traffic_total", "counter",
+		"Requests routed to each upstream, by traffic class.")
+	for _, upstream := range upstreams {
+		counts := upstream.trafficCounts()
+		writer.sample("authdelegate_upstream_traffic_total",
+			counts.Human, "upstream", upstream.name, "class",
+			trafficHuman)
+		writer.sample("authdelegate_upstream_traffic_total",
+			counts.Service, "upstream", upstream.name, "class",
+			trafficService)
+	}
+
+	writer.family("authdelegate_upstream_in_flight", "gauge",
+		"Requests currently in flight to each upstream.")
+	for _, upstream := range upstreams {
+		writer.sample("authdelegate_upstream_in_flight",
+			atomic.LoadInt64(&upstream.inFlight),
+			"upstream", upstream.name)
+	}
+
+	writer.family("authdelegate_upstream_concurrency_limit", "gauge",
+		"Adaptive concurrency limit of each upstream that has one.")
+	for _, upstream := range upstreams {
+		if status := upstream.limiter.status(); status != nil {
+			writer.sample("authdelegate_upstream_concurrency_limit",
+				status.Limit, "upstream", upstream.name)
+		}
+	}
+
+	writer.family("authdelegate_upstream_retries_deduplicated_total",
+		"counter", "Retries answered with the decision for the same "+
+			"request ID, by each upstream that sets retry_window.")
+	for _, upstream := range upstreams {
+		if upstream.retries != nil {
+			writer.sample(
+				"authdelegate_upstream_retries_deduplicated_total",
+				upstream.retries.deduplicatedCount(),
+				"upstream", upstream.name)
+		}
+	}
+
+	writer.family("authdelegate_upstream_rate_limited_total", "counter",
+		"Requests refused by each upstream's rate limits, by key.")
+	for _, upstream := range upstreams {
+		for _, limiter := range upstream.rateLimits {
+			writer.sample("authdelegate_upstream_rate_limited_total",
+				limiter.limitedCount(), "upstream", upstream.name,
+				"key", limiter.key)
+		}
+	}
+
+	writer.family("authdelegate_upstream_retries_total", "counter",
+		"Requests sent again after failing, by each upstream with a "+
+			"retry_policy.")
+	for _, upstream := range upstreams {
+		if upstream.retryPolicy != nil {
+			writer.sample("authdelegate_upstream_retries_total",
+				upstream.retryPolicy.retriedCount(),
+				"upstream", upstream.name)
+		}
+	}
+
+	writer.family("authdelegate_upstream_replica_healthy", "gauge",
+		"Whether health checks find each replica of each upstream "+
+			"with a health_check healthy.")
+	for _, upstream := range upstreams {
+		if upstream.replicas == nil {
+			continue
+		}
+		for _, replica := range upstream.replicas.replicas {
+			if replica.healthURL == nil {
+				continue
+			}
+			healthy := 0
+			if replica.isHealthy() {
+				healthy = 1
+			}
+			writer.sample("authdelegate_upstream_replica_healthy",
+				healthy, "upstream", upstream.name,
+				"url", replica.url.String())
+		}
+	}
+
+	writer.family("authdelegate_upstream_circuit_open", "gauge",
+		"Whether the circuit breaker of each upstream with one is "+
+			"refusing requests.")
+	for _, upstream := range upstreams {
+		if upstream.breaker == nil {
+			continue
+		}
+		open := 0
+		if upstream.breaker.isOpen() {
+			open = 1
+		}
+		writer.sample("authdelegate_upstream_circuit_open", open,
+			"upstream", upstream.name)
+	}
+
+	writer.family("authdelegate_upstream_latency_seconds", "histogram",
+		"Latency of each upstream's responses other than 5xx.")
+	for _, upstream := range upstreams {
+		writer.histogram("authdelegate_upstream_latency_seconds",
+			upstream.name, upstream.latency)
+	}
+}
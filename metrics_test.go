@@ -0,0 +1,117 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Metrics", func() {
+	var opts *AuthDelegateOptions
+	var upstream *httptest.Server
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if req.Header.Get("X-Token") == "valid" {
+					rw.WriteHeader(http.StatusOK)
+				} else {
+					rw.WriteHeader(http.StatusUnauthorized)
+				}
+			}))
+		opts = &AuthDelegateOptions{
+			Port:                8080,
+			MetricsPath:         "/metrics",
+			RejectKnownScanners: true,
+			Upstreams: []*AuthDelegateUpstream{&AuthDelegateUpstream{
+				Name: `sso "main"`,
+				URL:  upstream.URL,
+			}},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	serve := func(delegate http.Handler, uri, token string) int {
+		req, _ := http.NewRequest("GET", "http://delegate"+uri, nil)
+		req.Header.Set("X-Original-URI", uri)
+		req.Header.Set("X-Token", token)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	scrape := func(delegate http.Handler) []string {
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).
+			To(HavePrefix("text/plain"))
+		return strings.Split(recorder.Body.String(), "\n")
+	}
+
+	It("should report request, decision, and latency metrics", func() {
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		Expect(serve(delegate, "/", "valid")).To(Equal(http.StatusOK))
+		Expect(serve(delegate, "/", "valid")).To(Equal(http.StatusOK))
+		Expect(serve(delegate, "/", "bogus")).
+			To(Equal(http.StatusUnauthorized))
+		Expect(serve(delegate, "/.env", "valid")).
+			To(Equal(http.StatusForbidden))
+
+		const upstreamLabel = `upstream="sso \"main\""`
+		metrics := scrape(delegate)
+		Expect(metrics).To(ContainElement(
+			"# TYPE authdelegate_requests_total counter"))
+		Expect(metrics).To(ContainElement("authdelegate_requests_total 4"))
+		Expect(metrics).To(ContainElement(
+			`authdelegate_rejected_requests_total{rule="path"} 1`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_decisions_total{" + upstreamLabel +
+				`,decision="allow"} 2`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_decisions_total{" + upstreamLabel +
+				`,decision="deny"} 1`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_decisions_total{" + upstreamLabel +
+				`,decision="error"} 0`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_traffic_total{" + upstreamLabel +
+				`,class="service"} 3`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_in_flight{" + upstreamLabel + "} 0"))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_latency_seconds_bucket{" +
+				upstreamLabel + `,le="+Inf"} 3`))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_latency_seconds_count{" +
+				upstreamLabel + "} 3"))
+		Expect(metrics).To(ContainElement(
+			"authdelegate_upstream_latency_seconds_bucket{" +
+				upstreamLabel + `,le="16.384"} 3`))
+	})
+
+	It("should only serve metrics on the main port if configured", func() {
+		opts.MetricsPath = ""
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+		Expect(serve(delegate, "/metrics", "bogus")).
+			To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should fail validation if metrics_path conflicts", func() {
+		opts.BatchPath = "/metrics"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"metrics_path must differ from batch_path and " +
+				"subscribe_path: /metrics",
+		})))
+	})
+})
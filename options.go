@@ -1,25 +1,172 @@
-package main
+package authdelegate
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"html/template"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
 )
 
 // AuthDelegateOptions contains the parameters needed to determine which
 // authentication handler to launch and to configure it properly.
 type AuthDelegateOptions struct {
-	// Port on which to listen for requests
+	// Port on which to listen for requests; may be omitted if Listen is
+	// defined
 	Port int `json:"port"`
 
+	// If defined, a Unix domain socket on which to listen for requests as
+	// well as, or instead of, Port, e.g. "unix:///run/authdelegate.sock"
+	Listen string `json:"listen"`
+
+	// Permissions of the Listen socket, in octal, e.g. "0666"; defaults to
+	// "0660", so that only the owner and group may connect
+	UnixSocketMode string `json:"unix_socket_mode"`
+
+	// IP addresses or CIDR networks of the proxies whose X-Real-IP and
+	// X-Forwarded-For headers report the client address of requests;
+	// defaults to the loopback addresses
+	TrustedProxies []string `json:"trusted_proxies"`
+
 	// Path to the server's SSL certificate
 	SslCert string `json:"ssl_cert"`
 
 	// Path to the key for -ssl-cert
 	SslKey string `json:"ssl_key"`
 
+	// If true, staple the response of the OCSP responder of -ssl-cert to
+	// the TLS handshake, refreshing it before it expires; -ssl-cert must
+	// include the issuer certificate
+	SslOcspStapling bool `json:"ssl_ocsp_stapling"`
+
+	// How often to check whether -ssl-cert, -ssl-key, or the certificates
+	// of Listeners have changed, and reload them if so, e.g. "30s";
+	// defaults to one minute, and "0s" disables reloading
+	SslCertReloadInterval string `json:"ssl_cert_reload_interval"`
+
+	// If false, TLS session resumption (via session tickets) is disabled on
+	// Port and Listeners, so every connection performs a full handshake;
+	// defaults to true
+	SslSessionResumption *bool `json:"ssl_session_resumption"`
+
+	// Must be false: TLS 1.3 0-RTT early data, which an attacker can
+	// replay, is never accepted. Exists so that the policy can be stated
+	// explicitly in the configuration.
+	SslEarlyData bool `json:"ssl_early_data"`
+
+	// Minimum TLS version accepted by Port, Listeners, the admin listener,
+	// and the control listener: "1.2" (the default) or "1.3"
+	SslMinVersion string `json:"ssl_min_version"`
+
+	// TLS 1.2 cipher suites those listeners accept, by their IANA names,
+	// e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"; defaults to Go's
+	// secure suites. TLS 1.3 suites aren't configurable.
+	SslCipherSuites []string `json:"ssl_cipher_suites"`
+
+	// Key exchange curves those listeners offer, in order of preference,
+	// from "X25519", "P-256", "P-384", and "P-521"; defaults to Go's
+	// preferences
+	SslCurvePreferences []string `json:"ssl_curve_preferences"`
+
+	// If true, clients connecting to Port or to Listeners must present a
+	// certificate signed by one of the CAs in ClientCAFile, whose details
+	// are forwarded to upstreams in X-Client-Cert-* headers
+	RequireClientCert bool `json:"require_client_cert"`
+
+	// Path to a PEM file of CA certificates for RequireClientCert
+	ClientCAFile string `json:"client_ca_file"`
+
+	// If defined, the certificate served on Port and Listeners is obtained
+	// from an ACME certificate authority, such as Let's Encrypt, and
+	// renewed automatically, rather than read from SslCert and SslKey
+	Acme *AuthDelegateAcme `json:"acme"`
+
+	// If defined, warn as the certificates named in the configuration
+	// approach expiry
+	CertExpiryAlerts *AuthDelegateCertExpiryAlerts `json:"cert_expiry_alerts"`
+
+	// If defined, a plaintext HTTP listener served alongside the SSL
+	// listener on Port, e.g. for load balancer health checks that can't use
+	// TLS
+	PlaintextListener *AuthDelegatePlaintextListener `json:"plaintext_listener"`
+
+	// Additional addresses on which to accept requests, which may be
+	// routed differently from those received on Port
+	Listeners []*AuthDelegateListener `json:"listeners"`
+
+	// If true, open multiple listeners on Port using SO_REUSEPORT, each with
+	// its own accept loop, for high connection rates
+	ReusePort bool `json:"reuse_port"`
+
+	// Number of listeners to open if ReusePort is true; defaults to the
+	// number of CPUs
+	ReusePortListeners int `json:"reuse_port_listeners"`
+
+	// Overrides GOMAXPROCS; by default the Go runtime derives it from the
+	// cgroup CPU limit, and updates it as the limit changes, unless set in
+	// the environment
+	GoMaxProcs int `json:"gomaxprocs"`
+
+	// Overrides the Go runtime's soft memory limit, using the same syntax
+	// as GOMEMLIMIT, e.g. "512MiB"; by default it is derived from the
+	// cgroup memory limit, unless set in the environment
+	GoMemLimit string `json:"gomemlimit"`
+
+	// If not nil, overrides GOGC, the GC target percentage; a negative value
+	// disables garbage collection, which is only sensible with GoMemLimit
+	GoGC *int `json:"gogc"`
+
+	// Address (host:port) on which to serve administrative operations
+	AdminAddress string `json:"admin_address"`
+
+	// Path to the SSL certificate for the admin listener
+	AdminSslCert string `json:"admin_ssl_cert"`
+
+	// Path to the key for -admin-ssl-cert
+	AdminSslKey string `json:"admin_ssl_key"`
+
+	// Path to a PEM file of CA certificates; if specified, clients of the
+	// admin listener must present a certificate signed by one of them
+	AdminClientCA string `json:"admin_client_ca"`
+
+	// Path to a file containing a token that clients of the admin listener
+	// must present in an "Authorization: Bearer" header
+	AdminBearerTokenFile string `json:"admin_bearer_token_file"`
+
+	// IP addresses or CIDR networks from which the admin listener accepts
+	// requests; if empty, requests from any address are accepted
+	AdminAllowedNetworks []string `json:"admin_allowed_networks"`
+
+	// Address (host:port) on which to serve the gRPC control API, which
+	// requires mutual TLS
+	ControlAddress string `json:"control_address"`
+
+	// Paths to the SSL certificate and key for the control listener
+	ControlSslCert string `json:"control_ssl_cert"`
+	ControlSslKey  string `json:"control_ssl_key"`
+
+	// Path to a PEM file of CA certificates; clients of the control
+	// listener must present a certificate signed by one of them
+	ControlClientCA string `json:"control_client_ca"`
+
 	// Signed/authenticated requests are proxied to these servers based on
 	// a match with each upstream's HeaderName or CookieName. The server
 	// will send the request to the first upstream that matches one of its
@@ -29,149 +176,2813 @@ type AuthDelegateOptions struct {
 	// To have a "default" server, make it the final item, and don't
 	// define the HeaderName or CookieName.
 	Upstreams []*AuthDelegateUpstream `json:"upstreams"`
+
+	// How to choose among several upstreams that accept a request: "first"
+	// (the default) in the order of Upstreams, "most_specific" by their
+	// host, path prefix, and other conditions, or "reject" to refuse the
+	// request with 409 Conflict
+	MatchPolicy string `json:"match_policy"`
+
+	// If defined, the upstreams are read from, and watched in, a key in
+	// Consul or etcd, and Upstreams are used only until they are first read
+	DynamicUpstreams *AuthDelegateDynamicUpstreams `json:"dynamic_upstreams"`
+
+	// How long to wait for a response from an upstream that doesn't define
+	// its own Timeout, e.g. "5s"; if empty, there is no limit
+	DefaultTimeout string `json:"default_timeout"`
+
+	// If true, pass the Accept-Encoding header of incoming requests through
+	// to upstreams, and pass encoded upstream responses through unchanged.
+	// Otherwise, request "identity" encoding from upstreams and decode
+	// gzip or deflate responses from upstreams that send them anyway.
+	PassAcceptEncoding bool `json:"pass_accept_encoding"`
+
+	// If defined, accept requests from a proxy using Traefik's ForwardAuth
+	// conventions, which reports the original request in X-Forwarded-*
+	// headers rather than nginx's X-Original-URI and X-Original-Host
+	ForwardAuth *AuthDelegateForwardAuth `json:"forward_auth"`
+
+	// Maximum number of header lines to pass through from an upstream
+	// response; zero means no limit
+	MaxResponseHeaders int `json:"max_response_headers"`
+
+	// Maximum total size in bytes of the header lines to pass through from
+	// an upstream response; zero means no limit
+	MaxResponseHeaderBytes int `json:"max_response_header_bytes"`
+
+	// Path on Port at which to accept batches of decision requests; if
+	// empty, batches are not accepted
+	BatchPath string `json:"batch_path"`
+
+	// Maximum number of requests in a batch; defaults to 100
+	BatchMaxRequests int `json:"batch_max_requests"`
+
+	// Header whose value, "high" or "low", overrides the priority class of
+	// a request
+	PriorityHeader string `json:"priority_header"`
+
+	// Header whose value, "human" or "service", overrides the traffic
+	// class of a request
+	TrafficClassHeader string `json:"traffic_class_header"`
+
+	// Substrings of the User-Agent header, e.g. "kube-probe/", identifying
+	// requests from services even if they otherwise resemble requests
+	// from browsers
+	ServiceUserAgents []string `json:"service_user_agents"`
+
+	// If true, reject requests from well-known vulnerability scanners, and
+	// for paths that only scanners and bots probe, such as "/.env",
+	// without sending them to an upstream
+	RejectKnownScanners bool `json:"reject_known_scanners"`
+
+	// Substrings of the User-Agent header, matched case-insensitively,
+	// whose requests are rejected
+	RejectUserAgents []string `json:"reject_user_agents"`
+
+	// Path prefixes of X-Original-URI whose requests are rejected
+	RejectPaths []string `json:"reject_paths"`
+
+	// If defined, requests from these clients are allowed when their
+	// upstream fails
+	EmergencyAllowlist *AuthDelegateEmergencyAllowlist `json:"emergency_allowlist"`
+
+	// Path on Port at which clients may subscribe to changes in the
+	// decision for the credential their request carries; if empty,
+	// subscriptions are not accepted
+	SubscribePath string `json:"subscribe_path"`
+
+	// Path on Port at which to serve metrics in the Prometheus text format;
+	// if empty, metrics are only served by the admin listener
+	MetricsPath string `json:"metrics_path"`
+
+	// Paths on Port at which to serve liveness and readiness checks, e.g.
+	// "/healthz" and "/readyz"; if empty, they are not served
+	HealthPath    string `json:"health_path"`
+	ReadinessPath string `json:"readiness_path"`
+
+	// If true, the readiness check fails unless a connection can be opened
+	// to every upstream
+	ReadinessCheckUpstreams bool `json:"readiness_check_upstreams"`
+
+	// Path on Port at which to report the health of each upstream as JSON,
+	// e.g. "/upstream-status", for nginx to poll; if empty, it is not
+	// served
+	UpstreamStatusPath string `json:"upstream_status_path"`
+
+	// How often to log the latency percentiles of each upstream, e.g.
+	// "1m"; if empty, they are not logged
+	LatencyLogInterval string `json:"latency_log_interval"`
+
+	// How long to wait for requests in flight to complete on SIGTERM or
+	// SIGINT before exiting, e.g. "10s"; defaults to 30 seconds
+	ShutdownGracePeriod string `json:"shutdown_grace_period"`
+
+	// How long to keep serving requests on SIGTERM or SIGINT after
+	// readiness checks begin to fail, before closing the listeners, so that
+	// load balancers stop sending requests first, e.g. "10s"; defaults to
+	// no delay
+	ShutdownDelay string `json:"shutdown_delay"`
+
+	// If defined, a request sent on SIGTERM or SIGINT, before
+	// ShutdownDelay, e.g. to deregister from a load balancer
+	ShutdownNotify *AuthDelegateShutdownNotify `json:"shutdown_notify"`
+
+	// If true, the summary of requests logged on shutdown is logged as an
+	// audit record
+	AuditExitSummary bool `json:"audit_exit_summary"`
+
+	// Which decisions to log as audit records explaining them: "denials"
+	// for denials and errors, or "all"; defaults to none
+	AuditDecisions string `json:"audit_decisions"`
+
+	// If defined, how credentials, email addresses, and IP addresses are
+	// redacted from logs, audit records, and trace spans
+	LogRedaction *AuthDelegateLogRedaction `json:"log_redaction"`
+
+	// Backend for state that outlives a single request, such as
+	// revocations; defaults to memory local to this process
+	Storage *AuthDelegateStorage `json:"storage"`
+
+	// File to which memory storage is saved on SIGTERM or SIGINT, after
+	// requests in flight complete, and from which it is restored on startup
+	StateSnapshotPath string `json:"state_snapshot_path"`
+
+	// If a snapshot is older than this, e.g. "10m", cached decisions are
+	// not restored from it; defaults to restoring any unexpired decision
+	StateSnapshotMaxAge string `json:"state_snapshot_max_age"`
+
+	// If true, report how each upstream was evaluated against a request in
+	// the X-Auth-Match-Trace response header. Intended for integration
+	// tests; do not enable in production.
+	MatchTraceHeader bool `json:"match_trace_header"`
+
+	// Hex-encoded SHA-256 digests of credential values (the value of an
+	// upstream's header or cookie) whose requests should be traced
+	// verbosely
+	DebugCredentialHashes []string `json:"debug_credential_hashes"`
+
+	// Cookie that, when present in a request, enables verbose tracing
+	DebugCookieName string `json:"debug_cookie_name"`
+
+	// How long SIGUSR1, or POST /debug/verbose on the admin listener,
+	// traces every request; defaults to five minutes
+	VerboseLoggingDuration string `json:"verbose_logging_duration"`
+
+	// Path to which SIGUSR2, or POST /debug/cpu_profile on the admin
+	// listener, writes a CPU profile; if empty, profiling is disabled
+	CPUProfilePath string `json:"cpu_profile_path"`
+
+	// How long to write a CPU profile for; defaults to 30 seconds
+	CPUProfileDuration string `json:"cpu_profile_duration"`
+
+	// If defined, the beginnings of the bodies of 5xx responses from
+	// upstreams are sampled for GET /debug/error_samples on the admin
+	// listener
+	ErrorSamples *AuthDelegateErrorSamples `json:"error_samples"`
+
+	// If defined, export OpenTelemetry spans for each decision and each
+	// request sent to an upstream, and propagate the trace to upstreams
+	Tracing *AuthDelegateTracing `json:"tracing"`
+
+	// Email address, URL, or other contact for users to seek help from,
+	// shown on the delegate's own error pages
+	SupportContact string `json:"support_contact"`
+
+	// If defined, the delegate's own error responses are rendered from
+	// templates in the language the client prefers. Ignored if
+	// ErrorHandler is set.
+	ErrorPages *AuthDelegateErrorPages `json:"error_pages"`
+
+	// Writes the response when the delegate fails to obtain a decision
+	// from an upstream; defaults to returning 401 if no upstream matches
+	// and 502 otherwise, with an HTML page for browsers. Only available to
+	// programs embedding the delegate.
+	ErrorHandler ErrorHandler `json:"-"`
+
+	// Parsed version of GoMemLimit
+	goMemLimit int64
+
+	// Path of the Listen socket, and the parsed version of UnixSocketMode
+	socketPath     string
+	unixSocketMode os.FileMode
+
+	// Set of lowercased DebugCredentialHashes
+	debugHashes map[string]bool
+
+	// Contents of AdminClientCA
+	adminClientCAs *x509.CertPool
+
+	// Contents of ControlClientCA
+	controlClientCAs *x509.CertPool
+
+	// Contents of ClientCAFile
+	clientCAs *x509.CertPool
+
+	// Parsed version of SslCertReloadInterval
+	sslCertReloadInterval time.Duration
+
+	// Parsed versions of SslMinVersion, SslCipherSuites, and
+	// SslCurvePreferences
+	sslMinVersion       uint16
+	sslCipherSuites     []uint16
+	sslCurvePreferences []tls.CurveID
+
+	// Contents of AdminBearerTokenFile, with surrounding whitespace removed
+	adminBearerToken []byte
+
+	// Parsed version of AdminAllowedNetworks
+	adminNetworks []*net.IPNet
+
+	// Parsed version of TrustedProxies
+	trustedProxies trustedProxies
+
+	// Parsed version of StateSnapshotMaxAge
+	stateSnapshotMaxAge time.Duration
+
+	// Parsed versions of VerboseLoggingDuration and CPUProfileDuration
+	verboseLoggingDuration time.Duration
+	cpuProfileDuration     time.Duration
+
+	// Parsed version of ShutdownDelay
+	shutdownDelay time.Duration
+
+	// Parsed version of LatencyLogInterval
+	latencyLogInterval time.Duration
+
+	// Parsed version of DefaultTimeout
+	defaultTimeout time.Duration
+
+	// Parsed version of ShutdownGracePeriod
+	shutdownGracePeriod time.Duration
 }
 
 // AuthDelegateUpstream contains a raw URL string from the command line as
 // well as its parsed representation.
 type AuthDelegateUpstream struct {
-	// Unparsed version of the upstream URL
+	// Name used to identify this upstream in logs and admin operations;
+	// defaults to URL
+	Name string `json:"name"`
+
+	// Unparsed version of the upstream URL; defaults to "static:", "hmac:",
+	// "jwt:", "plugin:", or "exec:" followed by Name for upstreams of those
+	// types
 	URL string `json:"url"`
 
+	// If "static_tokens", requests are checked against TokenHashes and
+	// TokenHashesFile, if "hmac", their signatures are verified with
+	// HmacSecretFiles, if "jwt", their tokens are validated with the
+	// keys at JwtJwksURL or in JwtKeyFiles, if "plugin", they are
+	// decided by the Go plugin at PluginPath, and if "exec", by running
+	// ExecCommand, rather than being sent anywhere; if empty, they are
+	// sent to URL
+	Type string `json:"type"`
+
+	// Hex-encoded SHA-256 digests of the tokens a static_tokens upstream
+	// allows: the value of HeaderName or CookieName, without the
+	// AuthScheme, if any
+	TokenHashes []string `json:"token_hashes"`
+
+	// Path to a file of further token hashes, one per line; blank lines and
+	// lines beginning with "#" are ignored
+	TokenHashesFile string `json:"token_hashes_file"`
+
+	// Paths to files each containing a secret with which an hmac upstream
+	// may verify the signature in HeaderName, so that secrets can be
+	// rotated
+	HmacSecretFiles []string `json:"hmac_secret_files"`
+
+	// Headers of the original request included in its signature, in order
+	HmacSignedHeaders []string `json:"hmac_signed_headers"`
+
+	// Digest algorithm of signatures, e.g. "sha256"; defaults to "sha1"
+	HmacDigest string `json:"hmac_digest"`
+
+	// URL of the JSON Web Key Set with which a jwt upstream verifies
+	// token signatures
+	JwtJwksURL string `json:"jwt_jwks_url"`
+
+	// Paths to PEM-encoded public keys or certificates with which a jwt
+	// upstream verifies token signatures, whatever their key ID
+	JwtKeyFiles []string `json:"jwt_key_files"`
+
+	// If defined, the iss and aud claims that valid tokens must have
+	JwtIssuer   string `json:"jwt_issuer"`
+	JwtAudience string `json:"jwt_audience"`
+
+	// Claims of valid tokens returned in X-Auth-* headers, e.g.
+	// "preferred_username" in X-Auth-Preferred-Username; defaults to "sub"
+	JwtClaims []string `json:"jwt_claims"`
+
+	// Clock skew allowed when checking the exp and nbf claims, e.g. "30s"
+	JwtLeeway string `json:"jwt_leeway"`
+
+	// Path to a Go plugin, built with -buildmode=plugin, that exports a
+	// NewVerifier function which creates the handler that decides the
+	// requests of a plugin upstream
+	PluginPath string `json:"plugin_path"`
+
+	// Passed to the plugin's NewVerifier function, as JSON
+	PluginConfig json.RawMessage `json:"plugin_config"`
+
+	// Program, and its arguments, that an exec upstream runs for each
+	// request, without a shell. It reads the request as JSON on its
+	// standard input, and exits 0 to allow it, 1 to deny it with a 401
+	// status, or 2 to deny it with a 403 status; it is killed after
+	// Timeout, or 5 seconds if there is none
+	ExecCommand []string `json:"exec_command"`
+
+	// Maximum number of commands an exec upstream runs at once; further
+	// requests wait for one to exit, until Timeout. Defaults to 8
+	ExecMaxConcurrency int `json:"exec_max_concurrency"`
+
 	// Header that indicates that requests should be sent to this upstream
 	HeaderName string `json:"header_name"`
 
 	// CookieName that indicates that requests should be sent to this
-	// upstream
+	// upstream. If HeaderName is also defined, requests must carry both.
 	CookieName string `json:"cookie_name"`
 
+	// Further headers or cookies that indicate that requests should be sent
+	// to this upstream, e.g. the cookie name of an earlier oauth2_proxy
+	// version during a migration. Each requires HeaderName or CookieName,
+	// which is checked first. In JSON, header_name or cookie_name is a list
+	// of names instead, the first of which is HeaderName or CookieName.
+	HeaderAliases []string `json:"-"`
+	CookieAliases []string `json:"-"`
+
+	// If defined, only requests whose CookieName or CookieAliases value
+	// begins with this prefix, e.g. "v2:", or contains a match for this
+	// regular expression, are sent to this upstream; a cookie with another
+	// value is treated as absent. At most one may be defined.
+	CookieValuePrefix  string `json:"cookie_value_prefix"`
+	CookieValuePattern string `json:"cookie_value_pattern"`
+
+	// If defined, only requests in which each of these headers is present
+	// with a value containing a match for its regular expression, e.g.
+	// {"X-Api-Version": "^2\\."}, are sent to this upstream. Combines with
+	// the other match conditions.
+	HeaderValueRegex map[string]string `json:"header_value_regex"`
+
+	// If defined, only requests for this virtual host, e.g.
+	// "app1.example.gov", are sent to this upstream. A leading "*." matches
+	// any subdomain, e.g. "*.example.gov" for "app1.example.gov" but not
+	// "example.gov". The host is taken from the X-Original-Host header, or
+	// else the Host header. Combines with the other match conditions.
+	Host string `json:"host"`
+
+	// If defined, only requests whose X-Original-URI path is or is below
+	// this path, e.g. "/api" for "/api/users" but not "/apis", are sent to
+	// this upstream. Combines with HeaderName or CookieName, if specified.
+	PathPrefix string `json:"path_prefix"`
+
+	// If defined, only requests with one of these methods, e.g. ["GET",
+	// "HEAD"], are sent to this upstream. A request that this upstream
+	// would otherwise accept is refused with a 405 status, rather than sent
+	// to the default upstream, unless another upstream accepts it.
+	// Combines with the other match conditions.
+	Methods []string `json:"methods"`
+
+	// If defined, only requests whose Authorization header uses this
+	// scheme, e.g. "Bearer" or "Basic", ignoring case, are sent to this
+	// upstream. Implies a HeaderName of "Authorization", which is the only
+	// one it may be combined with.
+	AuthScheme string `json:"auth_scheme"`
+
+	// If defined, only requests for which this expression is true are
+	// sent to this upstream, e.g. "request.method == 'GET' &&
+	// has(request.cookies['_sess'])", for conditions the others can't
+	// express. Combines with the other match conditions.
+	MatchExpression string `json:"match_expression"`
+
+	// If defined, only requests satisfying this combination of header,
+	// cookie, host, path, and method conditions are sent to this upstream,
+	// e.g. to require a header or else a cookie. Translated into the
+	// equivalent MatchExpression. Combines with the other match conditions.
+	Match *AuthDelegateMatch `json:"match"`
+
+	// How long to wait for a "100 Continue" response from the upstream
+	// before sending the request body, e.g. "1s"; "0s" causes the body to
+	// be sent immediately. Defaults to one second.
+	ExpectContinueTimeout string `json:"expect_continue_timeout"`
+
+	// How long to wait for the upstream's response, including connecting
+	// to it, e.g. "2s", after which the request fails with a 504 status;
+	// defaults to DefaultTimeout
+	Timeout string `json:"timeout"`
+
+	// Upper bounds of the buckets of this upstream's latency histogram in
+	// metrics, in increasing order, e.g. ["5ms", "25ms", "100ms"]; defaults
+	// to powers of two from 0.5ms to 16s
+	LatencyBuckets []string `json:"latency_buckets"`
+
+	// If true, buffer request bodies of unknown length so they are sent
+	// with a Content-Length rather than chunked transfer encoding
+	DisableChunkedRequests bool `json:"disable_chunked_requests"`
+
+	// How long to cache decisions that allow a request, keyed by the value
+	// of HeaderName or CookieName, e.g. "30s"; if empty, decisions are not
+	// cached
+	CacheTTL string `json:"cache_ttl"`
+
+	// Maximum number of approvals to cache at once; zero means no limit
+	CacheMaxEntries int `json:"cache_max_entries"`
+
+	// How long to cache decisions that deny a request (401 or 403) with
+	// this upstream's header or cookie, e.g. "5s"; if empty, denials are
+	// not cached. Should be shorter than CacheTTL, so that users aren't
+	// denied for long after reauthenticating.
+	DenyCacheTTL string `json:"deny_cache_ttl"`
+
+	// Maximum number of denials to cache at once; zero means no limit
+	DenyCacheMaxEntries int `json:"deny_cache_max_entries"`
+
+	// Request attributes to combine with the value of HeaderName or
+	// CookieName in cache keys, for upstreams whose decisions depend on
+	// more than the credential: "method", "path", and "client_ip"
+	CacheKey []string `json:"cache_key"`
+
+	// If nonzero, the "path" cache key attribute includes only this many
+	// leading path segments, e.g. 1 for "/api" from "/api/users/1"
+	CacheKeyPathSegments int `json:"cache_key_path_segments"`
+
+	// If true, concurrent requests with the same cache key (by default,
+	// the same value of HeaderName or CookieName) are sent to this upstream
+	// as a single request, whose response is copied to each of them
+	CoalesceRequests bool `json:"coalesce_requests"`
+
+	// If defined, requests are sent to this upstream with the value of
+	// HeaderName or CookieName copied into this header, e.g.
+	// X-Auth-Credential, so that the upstream needn't know which was used
+	CredentialHeader string `json:"credential_header"`
+
+	// How to send requests whose original method is HEAD or OPTIONS to
+	// this upstream: "pass" (the default) sends them with that method, and
+	// "get" converts them to GET, for backends that handle them
+	// inconsistently
+	HeadRequests    string `json:"head_requests"`
+	OptionsRequests string `json:"options_requests"`
+
+	// If not empty, the only headers of this upstream's responses that are
+	// returned, e.g. X-Auth-Request-User for nginx's auth_request_set
+	PassResponseHeaders []string `json:"pass_response_headers"`
+
+	// If not empty, the only headers of this upstream's successful
+	// responses that are returned, e.g. the headers listed in Traefik's
+	// authResponseHeaders; responses that deny a request are returned
+	// unchanged
+	AuthResponseHeaders []string `json:"auth_response_headers"`
+
+	// Headers added to this upstream's responses that allow a request,
+	// and to all others, e.g. {"X-Auth-Source": "sso"}, for nginx or the
+	// application to route or log by; they replace any headers of the same
+	// names from the upstream
+	AcceptHeaders map[string]string `json:"accept_headers"`
+	DenyHeaders   map[string]string `json:"deny_headers"`
+
+	// If not empty, how long to remember this upstream's decision for a
+	// request ID, e.g. "2s", so that nginx's retries of the same original
+	// request are answered without querying the upstream again
+	RetryWindow string `json:"retry_window"`
+
+	// Header identifying the original request, whose value nginx sets from
+	// $request_id; defaults to X-Request-Id. Requires RetryWindow.
+	RequestIDHeader string `json:"request_id_header"`
+
+	// Limits on the rate of requests to this upstream from each client or
+	// with each credential, beyond which requests are refused with 429
+	RateLimits []*AuthDelegateRateLimit `json:"rate_limits"`
+
+	// If defined, requests to this upstream that fail transiently are
+	// sent again
+	RetryPolicy *AuthDelegateRetryPolicy `json:"retry_policy"`
+
+	// Further URLs of replicas of this upstream among which, and URL,
+	// requests are spread
+	ReplicaURLs []string `json:"replica_urls"`
+
+	// How requests are spread among URL and ReplicaURLs: "round_robin"
+	// (the default), "least_conn", or "random"
+	LoadBalancing string `json:"load_balancing"`
+
+	// Further URLs of replicas of this upstream, in order of preference, to
+	// which requests are sent while health checks find URL and ReplicaURLs
+	// down
+	FailoverURLs []string `json:"failover_urls"`
+
+	// If defined, URL, ReplicaURLs, and FailoverURLs are checked
+	// periodically
+	HealthCheck *AuthDelegateHealthCheck `json:"health_check"`
+
+	// If defined, limits the number of requests in flight to this upstream,
+	// adapting the limit to its latency and error rate
+	AdaptiveConcurrency *AuthDelegateAdaptiveConcurrency `json:"adaptive_concurrency"`
+
+	// Priority class of requests routed to this upstream, "high" (the
+	// default) or "low". Under overload, as determined by
+	// AdaptiveConcurrency, low priority requests are rejected first.
+	Priority string `json:"priority"`
+
+	// If "human" or "service", only requests of that traffic class are
+	// sent to this upstream, e.g. to send browsers to single sign-on and
+	// services to a token validator
+	Traffic string `json:"traffic"`
+
+	// If defined, allows requests for low-risk paths while this upstream
+	// is down
+	FailOpen *AuthDelegateFailOpen `json:"fail_open"`
+
+	// What happens to requests when this upstream is unreachable or times
+	// out: "fail_closed" (the default) refuses them with a 502 or 504
+	// status, while "fail_open" allows them with a 202 status, for
+	// low-risk internal apps
+	OnError string `json:"on_error"`
+
+	// If not zero, the status, 401 or 503, with which "fail_closed"
+	// refuses requests instead of 502 or 504
+	FailClosedStatus int `json:"fail_closed_status"`
+
+	// If defined, requests are refused without being sent to this
+	// upstream for a while after it fails repeatedly
+	CircuitBreaker *AuthDelegateCircuitBreaker `json:"circuit_breaker"`
+
+	// URL from which to populate the cache with the sessions this upstream
+	// currently allows, when the delegate starts; requires CacheTTL
+	CacheSeedURL string `json:"cache_seed_url"`
+
+	// Paths to the client certificate and key to present to this upstream,
+	// for upstreams that require mutual TLS
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+
+	// Path to a PEM file of CA certificates with which to verify this
+	// upstream's certificate, instead of the system's
+	ClientCA string `json:"client_ca"`
+
+	// If true, cache TLS sessions with this upstream so that new
+	// connections may resume them instead of performing a full handshake;
+	// requires an https URL
+	SessionResumption bool `json:"session_resumption"`
+
+	// Must be false: TLS 1.3 0-RTT early data, which an attacker can
+	// replay, is never sent
+	EarlyData bool `json:"early_data"`
+
+	// Protocol to use with this upstream: "http/1.1", e.g. for backends
+	// with broken HTTP/2 support, or "h2", which is negotiated via ALPN for
+	// an https URL and sent with prior knowledge otherwise. If empty, HTTP/2
+	// is used if an https upstream offers it, and HTTP/1.1 otherwise.
+	Protocol string `json:"protocol"`
+
+	// Contents of ClientCert and ClientKey
+	clientCertificate *tls.Certificate
+
+	// Contents of ClientCA
+	clientCAs *x509.CertPool
+
+	// Set of lowercased TokenHashes and the hashes in TokenHashesFile
+	tokenHashes map[string]bool
+
+	// Contents of HmacSecretFiles, with surrounding whitespace removed
+	hmacSecrets [][]byte
+
+	// Public keys in JwtKeyFiles
+	jwtKeys []crypto.PublicKey
+
+	// Parsed version of JwtLeeway
+	jwtLeeway time.Duration
+
+	// NewVerifier function of the plugin at PluginPath
+	newVerifier pluginConstructor
+
 	// Parsed version of the upstream URL
 	parsedURL *url.URL
-}
 
-// NewAuthDelegateOptionsFromJSON parses the JSON stored in config into an
-// AuthDelegateOptions structure, which is then validated. Returns nil and an
-// error if the JSON fails to parse or if AuthDelegateOptions.Validate()
-// fails.
-func NewAuthDelegateOptionsFromJSON(config []byte) (
-	*AuthDelegateOptions, error) {
-	var opts AuthDelegateOptions
-	if err := json.Unmarshal(config, &opts); err != nil {
-		return nil, errors.New("JSON parsing failed: " + err.Error())
-	}
-	if err := opts.Validate(); err != nil {
-		return nil, err
-	}
-	return &opts, nil
+	// Compiled version of MatchExpression
+	matchExpression *expression
+
+	// Compiled version of Match
+	match *expression
+
+	// Methods, in upper case, without repeats
+	methods []string
+
+	// Compiled version of CookieValuePrefix or CookieValuePattern
+	cookieValue *valueMatcher
+
+	// Compiled version of HeaderValueRegex, in order of header name
+	headerValueRegex []headerPattern
+
+	// Parsed versions of ReplicaURLs and FailoverURLs
+	parsedReplicaURLs  []*url.URL
+	parsedFailoverURLs []*url.URL
+
+	// Parsed version of ExpectContinueTimeout
+	expectContinueTimeout time.Duration
+
+	// Parsed version of Timeout, or of the default timeout if it's empty
+	timeout time.Duration
+
+	// Parsed version of LatencyBuckets
+	latencyBuckets []time.Duration
+
+	// Parsed version of CacheTTL
+	cacheTTL time.Duration
+
+	// Parsed version of DenyCacheTTL
+	denyCacheTTL time.Duration
+
+	// Parsed version of RetryWindow
+	retryWindow time.Duration
 }
 
-// Validate ensures that the AuthDelegateOptions configuration is correct and
-// parses some of the values into a useable format. It also sets the Mode
-// member that determines which proxy handler to launch. Collects as many
-// error messages as possible and returns them as a single string via the err
-// return value.
-func (opts *AuthDelegateOptions) Validate() (err error) {
-	var msgs []string
-	msgs = validatePort(opts, msgs)
-	msgs = validateSsl(opts, msgs)
-	msgs = validateUpstreams(opts, msgs)
+// plainUpstream is an AuthDelegateUpstream without its JSON methods.
+type plainUpstream AuthDelegateUpstream
 
-	if len(msgs) != 0 {
-		err = errors.New("Invalid options:\n  " +
-			strings.Join(msgs, "\n  "))
-	}
-	return
+// namedUpstream encodes an upstream as JSON with a header_name and
+// cookie_name that may each be a name or a list of names.
+type namedUpstream struct {
+	*plainUpstream
+	HeaderName nameList `json:"header_name"`
+	CookieName nameList `json:"cookie_name"`
 }
 
-func validatePort(opts *AuthDelegateOptions, msgs []string) []string {
-	if opts.Port <= 0 {
-		msgs = append(msgs, "port must be specified and "+
-			"greater than zero")
+// UnmarshalJSON decodes an upstream whose header_name or cookie_name may be
+// a list, setting HeaderAliases or CookieAliases to all but its first name.
+func (upstream *AuthDelegateUpstream) UnmarshalJSON(data []byte) error {
+	decoded := namedUpstream{plainUpstream: (*plainUpstream)(upstream)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
 	}
-	return msgs
+	upstream.HeaderName, upstream.HeaderAliases =
+		decoded.HeaderName.split()
+	upstream.CookieName, upstream.CookieAliases =
+		decoded.CookieName.split()
+	return nil
 }
 
-func checkExistenceAndPermission(path, optionName string,
-	msgs []string) []string {
-	if info, err := os.Stat(path); os.IsNotExist(err) {
-		msgs = append(msgs, optionName+" does not exist: "+path)
-	} else if os.IsPermission(err) {
-		msgs = append(msgs, optionName+" permission is denied: "+path)
-	} else if !info.Mode().IsRegular() {
-		msgs = append(msgs, optionName+" is not a regular file: "+path)
-	}
-	return msgs
+// MarshalJSON encodes an upstream with aliases as a header_name or
+// cookie_name list.
+func (upstream *AuthDelegateUpstream) MarshalJSON() ([]byte, error) {
+	return json.Marshal(namedUpstream{
+		(*plainUpstream)(upstream),
+		newNameList(upstream.HeaderName, upstream.HeaderAliases),
+		newNameList(upstream.CookieName, upstream.CookieAliases),
+	})
 }
 
-func validateSsl(opts *AuthDelegateOptions, msgs []string) []string {
-	certSpecified := opts.SslCert != ""
-	keySpecified := opts.SslKey != ""
-	if !(certSpecified || keySpecified) {
-		return msgs
-	} else if !(certSpecified && keySpecified) {
-		msgs = append(msgs, "ssl-cert and ssl-key must both be "+
-			"specified, or neither must be")
-	}
+// nameList is a header or cookie name, or a list of them, encoded as a
+// string if it has no more than one.
+type nameList []string
 
-	if certSpecified {
-		msgs = checkExistenceAndPermission(
-			opts.SslCert, "ssl-cert", msgs)
-	}
-	if keySpecified {
-		msgs = checkExistenceAndPermission(opts.SslKey, "ssl-key", msgs)
+func newNameList(name string, aliases []string) nameList {
+	if name == "" && len(aliases) == 0 {
+		return nil
 	}
-	return msgs
+	return append(nameList{name}, aliases...)
 }
 
-func validateUpstreams(opts *AuthDelegateOptions, msgs []string) []string {
-	if len(opts.Upstreams) == 0 {
-		return append(msgs, "no upstreams defined")
+// split returns the first name of the list, or the empty string if it is
+// empty, and the rest.
+func (names nameList) split() (string, []string) {
+	if len(names) == 0 {
+		return "", nil
+	} else if len(names) == 1 {
+		return names[0], nil
 	}
+	return names[0], names[1:]
+}
 
-	numUpstreams := len(opts.Upstreams)
-	var defaultUpstreams []string
-	cookieNames := make(map[string]int)
-	headerNames := make(map[string]int)
-
-	for i := 0; i != numUpstreams; i++ {
-		current := opts.Upstreams[i]
-		msgs = validateUpstream(current, msgs)
-		if current.HeaderName == "" && current.CookieName == "" {
-			defaultUpstreams = append(defaultUpstreams, current.URL)
+func (names *nameList) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*names = nil
+		if name != "" {
+			*names = nameList{name}
 		}
-		cookieNames[current.CookieName]++
-		headerNames[current.HeaderName]++
+		return nil
 	}
-	msgs = validateNameCounts("cookie names", cookieNames, msgs)
-	msgs = validateNameCounts("header names", headerNames, msgs)
-	msgs = validateDefaultUpstreams(defaultUpstreams,
-		opts.Upstreams[numUpstreams-1], msgs)
-	return msgs
+	return json.Unmarshal(data, (*[]string)(names))
 }
 
-func validateUpstream(upstream *AuthDelegateUpstream, msgs []string) []string {
-	var err error
-	if upstream.parsedURL, err = url.Parse(upstream.URL); err != nil {
-		msgs = append(msgs, "upstream URL failed to parse"+err.Error())
-	}
-	scheme := upstream.parsedURL.Scheme
-	if scheme == "" {
-		msgs = append(msgs, "upstream scheme not specified: "+
-			upstream.URL)
-	} else if !(scheme == "http" || scheme == "https") {
-		msgs = append(msgs, "invalid upstream scheme: "+upstream.URL)
+func (names nameList) MarshalJSON() ([]byte, error) {
+	if len(names) > 1 {
+		return json.Marshal([]string(names))
 	}
-	if upstream.HeaderName != "" && upstream.CookieName != "" {
-		msgs = append(msgs, "both header_name and cookie_name "+
-			"defined: "+upstream.URL)
-	}
-	return msgs
+	name, _ := names.split()
+	return json.Marshal(name)
 }
 
-func validateNameCounts(category string, counts map[string]int,
-	msgs []string) []string {
-	var repeatedNames []string
-	delete(counts, "")
-	for name, numAppearances := range counts {
+// AuthDelegateAdaptiveConcurrency configures the adaptive concurrency limit
+// of an upstream.
+type AuthDelegateAdaptiveConcurrency struct {
+	// Responses slower than this, e.g. "100ms", reduce the limit
+	TargetLatency string `json:"target_latency"`
+
+	// Bounds of the limit; MinLimit defaults to 1
+	MinLimit int `json:"min_limit"`
+	MaxLimit int `json:"max_limit"`
+
+	// Fraction of the limit available to low priority requests, between
+	// 0 and 1; defaults to 0.5
+	LowPriorityShare *float64 `json:"low_priority_share"`
+
+	// Parsed version of TargetLatency
+	targetLatency time.Duration
+}
+
+// AuthDelegateHealthCheck configures the active health checks of an
+// upstream's replicas.
+type AuthDelegateHealthCheck struct {
+	// Path requested from each replica, e.g. "/ping"; a 2xx or 3xx
+	// response means it is healthy
+	Path string `json:"path"`
+
+	// Time between checks, e.g. "5s"; defaults to 10s
+	Interval string `json:"interval"`
+
+	// Limit on each check; defaults to 2s
+	Timeout string `json:"timeout"`
+
+	// Consecutive successes after which an unhealthy replica is used
+	// again, and failures after which a healthy one is not; default to 2
+	// and 3
+	HealthyThreshold   int `json:"healthy_threshold"`
+	UnhealthyThreshold int `json:"unhealthy_threshold"`
+
+	// Parsed versions of Interval and Timeout
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// AuthDelegateForwardAuth names the headers in which a ForwardAuth proxy
+// reports the original request.
+type AuthDelegateForwardAuth struct {
+	// Defaults to X-Forwarded-Uri
+	URIHeader string `json:"uri_header"`
+
+	// Defaults to X-Forwarded-Host
+	HostHeader string `json:"host_header"`
+
+	// Defaults to X-Forwarded-Method
+	MethodHeader string `json:"method_header"`
+}
+
+// AuthDelegateFailOpen configures the fail-open policy of an upstream.
+type AuthDelegateFailOpen struct {
+	// How long the upstream must have been failing, e.g. "5m", before
+	// requests are allowed
+	After string `json:"after"`
+
+	// Paths of X-Original-URI, e.g. "/assets/", for which requests are
+	// allowed
+	PathPrefixes []string `json:"path_prefixes"`
+
+	// Parsed version of After
+	after time.Duration
+}
+
+// AuthDelegateErrorPages configures the templates from which the delegate's
+// own error responses are rendered.
+type AuthDelegateErrorPages struct {
+	// Directory of html/template files named after the status and
+	// language they render, e.g. "403.es.html" or "503.en-us.html"
+	Dir string `json:"dir"`
+
+	// Language of the templates used when the client accepts none of the
+	// others, e.g. "en"; every status with templates must have one in this
+	// language
+	DefaultLanguage string `json:"default_language"`
+
+	// Contents of Dir, by status and lowercased language
+	templates map[int]map[string]*template.Template
+}
+
+// AuthDelegateRateLimit limits the rate of requests to an upstream.
+type AuthDelegateRateLimit struct {
+	// "client_ip", the address reported by the proxy, or "credential",
+	// the value of the upstream's header or cookie
+	Key string `json:"key"`
+
+	// Sustained rate of requests allowed for each key
+	RequestsPerSecond float64 `json:"requests_per_second"`
+
+	// Requests allowed at once for each key, after it has been idle;
+	// defaults to RequestsPerSecond, rounded up
+	Burst int `json:"burst"`
+}
+
+// AuthDelegateRetryPolicy configures the retries of requests to an upstream.
+type AuthDelegateRetryPolicy struct {
+	// Attempts to send each request, including the first; defaults to 3
+	MaxAttempts int `json:"max_attempts"`
+
+	// Wait before the first retry, e.g. "50ms", which doubles with each
+	// further retry up to MaxBackoff; default to 25ms and 1s
+	Backoff    string `json:"backoff"`
+	MaxBackoff string `json:"max_backoff"`
+
+	// Failures to retry: "connection_errors", when no response is
+	// received, and "5xx"; defaults to connection_errors only
+	RetryOn []string `json:"retry_on"`
+
+	// Parsed versions of Backoff and MaxBackoff
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// AuthDelegateCircuitBreaker configures the circuit breaker of an upstream.
+type AuthDelegateCircuitBreaker struct {
+	// Consecutive failures after which the circuit opens; defaults to 5
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// If nonzero, the fraction of requests within Window, between 0 and 1,
+	// whose failure also opens the circuit, once at least MinRequests have
+	// been sent; MinRequests defaults to 20 and Window to 10s
+	FailureRate float64 `json:"failure_rate"`
+	MinRequests int     `json:"min_requests"`
+	Window      string  `json:"window"`
+
+	// How long the circuit stays open before a trial request is sent to
+	// the upstream, e.g. "1m"; defaults to 30s
+	CoolDown string `json:"cool_down"`
+
+	// Status of the responses to requests refused while the circuit is
+	// open: 503, the default, or a 2xx status to allow them instead. The
+	// default is 202 if the upstream's OnError is "fail_open".
+	Status int `json:"status"`
+
+	// Parsed versions of Window and CoolDown
+	window   time.Duration
+	coolDown time.Duration
+}
+
+// AuthDelegateListener configures an additional listener, using the same
+// upstreams as the main port, with listener-specific policy overrides.
+type AuthDelegateListener struct {
+	// Identifies the listener in logs; defaults to Address
+	Name string `json:"name"`
+
+	// Address (host:port) on which to accept requests
+	Address string `json:"address"`
+
+	// Names of upstreams to which requests received on this listener are
+	// never routed, so that they fall through to later upstreams, e.g. to
+	// exempt internal clients from an upstream requiring step-up
+	// authentication
+	SkipUpstreams []string `json:"skip_upstreams"`
+
+	// Paths to the certificate and key served on this listener instead of
+	// SslCert and SslKey, which needn't be defined, e.g. to accept TLS from
+	// remote callers while Port serves plaintext to a local nginx
+	SslCert string `json:"ssl_cert"`
+	SslKey  string `json:"ssl_key"`
+
+	// If true, this listener accepts plaintext requests even though Port
+	// uses TLS, e.g. on a loopback address for a local nginx
+	Plaintext bool `json:"plaintext"`
+
+	// Overrides RequireClientCert for this listener; if true, clients must
+	// present a certificate signed by one of the CAs in ClientCAFile, or
+	// in the top-level ClientCAFile if this one is empty
+	RequireClientCert *bool  `json:"require_client_cert"`
+	ClientCAFile      string `json:"client_ca_file"`
+
+	// Contents of ClientCAFile, or of the top-level ClientCAFile
+	clientCAs *x509.CertPool
+}
+
+func (listener *AuthDelegateListener) listenerName() string {
+	if listener.Name != "" {
+		return listener.Name
+	}
+	return listener.Address
+}
+
+// servesTLS returns true if Port serves TLS, with ssl_cert or a certificate
+// obtained by acme.
+func (opts *AuthDelegateOptions) servesTLS() bool {
+	return opts.SslCert != "" || opts.Acme != nil
+}
+
+// usesTLS returns true if the listener serves TLS: with its own ssl_cert, or
+// with the certificate of Port unless it is plaintext.
+func (listener *AuthDelegateListener) usesTLS(opts *AuthDelegateOptions) bool {
+	return listener.SslCert != "" ||
+		(opts.servesTLS() && !listener.Plaintext)
+}
+
+// forwardsClientCert returns true if clients connecting to Port or any of
+// Listeners must present a certificate, whose details are then forwarded to
+// upstreams.
+func (opts *AuthDelegateOptions) forwardsClientCert() bool {
+	if opts.RequireClientCert {
+		return true
+	}
+	for _, listener := range opts.Listeners {
+		if listener.requiresClientCert(opts) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresClientCert returns true if clients connecting to the listener must
+// present a certificate.
+func (listener *AuthDelegateListener) requiresClientCert(
+	opts *AuthDelegateOptions) bool {
+	if listener.RequireClientCert != nil {
+		return *listener.RequireClientCert
+	}
+	return opts.RequireClientCert && listener.usesTLS(opts)
+}
+
+// Modes of the plaintext listener: redirecting requests to Port, or serving
+// only the health and readiness checks
+const (
+	plaintextRedirect = "redirect"
+	plaintextHealth   = "health"
+)
+
+// AuthDelegateShutdownNotify defines the request sent when shutdown begins.
+type AuthDelegateShutdownNotify struct {
+	URL string `json:"url"`
+
+	// Defaults to POST
+	Method string `json:"method"`
+
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+
+	// How long to wait for a response, e.g. "2s"; defaults to five seconds
+	Timeout string `json:"timeout"`
+
+	// Parsed version of Timeout
+	timeout time.Duration
+}
+
+// AuthDelegatePlaintextListener configures a plaintext listener served
+// alongside the SSL listener. In either mode, it serves HealthPath,
+// ReadinessPath, and UpstreamStatusPath, if defined.
+type AuthDelegatePlaintextListener struct {
+	// Address (host:port) on which to accept plaintext requests
+	Address string `json:"address"`
+
+	// "redirect" to redirect every other request to the same host and URI
+	// on Port over HTTPS, or "health" to return 404 for every other request
+	Mode string `json:"mode"`
+}
+
+// AuthDelegateTracing configures the export of OpenTelemetry spans to a
+// collector.
+type AuthDelegateTracing struct {
+	// URL of the collector's OTLP/HTTP traces endpoint, e.g.
+	// "http://otel-collector:4318/v1/traces"; spans are sent as JSON
+	OTLPEndpoint string `json:"otlp_endpoint"`
+
+	// Headers sent with each export, e.g. for authentication
+	OTLPHeaders map[string]string `json:"otlp_headers"`
+
+	// The service.name of the spans; defaults to "authdelegate"
+	ServiceName string `json:"service_name"`
+
+	// Fraction of requests without a traceparent header to trace, between
+	// 0 and 1; defaults to 1. Requests with one are traced if their caller
+	// sampled them.
+	SampleRatio *float64 `json:"sample_ratio"`
+
+	// How often to send spans to the collector, e.g. "10s"; defaults to
+	// five seconds
+	ExportInterval string `json:"export_interval"`
+
+	// Parsed version of ExportInterval
+	exportInterval time.Duration
+}
+
+// AuthDelegateLogRedaction configures how each kind of personal data or
+// secret is redacted wherever it appears in logs, audit records, and trace
+// spans: "hash" replaces it with a salted digest, "truncate" with a prefix
+// of it, or with the network of an IP address, and "suppress" removes it.
+// Each kind is left unchanged by default. Log entries are redacted only by
+// the authdelegate command, which owns the standard logger; programs
+// embedding a delegate must redact their own logs.
+type AuthDelegateLogRedaction struct {
+	// Authorization header values, JSON Web Tokens, and credentials echoed
+	// by exec_command
+	Credentials string `json:"credentials"`
+
+	// Email addresses, such as those in request URIs or client identities
+	Emails string `json:"emails"`
+
+	// IPv4 and IPv6 addresses, including those of upstreams
+	IPs string `json:"ips"`
+
+	// How often the salt of hashed values is replaced, e.g. "1h"; defaults
+	// to 24 hours
+	SaltRotationInterval string `json:"salt_rotation_interval"`
+
+	// Parsed version of SaltRotationInterval
+	saltRotationInterval time.Duration
+}
+
+// AuthDelegateMatch is a condition on a request, of which each block
+// defines exactly one: a test of a single attribute, or a combination of
+// other blocks.
+type AuthDelegateMatch struct {
+	// True if this header is present and not empty
+	Header string `json:"header"`
+
+	// True if this cookie is present; may end in "*", as cookie_name may
+	Cookie string `json:"cookie"`
+
+	// With Header or Cookie, true only if its value contains a match for
+	// this regular expression
+	ValuePattern string `json:"value_pattern"`
+
+	// True for this virtual host, or subdomains of it if it begins with
+	// "*.", as for the upstream's Host
+	Host string `json:"host"`
+
+	// True if the X-Original-URI path is or is below this path, as for the
+	// upstream's PathPrefix
+	PathPrefix string `json:"path_prefix"`
+
+	// True for requests with this method, ignoring case
+	Method string `json:"method"`
+
+	// True if every one of these blocks is true
+	All []*AuthDelegateMatch `json:"all"`
+
+	// True if any one of these blocks is true
+	Any []*AuthDelegateMatch `json:"any"`
+
+	// True if this block is false
+	Not *AuthDelegateMatch `json:"not"`
+}
+
+// AuthDelegateErrorSamples configures the sampling of the bodies of 5xx
+// responses from each proxied upstream, so that backend error messages can
+// be seen without access to the backend. Samples are kept in memory only.
+type AuthDelegateErrorSamples struct {
+	// How many of the most recent samples to keep for each upstream, at
+	// most 1000; defaults to 10
+	Count int `json:"count"`
+
+	// How many bytes of each body to keep, at most 65536; defaults to 1024
+	MaxBytes int `json:"max_bytes"`
+
+	// The minimum time between samples from each upstream, e.g. "10s";
+	// defaults to one second
+	Interval string `json:"interval"`
+
+	// Parsed version of Interval
+	interval time.Duration
+}
+
+// AuthDelegateAcme configures the automatic provisioning of the server
+// certificate by an ACME certificate authority, which validates control of
+// each domain by connecting to Port, which must be reachable on port 443,
+// using the tls-alpn-01 challenge.
+type AuthDelegateAcme struct {
+	// Domain names for which to obtain certificates, one for each;
+	// wildcards aren't supported
+	Domains []string `json:"domains"`
+
+	// Directory in which the account key, and the certificates and their
+	// keys, are kept, so that they are reused after a restart
+	CacheDir string `json:"cache_dir"`
+
+	// URL of the certificate authority's ACME directory; defaults to that
+	// of Let's Encrypt's production service
+	DirectoryURL string `json:"directory_url"`
+
+	// If defined, the contact address of the account, to which the
+	// certificate authority may send expiry notices
+	Email string `json:"email"`
+
+	// Must be true, agreeing to the certificate authority's terms of
+	// service, since they are agreed to when the account is created
+	AcceptTermsOfService bool `json:"accept_terms_of_service"`
+}
+
+// AuthDelegateCertExpiryAlerts configures warnings about expiring
+// certificates: those of SslCert, each listener's SslCert, AdminSslCert,
+// ControlSslCert, and each upstream's ClientCert, and the CA certificates of
+// ClientCAFile, each listener's ClientCAFile, AdminClientCA,
+// ControlClientCA, and each upstream's ClientCA.
+type AuthDelegateCertExpiryAlerts struct {
+	// How long before a certificate expires to warn, e.g. ["720h", "168h"];
+	// a warning is raised as each is crossed, and when the certificate
+	// expires. Defaults to 30 and 7 days.
+	Thresholds []string `json:"thresholds"`
+
+	// How often to check the certificates, e.g. "1h"; defaults to an hour
+	CheckInterval string `json:"check_interval"`
+
+	// If defined, each warning is posted to this URL as JSON
+	WebhookURL string `json:"webhook_url"`
+
+	// Parsed version of Thresholds, longest first
+	thresholds []time.Duration
+
+	// Parsed version of CheckInterval
+	checkInterval time.Duration
+}
+
+// AuthDelegateEmergencyAllowlist identifies the clients, such as monitoring
+// and deployment tooling, whose requests are allowed when their upstream
+// fails.
+type AuthDelegateEmergencyAllowlist struct {
+	// Hex-encoded SHA-256 digests of credential values (the value of an
+	// upstream's header or cookie)
+	CredentialHashes []string `json:"credential_hashes"`
+
+	// Header in which the TLS-terminating proxy passes the identity of
+	// the verified client certificate, e.g. its subject DN. The proxy must
+	// always set it, so that clients can't. It is only honored on requests
+	// from TrustedProxies.
+	ClientIdentityHeader string `json:"client_identity_header"`
+
+	// Values of ClientIdentityHeader, or the subject DNs of the verified
+	// client certificates of requests not from TrustedProxies
+	ClientIdentities []string `json:"client_identities"`
+
+	// Set of lowercased CredentialHashes
+	hashes map[string]bool
+}
+
+// AuthDelegateStorage selects and configures the Storage implementation.
+type AuthDelegateStorage struct {
+	// "memory" (the default), "redis", or "file"
+	Type string `json:"type"`
+
+	// Address (host:port) of the Redis server, if Type is "redis"
+	Address string `json:"address"`
+
+	// Path to a file containing the password with which to authenticate to
+	// the Redis server, if it requires one, as the ACL user Username if
+	// specified
+	Username     string `json:"username"`
+	PasswordFile string `json:"password_file"`
+
+	// If true, connect to the Redis server over TLS, verifying its
+	// certificate with the CAs in TLSCAFile, or the system's if empty
+	TLS       bool   `json:"tls"`
+	TLSCAFile string `json:"tls_ca_file"`
+
+	// Directory in which to store state, if Type is "file"
+	Path string `json:"path"`
+
+	// Contents of PasswordFile, with surrounding whitespace removed
+	password string
+
+	// Contents of TLSCAFile
+	tlsCAs *x509.CertPool
+}
+
+// AuthDelegateDynamicUpstreams defines the key-value store key from which the
+// list of upstreams is read.
+type AuthDelegateDynamicUpstreams struct {
+	// "consul" or "etcd"
+	Type string `json:"type"`
+
+	// URL of the Consul HTTP API or of the etcd gRPC gateway, e.g.
+	// "http://127.0.0.1:8500"
+	Address string `json:"address"`
+
+	// Key whose value is a JSON list of upstreams, in the same format as
+	// the "upstreams" option
+	Key string `json:"key"`
+
+	// Consul ACL token or etcd authentication token, if required
+	Token string `json:"token"`
+
+	// How often to poll etcd for changes, e.g. "30s"; defaults to 10s.
+	// Consul is watched with blocking queries instead.
+	PollInterval string `json:"poll_interval"`
+
+	// Parsed version of PollInterval
+	pollInterval time.Duration
+}
+
+// NewAuthDelegateOptionsFromJSON parses the JSON stored in config into an
+// AuthDelegateOptions structure, which is then validated. References to
+// environment variables in string values, e.g. "${SSO_URL}", are expanded
+// first. Returns nil and an error if the JSON fails to parse, if a referenced
+// variable isn't set, or if AuthDelegateOptions.Validate() fails.
+func NewAuthDelegateOptionsFromJSON(config []byte) (
+	*AuthDelegateOptions, error) {
+	config, err := interpolateEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	var opts AuthDelegateOptions
+	if err := json.Unmarshal(config, &opts); err != nil {
+		return nil, errors.New("JSON parsing failed: " + err.Error())
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+// NewAuthDelegateOptionsFromYAML parses the YAML stored in config into an
+// AuthDelegateOptions structure, which is then validated. The YAML keys are
+// the same as those of the JSON configuration. Returns nil and an error if
+// the YAML fails to parse or if AuthDelegateOptions.Validate() fails.
+func NewAuthDelegateOptionsFromYAML(config []byte) (
+	*AuthDelegateOptions, error) {
+	converted, err := yamlToJSON(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuthDelegateOptionsFromJSON(converted)
+}
+
+func yamlToJSON(config []byte) ([]byte, error) {
+	converted, err := yaml.YAMLToJSON(config)
+	if err != nil {
+		return nil, errors.New("YAML parsing failed: " + err.Error())
+	}
+	return converted, nil
+}
+
+// Validate ensures that the AuthDelegateOptions configuration is correct and
+// parses some of the values into a useable format. It also sets the Mode
+// member that determines which proxy handler to launch. Collects as many
+// error messages as possible and returns them as a single string via the err
+// return value.
+func (opts *AuthDelegateOptions) Validate() (err error) {
+	var msgs []string
+	msgs = validatePort(opts, msgs)
+	msgs = validateSsl(opts, msgs)
+	msgs = validateAcme(opts, msgs)
+	msgs = validateClientCert(opts, msgs)
+	msgs = validateCertExpiryAlerts(opts, msgs)
+	msgs = validateReusePort(opts, msgs)
+	msgs = validateListeners(opts, msgs)
+	msgs = validateRuntimeSettings(opts, msgs)
+	msgs = validateAdmin(opts, msgs)
+	msgs = validateControl(opts, msgs)
+	msgs = validateMatchPolicy(opts, msgs)
+	msgs = validateUpstreams(opts, msgs)
+	msgs = validateDynamicUpstreams(opts, msgs)
+	msgs = validateTimeouts(opts, msgs)
+	msgs = validateResponseHeaderLimits(opts, msgs)
+	msgs = validateForwardAuth(opts, msgs)
+	msgs = validateTrustedProxies(opts, msgs)
+	msgs = validateBatch(opts, msgs)
+	msgs = validateServiceUserAgents(opts, msgs)
+	msgs = validateRejectionRules(opts, msgs)
+	msgs = validateEmergencyAllowlist(opts, msgs)
+	msgs = validateSubscribePath(opts, msgs)
+	msgs = validateMetricsPath(opts, msgs)
+	msgs = validateHealthPaths(opts, msgs)
+	msgs = validatePlaintextListener(opts, msgs)
+	msgs = validateStorage(opts, msgs)
+	msgs = validateStateSnapshot(opts, msgs)
+	msgs = validateDebug(opts, msgs)
+	msgs = validateDiagnostics(opts, msgs)
+	msgs = validateTracing(opts, msgs)
+	msgs = validateLatencyLogInterval(opts, msgs)
+	msgs = validateShutdownGracePeriod(opts, msgs)
+	msgs = validateShutdownNotify(opts, msgs)
+	msgs = validateAuditDecisions(opts, msgs)
+	msgs = validateLogRedaction(opts, msgs)
+	msgs = validateErrorSamples(opts, msgs)
+	msgs = validateErrorPages(opts, msgs)
+
+	if len(msgs) != 0 {
+		err = errors.New("Invalid options:\n  " +
+			strings.Join(msgs, "\n  "))
+	}
+	return
+}
+
+// Fingerprint returns a hex-encoded SHA-256 digest of the validated
+// configuration, which is the same for equivalent configurations regardless of
+// their formatting, key order, or file format. It does not cover the contents
+// of files the configuration refers to, such as ssl_cert.
+func (opts *AuthDelegateOptions) Fingerprint() string {
+	// Struct fields are encoded in a fixed order, and maps in key order.
+	encoded, err := json.Marshal(opts)
+	if err != nil {
+		return ""
+	}
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:])
+}
+
+func (opts *AuthDelegateOptions) errorHandler() ErrorHandler {
+	if opts.ErrorHandler != nil {
+		return explainingErrorHandler(opts.ErrorHandler)
+	}
+	handler := newDefaultErrorHandler(opts.SupportContact)
+	if opts.ErrorPages != nil {
+		handler = newErrorPageHandler(opts.ErrorPages,
+			opts.SupportContact, handler)
+	}
+	return explainingErrorHandler(handler)
+}
+
+func validatePort(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.Port < 0 || (opts.Port == 0 && opts.Listen == "") {
+		msgs = append(msgs, "port must be specified and "+
+			"greater than zero")
+	}
+	return validateListen(opts, msgs)
+}
+
+func validateListen(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.UnixSocketMode != "" {
+		mode, err := strconv.ParseUint(opts.UnixSocketMode, 8, 32)
+		if err != nil || mode > 0777 {
+			msgs = append(msgs, "invalid unix_socket_mode: "+
+				opts.UnixSocketMode)
+		} else if opts.Listen == "" {
+			msgs = append(msgs, "unix_socket_mode requires listen")
+		}
+		opts.unixSocketMode = os.FileMode(mode)
+	}
+	if opts.Listen == "" {
+		return msgs
+	}
+	if !strings.HasPrefix(opts.Listen, unixSocketScheme) {
+		return append(msgs, "listen must be a unix:// socket path: "+
+			opts.Listen)
+	}
+	opts.socketPath = strings.TrimPrefix(opts.Listen, unixSocketScheme)
+	if opts.UnixSocketMode == "" {
+		opts.unixSocketMode = defaultUnixSocketMode
+	}
+	if opts.socketPath == "" {
+		msgs = append(msgs, "listen must include a socket path: "+
+			opts.Listen)
+	} else if len(opts.socketPath) > maxSocketPathLength {
+		msgs = append(msgs, "listen socket path must be at most "+
+			strconv.Itoa(maxSocketPathLength)+" bytes: "+
+			opts.socketPath)
+	}
+	return msgs
+}
+
+func validateReusePort(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.ReusePort && !reusePortSupported {
+		msgs = append(msgs, "reuse_port is not supported on this "+
+			"platform")
+	}
+	if opts.ReusePort && opts.Port == 0 {
+		msgs = append(msgs, "reuse_port requires port")
+	}
+	if opts.ReusePortListeners < 0 {
+		msgs = append(msgs, "reuse_port_listeners must not be negative")
+	} else if opts.ReusePortListeners != 0 && !opts.ReusePort {
+		msgs = append(msgs, "reuse_port_listeners requires reuse_port")
+	}
+	return msgs
+}
+
+func validateListeners(opts *AuthDelegateOptions, msgs []string) []string {
+	upstreams := make(map[string]bool)
+	for _, upstream := range opts.Upstreams {
+		upstreams[upstreamLabel(upstream)] = true
+	}
+	names := make(map[string]int)
+	for _, listener := range opts.Listeners {
+		if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			msgs = append(msgs, "invalid listener address: "+
+				err.Error())
+		}
+		names[listener.listenerName()]++
+		for _, name := range listener.SkipUpstreams {
+			if !upstreams[name] {
+				msgs = append(msgs, "listener "+
+					listener.listenerName()+" skips "+
+					"unknown upstream: "+name)
+			}
+		}
+		msgs = validateListenerTLS(opts, listener, msgs)
+	}
+	return validateNameCounts("listener names", names, msgs)
+}
+
+// validateListenerTLS checks the TLS settings of an additional listener, and
+// loads the CA certificates with which it verifies client certificates, if
+// it requires them.
+func validateListenerTLS(opts *AuthDelegateOptions,
+	listener *AuthDelegateListener, msgs []string) []string {
+	name := "listener " + listener.listenerName()
+	if listener.Plaintext && listener.SslCert != "" {
+		msgs = append(msgs, name+" can't be plaintext and define "+
+			"ssl_cert")
+	} else if listener.Plaintext && !opts.servesTLS() {
+		msgs = append(msgs, name+" plaintext requires ssl_cert, since "+
+			"listeners are plaintext without it")
+	}
+	msgs = validateCertAndKey(listener.SslCert, listener.SslKey,
+		name+" ssl_cert", name+" ssl_key", msgs)
+	if !listener.requiresClientCert(opts) {
+		if listener.ClientCAFile != "" {
+			msgs = append(msgs, name+" client_ca_file requires "+
+				"require_client_cert")
+		}
+		return msgs
+	} else if !listener.usesTLS(opts) {
+		return append(msgs, name+" require_client_cert requires "+
+			"ssl_cert and ssl_key")
+	}
+	if listener.ClientCAFile == "" {
+		if listener.clientCAs = opts.clientCAs; opts.ClientCAFile == "" {
+			msgs = append(msgs, name+" require_client_cert requires "+
+				"client_ca_file")
+		}
+		return msgs
+	}
+	var pool *x509.CertPool
+	if pool, msgs = loadCertPool(listener.ClientCAFile,
+		name+" client_ca_file", msgs); pool != nil {
+		listener.clientCAs = pool
+	}
+	return msgs
+}
+
+func validateRuntimeSettings(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.GoMaxProcs < 0 {
+		msgs = append(msgs, "gomaxprocs must not be negative")
+	}
+	if opts.GoMemLimit != "" {
+		var err error
+		if opts.goMemLimit, err = parseByteSize(opts.GoMemLimit); err != nil {
+			msgs = append(msgs, "invalid gomemlimit: "+
+				opts.GoMemLimit)
+		}
+	}
+	return msgs
+}
+
+func checkExistenceAndPermission(path, optionName string,
+	msgs []string) []string {
+	if info, err := os.Stat(path); os.IsNotExist(err) {
+		msgs = append(msgs, optionName+" does not exist: "+path)
+	} else if os.IsPermission(err) {
+		msgs = append(msgs, optionName+" permission is denied: "+path)
+	} else if !info.Mode().IsRegular() {
+		msgs = append(msgs, optionName+" is not a regular file: "+path)
+	}
+	return msgs
+}
+
+func validateSsl(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.SslOcspStapling && opts.SslCert == "" {
+		msgs = append(msgs, "ssl_ocsp_stapling requires ssl_cert and "+
+			"ssl_key")
+	}
+	if opts.SslSessionResumption != nil && !opts.servesTLS() {
+		msgs = append(msgs, "ssl_session_resumption requires ssl_cert "+
+			"and ssl_key")
+	}
+	if opts.SslEarlyData {
+		msgs = append(msgs, "ssl_early_data is not supported, since "+
+			"TLS 1.3 0-RTT data can be replayed")
+	}
+	if opts.SslCertReloadInterval != "" {
+		parsed, err := time.ParseDuration(opts.SslCertReloadInterval)
+		if err != nil || parsed < 0 {
+			msgs = append(msgs, "invalid ssl_cert_reload_interval: "+
+				opts.SslCertReloadInterval)
+		}
+		opts.sslCertReloadInterval = parsed
+	}
+	msgs = validateTLSHardening(opts, msgs)
+	return validateCertAndKey(opts.SslCert, opts.SslKey,
+		"ssl-cert", "ssl-key", msgs)
+}
+
+// validateAcme checks the acme configuration, if any, which replaces
+// ssl_cert and ssl_key.
+func validateAcme(opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.Acme
+	if config == nil {
+		return msgs
+	}
+	if opts.SslCert != "" || opts.SslKey != "" {
+		msgs = append(msgs, "acme can't be combined with ssl_cert and "+
+			"ssl_key")
+	}
+	if len(config.Domains) == 0 {
+		msgs = append(msgs, "acme requires domains")
+	}
+	for _, domain := range config.Domains {
+		if domain == "" || net.ParseIP(domain) != nil ||
+			strings.ContainsAny(domain, "*:/ ") {
+			msgs = append(msgs, "acme domains entry must be a host "+
+				"name: "+domain)
+		}
+	}
+	if config.CacheDir == "" {
+		msgs = append(msgs, "acme requires cache_dir")
+	}
+	if config.DirectoryURL != "" {
+		if parsed, err := url.Parse(config.DirectoryURL); err != nil ||
+			parsed.Scheme != "https" || parsed.Host == "" {
+			msgs = append(msgs, "acme directory_url must be an https "+
+				"URL: "+config.DirectoryURL)
+		}
+	}
+	if !config.AcceptTermsOfService {
+		msgs = append(msgs, "acme requires accept_terms_of_service: "+
+			"true, agreeing to the certificate authority's terms of "+
+			"service")
+	}
+	return msgs
+}
+
+// tlsCurves maps the names of the curves of ssl_curve_preferences to their
+// IDs.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P-256":  tls.CurveP256,
+	"P-384":  tls.CurveP384,
+	"P-521":  tls.CurveP521,
+}
+
+// validateTLSHardening parses the minimum TLS version, cipher suites, and
+// curve preferences of the listeners. Only secure TLS 1.2 cipher suites may
+// be chosen, since Go doesn't allow TLS 1.3 suites to be configured.
+func validateTLSHardening(opts *AuthDelegateOptions, msgs []string) []string {
+	switch opts.SslMinVersion {
+	case "":
+	case "1.2":
+		opts.sslMinVersion = tls.VersionTLS12
+	case "1.3":
+		opts.sslMinVersion = tls.VersionTLS13
+	default:
+		msgs = append(msgs, "ssl_min_version must be 1.2 or 1.3: "+
+			opts.SslMinVersion)
+	}
+	if len(opts.SslCipherSuites) != 0 &&
+		opts.sslMinVersion == tls.VersionTLS13 {
+		msgs = append(msgs, "ssl_cipher_suites has no effect with "+
+			"ssl_min_version 1.3")
+	}
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	insecure := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	opts.sslCipherSuites = nil
+	for _, name := range opts.SslCipherSuites {
+		suite, ok := suites[name]
+		switch {
+		case insecure[name]:
+			msgs = append(msgs, "insecure ssl_cipher_suites entry: "+
+				name)
+		case !ok:
+			msgs = append(msgs, "unknown ssl_cipher_suites entry: "+
+				name)
+		case suite.SupportedVersions[0] == tls.VersionTLS13:
+			msgs = append(msgs, "ssl_cipher_suites entry is a TLS "+
+				"1.3 suite, which isn't configurable: "+name)
+		default:
+			opts.sslCipherSuites = append(opts.sslCipherSuites,
+				suite.ID)
+		}
+	}
+	opts.sslCurvePreferences = nil
+	for _, name := range opts.SslCurvePreferences {
+		if curve, ok := tlsCurves[name]; ok {
+			opts.sslCurvePreferences = append(
+				opts.sslCurvePreferences, curve)
+		} else {
+			msgs = append(msgs, "ssl_curve_preferences entry must be "+
+				"X25519, P-256, P-384, or P-521: "+name)
+		}
+	}
+	return msgs
+}
+
+func validateClientCert(opts *AuthDelegateOptions, msgs []string) []string {
+	if !opts.RequireClientCert {
+		if opts.ClientCAFile != "" {
+			msgs = append(msgs, "client_ca_file requires "+
+				"require_client_cert")
+		}
+		return msgs
+	}
+	if !opts.servesTLS() {
+		msgs = append(msgs, "require_client_cert requires ssl_cert and "+
+			"ssl_key")
+	}
+	if opts.ClientCAFile == "" {
+		return append(msgs, "require_client_cert requires client_ca_file")
+	}
+	var pool *x509.CertPool
+	if pool, msgs = loadCertPool(opts.ClientCAFile, "client_ca_file",
+		msgs); pool != nil {
+		opts.clientCAs = pool
+	}
+	return msgs
+}
+
+func validateCertExpiryAlerts(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.CertExpiryAlerts
+	if config == nil {
+		return msgs
+	}
+	thresholds := config.Thresholds
+	if thresholds == nil {
+		thresholds = defaultCertExpiryThresholds
+	} else if len(thresholds) == 0 {
+		msgs = append(msgs, "cert_expiry_alerts thresholds must not be "+
+			"empty")
+	}
+	config.thresholds = nil
+	for _, threshold := range thresholds {
+		parsed, err := time.ParseDuration(threshold)
+		if err != nil || parsed <= 0 {
+			msgs = append(msgs, "invalid cert_expiry_alerts threshold: "+
+				threshold)
+			continue
+		}
+		config.thresholds = append(config.thresholds, parsed)
+	}
+	sort.Slice(config.thresholds, func(i, j int) bool {
+		return config.thresholds[i] > config.thresholds[j]
+	})
+	msgs = validateDuration(config.CheckInterval, "check_interval",
+		"cert_expiry_alerts", &config.checkInterval, msgs)
+	if config.CheckInterval == "" {
+		config.checkInterval = defaultCertExpiryCheckInterval
+	} else if config.checkInterval == 0 {
+		msgs = append(msgs, "cert_expiry_alerts check_interval must be "+
+			"positive")
+	}
+	if config.WebhookURL != "" {
+		if parsed, err := url.Parse(config.WebhookURL); err != nil ||
+			!(parsed.Scheme == "http" || parsed.Scheme == "https") ||
+			parsed.Host == "" {
+			msgs = append(msgs, "invalid cert_expiry_alerts "+
+				"webhook_url: "+config.WebhookURL)
+		}
+	}
+	return msgs
+}
+
+func validateTracing(opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.Tracing
+	if config == nil {
+		return msgs
+	}
+	if parsed, err := url.Parse(config.OTLPEndpoint); err != nil ||
+		!(parsed.Scheme == "http" || parsed.Scheme == "https") ||
+		parsed.Host == "" {
+		msgs = append(msgs, "tracing otlp_endpoint must be an http or "+
+			"https URL: "+config.OTLPEndpoint)
+	}
+	var names []string
+	for name := range config.OTLPHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name,
+			" \t\r\n:()<>@,;\\\"/[]?={}") {
+			msgs = append(msgs, "invalid tracing otlp_headers name: "+
+				name)
+		} else if strings.ContainsAny(config.OTLPHeaders[name], "\r\n") {
+			msgs = append(msgs, "invalid tracing otlp_headers value: "+
+				name)
+		}
+	}
+	if ratio := config.SampleRatio; ratio != nil &&
+		!(*ratio >= 0 && *ratio <= 1) {
+		msgs = append(msgs, "tracing sample_ratio must be between 0 "+
+			"and 1: "+strconv.FormatFloat(*ratio, 'g', -1, 64))
+	}
+	msgs = validateDuration(config.ExportInterval, "export_interval",
+		"tracing", &config.exportInterval, msgs)
+	if config.ExportInterval == "" {
+		config.exportInterval = defaultTracingExportInterval
+	} else if config.exportInterval == 0 {
+		msgs = append(msgs, "tracing export_interval must be positive")
+	}
+	return msgs
+}
+
+func validateCertAndKey(cert, key, certOption, keyOption string,
+	msgs []string) []string {
+	certSpecified := cert != ""
+	keySpecified := key != ""
+	if !(certSpecified || keySpecified) {
+		return msgs
+	} else if !(certSpecified && keySpecified) {
+		msgs = append(msgs, certOption+" and "+keyOption+" must both "+
+			"be specified, or neither must be")
+	}
+
+	if certSpecified {
+		msgs = checkExistenceAndPermission(cert, certOption, msgs)
+	}
+	if keySpecified {
+		msgs = checkExistenceAndPermission(key, keyOption, msgs)
+	}
+	return msgs
+}
+
+func validateAdmin(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.AdminAddress == "" {
+		if opts.AdminSslCert != "" || opts.AdminSslKey != "" ||
+			opts.AdminClientCA != "" ||
+			opts.AdminBearerTokenFile != "" ||
+			len(opts.AdminAllowedNetworks) != 0 {
+			msgs = append(msgs, "admin options specified without "+
+				"admin_address")
+		}
+		return msgs
+	}
+	if _, _, err := net.SplitHostPort(opts.AdminAddress); err != nil {
+		msgs = append(msgs, "invalid admin_address: "+err.Error())
+	}
+	msgs = validateCertAndKey(opts.AdminSslCert, opts.AdminSslKey,
+		"admin-ssl-cert", "admin-ssl-key", msgs)
+	msgs = validateAdminClientCA(opts, msgs)
+	msgs = validateAdminBearerToken(opts, msgs)
+	msgs = validateAdminAllowedNetworks(opts, msgs)
+	return msgs
+}
+
+func validateAdminClientCA(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.AdminClientCA == "" {
+		return msgs
+	} else if opts.AdminSslCert == "" {
+		return append(msgs, "admin-client-ca requires admin-ssl-cert "+
+			"and admin-ssl-key")
+	}
+	var pool *x509.CertPool
+	if pool, msgs = loadCertPool(opts.AdminClientCA, "admin-client-ca",
+		msgs); pool != nil {
+		opts.adminClientCAs = pool
+	}
+	return msgs
+}
+
+func validateControl(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.ControlAddress == "" {
+		if opts.ControlSslCert != "" || opts.ControlSslKey != "" ||
+			opts.ControlClientCA != "" {
+			msgs = append(msgs, "control options specified without "+
+				"control_address")
+		}
+		return msgs
+	}
+	if !controlSupported {
+		return append(msgs, "control_address is not supported by this "+
+			"build, which has the nocontrol tag")
+	}
+	if _, _, err := net.SplitHostPort(opts.ControlAddress); err != nil {
+		msgs = append(msgs, "invalid control_address: "+err.Error())
+	}
+	if opts.ControlSslCert == "" || opts.ControlSslKey == "" ||
+		opts.ControlClientCA == "" {
+		return append(msgs, "control_address requires control-ssl-cert, "+
+			"control-ssl-key, and control-client-ca")
+	}
+	msgs = validateCertAndKey(opts.ControlSslCert, opts.ControlSslKey,
+		"control-ssl-cert", "control-ssl-key", msgs)
+	var pool *x509.CertPool
+	if pool, msgs = loadCertPool(opts.ControlClientCA,
+		"control-client-ca", msgs); pool != nil {
+		opts.controlClientCAs = pool
+	}
+	return msgs
+}
+
+// loadCertPool reads the PEM-encoded certificates in path. Returns nil if the
+// file can't be read or contains no certificates.
+func loadCertPool(path, optionName string,
+	msgs []string) (*x509.CertPool, []string) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, append(msgs, optionName+" could not be read: "+
+			err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, append(msgs, optionName+" contains no "+
+			"PEM-encoded certificates: "+path)
+	}
+	return pool, msgs
+}
+
+func validateAdminBearerToken(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.AdminBearerTokenFile == "" {
+		return msgs
+	}
+	token, err := ioutil.ReadFile(opts.AdminBearerTokenFile)
+	if err != nil {
+		return append(msgs, "admin-bearer-token-file could not be "+
+			"read: "+err.Error())
+	}
+	opts.adminBearerToken = bytes.TrimSpace(token)
+	if len(opts.adminBearerToken) == 0 {
+		msgs = append(msgs, "admin-bearer-token-file is empty: "+
+			opts.AdminBearerTokenFile)
+	}
+	return msgs
+}
+
+func validateAdminAllowedNetworks(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	opts.adminNetworks = nil
+	for _, network := range opts.AdminAllowedNetworks {
+		if parsed, ok := parseNetwork(network); ok {
+			opts.adminNetworks = append(opts.adminNetworks, parsed)
+		} else {
+			msgs = append(msgs, "invalid admin_allowed_networks "+
+				"entry: "+network)
+		}
+	}
+	return msgs
+}
+
+// parseNetwork parses network as CIDR notation or, failing that, as a single
+// IP address.
+func parseNetwork(network string) (*net.IPNet, bool) {
+	if _, parsed, err := net.ParseCIDR(network); err == nil {
+		return parsed, true
+	}
+	ip := net.ParseIP(network)
+	if ip == nil {
+		return nil, false
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, true
+}
+
+func validateUpstreams(opts *AuthDelegateOptions, msgs []string) []string {
+	if len(opts.Upstreams) == 0 {
+		return append(msgs, "no upstreams defined")
+	}
+
+	numUpstreams := len(opts.Upstreams)
+	var defaultUpstreams []string
+	upstreamNames := make(map[string]int)
+	cookieNames := make(map[string]int)
+	headerNames := make(map[string]int)
+
+	for i := 0; i != numUpstreams; i++ {
+		current := opts.Upstreams[i]
+		msgs = validateUpstream(current, msgs)
+		if current.isDefault() {
+			defaultUpstreams = append(defaultUpstreams, current.URL)
+		}
+		upstreamNames[current.Name]++
+		for _, name := range upstreamCookieNames(current) {
+			cookieNames[matcherScope(name, current)]++
+		}
+		for _, name := range upstreamHeaderNames(current) {
+			headerNames[matcherScope(name, current)]++
+		}
+	}
+	msgs = validateNameCounts("upstream names", upstreamNames, msgs)
+	msgs = validateNameCounts("cookie names", cookieNames, msgs)
+	msgs = validateNameCounts("header names", headerNames, msgs)
+	msgs = validateDefaultUpstreams(defaultUpstreams,
+		opts.Upstreams[numUpstreams-1], msgs)
+	msgs = validateOverlappingUpstreams(opts, msgs)
+	return msgs
+}
+
+func validateDynamicUpstreams(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	dynamic := opts.DynamicUpstreams
+	if dynamic == nil {
+		return msgs
+	}
+	if dynamic.Type != dynamicConsul && dynamic.Type != dynamicEtcd {
+		msgs = append(msgs, "dynamic_upstreams type must be consul or "+
+			"etcd: "+dynamic.Type)
+	}
+	if parsed, err := url.Parse(dynamic.Address); err != nil ||
+		!(parsed.Scheme == "http" || parsed.Scheme == "https") ||
+		parsed.Host == "" {
+		msgs = append(msgs, "invalid dynamic_upstreams address: "+
+			dynamic.Address)
+	}
+	if dynamic.Key == "" {
+		msgs = append(msgs, "dynamic_upstreams key must be specified")
+	}
+	if dynamic.PollInterval != "" && dynamic.Type == dynamicConsul {
+		msgs = append(msgs, "dynamic_upstreams poll_interval requires "+
+			"type etcd")
+	}
+	msgs = validateDuration(dynamic.PollInterval, "poll_interval",
+		"dynamic_upstreams", &dynamic.pollInterval, msgs)
+	if dynamic.pollInterval == 0 {
+		dynamic.pollInterval = defaultDynamicPollInterval
+	}
+	return msgs
+}
+
+func validateUpstream(upstream *AuthDelegateUpstream, msgs []string) []string {
+	localScheme, local := localUpstreamSchemes[upstream.Type]
+	if local && upstream.URL == "" && upstream.Name != "" {
+		upstream.URL = localScheme + ":" + upstream.Name
+	}
+	var err error
+	if upstream.parsedURL, err = url.Parse(upstream.URL); err != nil {
+		msgs = append(msgs, "upstream URL failed to parse"+err.Error())
+	}
+	scheme := upstream.parsedURL.Scheme
+	switch {
+	case local:
+		msgs = validateLocalUpstream(upstream, localScheme, msgs)
+	case upstream.Type != "":
+		msgs = append(msgs, "invalid upstream type for "+upstream.URL+
+			": "+upstream.Type)
+	case scheme == "":
+		msgs = append(msgs, "upstream scheme not specified: "+
+			upstream.URL)
+	case !(scheme == "http" || scheme == "https"):
+		msgs = append(msgs, "invalid upstream scheme: "+upstream.URL)
+	}
+	msgs = validateTypeOptions(upstream, msgs)
+	msgs = validateAuthScheme(upstream, msgs)
+	if len(upstream.HeaderAliases) != 0 && (upstream.HeaderName == "" ||
+		containsString(upstream.HeaderAliases, "")) {
+		msgs = append(msgs, "header_name must not include empty "+
+			"names: "+upstream.URL)
+	}
+	if len(upstream.CookieAliases) != 0 && (upstream.CookieName == "" ||
+		containsString(upstream.CookieAliases, "")) {
+		msgs = append(msgs, "cookie_name must not include empty "+
+			"names: "+upstream.URL)
+	}
+	for _, name := range upstreamCookieNames(upstream) {
+		if prefix, _ := cookieNamePrefix(name); prefix == "" ||
+			strings.Contains(prefix, "*") {
+			msgs = append(msgs, "invalid cookie name for "+
+				upstream.URL+": "+name)
+		}
+	}
+	msgs = validateCookieValue(upstream, msgs)
+	msgs = validateHeaderValueRegex(upstream, msgs)
+	msgs = validateUpstreamTLS(upstream, msgs)
+	msgs = validateDuration(upstream.Timeout, "timeout", upstream.URL,
+		&upstream.timeout, msgs)
+	msgs = validateDuration(upstream.ExpectContinueTimeout,
+		"expect_continue_timeout", upstream.URL,
+		&upstream.expectContinueTimeout, msgs)
+	msgs = validateCache(upstream, msgs)
+	msgs = validateCacheSeedURL(upstream, msgs)
+	msgs = validateResponseHeaderNames(upstream, msgs)
+	msgs = validateAnnotationHeaders(upstream, msgs)
+	if upstream.CredentialHeader != "" && upstream.HeaderName == "" &&
+		upstream.CookieName == "" {
+		msgs = append(msgs, "credential_header requires header_name "+
+			"or cookie_name: "+upstream.URL)
+	}
+	msgs = validateRetryWindow(upstream, msgs)
+	msgs = validateRetryPolicy(upstream, msgs)
+	msgs = validateRateLimits(upstream, msgs)
+	msgs = validateAdaptiveConcurrency(upstream, msgs)
+	msgs = validateLoadBalancing(upstream, msgs)
+	msgs = validateHealthCheck(upstream, msgs)
+	msgs = validateFailOpen(upstream, msgs)
+	msgs = validateCircuitBreaker(upstream, msgs)
+	msgs = validateOnError(upstream, msgs)
+	switch upstream.Priority {
+	case "", priorityHigh, priorityLow:
+	default:
+		msgs = append(msgs, "invalid priority for "+upstream.URL+": "+
+			upstream.Priority)
+	}
+	if name := strings.TrimPrefix(upstream.Host, "*."); upstream.Host != "" &&
+		(name == "" || strings.ContainsAny(name, "*:/ ")) {
+		msgs = append(msgs, "invalid host for "+upstream.URL+": "+
+			upstream.Host)
+	}
+	if upstream.PathPrefix != "" &&
+		!strings.HasPrefix(upstream.PathPrefix, "/") {
+		msgs = append(msgs, "path_prefix must begin with / for "+
+			upstream.URL+": "+upstream.PathPrefix)
+	}
+	switch upstream.Traffic {
+	case "", trafficHuman, trafficService:
+	default:
+		msgs = append(msgs, "invalid traffic for "+upstream.URL+": "+
+			upstream.Traffic)
+	}
+	msgs = validateMatch(upstream, msgs)
+	msgs = validateMethods(upstream, msgs)
+	msgs = validateLatencyBuckets(upstream, msgs)
+	if upstream.MatchExpression != "" {
+		var err error
+		if upstream.matchExpression, err = compileExpression(
+			upstream.MatchExpression); err != nil {
+			msgs = append(msgs, "invalid match_expression for "+
+				upstream.URL+": "+err.Error())
+		}
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"head_requests", upstream.HeadRequests},
+		{"options_requests", upstream.OptionsRequests},
+	} {
+		switch setting.value {
+		case "", methodPass, methodGet:
+		default:
+			msgs = append(msgs, setting.name+" must be pass or get "+
+				"for "+upstream.URL+": "+setting.value)
+		}
+	}
+	switch upstream.Protocol {
+	case "", protocolHTTP1, protocolHTTP2:
+	default:
+		msgs = append(msgs, "protocol must be http/1.1 or h2 for "+
+			upstream.URL+": "+upstream.Protocol)
+	}
+	return msgs
+}
+
+// validateUpstreamTLS loads the client certificate and CA certificates of
+// upstream, if specified.
+func validateUpstreamTLS(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	if upstream.EarlyData {
+		msgs = append(msgs, "early_data is not supported, since TLS 1.3 "+
+			"0-RTT data can be replayed: "+upstream.URL)
+	}
+	if upstream.SessionResumption && upstream.parsedURL.Scheme != "https" {
+		msgs = append(msgs, "session_resumption requires an https url: "+
+			upstream.URL)
+	}
+	if upstream.ClientCert == "" && upstream.ClientKey == "" &&
+		upstream.ClientCA == "" {
+		return msgs
+	} else if upstream.parsedURL.Scheme != "https" {
+		msgs = append(msgs, "client_cert, client_key, and client_ca "+
+			"require an https url: "+upstream.URL)
+	}
+	if (upstream.ClientCert == "") != (upstream.ClientKey == "") {
+		msgs = append(msgs, "client_cert and client_key must both be "+
+			"specified, or neither must be: "+upstream.URL)
+	} else if upstream.ClientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(upstream.ClientCert,
+			upstream.ClientKey)
+		if err != nil {
+			msgs = append(msgs, "client_cert could not be loaded for "+
+				upstream.URL+": "+err.Error())
+		} else {
+			upstream.clientCertificate = &certificate
+		}
+	}
+	if upstream.ClientCA != "" {
+		var pool *x509.CertPool
+		if pool, msgs = loadCertPool(upstream.ClientCA,
+			"client_ca for "+upstream.URL, msgs); pool != nil {
+			upstream.clientCAs = pool
+		}
+	}
+	return msgs
+}
+
+// validateAuthScheme checks that auth_scheme is a single token, and defaults
+// header_name to Authorization if it is specified, so that the credential is
+// the Authorization header for the purposes of caching and coalescing.
+func validateAuthScheme(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	if upstream.AuthScheme == "" {
+		return msgs
+	}
+	if strings.ContainsAny(upstream.AuthScheme, " \t\",=") {
+		msgs = append(msgs, "invalid auth_scheme for "+upstream.URL+": "+
+			upstream.AuthScheme)
+	}
+	if upstream.HeaderName != "" &&
+		!strings.EqualFold(upstream.HeaderName, "Authorization") {
+		msgs = append(msgs, "auth_scheme requires header_name "+
+			"Authorization or none: "+upstream.URL)
+	} else if upstream.HeaderName == "" {
+		upstream.HeaderName = "Authorization"
+	}
+	return msgs
+}
+
+// isDefault returns true if the upstream accepts every request, having no
+// match conditions.
+func (upstream *AuthDelegateUpstream) isDefault() bool {
+	return upstream.HeaderName == "" && upstream.CookieName == "" &&
+		upstream.Host == "" && upstream.PathPrefix == "" &&
+		upstream.Traffic == "" && upstream.MatchExpression == "" &&
+		upstream.Match == nil && len(upstream.Methods) == 0 &&
+		len(upstream.HeaderValueRegex) == 0 &&
+		!pluginMayMatch(upstream)
+}
+
+func validateFailOpen(upstream *AuthDelegateUpstream, msgs []string) []string {
+	config := upstream.FailOpen
+	if config == nil {
+		return msgs
+	}
+	if config.After == "" {
+		msgs = append(msgs, "fail_open after must be specified: "+
+			upstream.URL)
+	}
+	msgs = validateDuration(config.After, "fail_open after", upstream.URL,
+		&config.after, msgs)
+	if len(config.PathPrefixes) == 0 {
+		msgs = append(msgs, "fail_open path_prefixes must be "+
+			"specified: "+upstream.URL)
+	}
+	for _, prefix := range config.PathPrefixes {
+		msgs = validatePath(prefix, "fail_open path prefix", msgs)
+	}
+	return msgs
+}
+
+func validateOnError(upstream *AuthDelegateUpstream, msgs []string) []string {
+	switch upstream.FailClosedStatus {
+	case 0, http.StatusUnauthorized, http.StatusServiceUnavailable:
+	default:
+		msgs = append(msgs, "fail_closed_status must be 401 or 503 for "+
+			upstream.URL+": "+
+			strconv.Itoa(upstream.FailClosedStatus))
+	}
+	switch upstream.OnError {
+	case "", onErrorFailClosed:
+		return msgs
+	case onErrorFailOpen:
+	default:
+		return append(msgs, "invalid on_error for "+upstream.URL+": "+
+			upstream.OnError)
+	}
+	if upstream.FailClosedStatus != 0 {
+		msgs = append(msgs, "fail_closed_status requires on_error "+
+			"fail_closed: "+upstream.URL)
+	}
+	if upstreamAddress(upstream.parsedURL) == "" {
+		msgs = append(msgs, "on_error fail_open requires an http or "+
+			"https url: "+upstream.URL)
+	} else if upstream.FailOpen != nil {
+		msgs = append(msgs, "fail_open is redundant with on_error "+
+			"fail_open: "+upstream.URL)
+	}
+	if breaker := upstream.CircuitBreaker; breaker != nil &&
+		breaker.Status/100 != 2 {
+		msgs = append(msgs, "on_error fail_open requires a 2xx "+
+			"circuit_breaker status: "+upstream.URL)
+	}
+	return msgs
+}
+
+func validateAdaptiveConcurrency(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	config := upstream.AdaptiveConcurrency
+	if config == nil {
+		return msgs
+	}
+	if config.TargetLatency == "" {
+		msgs = append(msgs, "adaptive_concurrency target_latency must "+
+			"be specified: "+upstream.URL)
+	}
+	msgs = validateDuration(config.TargetLatency, "target_latency",
+		upstream.URL, &config.targetLatency, msgs)
+	if config.MinLimit == 0 {
+		config.MinLimit = 1
+	}
+	if config.MinLimit < 0 || config.MaxLimit < config.MinLimit {
+		msgs = append(msgs, "adaptive_concurrency requires "+
+			"0 < min_limit <= max_limit: "+upstream.URL)
+	}
+	if share := config.LowPriorityShare; share != nil &&
+		(*share < 0 || *share > 1) {
+		msgs = append(msgs, "low_priority_share must be between 0 "+
+			"and 1: "+upstream.URL)
+	}
+	return msgs
+}
+
+func validateCircuitBreaker(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	config := upstream.CircuitBreaker
+	if config == nil {
+		return msgs
+	} else if upstreamAddress(upstream.parsedURL) == "" {
+		return append(msgs, "circuit_breaker requires an http or https "+
+			"url: "+upstream.URL)
+	}
+	msgs = validateDuration(config.Window, "circuit_breaker window",
+		upstream.URL, &config.window, msgs)
+	msgs = validateDuration(config.CoolDown, "circuit_breaker cool_down",
+		upstream.URL, &config.coolDown, msgs)
+	if config.ConsecutiveFailures == 0 {
+		config.ConsecutiveFailures = defaultCircuitFailures
+	}
+	if config.MinRequests == 0 {
+		config.MinRequests = defaultCircuitMinRequests
+	}
+	if config.window == 0 {
+		config.window = defaultCircuitWindow
+	}
+	if config.coolDown == 0 {
+		config.coolDown = defaultCircuitCoolDown
+	}
+	if config.Status == 0 && upstream.OnError == onErrorFailOpen {
+		config.Status = http.StatusAccepted
+	} else if config.Status == 0 {
+		config.Status = http.StatusServiceUnavailable
+	}
+	if config.ConsecutiveFailures < 0 || config.MinRequests < 0 {
+		msgs = append(msgs, "circuit_breaker consecutive_failures and "+
+			"min_requests must be positive: "+upstream.URL)
+	}
+	if config.FailureRate < 0 || config.FailureRate > 1 {
+		msgs = append(msgs, "circuit_breaker failure_rate must be "+
+			"between 0 and 1: "+upstream.URL)
+	}
+	if config.Status != http.StatusServiceUnavailable &&
+		config.Status/100 != 2 {
+		msgs = append(msgs, "circuit_breaker status must be 503 or "+
+			"2xx for "+upstream.URL+": "+strconv.Itoa(config.Status))
+	}
+	return msgs
+}
+
+// parseReplicaURLs parses the URLs of replicas of upstream listed in the
+// option optionName, which must have the same scheme as its url.
+func parseReplicaURLs(upstream *AuthDelegateUpstream, optionName string,
+	urls []string, msgs []string) ([]*url.URL, []string) {
+	var parsedURLs []*url.URL
+	for _, replica := range urls {
+		parsed, err := url.Parse(replica)
+		if err != nil || parsed.Scheme != upstream.parsedURL.Scheme ||
+			parsed.Host == "" {
+			msgs = append(msgs, optionName+" must be "+
+				upstream.parsedURL.Scheme+" URLs like url: "+
+				upstream.URL+": "+replica)
+			continue
+		}
+		parsedURLs = append(parsedURLs, parsed)
+	}
+	return parsedURLs, msgs
+}
+
+func validateLoadBalancing(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	upstream.parsedReplicaURLs, msgs = parseReplicaURLs(upstream,
+		"replica_urls", upstream.ReplicaURLs, msgs)
+	switch upstream.LoadBalancing {
+	case "", balanceRoundRobin, balanceLeastConn, balanceRandom:
+	default:
+		msgs = append(msgs, "load_balancing must be round_robin, "+
+			"least_conn, or random for URL: "+upstream.URL)
+	}
+	if upstream.LoadBalancing != "" && len(upstream.ReplicaURLs) == 0 {
+		msgs = append(msgs, "load_balancing requires replica_urls: "+
+			upstream.URL)
+	}
+	return msgs
+}
+
+func validateHealthCheck(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	upstream.parsedFailoverURLs, msgs = parseReplicaURLs(upstream,
+		"failover_urls", upstream.FailoverURLs, msgs)
+	config := upstream.HealthCheck
+	if config == nil {
+		if len(upstream.FailoverURLs) != 0 {
+			msgs = append(msgs, "failover_urls requires health_check: "+
+				upstream.URL)
+		}
+		return msgs
+	} else if upstreamAddress(upstream.parsedURL) == "" {
+		return append(msgs, "health_check requires an http or https "+
+			"url: "+upstream.URL)
+	}
+	if !strings.HasPrefix(config.Path, "/") {
+		msgs = append(msgs, "health_check path must begin with /: "+
+			upstream.URL)
+	}
+	msgs = validateDuration(config.Interval, "health_check interval",
+		upstream.URL, &config.interval, msgs)
+	msgs = validateDuration(config.Timeout, "health_check timeout",
+		upstream.URL, &config.timeout, msgs)
+	if config.interval == 0 {
+		config.interval = defaultHealthCheckInterval
+	}
+	if config.timeout == 0 {
+		config.timeout = defaultHealthCheckTimeout
+	}
+	if config.HealthyThreshold == 0 {
+		config.HealthyThreshold = defaultHealthyThreshold
+	}
+	if config.UnhealthyThreshold == 0 {
+		config.UnhealthyThreshold = defaultUnhealthyThreshold
+	}
+	if config.HealthyThreshold < 0 || config.UnhealthyThreshold < 0 {
+		msgs = append(msgs, "health_check thresholds must be "+
+			"positive: "+upstream.URL)
+	}
+	return msgs
+}
+
+func validateCache(upstream *AuthDelegateUpstream, msgs []string) []string {
+	msgs = validateDuration(upstream.CacheTTL, "cache_ttl", upstream.URL,
+		&upstream.cacheTTL, msgs)
+	msgs = validateDuration(upstream.DenyCacheTTL, "deny_cache_ttl",
+		upstream.URL, &upstream.denyCacheTTL, msgs)
+	if (upstream.CacheTTL != "" || upstream.DenyCacheTTL != "") &&
+		upstream.HeaderName == "" && upstream.CookieName == "" {
+		msgs = append(msgs, "caching requires header_name or "+
+			"cookie_name: "+upstream.URL)
+	}
+	if upstream.CacheMaxEntries < 0 {
+		msgs = append(msgs, "cache_max_entries must not be negative: "+
+			upstream.URL)
+	} else if upstream.CacheMaxEntries != 0 && upstream.CacheTTL == "" {
+		msgs = append(msgs, "cache_max_entries requires cache_ttl: "+
+			upstream.URL)
+	}
+	if upstream.DenyCacheMaxEntries < 0 {
+		msgs = append(msgs, "deny_cache_max_entries must not be "+
+			"negative: "+upstream.URL)
+	} else if upstream.DenyCacheMaxEntries != 0 &&
+		upstream.DenyCacheTTL == "" {
+		msgs = append(msgs, "deny_cache_max_entries requires "+
+			"deny_cache_ttl: "+upstream.URL)
+	}
+	msgs = validateCacheKey(upstream, msgs)
+	if upstream.CoalesceRequests && upstream.HeaderName == "" &&
+		upstream.CookieName == "" {
+		msgs = append(msgs, "coalesce_requests requires header_name "+
+			"or cookie_name: "+upstream.URL)
+	}
+	return msgs
+}
+
+// localUpstreamSchemes maps the types of upstream that decide requests within
+// the delegate, rather than forwarding them, to the scheme of the URL that
+// identifies them in logs: the scheme, a colon, and the upstream's name.
+var localUpstreamSchemes = map[string]string{
+	upstreamStaticTokens: "static",
+	upstreamHMAC:         "hmac",
+	upstreamJWT:          "jwt",
+	upstreamPlugin:       "plugin",
+	upstreamExec:         "exec",
+}
+
+// validateLocalUpstream checks that an upstream that decides requests within
+// the delegate has a name, from which its URL is derived, and a credential to
+// check, then validates the options of its type.
+func validateLocalUpstream(upstream *AuthDelegateUpstream, scheme string,
+	msgs []string) []string {
+	if upstream.Name == "" {
+		return append(msgs, upstream.Type+" upstream requires a name")
+	} else if upstream.URL != scheme+":"+upstream.Name {
+		msgs = append(msgs, upstream.Type+" upstream "+upstream.Name+
+			" must not define url: "+upstream.URL)
+	}
+	if upstream.HeaderName == "" && upstream.CookieName == "" &&
+		upstream.AuthScheme == "" && upstream.Type != upstreamPlugin &&
+		upstream.Type != upstreamExec {
+		msgs = append(msgs, upstream.Type+" requires header_name, "+
+			"cookie_name, or auth_scheme: "+upstream.URL)
+	}
+	switch upstream.Type {
+	case upstreamStaticTokens:
+		msgs = validateStaticTokens(upstream, msgs)
+	case upstreamHMAC:
+		msgs = validateHMAC(upstream, msgs)
+	case upstreamJWT:
+		msgs = validateJWT(upstream, msgs)
+	case upstreamPlugin:
+		msgs = validatePlugin(upstream, msgs)
+	case upstreamExec:
+		msgs = validateExec(upstream, msgs)
+	}
+	return msgs
+}
+
+// validateTypeOptions checks that options specific to a type of upstream
+// are only defined for upstreams of that type.
+func validateTypeOptions(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	if upstream.Type != upstreamStaticTokens &&
+		(len(upstream.TokenHashes) != 0 || upstream.TokenHashesFile != "") {
+		msgs = append(msgs, "token_hashes and token_hashes_file require "+
+			"type static_tokens: "+upstream.URL)
+	}
+	if upstream.Type != upstreamHMAC &&
+		(len(upstream.HmacSecretFiles) != 0 ||
+			len(upstream.HmacSignedHeaders) != 0 ||
+			upstream.HmacDigest != "") {
+		msgs = append(msgs, "hmac_secret_files, hmac_signed_headers, "+
+			"and hmac_digest require type hmac: "+upstream.URL)
+	}
+	if upstream.Type != upstreamJWT && (upstream.JwtJwksURL != "" ||
+		len(upstream.JwtKeyFiles) != 0 || upstream.JwtIssuer != "" ||
+		upstream.JwtAudience != "" || len(upstream.JwtClaims) != 0 ||
+		upstream.JwtLeeway != "") {
+		msgs = append(msgs, "jwt_* options require type jwt: "+
+			upstream.URL)
+	}
+	if upstream.Type != upstreamPlugin && (upstream.PluginPath != "" ||
+		len(upstream.PluginConfig) != 0) {
+		msgs = append(msgs, "plugin_path and plugin_config require "+
+			"type plugin: "+upstream.URL)
+	}
+	if upstream.Type != upstreamExec && (len(upstream.ExecCommand) != 0 ||
+		upstream.ExecMaxConcurrency != 0) {
+		msgs = append(msgs, "exec_command and exec_max_concurrency "+
+			"require type exec: "+upstream.URL)
+	}
+	return msgs
+}
+
+// validateHMAC reads the secrets of an hmac upstream, and checks its digest
+// algorithm.
+func validateHMAC(upstream *AuthDelegateUpstream, msgs []string) []string {
+	if upstream.HmacDigest == "" {
+		upstream.HmacDigest = defaultHMACDigest
+	} else if hmacDigests[upstream.HmacDigest] == nil {
+		msgs = append(msgs, "invalid hmac_digest for "+upstream.URL+": "+
+			upstream.HmacDigest)
+	}
+	if upstream.CookieName != "" || upstream.AuthScheme != "" {
+		msgs = append(msgs, "hmac requires header_name, not "+
+			"cookie_name or auth_scheme: "+upstream.URL)
+	}
+	if len(upstream.HmacSecretFiles) == 0 {
+		msgs = append(msgs, "hmac requires hmac_secret_files: "+
+			upstream.URL)
+	}
+	upstream.hmacSecrets = nil
+	for _, path := range upstream.HmacSecretFiles {
+		secret, err := ioutil.ReadFile(path)
+		if err != nil {
+			msgs = append(msgs, "hmac_secret_files for "+upstream.URL+
+				" could not be read: "+err.Error())
+			continue
+		}
+		secret = bytes.TrimSpace(secret)
+		if len(secret) == 0 {
+			msgs = append(msgs, "hmac secret file for "+upstream.URL+
+				" is empty: "+path)
+			continue
+		}
+		upstream.hmacSecrets = append(upstream.hmacSecrets, secret)
+	}
+	return msgs
+}
+
+// validateJWT reads the keys of a jwt upstream, and checks its JWKS URL and
+// claims.
+func validateJWT(upstream *AuthDelegateUpstream, msgs []string) []string {
+	if upstream.JwtJwksURL == "" && len(upstream.JwtKeyFiles) == 0 {
+		msgs = append(msgs, "jwt requires jwt_jwks_url or "+
+			"jwt_key_files: "+upstream.URL)
+	} else if upstream.JwtJwksURL != "" {
+		if parsed, err := url.Parse(upstream.JwtJwksURL); err != nil ||
+			!(parsed.Scheme == "http" || parsed.Scheme == "https") ||
+			parsed.Host == "" {
+			msgs = append(msgs, "invalid jwt_jwks_url for "+
+				upstream.URL+": "+upstream.JwtJwksURL)
+		}
+	}
+	upstream.jwtKeys = nil
+	for _, path := range upstream.JwtKeyFiles {
+		var keys []crypto.PublicKey
+		keys, msgs = loadPublicKeys(path, "jwt_key_files for "+
+			upstream.URL, msgs)
+		upstream.jwtKeys = append(upstream.jwtKeys, keys...)
+	}
+	for _, claim := range upstream.JwtClaims {
+		if claim == "" {
+			msgs = append(msgs, "empty jwt_claims name: "+upstream.URL)
+		}
+	}
+	return validateDuration(upstream.JwtLeeway, "jwt_leeway", upstream.URL,
+		&upstream.jwtLeeway, msgs)
+}
+
+// loadPublicKeys reads the PEM-encoded public keys and certificates in path.
+// context identifies the option naming the file in error messages.
+func loadPublicKeys(path, context string,
+	msgs []string) ([]crypto.PublicKey, []string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, append(msgs, context+" could not be read: "+
+			err.Error())
+	}
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		var key crypto.PublicKey
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var certificate *x509.Certificate
+			if certificate, err = x509.ParseCertificate(
+				block.Bytes); err == nil {
+				key = certificate.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			msgs = append(msgs, context+" could not be parsed: "+
+				path+": "+err.Error())
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		msgs = append(msgs, context+" contains no public keys: "+path)
+	}
+	return keys, msgs
+}
+
+// validateStaticTokens reads the token hashes of a static_tokens upstream.
+func validateStaticTokens(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	hashes := append([]string(nil), upstream.TokenHashes...)
+	if upstream.TokenHashesFile != "" {
+		data, err := ioutil.ReadFile(upstream.TokenHashesFile)
+		if err != nil {
+			msgs = append(msgs, "token_hashes_file for "+upstream.URL+
+				" could not be read: "+err.Error())
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				hashes = append(hashes, line)
+			}
+		}
+	}
+	upstream.tokenHashes = make(map[string]bool)
+	for _, hash := range hashes {
+		digest, err := hex.DecodeString(hash)
+		if err != nil || len(digest) != sha256.Size {
+			msgs = append(msgs, "token hash for "+upstream.URL+
+				" is not a hex-encoded SHA-256 digest: "+hash)
+			continue
+		}
+		upstream.tokenHashes[strings.ToLower(hash)] = true
+	}
+	if len(upstream.TokenHashes) == 0 && upstream.TokenHashesFile == "" {
+		msgs = append(msgs, "static_tokens requires token_hashes or "+
+			"token_hashes_file: "+upstream.URL)
+	}
+	return msgs
+}
+
+func validateResponseHeaderNames(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	for _, option := range []struct {
+		name  string
+		names []string
+	}{
+		{"pass_response_headers", upstream.PassResponseHeaders},
+		{"auth_response_headers", upstream.AuthResponseHeaders},
+	} {
+		names := make(map[string]int)
+		for _, name := range option.names {
+			if name == "" {
+				msgs = append(msgs, "empty "+option.name+
+					" name: "+upstream.URL)
+			}
+			names[http.CanonicalHeaderKey(name)]++
+		}
+		msgs = validateNameCounts(option.name+" for "+upstream.URL,
+			names, msgs)
+	}
+	return msgs
+}
+
+// validateAnnotationHeaders ensures that the accept_headers and deny_headers
+// of upstream can be written, and don't alter the framing of the response.
+func validateAnnotationHeaders(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	for _, option := range []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"accept_headers", upstream.AcceptHeaders},
+		{"deny_headers", upstream.DenyHeaders},
+	} {
+		var names []string
+		for name := range option.headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if name == "" || strings.ContainsAny(name,
+				" \t\r\n:()<>@,;\\\"/[]?={}") {
+				msgs = append(msgs, "invalid "+option.name+
+					" name for "+upstream.URL+": "+name)
+			} else if strings.ContainsAny(option.headers[name],
+				"\r\n") {
+				msgs = append(msgs, "invalid "+option.name+
+					" value for "+upstream.URL+": "+name)
+			}
+			for _, framing := range framingResponseHeaders {
+				if http.CanonicalHeaderKey(name) == framing {
+					msgs = append(msgs, option.name+
+						" must not set "+framing+
+						": "+upstream.URL)
+				}
+			}
+		}
+	}
+	return msgs
+}
+
+func validateRateLimits(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	keys := make(map[string]int)
+	for _, config := range upstream.RateLimits {
+		switch config.Key {
+		case rateLimitClientIP:
+		case rateLimitCredential:
+			if upstream.HeaderName == "" && upstream.CookieName == "" {
+				msgs = append(msgs, "rate_limits key credential "+
+					"requires header_name or cookie_name: "+
+					upstream.URL)
+			}
+		default:
+			msgs = append(msgs, "rate_limits key must be client_ip "+
+				"or credential for "+upstream.URL+": "+config.Key)
+		}
+		keys[config.Key]++
+		if config.RequestsPerSecond <= 0 {
+			msgs = append(msgs, "rate_limits requests_per_second "+
+				"must be positive: "+upstream.URL)
+			continue
+		}
+		if config.Burst == 0 {
+			config.Burst = int(math.Ceil(config.RequestsPerSecond))
+		} else if config.Burst < 0 {
+			msgs = append(msgs, "rate_limits burst must be "+
+				"positive: "+upstream.URL)
+		}
+	}
+	return validateNameCounts("rate_limits keys for "+upstream.URL, keys,
+		msgs)
+}
+
+func validateRetryPolicy(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	config := upstream.RetryPolicy
+	if config == nil {
+		return msgs
+	} else if upstreamAddress(upstream.parsedURL) == "" {
+		return append(msgs, "retry_policy requires an http or https "+
+			"url: "+upstream.URL)
+	}
+	msgs = validateDuration(config.Backoff, "retry_policy backoff",
+		upstream.URL, &config.backoff, msgs)
+	msgs = validateDuration(config.MaxBackoff, "retry_policy max_backoff",
+		upstream.URL, &config.maxBackoff, msgs)
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if config.backoff == 0 {
+		config.backoff = defaultRetryBackoff
+	}
+	if config.maxBackoff == 0 {
+		config.maxBackoff = defaultRetryMaxBackoff
+	}
+	if len(config.RetryOn) == 0 {
+		config.RetryOn = []string{retryOnConnectionErrors}
+	}
+	if config.MaxAttempts < 0 {
+		msgs = append(msgs, "retry_policy max_attempts must be "+
+			"positive: "+upstream.URL)
+	}
+	if config.maxBackoff < config.backoff {
+		msgs = append(msgs, "retry_policy max_backoff must not be "+
+			"less than backoff: "+upstream.URL)
+	}
+	for _, condition := range config.RetryOn {
+		switch condition {
+		case retryOnConnectionErrors, retryOnServerErrors:
+		default:
+			msgs = append(msgs, "retry_policy retry_on must be "+
+				"connection_errors or 5xx for "+upstream.URL+
+				": "+condition)
+		}
+	}
+	return msgs
+}
+
+func validateRetryWindow(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	n := len(msgs)
+	msgs = validateDuration(upstream.RetryWindow, "retry_window",
+		upstream.URL, &upstream.retryWindow, msgs)
+	if len(msgs) == n && upstream.RetryWindow != "" &&
+		upstream.retryWindow == 0 {
+		msgs = append(msgs, "retry_window must be positive: "+
+			upstream.URL)
+	}
+	if upstream.RequestIDHeader != "" && upstream.RetryWindow == "" {
+		msgs = append(msgs, "request_id_header requires retry_window: "+
+			upstream.URL)
+	}
+	return msgs
+}
+
+func validateCacheKey(upstream *AuthDelegateUpstream, msgs []string) []string {
+	if len(upstream.CacheKey) != 0 && upstream.CacheTTL == "" &&
+		upstream.DenyCacheTTL == "" && !upstream.CoalesceRequests {
+		msgs = append(msgs, "cache_key requires cache_ttl, "+
+			"deny_cache_ttl, or coalesce_requests: "+upstream.URL)
+	}
+	attributes := make(map[string]int)
+	for _, attribute := range upstream.CacheKey {
+		if !cacheKeyAttributes[attribute] {
+			msgs = append(msgs, "unknown cache_key attribute for "+
+				upstream.URL+": "+attribute)
+		}
+		attributes[attribute]++
+	}
+	msgs = validateNameCounts("cache_key attributes for "+upstream.URL,
+		attributes, msgs)
+	if upstream.CacheKeyPathSegments < 0 {
+		msgs = append(msgs, "cache_key_path_segments must not be "+
+			"negative: "+upstream.URL)
+	} else if upstream.CacheKeyPathSegments != 0 &&
+		attributes[cacheKeyPath] == 0 {
+		msgs = append(msgs, "cache_key_path_segments requires the "+
+			"path cache_key attribute: "+upstream.URL)
+	}
+	if len(upstream.CacheKey) != 0 && upstream.CacheSeedURL != "" {
+		msgs = append(msgs, "cache_seed_url is incompatible with "+
+			"cache_key: "+upstream.URL)
+	}
+	return msgs
+}
+
+func validateCacheSeedURL(upstream *AuthDelegateUpstream,
+	msgs []string) []string {
+	if upstream.CacheSeedURL == "" {
+		return msgs
+	} else if upstream.CacheTTL == "" {
+		msgs = append(msgs, "cache_seed_url requires cache_ttl: "+
+			upstream.URL)
+	}
+	seedURL, err := url.Parse(upstream.CacheSeedURL)
+	if err != nil || !(seedURL.Scheme == "http" ||
+		seedURL.Scheme == "https") {
+		msgs = append(msgs, "invalid cache_seed_url for "+
+			upstream.URL+": "+upstream.CacheSeedURL)
+	}
+	return msgs
+}
+
+// validateDuration parses value into parsed, if value is not empty. The
+// duration must not be negative. context identifies the configuration item
+// containing the option in error messages.
+func validateDuration(value, optionName, context string,
+	parsed *time.Duration, msgs []string) []string {
+	if value == "" {
+		return msgs
+	}
+	var err error
+	if *parsed, err = time.ParseDuration(value); err != nil {
+		msgs = append(msgs, "invalid "+optionName+" for "+context+
+			": "+value)
+	} else if *parsed < 0 {
+		msgs = append(msgs, optionName+" for "+context+
+			" must not be negative: "+value)
+	}
+	return msgs
+}
+
+func upstreamLabel(upstream *AuthDelegateUpstream) string {
+	if upstream.Name != "" {
+		return upstream.Name
+	}
+	return upstream.URL
+}
+
+func validateNameCounts(category string, counts map[string]int,
+	msgs []string) []string {
+	var repeatedNames []string
+	delete(counts, "")
+	for name, numAppearances := range counts {
 		if numAppearances > 1 {
 			repeatedNames = append(repeatedNames, name)
 		}
@@ -183,6 +2994,189 @@ func validateNameCounts(category string, counts map[string]int,
 	return msgs
 }
 
+// shadows returns true if the match conditions of earlier are a superset of
+// those of later, i.e. every request matching later would also match
+// earlier. Returns false if earlier is a default upstream, or shares its
+// header and cookie names and other conditions with later, as these are
+// reported separately.
+func shadows(earlier, later *AuthDelegateUpstream) bool {
+	earlierHeaders, laterHeaders := upstreamHeaderNames(earlier),
+		upstreamHeaderNames(later)
+	earlierCookies, laterCookies := upstreamCookieNames(earlier),
+		upstreamCookieNames(later)
+	sharesHeader := sharesName(earlierHeaders, laterHeaders)
+	sharesCookie := sharesName(earlierCookies, laterCookies)
+	if earlier.isDefault() || ((sharesHeader || sharesCookie) &&
+		sharesHeader == (earlier.HeaderName != "") &&
+		sharesCookie == (earlier.CookieName != "") &&
+		(later.HeaderName == "") == (earlier.HeaderName == "") &&
+		(later.CookieName == "") == (earlier.CookieName == "") &&
+		strings.EqualFold(earlier.Host, later.Host) &&
+		earlier.PathPrefix == later.PathPrefix &&
+		earlier.Traffic == later.Traffic &&
+		strings.EqualFold(earlier.AuthScheme, later.AuthScheme) &&
+		earlier.MatchExpression == later.MatchExpression &&
+		matchSource(earlier) == matchSource(later) &&
+		methodsCover(earlier, later) && methodsCover(later, earlier) &&
+		earlier.CookieValuePrefix == later.CookieValuePrefix &&
+		earlier.CookieValuePattern == later.CookieValuePattern &&
+		headerPatternsCover(earlier, later) &&
+		headerPatternsCover(later, earlier)) {
+		return false
+	}
+	if earlier.HeaderName != "" &&
+		!includesNames(canonicalHeaderKeys(earlierHeaders),
+			canonicalHeaderKeys(laterHeaders), sameName) {
+		return false
+	}
+	if earlier.CookieName != "" &&
+		!includesNames(earlierCookies, laterCookies, cookieNameCovers) {
+		return false
+	} else if !cookieValueCovers(earlier, later) ||
+		!headerPatternsCover(earlier, later) ||
+		!methodsCover(earlier, later) {
+		return false
+	} else if earlier.Traffic != "" && earlier.Traffic != later.Traffic {
+		return false
+	} else if earlier.MatchExpression != "" &&
+		earlier.MatchExpression != later.MatchExpression {
+		return false
+	} else if earlier.match != nil &&
+		matchSource(earlier) != matchSource(later) {
+		return false
+	} else if pluginMayMatch(earlier) {
+		return false
+	} else if earlier.AuthScheme != "" &&
+		!strings.EqualFold(earlier.AuthScheme, later.AuthScheme) {
+		return false
+	} else if earlier.Host != "" && (later.Host == "" ||
+		!(strings.EqualFold(earlier.Host, later.Host) ||
+			hostMatches(later.Host, earlier.Host))) {
+		return false
+	}
+	return earlier.PathPrefix == "" || (later.PathPrefix != "" &&
+		hasPathPrefix(later.PathPrefix, earlier.PathPrefix))
+}
+
+// upstreamHeaderNames returns the names of header_name of upstream, or nil
+// if it has none.
+func upstreamHeaderNames(upstream *AuthDelegateUpstream) []string {
+	if upstream.HeaderName == "" {
+		return nil
+	}
+	return append([]string{upstream.HeaderName},
+		upstream.HeaderAliases...)
+}
+
+// upstreamCookieNames returns the names of cookie_name of upstream, or nil
+// if it has none.
+func upstreamCookieNames(upstream *AuthDelegateUpstream) []string {
+	if upstream.CookieName == "" {
+		return nil
+	}
+	return append([]string{upstream.CookieName},
+		upstream.CookieAliases...)
+}
+
+// sharesName returns true if any name is in both lists.
+func sharesName(names, others []string) bool {
+	for _, name := range others {
+		if includesNames(names, []string{name}, sameName) {
+			return true
+		}
+	}
+	return false
+}
+
+// includesNames returns true if others is not empty and every name in it is
+// covered by a name in names.
+func includesNames(names, others []string,
+	covers func(name, other string) bool) bool {
+	if len(others) == 0 {
+		return false
+	}
+	for _, other := range others {
+		found := false
+		for _, name := range names {
+			if covers(name, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func sameName(name, other string) bool {
+	return name == other
+}
+
+// cookieNameCovers returns true if every cookie that the cookie name or
+// prefix pattern other matches is also matched by name.
+func cookieNameCovers(name, other string) bool {
+	prefix, ok := cookieNamePrefix(name)
+	if !ok || other == name {
+		return name == other
+	} else if _, pattern := cookieNamePrefix(other); pattern {
+		return false
+	}
+	_, chunk := cookieChunkIndex(prefix, other)
+	return other == prefix || chunk
+}
+
+// matcherScope qualifies the header or cookie name of upstream with its other
+// match conditions, so that upstreams may share a name if, for example, they
+// match different hosts or paths. Returns name unchanged if it is empty.
+func matcherScope(name string, upstream *AuthDelegateUpstream) string {
+	if name == "" {
+		return name
+	}
+	if upstream.HeaderName != "" && upstream.CookieName != "" {
+		name += " (header_name " + upstream.HeaderName +
+			" and cookie_name " + upstream.CookieName + ")"
+	}
+	if upstream.Host != "" {
+		name += " (host " + strings.ToLower(upstream.Host) + ")"
+	}
+	if upstream.PathPrefix != "" {
+		name += " (path_prefix " + upstream.PathPrefix + ")"
+	}
+	if upstream.Traffic != "" {
+		name += " (traffic " + upstream.Traffic + ")"
+	}
+	if upstream.AuthScheme != "" {
+		name += " (auth_scheme " + strings.ToLower(upstream.AuthScheme) +
+			")"
+	}
+	if upstream.MatchExpression != "" {
+		name += " (match_expression " + upstream.MatchExpression + ")"
+	}
+	if upstream.match != nil {
+		name += " (match " + upstream.match.source + ")"
+	}
+	if upstream.methods != nil {
+		name += " (methods " + strings.Join(upstream.methods, ", ") + ")"
+	}
+	if upstream.CookieValuePrefix != "" {
+		name += " (cookie_value_prefix " + upstream.CookieValuePrefix + ")"
+	}
+	if upstream.CookieValuePattern != "" {
+		name += " (cookie_value_pattern " + upstream.CookieValuePattern +
+			")"
+	}
+	if len(upstream.HeaderValueRegex) != 0 {
+		name += " (header_value_regex " +
+			describeHeaderPatterns(upstream.headerValueRegex) + ")"
+	}
+	if pluginMayMatch(upstream) {
+		name += " (plugin " + upstreamLabel(upstream) + ")"
+	}
+	return name
+}
+
 func validateDefaultUpstreams(defaultUpstreams []string,
 	lastUpstream *AuthDelegateUpstream, msgs []string) []string {
 	numDefaults := len(defaultUpstreams)
@@ -201,3 +3195,498 @@ func validateDefaultUpstreams(defaultUpstreams []string,
 	}
 	return msgs
 }
+
+func validateServiceUserAgents(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	for _, userAgent := range opts.ServiceUserAgents {
+		if userAgent == "" {
+			return append(msgs, "service_user_agents must not "+
+				"contain an empty string")
+		}
+	}
+	return msgs
+}
+
+func validateRejectionRules(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	for _, userAgent := range opts.RejectUserAgents {
+		if userAgent == "" {
+			msgs = append(msgs, "reject_user_agents must not "+
+				"contain an empty string")
+			break
+		}
+	}
+	for _, path := range opts.RejectPaths {
+		if !strings.HasPrefix(path, "/") {
+			msgs = append(msgs, "reject_paths entry must begin "+
+				"with /: "+path)
+		}
+	}
+	return msgs
+}
+
+func validateResponseHeaderLimits(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.MaxResponseHeaders < 0 {
+		msgs = append(msgs, "max_response_headers must not be negative")
+	}
+	if opts.MaxResponseHeaderBytes < 0 {
+		msgs = append(msgs, "max_response_header_bytes must not be "+
+			"negative")
+	}
+	return msgs
+}
+
+func validateForwardAuth(opts *AuthDelegateOptions, msgs []string) []string {
+	headers := newForwardAuthHeaders(opts)
+	if headers == nil {
+		return msgs
+	}
+	if headers.uri == headers.host || headers.uri == headers.method ||
+		headers.host == headers.method {
+		msgs = append(msgs, "forward_auth uri_header, host_header, and "+
+			"method_header must be different")
+	}
+	return msgs
+}
+
+func validateBatch(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.BatchPath == "" {
+		if opts.BatchMaxRequests != 0 {
+			msgs = append(msgs, "batch_max_requests requires "+
+				"batch_path")
+		}
+		return msgs
+	}
+	msgs = validatePath(opts.BatchPath, "batch_path", msgs)
+	if opts.BatchMaxRequests < 0 {
+		msgs = append(msgs, "batch_max_requests must not be negative")
+	} else if opts.BatchMaxRequests == 0 {
+		opts.BatchMaxRequests = defaultBatchMaxRequests
+	}
+	return msgs
+}
+
+func validateSubscribePath(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.SubscribePath == "" {
+		return msgs
+	}
+	msgs = validatePath(opts.SubscribePath, "subscribe_path", msgs)
+	if opts.SubscribePath == opts.BatchPath {
+		msgs = append(msgs, "subscribe_path and batch_path must "+
+			"differ: "+opts.SubscribePath)
+	}
+	return msgs
+}
+
+func validateMetricsPath(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.MetricsPath == "" {
+		return msgs
+	}
+	msgs = validatePath(opts.MetricsPath, "metrics_path", msgs)
+	if opts.MetricsPath == opts.BatchPath ||
+		opts.MetricsPath == opts.SubscribePath {
+		msgs = append(msgs, "metrics_path must differ from "+
+			"batch_path and subscribe_path: "+opts.MetricsPath)
+	}
+	return msgs
+}
+
+func validateHealthPaths(opts *AuthDelegateOptions, msgs []string) []string {
+	others := []string{opts.BatchPath, opts.SubscribePath, opts.MetricsPath}
+	if opts.HealthPath != "" {
+		msgs = validatePath(opts.HealthPath, "health_path", msgs)
+		if containsString(others, opts.HealthPath) {
+			msgs = append(msgs, "health_path must differ from "+
+				"batch_path, subscribe_path, and metrics_path: "+
+				opts.HealthPath)
+		}
+	}
+	if opts.ReadinessPath != "" {
+		msgs = validatePath(opts.ReadinessPath, "readiness_path", msgs)
+		if containsString(append(others, opts.HealthPath),
+			opts.ReadinessPath) {
+			msgs = append(msgs, "readiness_path must differ from "+
+				"batch_path, subscribe_path, metrics_path, and "+
+				"health_path: "+opts.ReadinessPath)
+		}
+	} else if opts.ReadinessCheckUpstreams {
+		msgs = append(msgs, "readiness_check_upstreams requires "+
+			"readiness_path")
+	}
+	if opts.UpstreamStatusPath != "" {
+		msgs = validatePath(opts.UpstreamStatusPath,
+			"upstream_status_path", msgs)
+		if containsString(append(others, opts.HealthPath,
+			opts.ReadinessPath), opts.UpstreamStatusPath) {
+			msgs = append(msgs, "upstream_status_path must differ "+
+				"from batch_path, subscribe_path, metrics_path, "+
+				"health_path, and readiness_path: "+
+				opts.UpstreamStatusPath)
+		}
+	}
+	return msgs
+}
+
+func validatePlaintextListener(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.PlaintextListener
+	if config == nil {
+		return msgs
+	}
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		msgs = append(msgs, "invalid plaintext_listener address: "+
+			err.Error())
+	}
+	if !opts.servesTLS() {
+		msgs = append(msgs, "plaintext_listener requires ssl_cert and "+
+			"ssl_key")
+	}
+	switch config.Mode {
+	case plaintextRedirect:
+		if opts.Port == 0 {
+			msgs = append(msgs, "plaintext_listener mode redirect "+
+				"requires port")
+		}
+	case plaintextHealth:
+		if opts.HealthPath == "" && opts.ReadinessPath == "" &&
+			opts.UpstreamStatusPath == "" {
+			msgs = append(msgs, "plaintext_listener mode health "+
+				"requires health_path, readiness_path, or "+
+				"upstream_status_path")
+		}
+	default:
+		msgs = append(msgs, "plaintext_listener mode must be redirect "+
+			"or health: "+config.Mode)
+	}
+	return msgs
+}
+
+func validateStorage(opts *AuthDelegateOptions, msgs []string) []string {
+	storage := opts.Storage
+	if storage == nil {
+		return msgs
+	}
+	switch storage.Type {
+	case "", storageMemory:
+		if storage.Address != "" || storage.Path != "" {
+			msgs = append(msgs, "storage address and path require "+
+				"type redis or file")
+		}
+	case storageRedis:
+		if !redisSupported {
+			msgs = append(msgs, "storage type redis is not supported "+
+				"by this build, which has the noredis tag")
+		} else if _, _, err := net.SplitHostPort(
+			storage.Address); err != nil {
+			msgs = append(msgs, "invalid storage address: "+
+				err.Error())
+		}
+		msgs = validateRedisStorage(storage, msgs)
+	case storageFile:
+		if storage.Path == "" {
+			msgs = append(msgs, "storage path must be specified "+
+				"for type file")
+		}
+	default:
+		msgs = append(msgs, "unknown storage type: "+storage.Type)
+	}
+	if storage.Type != storageRedis && (storage.Username != "" ||
+		storage.PasswordFile != "" || storage.TLS ||
+		storage.TLSCAFile != "") {
+		msgs = append(msgs, "storage username, password_file, tls, and "+
+			"tls_ca_file require type redis")
+	}
+	return msgs
+}
+
+func validateRedisStorage(storage *AuthDelegateStorage,
+	msgs []string) []string {
+	if storage.PasswordFile != "" {
+		password, err := ioutil.ReadFile(storage.PasswordFile)
+		if err != nil {
+			msgs = append(msgs, "storage password_file could not "+
+				"be read: "+err.Error())
+		} else if storage.password = strings.TrimSpace(
+			string(password)); storage.password == "" {
+			msgs = append(msgs, "storage password_file is empty: "+
+				storage.PasswordFile)
+		}
+	} else if storage.Username != "" {
+		msgs = append(msgs, "storage username requires password_file")
+	}
+	if storage.TLSCAFile == "" {
+		return msgs
+	} else if !storage.TLS {
+		return append(msgs, "storage tls_ca_file requires tls")
+	}
+	storage.tlsCAs, msgs = loadCertPool(storage.TLSCAFile,
+		"storage tls_ca_file", msgs)
+	return msgs
+}
+
+func validateStateSnapshot(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.StateSnapshotPath == "" {
+		if opts.StateSnapshotMaxAge != "" {
+			msgs = append(msgs, "state_snapshot_max_age requires "+
+				"state_snapshot_path")
+		}
+		return msgs
+	}
+	if opts.Storage != nil && opts.Storage.Type != "" &&
+		opts.Storage.Type != storageMemory {
+		msgs = append(msgs, "state_snapshot_path requires memory "+
+			"storage")
+	}
+	return validateDuration(opts.StateSnapshotMaxAge,
+		"state_snapshot_max_age", "state_snapshot_path",
+		&opts.stateSnapshotMaxAge, msgs)
+}
+
+func validateShutdownGracePeriod(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.ShutdownGracePeriod == "" {
+		return msgs
+	}
+	var err error
+	opts.shutdownGracePeriod, err = time.ParseDuration(
+		opts.ShutdownGracePeriod)
+	if err != nil {
+		msgs = append(msgs, "invalid shutdown_grace_period: "+
+			opts.ShutdownGracePeriod)
+	} else if opts.shutdownGracePeriod < 0 {
+		msgs = append(msgs, "shutdown_grace_period must not be negative")
+	}
+	return msgs
+}
+
+func validateShutdownNotify(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	msgs = validateDuration(opts.ShutdownDelay, "shutdown_delay",
+		"shutdown", &opts.shutdownDelay, msgs)
+	config := opts.ShutdownNotify
+	if config == nil {
+		return msgs
+	}
+	if parsed, err := url.Parse(config.URL); err != nil ||
+		!(parsed.Scheme == "http" || parsed.Scheme == "https") ||
+		parsed.Host == "" {
+		msgs = append(msgs, "shutdown_notify url must be an http or "+
+			"https URL: "+config.URL)
+	}
+	if config.Method != "" && (strings.ContainsAny(config.Method,
+		" \t\r\n:()<>@,;\\\"/[]?={}") ||
+		strings.ToUpper(config.Method) != config.Method) {
+		msgs = append(msgs, "invalid shutdown_notify method: "+
+			config.Method)
+	}
+	var names []string
+	for name := range config.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name,
+			" \t\r\n:()<>@,;\\\"/[]?={}") {
+			msgs = append(msgs, "invalid shutdown_notify headers "+
+				"name: "+name)
+		} else if strings.ContainsAny(config.Headers[name], "\r\n") {
+			msgs = append(msgs, "invalid shutdown_notify headers "+
+				"value: "+name)
+		}
+	}
+	msgs = validateDuration(config.Timeout, "timeout", "shutdown_notify",
+		&config.timeout, msgs)
+	if config.Timeout == "" {
+		config.timeout = defaultShutdownNotifyTimeout
+	} else if config.timeout == 0 {
+		msgs = append(msgs, "shutdown_notify timeout must be positive")
+	}
+	return msgs
+}
+
+// validateTimeouts parses DefaultTimeout and applies it to the upstreams that
+// don't define their own timeout. Must follow validateUpstreams.
+func validateTimeouts(opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.DefaultTimeout == "" {
+		return msgs
+	}
+	var err error
+	opts.defaultTimeout, err = time.ParseDuration(opts.DefaultTimeout)
+	if err != nil {
+		return append(msgs, "invalid default_timeout: "+
+			opts.DefaultTimeout)
+	} else if opts.defaultTimeout <= 0 {
+		return append(msgs, "default_timeout must be positive")
+	}
+	for _, upstream := range opts.Upstreams {
+		if upstream.Timeout == "" {
+			upstream.timeout = opts.defaultTimeout
+		}
+	}
+	return msgs
+}
+
+func validateDiagnostics(opts *AuthDelegateOptions, msgs []string) []string {
+	for _, option := range []struct {
+		name   string
+		value  string
+		parsed *time.Duration
+		limit  time.Duration
+	}{
+		{"verbose_logging_duration", opts.VerboseLoggingDuration,
+			&opts.verboseLoggingDuration, maxVerboseLoggingDuration},
+		{"cpu_profile_duration", opts.CPUProfileDuration,
+			&opts.cpuProfileDuration, maxCPUProfileDuration},
+	} {
+		if option.value == "" {
+			continue
+		}
+		var err error
+		*option.parsed, err = time.ParseDuration(option.value)
+		if err != nil {
+			msgs = append(msgs, "invalid "+option.name+": "+
+				option.value)
+		} else if *option.parsed <= 0 || *option.parsed > option.limit {
+			msgs = append(msgs, option.name+" must be positive and "+
+				"at most "+option.limit.String()+": "+option.value)
+		}
+	}
+	if opts.CPUProfileDuration != "" && opts.CPUProfilePath == "" {
+		msgs = append(msgs, "cpu_profile_duration requires "+
+			"cpu_profile_path")
+	}
+	return msgs
+}
+
+func validateLatencyLogInterval(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	if opts.LatencyLogInterval == "" {
+		return msgs
+	}
+	var err error
+	opts.latencyLogInterval, err = time.ParseDuration(opts.LatencyLogInterval)
+	if err != nil {
+		msgs = append(msgs, "invalid latency_log_interval: "+
+			opts.LatencyLogInterval)
+	} else if opts.latencyLogInterval <= 0 {
+		msgs = append(msgs, "latency_log_interval must be positive")
+	}
+	return msgs
+}
+
+// validateErrorPages loads the templates in the error_pages dir.
+func validateErrorPages(opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.ErrorPages
+	if config == nil {
+		return msgs
+	} else if config.Dir == "" || config.DefaultLanguage == "" {
+		return append(msgs, "error_pages requires dir and "+
+			"default_language")
+	}
+	entries, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return append(msgs, "error_pages dir could not be read: "+
+			err.Error())
+	}
+	config.templates = make(map[int]map[string]*template.Template)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+		status, language, ok := parseErrorPageName(name)
+		if !ok {
+			msgs = append(msgs, "error_pages template must be named "+
+				"<status>.<language>.html: "+name)
+			continue
+		}
+		page, err := template.ParseFiles(filepath.Join(config.Dir, name))
+		if err != nil {
+			msgs = append(msgs, "error_pages template could not be "+
+				"parsed: "+err.Error())
+			continue
+		}
+		if config.templates[status] == nil {
+			config.templates[status] = make(
+				map[string]*template.Template)
+		}
+		config.templates[status][language] = page
+	}
+	if len(config.templates) == 0 {
+		msgs = append(msgs, "error_pages dir contains no templates: "+
+			config.Dir)
+	}
+	defaultLanguage := strings.ToLower(config.DefaultLanguage)
+	var statuses []int
+	for status := range config.templates {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		if config.templates[status][defaultLanguage] == nil {
+			msgs = append(msgs, "error_pages has no "+
+				config.DefaultLanguage+" template for "+
+				strconv.Itoa(status))
+		}
+	}
+	return msgs
+}
+
+func validatePath(path, optionName string, msgs []string) []string {
+	if !strings.HasPrefix(path, "/") {
+		msgs = append(msgs, optionName+" must begin with '/': "+path)
+	}
+	return msgs
+}
+
+// containsString returns true if values contains value.
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func validateEmergencyAllowlist(
+	opts *AuthDelegateOptions, msgs []string) []string {
+	config := opts.EmergencyAllowlist
+	if config == nil {
+		return msgs
+	}
+	if len(config.CredentialHashes) == 0 &&
+		len(config.ClientIdentities) == 0 {
+		msgs = append(msgs, "emergency_allowlist must define "+
+			"credential_hashes or client_identities")
+	}
+	config.hashes = make(map[string]bool)
+	for _, hash := range config.CredentialHashes {
+		digest, err := hex.DecodeString(hash)
+		if err != nil || len(digest) != sha256.Size {
+			msgs = append(msgs, "emergency allowlist credential "+
+				"hash is not a hex-encoded SHA-256 digest: "+hash)
+			continue
+		}
+		config.hashes[strings.ToLower(hash)] = true
+	}
+	return msgs
+}
+
+func validateDebug(opts *AuthDelegateOptions, msgs []string) []string {
+	if len(opts.DebugCredentialHashes) == 0 {
+		return msgs
+	}
+	opts.debugHashes = make(map[string]bool)
+	for _, hash := range opts.DebugCredentialHashes {
+		digest, err := hex.DecodeString(hash)
+		if err != nil || len(digest) != sha256.Size {
+			msgs = append(msgs, "debug credential hash is not a "+
+				"hex-encoded SHA-256 digest: "+hash)
+			continue
+		}
+		opts.debugHashes[strings.ToLower(hash)] = true
+	}
+	return msgs
+}
@@ -1,6 +1,7 @@
-package main
+package authdelegate
 
 import (
+	"encoding/json"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"net/url"
@@ -76,6 +77,136 @@ var _ = Describe("AuthDelegateOptions", func() {
 		Expect(err.Error()).To(HavePrefix("JSON parsing failed: "))
 	})
 
+	It("should parse and validate the equivalent YAML config", func() {
+		yamlConfig := []byte(strings.Join([]string{
+			`port: 443`,
+			`ssl_cert: ` + filename,
+			`ssl_key: ` + filename,
+			`upstreams:`,
+			`  - url: https://foo.com/auth`,
+			`    cookie_name: _oauth2_proxy`,
+			`  - url: http://127.0.0.1:8080/auth`,
+			`    header_name: X-Signature`,
+			`  - url: https://foo.com/auth`,
+		}, "\n"))
+		expected, err := NewAuthDelegateOptionsFromJSON(defaultConfig)
+		Expect(err).To(BeNil())
+		opts, err := NewAuthDelegateOptionsFromYAML(yamlConfig)
+		Expect(err).To(BeNil())
+		Expect(opts).To(Equal(expected))
+	})
+
+	It("should return an error if YAML parsing fails", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML(
+			[]byte("port: 443\n  upstreams: [\n"))
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix("YAML parsing failed: "))
+	})
+
+	It("should fingerprint equivalent configs identically", func() {
+		yamlConfig := []byte(strings.Join([]string{
+			`upstreams:`,
+			`  - cookie_name: _oauth2_proxy`,
+			`    url: https://foo.com/auth`,
+			`  - header_name: X-Signature`,
+			`    url: http://127.0.0.1:8080/auth`,
+			`  - url: https://foo.com/auth`,
+			`ssl_key: ` + filename,
+			`ssl_cert: ` + filename,
+			`port: 443`,
+		}, "\n"))
+		expected, err := NewAuthDelegateOptionsFromJSON(defaultConfig)
+		Expect(err).To(BeNil())
+		opts, err := NewAuthDelegateOptionsFromYAML(yamlConfig)
+		Expect(err).To(BeNil())
+		Expect(opts.Fingerprint()).To(HaveLen(64))
+		Expect(opts.Fingerprint()).To(Equal(expected.Fingerprint()))
+	})
+
+	It("should change the fingerprint when the config changes", func() {
+		expected, err := NewAuthDelegateOptionsFromJSON(defaultConfig)
+		Expect(err).To(BeNil())
+		opts, err := NewAuthDelegateOptionsFromJSON(defaultConfig)
+		Expect(err).To(BeNil())
+		opts.Upstreams[1].HeaderName = "X-Other-Signature"
+		Expect(opts.Fingerprint()).ToNot(Equal(expected.Fingerprint()))
+	})
+
+	It("should accept a list of header or cookie names", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    cookie_name: [_session, _session_v2]`,
+				`  - url: https://bar.com/auth`,
+				`    header_name: [X-Api-Key]`,
+			}, "\n")))
+		Expect(err).To(BeNil())
+		Expect(opts.Upstreams[0].CookieName).To(Equal("_session"))
+		Expect(opts.Upstreams[0].CookieAliases).To(Equal(
+			[]string{"_session_v2"}))
+		Expect(opts.Upstreams[1].HeaderName).To(Equal("X-Api-Key"))
+		Expect(opts.Upstreams[1].HeaderAliases).To(BeNil())
+
+		encoded, err := json.Marshal(opts.Upstreams)
+		Expect(err).To(BeNil())
+		Expect(string(encoded)).To(ContainSubstring(
+			`"cookie_name":["_session","_session_v2"]`))
+		Expect(string(encoded)).To(ContainSubstring(
+			`"header_name":"X-Api-Key"`))
+		var decoded []*AuthDelegateUpstream
+		Expect(json.Unmarshal(encoded, &decoded)).To(Succeed())
+		Expect(decoded[0].CookieAliases).To(Equal(
+			opts.Upstreams[0].CookieAliases))
+
+		_, err = NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    header_name: ["", X-Api-Key]`,
+			}, "\n")))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"header_name must not include empty names: " +
+				"https://foo.com/auth",
+		})))
+	})
+
+	It("should apply the same validation to YAML configs", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 0`,
+				`ssl_cert: ` + filename,
+				`ssl_key: ` + filename,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+			}, "\n")))
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"port must be specified and greater than zero",
+		})))
+	})
+
+	It("should select the parser by the config file extension", func() {
+		opts, err := parseOptions("config.YML", "", []byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`ssl_cert: ` + filename,
+				`ssl_key: ` + filename,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+			}, "\n")))
+		Expect(err).To(BeNil())
+		Expect(opts.Port).To(Equal(443))
+		_, err = parseOptions("config.json", "", []byte(`port: 443`))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(HavePrefix("JSON parsing failed: "))
+	})
+
 	It("should return an error if validation fails", func() {
 		badConfig := []byte(strings.Join([]string{
 			`{`,
@@ -102,8 +233,6 @@ var _ = Describe("AuthDelegateOptions", func() {
 			"port must be specified and greater than zero",
 			"ssl-cert does not exist: ./bogus.crt",
 			"ssl-key does not exist: ./bogus.key",
-			"both header_name and cookie_name defined: " +
-				"https://foo.com/auth",
 			"multiple upstreams without header_name or cookie_name",
 		}, "\n  ")))
 	})
@@ -196,6 +325,186 @@ var _ = Describe("AuthDelegateOptions", func() {
 		}, "\n  ")))
 	})
 
+	It("should fail validation if an upstream is shadowed", func() {
+		badConfig := []byte(strings.Join([]string{
+			`{`,
+			`  "port": 443,`,
+			`  "upstreams": [`,
+			`    { "url": "https://foo.com/auth",`,
+			`      "name": "hmac",`,
+			`      "header_name": "X-Signature"`,
+			`    },`,
+			`    { "url": "http://bar.com/auth",`,
+			`      "name": "hmac-v2",`,
+			`      "header_name": "x-signature"`,
+			`    }`,
+			`  ]`,
+			`}`,
+		}, "\n"))
+		opts, err := NewAuthDelegateOptionsFromJSON(badConfig)
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(strings.Join([]string{
+			"Invalid options:",
+			"upstream hmac-v2 is shadowed by earlier upstream " +
+				"hmac and can never match",
+		}, "\n  ")))
+	})
+
+	It("should allow repeated names for different path prefixes", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    header_name: X-Signature`,
+				`    path_prefix: /api`,
+				`  - url: https://bar.com/auth`,
+				`    header_name: X-Signature`,
+				`    path_prefix: /admin`,
+			}, "\n")))
+		Expect(err).To(BeNil())
+		Expect(opts.Upstreams[1].PathPrefix).To(Equal("/admin"))
+	})
+
+	It("should order upstreams requiring a header and a cookie", func() {
+		config := func(order ...int) []byte {
+			upstreams := []string{
+				"  - url: https://foo.com/auth\n    name: key\n" +
+					"    header_name: X-Api-Key",
+				"  - url: https://bar.com/auth\n    name: key-session\n" +
+					"    header_name: X-Api-Key\n    cookie_name: _session",
+				"  - url: https://baz.com/auth\n    name: key-session-2\n" +
+					"    header_name: X-Api-Key\n    cookie_name: _session",
+			}
+			lines := []string{"port: 443", "upstreams:"}
+			for _, i := range order {
+				lines = append(lines, upstreams[i])
+			}
+			return []byte(strings.Join(lines, "\n"))
+		}
+		_, err := NewAuthDelegateOptionsFromYAML(config(1, 0))
+		Expect(err).To(BeNil())
+
+		_, err = NewAuthDelegateOptionsFromYAML(config(0, 1))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"upstream key-session is shadowed by earlier upstream key " +
+				"and can never match",
+		})))
+
+		_, err = NewAuthDelegateOptionsFromYAML(config(1, 2))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"repeated cookie names: _session (header_name X-Api-Key " +
+				"and cookie_name _session)",
+			"repeated header names: X-Api-Key (header_name X-Api-Key " +
+				"and cookie_name _session)",
+		})))
+	})
+
+	It("should fail validation for overlapping path prefixes", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    name: api`,
+				`    path_prefix: /api`,
+				`  - url: https://bar.com/auth`,
+				`    name: api-v2`,
+				`    header_name: X-Signature`,
+				`    path_prefix: /api/v2`,
+				`  - url: https://baz.com/auth`,
+				`    cookie_name: _cookie`,
+				`    path_prefix: /admin`,
+				`  - url: https://baz.com/auth`,
+				`    cookie_name: _cookie`,
+				`    path_prefix: /admin`,
+				`  - url: https://qux.com/auth`,
+				`    path_prefix: admin`,
+			}, "\n")))
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"path_prefix must begin with / for https://qux.com/auth: " +
+				"admin",
+			"repeated cookie names: _cookie (path_prefix /admin)",
+			"upstream api-v2 is shadowed by earlier upstream api " +
+				"and can never match",
+		})))
+	})
+
+	It("should fail validation for duplicate host and selectors", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    header_name: X-Signature`,
+				`    host: app1.example.gov`,
+				`  - url: https://bar.com/auth`,
+				`    header_name: X-Signature`,
+				`    host: App1.Example.gov`,
+				`  - url: https://bar.com/auth`,
+				`    header_name: X-Signature`,
+				`    host: app2.example.gov`,
+				`  - url: https://baz.com/auth`,
+				`    name: all-apps`,
+				`    host: "*.example.gov"`,
+				`  - url: https://baz.com/auth`,
+				`    name: app3`,
+				`    host: app3.example.gov`,
+				`  - url: https://qux.com/auth`,
+				`    name: all-apps-again`,
+				`    host: "*.example.gov"`,
+				`  - url: https://qux.com/auth`,
+				`    host: "app4.example.gov:443"`,
+			}, "\n")))
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid host for https://qux.com/auth: " +
+				"app4.example.gov:443",
+			"repeated header names: X-Signature (host " +
+				"app1.example.gov)",
+			"upstream app3 is shadowed by earlier upstream all-apps " +
+				"and can never match",
+			"upstream all-apps-again is shadowed by earlier upstream " +
+				"all-apps and can never match",
+		})))
+	})
+
+	It("should fail validation for conflicting auth schemes", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(strings.Join(
+			[]string{
+				`port: 443`,
+				`upstreams:`,
+				`  - url: https://foo.com/auth`,
+				`    auth_scheme: Bearer`,
+				`  - url: https://bar.com/auth`,
+				`    auth_scheme: Basic`,
+				`  - url: https://bar.com/auth`,
+				`    name: basic-again`,
+				`    header_name: authorization`,
+				`    auth_scheme: basic`,
+				`  - url: https://baz.com/auth`,
+				`    header_name: X-Token`,
+				`    auth_scheme: Bearer`,
+				`  - url: https://qux.com/auth`,
+				`    auth_scheme: "Bearer realm"`,
+			}, "\n")))
+		Expect(opts).To(BeNil())
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"auth_scheme requires header_name Authorization or none: " +
+				"https://baz.com/auth",
+			"invalid auth_scheme for https://qux.com/auth: Bearer realm",
+			"upstream basic-again is shadowed by earlier upstream " +
+				"https://bar.com/auth and can never match",
+		})))
+	})
+
 	It("should fail validation if a cert specified, but no key", func() {
 		badConfig := []byte(strings.Join([]string{
 			`{`,
@@ -0,0 +1,64 @@
+package authdelegate
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// plaintextHandler serves the plaintext listener. It serves the health and
+// readiness checks of the routing table in effect, and redirects every other
+// request to the SSL listener or rejects it, depending on its mode.
+type plaintextHandler struct {
+	delegate *authDelegateHandler
+	mode     string
+
+	// Port of the SSL listener
+	port int
+}
+
+// newPlaintextServer creates the server for the plaintext listener defined by
+// opts, whose checks are those of delegate, created by NewAuthDelegate.
+func newPlaintextServer(delegate http.Handler,
+	opts *AuthDelegateOptions) *http.Server {
+	return &http.Server{Handler: &plaintextHandler{
+		delegate: delegate.(*authDelegateHandler),
+		mode:     opts.PlaintextListener.Mode,
+		port:     opts.Port,
+	}}
+}
+
+func (handler *plaintextHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	table := handler.delegate.routes()
+	if table.healthPath != "" && req.URL.Path == table.healthPath {
+		handler.delegate.serveHealth(rw, req)
+	} else if table.readinessPath != "" &&
+		req.URL.Path == table.readinessPath {
+		handler.delegate.serveReadiness(rw, req, table)
+	} else if table.upstreamStatusPath != "" &&
+		req.URL.Path == table.upstreamStatusPath {
+		handler.delegate.serveUpstreamStatus(rw, req, table)
+	} else if handler.mode == plaintextRedirect {
+		http.Redirect(rw, req, handler.httpsURL(req),
+			http.StatusPermanentRedirect)
+	} else {
+		http.NotFound(rw, req)
+	}
+}
+
+// httpsURL returns the URL of req on the SSL listener, omitting the port if
+// it is the default.
+func (handler *plaintextHandler) httpsURL(req *http.Request) string {
+	host := req.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if handler.port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(handler.port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + req.URL.RequestURI()
+}
@@ -0,0 +1,101 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"time"
+)
+
+var _ = Describe("Plaintext listener", func() {
+	var dir string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "plaintext")
+		Expect(err).To(BeNil())
+		cert := writeTestCertificate(dir, "server", time.Hour)
+		opts = &AuthDelegateOptions{
+			Port:    8443,
+			SslCert: cert.CertFile,
+			SslKey:  cert.KeyFile,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://127.0.0.1/"},
+			},
+			HealthPath: "/healthz",
+			PlaintextListener: &AuthDelegatePlaintextListener{
+				Address: "127.0.0.1:8080",
+				Mode:    "redirect",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	serve := func(method, url string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		server := newPlaintextServer(NewAuthDelegate(opts), opts)
+		req, _ := http.NewRequest(method, url, nil)
+		recorder := httptest.NewRecorder()
+		server.Handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should redirect requests to the SSL listener", func() {
+		recorder := serve("POST", "http://app.example.gov:8080/auth?a=b")
+		Expect(recorder.Code).To(Equal(http.StatusPermanentRedirect))
+		Expect(recorder.Header().Get("Location")).
+			To(Equal("https://app.example.gov:8443/auth?a=b"))
+
+		opts.Port = 443
+		recorder = serve("GET", "http://[::1]:8080/")
+		Expect(recorder.Header().Get("Location")).
+			To(Equal("https://[::1]/"))
+	})
+
+	It("should serve health checks in either mode", func() {
+		recorder := serve("GET", "http://127.0.0.1:8080/healthz")
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(Equal("ok\n"))
+
+		opts.PlaintextListener.Mode = "health"
+		Expect(serve("GET", "http://127.0.0.1:8080/healthz").Code).
+			To(Equal(http.StatusOK))
+		Expect(serve("GET", "http://127.0.0.1:8080/auth").Code).
+			To(Equal(http.StatusNotFound))
+	})
+
+	It("should fail validation for an invalid plaintext listener", func() {
+		opts.SslCert = ""
+		opts.SslKey = ""
+		opts.HealthPath = ""
+		opts.PlaintextListener = &AuthDelegatePlaintextListener{
+			Address: "127.0.0.1",
+			Mode:    "proxy",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid plaintext_listener address: address 127.0.0.1: " +
+				"missing port in address",
+			"plaintext_listener requires ssl_cert and ssl_key",
+			"plaintext_listener mode must be redirect or health: proxy",
+		})))
+
+		opts.PlaintextListener.Address = "127.0.0.1:8080"
+		opts.PlaintextListener.Mode = "health"
+		err = opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"plaintext_listener requires ssl_cert and ssl_key",
+			"plaintext_listener mode health requires health_path, " +
+				"readiness_path, or upstream_status_path",
+		})))
+	})
+})
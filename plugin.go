@@ -0,0 +1,131 @@
+package authdelegate
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// upstreamPlugin is the type of upstream whose requests are decided by a Go
+// plugin, so that verification or routing logic specific to one deployment
+// needn't be added to the delegate itself.
+const upstreamPlugin = "plugin"
+
+// pluginConstructorName is the function a plugin must export, of type
+// pluginConstructor.
+const pluginConstructorName = "NewVerifier"
+
+// pluginConstructor creates a verifier from the plugin_config of an upstream,
+// as JSON, or nil if it has none. The verifier decides each request as an
+// upstream would: a 2xx response allows it, a 401 or 403 denies it, and
+// anything else is an error. Only standard library types are involved, so
+// that plugins needn't import this package.
+type pluginConstructor = func(config []byte) (http.Handler, error)
+
+// pluginMatcher is implemented by verifiers that also decide which requests
+// their upstream accepts, in addition to its other match conditions.
+type pluginMatcher interface {
+	Accepts(req *http.Request) bool
+}
+
+// validatePlugin opens the plugin of a plugin upstream and looks up its
+// NewVerifier function, so that a missing plugin is reported when the
+// configuration is loaded. The verifier is created by newRoutingTable, so
+// that validating a configuration doesn't run plugin code. Go caches plugins
+// by path, so a plugin can't be replaced by reloading the configuration,
+// though its verifier is recreated with the new plugin_config.
+func validatePlugin(upstream *AuthDelegateUpstream, msgs []string) []string {
+	upstream.newVerifier = nil
+	if upstream.PluginPath == "" {
+		return append(msgs, "plugin requires plugin_path: "+upstream.URL)
+	}
+	symbol, err := lookupPluginConstructor(upstream.PluginPath)
+	if err == nil {
+		upstream.newVerifier, err = pluginConstructorOf(symbol)
+	}
+	if err != nil {
+		msgs = append(msgs, "plugin_path could not be loaded for "+
+			upstream.URL+": "+err.Error())
+	}
+	return msgs
+}
+
+// pluginConstructorOf returns symbol, the NewVerifier function of a plugin,
+// if it has the type of a pluginConstructor.
+func pluginConstructorOf(symbol interface{}) (pluginConstructor, error) {
+	constructor, ok := symbol.(pluginConstructor)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a func([]byte) "+
+			"(http.Handler, error), not %T", pluginConstructorName,
+			symbol)
+	}
+	return constructor, nil
+}
+
+// newPluginVerifier calls constructor, the NewVerifier function of a
+// plugin, with config.
+func newPluginVerifier(constructor pluginConstructor,
+	config []byte) (http.Handler, error) {
+	verifier, err := constructor(config)
+	if err == nil && verifier == nil {
+		err = fmt.Errorf("%s returned no verifier",
+			pluginConstructorName)
+	}
+	return verifier, err
+}
+
+// pluginHandler decides requests with the verifier of a plugin upstream,
+// responding with a 500 status if it panics, so that a faulty plugin fails
+// only the requests it handles.
+type pluginHandler struct {
+	upstream string
+	verifier http.Handler
+
+	// Error creating the verifier, with which every request fails
+	err error
+}
+
+// newPluginHandler creates the verifier of a plugin upstream, returning the
+// handler that decides its requests, and the verifier if it implements
+// pluginMatcher. If the verifier can't be created, e.g. because its
+// plugin_config is invalid, the error is logged, and every request the
+// upstream accepts fails with a 500 status.
+func newPluginHandler(upstream *AuthDelegateUpstream) (http.Handler,
+	pluginMatcher) {
+	handler := &pluginHandler{upstream: upstreamLabel(upstream)}
+	handler.verifier, handler.err = newPluginVerifier(upstream.newVerifier,
+		upstream.PluginConfig)
+	if handler.err != nil {
+		log.Printf("upstream %s: plugin failed: %s", handler.upstream,
+			handler.err)
+		return handler, nil
+	}
+	matcher, _ := handler.verifier.(pluginMatcher)
+	return handler, matcher
+}
+
+func (handler *pluginHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("upstream %s: plugin panicked: %v",
+				handler.upstream, recovered)
+			explainDecision(req, fmt.Sprintf("plugin: panicked: %v",
+				recovered))
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+	if handler.err != nil {
+		explainDecision(req, "plugin: failed: "+handler.err.Error())
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	handler.verifier.ServeHTTP(rw, req)
+}
+
+// pluginMayMatch returns true if upstream is a plugin upstream, whose
+// verifier may decide which requests it accepts. Verifiers aren't created
+// until the routing table is, so validation assumes that they do.
+func pluginMayMatch(upstream *AuthDelegateUpstream) bool {
+	return upstream.Type == upstreamPlugin
+}
@@ -0,0 +1,13 @@
+//go:build noplugin
+// +build noplugin
+
+package authdelegate
+
+import "errors"
+
+// lookupPluginConstructor fails in builds with the noplugin tag, which omit
+// the plugin package, and with it the need for cgo.
+var lookupPluginConstructor = func(path string) (interface{}, error) {
+	return nil, errors.New("plugins are not supported by this build, " +
+		"which has the noplugin tag")
+}
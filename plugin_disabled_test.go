@@ -0,0 +1,27 @@
+//go:build noplugin
+// +build noplugin
+
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Builds without plugins", func() {
+	It("should fail validation for a plugin upstream", func() {
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{{
+				Name:       "team",
+				Type:       "plugin",
+				PluginPath: "/opt/authdelegate/team.so",
+			}},
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"plugin_path could not be loaded for plugin:team: plugins " +
+				"are not supported by this build, which has the noplugin " +
+				"tag",
+		})))
+	})
+})
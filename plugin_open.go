@@ -0,0 +1,17 @@
+//go:build !noplugin
+// +build !noplugin
+
+package authdelegate
+
+import "plugin"
+
+// lookupPluginConstructor opens the plugin at path and returns its
+// NewVerifier function; tests replace it, since building a plugin requires
+// the go command.
+var lookupPluginConstructor = func(path string) (interface{}, error) {
+	opened, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return opened.Lookup(pluginConstructorName)
+}
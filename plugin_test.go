@@ -0,0 +1,162 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// teamVerifier is a verifier as a plugin might define it, allowing requests
+// carrying its token, and accepting only requests below its path.
+type teamVerifier struct {
+	Token string `json:"token"`
+	Path  string `json:"path"`
+}
+
+func (verifier *teamVerifier) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-Team-Token") == "panic" {
+		panic("bad token")
+	} else if req.Header.Get("X-Team-Token") != verifier.Token {
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+	rw.Header().Set("X-Auth-Team", "platform")
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (verifier *teamVerifier) Accepts(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("X-Original-URI"),
+		verifier.Path)
+}
+
+func newTeamVerifier(config []byte) (http.Handler, error) {
+	verifier := &teamVerifier{}
+	if err := json.Unmarshal(config, verifier); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+var _ = Describe("Plugin upstreams", func() {
+	var fallback *httptest.Server
+	var opts *AuthDelegateOptions
+	var lookup func(string) (interface{}, error)
+
+	BeforeEach(func() {
+		lookup = lookupPluginConstructor
+		lookupPluginConstructor = func(path string) (interface{}, error) {
+			if path != "/opt/authdelegate/team.so" {
+				return nil, errors.New("plugin.Open(\"" + path +
+					"\"): no such file")
+			}
+			return newTeamVerifier, nil
+		}
+		fallback = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "team",
+					Type:       "plugin",
+					PluginPath: "/opt/authdelegate/team.so",
+					PluginConfig: json.RawMessage(
+						`{"token": "secret", "path": "/team"}`),
+				},
+				&AuthDelegateUpstream{URL: fallback.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		lookupPluginConstructor = lookup
+		fallback.Close()
+	})
+
+	authorize := func(uri, token string) *httptest.ResponseRecorder {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", uri)
+		req.Header.Set("X-Team-Token", token)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should decide the requests the plugin accepts", func() {
+		recorder := authorize("/team/reports", "secret")
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+		Expect(recorder.Header().Get("X-Auth-Team")).To(
+			Equal("platform"))
+		Expect(authorize("/team/reports", "guess").Code).To(
+			Equal(http.StatusForbidden))
+		Expect(authorize("/other", "guess").Code).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should fail requests whose verification panics", func() {
+		Expect(authorize("/team/reports", "panic").Code).To(
+			Equal(http.StatusInternalServerError))
+	})
+
+	It("should create the verifier only for the routing table", func() {
+		created := 0
+		lookupPluginConstructor = func(string) (interface{}, error) {
+			return func(config []byte) (http.Handler, error) {
+				created++
+				return newTeamVerifier(config)
+			}, nil
+		}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(created).To(Equal(0))
+		NewAuthDelegate(opts)
+		Expect(created).To(Equal(1))
+	})
+
+	It("should fail requests if the verifier can't be created", func() {
+		opts.Upstreams[0].PluginConfig = json.RawMessage(`[]`)
+		Expect(authorize("/other", "secret").Code).To(
+			Equal(http.StatusInternalServerError))
+	})
+
+	It("should fail validation if the plugin can't be used", func() {
+		opts.Upstreams = append(opts.Upstreams[:1],
+			&AuthDelegateUpstream{
+				Name:       "missing",
+				Type:       "plugin",
+				PluginPath: "/opt/authdelegate/missing.so",
+			},
+			&AuthDelegateUpstream{Name: "unset", Type: "plugin"},
+			&AuthDelegateUpstream{
+				URL:        fallback.URL,
+				PluginPath: "/opt/authdelegate/team.so",
+			})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"plugin_path could not be loaded for plugin:missing: " +
+				"plugin.Open(\"/opt/authdelegate/missing.so\"): " +
+				"no such file",
+			"plugin requires plugin_path: plugin:unset",
+			"plugin_path and plugin_config require type plugin: " +
+				fallback.URL,
+		})))
+	})
+
+	It("should require NewVerifier to have the expected type", func() {
+		_, err := pluginConstructorOf(func() {})
+		Expect(err).To(MatchError("NewVerifier must be a func([]byte) " +
+			"(http.Handler, error), not func()"))
+		_, err = newPluginVerifier(func([]byte) (http.Handler, error) {
+			return nil, nil
+		}, nil)
+		Expect(err).To(MatchError("NewVerifier returned no verifier"))
+	})
+})
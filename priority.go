@@ -0,0 +1,45 @@
+package authdelegate
+
+import (
+	"context"
+	"net/http"
+)
+
+// Priority classes of requests. Under overload, low priority requests are
+// rejected before high priority ones.
+const (
+	priorityHigh = "high"
+	priorityLow  = "low"
+)
+
+// defaultLowPriorityShare is the fraction of an upstream's adaptive
+// concurrency limit available to low priority requests by default.
+const defaultLowPriorityShare = 0.5
+
+// priorityContextKey marks requests whose priority class was determined by
+// the delegate itself, e.g. the requests in a batch.
+type priorityContextKey struct{}
+
+func withPriority(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, class)
+}
+
+// requestPriority returns the priority class of req: the class set by the
+// delegate, if any; else the value of priorityHeader, if valid; else the
+// upstream's default class.
+func requestPriority(req *http.Request, priorityHeader,
+	upstreamClass string) string {
+	if class, ok := req.Context().Value(priorityContextKey{}).(string); ok {
+		return class
+	}
+	if priorityHeader != "" {
+		switch class, _ := headerValue(req.Header, priorityHeader); class {
+		case priorityHigh, priorityLow:
+			return class
+		}
+	}
+	if upstreamClass == "" {
+		return priorityHigh
+	}
+	return upstreamClass
+}
@@ -0,0 +1,67 @@
+package authdelegate
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Request priority", func() {
+	var req *http.Request
+
+	BeforeEach(func() {
+		req, _ = http.NewRequest("GET", "http://delegate/", nil)
+	})
+
+	It("should default to the upstream's class", func() {
+		Expect(requestPriority(req, "", "")).To(Equal(priorityHigh))
+		Expect(requestPriority(req, "", priorityLow)).
+			To(Equal(priorityLow))
+	})
+
+	It("should honor a valid priority header", func() {
+		req.Header.Set("X-Auth-Priority", "low")
+		Expect(requestPriority(req, "X-Auth-Priority", "")).
+			To(Equal(priorityLow))
+		Expect(requestPriority(req, "", "")).To(Equal(priorityHigh))
+		req.Header.Set("X-Auth-Priority", "urgent")
+		Expect(requestPriority(req, "X-Auth-Priority", priorityLow)).
+			To(Equal(priorityLow))
+	})
+
+	It("should give batch requests low priority", func() {
+		req.Header.Set("X-Auth-Priority", "high")
+		item, err := newBatchItemRequest(req, batchRequestItem{URI: "/"})
+		Expect(err).To(BeNil())
+		Expect(requestPriority(item, "X-Auth-Priority", "")).
+			To(Equal(priorityLow))
+		req = req.WithContext(withPriority(context.Background(),
+			priorityHigh))
+		Expect(requestPriority(req, "", priorityLow)).
+			To(Equal(priorityHigh))
+	})
+
+	It("should fail validation for invalid priorities", func() {
+		share := 1.5
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{{
+				URL:      "http://localhost",
+				Priority: "urgent",
+				AdaptiveConcurrency: &AuthDelegateAdaptiveConcurrency{
+					TargetLatency:    "1s",
+					MaxLimit:         10,
+					LowPriorityShare: &share,
+				},
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"low_priority_share must be between 0 and 1: " +
+				"http://localhost",
+			"invalid priority for http://localhost: urgent",
+		})))
+	})
+})
@@ -0,0 +1,55 @@
+package authdelegate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// ProfileEnvVar selects the configuration profile if the -profile flag isn't
+// specified.
+const ProfileEnvVar = "AUTHDELEGATE_PROFILE"
+
+// selectProfile merges the overrides of the named profile in the "profiles"
+// section of the JSON config over the rest of it, and returns the result
+// without the "profiles" section. Objects are merged recursively; other
+// values, including lists such as "upstreams", are replaced. If profile is
+// empty, the "profiles" section is removed and the rest returned unchanged.
+// Returns config unchanged if it isn't a JSON object, so that the error is
+// reported when it is parsed as options.
+func selectProfile(config []byte, profile string) ([]byte, error) {
+	var base map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(config))
+	decoder.UseNumber()
+	if err := decoder.Decode(&base); err != nil {
+		return config, nil
+	}
+	profiles, present := base["profiles"]
+	if !present && profile == "" {
+		return config, nil
+	}
+	delete(base, "profiles")
+	if profile != "" {
+		sections, _ := profiles.(map[string]interface{})
+		overrides, ok := sections[profile].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("profile not defined: " + profile)
+		}
+		mergeConfig(base, overrides)
+	}
+	return json.Marshal(base)
+}
+
+// mergeConfig merges overrides into base, recursively for objects present in
+// both.
+func mergeConfig(base, overrides map[string]interface{}) {
+	for key, value := range overrides {
+		override, ok := value.(map[string]interface{})
+		if existing, isObject := base[key].(map[string]interface{}); ok &&
+			isObject {
+			mergeConfig(existing, override)
+			continue
+		}
+		base[key] = value
+	}
+}
@@ -0,0 +1,73 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strings"
+)
+
+var _ = Describe("Configuration profiles", func() {
+	config := []byte(strings.Join([]string{
+		`port: 8080`,
+		`upstreams:`,
+		`  - url: http://127.0.0.1:8081/auth`,
+		`storage:`,
+		`  type: file`,
+		`  path: /tmp/authdelegate`,
+		`profiles:`,
+		`  production:`,
+		`    port: 443`,
+		`    upstreams:`,
+		`      - url: https://sso.example.gov/auth`,
+		`        cookie_name: _sso`,
+		`      - url: https://tokens.example.gov/auth`,
+		`    storage:`,
+		`      path: /var/lib/authdelegate`,
+		`  staging:`,
+		`    port: 8443`,
+	}, "\n"))
+
+	It("should use the base section without a profile", func() {
+		opts, err := parseOptions("config.yaml", "", config)
+		Expect(err).To(BeNil())
+		Expect(opts.Port).To(Equal(8080))
+		Expect(opts.Upstreams).To(HaveLen(1))
+		Expect(opts.Storage.Path).To(Equal("/tmp/authdelegate"))
+	})
+
+	It("should merge a profile's overrides over the base", func() {
+		opts, err := parseOptions("config.yaml", "production", config)
+		Expect(err).To(BeNil())
+		Expect(opts.Port).To(Equal(443))
+		Expect(opts.Upstreams).To(HaveLen(2))
+		Expect(opts.Upstreams[0].CookieName).To(Equal("_sso"))
+		Expect(*opts.Storage).To(Equal(AuthDelegateStorage{
+			Type: "file", Path: "/var/lib/authdelegate",
+		}))
+
+		opts, err = parseOptions("config.yaml", "staging", config)
+		Expect(err).To(BeNil())
+		Expect(opts.Port).To(Equal(8443))
+		Expect(opts.Upstreams).To(HaveLen(1))
+	})
+
+	It("should validate the merged configuration", func() {
+		_, err := parseOptions("config.json", "production", []byte(
+			`{"port": 8080, "upstreams": [{"url": "http://localhost"}],`+
+				` "profiles": {"production": {"port": 0}}}`))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"port must be specified and greater than zero",
+		})))
+	})
+
+	It("should fail if the profile isn't defined", func() {
+		_, err := parseOptions("config.yaml", "development", config)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("profile not defined: development"))
+		_, err = parseOptions("config.json", "production",
+			[]byte(`{"port": 8080}`))
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("profile not defined: production"))
+	})
+})
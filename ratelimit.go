@@ -0,0 +1,143 @@
+package authdelegate
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Values of the key of an upstream's rate_limits
+const (
+	rateLimitClientIP   = "client_ip"
+	rateLimitCredential = "credential"
+)
+
+// rateLimiter limits the rate of requests to an upstream from each client
+// IP address or with each credential, using a token bucket per key, so that
+// brute-force attacks and runaway clients are refused before they reach the
+// auth backend. Credentials are keyed by their hash.
+type rateLimiter struct {
+	key   string
+	rate  float64
+	burst float64
+
+	// Of a credential limit, limits each client IP address to the same rate
+	// of credentials that have no bucket, so that a client can't evade the
+	// limit by guessing a different credential with each request
+	newKeys *rateLimiter
+
+	// Guards the following fields
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	limited int64
+
+	// Removes each bucket once it has refilled, and so is equivalent to a
+	// new one
+	expiries *expiryQueue
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiters(upstream *AuthDelegateUpstream) []*rateLimiter {
+	var limiters []*rateLimiter
+	for _, config := range upstream.RateLimits {
+		limiter := newRateLimiter(config.Key, config.RequestsPerSecond,
+			float64(config.Burst))
+		if config.Key == rateLimitCredential {
+			limiter.newKeys = newRateLimiter(rateLimitClientIP,
+				limiter.rate, limiter.burst)
+		}
+		limiters = append(limiters, limiter)
+	}
+	return limiters
+}
+
+func newRateLimiter(key string, rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		key:      key,
+		rate:     rate,
+		burst:    burst,
+		buckets:  make(map[string]*tokenBucket),
+		expiries: newExpiryQueue(),
+	}
+}
+
+// allow takes a token from the bucket for key, returning false and the time
+// until the next token if it is empty. If the limiter has no bucket for key,
+// and limits new keys, it first takes a token from the bucket of client.
+func (limiter *rateLimiter) allow(key, client string,
+	now time.Time) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.expiries.expire(now, func(key string) {
+		delete(limiter.buckets, key)
+	})
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		if limiter.newKeys != nil {
+			if ok, wait := limiter.newKeys.allow(client, "",
+				now); !ok {
+				limiter.limited++
+				return false, wait
+			}
+		}
+		bucket = &tokenBucket{limiter.burst, now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(limiter.burst, bucket.tokens+
+		now.Sub(bucket.updated).Seconds()*limiter.rate)
+	bucket.updated = now
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	} else {
+		limiter.limited++
+	}
+	limiter.expiries.set(key, now.Add(limiter.wait(limiter.burst-
+		bucket.tokens)))
+	if allowed {
+		return true, 0
+	}
+	return false, limiter.wait(1 - bucket.tokens)
+}
+
+// wait returns the time the limiter takes to refill a bucket by tokens.
+func (limiter *rateLimiter) wait(tokens float64) time.Duration {
+	return time.Duration(tokens / limiter.rate * float64(time.Second))
+}
+
+// limitedCount returns the number of requests the limiter has refused.
+func (limiter *rateLimiter) limitedCount() int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return limiter.limited
+}
+
+// checkRateLimits returns the key of the first of the upstream's rate limits
+// that req, whose credential has hash (which may be empty), exceeds, setting
+// the Retry-After header of rw; returns the empty string if it exceeds none.
+func (delegate *authDelegate) checkRateLimits(rw http.ResponseWriter,
+	req *http.Request, hash string) string {
+	now := time.Now()
+	client := clientIP(req)
+	for _, limiter := range delegate.rateLimits {
+		key := client
+		if limiter.key == rateLimitCredential {
+			key = hash
+		}
+		if key == "" {
+			continue
+		}
+		if ok, wait := limiter.allow(key, client, now); !ok {
+			rw.Header().Set("Retry-After", strconv.Itoa(
+				int(math.Ceil(wait.Seconds()))))
+			return limiter.key
+		}
+	}
+	return ""
+}
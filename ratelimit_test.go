@@ -0,0 +1,158 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Rate limits", func() {
+	var server *httptest.Server
+	var requests int32
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL: server.URL,
+				},
+			},
+			MetricsPath: "/metrics",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	authorize := func(handler http.Handler,
+		ip, credential string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Real-IP", ip)
+		if credential != "" {
+			req.Header.Set("X-Api-Key", credential)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should limit requests from each client IP", func() {
+		opts.Upstreams[0].RateLimits = []*AuthDelegateRateLimit{
+			{Key: "client_ip", RequestsPerSecond: 0.5, Burst: 2},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		for i := 0; i != 2; i++ {
+			Expect(authorize(handler, "192.0.2.1", "").Code).To(
+				Equal(http.StatusAccepted))
+		}
+		recorder := authorize(handler, "192.0.2.1", "")
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal("2"))
+		Expect(authorize(handler, "192.0.2.2", "").Code).To(
+			Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		metrics := httptest.NewRecorder()
+		handler.ServeHTTP(metrics, req)
+		Expect(metrics.Body.String()).To(ContainSubstring(
+			`authdelegate_upstream_rate_limited_total{upstream="` +
+				server.URL + `",key="client_ip"} 1`))
+	})
+
+	It("should limit requests with each credential", func() {
+		opts.Upstreams[0].HeaderName = "X-Api-Key"
+		opts.Upstreams[0].RateLimits = []*AuthDelegateRateLimit{
+			{Key: "credential", RequestsPerSecond: 0.1},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Upstreams[0].RateLimits[0].Burst).To(Equal(1))
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "192.0.2.1", "guess1").Code).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize(handler, "192.0.2.2", "guess1").Code).To(
+			Equal(http.StatusTooManyRequests))
+		Expect(authorize(handler, "192.0.2.3", "guess2").Code).To(
+			Equal(http.StatusAccepted))
+	})
+
+	It("should limit the new credentials from each client IP", func() {
+		opts.Upstreams[0].HeaderName = "X-Api-Key"
+		opts.Upstreams[0].RateLimits = []*AuthDelegateRateLimit{
+			{Key: "credential", RequestsPerSecond: 0.5, Burst: 2},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		for _, guess := range []string{"guess1", "guess2"} {
+			Expect(authorize(handler, "192.0.2.1", guess).Code).To(
+				Equal(http.StatusAccepted))
+		}
+		recorder := authorize(handler, "192.0.2.1", "guess3")
+		Expect(recorder.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(recorder.Header().Get("Retry-After")).To(Equal("2"))
+		Expect(authorize(handler, "192.0.2.1", "guess1").Code).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize(handler, "192.0.2.2", "guess3").Code).To(
+			Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(4)))
+	})
+
+	It("should refill each bucket at the sustained rate", func() {
+		limiter := newRateLimiter("client_ip", 2, 2)
+		now := time.Now()
+		for i := 0; i != 2; i++ {
+			ok, _ := limiter.allow("client", "", now)
+			Expect(ok).To(BeTrue())
+		}
+		ok, wait := limiter.allow("client", "", now)
+		Expect(ok).To(BeFalse())
+		Expect(wait).To(Equal(500 * time.Millisecond))
+		ok, _ = limiter.allow("client", "",
+			now.Add(500*time.Millisecond))
+		Expect(ok).To(BeTrue())
+
+		limiter.allow("other", "", now.Add(1500*time.Millisecond))
+		Expect(limiter.buckets).To(HaveLen(1))
+		Expect(limiter.buckets).To(HaveKey("other"))
+		limiter.allow("later", "", now.Add(1900*time.Millisecond))
+		Expect(limiter.buckets).To(HaveLen(2))
+		limiter.allow("later", "", now.Add(2*time.Second))
+		Expect(limiter.buckets).To(HaveLen(1))
+		Expect(limiter.buckets).To(HaveKey("later"))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].RateLimits = []*AuthDelegateRateLimit{
+			{Key: "credential", RequestsPerSecond: 1},
+			{Key: "user", RequestsPerSecond: 0},
+			{Key: "client_ip", RequestsPerSecond: 1, Burst: -1},
+			{Key: "client_ip", RequestsPerSecond: 2},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"rate_limits key credential requires header_name or " +
+				"cookie_name: " + server.URL,
+			"rate_limits key must be client_ip or credential for " +
+				server.URL + ": user",
+			"rate_limits requests_per_second must be positive: " +
+				server.URL,
+			"rate_limits burst must be positive: " + server.URL,
+			"repeated rate_limits keys for " + server.URL +
+				": client_ip",
+		})))
+	})
+})
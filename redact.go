@@ -0,0 +1,240 @@
+package authdelegate
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ways of redacting a kind of value in logs
+const (
+	redactHash     = "hash"
+	redactTruncate = "truncate"
+	redactSuppress = "suppress"
+)
+
+// defaultRedactionSaltRotation is how often the salt of hashed values
+// changes unless salt_rotation_interval is specified.
+const defaultRedactionSaltRotation = 24 * time.Hour
+
+var (
+	// Authorization header values, JSON Web Tokens, and the credential
+	// passed to exec_command, which a command may echo to its standard
+	// error; the submatch that matched is the credential itself
+	credentialPattern = regexp.MustCompile(
+		`(?i:\b(?:Bearer|Basic)\s+([A-Za-z0-9._~+/=-]{8,}))|` +
+			`\b(eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*)|` +
+			`"credential":"((?:[^"\\]|\\.)*)"`)
+
+	// Email addresses, including those escaped in a URI
+	emailPattern = regexp.MustCompile(
+		`[A-Za-z0-9._%+-]+(?:@|%40)[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)+`)
+
+	// Candidate IPv4 and IPv6 addresses, which must parse as such to be
+	// redacted, so that times and the like are left alone
+	ipPattern = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b|` +
+		`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}` +
+		`(?:\.\d{1,3}){0,3}`)
+)
+
+// logRedactor removes credentials, email addresses, and IP addresses from
+// text bound for logs and trace spans, as configured by log_redaction. A
+// nil *logRedactor leaves text unchanged.
+type logRedactor struct {
+	credentials string
+	emails      string
+	ips         string
+	rotation    time.Duration
+
+	// The salt of hashed values, which is replaced after rotates
+	mu      sync.Mutex
+	salt    []byte
+	rotates time.Time
+}
+
+func newLogRedactor(opts *AuthDelegateOptions) *logRedactor {
+	config := opts.LogRedaction
+	if config == nil || (config.Credentials == "" && config.Emails == "" &&
+		config.IPs == "") {
+		return nil
+	}
+	return &logRedactor{
+		credentials: config.Credentials,
+		emails:      config.Emails,
+		ips:         config.IPs,
+		rotation:    config.saltRotationInterval,
+	}
+}
+
+// redactLogs makes the standard logger redact what delegate, which must have
+// been created by NewAuthDelegate, is configured to redact, if anything.
+// Only the authdelegate command calls it: a program embedding a delegate owns
+// the standard logger, so NewAuthDelegate leaves it alone, and its log
+// entries are redacted only if the program redacts them itself. Trace spans
+// and error samples are redacted either way.
+func redactLogs(delegate http.Handler) {
+	redactor := delegate.(*authDelegateHandler).redactor
+	if redactor != nil {
+		log.SetOutput(&redactingWriter{os.Stderr, redactor})
+	}
+}
+
+// redactingWriter redacts each line written to it before writing it to
+// out. The standard logger writes each entry in a single call.
+type redactingWriter struct {
+	out      io.Writer
+	redactor *logRedactor
+}
+
+func (writer *redactingWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(writer.out,
+		writer.redactor.text(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// text returns s with each credential, email address, and IP address
+// redacted as configured.
+func (redactor *logRedactor) text(s string) string {
+	if redactor == nil {
+		return s
+	}
+	if redactor.credentials != "" {
+		s = replaceSubmatch(credentialPattern, s, redactor.credential)
+	}
+	if redactor.emails != "" {
+		s = emailPattern.ReplaceAllStringFunc(s, redactor.email)
+	}
+	if redactor.ips != "" {
+		s = ipPattern.ReplaceAllStringFunc(s, redactor.ip)
+	}
+	return s
+}
+
+// replaceSubmatch replaces the submatch of each match of pattern in s with
+// the result of replace.
+func replaceSubmatch(pattern *regexp.Regexp, s string,
+	replace func(string) string) string {
+	var result strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(s, -1) {
+		start, end := match[0], match[1]
+		for i := 2; i < len(match); i += 2 {
+			if match[i] != -1 {
+				start, end = match[i], match[i+1]
+				break
+			}
+		}
+		result.WriteString(s[last:start])
+		result.WriteString(replace(s[start:end]))
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	result.WriteString(s[last:])
+	return result.String()
+}
+
+func (redactor *logRedactor) credential(value string) string {
+	switch redactor.credentials {
+	case redactHash:
+		return redactor.hash("credential", value)
+	case redactTruncate:
+		if len(value) <= 4 {
+			return "..."
+		}
+		return value[:4] + "..."
+	}
+	return "[credential]"
+}
+
+func (redactor *logRedactor) email(value string) string {
+	switch redactor.emails {
+	case redactHash:
+		return redactor.hash("email", value)
+	case redactTruncate:
+		at := strings.Index(value, "@")
+		separator := "@"
+		if at == -1 {
+			at = strings.Index(value, "%40")
+			separator = "%40"
+		}
+		return value[:1] + "***" + separator + value[at+len(separator):]
+	}
+	return "[email]"
+}
+
+func (redactor *logRedactor) ip(value string) string {
+	addr := net.ParseIP(value)
+	if addr == nil {
+		return value
+	}
+	switch redactor.ips {
+	case redactHash:
+		return redactor.hash("ip", addr.String())
+	case redactTruncate:
+		if addr.To4() != nil {
+			return addr.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return addr.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return "[ip]"
+}
+
+// hash returns a digest of value under the current salt, prefixed by kind,
+// so that the same value can be followed across log entries and spans until
+// the salt rotates, but can't be recovered.
+func (redactor *logRedactor) hash(kind, value string) string {
+	redactor.mu.Lock()
+	if now := time.Now(); !now.Before(redactor.rotates) {
+		redactor.salt = make([]byte, 32)
+		rand.Read(redactor.salt)
+		redactor.rotates = now.Add(redactor.rotation)
+	}
+	mac := hmac.New(sha256.New, redactor.salt)
+	redactor.mu.Unlock()
+	mac.Write([]byte(value))
+	return kind + ":" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+func validateLogRedaction(opts *AuthDelegateOptions,
+	msgs []string) []string {
+	config := opts.LogRedaction
+	if config == nil {
+		return msgs
+	}
+	for _, setting := range []struct{ name, value string }{
+		{"credentials", config.Credentials},
+		{"emails", config.Emails},
+		{"ips", config.IPs},
+	} {
+		switch setting.value {
+		case "", redactHash, redactTruncate, redactSuppress:
+		default:
+			msgs = append(msgs, "log_redaction "+setting.name+
+				" must be hash, truncate, or suppress: "+setting.value)
+		}
+	}
+	msgs = validateDuration(config.SaltRotationInterval,
+		"salt_rotation_interval", "log_redaction",
+		&config.saltRotationInterval, msgs)
+	if config.SaltRotationInterval == "" {
+		config.saltRotationInterval = defaultRedactionSaltRotation
+	} else if config.saltRotationInterval == 0 {
+		msgs = append(msgs, "log_redaction salt_rotation_interval must "+
+			"be positive")
+	}
+	return msgs
+}
@@ -0,0 +1,159 @@
+package authdelegate
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Log redaction", func() {
+	var opts *AuthDelegateOptions
+
+	const line = `2026/10/15 02:58:11 upstream legacy: exec: stderr: ` +
+		`denied {"method":"GET","uri":"/users/ana.diaz@example.gov",` +
+		`"client_ip":"192.0.2.7","credential":"s3cret-token"} ` +
+		`via 2001:db8:a0b:12f0::1 Authorization: Bearer ` +
+		`eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiJhbmEifQ.c2ln; ` +
+		`query email=ana.diaz%40example.gov`
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			LogRedaction: &AuthDelegateLogRedaction{
+				Credentials: "suppress",
+				Emails:      "suppress",
+				IPs:         "suppress",
+			},
+		}
+	})
+
+	redactor := func() *logRedactor {
+		Expect(validateLogRedaction(opts, nil)).To(BeEmpty())
+		return newLogRedactor(opts)
+	}
+
+	It("should leave logs unchanged unless configured", func() {
+		opts.LogRedaction = nil
+		Expect(redactor()).To(BeNil())
+		Expect(redactor().text(line)).To(Equal(line))
+	})
+
+	It("should suppress each kind of value", func() {
+		Expect(redactor().text(line)).To(Equal(
+			`2026/10/15 02:58:11 upstream legacy: exec: stderr: ` +
+				`denied {"method":"GET","uri":"/users/[email]",` +
+				`"client_ip":"[ip]","credential":"[credential]"} ` +
+				`via [ip] Authorization: Bearer [credential]; ` +
+				`query email=[email]`))
+	})
+
+	It("should truncate each kind of value", func() {
+		opts.LogRedaction.Credentials = "truncate"
+		opts.LogRedaction.Emails = "truncate"
+		opts.LogRedaction.IPs = "truncate"
+		Expect(redactor().text(line)).To(Equal(
+			`2026/10/15 02:58:11 upstream legacy: exec: stderr: ` +
+				`denied {"method":"GET","uri":"/users/a***@example.gov",` +
+				`"client_ip":"192.0.2.0/24","credential":"s3cr..."} ` +
+				`via 2001:db8:a0b::/48 Authorization: Bearer eyJh...; ` +
+				`query email=a***%40example.gov`))
+	})
+
+	It("should hash values with a salt that rotates", func() {
+		opts.LogRedaction.IPs = "hash"
+		opts.LogRedaction.SaltRotationInterval = "50ms"
+		redactor := redactor()
+		first := redactor.text("from 192.0.2.7 and 192.0.2.8")
+		Expect(first).To(MatchRegexp(
+			`^from ip:[0-9a-f]{12} and ip:[0-9a-f]{12}$`))
+		Expect(redactor.text("again 192.0.2.7")).To(
+			Equal("again " + first[5:20]))
+		Expect(first[5:20]).ToNot(Equal(first[25:]))
+
+		time.Sleep(60 * time.Millisecond)
+		Expect(redactor.text("again 192.0.2.7")).ToNot(
+			Equal("again " + first[5:20]))
+	})
+
+	It("should redact the log entries and spans of requests", func() {
+		opts.AuditDecisions = "denials"
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				Name:       "api-tokens",
+				Type:       "static_tokens",
+				HeaderName: "X-Api-Key",
+				TokenHashes: []string{
+					hashCredential("s3cret"),
+				},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/users/ana.diaz@example.gov")
+		req.Header.Set("X-Api-Key", "guess")
+		req.RemoteAddr = "192.0.2.7:41000"
+
+		var output bytes.Buffer
+		log.SetOutput(&redactingWriter{&output,
+			handler.(*authDelegateHandler).redactor})
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		log.SetOutput(os.Stderr)
+		Expect(output.String()).To(ContainSubstring(
+			`"uri":"/users/[email]","host":"delegate",` +
+				`"client_ip":"[ip]"`))
+		Expect(strings.Contains(output.String(), "192.0.2.7")).To(
+			BeFalse())
+
+		recorder := tracetest.NewSpanRecorder()
+		exporter := newSpanExporter()
+		exporter.provider.Store(sdktrace.NewTracerProvider(
+			sdktrace.WithSpanProcessor(recorder)))
+		span := (&tracer{}).start(req, exporter,
+			handler.(*authDelegateHandler).redactor)
+		child := span.child("GET", trace.SpanKindClient)
+		child.setString("url.full", "http://192.0.2.9:8081/auth")
+		child.fail("dial tcp 192.0.2.9:8081: connection refused")
+		child.end()
+		span.end()
+
+		ended := recorder.Ended()
+		Expect(ended).To(HaveLen(2))
+		Expect(ended[1].Attributes()).To(ContainElement(
+			attribute.String("client.address", "[ip]")))
+		Expect(ended[0].Attributes()).To(ContainElement(
+			attribute.String("url.full", "http://[ip]:8081/auth")))
+		Expect(ended[0].Status().Description).To(Equal(
+			"dial tcp [ip]:8081: connection refused"))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.LogRedaction = &AuthDelegateLogRedaction{
+			Credentials:          "mask",
+			IPs:                  "Hash",
+			SaltRotationInterval: "0s",
+		}
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{URL: "http://localhost:8081"},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"log_redaction credentials must be hash, truncate, or " +
+				"suppress: mask",
+			"log_redaction ips must be hash, truncate, or suppress: Hash",
+			"log_redaction salt_rotation_interval must be positive",
+		})))
+	})
+})
@@ -0,0 +1,107 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Scanner rejection", func() {
+	var opts *AuthDelegateOptions
+	var upstream *httptest.Server
+	var upstreamRequests int
+
+	BeforeEach(func() {
+		upstreamRequests = 0
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				upstreamRequests++
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		opts = &AuthDelegateOptions{
+			Port:                8080,
+			RejectKnownScanners: true,
+			RejectUserAgents:    []string{"BadBot"},
+			RejectPaths:         []string{"/internal/"},
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: upstream.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	serve := func(delegate http.Handler, uri, userAgent string) int {
+		req, _ := http.NewRequest("GET", "http://delegate/auth", nil)
+		req.Header.Set("X-Original-URI", uri)
+		req.Header.Set("User-Agent", userAgent)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should reject matching requests without contacting upstreams",
+		func() {
+			Expect(opts.Validate()).To(BeNil())
+			delegate := NewAuthDelegate(opts)
+			Expect(serve(delegate, "/", "sqlmap/1.7")).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/", "Mozilla/5.0 (compatible; "+
+				"Nmap Scripting Engine)")).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/", "badbot/2.0")).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/.env?x=1", "curl/8.4.0")).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/internal/jobs", "curl/8.4.0")).
+				To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/public/../internal/jobs",
+				"curl/8.4.0")).To(Equal(http.StatusForbidden))
+			Expect(serve(delegate, "/public/%2E%2E/internal/jobs",
+				"curl/8.4.0")).To(Equal(http.StatusForbidden))
+			Expect(upstreamRequests).To(Equal(0))
+
+			Expect(serve(delegate, "/internal", "curl/8.4.0")).
+				To(Equal(http.StatusAccepted))
+			Expect(upstreamRequests).To(Equal(1))
+			Expect(delegate.(*authDelegateHandler).rejections.load()).
+				To(Equal(rejectionCounts{UserAgent: 3, Path: 4}))
+		})
+
+	It("should report ErrRejected to the error handler", func() {
+		var reported error
+		opts.ErrorHandler = func(rw http.ResponseWriter,
+			req *http.Request, err error) {
+			reported = err
+			rw.WriteHeader(http.StatusTeapot)
+		}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(serve(NewAuthDelegate(opts), "/wp-login.php", "")).
+			To(Equal(http.StatusTeapot))
+		Expect(reported).To(MatchError(ErrRejected))
+	})
+
+	It("should reject nothing by default", func() {
+		opts.RejectKnownScanners = false
+		opts.RejectUserAgents = nil
+		opts.RejectPaths = nil
+		Expect(opts.Validate()).To(BeNil())
+		Expect(newRequestFilter(opts)).To(BeNil())
+		Expect(serve(NewAuthDelegate(opts), "/.env", "sqlmap/1.7")).
+			To(Equal(http.StatusAccepted))
+	})
+
+	It("should fail validation for invalid rules", func() {
+		opts.RejectUserAgents = []string{""}
+		opts.RejectPaths = []string{"wp-admin"}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"reject_user_agents must not contain an empty string",
+			"reject_paths entry must begin with /: wp-admin",
+		})))
+	})
+})
@@ -0,0 +1,60 @@
+package authdelegate
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnHangup reloads the configuration of delegate, which must have been
+// created by NewAuthDelegate, from configPath with the overrides of profile
+// whenever the process receives SIGHUP.
+func reloadOnHangup(delegate http.Handler, configPath, profile string) {
+	handler := delegate.(*authDelegateHandler)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			handler.reload(configPath, profile)
+		}
+	}()
+}
+
+// reload re-reads and re-validates the configuration at configPath, fetching
+// the remote configuration again if it is a bootstrap configuration, with the
+// overrides of profile if it isn't empty, then replaces the routing table
+// with one built from it. Requests already in flight complete using the
+// previous table. If the configuration can't be read or is invalid, logs the
+// error and keeps the previous table in effect. Options outside the routing
+// table, such as the port and storage, take effect only on restart.
+func (handler *authDelegateHandler) reload(
+	configPath, profile string) error {
+	configName, config, err := readConfig(configPath)
+	if err != nil {
+		log.Printf("config: reload failed: %s", err)
+		return err
+	}
+	opts, err := parseOptions(configName, profile, config)
+	if err != nil {
+		log.Printf("config: reload of %s failed; keeping the current "+
+			"configuration: %s", configPath, err)
+		return err
+	}
+	for _, warning := range opts.Lint() {
+		log.Printf("config: warning: %s: %s", configPath, warning)
+	}
+	if handler.watcher != nil {
+		if err = handler.watcher.rebase(opts); err != nil {
+			log.Printf("config: reload of %s failed; keeping the "+
+				"current configuration: %s", configPath, err)
+			return err
+		}
+	} else {
+		handler.swapRoutes(newRoutingTable(opts))
+	}
+	log.Printf("config: reloaded %s; fingerprint %s", configPath,
+		opts.Fingerprint())
+	return nil
+}
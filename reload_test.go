@@ -0,0 +1,128 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var _ = Describe("Configuration reloading", func() {
+	var dir, configPath string
+	var first, second *httptest.Server
+	var handler *authDelegateHandler
+
+	newServer := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+			}))
+	}
+
+	writeConfig := func(config string) {
+		Expect(ioutil.WriteFile(configPath, []byte(config),
+			0600)).To(Succeed())
+	}
+
+	status := func() int {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "reload")
+		Expect(err).To(BeNil())
+		configPath = filepath.Join(dir, "config.yaml")
+		first = newServer(http.StatusAccepted)
+		second = newServer(http.StatusNoContent)
+		config := "port: 8080\nupstreams:\n  - url: " + first.URL
+		writeConfig(config)
+		opts, err := parseOptions(configPath, "", []byte(config))
+		Expect(err).To(BeNil())
+		handler = NewAuthDelegate(opts).(*authDelegateHandler)
+	})
+
+	AfterEach(func() {
+		first.Close()
+		second.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should swap in a valid configuration", func() {
+		Expect(status()).To(Equal(http.StatusAccepted))
+		writeConfig("port: 8080\nupstreams:\n  - url: " + second.URL)
+		Expect(handler.reload(configPath, "")).To(Succeed())
+		Expect(status()).To(Equal(http.StatusNoContent))
+	})
+
+	It("should keep the state of upstreams of the same name", func() {
+		config := "port: 8080\nupstreams:\n  - name: session\n" +
+			"    url: " + first.URL + "\n" +
+			"    adaptive_concurrency:\n      target_latency: 1s\n" +
+			"      min_limit: 2\n      max_limit: 20\n" +
+			"    circuit_breaker:\n      consecutive_failures: 3\n" +
+			"      cool_down: 1m\n"
+		writeConfig(config)
+		Expect(handler.reload(configPath, "")).To(Succeed())
+		Expect(status()).To(Equal(http.StatusAccepted))
+		upstream := handler.routes().findUpstream("session")
+		upstream.setDraining(true)
+		upstream.limiter.limit = 5
+		upstream.breaker.open(time.Now(), "test")
+
+		writeConfig(strings.Replace(config, "max_limit: 20",
+			"max_limit: 4", 1))
+		Expect(handler.reload(configPath, "")).To(Succeed())
+		reloaded := handler.routes().findUpstream("session")
+		Expect(reloaded).ToNot(BeIdenticalTo(upstream))
+		Expect(reloaded.isDraining()).To(BeTrue())
+		Expect(reloaded.limiter.status().Limit).To(Equal(4))
+		Expect(reloaded.breaker.isOpen()).To(BeTrue())
+		Expect(reloaded.latency.totalSummary().Count).To(
+			Equal(uint64(1)))
+
+		writeConfig(strings.Replace(config, "name: session",
+			"name: other", 1))
+		Expect(handler.reload(configPath, "")).To(Succeed())
+		other := handler.routes().findUpstream("other")
+		Expect(other.isDraining()).To(BeFalse())
+		Expect(other.breaker.isOpen()).To(BeFalse())
+	})
+
+	It("should keep the current configuration if the new one is invalid",
+		func() {
+			writeConfig("port: 0\nupstreams:\n  - url: " + second.URL)
+			err := handler.reload(configPath, "")
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"port must be specified and greater than zero",
+			})))
+			Expect(status()).To(Equal(http.StatusAccepted))
+		})
+
+	It("should keep the current configuration if the file is missing",
+		func() {
+			Expect(os.Remove(configPath)).To(Succeed())
+			Expect(handler.reload(configPath, "")).ToNot(Succeed())
+			Expect(status()).To(Equal(http.StatusAccepted))
+		})
+
+	It("should reload on SIGHUP", func() {
+		reloadOnHangup(handler, configPath, "")
+		writeConfig("port: 8080\nupstreams:\n  - url: " + second.URL)
+		process, err := os.FindProcess(os.Getpid())
+		Expect(err).To(BeNil())
+		Expect(process.Signal(syscall.SIGHUP)).To(Succeed())
+		Eventually(status, time.Second).
+			Should(Equal(http.StatusNoContent))
+	})
+})
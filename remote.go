@@ -0,0 +1,278 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// remoteConfigClient fetches remote configurations and their signatures.
+var remoteConfigClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxRemoteConfigSize limits the size of a remote configuration or signature.
+const maxRemoteConfigSize = 16 << 20
+
+// remoteConfigSource is the remote_config section of a bootstrap
+// configuration, which identifies a centrally managed configuration and the
+// key with which it must be signed.
+type remoteConfigSource struct {
+	// HTTPS URL of the configuration, or s3://bucket/key
+	URL string `json:"url"`
+
+	// URL of the detached Ed25519 signature of the configuration; defaults
+	// to URL with ".sig" appended
+	SignatureURL string `json:"signature_url"`
+
+	// Path to a PEM file containing the Ed25519 public key
+	PublicKey string `json:"public_key"`
+
+	// HTTPS endpoint of the S3-compatible service and the region of the
+	// bucket, for s3:// URLs; the endpoint defaults to that of AWS in the
+	// region, which defaults to $AWS_REGION, then "us-east-1"
+	Endpoint string `json:"endpoint"`
+	Region   string `json:"region"`
+}
+
+// readConfig returns the configuration at configPath, and the path by whose
+// extension its format is determined. If configPath contains a bootstrap
+// configuration, which defines only remote_config, returns the remote
+// configuration instead, after verifying its signature.
+func readConfig(configPath string) (string, []byte, error) {
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return "", nil, err
+	}
+	source, err := parseBootstrapConfig(configPath, config)
+	if source == nil || err != nil {
+		return configPath, config, err
+	}
+	configURL, inS3, err := source.resolve(source.URL)
+	if err != nil {
+		return "", nil, err
+	}
+	if config, err = source.fetch(configURL, inS3); err != nil {
+		return "", nil, err
+	}
+	signatureURL := source.SignatureURL
+	if signatureURL == "" {
+		signatureURL = source.URL + ".sig"
+	}
+	if err = source.verify(config, signatureURL); err != nil {
+		return "", nil, err
+	}
+	return configURL.Path, config, nil
+}
+
+// parseBootstrapConfig returns the remote_config section of config, or nil if
+// config doesn't define one. Returns an error if remote_config is invalid.
+// Returns nil and no error if config fails to parse, so that the error is
+// reported when it is parsed as options.
+func parseBootstrapConfig(configPath string, config []byte) (
+	*remoteConfigSource, error) {
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".yaml", ".yml":
+		var err error
+		if config, err = yamlToJSON(config); err != nil {
+			return nil, nil
+		}
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(config, &sections); err != nil {
+		return nil, nil
+	}
+	section, present := sections["remote_config"]
+	if !present {
+		return nil, nil
+	}
+	if len(sections) != 1 {
+		return nil, errors.New("remote_config must be the only option " +
+			"in a bootstrap configuration")
+	}
+	source := &remoteConfigSource{}
+	decoder := json.NewDecoder(bytes.NewReader(section))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(source); err != nil {
+		return nil, errors.New("remote_config parsing failed: " +
+			err.Error())
+	}
+	var msgs []string
+	if !strings.HasPrefix(source.URL, "https://") &&
+		!strings.HasPrefix(source.URL, "s3://") {
+		msgs = append(msgs, "remote_config url must begin with "+
+			"https:// or s3://: "+source.URL)
+	}
+	if source.SignatureURL != "" &&
+		!strings.HasPrefix(source.SignatureURL, "https://") &&
+		!strings.HasPrefix(source.SignatureURL, "s3://") {
+		msgs = append(msgs, "remote_config signature_url must begin "+
+			"with https:// or s3://: "+source.SignatureURL)
+	}
+	if source.PublicKey == "" {
+		msgs = append(msgs, "remote_config public_key must be specified")
+	}
+	if source.Endpoint != "" &&
+		!strings.HasPrefix(source.Endpoint, "https://") {
+		msgs = append(msgs, "remote_config endpoint must begin with "+
+			"https://: "+source.Endpoint)
+	}
+	if len(msgs) != 0 {
+		return nil, errors.New("Invalid options:\n  " +
+			strings.Join(msgs, "\n  "))
+	}
+	return source, nil
+}
+
+// resolve returns the HTTPS URL from which to fetch rawURL, translating an
+// s3:// URL to a path-style URL on the S3 endpoint, and whether it did so.
+func (source *remoteConfigSource) resolve(rawURL string) (
+	*url.URL, bool, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, false, errors.New("remote_config URL failed to " +
+			"parse: " + err.Error())
+	}
+	if parsed.Scheme != "s3" {
+		return parsed, false, nil
+	}
+	endpoint := source.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + source.region() + ".amazonaws.com"
+	}
+	resolved, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, false, errors.New("remote_config endpoint failed " +
+			"to parse: " + err.Error())
+	}
+	resolved.Path = strings.TrimSuffix(resolved.Path, "/") + "/" +
+		parsed.Host + parsed.Path
+	return resolved, true, nil
+}
+
+func (source *remoteConfigSource) region() string {
+	if source.Region != "" {
+		return source.Region
+	} else if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// fetch returns the body of the object at location. Requests for objects in
+// S3 are signed if the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+// variables are set.
+func (source *remoteConfigSource) fetch(
+	location *url.URL, inS3 bool) ([]byte, error) {
+	req, err := http.NewRequest("GET", location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if inS3 && accessKey != "" && secretKey != "" {
+		if err := signS3Request(req, source.region(), accessKey,
+			secretKey, os.Getenv("AWS_SESSION_TOKEN"),
+			time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := remoteConfigClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s returned %d",
+			location.Redacted(), resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body,
+		maxRemoteConfigSize))
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s failed: %s",
+			location.Redacted(), err)
+	}
+	return body, nil
+}
+
+// verify returns an error unless the signature at signatureURL is a valid
+// signature of config by the source's public key. The signature may be raw or
+// base64-encoded.
+func (source *remoteConfigSource) verify(
+	config []byte, signatureURL string) error {
+	publicKey, err := readEd25519PublicKey(source.PublicKey)
+	if err != nil {
+		return err
+	}
+	location, inS3, err := source.resolve(signatureURL)
+	if err != nil {
+		return err
+	}
+	signature, err := source.fetch(location, inS3)
+	if err != nil {
+		return err
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(
+			strings.TrimSpace(string(signature)))
+		if err == nil {
+			signature = decoded
+		}
+	}
+	if !ed25519.Verify(publicKey, config, signature) {
+		return errors.New("remote configuration signature " +
+			"verification failed: " + source.URL)
+	}
+	return nil
+}
+
+func readEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("no PEM public key found in " + path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key in %s: %s", path, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not Ed25519: " + path)
+	}
+	return publicKey, nil
+}
+
+// emptyPayloadHash is the hex SHA-256 digest of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb924" +
+	"27ae41e4649b934ca495991b7852b855"
+
+// signS3Request adds an AWS Signature Version 4 Authorization header to req,
+// a GET request without a body.
+func signS3Request(req *http.Request, region, accessKey, secretKey,
+	sessionToken string, now time.Time) error {
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	credentials := aws.Credentials{
+		AccessKeyID:     accessKey,
+		SecretAccessKey: secretKey,
+		SessionToken:    sessionToken,
+	}
+	return v4.NewSigner().SignHTTP(req.Context(), credentials, req,
+		emptyPayloadHash, "s3", region, now)
+}
@@ -0,0 +1,181 @@
+package authdelegate
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("Remote configuration", func() {
+	var dir, keyPath, bootstrapPath string
+	var privateKey ed25519.PrivateKey
+	var objects map[string][]byte
+	var authorization string
+	var server *httptest.Server
+	var client *http.Client
+
+	config := []byte(
+		"port: 8080\nupstreams:\n  - url: https://foo.com/auth\n")
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "remote")
+		Expect(err).To(BeNil())
+		publicKey, key, err := ed25519.GenerateKey(rand.Reader)
+		Expect(err).To(BeNil())
+		privateKey = key
+		encoded, err := x509.MarshalPKIXPublicKey(publicKey)
+		Expect(err).To(BeNil())
+		keyPath = filepath.Join(dir, "config.pub")
+		Expect(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+			Type: "PUBLIC KEY", Bytes: encoded,
+		}), 0600)).To(Succeed())
+		bootstrapPath = filepath.Join(dir, "bootstrap.yaml")
+
+		objects = map[string][]byte{}
+		authorization = ""
+		server = httptest.NewTLSServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				authorization = req.Header.Get("Authorization")
+				object, ok := objects[req.URL.Path]
+				if !ok {
+					http.NotFound(rw, req)
+					return
+				}
+				rw.Write(object)
+			}))
+		client = remoteConfigClient
+		remoteConfigClient = server.Client()
+	})
+
+	AfterEach(func() {
+		remoteConfigClient = client
+		server.Close()
+		os.RemoveAll(dir)
+	})
+
+	writeBootstrap := func(lines ...string) {
+		Expect(ioutil.WriteFile(bootstrapPath,
+			[]byte(strings.Join(lines, "\n")), 0600)).To(Succeed())
+	}
+
+	publish := func(path string, content []byte) {
+		objects[path] = content
+		signature := ed25519.Sign(privateKey, content)
+		objects[path+".sig"] = []byte(
+			base64.StdEncoding.EncodeToString(signature) + "\n")
+	}
+
+	It("should return a local configuration unchanged", func() {
+		writeBootstrap(string(config))
+		name, fetched, err := readConfig(bootstrapPath)
+		Expect(err).To(BeNil())
+		Expect(name).To(Equal(bootstrapPath))
+		Expect(fetched).To(Equal(config))
+	})
+
+	It("should fetch and verify a configuration over HTTPS", func() {
+		publish("/fleet/config.yaml", config)
+		writeBootstrap(`remote_config:`,
+			`  url: `+server.URL+`/fleet/config.yaml`,
+			`  public_key: `+keyPath)
+		name, fetched, err := readConfig(bootstrapPath)
+		Expect(err).To(BeNil())
+		Expect(name).To(Equal("/fleet/config.yaml"))
+		Expect(fetched).To(Equal(config))
+		opts, err := parseOptions(name, "", fetched)
+		Expect(err).To(BeNil())
+		Expect(opts.Port).To(Equal(8080))
+	})
+
+	It("should accept a raw signature at signature_url", func() {
+		objects["/config.json"] = []byte(`{"port": 8080}`)
+		objects["/signatures/config.json"] = ed25519.Sign(privateKey,
+			objects["/config.json"])
+		writeBootstrap(`remote_config:`,
+			`  url: `+server.URL+`/config.json`,
+			`  signature_url: `+server.URL+`/signatures/config.json`,
+			`  public_key: `+keyPath)
+		_, fetched, err := readConfig(bootstrapPath)
+		Expect(err).To(BeNil())
+		Expect(fetched).To(Equal(objects["/config.json"]))
+	})
+
+	It("should reject a configuration with an invalid signature", func() {
+		publish("/config.yaml", config)
+		objects["/config.yaml"] = []byte(string(config) + "gogc: 400\n")
+		writeBootstrap(`remote_config:`,
+			`  url: `+server.URL+`/config.yaml`,
+			`  public_key: `+keyPath)
+		_, _, err := readConfig(bootstrapPath)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("remote configuration signature " +
+			"verification failed: " + server.URL + "/config.yaml"))
+	})
+
+	It("should report a missing configuration or signature", func() {
+		objects["/config.yaml"] = config
+		writeBootstrap(`remote_config:`,
+			`  url: `+server.URL+`/config.yaml`,
+			`  public_key: `+keyPath)
+		_, _, err := readConfig(bootstrapPath)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("fetching " + server.URL +
+			"/config.yaml.sig returned 404"))
+	})
+
+	It("should sign requests for objects in an S3 bucket", func() {
+		publish("/configs/fleet/config.yaml", config)
+		os.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+		os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+		defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+		defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+		writeBootstrap(`remote_config:`,
+			`  url: s3://configs/fleet/config.yaml`,
+			`  endpoint: `+server.URL,
+			`  region: us-west-2`,
+			`  public_key: `+keyPath)
+		name, fetched, err := readConfig(bootstrapPath)
+		Expect(err).To(BeNil())
+		Expect(name).To(Equal("/configs/fleet/config.yaml"))
+		Expect(fetched).To(Equal(config))
+		Expect(authorization).To(MatchRegexp(
+			`^AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/\d{8}/us-west-2/` +
+				`s3/aws4_request, SignedHeaders=host;` +
+				`x-amz-content-sha256;x-amz-date, ` +
+				`Signature=[0-9a-f]{64}$`))
+	})
+
+	It("should validate the bootstrap configuration", func() {
+		writeBootstrap(`remote_config:`,
+			`  url: http://example.gov/config.yaml`,
+			`  endpoint: http://s3.example.gov`)
+		_, _, err := readConfig(bootstrapPath)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"remote_config url must begin with https:// or s3://: " +
+				"http://example.gov/config.yaml",
+			"remote_config public_key must be specified",
+			"remote_config endpoint must begin with https://: " +
+				"http://s3.example.gov",
+		})))
+
+		writeBootstrap(`port: 8080`, `remote_config:`,
+			`  url: https://example.gov/config.yaml`,
+			`  public_key: `+keyPath)
+		_, _, err = readConfig(bootstrapPath)
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal("remote_config must be the only " +
+			"option in a bootstrap configuration"))
+	})
+})
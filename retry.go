@@ -0,0 +1,109 @@
+package authdelegate
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRequestIDHeader identifies the original request if an upstream sets
+// retry_window but not request_id_header. nginx sets it with
+// "proxy_set_header X-Request-Id $request_id;".
+const defaultRequestIDHeader = "X-Request-Id"
+
+// retryDeduplicator remembers an upstream's decisions by request ID for a
+// short window, so that retries of the same original request are answered
+// without querying the upstream again. A nil *retryDeduplicator remembers
+// nothing.
+type retryDeduplicator struct {
+	header string
+	window time.Duration
+
+	// Guards the following fields
+	mutex        sync.Mutex
+	decisions    map[string]cachedDecision
+	deduplicated int64
+
+	// Removes each decision once its window has passed
+	expiries *expiryQueue
+}
+
+func newRetryDeduplicator(upstream *AuthDelegateUpstream) *retryDeduplicator {
+	if upstream.retryWindow == 0 {
+		return nil
+	}
+	header := upstream.RequestIDHeader
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	return &retryDeduplicator{
+		header:    http.CanonicalHeaderKey(header),
+		window:    upstream.retryWindow,
+		decisions: make(map[string]cachedDecision),
+		expiries:  newExpiryQueue(),
+	}
+}
+
+// key returns the key under which the decision for req, whose credential has
+// hash (which may be empty), is remembered, or the empty string if req has no
+// request ID. Since clients can send a request ID of their choosing unless the
+// proxy overwrites it, the original method, host, and URI and the hash are
+// included, so that a request ID reused for another request or with another
+// credential is never answered with the first one's decision.
+func (dedup *retryDeduplicator) key(req *http.Request, hash string) string {
+	if dedup == nil {
+		return ""
+	}
+	id, _ := headerValue(req.Header, dedup.header)
+	if id == "" {
+		return ""
+	}
+	return strings.Join([]string{id, originalMethod(req), requestHost(req),
+		originalURI(req), hash}, "\x00")
+}
+
+// get returns the decision remembered under key, or nil if there is none or
+// it has expired.
+func (dedup *retryDeduplicator) get(key string) *cachedDecision {
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	dedup.expire(time.Now())
+	decision, ok := dedup.decisions[key]
+	if !ok {
+		return nil
+	}
+	dedup.deduplicated++
+	return &decision
+}
+
+// put remembers the decision captured by recorder under key, unless it is a
+// failure, which a retry should be allowed to resolve.
+func (dedup *retryDeduplicator) put(key string, recorder *cacheRecorder) {
+	decision := recorder.decision
+	if !decision.allowed() && !decision.denied() {
+		return
+	}
+	now := time.Now()
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	dedup.expire(now)
+	dedup.decisions[key] = decision
+	dedup.expiries.set(key, now.Add(dedup.window))
+}
+
+// expire forgets the decisions whose window has passed by now. The caller
+// must hold dedup.mutex.
+func (dedup *retryDeduplicator) expire(now time.Time) {
+	dedup.expiries.expire(now, func(key string) {
+		delete(dedup.decisions, key)
+	})
+}
+
+// deduplicatedCount returns the number of retries answered with a remembered
+// decision.
+func (dedup *retryDeduplicator) deduplicatedCount() int64 {
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	return dedup.deduplicated
+}
@@ -0,0 +1,162 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Retry de-duplication", func() {
+	var upstream *httptest.Server
+	var requests int32
+	var status int
+	var opts *AuthDelegateOptions
+	var handler http.Handler
+
+	BeforeEach(func() {
+		requests = 0
+		status = http.StatusAccepted
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				rw.Header().Set("X-User", "user@example.gov")
+				rw.WriteHeader(status)
+			}))
+		opts = &AuthDelegateOptions{
+			Port:        8080,
+			MetricsPath: "/metrics",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:        "sso",
+					URL:         upstream.URL,
+					CookieName:  "_session",
+					RetryWindow: "1m",
+				},
+			},
+		}
+		handler = nil
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorizeURI := func(header, id, session,
+		uri string) *httptest.ResponseRecorder {
+		if handler == nil {
+			Expect(opts.Validate()).To(BeNil())
+			handler = NewAuthDelegate(opts)
+		}
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", uri)
+		if id != "" {
+			req.Header.Set(header, id)
+		}
+		req.AddCookie(&http.Cookie{Name: "_session", Value: session})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	authorize := func(header, id, session string) *httptest.ResponseRecorder {
+		return authorizeURI(header, id, session, "/")
+	}
+
+	It("should answer retries of a request with its decision", func() {
+		authorize("X-Request-Id", "req-1", "user")
+		recorder := authorize("X-Request-Id", "req-1", "user")
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(recorder.Header().Get("X-User")).To(
+			Equal("user@example.gov"))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+
+		authorize("X-Request-Id", "req-2", "user")
+		authorize("X-Request-Id", "req-1", "other")
+		authorize("X-Request-Id", "", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(4)))
+		authorizeURI("X-Request-Id", "req-1", "user", "/admin")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(5)))
+
+		req, _ := http.NewRequest("GET", "http://delegate/metrics", nil)
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(strings.Split(recorder.Body.String(), "\n")).To(
+			ContainElement("authdelegate_upstream_retries_deduplicated_" +
+				`total{upstream="sso"} 1`))
+	})
+
+	It("should remember denials but not failures", func() {
+		status = http.StatusUnauthorized
+		authorize("X-Request-Id", "req-1", "user")
+		Expect(authorize("X-Request-Id", "req-1", "user").Code).To(
+			Equal(http.StatusUnauthorized))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+
+		status = http.StatusServiceUnavailable
+		authorize("X-Request-Id", "req-2", "user")
+		authorize("X-Request-Id", "req-2", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+	})
+
+	It("should forget decisions after the window", func() {
+		opts.Upstreams[0].RetryWindow = "50ms"
+		authorize("X-Request-Id", "req-1", "user")
+		time.Sleep(60 * time.Millisecond)
+		authorize("X-Request-Id", "req-1", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+	})
+
+	It("should drop expired decisions when remembering another", func() {
+		dedup := &retryDeduplicator{
+			window:    10 * time.Millisecond,
+			decisions: make(map[string]cachedDecision),
+			expiries:  newExpiryQueue(),
+		}
+		recorder := &cacheRecorder{
+			decision: cachedDecision{Status: http.StatusAccepted},
+		}
+		dedup.put("req-1", recorder)
+		dedup.put("req-2", recorder)
+		Expect(dedup.decisions).To(HaveLen(2))
+		time.Sleep(15 * time.Millisecond)
+		dedup.put("req-3", recorder)
+		Expect(dedup.decisions).To(HaveLen(1))
+		Expect(dedup.decisions).To(HaveKey("req-3"))
+		Expect(dedup.get("req-1")).To(BeNil())
+		Expect(dedup.get("req-3")).ToNot(BeNil())
+	})
+
+	It("should read the request ID from the configured header", func() {
+		opts.Upstreams[0].RequestIDHeader = "X-Nginx-Request"
+		authorize("X-Request-Id", "req-1", "user")
+		authorize("X-Request-Id", "req-1", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+		authorize("X-Nginx-Request", "req-1", "user")
+		authorize("X-Nginx-Request", "req-1", "user")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams = append(opts.Upstreams, &AuthDelegateUpstream{
+			URL:             "http://localhost:8081",
+			HeaderName:      "Authorization",
+			RetryWindow:     "0s",
+			RequestIDHeader: "X-Request-Id",
+		}, &AuthDelegateUpstream{
+			URL:             "http://localhost:8082",
+			HeaderName:      "X-Api-Key",
+			RequestIDHeader: "X-Request-Id",
+		})
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"retry_window must be positive: http://localhost:8081",
+			"request_id_header requires retry_window: " +
+				"http://localhost:8082",
+		})))
+	})
+})
@@ -0,0 +1,156 @@
+package authdelegate
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Values of the retry_on option of an upstream's retry_policy
+const (
+	// The request couldn't be sent, or no response was received
+	retryOnConnectionErrors = "connection_errors"
+
+	// The upstream returned a 5xx status
+	retryOnServerErrors = "5xx"
+)
+
+// Defaults of an upstream's retry_policy options
+const (
+	defaultRetryMaxAttempts = 3
+	defaultRetryBackoff     = 25 * time.Millisecond
+	defaultRetryMaxBackoff  = time.Second
+)
+
+// retryPolicy resends requests to an upstream that fail transiently. Auth
+// checks don't change anything, so they are safe to repeat whatever their
+// method, provided their body, if any, can be sent again. Each retry goes to
+// the replica chosen for it, which may differ from the last, and waits for a
+// randomized, exponentially increasing backoff first. The upstream's timeout
+// covers every attempt.
+type retryPolicy struct {
+	maxAttempts      int
+	backoff          time.Duration
+	maxBackoff       time.Duration
+	connectionErrors bool
+	serverErrors     bool
+	replicas         *replicaSet
+
+	// Accessed atomically
+	retried int64
+}
+
+// newRetryPolicy returns nil if upstream doesn't define a retry_policy.
+func newRetryPolicy(upstream *AuthDelegateUpstream,
+	replicas *replicaSet) *retryPolicy {
+	config := upstream.RetryPolicy
+	if config == nil {
+		return nil
+	}
+	policy := &retryPolicy{
+		maxAttempts: config.MaxAttempts,
+		backoff:     config.backoff,
+		maxBackoff:  config.maxBackoff,
+		replicas:    replicas,
+	}
+	for _, condition := range config.RetryOn {
+		switch condition {
+		case retryOnConnectionErrors:
+			policy.connectionErrors = true
+		case retryOnServerErrors:
+			policy.serverErrors = true
+		}
+	}
+	return policy
+}
+
+// wrap returns transport unchanged if policy is nil.
+func (policy *retryPolicy) wrap(
+	transport http.RoundTripper) http.RoundTripper {
+	if policy == nil {
+		return transport
+	}
+	return &retryTransport{transport, policy}
+}
+
+func (policy *retryPolicy) retriedCount() int64 {
+	return atomic.LoadInt64(&policy.retried)
+}
+
+// shouldRetry returns true if the result of an attempt warrants another.
+func (policy *retryPolicy) shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return policy.connectionErrors
+	}
+	return policy.serverErrors &&
+		res.StatusCode >= http.StatusInternalServerError
+}
+
+// delay returns the backoff before the retry following attempt, counting
+// from 1: a random duration between half and all of the backoff, which
+// doubles with each attempt up to maxBackoff.
+func (policy *retryPolicy) delay(attempt int) time.Duration {
+	backoff := policy.backoff
+	for i := 1; i < attempt && backoff < policy.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+type retryTransport struct {
+	http.RoundTripper
+	policy *retryPolicy
+}
+
+func (transport *retryTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	policy := transport.policy
+	replayable := req.Body == nil || req.Body == http.NoBody ||
+		req.GetBody != nil
+	for attempt := 1; ; attempt++ {
+		res, err := transport.RoundTripper.RoundTrip(req)
+		if attempt == policy.maxAttempts || !replayable ||
+			!policy.shouldRetry(res, err) {
+			return res, err
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		timer := time.NewTimer(policy.delay(attempt))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		if req, err = transport.nextAttempt(req); err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&policy.retried, 1)
+	}
+}
+
+// nextAttempt returns a copy of req to send to the replica chosen for the
+// next attempt, with a fresh copy of its body.
+func (transport *retryTransport) nextAttempt(
+	req *http.Request) (*http.Request, error) {
+	next := req.WithContext(req.Context())
+	if transport.policy.replicas != nil {
+		next.URL = transport.policy.replicas.target()
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+	return next, nil
+}
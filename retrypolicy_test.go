@@ -0,0 +1,122 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+var _ = Describe("Retry policies", func() {
+	var server, down *httptest.Server
+	var requests, failures int32
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, 0)
+		server = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if atomic.AddInt32(&requests, 1) <=
+					atomic.LoadInt32(&failures) {
+					rw.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		down = httptest.NewServer(http.NotFoundHandler())
+		down.Close()
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL: server.URL,
+					RetryPolicy: &AuthDelegateRetryPolicy{
+						Backoff: "1ms",
+					},
+				},
+			},
+			MetricsPath: "/metrics",
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serve := func(handler http.Handler,
+		path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate"+path, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should retry connection errors on another replica", func() {
+		opts.Upstreams[0].URL = down.URL
+		opts.Upstreams[0].ReplicaURLs = []string{server.URL}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(serve(handler, "/").Code).To(Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+		Expect(serve(handler, "/metrics").Body.String()).To(
+			ContainSubstring(`authdelegate_upstream_retries_total{` +
+				`upstream="` + down.URL + `"} 1`))
+	})
+
+	It("should retry 5xx responses only if configured to", func() {
+		atomic.StoreInt32(&failures, 1)
+		Expect(opts.Validate()).To(BeNil())
+		Expect(serve(NewAuthDelegate(opts), "/").Code).To(
+			Equal(http.StatusBadGateway))
+
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&failures, 2)
+		opts.Upstreams[0].RetryPolicy.RetryOn = []string{"5xx"}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(serve(NewAuthDelegate(opts), "/").Code).To(
+			Equal(http.StatusAccepted))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+	})
+
+	It("should stop after max_attempts", func() {
+		atomic.StoreInt32(&failures, 10)
+		opts.Upstreams[0].RetryPolicy.RetryOn = []string{"5xx"}
+		opts.Upstreams[0].RetryPolicy.MaxAttempts = 2
+		Expect(opts.Validate()).To(BeNil())
+		Expect(serve(NewAuthDelegate(opts), "/").Code).To(
+			Equal(http.StatusBadGateway))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+	})
+
+	It("should increase the backoff up to max_backoff", func() {
+		policy := &retryPolicy{
+			backoff: 100, maxBackoff: 300,
+		}
+		for i, limit := range []time.Duration{100, 200, 300, 300} {
+			delay := policy.delay(i + 1)
+			Expect(delay).To(BeNumerically(">=", limit/2))
+			Expect(delay).To(BeNumerically("<=", limit))
+		}
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams[0].RetryPolicy = &AuthDelegateRetryPolicy{
+			MaxAttempts: -1,
+			Backoff:     "2s",
+			RetryOn:     []string{"timeouts"},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"retry_policy max_attempts must be positive: " +
+				server.URL,
+			"retry_policy max_backoff must not be less than " +
+				"backoff: " + server.URL,
+			"retry_policy retry_on must be connection_errors or " +
+				"5xx for " + server.URL + ": timeouts",
+		})))
+	})
+})
@@ -0,0 +1,153 @@
+package authdelegate
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// revocationPrefix begins the Storage key of each revoked credential hash.
+const revocationPrefix = "revoked:"
+
+// revocationVersionKey is the Storage key whose value changes with every
+// revocation or reinstatement, so that delegates sharing storage need only
+// read it to learn whether to reload the list.
+const revocationVersionKey = "revocations:version"
+
+// revocationRefreshInterval is how often the list is reloaded, if it has
+// changed, from storage shared with other delegates.
+const revocationRefreshInterval = time.Second
+
+// revocationList contains the hashes of credentials that are denied without
+// consulting an upstream, as computed by hashCredential. The list is held in
+// memory so that checking it doesn't contact the storage backend, and changes
+// are written through to storage.
+type revocationList struct {
+	storage Storage
+
+	mutex  sync.RWMutex
+	hashes map[string]bool
+
+	// Whether the list has been loaded from storage, and the value of
+	// revocationVersionKey, if any, at the time
+	loaded  bool
+	version string
+
+	// Accessed atomically; allows the common case of an empty list to
+	// skip hashing credentials
+	size int64
+}
+
+// newRevocationList loads the revocations previously written to storage. If
+// it fails, the error is logged and the list starts empty.
+func newRevocationList(storage Storage) *revocationList {
+	list := &revocationList{
+		storage: storage,
+		hashes:  make(map[string]bool),
+	}
+	if err := list.load(); err != nil {
+		log.Printf("revocations: failed to load from storage: %s", err)
+	}
+	return list
+}
+
+// load replaces the list with the revocations in storage, unless
+// revocationVersionKey is unchanged since the list was last loaded.
+func (list *revocationList) load() error {
+	version, _, err := list.storage.Get(revocationVersionKey)
+	if err != nil {
+		return err
+	}
+	list.mutex.RLock()
+	unchanged := list.loaded && list.version == string(version)
+	list.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+	keys, err := list.storage.Keys(revocationPrefix)
+	if err != nil {
+		return err
+	}
+	hashes := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		hashes[strings.TrimPrefix(key, revocationPrefix)] = true
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.hashes = hashes
+	list.loaded = true
+	list.version = string(version)
+	atomic.StoreInt64(&list.size, int64(len(list.hashes)))
+	return nil
+}
+
+// refresh reloads the list every interval, so that revocations made through
+// other delegates sharing storage take effect without a restart.
+func (list *revocationList) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := list.load(); err != nil {
+			log.Printf("revocations: failed to refresh from "+
+				"storage: %s", err)
+		}
+	}
+}
+
+func (list *revocationList) any() bool {
+	return atomic.LoadInt64(&list.size) != 0
+}
+
+func (list *revocationList) isRevoked(hash string) bool {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	return list.hashes[hash]
+}
+
+// revoke takes effect immediately even if it returns an error, which
+// indicates that the revocation could not be written to storage.
+func (list *revocationList) revoke(hash string) error {
+	list.mutex.Lock()
+	list.hashes[hash] = true
+	atomic.StoreInt64(&list.size, int64(len(list.hashes)))
+	list.mutex.Unlock()
+	if err := list.storage.Set(revocationPrefix+hash, []byte{},
+		0); err != nil {
+		return err
+	}
+	return list.changed()
+}
+
+// reinstate takes effect immediately even if it returns an error, which
+// indicates that the revocation could not be removed from storage.
+func (list *revocationList) reinstate(hash string) error {
+	list.mutex.Lock()
+	delete(list.hashes, hash)
+	atomic.StoreInt64(&list.size, int64(len(list.hashes)))
+	list.mutex.Unlock()
+	if err := list.storage.Delete(revocationPrefix + hash); err != nil {
+		return err
+	}
+	return list.changed()
+}
+
+// changed updates revocationVersionKey, so that other delegates sharing
+// storage reload the list. The list itself is reloaded at its next refresh,
+// which picks up any concurrent change made through another delegate.
+func (list *revocationList) changed() error {
+	return list.storage.Set(revocationVersionKey,
+		[]byte(strconv.FormatInt(time.Now().UnixNano(), 10)), 0)
+}
+
+func (list *revocationList) list() []string {
+	list.mutex.RLock()
+	defer list.mutex.RUnlock()
+	hashes := []string{}
+	for hash := range list.hashes {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
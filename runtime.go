@@ -0,0 +1,169 @@
+package authdelegate
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cgroupRoot is where the cgroup filesystem is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// memoryLimitFraction is the fraction of a cgroup memory limit to use as the
+// Go runtime's soft memory limit, leaving headroom for non-heap memory.
+const memoryLimitFraction = 0.9
+
+// applyRuntimeSettings sets GOMAXPROCS from opts, if specified, leaving the
+// runtime to derive it from the container's cgroup CPU limit, and to update
+// it as that changes, otherwise. Sets the soft memory limit from, in order of
+// precedence: opts, the GOMEMLIMIT environment variable, or the container's
+// cgroup memory limit. Sets the GC target percentage from opts, if
+// specified. Logs the effective values and their sources.
+func applyRuntimeSettings(opts *AuthDelegateOptions, root string) {
+	procsSource := "cgroup"
+	if opts.GoMaxProcs > 0 {
+		runtime.GOMAXPROCS(opts.GoMaxProcs)
+		procsSource = "config"
+	} else if os.Getenv("GOMAXPROCS") != "" {
+		procsSource = "environment"
+	}
+
+	limit, limitSource := opts.goMemLimit, "config"
+	if limit == 0 {
+		limitSource = "environment"
+		if os.Getenv("GOMEMLIMIT") == "" {
+			limit, limitSource = cgroupMemoryLimit(root), "cgroup"
+		}
+	}
+	if limit > 0 {
+		debug.SetMemoryLimit(limit)
+	} else {
+		limitSource = "default"
+	}
+
+	if opts.GoGC != nil {
+		debug.SetGCPercent(*opts.GoGC)
+	}
+
+	log.Printf("runtime: GOMAXPROCS %d (%s), GOMEMLIMIT %d bytes (%s), "+
+		"GOGC %d", runtime.GOMAXPROCS(0), procsSource,
+		debug.SetMemoryLimit(-1), limitSource, currentGCPercent())
+}
+
+// currentGCPercent returns the GC target percentage, which is negative if
+// garbage collection is disabled.
+func currentGCPercent() int {
+	sample := []metrics.Sample{{Name: "/gc/gogc:percent"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 100
+	}
+	// The runtime stores an "off" GOGC as a negative value, which the
+	// metric reports as its unsigned conversion.
+	return int(int32(sample[0].Value.Uint64()))
+}
+
+type gcPauses struct {
+	Min int64 `json:"min"`
+	P25 int64 `json:"p25"`
+	P50 int64 `json:"p50"`
+	P75 int64 `json:"p75"`
+	Max int64 `json:"max"`
+}
+
+type gcInfo struct {
+	GCPercent int    `json:"gc_percent"`
+	NumGC     int64  `json:"num_gc"`
+	LastGC    string `json:"last_gc,omitempty"`
+
+	// All durations are in nanoseconds.
+	PauseTotal int64 `json:"pause_total_ns"`
+
+	// Quantiles of the most recent pauses retained by the runtime
+	RecentPauses gcPauses `json:"recent_pauses_ns"`
+}
+
+func currentGCInfo() gcInfo {
+	stats := debug.GCStats{PauseQuantiles: make([]time.Duration, 5)}
+	debug.ReadGCStats(&stats)
+	info := gcInfo{
+		GCPercent:  currentGCPercent(),
+		NumGC:      stats.NumGC,
+		PauseTotal: int64(stats.PauseTotal),
+	}
+	if stats.NumGC != 0 {
+		q := stats.PauseQuantiles
+		info.LastGC = stats.LastGC.Format(time.RFC3339Nano)
+		info.RecentPauses = gcPauses{int64(q[0]), int64(q[1]),
+			int64(q[2]), int64(q[3]), int64(q[4])}
+	}
+	return info
+}
+
+func serveGCInfo(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, currentGCInfo())
+}
+
+// cgroupMemoryLimit returns memoryLimitFraction of the cgroup memory limit,
+// or zero if there is no limit.
+func cgroupMemoryLimit(root string) int64 {
+	limit := readCgroupNumber(root, "memory.max")
+	if limit == 0 {
+		limit = readCgroupNumber(root, "memory/memory.limit_in_bytes")
+	}
+	// cgroup v1 reports "no limit" as a value near math.MaxInt64.
+	if limit <= 0 || limit >= math.MaxInt64/2 {
+		return 0
+	}
+	return int64(limit * memoryLimitFraction)
+}
+
+func readCgroupFields(root, path string) []string {
+	content, err := ioutil.ReadFile(filepath.Join(root, path))
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(content))
+}
+
+// readCgroupNumber returns zero if the file is missing or doesn't contain a
+// number, e.g. "max".
+func readCgroupNumber(root, path string) float64 {
+	fields := readCgroupFields(root, path)
+	if len(fields) != 1 {
+		return 0
+	}
+	value, _ := strconv.ParseFloat(fields[0], 64)
+	return value
+}
+
+// parseByteSize parses a size using the same syntax as GOMEMLIMIT: a number
+// of bytes with an optional B, KiB, MiB, GiB, or TiB suffix.
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	for i, suffix := range []string{"TiB", "GiB", "MiB", "KiB", "B"} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSuffix(value, suffix)
+			multiplier = int64(1) << uint(10*(4-i))
+			break
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("invalid size")
+	}
+	if size > math.MaxInt64/multiplier {
+		return 0, errors.New("size too large")
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,109 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+)
+
+var _ = Describe("Runtime settings", func() {
+	var root string
+
+	BeforeEach(func() {
+		root, _ = ioutil.TempDir("", "authdelegate-cgroup-test")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+
+	writeFile := func(path, content string) {
+		path = filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		ioutil.WriteFile(path, []byte(content), 0600)
+	}
+
+	It("should find no limits without a cgroup filesystem", func() {
+		Expect(cgroupMemoryLimit(root)).To(Equal(int64(0)))
+	})
+
+	It("should read cgroup v2 limits", func() {
+		writeFile("memory.max", "1000000\n")
+		Expect(cgroupMemoryLimit(root)).To(Equal(int64(900000)))
+	})
+
+	It("should read unlimited cgroup v2 limits", func() {
+		writeFile("memory.max", "max\n")
+		Expect(cgroupMemoryLimit(root)).To(Equal(int64(0)))
+	})
+
+	It("should read cgroup v1 limits", func() {
+		writeFile("memory/memory.limit_in_bytes", "2000000\n")
+		Expect(cgroupMemoryLimit(root)).To(Equal(int64(1800000)))
+	})
+
+	It("should read unlimited cgroup v1 limits", func() {
+		writeFile("memory/memory.limit_in_bytes",
+			"9223372036854771712\n")
+		Expect(cgroupMemoryLimit(root)).To(Equal(int64(0)))
+	})
+
+	It("should parse sizes like GOMEMLIMIT", func() {
+		for value, expected := range map[string]int64{
+			"1024":   1024,
+			"512B":   512,
+			"2KiB":   2048,
+			"512MiB": 512 << 20,
+			"1GiB":   1 << 30,
+			"1TiB":   1 << 40,
+		} {
+			size, err := parseByteSize(value)
+			Expect(err).To(BeNil())
+			Expect(size).To(Equal(expected))
+		}
+		_, err := parseByteSize("1GB")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should report GC statistics", func() {
+		runtime.GC()
+		info := currentGCInfo()
+		Expect(info.GCPercent).To(Equal(currentGCPercent()))
+		Expect(info.NumGC).To(BeNumerically(">", 0))
+		Expect(info.LastGC).ToNot(BeEmpty())
+		Expect(info.RecentPauses.Max).To(BeNumerically(">=",
+			info.RecentPauses.Min))
+	})
+
+	It("should apply a gogc of zero", func() {
+		opts, err := NewAuthDelegateOptionsFromYAML([]byte(
+			"port: 8080\ngogc: 0\nupstreams:\n" +
+				"  - url: http://127.0.0.1/\n"))
+		Expect(err).To(BeNil())
+		previous := debug.SetGCPercent(100)
+		defer debug.SetGCPercent(previous)
+		applyRuntimeSettings(opts, root)
+		Expect(currentGCPercent()).To(Equal(0))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts := &AuthDelegateOptions{
+			Port:       8080,
+			GoMaxProcs: -1,
+			GoMemLimit: "lots",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: "http://127.0.0.1/"},
+			},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"gomaxprocs must not be negative",
+			"invalid gomemlimit: lots",
+		})))
+	})
+})
@@ -0,0 +1,154 @@
+package authdelegate
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	scheduleIdle      = "idle"
+	schedulePending   = "pending"
+	scheduleActivated = "activated"
+)
+
+// configScheduler activates a validated routing table at a scheduled time.
+// If a revert window is specified, the previous routing table is restored
+// when the window expires unless the new one is confirmed first.
+type configScheduler struct {
+	delegate *authDelegateHandler
+
+	mutex       sync.Mutex
+	status      scheduleStatus
+	revertAfter time.Duration
+	pending     *routingTable
+	previous    *routingTable
+	timer       *time.Timer
+
+	// Incremented whenever the timer is replaced, so that a callback
+	// from a stopped timer may recognize that it is stale
+	generation int
+}
+
+type scheduleStatus struct {
+	State      string `json:"state"`
+	ActivateAt string `json:"activate_at,omitempty"`
+	RevertAt   string `json:"revert_at,omitempty"`
+}
+
+func newConfigScheduler(delegate *authDelegateHandler) *configScheduler {
+	return &configScheduler{
+		delegate: delegate,
+		status:   scheduleStatus{State: scheduleIdle},
+	}
+}
+
+func (scheduler *configScheduler) getStatus() scheduleStatus {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	return scheduler.status
+}
+
+// schedule arranges for table to replace the current routing table at
+// activateAt. If revertAfter is nonzero, the current routing table will be
+// restored revertAfter the activation unless confirm is called. Replaces any
+// pending schedule, but fails if a previously scheduled table has been
+// activated but not yet confirmed.
+func (scheduler *configScheduler) schedule(table *routingTable,
+	activateAt time.Time, revertAfter time.Duration) error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.status.State == scheduleActivated {
+		return errors.New("activated configuration awaiting " +
+			"confirmation or revert")
+	}
+	scheduler.pending = table
+	scheduler.revertAfter = revertAfter
+	scheduler.status = scheduleStatus{
+		State:      schedulePending,
+		ActivateAt: activateAt.Format(time.RFC3339),
+	}
+	scheduler.resetTimer(activateAt.Sub(time.Now()), scheduler.activate)
+	log.Printf("config: scheduled activation at %s",
+		scheduler.status.ActivateAt)
+	return nil
+}
+
+// cancel discards a pending schedule that has not yet been activated.
+func (scheduler *configScheduler) cancel() error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.status.State != schedulePending {
+		return errors.New("no configuration pending activation")
+	}
+	scheduler.stopTimer()
+	scheduler.pending = nil
+	scheduler.status = scheduleStatus{State: scheduleIdle}
+	log.Printf("config: scheduled activation canceled")
+	return nil
+}
+
+// confirm keeps an activated routing table in effect, canceling its revert.
+func (scheduler *configScheduler) confirm() error {
+	scheduler.mutex.Lock()
+	defer scheduler.mutex.Unlock()
+	if scheduler.status.State != scheduleActivated {
+		return errors.New("no activated configuration awaiting " +
+			"confirmation")
+	}
+	scheduler.stopTimer()
+	scheduler.previous = nil
+	scheduler.status = scheduleStatus{State: scheduleIdle}
+	log.Printf("config: activated configuration confirmed")
+	return nil
+}
+
+func (scheduler *configScheduler) activate() {
+	scheduler.previous = scheduler.delegate.swapRoutes(scheduler.pending)
+	scheduler.pending = nil
+	log.Printf("config: scheduled configuration activated")
+
+	if scheduler.revertAfter == 0 {
+		scheduler.previous = nil
+		scheduler.status = scheduleStatus{State: scheduleIdle}
+		return
+	}
+	revertAt := time.Now().Add(scheduler.revertAfter)
+	scheduler.status.State = scheduleActivated
+	scheduler.status.RevertAt = revertAt.Format(time.RFC3339)
+	scheduler.resetTimer(scheduler.revertAfter, scheduler.revert)
+	log.Printf("config: will revert at %s unless confirmed",
+		scheduler.status.RevertAt)
+}
+
+func (scheduler *configScheduler) revert() {
+	scheduler.delegate.swapRoutes(scheduler.previous)
+	scheduler.previous = nil
+	scheduler.status = scheduleStatus{State: scheduleIdle}
+	log.Printf("config: activated configuration not confirmed; reverted")
+}
+
+// resetTimer must be called with scheduler.mutex held. action will also be
+// invoked with scheduler.mutex held.
+func (scheduler *configScheduler) resetTimer(
+	delay time.Duration, action func()) {
+	scheduler.stopTimer()
+	generation := scheduler.generation
+	scheduler.timer = time.AfterFunc(delay, func() {
+		scheduler.mutex.Lock()
+		defer scheduler.mutex.Unlock()
+		if generation == scheduler.generation {
+			action()
+		}
+	})
+}
+
+// stopTimer must be called with scheduler.mutex held.
+func (scheduler *configScheduler) stopTimer() {
+	if scheduler.timer != nil {
+		scheduler.timer.Stop()
+		scheduler.timer = nil
+	}
+	scheduler.generation++
+}
@@ -0,0 +1,135 @@
+package authdelegate
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Scheduled configuration activation", func() {
+	var delegate *authDelegateHandler
+	var scheduler *configScheduler
+	var current, candidate *routingTable
+
+	BeforeEach(func() {
+		delegate = NewAuthDelegate(&AuthDelegateOptions{}).(*authDelegateHandler)
+		current = delegate.routes()
+		candidate = &routingTable{}
+		scheduler = newConfigScheduler(delegate)
+	})
+
+	state := func() string {
+		return scheduler.getStatus().State
+	}
+
+	It("should activate a configuration at the scheduled time", func() {
+		Expect(scheduler.schedule(candidate,
+			time.Now().Add(20*time.Millisecond), 0)).To(BeNil())
+		Expect(state()).To(Equal(schedulePending))
+		Expect(delegate.routes()).To(BeIdenticalTo(current))
+		Eventually(delegate.routes).Should(BeIdenticalTo(candidate))
+		Expect(state()).To(Equal(scheduleIdle))
+	})
+
+	It("should not activate a canceled configuration", func() {
+		Expect(scheduler.schedule(candidate,
+			time.Now().Add(20*time.Millisecond), 0)).To(BeNil())
+		Expect(scheduler.cancel()).To(BeNil())
+		Consistently(delegate.routes, "50ms").Should(
+			BeIdenticalTo(current))
+		Expect(state()).To(Equal(scheduleIdle))
+	})
+
+	It("should revert an unconfirmed configuration", func() {
+		Expect(scheduler.schedule(candidate, time.Now(),
+			30*time.Millisecond)).To(BeNil())
+		Eventually(delegate.routes).Should(BeIdenticalTo(candidate))
+		Expect(state()).To(Equal(scheduleActivated))
+		Expect(scheduler.schedule(candidate, time.Now(), 0)).ToNot(BeNil())
+		Eventually(delegate.routes).Should(BeIdenticalTo(current))
+		Expect(state()).To(Equal(scheduleIdle))
+	})
+
+	It("should keep a confirmed configuration", func() {
+		Expect(scheduler.schedule(candidate, time.Now(),
+			30*time.Millisecond)).To(BeNil())
+		Eventually(state).Should(Equal(scheduleActivated))
+		Expect(scheduler.confirm()).To(BeNil())
+		Consistently(delegate.routes, "60ms").Should(
+			BeIdenticalTo(candidate))
+	})
+
+	It("should not confirm or cancel when nothing is scheduled", func() {
+		Expect(scheduler.confirm()).ToNot(BeNil())
+		Expect(scheduler.cancel()).ToNot(BeNil())
+	})
+
+	It("should reject an invalid configuration via the admin API", func() {
+		admin := NewAdminHandler(delegate)
+		req, _ := http.NewRequest("POST", "/config/schedule?activate_at="+
+			time.Now().Format(time.RFC3339),
+			bytes.NewBufferString(`{"port": 0}`))
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(HavePrefix("Invalid options:"))
+	})
+
+	It("should parse YAML with the profile via the admin API", func() {
+		var handled bool
+		delegate = NewAuthDelegate(&AuthDelegateOptions{
+			ErrorHandler: func(rw http.ResponseWriter,
+				req *http.Request, err error) {
+				handled = true
+			},
+		}).(*authDelegateHandler)
+		admin := newAdminHandler(delegate, "production")
+		req, _ := http.NewRequest("POST",
+			"/config/schedule?activate_at="+
+				time.Now().Format(time.RFC3339),
+			bytes.NewBufferString("port: 8080\n"+
+				"upstreams:\n"+
+				"- {name: sso, url: 'http://localhost:8081'}\n"+
+				"profiles:\n"+
+				"  production:\n"+
+				"    upstreams:\n"+
+				"    - name: prod\n"+
+				"      url: 'http://localhost:8082'\n"))
+		req.Header.Set("Content-Type", "application/yaml")
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Eventually(func() []*authDelegate {
+			return delegate.routes().upstreams
+		}).Should(HaveLen(1))
+		Expect(delegate.routes().upstreams[0].name).To(Equal("prod"))
+		delegate.routes().errorHandler(httptest.NewRecorder(), req,
+			ErrNoUpstreamMatch)
+		Expect(handled).To(BeTrue())
+	})
+
+	It("should reject a configuration that is too large", func() {
+		admin := NewAdminHandler(delegate)
+		req, _ := http.NewRequest("POST",
+			"/config/schedule?activate_at="+
+				time.Now().Format(time.RFC3339),
+			bytes.NewReader(make([]byte, maxAdminConfig+1)))
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+
+	It("should require activate_at via the admin API", func() {
+		admin := NewAdminHandler(delegate)
+		req, _ := http.NewRequest("POST", "/config/schedule",
+			bytes.NewBufferString(`{}`))
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(HavePrefix(
+			"invalid activate_at: "))
+	})
+})
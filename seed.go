@@ -0,0 +1,93 @@
+package authdelegate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cacheSeedTimeout bounds the request to each upstream's cache_seed_url.
+const cacheSeedTimeout = 10 * time.Second
+
+// cacheSeed is the response expected from a cache_seed_url: the sessions an
+// upstream would currently allow.
+type cacheSeed struct {
+	Sessions []seedSession `json:"sessions"`
+}
+
+type seedSession struct {
+	// Hex-encoded SHA-256 digest of the session's header or cookie value,
+	// so that the seed endpoint needn't disclose credentials
+	CredentialHash string `json:"credential_hash"`
+
+	// Status to return for the session; defaults to 200, and must be 2xx
+	Status int `json:"status"`
+
+	// Headers to return for the session, e.g. the user's identity
+	Header http.Header `json:"header"`
+}
+
+// seedCaches populates the decision cache of delegate, which must have been
+// created by NewAuthDelegate, from the cache_seed_url of each upstream in
+// opts. Failures are logged and otherwise ignored, since the cache will fill
+// as requests arrive.
+func seedCaches(delegate http.Handler, opts *AuthDelegateOptions) {
+	handler := delegate.(*authDelegateHandler)
+	for _, upstream := range opts.Upstreams {
+		if upstream.CacheSeedURL == "" {
+			continue
+		}
+		name := upstreamLabel(upstream)
+		if seeded, err := handler.seedCache(upstream); err != nil {
+			log.Printf("cache: failed to seed %s: %s", name, err)
+		} else {
+			log.Printf("cache: seeded %d decisions for %s", seeded, name)
+		}
+	}
+}
+
+func (handler *authDelegateHandler) seedCache(
+	upstream *AuthDelegateUpstream) (seeded int, err error) {
+	client := &http.Client{
+		Transport: newUpstreamTransport(upstream),
+		Timeout:   cacheSeedTimeout,
+	}
+	res, err := client.Get(upstream.CacheSeedURL)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.New("unexpected status: " + res.Status)
+	}
+	var seed cacheSeed
+	if err := json.NewDecoder(res.Body).Decode(&seed); err != nil {
+		return 0, fmt.Errorf("malformed response: %s", err)
+	}
+
+	name := upstreamLabel(upstream)
+	for _, session := range seed.Sessions {
+		hash := strings.ToLower(session.CredentialHash)
+		if digest, err := hex.DecodeString(hash); err != nil ||
+			len(digest) != sha256.Size {
+			continue
+		}
+		decision := &cachedDecision{
+			Status: session.Status, Header: session.Header,
+		}
+		if decision.Status == 0 {
+			decision.Status = http.StatusOK
+		}
+		if decision.allowed() {
+			handler.cache.put(name, hash, decision, upstream.cacheTTL)
+			seeded++
+		}
+	}
+	return seeded, nil
+}
@@ -0,0 +1,89 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Cache seeding", func() {
+	var seedServer *httptest.Server
+	var seedResponse string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		seedResponse = ""
+		seedServer = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/sessions" {
+					rw.WriteHeader(http.StatusForbidden)
+					return
+				}
+				rw.Write([]byte(seedResponse))
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:         "sso",
+					URL:          seedServer.URL,
+					CookieName:   "_session",
+					CacheTTL:     "1m",
+					CacheSeedURL: seedServer.URL + "/sessions",
+				},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		seedServer.Close()
+	})
+
+	It("should serve seeded sessions from the cache", func() {
+		seedResponse = `{"sessions": [
+			{"credential_hash": "` + hashCredential("alice") + `",
+			 "header": {"X-User": ["alice"]}},
+			{"credential_hash": "` + hashCredential("bob") + `",
+			 "status": 403},
+			{"credential_hash": "bogus"}
+		]}`
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		Expect(handler.seedCache(opts.Upstreams[0])).To(Equal(1))
+
+		req, _ := http.NewRequest("GET", "http://delegate/foo", nil)
+		req.AddCookie(&http.Cookie{Name: "_session", Value: "alice"})
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("X-User")).To(Equal("alice"))
+
+		// The seed server denies requests other than for /sessions.
+		req, _ = http.NewRequest("GET", "http://delegate/foo", nil)
+		req.AddCookie(&http.Cookie{Name: "_session", Value: "bob"})
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusForbidden))
+	})
+
+	It("should report a malformed seed response", func() {
+		seedResponse = "not JSON"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		_, err := handler.seedCache(opts.Upstreams[0])
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should fail validation without cache_ttl", func() {
+		opts.Upstreams[0].CacheTTL = ""
+		opts.Upstreams[0].CacheSeedURL = "ftp://sessions"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"cache_seed_url requires cache_ttl: " + seedServer.URL,
+			"invalid cache_seed_url for " + seedServer.URL +
+				": ftp://sessions",
+		})))
+	})
+})
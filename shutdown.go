@@ -0,0 +1,159 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultShutdownNotifyTimeout is how long to wait for the response to the
+// shutdown notification unless its timeout is specified.
+const defaultShutdownNotifyTimeout = 5 * time.Second
+
+// Phases of shutdown, in order, as reported by the authdelegate_shutdown_phase
+// metric
+const (
+	// Not shutting down
+	shutdownServing = iota
+
+	// Failing readiness checks and notifying the load balancer
+	shutdownDeregistering
+
+	// Waiting shutdown_delay for load balancers to stop sending requests
+	shutdownDelaying
+
+	// Listeners closed; waiting for requests in flight to complete
+	shutdownDraining
+)
+
+var shutdownPhases = []string{"serving", "deregistering", "delaying",
+	"draining"}
+
+func (handler *authDelegateHandler) setShutdownPhase(phase int32) {
+	atomic.StoreInt32(&handler.shutdownPhase, phase)
+}
+
+// shuttingDown returns true once shutdown has begun, after which readiness
+// checks fail.
+func (handler *authDelegateHandler) shuttingDown() bool {
+	return atomic.LoadInt32(&handler.shutdownPhase) != shutdownServing
+}
+
+// requestsInFlight returns the number of requests in flight to the upstreams
+// of the routing table in effect.
+func (handler *authDelegateHandler) requestsInFlight() (total int64) {
+	for _, upstream := range handler.routes().upstreams {
+		total += atomic.LoadInt64(&upstream.inFlight)
+	}
+	return
+}
+
+// deregister begins the shutdown of delegate, which must have been created by
+// NewAuthDelegate, while its listeners are still open: it fails readiness
+// checks, sends the shutdown notification defined by opts, if any, then
+// waits until shutdown_delay has passed since it began, so that load
+// balancers and peers stop sending requests before the listeners close.
+func deregister(delegate http.Handler, opts *AuthDelegateOptions) {
+	handler := delegate.(*authDelegateHandler)
+	start := time.Now()
+	handler.setShutdownPhase(shutdownDeregistering)
+	log.Printf("shutdown: failing readiness checks")
+	if opts.ShutdownNotify != nil {
+		notifyShutdown(opts.ShutdownNotify)
+	}
+	if remaining := opts.shutdownDelay - time.Since(start); remaining > 0 {
+		handler.setShutdownPhase(shutdownDelaying)
+		log.Printf("shutdown: waiting %s for load balancers to stop "+
+			"sending requests", remaining.Round(time.Millisecond))
+		time.Sleep(remaining)
+	}
+}
+
+// notifyShutdown sends the shutdown notification defined by config, e.g. to
+// deregister from a load balancer, logging the outcome.
+func notifyShutdown(config *AuthDelegateShutdownNotify) {
+	method := config.Method
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, config.URL,
+		strings.NewReader(config.Body))
+	if err != nil {
+		log.Printf("shutdown: failed to notify %s: %s", config.URL, err)
+		return
+	}
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{Timeout: config.timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		log.Printf("shutdown: failed to notify %s: %s", config.URL, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		log.Printf("shutdown: failed to notify %s: status %d",
+			config.URL, res.StatusCode)
+		return
+	}
+	log.Printf("shutdown: notified %s", config.URL)
+}
+
+// exitSummary describes what a delegate did during its lifetime, for
+// short-lived instances such as those in CI environments. Upstream counts
+// cover only the configuration in effect, since they restart from zero when
+// it is reloaded.
+type exitSummary struct {
+	UptimeSeconds float64           `json:"uptime_seconds"`
+	Requests      int64             `json:"requests"`
+	Rejected      int64             `json:"rejected"`
+	Upstreams     []upstreamSummary `json:"upstreams"`
+}
+
+type upstreamSummary struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Allowed  int64  `json:"allowed"`
+	Denied   int64  `json:"denied"`
+	Errors   int64  `json:"errors"`
+}
+
+func (handler *authDelegateHandler) exitSummary() *exitSummary {
+	rejections := handler.rejections.load()
+	summary := &exitSummary{
+		UptimeSeconds: time.Since(handler.started).Seconds(),
+		Requests:      atomic.LoadInt64(&handler.requests),
+		Rejected:      rejections.UserAgent + rejections.Path,
+		Upstreams:     []upstreamSummary{},
+	}
+	for _, upstream := range handler.routes().upstreams {
+		counts := upstreamSummary{
+			Name:    upstream.name,
+			Allowed: atomic.LoadInt64(&upstream.allowed),
+			Denied:  atomic.LoadInt64(&upstream.denied),
+			Errors:  atomic.LoadInt64(&upstream.failed),
+		}
+		counts.Requests = counts.Allowed + counts.Denied + counts.Errors
+		summary.Upstreams = append(summary.Upstreams, counts)
+	}
+	return summary
+}
+
+// logExitSummary logs the exitSummary of delegate, which must have been
+// created by NewAuthDelegate, as JSON once it has shut down, as an audit
+// record if opts enables audit_exit_summary.
+func logExitSummary(delegate http.Handler, opts *AuthDelegateOptions) {
+	summary, err := json.Marshal(
+		delegate.(*authDelegateHandler).exitSummary())
+	if err != nil {
+		log.Printf("shutdown: failed to encode summary: %s", err)
+	} else if opts.AuditExitSummary {
+		log.Printf("AUDIT exit summary: %s", summary)
+	} else {
+		log.Printf("shutdown: summary: %s", summary)
+	}
+}
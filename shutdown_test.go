@@ -0,0 +1,220 @@
+package authdelegate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Warm shutdown", func() {
+	var upstream, balancer *httptest.Server
+	var notifications chan string
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		notifications = make(chan string, 1)
+		balancer = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := ioutil.ReadAll(req.Body)
+				notifications <- req.Method + " " + req.URL.Path +
+					" " + req.Header.Get("Authorization") +
+					" " + string(body)
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: upstream.URL},
+			},
+			ReadinessPath: "/ready",
+			MetricsPath:   "/metrics",
+			ShutdownDelay: "200ms",
+			ShutdownNotify: &AuthDelegateShutdownNotify{
+				URL:     balancer.URL + "/deregister",
+				Headers: map[string]string{"Authorization": "Bearer x"},
+				Body:    `{"target":"authdelegate-1"}`,
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		balancer.Close()
+	})
+
+	get := func(handler http.Handler,
+		path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "http://delegate"+path, nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("should fail readiness and notify before the delay", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(get(handler, "/ready").Code).To(Equal(http.StatusOK))
+		Expect(get(handler, "/metrics").Body.String()).To(ContainSubstring(
+			`authdelegate_shutdown_phase{phase="serving"} 1`))
+
+		start := time.Now()
+		done := make(chan struct{}, 1)
+		go func() {
+			deregister(handler, opts)
+			done <- struct{}{}
+		}()
+		Eventually(notifications).Should(Receive(Equal(
+			`POST /deregister Bearer x {"target":"authdelegate-1"}`)))
+		ready := get(handler, "/ready")
+		Expect(ready.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(ready.Body.String()).To(Equal("shutting down\n"))
+		Expect(get(handler, "/").Code).To(Equal(http.StatusAccepted))
+		Expect(get(handler, "/metrics").Body.String()).To(ContainSubstring(
+			`authdelegate_shutdown_phase{phase="delaying"} 1`))
+		Eventually(done).Should(Receive())
+		Expect(time.Since(start)).To(BeNumerically(">=",
+			200*time.Millisecond))
+	})
+
+	It("should continue if the notification fails", func() {
+		balancer.Close()
+		opts.ShutdownDelay = ""
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		deregister(handler, opts)
+		Expect(get(handler, "/ready").Code).To(Equal(
+			http.StatusServiceUnavailable))
+	})
+
+	It("should serve requests until the delay expires", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		opts.Port = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		Expect(opts.Validate()).To(BeNil())
+		server := &http.Server{Handler: NewAuthDelegate(opts)}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		go func() { served <- serve(ctx, server, opts) }()
+		status := func() int {
+			res, err := http.Get("http://127.0.0.1:" +
+				strconv.Itoa(opts.Port) + "/")
+			if err != nil {
+				return 0
+			}
+			res.Body.Close()
+			return res.StatusCode
+		}
+		Eventually(status).Should(Equal(http.StatusAccepted))
+
+		cancel()
+		Eventually(notifications).Should(Receive())
+		Expect(status()).To(Equal(http.StatusAccepted))
+		Eventually(served).Should(Receive(BeNil()))
+		Expect(status()).To(Equal(0))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.ShutdownDelay = "-1s"
+		opts.ShutdownNotify = &AuthDelegateShutdownNotify{
+			URL:     "lb.internal/deregister",
+			Method:  "de register",
+			Headers: map[string]string{"X-Token": "a\nb"},
+			Timeout: "0s",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"shutdown_delay for shutdown must not be negative: -1s",
+			"shutdown_notify url must be an http or https URL: " +
+				"lb.internal/deregister",
+			"invalid shutdown_notify method: de register",
+			"invalid shutdown_notify headers value: X-Token",
+			"shutdown_notify timeout must be positive",
+		})))
+	})
+})
+
+var _ = Describe("Exit summary", func() {
+	var allow, deny *httptest.Server
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		newServer := func(status int) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, req *http.Request) {
+					rw.WriteHeader(status)
+				}))
+		}
+		allow = newServer(http.StatusAccepted)
+		deny = newServer(http.StatusUnauthorized)
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				{Name: "api", URL: allow.URL, HeaderName: "X-Api-Key"},
+				{Name: "session", URL: deny.URL},
+			},
+			RejectPaths: []string{"/.env"},
+		}
+	})
+
+	AfterEach(func() {
+		allow.Close()
+		deny.Close()
+	})
+
+	summarize := func() (string, *exitSummary) {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		for _, path := range []string{"/", "/", "/.env"} {
+			req, _ := http.NewRequest("GET", "http://delegate/", nil)
+			req.Header.Set("X-Original-URI", path)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Api-Key", "key")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		var output bytes.Buffer
+		log.SetOutput(&output)
+		logExitSummary(handler, opts)
+		log.SetOutput(os.Stderr)
+		line := strings.TrimSpace(output.String())
+		summary := &exitSummary{}
+		Expect(json.Unmarshal([]byte(line[strings.Index(line, "{"):]),
+			summary)).To(Succeed())
+		return line, summary
+	}
+
+	It("should log the requests decided by each upstream", func() {
+		line, summary := summarize()
+		Expect(line).To(ContainSubstring("shutdown: summary: {"))
+		Expect(summary.UptimeSeconds).To(BeNumerically(">", 0))
+		Expect(summary.Requests).To(Equal(int64(4)))
+		Expect(summary.Rejected).To(Equal(int64(1)))
+		Expect(summary.Upstreams).To(Equal([]upstreamSummary{
+			{Name: "api", Requests: 1, Allowed: 1},
+			{Name: "session", Requests: 2, Denied: 2},
+		}))
+	})
+
+	It("should log the summary as an audit record if enabled", func() {
+		opts.AuditExitSummary = true
+		line, _ := summarize()
+		Expect(line).To(ContainSubstring("AUDIT exit summary: {"))
+	})
+})
@@ -0,0 +1,134 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateSnapshot is the on-disk form of a memoryStorage, so that cached
+// decisions and revocations survive a restart.
+type stateSnapshot struct {
+	SavedAt time.Time       `json:"saved_at"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+type snapshotEntry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+
+	// Unix nanoseconds; zero if the entry never expires
+	Expires int64 `json:"expires,omitempty"`
+}
+
+func (storage *memoryStorage) snapshot() *stateSnapshot {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	now := time.Now()
+	snapshot := &stateSnapshot{SavedAt: now, Entries: []snapshotEntry{}}
+	for key, entry := range storage.entries {
+		if entry.expired(now) {
+			continue
+		}
+		saved := snapshotEntry{Key: key, Value: entry.value}
+		if !entry.expires.IsZero() {
+			saved.Expires = entry.expires.UnixNano()
+		}
+		snapshot.Entries = append(snapshot.Entries, saved)
+	}
+	return snapshot
+}
+
+// restore adds the unexpired entries of snapshot to storage. If maxAge is
+// nonzero and the snapshot is older than that, only entries that never
+// expire, such as revocations, are restored. Returns the number of entries
+// restored.
+func (storage *memoryStorage) restore(snapshot *stateSnapshot,
+	maxAge time.Duration) (restored int) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	now := time.Now()
+	stale := maxAge != 0 && now.Sub(snapshot.SavedAt) > maxAge
+	for _, saved := range snapshot.Entries {
+		entry := memoryEntry{value: saved.Value}
+		if saved.Expires != 0 {
+			entry.expires = time.Unix(0, saved.Expires)
+			if stale || entry.expired(now) {
+				continue
+			}
+			storage.expiries.set(saved.Key, entry.expires)
+		}
+		storage.entries[saved.Key] = entry
+		restored++
+	}
+	return
+}
+
+func saveSnapshot(storage *memoryStorage, path string) error {
+	content, err := json.Marshal(storage.snapshot())
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, content)
+}
+
+// loadSnapshot restores the snapshot at path into storage. It is not an error
+// if path doesn't exist, as on first startup.
+func loadSnapshot(storage *memoryStorage, path string,
+	maxAge time.Duration) error {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot stateSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return err
+	}
+	restored := storage.restore(&snapshot, maxAge)
+	log.Printf("snapshot: restored %d of %d entries saved at %s",
+		restored, len(snapshot.Entries),
+		snapshot.SavedAt.Format(time.RFC3339))
+	return nil
+}
+
+// saveDelegateSnapshot saves the state of delegate, which must have been
+// created by NewAuthDelegate, to path if it uses memory storage.
+func saveDelegateSnapshot(delegate http.Handler, path string) error {
+	storage, ok := delegate.(*authDelegateHandler).storage.(*memoryStorage)
+	if !ok {
+		return nil
+	}
+	if err := saveSnapshot(storage, path); err != nil {
+		return err
+	}
+	log.Printf("snapshot: saved to %s", path)
+	return nil
+}
+
+// writeFileAtomically writes to a temporary file and renames it into place,
+// so that readers never observe partially written content.
+func writeFileAtomically(path string, content []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = temp.Write(content); err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
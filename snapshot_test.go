@@ -0,0 +1,90 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var _ = Describe("State snapshots", func() {
+	var dir, path string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "snapshot_test")
+		Expect(err).To(BeNil())
+		path = filepath.Join(dir, "state.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should restore unexpired entries", func() {
+		storage := newMemoryStorage()
+		storage.Set("decision:a", []byte("x"), time.Minute)
+		storage.Set("decision:b", []byte("y"), time.Millisecond)
+		storage.Set("revoked:c", []byte{}, 0)
+		Expect(saveSnapshot(storage, path)).To(BeNil())
+		time.Sleep(2 * time.Millisecond)
+
+		restored := newMemoryStorage()
+		Expect(loadSnapshot(restored, path, 0)).To(BeNil())
+		Expect(restored.Keys("")).To(Equal(
+			[]string{"decision:a", "revoked:c"}))
+		value, _, _ := restored.Get("decision:a")
+		Expect(string(value)).To(Equal("x"))
+	})
+
+	It("should restore only permanent entries from a stale snapshot",
+		func() {
+			storage := newMemoryStorage()
+			storage.Set("decision:a", []byte("x"), time.Hour)
+			storage.Set("revoked:c", []byte{}, 0)
+			snapshot := storage.snapshot()
+			snapshot.SavedAt = snapshot.SavedAt.Add(-time.Minute)
+
+			restored := newMemoryStorage()
+			Expect(restored.restore(snapshot, time.Second)).To(Equal(1))
+			Expect(restored.Keys("")).To(Equal([]string{"revoked:c"}))
+		})
+
+	It("should ignore a missing snapshot", func() {
+		Expect(loadSnapshot(newMemoryStorage(), path, 0)).To(BeNil())
+	})
+
+	It("should restore revocations when the delegate starts", func() {
+		storage := newMemoryStorage()
+		newRevocationList(storage).revoke("abc")
+		Expect(saveSnapshot(storage, path)).To(BeNil())
+
+		opts := &AuthDelegateOptions{
+			Port:              8080,
+			Upstreams:         []*AuthDelegateUpstream{{URL: "http://x"}},
+			StateSnapshotPath: path,
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		Expect(handler.revocations.isRevoked("abc")).To(BeTrue())
+	})
+
+	It("should fail validation unless storage is in memory", func() {
+		opts := &AuthDelegateOptions{
+			Port:                8080,
+			Upstreams:           []*AuthDelegateUpstream{{URL: "http://x"}},
+			Storage:             &AuthDelegateStorage{Type: "file", Path: dir},
+			StateSnapshotPath:   path,
+			StateSnapshotMaxAge: "soon",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"state_snapshot_path requires memory storage",
+			"invalid state_snapshot_max_age for state_snapshot_path: " +
+				"soon",
+		})))
+	})
+})
@@ -0,0 +1,142 @@
+package authdelegate
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage holds the state of features that must outlive a single request,
+// such as the revocation list. Implementations must be safe for concurrent
+// use. A zero TTL means a value never expires.
+type Storage interface {
+	// Get returns the value of key, and false if it is absent or expired.
+	Get(key string) (value []byte, ok bool, err error)
+
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Delete removes key; it is not an error if key is absent.
+	Delete(key string) error
+
+	// Keys returns the unexpired keys beginning with prefix.
+	Keys(prefix string) ([]string, error)
+}
+
+const (
+	storageMemory = "memory"
+	storageRedis  = "redis"
+	storageFile   = "file"
+)
+
+// newStorage returns the Storage selected by opts; defaults to memoryStorage,
+// restored from opts.StateSnapshotPath if specified. Doesn't contact a remote
+// backend, so that the delegate may start while it is unavailable.
+func newStorage(opts *AuthDelegateOptions) Storage {
+	if opts.Storage != nil {
+		switch opts.Storage.Type {
+		case storageRedis:
+			return newRedisStorage(opts.Storage)
+		case storageFile:
+			storage := newFileStorage(opts.Storage.Path)
+			go storage.sweep(fileStorageSweepInterval)
+			return storage
+		}
+	}
+	storage := newMemoryStorage()
+	if opts.StateSnapshotPath != "" {
+		err := loadSnapshot(storage, opts.StateSnapshotPath,
+			opts.stateSnapshotMaxAge)
+		if err != nil {
+			log.Printf("snapshot: failed to restore from %s: %s",
+				opts.StateSnapshotPath, err)
+		}
+	}
+	return storage
+}
+
+// memoryStorage is a Storage local to this process. Expired entries are
+// removed whenever it is accessed.
+type memoryStorage struct {
+	mutex   sync.Mutex
+	entries map[string]memoryEntry
+
+	// Removes each entry with a TTL once it has expired
+	expiries *expiryQueue
+}
+
+type memoryEntry struct {
+	value []byte
+
+	// Zero if the entry never expires
+	expires time.Time
+}
+
+func (entry memoryEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && !now.Before(entry.expires)
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		entries:  make(map[string]memoryEntry),
+		expiries: newExpiryQueue(),
+	}
+}
+
+// expire removes the entries that have expired by now. An entry that was
+// replaced by one that expires later, or never, is kept. The caller must hold
+// storage.mutex.
+func (storage *memoryStorage) expire(now time.Time) {
+	storage.expiries.expire(now, func(key string) {
+		if storage.entries[key].expired(now) {
+			delete(storage.entries, key)
+		}
+	})
+}
+
+func (storage *memoryStorage) Get(key string) ([]byte, bool, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.expire(time.Now())
+	entry, ok := storage.entries[key]
+	return entry.value, ok, nil
+}
+
+func (storage *memoryStorage) Set(key string, value []byte,
+	ttl time.Duration) error {
+	now := time.Now()
+	entry := memoryEntry{value: append([]byte(nil), value...)}
+	if ttl != 0 {
+		entry.expires = now.Add(ttl)
+	}
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.expire(now)
+	storage.entries[key] = entry
+	if ttl != 0 {
+		storage.expiries.set(key, entry.expires)
+	}
+	return nil
+}
+
+func (storage *memoryStorage) Delete(key string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	delete(storage.entries, key)
+	return nil
+}
+
+func (storage *memoryStorage) Keys(prefix string) ([]string, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	storage.expire(time.Now())
+	keys := []string{}
+	for key := range storage.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
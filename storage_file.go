@@ -0,0 +1,153 @@
+package authdelegate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileStorageSweepInterval is how often fileStorage removes the files of
+// expired entries that haven't been read since they expired.
+const fileStorageSweepInterval = time.Minute
+
+// fileStorage is a Storage that keeps each key in its own file within a
+// directory, so that state survives restarts. Each file contains the
+// expiration time in Unix nanoseconds (zero if none) on its first line, the
+// hex-encoded key on its second, followed by the value.
+type fileStorage struct {
+	dir string
+}
+
+func newFileStorage(dir string) *fileStorage {
+	return &fileStorage{dir: dir}
+}
+
+// path names the file of key by its SHA-256 digest, so that any key, however
+// long, is a valid file name.
+func (storage *fileStorage) path(key string) string {
+	digest := sha256.Sum256([]byte(key))
+	return filepath.Join(storage.dir, hex.EncodeToString(digest[:]))
+}
+
+func (storage *fileStorage) Get(key string) ([]byte, bool, error) {
+	content, err := ioutil.ReadFile(storage.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	entryKey, value, expired := parseFileEntry(content, time.Now())
+	if expired {
+		return nil, false, storage.Delete(key)
+	} else if entryKey != key {
+		return nil, false, nil
+	}
+	return value, true, nil
+}
+
+// parseFileEntry treats a malformed entry, e.g. one truncated by a crash, as
+// expired.
+func parseFileEntry(content []byte, now time.Time) (
+	key string, value []byte, expired bool) {
+	lines := bytes.SplitN(content, []byte("\n"), 3)
+	if len(lines) != 3 {
+		return "", nil, true
+	}
+	expires, err := strconv.ParseInt(string(lines[0]), 10, 64)
+	if err != nil || (expires != 0 && now.UnixNano() >= expires) {
+		return "", nil, true
+	}
+	decoded, err := hex.DecodeString(string(lines[1]))
+	if err != nil {
+		return "", nil, true
+	}
+	return string(decoded), lines[2], false
+}
+
+func (storage *fileStorage) Set(key string, value []byte,
+	ttl time.Duration) error {
+	if err := os.MkdirAll(storage.dir, 0700); err != nil {
+		return err
+	}
+	var expires int64
+	if ttl != 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	content := append([]byte(strconv.FormatInt(expires, 10)+"\n"+
+		hex.EncodeToString([]byte(key))+"\n"), value...)
+	return writeFileAtomically(storage.path(key), content)
+}
+
+func (storage *fileStorage) Delete(key string) error {
+	err := os.Remove(storage.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (storage *fileStorage) Keys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := storage.scan(func(key string) {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// scan passes the key of each unexpired entry to found, removing the files of
+// expired entries.
+func (storage *fileStorage) scan(found func(key string)) error {
+	names, err := ioutil.ReadDir(storage.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, info := range names {
+		// Skip the temporary files of writeFileAtomically
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			continue
+		}
+		path := filepath.Join(storage.dir, info.Name())
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		key, _, expired := parseFileEntry(content, now)
+		if !expired {
+			found(key)
+		} else if err = os.Remove(path); err != nil &&
+			!os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweep removes the files of expired entries every interval, so that keys
+// that are never read again don't accumulate in the directory.
+func (storage *fileStorage) sweep(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := storage.scan(func(string) {}); err != nil {
+			log.Printf("storage: failed to remove expired entries "+
+				"from %s: %s", storage.dir, err)
+		}
+	}
+}
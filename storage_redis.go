@@ -0,0 +1,96 @@
+//go:build !noredis
+// +build !noredis
+
+package authdelegate
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSupported is false in builds with the noredis tag, which omit Redis
+// storage.
+const redisSupported = true
+
+// redisTimeout bounds each command sent to Redis, including connecting.
+const redisTimeout = time.Second
+
+// redisStorage is a Storage backed by a Redis server, so that state may be
+// shared by several delegates. Commands are sent over a pool of connections,
+// so that concurrent requests don't wait on each other.
+type redisStorage struct {
+	client *redis.Client
+}
+
+// newRedisStorage returns a redisStorage for the server configured by config,
+// which must have been validated.
+func newRedisStorage(config *AuthDelegateStorage) *redisStorage {
+	options := &redis.Options{
+		Addr:         config.Address,
+		Username:     config.Username,
+		Password:     config.password,
+		DialTimeout:  redisTimeout,
+		ReadTimeout:  redisTimeout,
+		WriteTimeout: redisTimeout,
+	}
+	if config.TLS {
+		host, _, _ := net.SplitHostPort(config.Address)
+		options.TLSConfig = &tls.Config{
+			ServerName: host,
+			RootCAs:    config.tlsCAs,
+		}
+	}
+	return &redisStorage{client: redis.NewClient(options)}
+}
+
+func (storage *redisStorage) Get(key string) ([]byte, bool, error) {
+	value, err := storage.client.Get(context.Background(), key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (storage *redisStorage) Set(key string, value []byte,
+	ttl time.Duration) error {
+	if ttl != 0 && ttl < time.Millisecond {
+		ttl = time.Millisecond
+	}
+	return storage.client.Set(context.Background(), key, value, ttl).Err()
+}
+
+func (storage *redisStorage) Delete(key string) error {
+	return storage.client.Del(context.Background(), key).Err()
+}
+
+// Keys uses SCAN rather than KEYS, so as not to block the server.
+func (storage *redisStorage) Keys(prefix string) ([]string, error) {
+	ctx := context.Background()
+	pattern := redisGlobEscaper.Replace(prefix) + "*"
+	found := make(map[string]bool)
+	iterator := storage.client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iterator.Next(ctx) {
+		found[iterator.Val()] = true
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+var redisGlobEscaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
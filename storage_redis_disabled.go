@@ -0,0 +1,12 @@
+//go:build noredis
+// +build noredis
+
+package authdelegate
+
+const redisSupported = false
+
+// newRedisStorage is never called, since validation rejects storage of type
+// redis in builds with the noredis tag.
+func newRedisStorage(config *AuthDelegateStorage) Storage {
+	return newMemoryStorage()
+}
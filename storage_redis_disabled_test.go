@@ -0,0 +1,26 @@
+//go:build noredis
+// +build noredis
+
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Builds without Redis storage", func() {
+	It("should fail validation for storage of type redis", func() {
+		opts := &AuthDelegateOptions{
+			Port:      8080,
+			Upstreams: []*AuthDelegateUpstream{{URL: "http://x"}},
+			Storage: &AuthDelegateStorage{
+				Type:    "redis",
+				Address: "localhost:6379",
+			},
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"storage type redis is not supported by this build, which " +
+				"has the noredis tag",
+		})))
+	})
+})
@@ -0,0 +1,255 @@
+//go:build !noredis
+// +build !noredis
+
+package authdelegate
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeRedis implements the subset of the Redis protocol used by
+// redisStorage, ignoring expiration. If password isn't empty, it must be
+// presented with AUTH before any other command.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+	mutex    sync.Mutex
+	values   map[string]string
+}
+
+func newFakeRedis(listener net.Listener, password string) *fakeRedis {
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		values:   map[string]string{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := server.password == ""
+	for {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			authenticated = args[len(args)-1] == server.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "HELLO", "CLIENT":
+			reply = "-ERR unknown command\r\n"
+		default:
+			reply = "-NOAUTH Authentication required.\r\n"
+			if authenticated {
+				reply = server.reply(args)
+			}
+		}
+		io.WriteString(conn, reply)
+	}
+}
+
+// readRedisCommand reads a command, an array of bulk strings.
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	readLine := func(kind byte) (int, error) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, err
+		} else if len(line) < 3 || line[0] != kind {
+			return 0, errors.New("malformed command: " + line)
+		}
+		return strconv.Atoi(strings.TrimSpace(line[1:]))
+	}
+	count, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
+
+func (server *fakeRedis) reply(args []string) string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := server.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+	case "SET":
+		server.values[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		delete(server.values, args[1])
+		return ":1\r\n"
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[3], "*")
+		var keys []string
+		for key := range server.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, "$"+strconv.Itoa(len(key))+
+					"\r\n"+key+"\r\n")
+			}
+		}
+		return "*2\r\n$1\r\n0\r\n*" + strconv.Itoa(len(keys)) + "\r\n" +
+			strings.Join(keys, "")
+	}
+	return "-ERR unknown command\r\n"
+}
+
+var _ = Describe("redisStorage", func() {
+	var server *fakeRedis
+	var dir string
+
+	BeforeEach(func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		server = newFakeRedis(listener, "")
+		dir, err = ioutil.TempDir("", "storage_redis_test")
+		Expect(err).To(BeNil())
+	})
+
+	AfterEach(func() {
+		server.listener.Close()
+		os.RemoveAll(dir)
+	})
+
+	// newStorage validates config, as newRedisStorage requires.
+	newStorage := func(config *AuthDelegateStorage) *redisStorage {
+		config.Type = "redis"
+		config.Address = server.listener.Addr().String()
+		opts := &AuthDelegateOptions{
+			Port:      8080,
+			Upstreams: []*AuthDelegateUpstream{{URL: "http://x"}},
+			Storage:   config,
+		}
+		Expect(opts.Validate()).To(BeNil())
+		return newRedisStorage(config)
+	}
+
+	behavesLikeStorage(func() Storage {
+		return newStorage(&AuthDelegateStorage{})
+	})
+
+	It("should authenticate with the password", func() {
+		server.listener.Close()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		server = newFakeRedis(listener, "secret")
+		passwordFile := filepath.Join(dir, "password")
+		Expect(ioutil.WriteFile(passwordFile, []byte("secret\n"),
+			0600)).To(BeNil())
+		storage := newStorage(&AuthDelegateStorage{
+			PasswordFile: passwordFile,
+		})
+		Expect(storage.Set("foo", []byte("bar"),
+			time.Minute)).To(BeNil())
+		value, ok, err := storage.Get("foo")
+		Expect(err).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(string(value)).To(Equal("bar"))
+
+		_, _, err = newStorage(&AuthDelegateStorage{}).Get("foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should connect over TLS", func() {
+		server.listener.Close()
+		certificate := writeTestCertificate(dir, "redis", time.Hour)
+		pair, err := tls.LoadX509KeyPair(certificate.CertFile,
+			certificate.KeyFile)
+		Expect(err).To(BeNil())
+		listener, err := tls.Listen("tcp", "127.0.0.1:0",
+			&tls.Config{Certificates: []tls.Certificate{pair}})
+		Expect(err).To(BeNil())
+		server = newFakeRedis(listener, "")
+		storage := newStorage(&AuthDelegateStorage{
+			TLS:       true,
+			TLSCAFile: certificate.CertFile,
+		})
+		Expect(storage.Set("foo", []byte("bar"), 0)).To(BeNil())
+		value, ok, err := storage.Get("foo")
+		Expect(err).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(string(value)).To(Equal("bar"))
+
+		_, _, err = newStorage(&AuthDelegateStorage{TLS: true}).
+			Get("foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should report connection failures", func() {
+		storage := newStorage(&AuthDelegateStorage{})
+		server.listener.Close()
+		_, _, err := storage.Get("foo")
+		Expect(err).ToNot(BeNil())
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts := &AuthDelegateOptions{
+			Port:      8080,
+			Upstreams: []*AuthDelegateUpstream{{URL: "http://x"}},
+			Storage: &AuthDelegateStorage{
+				Type:      "redis",
+				Username:  "delegate",
+				TLSCAFile: filepath.Join(dir, "ca.pem"),
+			},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(ContainSubstring(
+			"invalid storage address"))
+		Expect(err.Error()).To(ContainSubstring(
+			"storage username requires password_file"))
+		Expect(err.Error()).To(ContainSubstring(
+			"storage tls_ca_file requires tls"))
+
+		opts.Storage = &AuthDelegateStorage{Type: "file", Path: dir,
+			TLS: true}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"storage username, password_file, tls, and " +
+				"tls_ca_file require type redis",
+		})))
+	})
+})
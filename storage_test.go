@@ -0,0 +1,175 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// behavesLikeStorage describes the behavior common to every Storage.
+func behavesLikeStorage(newStorage func() Storage) {
+	var storage Storage
+
+	BeforeEach(func() {
+		storage = newStorage()
+	})
+
+	It("should set, get, and delete values", func() {
+		_, ok, err := storage.Get("foo")
+		Expect(err).To(BeNil())
+		Expect(ok).To(BeFalse())
+
+		Expect(storage.Set("foo", []byte("bar"), 0)).To(BeNil())
+		value, ok, err := storage.Get("foo")
+		Expect(err).To(BeNil())
+		Expect(ok).To(BeTrue())
+		Expect(string(value)).To(Equal("bar"))
+
+		Expect(storage.Delete("foo")).To(BeNil())
+		Expect(storage.Delete("foo")).To(BeNil())
+		_, ok, _ = storage.Get("foo")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should list keys by prefix", func() {
+		Expect(storage.Set("a:2", []byte{}, 0)).To(BeNil())
+		Expect(storage.Set("a:1", []byte("x"), 0)).To(BeNil())
+		Expect(storage.Set("b:1", []byte("y"), 0)).To(BeNil())
+		Expect(storage.Keys("a:")).To(Equal([]string{"a:1", "a:2"}))
+		Expect(storage.Keys("c:")).To(BeEmpty())
+	})
+}
+
+var _ = Describe("Storage", func() {
+	Describe("memoryStorage", func() {
+		behavesLikeStorage(func() Storage { return newMemoryStorage() })
+
+		It("should expire values", func() {
+			storage := newMemoryStorage()
+			Expect(storage.Set("foo", []byte("bar"),
+				time.Millisecond)).To(BeNil())
+			time.Sleep(2 * time.Millisecond)
+			_, ok, _ := storage.Get("foo")
+			Expect(ok).To(BeFalse())
+			Expect(storage.Keys("")).To(BeEmpty())
+		})
+
+		It("should remove expired values when others are set", func() {
+			storage := newMemoryStorage()
+			Expect(storage.Set("foo", []byte("bar"),
+				time.Millisecond)).To(BeNil())
+			Expect(storage.Set("baz", []byte("bar"),
+				time.Millisecond)).To(BeNil())
+			Expect(storage.Set("baz", []byte("qux"), 0)).To(BeNil())
+			time.Sleep(2 * time.Millisecond)
+			Expect(storage.Set("quux", []byte("bar"),
+				time.Minute)).To(BeNil())
+			Expect(storage.entries).To(HaveLen(2))
+			Expect(storage.entries).To(HaveKey("baz"))
+			Expect(storage.entries).To(HaveKey("quux"))
+		})
+	})
+
+	Describe("fileStorage", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "storage_test")
+			Expect(err).To(BeNil())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		behavesLikeStorage(func() Storage {
+			return newFileStorage(dir + "/state")
+		})
+
+		It("should expire values", func() {
+			storage := newFileStorage(dir)
+			Expect(storage.Set("foo", []byte("bar"),
+				time.Millisecond)).To(BeNil())
+			time.Sleep(2 * time.Millisecond)
+			_, ok, _ := storage.Get("foo")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should store keys longer than a file name", func() {
+			storage := newFileStorage(dir)
+			key := "decision:http://127.0.0.1:8080/oauth2/auth:" +
+				strings.Repeat("0", 64) + ":" +
+				strings.Repeat("1", 64)
+			Expect(storage.Set(key, []byte("bar"), 0)).To(BeNil())
+			value, ok, err := storage.Get(key)
+			Expect(err).To(BeNil())
+			Expect(ok).To(BeTrue())
+			Expect(string(value)).To(Equal("bar"))
+			Expect(storage.Keys("decision:")).To(
+				Equal([]string{key}))
+		})
+
+		It("should remove expired values when scanning", func() {
+			storage := newFileStorage(dir)
+			Expect(storage.Set("foo", []byte("bar"),
+				time.Millisecond)).To(BeNil())
+			Expect(storage.Set("baz", []byte("qux"), 0)).To(BeNil())
+			time.Sleep(2 * time.Millisecond)
+			Expect(storage.scan(func(string) {})).To(BeNil())
+			names, _ := ioutil.ReadDir(dir)
+			Expect(names).To(HaveLen(1))
+			Expect(storage.Keys("")).To(Equal([]string{"baz"}))
+		})
+
+		It("should persist values across instances", func() {
+			Expect(newFileStorage(dir).Set("foo", []byte("bar"),
+				0)).To(BeNil())
+			value, ok, _ := newFileStorage(dir).Get("foo")
+			Expect(ok).To(BeTrue())
+			Expect(string(value)).To(Equal("bar"))
+		})
+	})
+
+	It("should restore revocations from storage", func() {
+		storage := newMemoryStorage()
+		Expect(newRevocationList(storage).revoke("abc")).To(BeNil())
+		list := newRevocationList(storage)
+		Expect(list.any()).To(BeTrue())
+		Expect(list.isRevoked("abc")).To(BeTrue())
+		Expect(list.reinstate("abc")).To(BeNil())
+		Expect(newRevocationList(storage).any()).To(BeFalse())
+	})
+
+	It("should reload revocations changed through another list", func() {
+		storage := newMemoryStorage()
+		list, other := newRevocationList(storage),
+			newRevocationList(storage)
+		Expect(other.revoke("abc")).To(BeNil())
+		Expect(list.isRevoked("abc")).To(BeFalse())
+		Expect(list.load()).To(BeNil())
+		Expect(list.isRevoked("abc")).To(BeTrue())
+		Expect(other.reinstate("abc")).To(BeNil())
+		Expect(list.load()).To(BeNil())
+		Expect(list.any()).To(BeFalse())
+	})
+
+	It("should fail validation for invalid storage options", func() {
+		opts := &AuthDelegateOptions{
+			Port:      8080,
+			Upstreams: []*AuthDelegateUpstream{{URL: "http://x"}},
+			Storage:   &AuthDelegateStorage{Type: "file"},
+		}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"storage path must be specified for type file",
+		})))
+
+		opts.Storage = &AuthDelegateStorage{Type: "bolt"}
+		Expect(opts.Validate().Error()).To(Equal(optionErrors([]string{
+			"unknown storage type: bolt",
+		})))
+	})
+})
@@ -0,0 +1,177 @@
+package authdelegate
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// subscriptionKeepalive is how often a comment is sent to idle subscribers,
+// so that intermediate proxies don't close the connection.
+const subscriptionKeepalive = 30 * time.Second
+
+// subscriptionBuffer is the number of events buffered for each subscriber;
+// events for a subscriber that falls further behind are dropped.
+const subscriptionBuffer = 8
+
+// decisionEvent notifies a subscriber of a change in the decision for a
+// credential.
+type decisionEvent struct {
+	Allowed bool `json:"allowed"`
+	Status  int  `json:"status"`
+
+	// "upstream" if the decision came from an upstream, or "revoked" or
+	// "reinstated" if it was changed by an admin operation
+	Source string `json:"source"`
+}
+
+// decisionSubscriptions tracks the latest decision for each credential that
+// has subscribers, and notifies them when it changes. Credentials are
+// identified by the hash computed by hashCredential.
+type decisionSubscriptions struct {
+	mutex       sync.Mutex
+	subscribers map[string]map[chan decisionEvent]bool
+	latest      map[string]decisionEvent
+
+	// Accessed atomically; allows the common case of no subscribers to
+	// skip hashing credentials
+	size int64
+
+	// Closed when the server shuts down, ending every stream, which would
+	// otherwise keep the shutdown waiting for them to complete
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+func newDecisionSubscriptions() *decisionSubscriptions {
+	return &decisionSubscriptions{
+		subscribers: make(map[string]map[chan decisionEvent]bool),
+		latest:      make(map[string]decisionEvent),
+		closing:     make(chan struct{}),
+	}
+}
+
+// closeAll ends every stream, and any opened later.
+func (subs *decisionSubscriptions) closeAll() {
+	subs.closeOnce.Do(func() { close(subs.closing) })
+}
+
+func (subs *decisionSubscriptions) any() bool {
+	return atomic.LoadInt64(&subs.size) != 0
+}
+
+func (subs *decisionSubscriptions) has(hash string) bool {
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	return len(subs.subscribers[hash]) != 0
+}
+
+func (subs *decisionSubscriptions) subscribe(hash string) chan decisionEvent {
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	events := make(chan decisionEvent, subscriptionBuffer)
+	if subs.subscribers[hash] == nil {
+		subs.subscribers[hash] = make(map[chan decisionEvent]bool)
+	}
+	subs.subscribers[hash][events] = true
+	atomic.AddInt64(&subs.size, 1)
+	return events
+}
+
+func (subs *decisionSubscriptions) unsubscribe(hash string,
+	events chan decisionEvent) {
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	delete(subs.subscribers[hash], events)
+	if len(subs.subscribers[hash]) == 0 {
+		delete(subs.subscribers, hash)
+		delete(subs.latest, hash)
+	}
+	atomic.AddInt64(&subs.size, -1)
+}
+
+// publish notifies the subscribers of hash of event, unless it has the same
+// outcome as the previous event published for hash.
+func (subs *decisionSubscriptions) publish(hash string, event decisionEvent) {
+	subs.mutex.Lock()
+	defer subs.mutex.Unlock()
+	subscribers := subs.subscribers[hash]
+	if len(subscribers) == 0 {
+		return
+	}
+	if latest, ok := subs.latest[hash]; ok && latest.Allowed == event.Allowed {
+		return
+	}
+	subs.latest[hash] = event
+	for events := range subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// serveSubscription streams decisionEvents for the credential carried by req
+// as server-sent events until the client disconnects or the server shuts
+// down.
+func (handler *authDelegateHandler) serveSubscription(rw http.ResponseWriter,
+	req *http.Request, table *routingTable) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported",
+			http.StatusInternalServerError)
+		return
+	}
+	var credential string
+	var present bool
+	if upstream := table.selectUpstream(req, nil); upstream != nil {
+		credential, present = upstream.credential(req)
+	}
+	if !present {
+		http.Error(rw, "request carries no credential",
+			http.StatusBadRequest)
+		return
+	}
+
+	hash := hashCredential(credential)
+	events := handler.subscriptions.subscribe(hash)
+	defer handler.subscriptions.unsubscribe(hash, events)
+	if handler.revocations.isRevoked(hash) {
+		handler.subscriptions.publish(hash, decisionEvent{
+			Status: http.StatusUnauthorized, Source: "revoked",
+		})
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(subscriptionKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event := <-events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(rw, "event: decision\ndata: %s\n\n", data)
+		case <-keepalive.C:
+			fmt.Fprint(rw, ": keepalive\n\n")
+		case <-req.Context().Done():
+			return
+		case <-handler.subscriptions.closing:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func decisionFromStatus(status int) decisionEvent {
+	return decisionEvent{
+		Allowed: status/100 == 2,
+		Status:  status,
+		Source:  "upstream",
+	}
+}
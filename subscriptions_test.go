@@ -0,0 +1,138 @@
+package authdelegate
+
+import (
+	"bufio"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Decision subscriptions", func() {
+	var upstream *httptest.Server
+	var status int
+	var handler *authDelegateHandler
+
+	BeforeEach(func() {
+		status = http.StatusAccepted
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(status)
+			}))
+		opts := &AuthDelegateOptions{
+			Port:          8080,
+			SubscribePath: "/subscribe",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					URL:        upstream.URL,
+					HeaderName: "X-Api-Key",
+				},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		handler = NewAuthDelegate(opts).(*authDelegateHandler)
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	authorize := func(key string) int {
+		req, _ := http.NewRequest("GET", "http://delegate/foo", nil)
+		req.Header.Set("X-Api-Key", key)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	// subscribe returns a function that reads the data of the next event.
+	subscribe := func(key string) (next func() string, stop func()) {
+		delegate := httptest.NewServer(handler)
+		req, _ := http.NewRequest("GET", delegate.URL+"/subscribe", nil)
+		req.Header.Set("X-Api-Key", key)
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).To(BeNil())
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(res.Header.Get("Content-Type")).
+			To(Equal("text/event-stream"))
+		Eventually(handler.subscriptions.any).Should(BeTrue())
+
+		reader := bufio.NewReader(res.Body)
+		next = func() string {
+			for {
+				line, err := reader.ReadString('\n')
+				Expect(err).To(BeNil())
+				if strings.HasPrefix(line, "data: ") {
+					return strings.TrimSpace(line[6:])
+				}
+			}
+		}
+		stop = func() {
+			res.Body.Close()
+			delegate.Close()
+		}
+		return
+	}
+
+	It("should reject subscriptions without a credential", func() {
+		req, _ := http.NewRequest("GET", "http://delegate/subscribe", nil)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should notify subscribers when the decision changes", func() {
+		next, stop := subscribe("key")
+		defer stop()
+
+		Expect(authorize("key")).To(Equal(http.StatusAccepted))
+		Expect(next()).To(Equal(
+			`{"allowed":true,"status":202,"source":"upstream"}`))
+
+		// Neither a repeated outcome nor another credential's
+		// decision produces an event.
+		Expect(authorize("key")).To(Equal(http.StatusAccepted))
+		status = http.StatusForbidden
+		Expect(authorize("other")).To(Equal(http.StatusForbidden))
+		Expect(authorize("key")).To(Equal(http.StatusForbidden))
+		Expect(next()).To(Equal(
+			`{"allowed":false,"status":403,"source":"upstream"}`))
+	})
+
+	It("should deny revoked credentials and notify subscribers", func() {
+		next, stop := subscribe("key")
+		defer stop()
+		hash := hashCredential("key")
+		admin := NewAdminHandler(handler)
+
+		req, _ := http.NewRequest("POST",
+			"http://admin/credentials/revoke?hash="+hash, nil)
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(MatchJSON(`["` + hash + `"]`))
+		Expect(next()).To(Equal(
+			`{"allowed":false,"status":401,"source":"revoked"}`))
+		Expect(authorize("key")).To(Equal(http.StatusUnauthorized))
+		Expect(authorize("other")).To(Equal(http.StatusAccepted))
+
+		req, _ = http.NewRequest("POST",
+			"http://admin/credentials/reinstate?hash="+hash, nil)
+		recorder = httptest.NewRecorder()
+		admin.ServeHTTP(recorder, req)
+		Expect(recorder.Body.String()).To(MatchJSON(`[]`))
+		Expect(next()).To(Equal(
+			`{"allowed":true,"status":200,"source":"reinstated"}`))
+		Expect(authorize("key")).To(Equal(http.StatusAccepted))
+	})
+
+	It("should reject malformed credential hashes", func() {
+		req, _ := http.NewRequest("POST",
+			"http://admin/credentials/revoke?hash=foo", nil)
+		recorder := httptest.NewRecorder()
+		NewAdminHandler(handler).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(handler.revocations.any()).To(BeFalse())
+	})
+})
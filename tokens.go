@@ -0,0 +1,62 @@
+package authdelegate
+
+import (
+	"net/http"
+	"strings"
+)
+
+// upstreamStaticTokens is the type of upstream that checks credentials
+// against a set of token hashes itself, rather than forwarding requests.
+const upstreamStaticTokens = "static_tokens"
+
+// staticTokensHandler allows requests whose credential is one of a set of
+// tokens, identified by their hashes, and denies all others, without sending
+// them anywhere.
+type staticTokensHandler struct {
+	credential func(*http.Request) (string, bool)
+	authScheme string
+
+	// Set of lowercased, hex-encoded SHA-256 digests of the tokens
+	hashes map[string]bool
+}
+
+func newStaticTokensHandler(upstream *AuthDelegateUpstream,
+	delegate *authDelegate) http.Handler {
+	return &staticTokensHandler{
+		credential: delegate.credential,
+		authScheme: authSchemePrefix(upstream.AuthScheme),
+		hashes:     upstream.tokenHashes,
+	}
+}
+
+// token returns the credential of req without its Authorization scheme, if
+// any, or the empty string if req has none.
+func (handler *staticTokensHandler) token(req *http.Request) string {
+	credential, _ := handler.credential(req)
+	return withoutAuthScheme(credential, handler.authScheme)
+}
+
+// withoutAuthScheme returns credential without authScheme, as returned by
+// authSchemePrefix, and the whitespace that follows it, or the empty string
+// if credential doesn't begin with authScheme. Returns credential unchanged
+// if authScheme is empty.
+func withoutAuthScheme(credential, authScheme string) string {
+	if authScheme == "" {
+		return credential
+	} else if len(credential) < len(authScheme) ||
+		!strings.EqualFold(credential[:len(authScheme)], authScheme) {
+		return ""
+	}
+	return strings.TrimSpace(credential[len(authScheme):])
+}
+
+func (handler *staticTokensHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	if token := handler.token(req); token != "" &&
+		handler.hashes[hashCredential(token)] {
+		rw.WriteHeader(http.StatusAccepted)
+		return
+	}
+	explainDecision(req, "static: token not recognized")
+	rw.WriteHeader(http.StatusUnauthorized)
+}
@@ -0,0 +1,125 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+)
+
+var _ = Describe("Static token upstreams", func() {
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		opts = &AuthDelegateOptions{
+			Port:          8080,
+			ReadinessPath: "/readyz",
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name:       "api-tokens",
+					Type:       "static_tokens",
+					AuthScheme: "Bearer",
+					TokenHashes: []string{
+						hashCredential("s3cret"),
+					},
+				},
+			},
+			ReadinessCheckUpstreams: true,
+		}
+	})
+
+	authorize := func(header, value string) int {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set(header, value)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	It("should allow only the listed tokens", func() {
+		Expect(authorize("Authorization", "Bearer s3cret")).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize("Authorization", "bearer  s3cret")).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize("Authorization", "Bearer guess")).To(
+			Equal(http.StatusUnauthorized))
+		Expect(authorize("Authorization", "Basic s3cret")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should derive its URL from its name", func() {
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Upstreams[0].URL).To(Equal("static:api-tokens"))
+		Expect(opts.Validate()).To(BeNil())
+	})
+
+	It("should read further hashes from a file", func() {
+		dir, err := ioutil.TempDir("", "tokens")
+		Expect(err).To(BeNil())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "tokens")
+		Expect(ioutil.WriteFile(path, []byte("# deploy bot\n"+
+			hashCredential("deploy")+"\n\n"), 0600)).To(Succeed())
+		opts.Upstreams[0] = &AuthDelegateUpstream{
+			Name:            "api-tokens",
+			Type:            "static_tokens",
+			HeaderName:      "X-Api-Key",
+			TokenHashesFile: path,
+		}
+		Expect(authorize("X-Api-Key", "deploy")).To(
+			Equal(http.StatusAccepted))
+		Expect(authorize("X-Api-Key", "s3cret")).To(
+			Equal(http.StatusUnauthorized))
+	})
+
+	It("should not be checked for readiness", func() {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://delegate/readyz", nil)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+	})
+
+	It("should fail validation for invalid settings", func() {
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				Type:       "static_tokens",
+				HeaderName: "X-Api-Key",
+			},
+			&AuthDelegateUpstream{
+				Name:        "api-tokens",
+				Type:        "static_tokens",
+				URL:         "http://localhost:8081",
+				CookieName:  "_token",
+				TokenHashes: []string{"abc123"},
+			},
+			&AuthDelegateUpstream{
+				URL:        "http://localhost:8082",
+				Type:       "oauth",
+				HeaderName: "X-Oauth",
+			},
+			&AuthDelegateUpstream{
+				Name: "bots",
+				Type: "static_tokens",
+			},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"static_tokens upstream requires a name",
+			"static_tokens upstream api-tokens must not define url: " +
+				"http://localhost:8081",
+			"token hash for http://localhost:8081 is not a " +
+				"hex-encoded SHA-256 digest: abc123",
+			"invalid upstream type for http://localhost:8082: oauth",
+			"static_tokens requires header_name, cookie_name, or " +
+				"auth_scheme: static:bots",
+			"static_tokens requires token_hashes or " +
+				"token_hashes_file: static:bots",
+		})))
+	})
+})
@@ -0,0 +1,327 @@
+package authdelegate
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// traceparentHeader carries the W3C Trace Context of a request.
+const traceparentHeader = "Traceparent"
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "github.com/18F/authdelegate"
+
+// Defaults of the tracing options
+const (
+	defaultTracingServiceName    = "authdelegate"
+	defaultTracingExportInterval = 5 * time.Second
+)
+
+// Spans beyond maxQueuedSpans awaiting export are dropped; at most
+// maxExportedSpans are sent in a single export request.
+const (
+	maxQueuedSpans   = 4096
+	maxExportedSpans = 512
+)
+
+// tracingExportTimeout limits each export request.
+const tracingExportTimeout = 10 * time.Second
+
+// traceContextPropagator reads and writes traceparent and tracestate
+// headers.
+var traceContextPropagator = propagation.TraceContext{}
+
+// span times an operation within a trace: the decision of a request, or a
+// request sent to an upstream. Spans that aren't sampled are propagated to
+// upstreams but never exported. A nil *span is valid and does nothing, so
+// that callers need not check whether tracing is enabled. Its string
+// attributes and error are redacted by redactor.
+type span struct {
+	recorded trace.Span
+	redactor *logRedactor
+}
+
+type spanContextKey struct{}
+
+// withSpan returns a copy of ctx carrying span, the parent of the spans of
+// requests sent to upstreams on its behalf.
+func withSpan(ctx context.Context, span *span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+func spanFrom(ctx context.Context) *span {
+	span, _ := ctx.Value(spanContextKey{}).(*span)
+	return span
+}
+
+// child starts a span of kind within the trace of parent.
+func (parent *span) child(name string, kind trace.SpanKind) *span {
+	_, recorded := parent.recorded.TracerProvider().Tracer(tracerName,
+		trace.WithInstrumentationVersion(version)).Start(
+		trace.ContextWithSpan(context.Background(), parent.recorded),
+		name, trace.WithSpanKind(kind))
+	return &span{recorded, parent.redactor}
+}
+
+func (span *span) setString(key, value string) {
+	if span != nil {
+		span.recorded.SetAttributes(
+			attribute.String(key, span.redactor.text(value)))
+	}
+}
+
+func (span *span) setInt(key string, value int) {
+	if span != nil {
+		span.recorded.SetAttributes(attribute.Int(key, value))
+	}
+}
+
+// fail marks the span as failed for reason.
+func (span *span) fail(reason string) {
+	if span != nil {
+		span.recorded.SetStatus(codes.Error, span.redactor.text(reason))
+	}
+}
+
+// end completes the span, queuing it for export if it is sampled.
+func (span *span) end() {
+	if span != nil {
+		span.recorded.End()
+	}
+}
+
+// inject sets the traceparent and tracestate headers of header to propagate
+// the trace to an upstream, naming span as the parent.
+func (span *span) inject(header http.Header) {
+	traceContextPropagator.Inject(
+		trace.ContextWithSpan(context.Background(), span.recorded),
+		propagation.HeaderCarrier(header))
+}
+
+// tracer starts a span for each decision, which continues the trace of the
+// request's traceparent header, if any, or else starts a new trace. The
+// spans are sampled and sent as config specifies by the exporter of the
+// delegate, which swapRoutes configures when the tracer's routing table
+// takes effect.
+type tracer struct {
+	config *AuthDelegateTracing
+}
+
+// newTracer returns nil unless opts enables tracing.
+func newTracer(opts *AuthDelegateOptions) *tracer {
+	if opts.Tracing == nil {
+		return nil
+	}
+	return &tracer{opts.Tracing}
+}
+
+// exportConfig returns the configuration of the exporter of the spans of
+// tracer, or nil if tracing is disabled.
+func (tracer *tracer) exportConfig() *AuthDelegateTracing {
+	if tracer == nil {
+		return nil
+	}
+	return tracer.config
+}
+
+// start returns the server span of the decision of req, to be sent by
+// exporter, or nil if tracing is disabled. Its attributes are redacted by
+// redactor.
+func (tracer *tracer) start(req *http.Request, exporter *spanExporter,
+	redactor *logRedactor) *span {
+	if tracer == nil {
+		return nil
+	}
+	ctx := traceContextPropagator.Extract(context.Background(),
+		propagation.HeaderCarrier(req.Header))
+	_, recorded := exporter.tracer().Start(ctx, req.Method,
+		trace.WithSpanKind(trace.SpanKindServer))
+	span := &span{recorded, redactor}
+	span.setString("http.request.method", req.Method)
+	span.setString("url.path", pathPrefix(originalURI(req), 0))
+	span.setString("server.address", requestHost(req))
+	span.setString("client.address", clientIP(req))
+	return span
+}
+
+// endDecision completes the server span of a decision with the status of its
+// response.
+func (span *span) endDecision(status int) {
+	if span == nil {
+		return
+	}
+	span.setInt("http.response.status_code", status)
+	span.setString("authdelegate.decision", decisionName(status))
+	if status >= 500 {
+		span.fail(http.StatusText(status))
+	}
+	span.end()
+}
+
+// tracingTransport records a client span for each request sent to an
+// upstream on behalf of a traced decision, and propagates it to the upstream
+// in the traceparent header.
+type tracingTransport struct {
+	http.RoundTripper
+}
+
+// newTracingTransport returns transport unchanged unless opts enables
+// tracing.
+func newTracingTransport(transport http.RoundTripper,
+	opts *AuthDelegateOptions) http.RoundTripper {
+	if opts.Tracing == nil {
+		return transport
+	}
+	return &tracingTransport{transport}
+}
+
+func (transport *tracingTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	parent := spanFrom(req.Context())
+	if parent == nil {
+		return transport.RoundTripper.RoundTrip(req)
+	}
+	span := parent.child(req.Method, trace.SpanKindClient)
+	defer span.end()
+	span.setString("http.request.method", req.Method)
+	span.setString("server.address", req.URL.Hostname())
+	span.setString("url.full", req.URL.Redacted())
+	traced := req.WithContext(req.Context())
+	traced.Header = req.Header.Clone()
+	span.inject(traced.Header)
+	res, err := transport.RoundTripper.RoundTrip(traced)
+	if err != nil {
+		span.fail(err.Error())
+		return nil, err
+	}
+	span.setInt("http.response.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		span.fail(http.StatusText(res.StatusCode))
+	}
+	return res, nil
+}
+
+// spanExporter sends completed spans to an OpenTelemetry collector in
+// batches, using the OpenTelemetry SDK's OTLP/HTTP exporter. The delegate
+// owns a single exporter, which outlives its routing tables: swapRoutes
+// configures it for the tracing options of each table that takes effect,
+// and serve flushes it on shutdown.
+type spanExporter struct {
+	// Guards config, which provider, holding the current
+	// *sdktrace.TracerProvider, implements; the provider is nil if
+	// tracing is disabled
+	mutex    sync.Mutex
+	config   *AuthDelegateTracing
+	provider atomic.Value
+
+	// Accessed atomically
+	exported int64
+	dropped  int64
+}
+
+func newSpanExporter() *spanExporter {
+	exporter := &spanExporter{}
+	exporter.provider.Store((*sdktrace.TracerProvider)(nil))
+	return exporter
+}
+
+// tracer returns the tracer of the current provider, which doesn't record
+// spans if tracing is disabled.
+func (exporter *spanExporter) tracer() trace.Tracer {
+	var provider trace.TracerProvider = noop.NewTracerProvider()
+	current := exporter.provider.Load().(*sdktrace.TracerProvider)
+	if current != nil {
+		provider = current
+	}
+	return provider.Tracer(tracerName,
+		trace.WithInstrumentationVersion(version))
+}
+
+// configure replaces the current provider, if any, with one that samples and
+// sends spans as config specifies, or with none if config is nil. The spans
+// of the previous provider that have ended are sent before configure
+// returns; those that end later are dropped.
+func (exporter *spanExporter) configure(config *AuthDelegateTracing) {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	if config == exporter.config {
+		return
+	}
+	exporter.config = config
+	var provider *sdktrace.TracerProvider
+	if config != nil {
+		provider = exporter.newProvider(config)
+	}
+	previous := exporter.provider.Swap(provider).(*sdktrace.TracerProvider)
+	if previous != nil {
+		if err := previous.Shutdown(context.Background()); err != nil {
+			log.Printf("tracing: %s", err)
+		}
+	}
+}
+
+// shutdown stops exporting, and waits until the spans ended have been sent.
+func (exporter *spanExporter) shutdown() {
+	exporter.configure(nil)
+}
+
+func (exporter *spanExporter) newProvider(
+	config *AuthDelegateTracing) *sdktrace.TracerProvider {
+	client, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(config.OTLPEndpoint),
+		otlptracehttp.WithHeaders(config.OTLPHeaders),
+		otlptracehttp.WithTimeout(tracingExportTimeout),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{}))
+	if err != nil {
+		log.Printf("tracing: %s; not exporting spans", err)
+		return nil
+	}
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingServiceName
+	}
+	ratio := 1.0
+	if config.SampleRatio != nil {
+		ratio = *config.SampleRatio
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(&countingSpanExporter{client, exporter},
+			sdktrace.WithBatchTimeout(config.exportInterval),
+			sdktrace.WithMaxQueueSize(maxQueuedSpans),
+			sdktrace.WithMaxExportBatchSize(maxExportedSpans)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(ratio))))
+}
+
+// countingSpanExporter counts the spans that its SpanExporter sends, and
+// those it fails to send, in the counters of exporter.
+type countingSpanExporter struct {
+	sdktrace.SpanExporter
+	exporter *spanExporter
+}
+
+func (counting *countingSpanExporter) ExportSpans(ctx context.Context,
+	spans []sdktrace.ReadOnlySpan) error {
+	err := counting.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil {
+		atomic.AddInt64(&counting.exporter.dropped, int64(len(spans)))
+		return err
+	}
+	atomic.AddInt64(&counting.exporter.exported, int64(len(spans)))
+	return nil
+}
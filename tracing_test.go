@@ -0,0 +1,232 @@
+package authdelegate
+
+import (
+	"context"
+	"encoding/hex"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var _ = Describe("Tracing", func() {
+	var upstream, collector *httptest.Server
+	var mutex sync.Mutex
+	var received []string
+	var exported []*tracepb.Span
+	var opts *AuthDelegateOptions
+
+	BeforeEach(func() {
+		received, exported = nil, nil
+		upstream = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				mutex.Lock()
+				received = append(received,
+					req.Header.Get("Traceparent"))
+				mutex.Unlock()
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		collector = httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				defer GinkgoRecover()
+				Expect(req.Header.Get("Authorization")).To(
+					Equal("Bearer collector-token"))
+				body, err := ioutil.ReadAll(req.Body)
+				Expect(err).To(BeNil())
+				var traces coltracepb.ExportTraceServiceRequest
+				Expect(proto.Unmarshal(body, &traces)).To(Succeed())
+				resource := traces.ResourceSpans[0]
+				Expect(resource.Resource.Attributes[0].Value.
+					GetStringValue()).To(Equal("authdelegate"))
+				mutex.Lock()
+				exported = append(exported,
+					resource.ScopeSpans[0].Spans...)
+				mutex.Unlock()
+			}))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{
+					Name: "session",
+					URL:  upstream.URL,
+				},
+			},
+			Tracing: &AuthDelegateTracing{
+				OTLPEndpoint: collector.URL + "/v1/traces",
+				OTLPHeaders: map[string]string{
+					"Authorization": "Bearer collector-token",
+				},
+				ExportInterval: "10ms",
+			},
+		}
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+		collector.Close()
+	})
+
+	authorize := func(handler http.Handler, traceparent string) int {
+		req, _ := http.NewRequest("GET", "http://delegate/", nil)
+		req.Header.Set("X-Original-URI", "/app?page=2")
+		if traceparent != "" {
+			req.Header.Set("Traceparent", traceparent)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+
+	exportedSpans := func() []*tracepb.Span {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]*tracepb.Span(nil), exported...)
+	}
+
+	attribute := func(span *tracepb.Span, key string) string {
+		for _, attribute := range span.Attributes {
+			if attribute.Key != key {
+				continue
+			}
+			value := attribute.Value.Value
+			if integer, ok := value.(*commonpb.AnyValue_IntValue); ok {
+				return strconv.FormatInt(integer.IntValue, 10)
+			}
+			return attribute.Value.GetStringValue()
+		}
+		return ""
+	}
+
+	id := func(id []byte) string {
+		return hex.EncodeToString(id)
+	}
+
+	It("should continue the caller's trace to the upstream", func() {
+		opts.MetricsPath = "/metrics"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+
+			"00f067aa0ba902b7-01")).To(Equal(http.StatusAccepted))
+		Eventually(exportedSpans).Should(HaveLen(2))
+
+		spans := exportedSpans()
+		client, server := spans[0], spans[1]
+		Expect(server.Kind).To(Equal(tracepb.Span_SPAN_KIND_SERVER))
+		Expect(id(server.TraceId)).To(Equal(
+			"4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(id(server.ParentSpanId)).To(Equal("00f067aa0ba902b7"))
+		Expect(attribute(server, "url.path")).To(Equal("/app"))
+		Expect(attribute(server, "authdelegate.upstream")).To(
+			Equal("session"))
+		Expect(attribute(server, "authdelegate.decision")).To(
+			Equal("allow"))
+		Expect(attribute(server, "http.response.status_code")).To(
+			Equal("202"))
+
+		Expect(client.Kind).To(Equal(tracepb.Span_SPAN_KIND_CLIENT))
+		Expect(client.TraceId).To(Equal(server.TraceId))
+		Expect(client.ParentSpanId).To(Equal(server.SpanId))
+		Expect(received).To(Equal([]string{
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-" + id(client.SpanId) +
+				"-01",
+		}))
+
+		metrics := func() string {
+			req, _ := http.NewRequest("GET", "http://delegate/metrics",
+				nil)
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder.Body.String()
+		}
+		Eventually(metrics).Should(ContainSubstring(
+			"authdelegate_trace_spans_exported_total 2"))
+	})
+
+	It("should propagate but not export unsampled traces", func() {
+		ratio := 0.0
+		opts.Tracing.SampleRatio = &ratio
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "")).To(Equal(http.StatusAccepted))
+		Expect(authorize(handler, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+
+			"00f067aa0ba902b7-00")).To(Equal(http.StatusAccepted))
+		Expect(received).To(HaveLen(2))
+		for _, traceparent := range received {
+			parent := trace.SpanContextFromContext(
+				traceContextPropagator.Extract(context.Background(),
+					propagation.HeaderCarrier{
+						"Traceparent": {traceparent},
+					}))
+			Expect(parent.IsValid()).To(BeTrue())
+			Expect(parent.IsSampled()).To(BeFalse())
+		}
+		Expect(received[1]).To(HavePrefix(
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-"))
+		Consistently(exportedSpans, "50ms").Should(BeEmpty())
+	})
+
+	It("should send queued spans when tracing is reconfigured", func() {
+		opts.Tracing.ExportInterval = "1h"
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts).(*authDelegateHandler)
+		Expect(authorize(handler, "")).To(Equal(http.StatusAccepted))
+		Consistently(exportedSpans, "50ms").Should(BeEmpty())
+
+		untraced := *opts
+		untraced.Tracing = nil
+		handler.swapRoutes(newRoutingTable(&untraced))
+		Eventually(exportedSpans).Should(HaveLen(2))
+		Expect(authorize(handler, "")).To(Equal(http.StatusAccepted))
+
+		handler.swapRoutes(newRoutingTable(opts))
+		Expect(authorize(handler, "")).To(Equal(http.StatusAccepted))
+		handler.exporter.shutdown()
+		Expect(exportedSpans()).To(HaveLen(4))
+	})
+
+	It("should start a new trace for an invalid traceparent", func() {
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		Expect(authorize(handler, "00-4BF92F3577B34DA6A3CE929D0E0E4736-"+
+			"00F067AA0BA902B7-01")).To(Equal(http.StatusAccepted))
+		Eventually(exportedSpans).Should(HaveLen(2))
+
+		server := exportedSpans()[1]
+		Expect(id(server.TraceId)).ToNot(Equal(
+			"4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(server.ParentSpanId).To(BeEmpty())
+	})
+
+	It("should fail validation for invalid settings", func() {
+		ratio := 1.5
+		opts.Tracing = &AuthDelegateTracing{
+			OTLPEndpoint: "collector:4318",
+			OTLPHeaders: map[string]string{
+				"Bad Name": "x",
+				"X-Token":  "a\r\nb",
+			},
+			SampleRatio:    &ratio,
+			ExportInterval: "0s",
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"tracing otlp_endpoint must be an http or https URL: " +
+				"collector:4318",
+			"invalid tracing otlp_headers name: Bad Name",
+			"invalid tracing otlp_headers value: X-Token",
+			"tracing sample_ratio must be between 0 and 1: 1.5",
+			"tracing export_interval must be positive",
+		})))
+	})
+})
@@ -0,0 +1,81 @@
+package authdelegate
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Traffic classes of requests: those from people using browsers, and those
+// from other services.
+const (
+	trafficHuman   = "human"
+	trafficService = "service"
+)
+
+// trafficClassifier determines the traffic class of a request: from the value
+// of header, if valid; else service traffic if the User-Agent contains one of
+// serviceUserAgents; else human traffic if the request was made by a browser.
+type trafficClassifier struct {
+	header            string
+	serviceUserAgents []string
+}
+
+func newTrafficClassifier(opts *AuthDelegateOptions) *trafficClassifier {
+	classifier := &trafficClassifier{
+		serviceUserAgents: opts.ServiceUserAgents,
+	}
+	if opts.TrafficClassHeader != "" {
+		classifier.header = http.CanonicalHeaderKey(
+			opts.TrafficClassHeader)
+	}
+	return classifier
+}
+
+// classify returns the traffic class of req. Does not allocate, as it may be
+// called for every upstream evaluated against every request.
+func (classifier *trafficClassifier) classify(req *http.Request) string {
+	if classifier.header != "" {
+		switch class, _ := headerValue(req.Header,
+			classifier.header); class {
+		case trafficHuman, trafficService:
+			return class
+		}
+	}
+	userAgent, _ := headerValue(req.Header, "User-Agent")
+	for _, service := range classifier.serviceUserAgents {
+		if strings.Contains(userAgent, service) {
+			return trafficService
+		}
+	}
+	// Browsers send the Fetch Metadata headers, and all of them begin their
+	// User-Agent with "Mozilla/" for historical reasons.
+	if _, ok := headerValue(req.Header, "Sec-Fetch-Mode"); ok {
+		return trafficHuman
+	} else if strings.HasPrefix(userAgent, "Mozilla/") {
+		return trafficHuman
+	}
+	return trafficService
+}
+
+// trafficCounts reports the number of requests of each traffic class routed
+// to an upstream.
+type trafficCounts struct {
+	Human   int64 `json:"human"`
+	Service int64 `json:"service"`
+}
+
+func (delegate *authDelegate) countTraffic(class string) {
+	if class == trafficHuman {
+		atomic.AddInt64(&delegate.humanRequests, 1)
+	} else {
+		atomic.AddInt64(&delegate.serviceRequests, 1)
+	}
+}
+
+func (delegate *authDelegate) trafficCounts() trafficCounts {
+	return trafficCounts{
+		Human:   atomic.LoadInt64(&delegate.humanRequests),
+		Service: atomic.LoadInt64(&delegate.serviceRequests),
+	}
+}
@@ -0,0 +1,109 @@
+package authdelegate
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("Traffic classification", func() {
+	const browserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) " +
+		"Gecko/20100101 Firefox/120.0"
+	var req *http.Request
+	var classifier *trafficClassifier
+
+	BeforeEach(func() {
+		req, _ = http.NewRequest("GET", "http://delegate/", nil)
+		classifier = newTrafficClassifier(&AuthDelegateOptions{
+			TrafficClassHeader: "x-auth-traffic",
+			ServiceUserAgents:  []string{"kube-probe/"},
+		})
+	})
+
+	It("should classify browser requests as human", func() {
+		req.Header.Set("User-Agent", browserAgent)
+		Expect(classifier.classify(req)).To(Equal(trafficHuman))
+		req.Header.Set("User-Agent", "")
+		req.Header.Set("Sec-Fetch-Mode", "navigate")
+		Expect(classifier.classify(req)).To(Equal(trafficHuman))
+	})
+
+	It("should classify other requests as service", func() {
+		Expect(classifier.classify(req)).To(Equal(trafficService))
+		req.Header.Set("User-Agent", "Go-http-client/1.1")
+		Expect(classifier.classify(req)).To(Equal(trafficService))
+	})
+
+	It("should classify configured user agents as service", func() {
+		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; "+
+			"kube-probe/1.28)")
+		Expect(classifier.classify(req)).To(Equal(trafficService))
+	})
+
+	It("should honor a valid traffic class header", func() {
+		req.Header.Set("User-Agent", browserAgent)
+		req.Header.Set("X-Auth-Traffic", "service")
+		Expect(classifier.classify(req)).To(Equal(trafficService))
+		req.Header.Set("X-Auth-Traffic", "robot")
+		Expect(classifier.classify(req)).To(Equal(trafficHuman))
+	})
+
+	It("should route each traffic class to its upstream", func() {
+		newServer := func(status int) *httptest.Server {
+			return httptest.NewServer(http.HandlerFunc(
+				func(rw http.ResponseWriter, r *http.Request) {
+					rw.WriteHeader(status)
+				}))
+		}
+		sso := newServer(http.StatusAccepted)
+		defer sso.Close()
+		tokens := newServer(http.StatusNoContent)
+		defer tokens.Close()
+		opts := &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				{Name: "sso", URL: sso.URL, Traffic: "human"},
+				{Name: "tokens", URL: tokens.URL,
+					Traffic: "service"},
+			},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		delegate := NewAuthDelegate(opts)
+
+		recorder := httptest.NewRecorder()
+		req.Header.Set("User-Agent", browserAgent)
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+
+		recorder = httptest.NewRecorder()
+		req.Header.Set("User-Agent", "curl/8.4.0")
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusNoContent))
+
+		table := delegate.(*authDelegateHandler).routes()
+		Expect(table.upstreams[0].trafficCounts()).To(Equal(
+			trafficCounts{Human: 1}))
+		Expect(table.upstreams[1].trafficCounts()).To(Equal(
+			trafficCounts{Service: 1}))
+		Expect(table.upstreams[0].explain(req)).
+			To(Equal("service traffic"))
+	})
+
+	It("should fail validation for invalid classification options", func() {
+		opts := &AuthDelegateOptions{
+			Port:              8080,
+			ServiceUserAgents: []string{""},
+			Upstreams: []*AuthDelegateUpstream{{
+				URL:     "http://localhost",
+				Traffic: "robot",
+			}},
+		}
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid traffic for http://localhost: robot",
+			"service_user_agents must not contain an empty string",
+		})))
+	})
+})
@@ -0,0 +1,155 @@
+package authdelegate
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// Values of an upstream's protocol option
+const (
+	protocolHTTP1 = "http/1.1"
+	protocolHTTP2 = "h2"
+)
+
+// newUpstreamTransport creates a http.Transport with the default transport's
+// settings, modified per the options of upstream.
+func newUpstreamTransport(upstream *AuthDelegateUpstream) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if upstream.ExpectContinueTimeout != "" {
+		transport.ExpectContinueTimeout = upstream.expectContinueTimeout
+	}
+	switch upstream.Protocol {
+	case protocolHTTP1:
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	case protocolHTTP2:
+		transport.Protocols = new(http.Protocols)
+		if upstream.parsedURL.Scheme == "https" {
+			transport.Protocols.SetHTTP2(true)
+		} else {
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+	if upstream.clientCertificate != nil || upstream.clientCAs != nil ||
+		upstream.SessionResumption {
+		transport.TLSClientConfig = &tls.Config{RootCAs: upstream.clientCAs}
+		if upstream.clientCertificate != nil {
+			transport.TLSClientConfig.Certificates =
+				[]tls.Certificate{*upstream.clientCertificate}
+		}
+		if upstream.SessionResumption {
+			transport.TLSClientConfig.ClientSessionCache =
+				tls.NewLRUClientSessionCache(0)
+		}
+	}
+	return transport
+}
+
+// timeoutTransport limits the time from the start of each request to an
+// upstream until its response body is closed.
+type timeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+}
+
+// newTimeoutTransport returns transport unchanged if timeout is zero.
+func newTimeoutTransport(transport http.RoundTripper,
+	timeout time.Duration) http.RoundTripper {
+	if timeout == 0 {
+		return transport
+	}
+	return &timeoutTransport{transport, timeout}
+}
+
+func (transport *timeoutTransport) RoundTrip(
+	req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), transport.timeout)
+	res, err := transport.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelingBody{res.Body, cancel}
+	return res, nil
+}
+
+// cancelingBody releases the context of a request when its response body is
+// closed.
+type cancelingBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelingBody) Close() error {
+	defer body.cancel()
+	return body.ReadCloser.Close()
+}
+
+// maxBufferedRequestBody is the largest request body of unknown length that
+// is buffered for an upstream with DisableChunkedRequests.
+const maxBufferedRequestBody = 1 << 20
+
+// bufferingHandler reads request bodies of unknown length into memory before
+// passing requests to handler, so they will be sent with a Content-Length
+// header instead of using chunked transfer encoding, for upstreams that stall
+// on chunked requests. Requests whose bodies are too large, or can't be read,
+// fail with ErrRequestBodyTooLarge or ErrInvalidRequestBody.
+type bufferingHandler struct {
+	upstream     string
+	handler      http.Handler
+	errorHandler ErrorHandler
+}
+
+func newBufferingHandler(upstream *AuthDelegateUpstream,
+	opts *AuthDelegateOptions, handler http.Handler) *bufferingHandler {
+	return &bufferingHandler{
+		upstream:     upstreamLabel(upstream),
+		handler:      handler,
+		errorHandler: opts.errorHandler(),
+	}
+}
+
+func (buffering *bufferingHandler) ServeHTTP(
+	rw http.ResponseWriter, req *http.Request) {
+	if err := bufferRequestBody(rw, req); err != nil {
+		code := ErrInvalidRequestBody
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = ErrRequestBodyTooLarge
+		}
+		buffering.errorHandler(rw, req, &DelegateError{
+			Code: code, Upstream: buffering.upstream, Cause: err,
+		})
+		return
+	}
+	buffering.handler.ServeHTTP(rw, req)
+}
+
+// bufferRequestBody replaces a request body of unknown length with a copy in
+// memory of up to maxBufferedRequestBody bytes, returning any error reading
+// it.
+func bufferRequestBody(rw http.ResponseWriter, req *http.Request) error {
+	if req.Body == nil || req.ContentLength >= 0 {
+		return nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body,
+		maxBufferedRequestBody))
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	} else {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	req.TransferEncoding = nil
+	return nil
+}
@@ -0,0 +1,314 @@
+package authdelegate
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing/iotest"
+	"time"
+)
+
+var _ = Describe("Upstream transport options", func() {
+	var server *httptest.Server
+	var opts *AuthDelegateOptions
+	var transferEncoding []string
+	var contentLength int64
+	var body string
+	var resumed bool
+	var proto string
+
+	BeforeEach(func() {
+		handler := func(rw http.ResponseWriter, req *http.Request) {
+			transferEncoding = req.TransferEncoding
+			contentLength = req.ContentLength
+			bodyBytes, _ := ioutil.ReadAll(req.Body)
+			body = string(bodyBytes)
+			resumed = req.TLS != nil && req.TLS.DidResume
+			proto = req.Proto
+			rw.WriteHeader(http.StatusAccepted)
+		}
+		server = httptest.NewServer(http.HandlerFunc(handler))
+		opts = &AuthDelegateOptions{
+			Port: 8080,
+			Upstreams: []*AuthDelegateUpstream{
+				&AuthDelegateUpstream{URL: server.URL},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	serveChunked := func() {
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("POST", "http://foo.com/",
+			ioutil.NopCloser(strings.NewReader("foobar")))
+		req.ContentLength = -1
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(body).To(Equal("foobar"))
+	}
+
+	It("should forward bodies of unknown length as chunked by default",
+		func() {
+			serveChunked()
+			Expect(transferEncoding).To(Equal([]string{"chunked"}))
+		})
+
+	It("should buffer bodies of unknown length if configured", func() {
+		opts.Upstreams[0].DisableChunkedRequests = true
+		serveChunked()
+		Expect(transferEncoding).To(BeNil())
+		Expect(contentLength).To(Equal(int64(6)))
+	})
+
+	It("should refuse bodies too large or unreadable to buffer", func() {
+		opts.Upstreams[0].DisableChunkedRequests = true
+		Expect(opts.Validate()).To(BeNil())
+		handler := NewAuthDelegate(opts)
+		serve := func(body io.Reader) int {
+			req, _ := http.NewRequest("POST", "http://foo.com/",
+				ioutil.NopCloser(body))
+			req.ContentLength = -1
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+		body = ""
+		Expect(serve(strings.NewReader(strings.Repeat("x",
+			maxBufferedRequestBody+1)))).To(
+			Equal(http.StatusRequestEntityTooLarge))
+		Expect(serve(io.MultiReader(strings.NewReader("foo"),
+			iotest.ErrReader(errors.New("reset"))))).To(
+			Equal(http.StatusBadRequest))
+		Expect(body).To(BeEmpty())
+		Expect(serve(strings.NewReader(strings.Repeat("x",
+			maxBufferedRequestBody)))).To(Equal(http.StatusAccepted))
+		Expect(body).To(HaveLen(maxBufferedRequestBody))
+	})
+
+	It("should set the expect-continue timeout if configured", func() {
+		opts.Upstreams[0].ExpectContinueTimeout = "250ms"
+		Expect(opts.Validate()).To(BeNil())
+		transport := newUpstreamTransport(opts.Upstreams[0])
+		Expect(transport.ExpectContinueTimeout).To(
+			Equal(250 * time.Millisecond))
+	})
+
+	It("should keep the default expect-continue timeout", func() {
+		Expect(opts.Validate()).To(BeNil())
+		transport := newUpstreamTransport(opts.Upstreams[0])
+		Expect(transport.ExpectContinueTimeout).To(Equal(
+			http.DefaultTransport.(*http.Transport).ExpectContinueTimeout))
+	})
+
+	It("should return Gateway Timeout if an upstream is too slow", func() {
+		slow := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				select {
+				case <-req.Context().Done():
+				case <-time.After(time.Second):
+				}
+				rw.WriteHeader(http.StatusAccepted)
+			}))
+		defer slow.Close()
+		opts.DefaultTimeout = "20ms"
+		opts.Upstreams = []*AuthDelegateUpstream{
+			&AuthDelegateUpstream{
+				URL:        server.URL,
+				HeaderName: "X-Fast",
+				Timeout:    "1s",
+			},
+			&AuthDelegateUpstream{URL: slow.URL},
+		}
+		Expect(opts.Validate()).To(BeNil())
+		Expect(opts.Upstreams[0].timeout).To(Equal(time.Second))
+		Expect(opts.Upstreams[1].timeout).To(
+			Equal(20 * time.Millisecond))
+		delegate := NewAuthDelegate(opts)
+
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		recorder := httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusGatewayTimeout))
+
+		req.Header.Set("X-Fast", "yes")
+		recorder = httptest.NewRecorder()
+		delegate.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	})
+
+	It("should fail validation if a timeout is malformed", func() {
+		opts.DefaultTimeout = "0s"
+		opts.Upstreams[0].Timeout = "-1s"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"timeout for " + server.URL + " must not be negative: -1s",
+			"default_timeout must be positive",
+		})))
+	})
+
+	It("should fail validation if a duration is malformed", func() {
+		opts.Upstreams[0].ExpectContinueTimeout = "forever"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"invalid expect_continue_timeout for " + server.URL +
+				": forever",
+		})))
+	})
+
+	It("should use HTTP/2 with prior knowledge if pinned to h2", func() {
+		h2cServer := httptest.NewUnstartedServer(server.Config.Handler)
+		h2cServer.Config.Protocols = new(http.Protocols)
+		h2cServer.Config.Protocols.SetHTTP1(true)
+		h2cServer.Config.Protocols.SetUnencryptedHTTP2(true)
+		h2cServer.Start()
+		defer h2cServer.Close()
+		opts.Upstreams[0].URL = h2cServer.URL
+		opts.Upstreams[0].Protocol = "h2"
+		Expect(opts.Validate()).To(BeNil())
+		req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+		recorder := httptest.NewRecorder()
+		NewAuthDelegate(opts).ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusAccepted))
+		Expect(proto).To(Equal("HTTP/2.0"))
+	})
+
+	It("should fail validation if the protocol is unknown", func() {
+		opts.Upstreams[0].Protocol = "h3"
+		err := opts.Validate()
+		Expect(err).ToNot(BeNil())
+		Expect(err.Error()).To(Equal(optionErrors([]string{
+			"protocol must be http/1.1 or h2 for " + server.URL + ": h3",
+		})))
+	})
+
+	Context("with mutual TLS", func() {
+		var dir string
+		var cert *testCertificate
+		var tlsServer *httptest.Server
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "transport")
+			Expect(err).To(BeNil())
+			cert = writeTestCertificate(dir, "upstream", time.Hour)
+			keyPair, err := tls.LoadX509KeyPair(cert.CertFile,
+				cert.KeyFile)
+			Expect(err).To(BeNil())
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(cert.Cert)
+			tlsServer = httptest.NewUnstartedServer(server.Config.Handler)
+			tlsServer.EnableHTTP2 = true
+			tlsServer.TLS = &tls.Config{
+				Certificates: []tls.Certificate{keyPair},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			}
+			tlsServer.StartTLS()
+			opts.Upstreams[0].URL = tlsServer.URL
+			opts.Upstreams[0].ClientCA = cert.CertFile
+		})
+
+		AfterEach(func() {
+			tlsServer.Close()
+			os.RemoveAll(dir)
+		})
+
+		status := func() int {
+			Expect(opts.Validate()).To(BeNil())
+			req, _ := http.NewRequest("GET", "http://foo.com/", nil)
+			recorder := httptest.NewRecorder()
+			NewAuthDelegate(opts).ServeHTTP(recorder, req)
+			return recorder.Code
+		}
+
+		It("should present the client certificate", func() {
+			opts.Upstreams[0].ClientCert = cert.CertFile
+			opts.Upstreams[0].ClientKey = cert.KeyFile
+			Expect(status()).To(Equal(http.StatusAccepted))
+		})
+
+		It("should fail without a client certificate", func() {
+			Expect(status()).To(Equal(http.StatusBadGateway))
+		})
+
+		It("should resume TLS sessions only if configured", func() {
+			opts.Upstreams[0].ClientCert = cert.CertFile
+			opts.Upstreams[0].ClientKey = cert.KeyFile
+			get := func() bool {
+				Expect(opts.Validate()).To(BeNil())
+				transport := newUpstreamTransport(opts.Upstreams[0])
+				transport.DisableKeepAlives = true
+				client := &http.Client{Transport: transport}
+				for i := 0; i != 2; i++ {
+					resp, err := client.Get(tlsServer.URL)
+					Expect(err).To(BeNil())
+					resp.Body.Close()
+				}
+				return resumed
+			}
+			Expect(get()).To(BeFalse())
+			opts.Upstreams[0].SessionResumption = true
+			Expect(get()).To(BeTrue())
+		})
+
+		It("should negotiate HTTP/2 unless pinned to HTTP/1.1", func() {
+			opts.Upstreams[0].ClientCert = cert.CertFile
+			opts.Upstreams[0].ClientKey = cert.KeyFile
+			Expect(status()).To(Equal(http.StatusAccepted))
+			Expect(proto).To(Equal("HTTP/2.0"))
+
+			opts.Upstreams[0].Protocol = "http/1.1"
+			Expect(status()).To(Equal(http.StatusAccepted))
+			Expect(proto).To(Equal("HTTP/1.1"))
+
+			opts.Upstreams[0].Protocol = "h2"
+			Expect(status()).To(Equal(http.StatusAccepted))
+			Expect(proto).To(Equal("HTTP/2.0"))
+		})
+
+		It("should fail validation for invalid TLS options", func() {
+			opts.Upstreams[0].URL = server.URL
+			opts.Upstreams[0].ClientCert = cert.CertFile
+			opts.Upstreams[0].ClientCA = cert.KeyFile
+			err := opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"client_cert, client_key, and client_ca require an " +
+					"https url: " + server.URL,
+				"client_cert and client_key must both be specified, " +
+					"or neither must be: " + server.URL,
+				"client_ca for " + server.URL + " contains no " +
+					"PEM-encoded certificates: " + cert.KeyFile,
+			})))
+		})
+
+		It("should fail validation for session options", func() {
+			opts.Upstreams[0].URL = server.URL
+			opts.Upstreams[0].ClientCA = ""
+			opts.Upstreams[0].SessionResumption = true
+			opts.Upstreams[0].EarlyData = true
+			err := opts.Validate()
+			Expect(err).ToNot(BeNil())
+			Expect(err.Error()).To(Equal(optionErrors([]string{
+				"early_data is not supported, since TLS 1.3 0-RTT " +
+					"data can be replayed: " + server.URL,
+				"session_resumption requires an https url: " +
+					server.URL,
+			})))
+		})
+	})
+})
@@ -0,0 +1,40 @@
+package authdelegate
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version identifies the release, and may be set at build time with:
+//
+//	go build -ldflags \
+//	    "-X github.com/18F/authdelegate.version=v1.2.3" \
+//	    ./cmd/authdelegate
+var version = "dev"
+
+type versionInfo struct {
+	Version    string `json:"version"`
+	GoVersion  string `json:"go_version"`
+	GoMaxProcs int    `json:"gomaxprocs"`
+	GoMemLimit int64  `json:"gomemlimit"`
+
+	// Fingerprint of the configuration in effect, if known
+	ConfigFingerprint string `json:"config_fingerprint,omitempty"`
+}
+
+func currentVersionInfo() versionInfo {
+	return versionInfo{
+		Version:    version,
+		GoVersion:  runtime.Version(),
+		GoMaxProcs: runtime.GOMAXPROCS(0),
+		GoMemLimit: debug.SetMemoryLimit(-1),
+	}
+}
+
+func (admin *adminHandler) serveVersion(
+	rw http.ResponseWriter, req *http.Request) {
+	info := currentVersionInfo()
+	info.ConfigFingerprint = admin.delegate.routes().fingerprint
+	writeJSON(rw, info)
+}